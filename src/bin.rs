@@ -1,36 +1,295 @@
 extern crate docopt;
 #[macro_use]
 extern crate iron;
+extern crate hyper;
+extern crate libc;
 extern crate bincode;
 extern crate router;
 extern crate persistent;
 extern crate rustc_serialize;
+extern crate rand;
+extern crate crypto;
 extern crate hammer;
 
 pub mod http;
 
+use std::fs::File;
+use std::io::{BufWriter, Write};
 use std::path::PathBuf;
+use std::process;
+
+use hammer::db::StorageBackend;
+use hammer::db::verify;
+use hammer::db::advise;
+use hammer::db::estimate;
+use hammer::db::generate;
+use hammer::db::generate::Generator;
 
 use docopt::Docopt;
+use rustc_serialize::Encodable;
 
 const USAGE: &'static str = "
 Hammer
 
 Usage:
-    hammerhttp [--data-dir=<path>] [--bind=<host:port>]
+    hammerhttp [--data-dir=<path>] [--bind=<host:port>] [--max-pending-writes=<n>] [--throttle-delay=<ms>] [--rerank=<cmd>] [--ingest-hook=<cmd>] [--scrub-interval=<s>] [--scrub-repair] [--shards=<n>] [--lock-free-reads] [--insert-workers=<n>] [--memstats-interval=<s>] [--dedup-window=<s>] [--debug-vars] [--max-response-bytes=<n>] [--sink=<spec>] [--sink-sync] [--sink-retries=<n>] [--reap-interval=<s>] [--cors-origins=<list>] [--cors-methods=<list>] [--cors-headers=<list>] [--admin-bind=<host:port>] [--take-over=<host:port>] [--upgrade-binary=<path>] [--resp-bind=<host:port>] [--slow-op-ms=<ms>] [--access-log=<path>] [--access-log-format=<fmt>] [--access-log-max-bytes=<n>] [--access-log-keep=<n>] [--config=<path>] [--namespace-concurrency=<n>] [--feed-writes] [--standby-of=<host:port>] [--promote-after=<s>] [--epoch=<n>] [--auth-tokens=<path>] [--auth-command=<cmd>] [--capture=<path>] [--capture-rate=<r>] [--shadow=<host:port>] [--shadow-rate=<r>] [--shadow-diffs=<path>] [--shard-map=<path>] [--usage-interval=<s>] [--usage-webhook=<url>] [--encryption-key=<path>]
+    hammerhttp dedup-report --namespace=<ns> --tolerance=<n> [--bits=<n>] [--server=<host:port>] [--output=<path>]
+    hammerhttp verify --tolerance=<n> [--bits=<n>] [--seed=<n>] [--ops=<n>]
+    hammerhttp advise --input=<path> [--bits=<n>] [--target-recall=<r>]
+    hammerhttp gen --count=<n> [--bits=<n>] [--cluster-size=<n>] [--noise=<n>] [--seed=<n>] [--output=<path> | --namespace=<ns> --tolerance=<n> [--server=<host:port>]]
+    hammerhttp replay --input=<path> [--server=<host:port>] [--speed=<x>]
+    hammerhttp diff <server-a> <server-b> --namespace=<ns> --tolerance=<n> [--bits=<n>] [--samples=<n>]
+    hammerhttp import --from=<url> --namespace=<ns> --tolerance=<n> [--bits=<n>] [--server=<host:port>] [--pattern=<glob>] [--field=<name>] [--format=<fmt>]
+    hammerhttp estimate --keys=<n> --tolerance=<n> [--bits=<n>] [--backend=<b>]
+    hammerhttp fsck --data-dir=<path> [--repair]
     hammerhttp (-h | --help)
 
 Options:
     --data-dir=<path>       If set, data will be persisted to the given path (if 
                             unset, data will be persisted to a temporary location)
     --bind=<host:port>      Host & port to bind to [default: localhost:3000]
+    --max-pending-writes=<n>
+                            Reject /add requests once more than this many are
+                            in flight (0 disables throttling) [default: 0]
+    --throttle-delay=<ms>   Retry-After given to throttled writes for each
+                            pending write over the limit [default: 10]
+    --rerank=<cmd>          Pass query results through this command before
+                            returning them (see README)
+    --ingest-hook=<cmd>     Pass /add values through this command before
+                            adding them (see README)
+    --scrub-interval=<s>    Check index consistency every <s> seconds (0
+                            disables checks) [default: 0]
+    --scrub-repair          Repair inconsistencies found by the checks
+    --shards=<n>            Split each binary DB into <n> independently locked
+                            shards, allowing concurrent writes [default: 1]
+    --lock-free-reads       Keep two copies of each binary DB, so queries
+                            don't wait for writes (see README)
+    --insert-workers=<n>    Threads used to compute the variants of values
+                            added by each /add request [default: 4]
+    --memstats-interval=<s> Log memory use every <s> seconds (0 disables
+                            logging) [default: 0]
+    --dedup-window=<s>      Drop values added again within <s> seconds of
+                            being added (0 disables) [default: 0]
+    --debug-vars            Count requests and time DB operations, reporting
+                            them at /debug/vars (expvar format)
+    --max-response-bytes=<n>
+                            Truncate query matches once a response holds
+                            about <n> bytes of them (0 is unlimited) [default: 0]
+    --sink=<spec>           Mirror accepted adds and deletes to a sink, either
+                            file:<path> or command:<cmd> (see README)
+    --sink-sync             Mirror writes before responding to them, rather
+                            than in the background
+    --sink-retries=<n>      Retries for writes the sink rejects [default: 3]
+    --reap-interval=<s>     Remove keys older than their DB's retention period
+                            every <s> seconds [default: 60]
+    --cors-origins=<list>   Allow cross-origin requests from these
+                            comma-separated origins (or * for any)
+    --cors-methods=<list>   Methods allowed in cross-origin requests
+                            [default: GET,POST,DELETE]
+    --cors-headers=<list>   Headers allowed in cross-origin requests
+                            [default: Content-Type]
+    --admin-bind=<host:port>
+                            Serve the admin endpoints (/metrics, /debug/vars,
+                            /admin/..., /chaos) on this address instead of
+                            --bind
+    --take-over=<host:port> Copy DBs from the server with admin endpoints at
+                            this address before serving (used by upgrades)
+    --upgrade-binary=<path> Binary started by POST /admin/upgrade (default:
+                            this server's own path)
+    --resp-bind=<host:port> Also accept Redis protocol (RESP) commands on this
+                            address (see README)
+    --slow-op-ms=<ms>       Log binary DB operations taking at least <ms>
+                            milliseconds (0 disables logging) [default: 0]
+    --access-log=<path>     Log each request to this file
+    --access-log-format=<fmt>
+                            Access log format: common, combined or json
+                            [default: common]
+    --access-log-max-bytes=<n>
+                            Rotate the access log once it reaches <n> bytes (0
+                            disables rotation) [default: 0]
+    --access-log-keep=<n>   Rotated access logs to keep [default: 5]
+    --config=<path>         Read reloadable settings from this JSON file, again
+                            on SIGHUP or POST /admin/reload (see README)
+    --namespace-concurrency=<n>
+                            Reject requests for a namespace while <n> are
+                            already being handled (0 is unlimited) [default: 0]
+    --feed-writes           Publish accepted adds and deletes to /changes (for
+                            standbys)
+    --standby-of=<host:port>
+                            Follow the primary with admin endpoints at this
+                            address, rejecting writes until promoted
+    --promote-after=<s>     Promote a standby once its primary has been
+                            unreachable for <s> seconds (0 disables)
+                            [default: 0]
+    --epoch=<n>             Leader epoch to start at; writes are rejected once
+                            a higher epoch is seen [default: 1]
+    --auth-tokens=<path>    Require a bearer token from this file, with data
+                            or admin scope, on every request (see README)
+    --auth-command=<cmd>    Require a bearer token accepted by this command,
+                            i.e. a JWT validator (see README)
+    --capture=<path>        Record add, query, any_match and delete requests
+                            to this file, for replays (see README)
+    --capture-rate=<r>      Fraction of requests recorded [default: 1.0]
+    --shadow=<host:port>    Mirror query and any_match requests to this
+                            server in the background, comparing its results
+                            (see README)
+    --shadow-rate=<r>       Fraction of queries mirrored [default: 0.1]
+    --shadow-diffs=<path>   Record queries whose results differ to this file
+    --shard-map=<path>      Serve the cluster's shard map from this file to
+                            shard-aware clients (see README)
+    --usage-interval=<s>    Record each namespace's requests and stored
+                            key-seconds every <s> seconds, for chargeback (0
+                            disables records) [default: 0]
+    --usage-webhook=<url>   POST each period's usage records to this URL
+    --encryption-key=<path> Encrypt dump archives and the state saved under
+                            --data-dir with the key in this file (see README)
     -h --help               Show this screen.
+
+dedup-report options:
+    --namespace=<ns>        Namespace of the binary DB to report on
+    --tolerance=<n>         Tolerance of the binary DB to report on
+    --bits=<n>              Bitsize of the binary DB to report on [default: 64]
+    --server=<host:port>    Server holding the DB [default: localhost:3000]
+    --output=<path>         Write the report to <path> rather than stdout
+
+verify options:
+    --seed=<n>              Seed for the random operations [default: 0]
+    --ops=<n>               Number of random operations [default: 10000]
+
+advise options:
+    --input=<path>          Sample of base64-encoded keys, one per line (at
+                            most the first 10,000 are used)
+    --target-recall=<r>     Fraction of near-duplicates the suggested
+                            tolerance should find [default: 0.99]
+
+gen options:
+    --count=<n>             Number of keys to generate, optionally suffixed
+                            with K or M (i.e. 1M)
+    --cluster-size=<n>      Average number of keys in each cluster of
+                            near-duplicates [default: 5]
+    --noise=<n>             Most bits a key differs from its cluster's center
+                            by [default: 3]
+
+    Keys are written as base64, one per line, unless --namespace is given, in
+    which case they're added to that binary DB on --server.
+
+replay options:
+    --speed=<x>             Replay this many times as fast as the requests
+                            were captured (0 is as fast as possible)
+                            [default: 1.0]
+
+    --input is a file written by --capture.
+
+diff options:
+    --samples=<n>           Keys to list from each side of the difference
+                            [default: 10]
+
+import options:
+    --from=<url>            Store to import from, either
+                            redis://[:password@]host[:port][/db] or
+                            elasticsearch://host[:port]/index
+    --pattern=<glob>        Redis keys to import [default: *]
+    --field=<name>          Hash field (Redis) or document field
+                            (Elasticsearch) holding the fingerprint
+    --format=<fmt>          How fingerprints are stored: base64, hex, decimal
+                            or raw [default: base64]
+
+estimate options:
+    --keys=<n>              Number of keys to estimate for, optionally
+                            suffixed with K or M (i.e. 1M)
+    --backend=<b>           Where the DB is kept: memory, or rocksdb to
+                            estimate its size on disk [default: memory]
+
+fsck options:
+    --repair                Rebuild missing index entries and remove dangling
+                            ones, rather than only reporting them
+
+    The server using --data-dir must be stopped first; a database it
+    still holds open stops the check, exiting with status 2.
 ";
 
 #[derive(Debug, RustcDecodable)]
 struct Args {
     flag_data_dir: Option<String>,
     flag_bind: String,
+    flag_max_pending_writes: usize,
+    flag_throttle_delay: u64,
+    flag_rerank: Option<String>,
+    flag_ingest_hook: Option<String>,
+    flag_scrub_interval: u64,
+    flag_scrub_repair: bool,
+    flag_shards: usize,
+    flag_lock_free_reads: bool,
+    flag_insert_workers: usize,
+    flag_memstats_interval: u64,
+    flag_dedup_window: u64,
+    flag_debug_vars: bool,
+    flag_max_response_bytes: usize,
+    flag_sink: Option<String>,
+    flag_sink_sync: bool,
+    flag_sink_retries: usize,
+    flag_reap_interval: u64,
+    flag_cors_origins: Option<String>,
+    flag_cors_methods: String,
+    flag_cors_headers: String,
+    flag_admin_bind: Option<String>,
+    flag_take_over: Option<String>,
+    flag_upgrade_binary: Option<String>,
+    flag_resp_bind: Option<String>,
+    flag_slow_op_ms: u64,
+    flag_access_log: Option<String>,
+    flag_access_log_format: String,
+    flag_access_log_max_bytes: u64,
+    flag_access_log_keep: usize,
+    flag_config: Option<String>,
+    flag_namespace_concurrency: usize,
+    flag_feed_writes: bool,
+    flag_standby_of: Option<String>,
+    flag_promote_after: u64,
+    flag_epoch: u64,
+    flag_auth_tokens: Option<String>,
+    flag_auth_command: Option<String>,
+    cmd_dedup_report: bool,
+    flag_namespace: String,
+    flag_tolerance: usize,
+    flag_bits: usize,
+    flag_server: String,
+    flag_output: Option<String>,
+    cmd_verify: bool,
+    flag_seed: u64,
+    flag_ops: usize,
+    cmd_advise: bool,
+    flag_input: String,
+    flag_target_recall: f64,
+    cmd_gen: bool,
+    flag_count: String,
+    flag_cluster_size: usize,
+    flag_noise: usize,
+    flag_capture: Option<String>,
+    flag_capture_rate: f64,
+    flag_shadow: Option<String>,
+    flag_shadow_rate: f64,
+    flag_shadow_diffs: Option<String>,
+    flag_shard_map: Option<String>,
+    flag_usage_interval: u64,
+    flag_usage_webhook: Option<String>,
+    flag_encryption_key: Option<String>,
+    cmd_replay: bool,
+    flag_speed: f64,
+    cmd_diff: bool,
+    arg_server_a: String,
+    arg_server_b: String,
+    flag_samples: usize,
+    cmd_import: bool,
+    flag_from: String,
+    flag_pattern: String,
+    flag_field: Option<String>,
+    flag_format: String,
+    cmd_estimate: bool,
+    flag_keys: String,
+    flag_backend: String,
+    cmd_fsck: bool,
+    flag_repair: bool,
 }
 
 pub fn main() {
@@ -38,10 +297,269 @@ pub fn main() {
         .and_then(|d| d.decode())
         .unwrap_or_else(|e| e.exit());
 
+    if args.cmd_dedup_report {
+        match http::dedup_report::run(&args.flag_server, args.flag_bits, args.flag_tolerance, &args.flag_namespace, args.flag_output.as_ref().map(|s| &s[..])) {
+            // The report may be on stdout
+            Ok(summary) => {
+                writeln!(std::io::stderr(), "{} duplicate pairs among {} values", summary.pairs, summary.values).unwrap();
+                process::exit(0);
+            },
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(1);
+            },
+        }
+    }
+
+    if args.cmd_verify {
+        let report = match args.flag_bits {
+            32 => verify::run::<u32>(args.flag_seed, args.flag_ops, args.flag_tolerance),
+            64 => verify::run::<u64>(args.flag_seed, args.flag_ops, args.flag_tolerance),
+            128 => verify::run::<[u64; 2]>(args.flag_seed, args.flag_ops, args.flag_tolerance),
+            256 => verify::run::<[u64; 4]>(args.flag_seed, args.flag_ops, args.flag_tolerance),
+            _ => {
+                writeln!(std::io::stderr(), "Unsupported bitsize {}", args.flag_bits).unwrap();
+                process::exit(1);
+            },
+        };
+
+        println!("{} inserts, {} removes, {} queries", report.inserts, report.removes, report.queries);
+        for failure in report.failures.iter() {
+            println!("FAIL {}", failure);
+        }
+        process::exit(match report.ok() { true => 0, false => 1 });
+    }
+
+    if args.cmd_advise {
+        let advice = match args.flag_bits {
+            32 => advise::load::<u32>(&args.flag_input).map(|sample| advise::advise(&sample, args.flag_target_recall)),
+            64 => advise::load::<u64>(&args.flag_input).map(|sample| advise::advise(&sample, args.flag_target_recall)),
+            128 => advise::load::<[u64; 2]>(&args.flag_input).map(|sample| advise::advise(&sample, args.flag_target_recall)),
+            256 => advise::load::<[u64; 4]>(&args.flag_input).map(|sample| advise::advise(&sample, args.flag_target_recall)),
+            _ => Err(format!("Unsupported bitsize {}", args.flag_bits)),
+        };
+
+        match advice {
+            Ok(advice) => {
+                print!("{}", advice);
+                process::exit(0);
+            },
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(1);
+            },
+        }
+    }
+
+    if args.cmd_gen {
+        let count = match generate::parse_count(&args.flag_count) {
+            Ok(n) => n,
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(1);
+            },
+        };
+
+        let (seed, size, noise) = (args.flag_seed, args.flag_cluster_size, args.flag_noise);
+        let result = match args.flag_bits {
+            32 => gen(&args, Generator::<u32>::new(seed, count, size, noise)),
+            64 => gen(&args, Generator::<u64>::new(seed, count, size, noise)),
+            128 => gen(&args, Generator::<[u64; 2]>::new(seed, count, size, noise)),
+            256 => gen(&args, Generator::<[u64; 4]>::new(seed, count, size, noise)),
+            _ => Err(format!("Unsupported bitsize {}", args.flag_bits)),
+        };
+
+        match result {
+            Ok(_) => process::exit(0),
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(1);
+            },
+        }
+    }
+
+    if args.cmd_replay {
+        let records = match http::replay::load(&args.flag_input) {
+            Ok(records) => records,
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(1);
+            },
+        };
+
+        let summary = http::replay::run(&args.flag_server, records, args.flag_speed);
+        print!("{}", summary);
+        process::exit(match summary.failed { 0 => 0, _ => 1 });
+    }
+
+    if args.cmd_diff {
+        match http::index_diff::run(&args.arg_server_a, &args.arg_server_b, args.flag_bits, args.flag_tolerance, &args.flag_namespace, args.flag_samples) {
+            Ok(diff) => {
+                print!("{}", diff);
+                process::exit(match diff.same() { true => 0, false => 1 });
+            },
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(2);
+            },
+        }
+    }
+
+    if args.cmd_import {
+        let result = http::import::Source::parse(&args.flag_from).and_then(|source| {
+            let format = try!(http::import::Format::parse(&args.flag_format));
+            let loader = http::loader::Loader::new(&args.flag_server, args.flag_bits, args.flag_tolerance, &args.flag_namespace);
+            http::import::run(&source, &args.flag_pattern, args.flag_field.as_ref().map(|s| &s[..]), format, args.flag_bits, loader)
+        });
+
+        match result {
+            Ok(summary) => {
+                println!("{} read, {} skipped, {} added, {} already present, {} rejected", summary.read, summary.skipped, summary.added, summary.exists, summary.errors);
+                match summary.first_skipped {
+                    Some(e) => println!("first skipped: {}", e),
+                    None => {},
+                }
+                process::exit(0);
+            },
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(1);
+            },
+        }
+    }
+
+    if args.cmd_estimate {
+        let result = generate::parse_count(&args.flag_keys).and_then(|keys| {
+            let backend = try!(estimate::Backend::parse(&args.flag_backend));
+            match args.flag_bits {
+                32 | 64 | 128 | 256 => Ok(estimate::estimate(args.flag_bits, args.flag_tolerance, keys, backend)),
+                _ => Err(format!("Unsupported bitsize {}", args.flag_bits)),
+            }
+        });
+
+        match result {
+            Ok(report) => {
+                print!("{}", report);
+                process::exit(0);
+            },
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(1);
+            },
+        }
+    }
+
+    if args.cmd_fsck {
+        let data_dir = PathBuf::from(args.flag_data_dir.clone().unwrap());
+        match http::fsck::run(&data_dir, args.flag_repair) {
+            Ok(fsck) => {
+                print!("{}", fsck);
+                process::exit(match fsck.ok() { true => 0, false => 1 });
+            },
+            Err(e) => {
+                writeln!(std::io::stderr(), "{}", e).unwrap();
+                process::exit(2);
+            },
+        }
+    }
+
+    if args.flag_capture_rate < 0.0 || args.flag_capture_rate > 1.0 {
+        println!("--capture-rate must be between 0 and 1");
+        process::exit(1);
+    }
+    if args.flag_shadow_rate < 0.0 || args.flag_shadow_rate > 1.0 {
+        println!("--shadow-rate must be between 0 and 1");
+        process::exit(1);
+    }
+
     let config = http::Config{
         data_dir: args.flag_data_dir.map(|d| PathBuf::from(d)),
         bind: args.flag_bind,
+        max_pending_writes: args.flag_max_pending_writes,
+        throttle_delay_ms: args.flag_throttle_delay,
+        rerank_command: args.flag_rerank,
+        ingest_hook_command: args.flag_ingest_hook,
+        scrub_interval_s: args.flag_scrub_interval,
+        scrub_repair: args.flag_scrub_repair,
+        shards: args.flag_shards,
+        lock_free_reads: args.flag_lock_free_reads,
+        insert_workers: args.flag_insert_workers,
+        memstats_interval_s: args.flag_memstats_interval,
+        dedup_window_s: args.flag_dedup_window,
+        debug_vars: args.flag_debug_vars,
+        max_response_bytes: args.flag_max_response_bytes,
+        sink: args.flag_sink,
+        sink_sync: args.flag_sink_sync,
+        sink_retries: args.flag_sink_retries,
+        reap_interval_s: args.flag_reap_interval,
+        cors_origins: args.flag_cors_origins,
+        cors_methods: args.flag_cors_methods,
+        cors_headers: args.flag_cors_headers,
+        admin_bind: args.flag_admin_bind,
+        take_over: args.flag_take_over,
+        upgrade_binary: args.flag_upgrade_binary,
+        resp_bind: args.flag_resp_bind,
+        slow_op_ms: args.flag_slow_op_ms,
+        access_log: args.flag_access_log,
+        access_log_format: args.flag_access_log_format,
+        access_log_max_bytes: args.flag_access_log_max_bytes,
+        access_log_keep: args.flag_access_log_keep,
+        config_file: args.flag_config,
+        namespace_concurrency: args.flag_namespace_concurrency,
+        feed_writes: args.flag_feed_writes,
+        standby_of: args.flag_standby_of,
+        promote_after_s: args.flag_promote_after,
+        epoch: args.flag_epoch,
+        auth_tokens: args.flag_auth_tokens,
+        auth_command: args.flag_auth_command,
+        capture: args.flag_capture,
+        capture_rate: args.flag_capture_rate,
+        shadow: args.flag_shadow,
+        shadow_rate: args.flag_shadow_rate,
+        shadow_diffs: args.flag_shadow_diffs,
+        shard_map: args.flag_shard_map,
+        usage_interval_s: args.flag_usage_interval,
+        usage_webhook: args.flag_usage_webhook,
+        encryption_key: args.flag_encryption_key,
     };
 
+    if config.data_dir.is_some() && !StorageBackend::rocksdb_available() {
+        println!("--data-dir requires RocksDB; rebuild with `--features rocksdb`");
+        process::exit(1);
+    }
+    if config.data_dir.is_some() && config.lock_free_reads {
+        println!("--lock-free-reads keeps DBs in memory, so can't be used with --data-dir");
+        process::exit(1);
+    }
+
     http::server::serve(config)
 }
+
+/// Writes the generated `keys` to `--output` (or stdout), or adds them to
+/// `--namespace` on `--server`
+///
+fn gen<T: Encodable, I: Iterator<Item=T>>(args: &Args, keys: I) -> Result<(), String> {
+    if !args.flag_namespace.is_empty() {
+        let summary = try!(http::loader::run(&args.flag_server, args.flag_bits, args.flag_tolerance, &args.flag_namespace, keys));
+        writeln!(std::io::stderr(), "{} added, {} already present, {} rejected", summary.added, summary.exists, summary.errors).unwrap();
+        return Ok(())
+    }
+
+    let mut out: Box<Write> = match args.flag_output {
+        Some(ref path) => match File::create(path) {
+            Ok(f) => Box::new(BufWriter::new(f)),
+            Err(e) => return Err(format!("unable to create '{}': {}", path, e)),
+        },
+        None => Box::new(BufWriter::new(std::io::stdout())),
+    };
+    for key in keys {
+        match writeln!(out, "{}", http::binary_handler::encode_value(&key)) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to write keys: {}", e)),
+        }
+    }
+    match out.flush() {
+        Ok(_) => Ok(()),
+        Err(e) => Err(format!("unable to write keys: {}", e)),
+    }
+}
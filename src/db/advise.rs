@@ -0,0 +1,431 @@
+//! Index advisor
+//!
+//! `advise` looks at a sample of keys and suggests a tolerance, along with
+//! the partitions, memory and query cost that tolerance would give.
+//!
+//! Unrelated keys are around half their bits apart, while near-duplicates
+//! are much closer.  From each bit's frequency in the sample, `advise` models
+//! the distance between unrelated keys, and takes a key's nearest neighbour
+//! in the sample as a near-duplicate if unrelated keys that close would be
+//! expected less than once in a hundred samples.  The suggested tolerance is
+//! the smallest which reaches `target_recall` of those nearest neighbours.
+//!
+//! Biased bits (mostly 0 or mostly 1) and correlated bits carry less
+//! information than their number suggests, so partitions made of them hold
+//! fewer distinct values, and queries have more candidates to verify.  Each
+//! partition's effective bits discount them; candidate estimates are for a
+//! million keys distributed like the sample, and memory estimates (see
+//! `estimate`) for a million keys held in memory; both are rough.
+
+use std::cmp::{max, min};
+use std::fmt;
+use std::fs::File;
+use std::io::{BufRead, BufReader};
+
+use bincode;
+use rustc_serialize::Decodable;
+use rustc_serialize::base64::FromBase64;
+
+use db::estimate;
+use db::estimate::Backend;
+use db::hamming::Hamming;
+use db::window;
+use db::window::Window;
+use hyperplane::FromBits;
+
+/// Most keys read from the sample, since every pair is compared
+pub const MAX_SAMPLE: usize = 10000;
+
+/// Bits whose frequency is further than this from 0.5 are reported as biased
+const BIAS_THRESHOLD: f64 = 0.4;
+
+/// Pairs of bits with a correlation at least this strong are reported
+const CORRELATION_THRESHOLD: f64 = 0.5;
+
+/// Unrelated pairs of keys expected in the sample within the near-duplicate
+/// cutoff
+const CHANCE_PAIRS: f64 = 0.01;
+
+/// Most correlated pairs reported
+const MAX_CORRELATED: usize = 10;
+
+/// Keys the estimates are for
+const ESTIMATE_KEYS: f64 = 1e6;
+
+pub struct PartitionAdvice {
+    pub window: Window,
+    /// Information in the partition's bits, discounting bias and correlation
+    pub effective_bits: f64,
+}
+
+pub struct Advice {
+    pub sample: usize,
+    pub bits: usize,
+    pub target_recall: f64,
+    /// Nearest-neighbour distances taken as near-duplicates
+    pub near_duplicates: usize,
+    /// Largest distance taken as a near-duplicate; none if the bits are so
+    /// biased that unrelated keys are expected even at distance 0
+    pub cutoff: Option<usize>,
+    /// Suggested tolerance, if any near-duplicates were found
+    pub tolerance: Option<usize>,
+    /// Partitions at the suggested tolerance (or 0)
+    pub partitions: Vec<PartitionAdvice>,
+    /// Bits and their frequency of being set, for biased bits
+    pub biased_bits: Vec<(usize, f64)>,
+    /// Pairs of bits and their correlation, most strongly correlated first
+    pub correlated_bits: Vec<(usize, usize, f64)>,
+    /// Unrelated keys expected within tolerance of each query, per million keys
+    pub random_matches: f64,
+    /// Candidates expected to be verified for each query, per million keys
+    pub candidates: f64,
+    /// Estimated index size, per million keys
+    pub bytes: f64,
+}
+
+/// Reads at most `MAX_SAMPLE` base64-encoded keys from `path`, one per line
+///
+pub fn load<T: Decodable>(path: &str) -> Result<Vec<T>, String> {
+    let file = match File::open(path) {
+        Ok(f) => f,
+        Err(e) => return Err(format!("unable to open '{}': {}", path, e)),
+    };
+
+    let mut keys = vec![];
+    for (i, line) in BufReader::new(file).lines().enumerate() {
+        if keys.len() >= MAX_SAMPLE {
+            break
+        }
+        let line = match line {
+            Ok(line) => line,
+            Err(e) => return Err(format!("unable to read '{}': {}", path, e)),
+        };
+        let line = line.trim();
+        if line.is_empty() {
+            continue
+        }
+
+        let bytes = match line.from_base64() {
+            Ok(bytes) => bytes,
+            Err(e) => return Err(format!("{}:{}: unable to base64-decode '{}': {:?}", path, i + 1, line, e)),
+        };
+        match bincode::rustc_serialize::decode(&bytes) {
+            Ok(key) => keys.push(key),
+            Err(e) => return Err(format!("{}:{}: unable to decode '{}': {:?}", path, i + 1, line, e)),
+        }
+    }
+
+    Ok(keys)
+}
+
+/// Analyzes `sample` and suggests a tolerance finding `target_recall` of the
+/// near-duplicates in it
+///
+pub fn advise<T: FromBits + Hamming>(sample: &[T], target_recall: f64) -> Advice {
+    let bits = T::bits();
+    let n = sample.len();
+    let columns = Columns::new(sample, bits);
+    let freqs: Vec<f64> = (0..bits).map(|i| columns.frequency(i)).collect();
+
+    let biased_bits = freqs.iter().enumerate()
+        .filter(|&(_, &p)| (p - 0.5).abs() > BIAS_THRESHOLD)
+        .map(|(i, &p)| (i, p))
+        .collect();
+
+    let mut correlated_bits = vec![];
+    for i in 0..bits {
+        for j in (i + 1)..bits {
+            let phi = columns.correlation(i, j);
+            if phi.abs() >= CORRELATION_THRESHOLD {
+                correlated_bits.push((i, j, phi));
+            }
+        }
+    }
+    correlated_bits.sort_by(|a, b| b.2.abs().partial_cmp(&a.2.abs()).unwrap());
+    correlated_bits.truncate(MAX_CORRELATED);
+
+    // Unrelated keys differ in each bit independently, with probability
+    // 2p(1 - p)
+    let unrelated = cumulative(&distance_distribution(&freqs));
+    let pairs = (n * n.saturating_sub(1) / 2) as f64;
+    let cutoff = (0..(bits + 1)).take_while(|&d| unrelated[d] * pairs < CHANCE_PAIRS).last();
+
+    let mut near: Vec<usize> = nearest_distances(sample).into_iter()
+        .filter(|&d| cutoff.map(|c| d <= c).unwrap_or(false))
+        .collect();
+    near.sort();
+
+    let tolerance = match near.len() {
+        0 => None,
+        len => {
+            let covered = min(max((target_recall * len as f64).ceil() as usize, 1), len);
+            Some(near[covered - 1])
+        },
+    };
+
+    let windows = window::partitions(bits, tolerance.unwrap_or(0));
+    let partitions: Vec<PartitionAdvice> = windows.into_iter().map(|w| {
+        let effective_bits = effective_bits(&columns, &freqs, &w);
+        PartitionAdvice{window: w, effective_bits: effective_bits}
+    }).collect();
+
+    // A key is a candidate in a partition if its window is at most 1 from the
+    // query's
+    let candidates = partitions.iter().fold(0.0, |sum, p| {
+        let share = (p.window.dimensions + 1) as f64 / 2f64.powf(p.effective_bits);
+        sum + ESTIMATE_KEYS * share.min(1.0)
+    });
+    let bytes = estimate::estimate(bits, tolerance.unwrap_or(0), ESTIMATE_KEYS as usize, Backend::InMemory).bytes;
+
+    Advice{
+        sample: n,
+        bits: bits,
+        target_recall: target_recall,
+        near_duplicates: near.len(),
+        cutoff: cutoff,
+        tolerance: tolerance,
+        partitions: partitions,
+        biased_bits: biased_bits,
+        correlated_bits: correlated_bits,
+        random_matches: ESTIMATE_KEYS * unrelated[tolerance.unwrap_or(0)],
+        candidates: candidates,
+        bytes: bytes,
+    }
+}
+
+/// The sample's bits, one bitset of keys per bit
+///
+struct Columns {
+    n: usize,
+    columns: Vec<Vec<u64>>,
+}
+
+impl Columns {
+    fn new<T: FromBits>(sample: &[T], bits: usize) -> Columns {
+        let words = (sample.len() + 63) / 64;
+        let mut columns = vec![vec![0u64; words]; bits];
+
+        for (k, key) in sample.iter().enumerate() {
+            for (i, &bit) in key.to_bits().iter().enumerate() {
+                if bit {
+                    columns[i][k / 64] |= 1 << (k % 64);
+                }
+            }
+        }
+        Columns{n: sample.len(), columns: columns}
+    }
+
+    fn frequency(&self, i: usize) -> f64 {
+        match self.n {
+            0 => 0.0,
+            n => self.columns[i].iter().fold(0, |sum, w| sum + w.count_ones()) as f64 / n as f64,
+        }
+    }
+
+    /// Frequency of bits `i` and `j` both being set
+    ///
+    fn joint_frequency(&self, i: usize, j: usize) -> f64 {
+        match self.n {
+            0 => 0.0,
+            n => self.columns[i].iter().zip(self.columns[j].iter()).fold(0, |sum, (a, b)| sum + (a & b).count_ones()) as f64 / n as f64,
+        }
+    }
+
+    /// Correlation (phi coefficient) of bits `i` and `j`, 0 if either is
+    /// constant
+    ///
+    fn correlation(&self, i: usize, j: usize) -> f64 {
+        let (pi, pj) = (self.frequency(i), self.frequency(j));
+        let spread = (pi * (1.0 - pi) * pj * (1.0 - pj)).sqrt();
+        match spread > 0.0 {
+            true => (self.joint_frequency(i, j) - pi * pj) / spread,
+            false => 0.0,
+        }
+    }
+
+    /// Mutual information of bits `i` and `j`, in bits
+    ///
+    fn mutual_information(&self, i: usize, j: usize) -> f64 {
+        let (pi, pj) = (self.frequency(i), self.frequency(j));
+        let both = self.joint_frequency(i, j);
+        let cells = [
+            (both, pi, pj),
+            (pi - both, pi, 1.0 - pj),
+            (pj - both, 1.0 - pi, pj),
+            (1.0 - pi - pj + both, 1.0 - pi, 1.0 - pj),
+        ];
+
+        cells.iter().fold(0.0, |sum, &(joint, a, b)| {
+            match joint > 0.0 && a > 0.0 && b > 0.0 {
+                true => sum + joint * (joint / (a * b)).log2(),
+                false => sum,
+            }
+        })
+    }
+}
+
+fn entropy(p: f64) -> f64 {
+    match p > 0.0 && p < 1.0 {
+        true => -p * p.log2() - (1.0 - p) * (1.0 - p).log2(),
+        false => 0.0,
+    }
+}
+
+/// Information in the bits of `w`, less the information shared by pairs of
+/// them
+///
+fn effective_bits(columns: &Columns, freqs: &[f64], w: &Window) -> f64 {
+    let end = w.start_dimension + w.dimensions;
+    let mut total = (w.start_dimension..end).fold(0.0, |sum, i| sum + entropy(freqs[i]));
+
+    for i in w.start_dimension..end {
+        for j in (i + 1)..end {
+            total -= columns.mutual_information(i, j);
+        }
+    }
+    total.max(0.0)
+}
+
+/// Probability of each distance between unrelated keys, given each bit's
+/// frequency
+///
+fn distance_distribution(freqs: &[f64]) -> Vec<f64> {
+    let mut dist = vec![0.0; freqs.len() + 1];
+    dist[0] = 1.0;
+
+    for (i, &p) in freqs.iter().enumerate() {
+        let differ = 2.0 * p * (1.0 - p);
+        for d in (0..(i + 1)).rev() {
+            dist[d + 1] += dist[d] * differ;
+            dist[d] *= 1.0 - differ;
+        }
+    }
+    dist
+}
+
+fn cumulative(dist: &[f64]) -> Vec<f64> {
+    dist.iter().scan(0.0, |sum, &p| { *sum += p; Some(*sum) }).collect()
+}
+
+/// Distance from each key to its nearest neighbour in `sample`
+///
+fn nearest_distances<T: Hamming>(sample: &[T]) -> Vec<usize> {
+    let mut nearest = vec![usize::max_value(); sample.len()];
+
+    for i in 0..sample.len() {
+        for j in (i + 1)..sample.len() {
+            let d = sample[i].hamming(&sample[j]);
+            nearest[i] = min(nearest[i], d);
+            nearest[j] = min(nearest[j], d);
+        }
+    }
+    nearest.into_iter().filter(|&d| d != usize::max_value()).collect()
+}
+
+impl fmt::Display for Advice {
+    fn fmt(&self, f: &mut fmt::Formatter) -> Result<(), fmt::Error> {
+        try!(writeln!(f, "{} keys of {} bits", self.sample, self.bits));
+
+        match (self.tolerance, self.cutoff) {
+            (Some(tolerance), Some(cutoff)) => {
+                try!(writeln!(f, "{} keys have a near-duplicate within {} bits", self.near_duplicates, cutoff));
+                try!(writeln!(f, "tolerance: {} (finds {:.1}% of them)", tolerance, 100.0 * self.target_recall.min(1.0)));
+            },
+            (None, Some(cutoff)) => try!(writeln!(f, "no keys have a near-duplicate within {} bits; tolerance 0 finds exact duplicates", cutoff)),
+            (_, None) => try!(writeln!(f, "the bits are too biased to tell near-duplicates from unrelated keys; try masking the biased bits")),
+        }
+
+        try!(writeln!(f, "partitions: {}", self.partitions.len()));
+        for p in self.partitions.iter() {
+            try!(writeln!(f, "  bits {}-{}: {:.1} effective bits", p.window.start_dimension, p.window.start_dimension + p.window.dimensions - 1, p.effective_bits));
+        }
+
+        try!(writeln!(f, "per million keys:"));
+        try!(writeln!(f, "  memory: ~{:.0} MB", self.bytes / 1e6));
+        try!(writeln!(f, "  candidates per query: ~{:.0}", self.candidates));
+        try!(writeln!(f, "  unrelated matches per query: ~{:.3}", self.random_matches));
+
+        if !self.biased_bits.is_empty() {
+            try!(writeln!(f, "biased bits (consider masking them):"));
+            for &(i, p) in self.biased_bits.iter() {
+                try!(writeln!(f, "  {}: set in {:.1}% of keys", i, 100.0 * p));
+            }
+        }
+        if !self.correlated_bits.is_empty() {
+            try!(writeln!(f, "correlated bits:"));
+            for &(i, j, phi) in self.correlated_bits.iter() {
+                try!(writeln!(f, "  {} and {}: {:.2}", i, j, phi));
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use rand::{Rng, SeedableRng, XorShiftRng};
+
+    use db::advise::{advise, distance_distribution};
+
+    fn rng() -> XorShiftRng {
+        XorShiftRng::from_seed([1, 0x9E3779B9, 0x7F4A7C15, 0x2545F491])
+    }
+
+    #[test]
+    fn distance_distribution_of_fair_bits_is_binomial() {
+        let dist = distance_distribution(&[0.5, 0.5]);
+        assert_eq!(dist, vec![0.25, 0.5, 0.25]);
+    }
+
+    #[test]
+    fn uniform_keys_have_no_near_duplicates() {
+        let mut rng = rng();
+        let sample: Vec<u64> = (0..500).map(|_| rng.gen()).collect();
+
+        let advice = advise(&sample, 0.99);
+        assert_eq!(advice.tolerance, None);
+        assert!(advice.biased_bits.is_empty());
+        assert_eq!(advice.partitions.len(), 1);
+    }
+
+    #[test]
+    fn clustered_keys_suggest_their_spread() {
+        let mut rng = rng();
+        let mut sample: Vec<u64> = vec![];
+        for _ in 0..100 {
+            let center: u64 = rng.gen();
+            sample.push(center);
+            let flips = (0..3).fold(0u64, |flips, _| flips ^ (1u64 << rng.gen_range(0usize, 64)));
+            sample.push(center ^ flips);
+        }
+
+        let advice = advise(&sample, 1.0);
+        let tolerance = advice.tolerance.unwrap();
+        assert!(tolerance >= 1 && tolerance <= 3, "tolerance {}", tolerance);
+        assert_eq!(advice.partitions.len(), (tolerance + 3) / 2);
+    }
+
+    #[test]
+    fn constant_bits_are_biased_and_carry_nothing() {
+        let mut rng = rng();
+        let sample: Vec<u64> = (0..500).map(|_| rng.gen::<u64>() & 0xFFFFFFFF).collect();
+
+        let advice = advise(&sample, 0.99);
+        assert_eq!(advice.biased_bits.len(), 32);
+        assert!(advice.biased_bits.iter().all(|&(i, p)| i >= 32 && p == 0.0));
+        assert!(advice.partitions[0].effective_bits < 33.0);
+    }
+
+    #[test]
+    fn correlated_bits_are_reported() {
+        let mut rng = rng();
+        let sample: Vec<u64> = (0..500).map(|_| {
+            let v: u64 = rng.gen::<u64>() & !2;
+            v | ((v & 1) << 1)
+        }).collect();
+
+        let advice = advise(&sample, 0.99);
+        assert_eq!(advice.correlated_bits.len(), 1);
+        assert_eq!((advice.correlated_bits[0].0, advice.correlated_bits[0].1), (0, 1));
+    }
+}
@@ -1,101 +1,131 @@
+//! Database benchmarks
+//!
+//! Built with the `bench` feature, which needs a nightly compiler (see `make
+//! bench`).  Each module benchmarks one combination of bits, tolerance,
+//! backend and dataset size, named `b<bits>_t<tolerance>_<size>_<backend>`.
+//! Datasets are generated from a fixed seed, so results are comparable
+//! between runs.
+
 extern crate test;
-extern crate rand;
 
-use self::rand::*;
+use std::hash::Hash;
 
-use db::*;
-use db::hashing::*;
-use db::deletion_db::*;
-use db::substitution_db::*;
+use rand::{Rng, SeedableRng, XorShiftRng};
 
-#[bench]
-fn insert_large_value(b: &mut test::Bencher) {
-    let mut p: DeletionDB<Vec<u8>, Hashed<Vec<u8>>> = Database::new(100, 4);
+use db::{Database, Factory, StorageBackend};
+use hyperplane::FromBits;
 
-    let mut rng = thread_rng();
-    let mut value = Vec::with_capacity(100);
-    for _ in (0..100) {
-        value.push(rng.gen());
-    }
-    let hashed_value = Hashed::new(value);
+fn random_values<T: FromBits>(seed: u32, count: usize) -> Vec<T> {
+    let mut rng = XorShiftRng::from_seed([seed, 0x9E3779B9, 0x7F4A7C15, 0x2545F491]);
 
-    b.iter(|| {
-        p.insert(hashed_value.clone());
-    })
+    (0..count).map(|_| {
+        let bits: Vec<bool> = (0..T::bits()).map(|_| rng.gen()).collect();
+        T::from_bits(&bits)
+    }).collect()
 }
 
-#[bench]
-fn insert_new_value(b: &mut test::Bencher) {
-    let mut p: SubstitutionDB<u64, u64> = Database::new(64, 4);
-
-    let mut rng = thread_rng();
-    let value = rng.gen();
-
-    b.iter(|| {
-        p.insert(value);
-    })
+/// `value` with `n` of its bits flipped
+///
+fn flip<T: FromBits>(value: &T, n: usize) -> T {
+    let mut bits = value.to_bits();
+    for i in 0..n {
+        bits[i * 3] = !bits[i * 3];
+    }
+    T::from_bits(&bits)
 }
 
-#[bench]
-fn insert_existing_value(b: &mut test::Bencher) {
-    let mut p: SubstitutionDB<u64, u64> = Database::new(64, 4);
-
-    let mut rng = thread_rng();
-    let value = rng.gen();
-    p.insert(value);
-
-    b.iter(|| {
-        p.insert(value);
-    })
+fn populated<T: Clone + FromBits + Factory>(tolerance: usize, size: usize, backend: StorageBackend) -> (Box<Database<T>>, Vec<T>) {
+    let mut db: Box<Database<T>> = Factory::build(T::bits(), tolerance, backend);
+    let values: Vec<T> = random_values(0, size);
+    for v in values.iter() {
+        db.insert(v.clone());
+    }
+    (db, values)
 }
 
-#[bench]
-fn find_existing_value(b: &mut test::Bencher) {
-    let mut p: SubstitutionDB<u64, u64> = Database::new(64, 4);
-
-    let mut rng = thread_rng();
-    let value = rng.gen();
-    p.insert(value);
+/// Insert and remove a value not in the database, keeping its size constant
+///
+fn insert_remove<T: Clone + Eq + Hash + FromBits + Factory>(b: &mut test::Bencher, tolerance: usize, size: usize, backend: StorageBackend) {
+    let (mut db, _) = populated::<T>(tolerance, size, backend);
+    let values: Vec<T> = random_values(1, 1000);
 
+    let mut i = 0;
     b.iter(|| {
-        p.get(&value);
+        let v = &values[i % values.len()];
+        db.insert(v.clone());
+        db.remove(v);
+        i += 1;
     })
 }
 
-#[bench]
-fn find_missing_value(b: &mut test::Bencher) {
-    let p: SubstitutionDB<u64, u64> = Database::new(64, 4);
-
-    let mut rng = thread_rng();
-    let value = rng.gen();
+/// Query with stored values flipped by `distance` bits
+///
+fn get_at<T: Clone + FromBits + Factory>(b: &mut test::Bencher, tolerance: usize, size: usize, backend: StorageBackend, distance: usize) {
+    let (db, values) = populated::<T>(tolerance, size, backend);
+    let queries: Vec<T> = values.iter().take(1000).map(|v| flip(v, distance)).collect();
 
+    let mut i = 0;
     b.iter(|| {
-        p.get(&value);
+        let found = db.get(&queries[i % queries.len()]);
+        i += 1;
+        found
     })
 }
 
-#[bench]
-fn remove_missing_value(b: &mut test::Bencher) {
-    let mut p: SubstitutionDB<u64, u64> = Database::new(64, 4);
-
-    let mut rng = thread_rng();
-    let value = rng.gen();
+/// Query with values which (almost certainly) have no matches
+///
+fn get_miss<T: Clone + FromBits + Factory>(b: &mut test::Bencher, tolerance: usize, size: usize, backend: StorageBackend) {
+    let (db, _) = populated::<T>(tolerance, size, backend);
+    let queries: Vec<T> = random_values(2, 1000);
 
+    let mut i = 0;
     b.iter(|| {
-        p.remove(&value);
+        let found = db.get(&queries[i % queries.len()]);
+        i += 1;
+        found
     })
 }
 
-#[bench]
-fn remove_existing_value(b: &mut test::Bencher) {
-    let mut p: SubstitutionDB<u64, u64> = Database::new(64, 4);
-
-    let mut rng = thread_rng();
-    let value = rng.gen();
-    p.insert(value);
-
-    b.iter(|| {
-        p.remove(&value);
-    })
+macro_rules! benches {
+    ($name:ident, $t:ty, $tolerance:expr, $size:expr, $backend:expr) => {
+        mod $name {
+            use super::test;
+            use super::{insert_remove, get_at, get_miss};
+            use db::StorageBackend;
+
+            #[bench]
+            fn insert_remove_value(b: &mut test::Bencher) {
+                insert_remove::<$t>(b, $tolerance, $size, $backend);
+            }
+
+            #[bench]
+            fn get_exact(b: &mut test::Bencher) {
+                get_at::<$t>(b, $tolerance, $size, $backend, 0);
+            }
+
+            #[bench]
+            fn get_at_tolerance(b: &mut test::Bencher) {
+                get_at::<$t>(b, $tolerance, $size, $backend, $tolerance);
+            }
+
+            #[bench]
+            fn get_missing(b: &mut test::Bencher) {
+                get_miss::<$t>(b, $tolerance, $size, $backend);
+            }
+        }
+    }
 }
 
+benches!(b32_t3_1k_mem, u32, 3, 1_000, StorageBackend::InMemory);
+benches!(b64_t4_1k_mem, u64, 4, 1_000, StorageBackend::InMemory);
+benches!(b64_t4_100k_mem, u64, 4, 100_000, StorageBackend::InMemory);
+benches!(b64_t8_1k_mem, u64, 8, 1_000, StorageBackend::InMemory);
+benches!(b64_t8_100k_mem, u64, 8, 100_000, StorageBackend::InMemory);
+benches!(b128_t8_1k_mem, [u64; 2], 8, 1_000, StorageBackend::InMemory);
+benches!(b128_t8_100k_mem, [u64; 2], 8, 100_000, StorageBackend::InMemory);
+benches!(b256_t16_1k_mem, [u64; 4], 16, 1_000, StorageBackend::InMemory);
+
+#[cfg(feature = "rocksdb")]
+benches!(b64_t4_1k_rocksdb, u64, 4, 1_000, StorageBackend::TempRocksDB);
+#[cfg(feature = "rocksdb")]
+benches!(b64_t8_100k_rocksdb, u64, 8, 100_000, StorageBackend::TempRocksDB);
@@ -0,0 +1,327 @@
+//! Bucket size tracking
+//!
+//! Every indexed value is stored in one exact-match bucket per partition.
+//! Values are expected to be spread evenly across buckets; when many values
+//! share a bucket, every query hitting that bucket has to verify all of them.
+//! `BucketTracker` maintains the distribution of bucket sizes in each
+//! partition, and records buckets whose size exceeds a threshold so skewed key
+//! distributions can be detected early.
+//!
+//! Sizes are tracked as values are inserted and removed, so they only reflect
+//! changes made since the database was opened.
+//!
+//! The tracker also estimates how many distinct values have been inserted
+//! (see `db::cardinality`), which unlike the number of stored values isn't
+//! reduced when values are removed or evicted.
+
+use std::cmp::max;
+use std::collections::HashMap;
+use std::hash::Hash;
+
+use db::cardinality::HyperLogLog;
+use db::window::Window;
+
+/// Bucket size distribution for a single partition
+///
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct PartitionStats {
+    pub window: Window,
+    /// Number of non-empty buckets
+    pub buckets: usize,
+    /// Size of the largest bucket seen
+    pub max_size: usize,
+    /// `histogram[i]` is the number of buckets with between `2^i` and
+    /// `2^(i+1) - 1` values
+    pub histogram: Vec<usize>,
+    /// Missing entries restored by re-inserts (see
+    /// `Database::set_repair_on_insert`)
+    pub repaired: usize,
+}
+
+/// A bucket exceeding the threshold
+///
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct HeavyBucket<T> {
+    pub window: Window,
+    pub size: usize,
+    /// One of the values stored in the bucket
+    pub sample: T,
+}
+
+/// Memory held by a single partition's index entries (see
+/// `Database::memory`)
+///
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct PartitionMemory {
+    pub window: Window,
+    /// Number of non-empty buckets, counting 0- and 1-variants separately
+    pub buckets: usize,
+    /// Number of index entries: a 0-variant and a 1-variant per bit of the
+    /// window for each value
+    pub entries: usize,
+    /// Approximate bytes held by the buckets and their entries
+    pub bytes: usize,
+}
+
+impl PartitionMemory {
+    /// Add the memory of a database with the same partitions
+    ///
+    pub fn merge(partitions: &mut Vec<PartitionMemory>, other: Vec<PartitionMemory>) {
+        for (memory, other) in partitions.iter_mut().zip(other.into_iter()) {
+            memory.buckets += other.buckets;
+            memory.entries += other.entries;
+            memory.bytes += other.bytes;
+        }
+    }
+}
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct BucketStats<T> {
+    pub partitions: Vec<PartitionStats>,
+    /// Buckets over the threshold, largest first
+    pub heavy: Vec<HeavyBucket<T>>,
+    /// Distinct values inserted
+    pub distinct: HyperLogLog,
+}
+
+impl<T> BucketStats<T> {
+    /// Combine with statistics from a database with the same partitions
+    ///
+    /// Buckets are counted separately in each database, so a bucket holding
+    /// values in both is counted twice.
+    ///
+    pub fn merge(&mut self, other: BucketStats<T>) {
+        for (stats, other) in self.partitions.iter_mut().zip(other.partitions.into_iter()) {
+            stats.buckets += other.buckets;
+            stats.max_size = max(stats.max_size, other.max_size);
+            stats.repaired += other.repaired;
+
+            if stats.histogram.len() < other.histogram.len() {
+                stats.histogram.resize(other.histogram.len(), 0);
+            }
+            for (i, count) in other.histogram.into_iter().enumerate() {
+                stats.histogram[i] += count;
+            }
+        }
+
+        self.heavy.extend(other.heavy.into_iter());
+        self.heavy.sort_by(|a, b| b.size.cmp(&a.size));
+
+        self.distinct.merge(&other.distinct);
+    }
+}
+
+pub struct BucketTracker<K, T> {
+    threshold: Option<usize>,
+    partitions: Vec<PartitionStats>,
+    heavy: HashMap<(usize, K), (usize, T)>,
+    distinct: HyperLogLog,
+}
+
+impl<K: Clone + Eq + Hash, T: Clone + Hash> BucketTracker<K, T> {
+    pub fn new(windows: &[Window]) -> BucketTracker<K, T> {
+        let partitions = windows.iter().map(|window| {
+            PartitionStats{window: window.clone(), buckets: 0, max_size: 0, histogram: vec![], repaired: 0}
+        }).collect();
+
+        BucketTracker{threshold: None, partitions: partitions, heavy: HashMap::new(), distinct: HyperLogLog::new()}
+    }
+
+    /// Record that `value` was inserted
+    ///
+    pub fn inserted(&mut self, value: &T) {
+        self.distinct.add(value);
+    }
+
+    /// Record buckets larger than `threshold` as heavy
+    ///
+    pub fn set_threshold(&mut self, threshold: usize) {
+        self.threshold = Some(threshold);
+
+        let light: Vec<(usize, K)> = self.heavy.iter()
+            .filter(|&(_, &(size, _))| size <= threshold)
+            .map(|(k, _)| k.clone())
+            .collect();
+        for k in light.iter() {
+            self.heavy.remove(k);
+        }
+    }
+
+    /// Record that the bucket `key` in partition `partition` grew to `size`
+    /// when `value` was added to it
+    ///
+    /// Returns true if the bucket just crossed the threshold
+    ///
+    pub fn grew(&mut self, partition: usize, key: &K, size: usize, value: &T) -> bool {
+        {
+            let stats = &mut self.partitions[partition];
+            if size == 1 {
+                stats.buckets += 1;
+            } else {
+                decrement(&mut stats.histogram, size_class(size - 1));
+            }
+            increment(&mut stats.histogram, size_class(size));
+            stats.max_size = max(stats.max_size, size);
+        }
+
+        match self.threshold {
+            Some(threshold) if size > threshold => {
+                let crossed = size == threshold + 1;
+                self.heavy.insert((partition, key.clone()), (size, value.clone()));
+                crossed
+            },
+            _ => false,
+        }
+    }
+
+    /// Record that `count` missing 1-variant entries were restored in
+    /// partition `partition`
+    ///
+    pub fn repaired(&mut self, partition: usize, count: usize) {
+        self.partitions[partition].repaired += count;
+    }
+
+    /// Record that the bucket `key` in partition `partition` shrank to `size`
+    ///
+    pub fn shrank(&mut self, partition: usize, key: &K, size: usize) {
+        {
+            let stats = &mut self.partitions[partition];
+            decrement(&mut stats.histogram, size_class(size + 1));
+            if size == 0 {
+                stats.buckets -= 1;
+            } else {
+                increment(&mut stats.histogram, size_class(size));
+            }
+        }
+
+        let heavy_key = (partition, key.clone());
+        match self.threshold {
+            Some(threshold) if size > threshold => {
+                match self.heavy.get_mut(&heavy_key) {
+                    Some(&mut (ref mut heavy_size, _)) => *heavy_size = size,
+                    None => {},
+                }
+            },
+            _ => { self.heavy.remove(&heavy_key); },
+        }
+    }
+
+    /// The number of buckets over the threshold
+    ///
+    pub fn heavy_count(&self) -> usize {
+        self.heavy.len()
+    }
+
+    pub fn stats(&self) -> BucketStats<T> {
+        let mut heavy: Vec<HeavyBucket<T>> = self.heavy.iter().map(|(&(partition, _), &(size, ref sample))| {
+            HeavyBucket{window: self.partitions[partition].window.clone(), size: size, sample: sample.clone()}
+        }).collect();
+        heavy.sort_by(|a, b| b.size.cmp(&a.size));
+
+        BucketStats{partitions: self.partitions.clone(), heavy: heavy, distinct: self.distinct.clone()}
+    }
+}
+
+fn size_class(size: usize) -> usize {
+    // floor(log2(size))
+    (0usize.leading_zeros() - size.leading_zeros() - 1) as usize
+}
+
+fn increment(histogram: &mut Vec<usize>, class: usize) {
+    if histogram.len() <= class {
+        histogram.resize(class + 1, 0);
+    }
+    histogram[class] += 1;
+}
+
+fn decrement(histogram: &mut Vec<usize>, class: usize) {
+    histogram[class] -= 1;
+    while histogram.last() == Some(&0) {
+        histogram.pop();
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use db::bucket_stats::*;
+    use db::bucket_stats::size_class;
+    use db::window::Window;
+
+    fn windows() -> Vec<Window> {
+        vec![Window{start_dimension: 0, dimensions: 8}, Window{start_dimension: 8, dimensions: 8}]
+    }
+
+    #[test]
+    fn size_classes() {
+        assert_eq!(size_class(1), 0);
+        assert_eq!(size_class(3), 1);
+        assert_eq!(size_class(4), 2);
+    }
+
+    #[test]
+    fn histogram() {
+        let mut tracker: BucketTracker<u8, u64> = BucketTracker::new(&windows());
+        tracker.grew(0, &1, 1, &1);
+        tracker.grew(0, &1, 2, &2);
+        tracker.grew(0, &2, 1, &3);
+
+        let stats = tracker.stats();
+        assert_eq!(stats.partitions[0].buckets, 2);
+        assert_eq!(stats.partitions[0].max_size, 2);
+        assert_eq!(stats.partitions[0].histogram, vec![1, 1]);
+        assert_eq!(stats.partitions[1].buckets, 0);
+
+        tracker.shrank(0, &1, 1);
+        assert_eq!(tracker.stats().partitions[0].histogram, vec![2]);
+    }
+
+    #[test]
+    fn heavy_buckets() {
+        let mut tracker: BucketTracker<u8, u64> = BucketTracker::new(&windows());
+        tracker.set_threshold(1);
+
+        assert!(!tracker.grew(1, &1, 1, &1));
+        assert!(tracker.grew(1, &1, 2, &2));
+        assert!(!tracker.grew(1, &1, 3, &3));
+
+        assert_eq!(tracker.stats().heavy, vec![HeavyBucket{window: windows()[1].clone(), size: 3, sample: 3}]);
+        assert_eq!(tracker.heavy_count(), 1);
+
+        tracker.shrank(1, &1, 1);
+        assert_eq!(tracker.stats().heavy, vec![]);
+        assert_eq!(tracker.heavy_count(), 0);
+    }
+
+    #[test]
+    fn merge() {
+        let mut a: BucketTracker<u8, u64> = BucketTracker::new(&windows());
+        a.set_threshold(1);
+        a.grew(0, &1, 1, &1);
+        a.grew(0, &1, 2, &2);
+
+        let mut b: BucketTracker<u8, u64> = BucketTracker::new(&windows());
+        b.grew(0, &1, 1, &3);
+
+        let mut stats = a.stats();
+        stats.merge(b.stats());
+
+        assert_eq!(stats.partitions[0].buckets, 2);
+        assert_eq!(stats.partitions[0].max_size, 2);
+        assert_eq!(stats.partitions[0].histogram, vec![1, 1]);
+        assert_eq!(stats.heavy.len(), 1);
+    }
+
+    #[test]
+    fn distinct_inserted() {
+        let mut tracker: BucketTracker<u8, u64> = BucketTracker::new(&windows());
+        tracker.grew(0, &1, 1, &1);
+        tracker.shrank(0, &1, 0);
+        for v in vec![1, 2, 2, 3].into_iter() {
+            tracker.inserted(&v);
+        }
+
+        // Removal doesn't reduce the count
+        assert_eq!(tracker.stats().partitions[0].buckets, 0);
+        assert_eq!(tracker.stats().distinct.estimate(), 3);
+    }
+}
@@ -0,0 +1,145 @@
+//! Near-duplicate clustering
+//!
+//! `single_linkage` groups values into clusters such that two values are in
+//! the same cluster if there's a chain of values between them, each within
+//! `radius` of the next.  Neighbours are found by querying the database, so
+//! `radius` can't be larger than the database's tolerance.
+
+use std::collections::HashMap;
+use std::hash::Hash;
+
+use db::Database;
+use db::hamming::Hamming;
+
+/// Clusters of values connected to `keys` through `db`
+///
+/// Every value in a cluster is either one of `keys` or stored in `db`.  Values
+/// found while clustering are queried in turn, so each cluster is complete
+/// even if only one of its values is given.  Clusters are returned largest
+/// first, and include single values which have no neighbours.
+///
+pub fn single_linkage<T: Clone + Eq + Hash + Hamming>(db: &Database<T>, keys: Vec<T>, radius: usize) -> Vec<Vec<T>> {
+    let mut values: Vec<T> = vec![];
+    let mut index: HashMap<T, usize> = HashMap::new();
+    let mut parents: Vec<usize> = vec![];
+
+    for key in keys.into_iter() {
+        node(key, &mut values, &mut index, &mut parents);
+    }
+
+    let mut i = 0;
+    while i < values.len() {
+        let found = db.get(&values[i]);
+
+        match found {
+            Some(found) => for v in found.into_iter() {
+                if !values[i].hamming_lte(&v, radius) {
+                    continue
+                }
+                let j = node(v, &mut values, &mut index, &mut parents);
+                union(&mut parents, i, j);
+            },
+            None => {},
+        }
+        i += 1;
+    }
+
+    let mut clusters: HashMap<usize, Vec<T>> = HashMap::new();
+    for (i, value) in values.into_iter().enumerate() {
+        let root = find(&mut parents, i);
+        clusters.entry(root).or_insert(vec![]).push(value);
+    }
+
+    let mut clusters: Vec<Vec<T>> = clusters.into_iter().map(|(_, c)| c).collect();
+    clusters.sort_by(|a, b| b.len().cmp(&a.len()));
+    clusters
+}
+
+/// Index of `value`'s node, adding it if necessary
+///
+fn node<T: Clone + Eq + Hash>(value: T, values: &mut Vec<T>, index: &mut HashMap<T, usize>, parents: &mut Vec<usize>) -> usize {
+    match index.get(&value) {
+        Some(&i) => return i,
+        None => {},
+    }
+
+    let i = values.len();
+    index.insert(value.clone(), i);
+    values.push(value);
+    parents.push(i);
+    i
+}
+
+fn find(parents: &mut Vec<usize>, i: usize) -> usize {
+    let mut root = i;
+    while parents[root] != root {
+        root = parents[root];
+    }
+
+    // Compress the path so later lookups are quicker
+    let mut i = i;
+    while parents[i] != root {
+        let next = parents[i];
+        parents[i] = root;
+        i = next;
+    }
+    root
+}
+
+fn union(parents: &mut Vec<usize>, a: usize, b: usize) {
+    let (a, b) = (find(parents, a), find(parents, b));
+    if a != b {
+        parents[b] = a;
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use db::{Database, Factory, StorageBackend};
+    use db::cluster::single_linkage;
+
+    fn sorted(mut clusters: Vec<Vec<u64>>) -> Vec<Vec<u64>> {
+        for c in clusters.iter_mut() {
+            c.sort();
+        }
+        clusters.sort();
+        clusters
+    }
+
+    #[test]
+    fn clusters_chains_of_neighbours() {
+        let mut db: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        // 0b0000 - 0b0011 - 0b1111 is a chain, though the ends are 4 apart
+        for v in vec![0b0000u64, 0b0011u64, 0b1111u64, 0xFF000000u64].into_iter() {
+            db.insert(v);
+        }
+
+        let mut all = vec![];
+        db.for_each(&mut |v| { all.push(*v); Ok(()) }).unwrap();
+
+        assert_eq!(
+            sorted(single_linkage(&*db, all, 2)),
+            vec![vec![0b0000u64, 0b0011u64, 0b1111u64], vec![0xFF000000u64]]
+        );
+    }
+
+    #[test]
+    fn expands_from_given_keys() {
+        let mut db: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        for v in vec![0b0000u64, 0b0011u64, 0b1111u64, 0xFF000000u64].into_iter() {
+            db.insert(v);
+        }
+
+        // The queried key needn't be stored
+        assert_eq!(
+            sorted(single_linkage(&*db, vec![0b0001u64], 2)),
+            vec![vec![0b0000u64, 0b0001u64, 0b0011u64, 0b1111u64]]
+        );
+
+        // A smaller radius breaks the chain
+        assert_eq!(
+            sorted(single_linkage(&*db, vec![0b0000u64], 1)),
+            vec![vec![0b0000u64]]
+        );
+    }
+}
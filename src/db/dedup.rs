@@ -0,0 +1,320 @@
+//! Duplicate insert suppression
+//!
+//! Inserting a value which is already stored is cheap to detect but expensive
+//! to reject, since every variant of the value is computed first.  `Dedup`
+//! remembers the values inserted over a short window and drops repeated
+//! inserts of the same value without passing them to the underlying database.
+//!
+//! Removing a value through the wrapper forgets it, so a value can be
+//! re-inserted immediately after being removed.
+
+use std::collections::{HashMap, HashSet, VecDeque};
+use std::hash::Hash;
+use std::sync::Mutex;
+use std::time::{Duration, Instant, SystemTime};
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+
+struct Recent<T> {
+    inserted: HashMap<T, Instant>,
+    order: VecDeque<(Instant, T)>,
+}
+
+impl<T: Clone + Eq + Hash> Recent<T> {
+    fn expire(&mut self, now: Instant, window: Duration) {
+        loop {
+            let expired = match self.order.front() {
+                Some(&(at, _)) => now.duration_since(at) >= window,
+                None => false,
+            };
+            if !expired {
+                break
+            }
+
+            let (at, key) = self.order.pop_front().unwrap();
+            // The key may have been forgotten and inserted again since
+            if self.inserted.get(&key) == Some(&at) {
+                self.inserted.remove(&key);
+            }
+        }
+    }
+
+    fn forget(&mut self, key: &T) {
+        self.inserted.remove(key);
+    }
+}
+
+pub struct Dedup<T> {
+    db: Box<Database<T>>,
+    window: Duration,
+    recent: Mutex<Recent<T>>,
+    on_duplicate: Box<Fn(&T) + Sync + Send>,
+}
+
+impl<T: Clone + Eq + Hash> Dedup<T> {
+    /// Suppress inserts of values already inserted within `window`;
+    /// `on_duplicate` is called with each suppressed value
+    ///
+    pub fn new(db: Box<Database<T>>, window: Duration, on_duplicate: Box<Fn(&T) + Sync + Send>) -> Dedup<T> {
+        let recent = Recent{inserted: HashMap::new(), order: VecDeque::new()};
+
+        Dedup{db: db, window: window, recent: Mutex::new(recent), on_duplicate: on_duplicate}
+    }
+
+    /// Returns true if `key` hasn't been inserted within the window, and
+    /// records it as inserted
+    ///
+    fn admit(&self, key: &T) -> bool {
+        let now = Instant::now();
+        let mut recent = self.recent.lock().unwrap();
+        recent.expire(now, self.window);
+
+        if recent.inserted.contains_key(key) {
+            return false
+        }
+
+        recent.inserted.insert(key.clone(), now);
+        recent.order.push_back((now, key.clone()));
+        true
+    }
+}
+
+impl<T: Sync + Send + Clone + Eq + Hash> Database<T> for Dedup<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        self.db.get(key)
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        self.db.try_get(key)
+    }
+
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        self.db.get_bounded(key, max_candidates)
+    }
+
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        self.db.try_get_bounded(key, max_candidates)
+    }
+
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        self.db.get_iter(key)
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.db.any_within(key)
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.db.contains(key)
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.db.explain(key, value)
+    }
+
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.db.query_cost(key)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        if !self.admit(&key) {
+            (self.on_duplicate)(&key);
+            return false
+        }
+
+        self.db.insert(key)
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        self.recent.lock().unwrap().forget(key);
+        self.db.remove(key)
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let mut results = vec![false; keys.len()];
+        let mut positions = Vec::with_capacity(keys.len());
+        let mut admitted = Vec::with_capacity(keys.len());
+
+        for (i, key) in keys.into_iter().enumerate() {
+            if self.admit(&key) {
+                positions.push(i);
+                admitted.push(key);
+            } else {
+                (self.on_duplicate)(&key);
+            }
+        }
+
+        let inserted = self.db.insert_batch(admitted, workers);
+        for (i, inserted) in positions.into_iter().zip(inserted.into_iter()) {
+            results[i] = inserted;
+        }
+
+        results
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        self.recent.lock().unwrap().forget(key);
+        self.db.try_remove(key)
+    }
+
+    /// Keys which fail to insert are forgotten, so retrying them isn't
+    /// mistaken for a duplicate
+    ///
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let mut results: Vec<Result<bool, StoreError>> = keys.iter().map(|_| Ok(false)).collect();
+        let mut positions = Vec::with_capacity(keys.len());
+        let mut admitted = Vec::with_capacity(keys.len());
+
+        for (i, key) in keys.into_iter().enumerate() {
+            if self.admit(&key) {
+                positions.push(i);
+                admitted.push(key);
+            } else {
+                (self.on_duplicate)(&key);
+            }
+        }
+
+        let inserted = self.db.try_insert_batch(admitted.clone(), workers);
+        for ((i, key), inserted) in positions.into_iter().zip(admitted.iter()).zip(inserted.into_iter()) {
+            if inserted.is_err() {
+                self.recent.lock().unwrap().forget(key);
+            }
+            results[i] = inserted;
+        }
+
+        results
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        self.db.concurrent_writes()
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        if !self.admit(&key) {
+            (self.on_duplicate)(&key);
+            return false
+        }
+
+        self.db.insert_concurrent(key)
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        self.recent.lock().unwrap().forget(key);
+        self.db.remove_concurrent(key)
+    }
+
+    /// A key which fails to insert is forgotten, as with `try_insert_batch`
+    ///
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        if !self.admit(&key) {
+            (self.on_duplicate)(&key);
+            return Ok(false)
+        }
+
+        let inserted = self.db.try_insert_concurrent(key.clone());
+        if inserted.is_err() {
+            self.recent.lock().unwrap().forget(&key);
+        }
+        inserted
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        self.recent.lock().unwrap().forget(key);
+        self.db.try_remove_concurrent(key)
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        self.db.check()
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        self.db.repair()
+    }
+
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        self.db.plan_repair()
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        self.db.repair_batch(plan, max)
+    }
+
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        self.db.bucket_stats()
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.db.heavy_bucket_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.db.set_bucket_threshold(threshold)
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.db.set_repair_on_insert(repair)
+    }
+
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        self.db.memory()
+    }
+
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        self.db.for_each(f)
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.db.inserted_at(value)
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        self.db.inserted_before(cutoff)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+
+    use db::{Database, Factory, StorageBackend};
+    use db::dedup::Dedup;
+
+    #[test]
+    fn suppresses_duplicates_within_window() {
+        let duplicates = Arc::new(Mutex::new(vec![]));
+        let duplicates_clone = duplicates.clone();
+
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Dedup::new(db, Duration::from_secs(3600), Box::new(move |k: &u64| duplicates_clone.lock().unwrap().push(*k)));
+
+        assert!(db.insert(0b0001u64));
+        assert!(!db.insert(0b0001u64));
+        assert_eq!(db.insert_batch(vec![0b0001u64, 0xFF00u64, 0xFF00u64], 2), vec![false, true, false]);
+
+        assert_eq!(*duplicates.lock().unwrap(), vec![0b0001u64, 0b0001u64, 0xFF00u64]);
+    }
+
+    #[test]
+    fn removed_values_can_be_reinserted() {
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Dedup::new(db, Duration::from_secs(3600), Box::new(|_: &u64| {}));
+
+        assert!(db.insert(0b0001u64));
+        assert!(db.remove(&0b0001u64));
+        assert!(db.insert(0b0001u64));
+    }
+
+    #[test]
+    fn duplicates_outside_window_reach_db() {
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Dedup::new(db, Duration::from_secs(0), Box::new(|_: &u64| panic!("unexpected duplicate")));
+
+        assert!(db.insert(0b0001u64));
+        assert!(!db.insert(0b0001u64));
+    }
+}
@@ -9,7 +9,9 @@ use num::rational::Ratio;
 use db::id_map;
 use db::TypeMap;
 use db::Database;
-use db::result_accumulator::ResultAccumulator;
+use db::error::StoreError;
+use db::result_accumulator::{ResultAccumulator, AccumulatorPool};
+use db::explain::{MatchKind, PartitionMatch};
 use db::map_set::{MapSet, InMemoryHash};
 use db::window::{Window, Windowable};
 use db::id_map::{ToID, IDMap};
@@ -40,6 +42,7 @@ pub struct DB<T = (Vec<u8>, id_map::HashMap<u64, Vec<u8>>, InMemoryHash<Key<Dvec
 
     value_store: <T as TypeMap>::ValueStore,
     variant_store: <T as TypeMap>::VariantStore,
+    pool: AccumulatorPool<<T as TypeMap>::Input>,
 }
 
 impl<T: TypeMap> DB<T> where
@@ -109,18 +112,18 @@ impl<T: TypeMap> DB<T> where
 
             value_store: value_store,
             variant_store: variant_store,
+            pool: AccumulatorPool::new(),
         };
     }
-}
 
-impl<T: TypeMap> Database<<T as TypeMap>::Input> for  DB<T> where
-<T as TypeMap>::Window: DeletionVariant<<T as TypeMap>::Variant>,
-<T as TypeMap>::VariantStore: MapSet<Key<<T as TypeMap>::Variant>, <T as TypeMap>::Identifier>,
-{
-    /// Get all indexed values within `self.tolerance` hamming distance of `key`
+    /// Collect candidates for `key` from each partition
     ///
-    fn get(&self, key: &<T as TypeMap>::Input) -> Option<HashSet<<T as TypeMap>::Input>> {
-        let mut results = ResultAccumulator::new(self.tolerance, key.clone());
+    fn candidates(&self, key: &<T as TypeMap>::Input) -> ResultAccumulator<<T as TypeMap>::Input, <T as TypeMap>::Metric> {
+        self.try_candidates(key).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn try_candidates(&self, key: &<T as TypeMap>::Input) -> Result<ResultAccumulator<<T as TypeMap>::Input, <T as TypeMap>::Metric>, StoreError> {
+        let mut results: ResultAccumulator<_, <T as TypeMap>::Metric> = self.pool.accumulator(self.tolerance, key.clone());
 
         // Split across tasks?
         for window in self.partitions.iter() {
@@ -128,7 +131,7 @@ impl<T: TypeMap> Database<<T as TypeMap>::Input> for  DB<T> where
             let transformed_key = key.window(window.start_dimension, window.dimensions);
 
             for variant in transformed_key.deletion_variants(window.dimensions) {
-                match self.variant_store.get(&(window.clone(), variant)) {
+                match try!(self.variant_store.try_get(&(window.clone(), variant))) {
                     Some(ids) => {
                         // Iterate through the values found in the deletion variant's set
                         for id in ids.iter() {
@@ -143,38 +146,107 @@ impl<T: TypeMap> Database<<T as TypeMap>::Input> for  DB<T> where
                 }
             }
 
+            // An exact match shares every deletion variant of the window, a
+            // 1-match shares exactly one
             for (id, count) in counts {
-                if count > 2 {
-                    results.insert_zero_variant(&self.value_store.get(id))
+                if count >= window.dimensions {
+                    results.insert_zero_variant(&try!(self.value_store.try_get(id)))
                 } else {
-                    results.insert_one_variant(&self.value_store.get(id))
+                    results.insert_one_variant(&try!(self.value_store.try_get(id)))
                 }
             }
         }
 
-        results.found_values()
+        Ok(results)
     }
 
-    /// Insert `key` into indices
+    /// Insert `key` into indices, stopping at the first entry a store fails
+    /// to write
     ///
     /// Returns true if key was added to ANY index
     ///
-    fn insert(&mut self, key: <T as TypeMap>::Input) -> bool {
+    fn try_insert(&mut self, key: <T as TypeMap>::Input) -> Result<bool, StoreError> {
         let id = key.clone().to_id();
-        self.value_store.insert(id.clone(), key.clone());
+        try!(self.value_store.try_insert(id.clone(), key.clone()));
 
-        // Split across tasks?
-        self.partitions.clone().into_iter().map(|window| {
+        // Every variant is inserted, so the result is whether ANY was
+        let mut inserted = false;
+        for window in self.partitions.clone().into_iter() {
+            let transformed_key = key.window(window.start_dimension, window.dimensions);
+
+            for deletion_variant in transformed_key.deletion_variants(window.dimensions) {
+                inserted = try!(self.variant_store.try_insert((window.clone(), deletion_variant), id.clone())) || inserted;
+            }
+        }
+
+        Ok(inserted)
+    }
+}
+
+impl<T: TypeMap> Database<<T as TypeMap>::Input> for  DB<T> where
+<T as TypeMap>::Window: DeletionVariant<<T as TypeMap>::Variant>,
+<T as TypeMap>::VariantStore: MapSet<Key<<T as TypeMap>::Variant>, <T as TypeMap>::Identifier>,
+{
+    /// Get all indexed values within `self.tolerance` hamming distance of `key`
+    ///
+    fn get(&self, key: &<T as TypeMap>::Input) -> Option<HashSet<<T as TypeMap>::Input>> {
+        let results = self.candidates(key);
+        let found = results.found_values();
+        self.pool.recycle(results, &found);
+        found
+    }
+
+    fn try_get(&self, key: &<T as TypeMap>::Input) -> Result<Option<HashSet<<T as TypeMap>::Input>>, StoreError> {
+        let results = try!(self.try_candidates(key));
+        let found = results.found_values();
+        self.pool.recycle(results, &found);
+        Ok(found)
+    }
+
+    fn get_bounded(&self, key: &<T as TypeMap>::Input, max_candidates: usize) -> (Option<HashSet<<T as TypeMap>::Input>>, bool) {
+        self.try_get_bounded(key, max_candidates).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn try_get_bounded(&self, key: &<T as TypeMap>::Input, max_candidates: usize) -> Result<(Option<HashSet<<T as TypeMap>::Input>>, bool), StoreError> {
+        let results = try!(self.try_candidates(key));
+        let (found, overflowed) = results.found_values_bounded(max_candidates);
+        self.pool.recycle(results, &found);
+        Ok((found, overflowed))
+    }
+
+    /// Partitions where `value` shares deletion variants with `key`
+    ///
+    fn explain(&self, key: &<T as TypeMap>::Input, value: &<T as TypeMap>::Input) -> Option<Vec<PartitionMatch>> {
+        let id = value.clone().to_id();
+
+        let matches = self.partitions.iter().filter_map(|window| {
             let transformed_key = key.window(window.start_dimension, window.dimensions);
 
-            // NOTE: think about how to detect 'new' values
-            transformed_key.deletion_variants(window.dimensions).map(|deletion_variant| {
-                self.variant_store.insert((window.clone(), deletion_variant.clone()), id.clone())
+            let count = transformed_key.deletion_variants(window.dimensions).filter(|variant| {
+                match self.variant_store.get(&(window.clone(), variant.clone())) {
+                    Some(ids) => ids.contains(&id),
+                    None => false,
+                }
+            }).count();
 
-            }).collect::<Vec<bool>>().iter().any(|i| *i)
+            if count >= window.dimensions {
+                Some(PartitionMatch{window: window.clone(), kind: MatchKind::Exact})
+            } else if count > 0 {
+                Some(PartitionMatch{window: window.clone(), kind: MatchKind::One})
+            } else {
+                None
+            }
+        }).collect();
 
-            // Collecting first to force evaluation
-        }).collect::<Vec<bool>>().iter().any(|i| *i)
+        Some(matches)
+    }
+
+    /// Insert `key` into indices
+    ///
+    /// Returns true if key was added to ANY index
+    ///
+    fn insert(&mut self, key: <T as TypeMap>::Input) -> bool {
+        self.try_insert(key).unwrap_or_else(|e| panic!("{}", e))
     }
 
     /// Remove `key` from indices
@@ -182,20 +254,48 @@ impl<T: TypeMap> Database<<T as TypeMap>::Input> for  DB<T> where
     /// Returns true if key was removed from ANY index
     ///
     fn remove(&mut self, key: &<T as TypeMap>::Input) -> bool {
+        self.try_remove(key).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    /// Stops at the first entry the variant store fails to remove
+    ///
+    fn try_remove(&mut self, key: &<T as TypeMap>::Input) -> Result<bool, StoreError> {
         let id = key.clone().to_id();
-        self.value_store.remove(&id);
+        try!(self.value_store.try_remove(&id));
 
-        // Split across tasks?
-        self.partitions.clone().into_iter().map(|window| {
+        // Every variant is removed, so the result is whether ANY was
+        let mut removed = false;
+        for window in self.partitions.clone().into_iter() {
             let transformed_key = key.window(window.start_dimension, window.dimensions);
 
-            transformed_key.deletion_variants(window.dimensions).map(|ref deletion_variant| {
-                self.variant_store.remove(&(window.clone(), deletion_variant.clone()), &id)
+            for deletion_variant in transformed_key.deletion_variants(window.dimensions) {
+                removed = try!(self.variant_store.try_remove(&(window.clone(), deletion_variant), &id)) || removed;
+            }
+        }
 
-            }).collect::<Vec<bool>>().iter().any(|i| *i)
+        Ok(removed)
+    }
 
-            // Collecting first to force evaluation
-        }).collect::<Vec<bool>>().iter().any(|i| *i)
+    fn try_insert_batch(&mut self, keys: Vec<<T as TypeMap>::Input>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let _ = workers;
+        keys.into_iter().map(|key| self.try_insert(key)).collect()
+    }
+
+    /// Call `f` with each value having at least one variant entry
+    ///
+    fn for_each(&self, f: &mut FnMut(&<T as TypeMap>::Input) -> Result<(), String>) -> Result<(), String> {
+        // Each value has several variant entries per partition
+        let mut seen = HashSet::new();
+
+        for (_, id) in self.variant_store.iter() {
+            if !self.value_store.contains(&id) || !seen.insert(id.clone()) {
+                continue
+            }
+
+            try!(f(&self.value_store.get(id)));
+        }
+
+        Ok(())
     }
 }
 
@@ -476,6 +576,59 @@ mod test {
         assert!(!p.remove(&a));
     }
 
+    #[test]
+    fn explain_reports_matching_partitions() {
+        use db::explain::MatchKind;
+
+        let mut p: DB<TypeMapVecU8> = DB::new(8, 2);
+        let a = vec![0,0,0,0,0,0,0,0];
+        let b = vec![0,0,0,0,0,0,0,1];
+
+        p.insert(a.clone());
+
+        let kinds: Vec<MatchKind> = p.explain(&b, &a).unwrap().into_iter().map(|m| m.kind).collect();
+        assert_eq!(kinds, vec![MatchKind::Exact, MatchKind::One]);
+    }
+
+    #[test]
+    fn narrow_windows_count_exact_matches() {
+        use db::explain::MatchKind;
+
+        // Two windows of two dimensions, which share two deletion variants
+        // with an exact match
+        let mut p: DB<TypeMapVecU8> = DB::new(4, 2);
+        let a = vec![0,0,0,0];
+        let b = vec![1,1,0,0];
+        let mut expected = HashSet::new();
+        expected.insert(a.clone());
+
+        p.insert(a.clone());
+
+        let kinds: Vec<MatchKind> = p.explain(&b, &a).unwrap().into_iter().map(|m| m.kind).collect();
+        assert_eq!(kinds, vec![MatchKind::Exact]);
+        // Only eligible if the second window counts as an exact match
+        assert_eq!(p.get(&b), Some(expected));
+    }
+
+    #[test]
+    fn for_each_visits_every_value_once() {
+        let mut p: DB<TypeMapVecU8> = DB::new(8, 2);
+        let a = vec![0,0,0,0,0,0,0,0];
+        let b = vec![1,0,0,0,0,0,0,0];
+        let c = vec![1,1,1,1,0,0,0,0];
+
+        p.insert(a.clone());
+        p.insert(b.clone());
+        p.insert(c.clone());
+        p.remove(&b);
+
+        let mut found = vec![];
+        assert_eq!(p.for_each(&mut |v| { found.push(v.clone()); Ok(()) }), Ok(()));
+        found.sort();
+
+        assert_eq!(found, vec![a, c]);
+    }
+
     /*
      * We want to simulate adding & removing a ton of keys and then verify the
      * state is consistent.  
@@ -0,0 +1,192 @@
+//! Multi-value documents
+//!
+//! Some things are identified by several hashes rather than one - a video by
+//! the hashes of its frames, say.  `Documents` stores documents made up of
+//! many scalar values, and finds the stored documents which match at least
+//! `M` of a queried document's `N` values, where a value matches if the
+//! document holds a value within tolerance of it.  With `M = N` every queried
+//! value must match (AND); with `M = 1` any may (OR).
+//!
+//! Values are indexed in a regular database, so the cost of a query grows
+//! with the number of values within tolerance of the queried values rather
+//! than with the number of documents.  A document's values are a set: their
+//! order is ignored, as are repeated values.
+
+use std::collections::{HashMap, HashSet};
+use std::hash::{Hash, Hasher};
+
+use fnv::FnvHasher;
+
+use db::Database;
+
+pub struct Documents<T> {
+    values: Box<Database<T>>,
+    next_id: u64,
+    documents: HashMap<u64, Vec<T>>,
+    ids: HashMap<Vec<T>, u64>,
+    // IDs of the documents holding each stored value
+    containing: HashMap<T, HashSet<u64>>,
+}
+
+impl<T: Clone + Eq + Hash> Documents<T> {
+    /// Store documents, indexing their values in `values` (which should be
+    /// empty)
+    ///
+    pub fn new(values: Box<Database<T>>) -> Documents<T> {
+        Documents{
+            values: values,
+            next_id: 0,
+            documents: HashMap::new(),
+            ids: HashMap::new(),
+            containing: HashMap::new(),
+        }
+    }
+
+    /// Number of documents stored
+    ///
+    pub fn len(&self) -> usize {
+        self.documents.len()
+    }
+
+    /// Returns true if the document wasn't already stored
+    ///
+    pub fn insert(&mut self, document: Vec<T>) -> bool {
+        let document = Documents::distinct(document);
+        if self.ids.contains_key(&document) {
+            return false
+        }
+
+        let id = self.next_id;
+        self.next_id += 1;
+
+        for value in document.iter() {
+            self.values.insert(value.clone());
+            self.containing.entry(value.clone()).or_insert(HashSet::new()).insert(id);
+        }
+        self.ids.insert(document.clone(), id);
+        self.documents.insert(id, document);
+        true
+    }
+
+    /// Returns true if the document was stored
+    ///
+    pub fn remove(&mut self, document: &Vec<T>) -> bool {
+        let document = Documents::distinct(document.clone());
+        let id = match self.ids.remove(&document) {
+            Some(id) => id,
+            None => return false,
+        };
+        self.documents.remove(&id);
+
+        for value in document.iter() {
+            let unused = match self.containing.get_mut(value) {
+                Some(ids) => { ids.remove(&id); ids.is_empty() },
+                None => false,
+            };
+            if unused {
+                self.containing.remove(value);
+                self.values.remove(value);
+            }
+        }
+        true
+    }
+
+    /// Stored documents holding values within tolerance of at least
+    /// `min_matches` of the values in `document`
+    ///
+    pub fn get(&self, document: &Vec<T>, min_matches: usize) -> Option<HashSet<Vec<T>>> {
+        let mut matches: HashMap<u64, usize> = HashMap::new();
+
+        for value in Documents::distinct(document.clone()).iter() {
+            // Each queried value counts once per document, however many of
+            // the document's values it matches
+            let mut matched = HashSet::new();
+            match self.values.get(value) {
+                Some(found) => for v in found.iter() {
+                    match self.containing.get(v) {
+                        Some(ids) => matched.extend(ids.iter().cloned()),
+                        None => {},
+                    }
+                },
+                None => {},
+            }
+
+            for id in matched.into_iter() {
+                *matches.entry(id).or_insert(0) += 1;
+            }
+        }
+
+        let found: HashSet<Vec<T>> = matches.into_iter()
+            .filter(|&(_, count)| count >= min_matches)
+            .map(|(id, _)| self.documents[&id].clone())
+            .collect();
+
+        match found.len() {
+            0 => None,
+            _ => Some(found),
+        }
+    }
+
+    /// `document`'s values without repeats, in a canonical order
+    ///
+    fn distinct(document: Vec<T>) -> Vec<T> {
+        let mut seen = HashSet::new();
+        let mut distinct: Vec<T> = document.into_iter().filter(|v| seen.insert(v.clone())).collect();
+        // Order by hash so that documents holding the same values (barring
+        // hash collisions) compare equal whatever order they were given in
+        distinct.sort_by_key(|v| Documents::hash(v));
+        distinct
+    }
+
+    fn hash(value: &T) -> u64 {
+        let mut hasher = FnvHasher::default();
+        value.hash(&mut hasher);
+        hasher.finish()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use db::{Database, Factory, StorageBackend};
+    use db::documents::Documents;
+
+    fn documents() -> Documents<u64> {
+        let values: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        let mut docs = Documents::new(values);
+
+        assert!(docs.insert(vec![0x0000u64, 0x00FFu64, 0xFF00u64]));
+        assert!(docs.insert(vec![0x0F0Fu64, 0xF0F0u64]));
+        docs
+    }
+
+    #[test]
+    fn requires_min_matches() {
+        let docs = documents();
+
+        // Within tolerance of two of the first document's values
+        let query = vec![0x0001u64, 0x00FEu64, 0x1234u64];
+        assert_eq!(docs.get(&query, 2), Some(vec![vec![0x0000u64, 0x00FFu64, 0xFF00u64]].into_iter().map(|d| Documents::distinct(d)).collect()));
+        assert_eq!(docs.get(&query, 3), None);
+    }
+
+    #[test]
+    fn ignores_order_and_repeats() {
+        let mut docs = documents();
+
+        assert!(!docs.insert(vec![0xFF00u64, 0x0000u64, 0x00FFu64, 0x0000u64]));
+        assert_eq!(docs.len(), 2);
+
+        // A repeated queried value only counts once
+        assert_eq!(docs.get(&vec![0x0F0Fu64, 0x0F0Fu64], 2), None);
+    }
+
+    #[test]
+    fn removes_unused_values() {
+        let mut docs = documents();
+
+        assert!(docs.remove(&vec![0xF0F0u64, 0x0F0Fu64]));
+        assert!(!docs.remove(&vec![0xF0F0u64, 0x0F0Fu64]));
+        assert_eq!(docs.get(&vec![0x0F0Fu64], 1), None);
+        assert_eq!(docs.values.get(&0x0F0Fu64), None);
+    }
+}
@@ -0,0 +1,64 @@
+//! Storage errors
+//!
+//! Stores and databases which can fail (on I/O, say) report it with the
+//! `try_` methods of `MapSet` and `Database`, which return a `StoreError`
+//! rather than panicking.  Errors are classified so callers know whether to
+//! retry: a transient error (the store was busy, or an operation timed out)
+//! may succeed if the operation is retried, while a permanent one (corrupt
+//! data, a missing file) won't.
+//!
+//! A write which fails part way through may leave some of a value's index
+//! entries written; `Database::check` and `Database::repair` find and fix
+//! them.
+
+use std::fmt;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ErrorKind {
+    /// Retrying may succeed
+    Transient,
+    /// Retrying won't help
+    Permanent,
+}
+
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct StoreError {
+    pub kind: ErrorKind,
+    pub message: String,
+}
+
+impl StoreError {
+    pub fn transient<S: Into<String>>(message: S) -> StoreError {
+        StoreError{kind: ErrorKind::Transient, message: message.into()}
+    }
+
+    pub fn permanent<S: Into<String>>(message: S) -> StoreError {
+        StoreError{kind: ErrorKind::Permanent, message: message.into()}
+    }
+
+    pub fn is_transient(&self) -> bool {
+        self.kind == ErrorKind::Transient
+    }
+}
+
+impl fmt::Display for StoreError {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        match self.kind {
+            ErrorKind::Transient => write!(f, "transient store error: {}", self.message),
+            ErrorKind::Permanent => write!(f, "store error: {}", self.message),
+        }
+    }
+}
+
+/// Classify an error from the RocksDB stores by its status message: busy,
+/// timed out, aborted and incomplete operations may succeed if retried,
+/// anything else (i.e. corruption or an I/O error) won't
+///
+pub fn classify(e: String) -> StoreError {
+    let transient = ["Resource busy", "timed out", "Operation aborted", "Result incomplete", "Try again"];
+
+    match transient.iter().any(|status| e.contains(status)) {
+        true => StoreError::transient(format!("rocksdb: {}", e)),
+        false => StoreError::permanent(format!("rocksdb: {}", e)),
+    }
+}
@@ -0,0 +1,257 @@
+//! Memory estimates
+//!
+//! `estimate` predicts how much a binary database of a given size, tolerance
+//! and number of keys will hold, before any keys are added.  Each key is
+//! indexed in every partition under its own window (its 0-variant) and under
+//! each window one bit away (its 1-variants), so a key of `bits` bits in
+//! partitions of `d` bits has `bits + partitions` index entries - 67 for
+//! 64-bit keys at tolerance 4, which is why a million keys take gigabytes.
+//!
+//! Entries are grouped into buckets by variant.  A partition's buckets are
+//! modelled as filled uniformly at random, so narrow partitions (high
+//! tolerances) have few, large buckets and wide ones have many small ones.
+//! Keys which cluster, or bits which are biased, fill fewer buckets; see
+//! `advise` for how much information a sample's partitions actually hold.
+//!
+//! In memory, buckets of up to `MAX_CHUNK` key ids are held in slab chunks
+//! sized to the next power of two, and larger ones in hash sets which
+//! allocate at least `MIN_SET_SLOTS` slots.  With RocksDB, each entry is a key
+//! of its own and resident memory is bounded by RocksDB's caches, so the
+//! estimate is of the data written to disk instead (before compression).
+//! Allocator overhead isn't counted, so treat estimates as lower bounds to
+//! within a factor of two.
+
+use std::cmp::max;
+use std::fmt;
+use std::mem::size_of;
+
+use num::rational::Ratio;
+
+use db::map_set::{InMemoryHash, MAX_CHUNK};
+use db::substitution::Key;
+use db::window;
+use db::window::Window;
+
+/// Fewest slots in a hash table holding anything (Rust's standard library
+/// allocates 32 on the first insert)
+const MIN_SET_SLOTS: f64 = 32.0;
+
+/// Hash tables are at most 10/11 full
+const LOAD_FACTOR: f64 = 10.0 / 11.0;
+
+/// Hash tables grow by doubling, so on average they're three quarters of the
+/// way between sizes
+const GROWTH_SLACK: f64 = 1.33;
+
+/// Bytes stored with each hash table slot alongside its entry (the hash)
+const SLOT_HASH_BYTES: f64 = 8.0;
+
+/// Bytes of bincode's enum tag, prefixed to every RocksDB key
+const TAG_BYTES: f64 = 4.0;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Backend {
+    InMemory,
+    RocksDB,
+}
+
+impl Backend {
+    pub fn parse(s: &str) -> Result<Backend, String> {
+        match s {
+            "memory" => Ok(Backend::InMemory),
+            "rocksdb" => Ok(Backend::RocksDB),
+            _ => Err(format!("unknown backend '{}' (expected memory or rocksdb)", s)),
+        }
+    }
+}
+
+pub struct PartitionEstimate {
+    pub window: Window,
+    /// Index entries: a 0-variant and `dimensions` 1-variants for every key
+    pub entries: f64,
+    /// Distinct variants the entries are grouped under
+    pub buckets: f64,
+    pub bytes: f64,
+}
+
+pub struct Estimate {
+    pub keys: usize,
+    pub bits: usize,
+    pub tolerance: usize,
+    pub backend: Backend,
+    pub partitions: Vec<PartitionEstimate>,
+    /// Bytes of the value store, which maps key ids back to keys
+    pub value_bytes: f64,
+    /// Bytes of the whole database
+    pub bytes: f64,
+}
+
+/// Estimates the size of a `bits`-bit database with `tolerance` holding
+/// `keys` uniformly distributed keys
+///
+pub fn estimate(bits: usize, tolerance: usize, keys: usize, backend: Backend) -> Estimate {
+    let n = keys as f64;
+
+    // As chosen by `Factory::build`: keys of up to 64 bits are their own ids,
+    // wider keys are hashed to 64-bit ids and stored separately
+    let partition_count = (tolerance + 3) / 2;
+    let widest = Ratio::new_raw(bits, partition_count).ceil().to_integer();
+    let key_bytes = variant_key_bytes(widest, backend);
+    let (id_bytes, value_bytes) = match bits <= 64 {
+        true => ((bits / 8) as f64, 0.0),
+        false => (8.0, n * table_bytes(8.0 + (bits / 8) as f64, backend)),
+    };
+
+    let partitions: Vec<PartitionEstimate> = window::partitions(bits, tolerance).into_iter().map(|w| {
+        let space = 2f64.powi(w.dimensions as i32);
+        let zero_entries = n;
+        let one_entries = n * w.dimensions as f64;
+
+        // 0- and 1-variants are keyed separately, so fill separate buckets
+        let zero_buckets = occupied(zero_entries, space);
+        let one_buckets = occupied(one_entries, space);
+
+        let bytes = match backend {
+            Backend::InMemory => {
+                let bucket_bytes = table_bytes(key_bytes + InMemoryHash::<u64, u64>::bucket_size() as f64, backend);
+                zero_buckets * bucket_bytes + sets_bytes(zero_entries, zero_buckets, id_bytes) +
+                    one_buckets * bucket_bytes + sets_bytes(one_entries, one_buckets, id_bytes)
+            },
+            Backend::RocksDB => (zero_entries + one_entries) * (key_bytes + id_bytes),
+        };
+
+        PartitionEstimate{window: w, entries: zero_entries + one_entries, buckets: zero_buckets + one_buckets, bytes: bytes}
+    }).collect();
+
+    let bytes = partitions.iter().fold(value_bytes, |sum, p| sum + p.bytes);
+    Estimate{
+        keys: keys,
+        bits: bits,
+        tolerance: tolerance,
+        backend: backend,
+        partitions: partitions,
+        value_bytes: value_bytes,
+        bytes: bytes,
+    }
+}
+
+/// Expected number of distinct values among `n` drawn uniformly from `space`
+///
+fn occupied(n: f64, space: f64) -> f64 {
+    match n > 0.0 {
+        true => -space * (-n / space).exp_m1(),
+        false => 0.0,
+    }
+}
+
+/// Bytes of a variant key, whose window type is the narrowest unsigned type
+/// holding `widest` bits
+///
+fn variant_key_bytes(widest: usize, backend: Backend) -> f64 {
+    let (in_memory, variant) = match widest {
+        0...8 => (size_of::<Key<u8>>(), 1),
+        9...16 => (size_of::<Key<u16>>(), 2),
+        17...32 => (size_of::<Key<u32>>(), 4),
+        33...64 => (size_of::<Key<u64>>(), 8),
+        65...128 => (size_of::<Key<[u64; 2]>>(), 16),
+        _ => (size_of::<Key<[u64; 4]>>(), 32),
+    };
+    match backend {
+        Backend::InMemory => in_memory as f64,
+        // The tag, the window's start and width, then the variant
+        Backend::RocksDB => TAG_BYTES + 2.0 * size_of::<usize>() as f64 + variant as f64,
+    }
+}
+
+/// Bytes per entry of a hash table of `entry_bytes` entries, counting the
+/// empty slots it keeps
+///
+fn table_bytes(entry_bytes: f64, backend: Backend) -> f64 {
+    match backend {
+        Backend::InMemory => (entry_bytes + SLOT_HASH_BYTES) * GROWTH_SLACK / LOAD_FACTOR,
+        Backend::RocksDB => entry_bytes,
+    }
+}
+
+/// Bytes allocated by `buckets` buckets holding `entries` ids of `id_bytes`
+/// each between them
+///
+fn sets_bytes(entries: f64, buckets: f64, id_bytes: f64) -> f64 {
+    if buckets == 0.0 {
+        return 0.0
+    }
+    let per_bucket = (entries / buckets).ceil();
+    if per_bucket <= MAX_CHUNK as f64 {
+        return buckets * per_bucket.log2().ceil().exp2() * id_bytes
+    }
+    let slots = (per_bucket / LOAD_FACTOR).ceil().max(MIN_SET_SLOTS);
+    buckets * slots.log2().ceil().exp2() * (id_bytes + SLOT_HASH_BYTES)
+}
+
+impl fmt::Display for Estimate {
+    fn fmt(&self, f: &mut fmt::Formatter) -> Result<(), fmt::Error> {
+        let (backend, measure) = match self.backend {
+            Backend::InMemory => ("in memory", "memory"),
+            Backend::RocksDB => ("in RocksDB", "disk, before compression"),
+        };
+        try!(writeln!(f, "{} keys of {} bits, tolerance {}, {}", self.keys, self.bits, self.tolerance, backend));
+        try!(writeln!(f, "partitions: {}", self.partitions.len()));
+        for p in self.partitions.iter() {
+            try!(writeln!(f, "  bits {}-{}: {:.0} entries in {:.0} buckets, ~{:.0} MB",
+                          p.window.start_dimension, p.window.start_dimension + p.window.dimensions - 1, p.entries, p.buckets, p.bytes / 1e6));
+        }
+        if self.value_bytes > 0.0 {
+            try!(writeln!(f, "values: ~{:.0} MB", self.value_bytes / 1e6));
+        }
+        try!(writeln!(f, "total: ~{:.0} MB of {} (~{:.0} bytes per key)", self.bytes / 1e6, measure, self.bytes / max(self.keys, 1) as f64));
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use db::estimate::{estimate, occupied, Backend};
+
+    #[test]
+    fn every_key_has_an_entry_per_bit_and_partition() {
+        let e = estimate(64, 4, 1000, Backend::InMemory);
+        assert_eq!(e.partitions.len(), 3);
+
+        let entries = e.partitions.iter().fold(0.0, |sum, p| sum + p.entries);
+        assert_eq!(entries, 1000.0 * (64 + 3) as f64);
+    }
+
+    #[test]
+    fn buckets_fill_up() {
+        assert_eq!(occupied(0.0, 256.0), 0.0);
+        assert!((occupied(1.0, 1e12) - 1.0).abs() < 1e-6);
+        assert!(occupied(1e6, 256.0) > 255.9);
+    }
+
+    #[test]
+    fn a_million_keys_take_gigabytes_in_memory() {
+        let e = estimate(64, 6, 1000000, Backend::InMemory);
+        assert!(e.bytes > 1e9, "{}", e.bytes);
+        assert_eq!(e.value_bytes, 0.0);
+    }
+
+    #[test]
+    fn wide_keys_are_stored_separately() {
+        let e = estimate(256, 8, 1000, Backend::InMemory);
+        assert!(e.value_bytes > 1000.0 * 40.0);
+    }
+
+    #[test]
+    fn empty_databases_take_nothing() {
+        assert_eq!(estimate(64, 6, 0, Backend::InMemory).bytes, 0.0);
+    }
+
+    #[test]
+    fn estimates_grow_with_keys() {
+        for &backend in [Backend::InMemory, Backend::RocksDB].iter() {
+            let small = estimate(64, 6, 1000, backend).bytes;
+            let large = estimate(64, 6, 100000, backend).bytes;
+            assert!(large > small);
+        }
+    }
+}
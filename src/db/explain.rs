@@ -0,0 +1,25 @@
+//! Query diagnostics
+//!
+//! A value is returned by a query if it's within tolerance of the query and
+//! was found as a candidate in enough partitions: at least one partition with
+//! an exact match, or (for even tolerances) two partitions with 1-dimension
+//! matches.  `Database::explain` reports which partitions found a value, which
+//! can be used to check how much margin the partitioning has on real data.
+
+use db::window::Window;
+
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum MatchKind {
+    /// The value's window is identical to the query's
+    Exact,
+    /// The value's window differs from the query's in one dimension
+    One,
+}
+
+/// A partition in which a value was found as a candidate
+///
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct PartitionMatch {
+    pub window: Window,
+    pub kind: MatchKind,
+}
@@ -0,0 +1,493 @@
+//! Databases split across several hammer servers
+//!
+//! `Federated` is to `Remote` databases what `Sharded` is to local ones:
+//! values are assigned to shards by hash, each shard being a database on
+//! other servers (with its own replicas), and queries are sent to every shard
+//! at once and their results combined.  A value found on more than one shard
+//! (i.e. while values are being moved between them) is only returned once.
+//!
+//! A fanned-out query takes as long as its slowest shard, so it's the shards'
+//! tail latency which sets the query's.  Hedging each shard's queries (see
+//! `Remote::set_hedge_percentile`) keeps one slow replica from holding up
+//! every query.
+//!
+//! If a shard can't be queried (every replica failed), `get` returns the
+//! matches from the other shards rather than nothing; `get_partial` reports
+//! whether the results are complete and which shards were skipped, or with
+//! `require_complete` fails the query instead, as `try_get` does.  Errors
+//! are the shards' `StoreError`s, so a skipped shard which may answer if
+//! asked again fails the query transiently.
+//!
+//! Rather than being given its shards, `discover` fetches the cluster's
+//! `ShardMap` from any of a few seed servers (started with `--shard-map`), so
+//! clients can talk to the shards directly instead of through a proxy.  When
+//! a shard can't be reached, the map is fetched again, and if its version has
+//! changed the request is retried on the new shards.
+//!
+//! # Examples
+//!
+//! ```ignore
+//! let shards = vec![
+//!     vec!["10.0.0.1:3000".to_string(), "10.0.0.2:3000".to_string()],
+//!     vec!["10.0.1.1:3000".to_string(), "10.0.1.2:3000".to_string()],
+//! ].into_iter().map(|replicas| {
+//!     let mut shard = Remote::new(replicas, "b/64/8/foo");
+//!     shard.set_hedge_percentile(Some(0.95));
+//!     shard
+//! }).collect();
+//! let db = Federated::new(shards);
+//!
+//! db.insert_concurrent(0b0001);
+//! assert!(db.get(&0b0000).unwrap().contains(&0b0001));
+//!
+//! // Or find the shards from the cluster
+//! let db = Federated::<u64>::discover(vec!["10.0.0.1:3000".to_string()], "b/64/8/foo", None, Box::new(|shard: &mut Remote<u64>| {
+//!     shard.set_hedge_percentile(Some(0.95));
+//! })).unwrap();
+//! ```
+
+use std::collections::HashSet;
+use std::hash::{Hash, Hasher};
+use std::io::Read;
+use std::sync::{Arc, RwLock};
+use std::sync::mpsc;
+use std::thread;
+
+use fnv::FnvHasher;
+use hyper::Client;
+use hyper::header::Headers;
+use hyper::status::StatusCode;
+use rustc_serialize::{Encodable, Decodable};
+use rustc_serialize::json;
+
+use db::Database;
+use db::error::StoreError;
+use db::remote::Remote;
+
+/// The servers holding each shard of a cluster's databases
+///
+/// Served by `GET /shard_map` on servers started with `--shard-map=<path>`,
+/// from a file like:
+///
+/// ```json
+/// {"version":2,"shards":[["10.0.0.1:3000","10.0.0.2:3000"],["10.0.1.1:3000"]]}
+/// ```
+///
+/// Each shard lists its replicas, primary first.  The version should be
+/// increased whenever the map changes, so clients can tell when theirs is
+/// out of date.
+///
+#[derive(Clone, Debug, PartialEq, RustcDecodable, RustcEncodable)]
+pub struct ShardMap {
+    pub version: u64,
+    pub shards: Vec<Vec<String>>,
+}
+
+impl ShardMap {
+    /// Checks that every shard has a replica
+    ///
+    pub fn validate(&self) -> Result<(), String> {
+        if self.shards.is_empty() {
+            return Err("a shard map needs at least one shard".to_string())
+        }
+        match self.shards.iter().position(|replicas| replicas.is_empty()) {
+            Some(i) => Err(format!("shard {} has no replicas", i)),
+            None => Ok(()),
+        }
+    }
+}
+
+/// Where to fetch the shard map from, and how to set up its shards
+///
+struct Discovery<T> {
+    seeds: Vec<String>,
+    db: String,
+    token: Option<String>,
+    configure: Box<Fn(&mut Remote<T>) + Sync + Send>,
+    client: Client,
+}
+
+impl<T> Discovery<T> where
+T: Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
+{
+    /// The shard map from the first seed which has one
+    ///
+    fn fetch(&self) -> Result<ShardMap, String> {
+        let mut last_error = "no seed servers given".to_string();
+
+        for seed in self.seeds.iter() {
+            match fetch_shard_map(&self.client, seed, &self.token) {
+                Ok(map) => return Ok(map),
+                Err(e) => last_error = e,
+            }
+        }
+        Err(last_error)
+    }
+
+    fn shards(&self, map: &ShardMap) -> Vec<Arc<Remote<T>>> {
+        map.shards.iter().map(|replicas| {
+            let mut shard = Remote::new(replicas.clone(), &self.db);
+            shard.set_token(self.token.clone());
+            (self.configure)(&mut shard);
+            Arc::new(shard)
+        }).collect()
+    }
+}
+
+pub struct Federated<T> {
+    shards: RwLock<Vec<Arc<Remote<T>>>>,
+    /// Version of the shard map the shards came from
+    version: RwLock<u64>,
+    discovery: Option<Discovery<T>>,
+}
+
+/// Matches from the shards which answered a query
+///
+#[derive(Debug)]
+pub struct ShardResults<T> {
+    pub found: Option<HashSet<T>>,
+    /// False if some shards were skipped, in which case matches on them are
+    /// missing
+    pub complete: bool,
+    /// Shards which couldn't be queried, by index, and why
+    pub skipped: Vec<(usize, StoreError)>,
+}
+
+impl<T> Federated<T> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
+{
+    /// Create a database spread across `shards`
+    ///
+    /// Values are assigned to shards by hash, so the same shards must be
+    /// passed in the same order every time.
+    ///
+    pub fn new(shards: Vec<Remote<T>>) -> Federated<T> {
+        assert!(!shards.is_empty(), "at least one shard is required");
+
+        Federated{
+            shards: RwLock::new(shards.into_iter().map(|shard| Arc::new(shard)).collect()),
+            version: RwLock::new(0),
+            discovery: None,
+        }
+    }
+
+    /// The database `db` on the shards in the shard map fetched from the
+    /// first of `seeds` which answers
+    ///
+    /// `token` is sent with every request, and `configure` is called with
+    /// each shard (i.e. to set up hedging) whenever the map is fetched.
+    ///
+    pub fn discover(seeds: Vec<String>, db: &str, token: Option<String>, configure: Box<Fn(&mut Remote<T>) + Sync + Send>) -> Result<Federated<T>, String> {
+        let discovery = Discovery{seeds: seeds, db: db.to_string(), token: token, configure: configure, client: Client::new()};
+        let map = try!(discovery.fetch());
+
+        Ok(Federated{
+            shards: RwLock::new(discovery.shards(&map)),
+            version: RwLock::new(map.version),
+            discovery: Some(discovery),
+        })
+    }
+
+    /// Fetch the shard map again, returning true if it's changed
+    ///
+    /// Always false for databases which weren't discovered.
+    ///
+    pub fn refresh(&self) -> bool {
+        let discovery = match self.discovery {
+            Some(ref discovery) => discovery,
+            None => return false,
+        };
+        let map = match discovery.fetch() {
+            Ok(map) => map,
+            Err(_) => return false,
+        };
+
+        let mut version = self.version.write().unwrap();
+        if map.version == *version {
+            return false
+        }
+        *self.shards.write().unwrap() = discovery.shards(&map);
+        *version = map.version;
+        true
+    }
+
+    /// Version of the shard map in use, 0 for databases which weren't
+    /// discovered
+    ///
+    pub fn version(&self) -> u64 {
+        *self.version.read().unwrap()
+    }
+
+    fn shard_index(shards: &[Arc<Remote<T>>], key: &T) -> usize {
+        let mut hasher = FnvHasher::default();
+        key.hash(&mut hasher);
+
+        (hasher.finish() % shards.len() as u64) as usize
+    }
+
+    fn shard(&self, key: &T) -> Arc<Remote<T>> {
+        let shards = self.shards.read().unwrap();
+        shards[Federated::shard_index(&shards, key)].clone()
+    }
+
+    /// Call `f` with `key`'s shard, and again with its new shard if that
+    /// fails and the shard map has changed
+    ///
+    fn routed<R, F>(&self, key: &T, f: F) -> Result<R, StoreError> where
+    F: Fn(&Remote<T>) -> Result<R, StoreError>,
+    {
+        match f(&*self.shard(key)) {
+            Err(_) if self.refresh() => f(&*self.shard(key)),
+            result => result,
+        }
+    }
+
+    /// Results of querying every shard at once for `key`, by shard
+    ///
+    fn fan_out<R, F>(&self, key: &T, query: F) -> Vec<Result<R, StoreError>> where
+    R: 'static + Send,
+    F: 'static + Sync + Send + Fn(&Remote<T>, &T) -> Result<R, StoreError>,
+    {
+        let shards = self.shards.read().unwrap().clone();
+        let query = Arc::new(query);
+        let (tx, rx) = mpsc::channel();
+
+        for (i, shard) in shards.iter().enumerate() {
+            let (shard, key, query, tx) = (shard.clone(), key.clone(), query.clone(), tx.clone());
+            thread::spawn(move || {
+                let _ = tx.send((i, query(&*shard, &key)));
+            });
+        }
+        drop(tx);
+
+        let mut results: Vec<Option<Result<R, StoreError>>> = shards.iter().map(|_| None).collect();
+        for (i, result) in rx.iter() {
+            results[i] = Some(result);
+        }
+        results.into_iter().map(|result| result.unwrap_or_else(|| Err(StoreError::permanent("shard query panicked")))).collect()
+    }
+
+    /// Matches for `key` on the shards which could be queried
+    ///
+    /// With `require_complete`, fails with the first skipped shard's error if
+    /// any shard couldn't be queried.
+    ///
+    pub fn get_partial(&self, key: &T, require_complete: bool) -> Result<ShardResults<T>, StoreError> {
+        let results = self.query_shards(key);
+        let results = match results.iter().any(|result| result.is_err()) && self.refresh() {
+            true => self.query_shards(key),
+            false => results,
+        };
+
+        let mut found = HashSet::new();
+        let mut skipped = vec![];
+
+        for (i, result) in results.into_iter().enumerate() {
+            match result {
+                Ok(Some(values)) => found.extend(values.into_iter()),
+                Ok(None) => {},
+                Err(e) => skipped.push((i, e)),
+            }
+        }
+
+        match skipped.first() {
+            Some(&(i, ref e)) if require_complete => return Err(StoreError{kind: e.kind, message: format!("shard {} couldn't be queried: {}", i, e.message)}),
+            _ => {},
+        }
+
+        Ok(ShardResults{
+            found: match found.is_empty() {
+                true => None,
+                false => Some(found),
+            },
+            complete: skipped.is_empty(),
+            skipped: skipped,
+        })
+    }
+
+    fn query_shards(&self, key: &T) -> Vec<Result<Option<HashSet<T>>, StoreError>> {
+        self.fan_out(key, |shard, key| shard.try_get(key))
+    }
+
+    /// Whether any shard has a match for `key`; an error only if none do and
+    /// some shard couldn't be queried
+    ///
+    pub fn try_any_within(&self, key: &T) -> Result<bool, StoreError> {
+        let mut error = None;
+
+        for result in self.fan_out(key, |shard, key| shard.try_any_within(key)) {
+            match result {
+                Ok(true) => return Ok(true),
+                Ok(false) => {},
+                Err(e) => error = Some(e),
+            }
+        }
+
+        match error {
+            Some(e) => Err(e),
+            None => Ok(false),
+        }
+    }
+}
+
+impl<T> Database<T> for Federated<T> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
+{
+    /// Matches from the shards which could be queried (see `get_partial`)
+    ///
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        match self.get_partial(key, false) {
+            Ok(results) => results.found,
+            Err(_) => None,
+        }
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.try_any_within(key).unwrap_or(false)
+    }
+
+    /// Only asks the shard `key` would be stored on
+    ///
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.routed(key, |shard| shard.try_contains(key)).unwrap_or(false)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        self.insert_concurrent(key)
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        self.remove_concurrent(key)
+    }
+
+    /// Matches for `key` on every shard, or an error if any shard couldn't
+    /// be queried
+    ///
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        self.get_partial(key, true).map(|results| results.found)
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        self.routed(key, |shard| shard.delete(key))
+    }
+
+    /// Adds the keys with one request per shard
+    ///
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        self.try_insert_batch(keys, workers).into_iter().map(|added| added.unwrap_or(false)).collect()
+    }
+
+    /// Adds the keys with one request per shard, so if a shard's request
+    /// fails each of its keys gets the error
+    ///
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let _ = workers;
+        let shards = self.shards.read().unwrap().clone();
+        let mut results: Vec<Result<bool, StoreError>> = keys.iter().map(|_| Ok(false)).collect();
+        let mut by_shard: Vec<(Vec<usize>, Vec<T>)> = shards.iter().map(|_| (vec![], vec![])).collect();
+
+        for (i, key) in keys.into_iter().enumerate() {
+            let shard = Federated::shard_index(&shards, &key);
+            by_shard[shard].0.push(i);
+            by_shard[shard].1.push(key);
+        }
+
+        for (shard, (positions, keys)) in by_shard.into_iter().enumerate() {
+            if keys.is_empty() {
+                continue
+            }
+            for (i, added) in positions.into_iter().zip(shards[shard].add(keys).into_iter()) {
+                results[i] = added;
+            }
+        }
+        results
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        true
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        self.routed(&key, |shard| shard.add(vec![key.clone()]).pop().unwrap()).unwrap_or(false)
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        self.routed(key, |shard| shard.delete(key)).unwrap_or(false)
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        self.routed(&key, |shard| shard.add(vec![key.clone()]).pop().unwrap())
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        self.routed(key, |shard| shard.delete(key))
+    }
+}
+
+fn fetch_shard_map(client: &Client, server: &str, token: &Option<String>) -> Result<ShardMap, String> {
+    let url = format!("http://{}/shard_map", server);
+    let mut headers = Headers::new();
+    match *token {
+        Some(ref token) => headers.set_raw("Authorization", vec![format!("Bearer {}", token).into_bytes()]),
+        None => {},
+    }
+
+    let mut res = match client.get(&url).headers(headers).send() {
+        Ok(res) => res,
+        Err(e) => return Err(format!("GET {} failed: {}", url, e)),
+    };
+
+    let mut body = String::new();
+    match res.read_to_string(&mut body) {
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to read response to GET {}: {}", url, e)),
+    }
+    match res.status {
+        StatusCode::Ok => {},
+        status => return Err(format!("GET {} returned {}: {}", url, status, body.trim())),
+    }
+
+    let map = match json::decode::<ShardMap>(&body) {
+        Ok(map) => map,
+        Err(e) => return Err(format!("unable to parse shard map from {}: {}", server, e)),
+    };
+    try!(map.validate());
+    Ok(map)
+}
+
+#[cfg(test)]
+mod test {
+    use db::federated::{Federated, ShardMap};
+    use db::remote::Remote;
+
+    fn unreachable() -> Remote<u64> {
+        // Nothing listens on port 1, so connections are refused straight away
+        let mut shard = Remote::new(vec!["127.0.0.1:1".to_string()], "b/64/8/foo");
+        shard.set_retries(0);
+        shard
+    }
+
+    #[test]
+    fn skipped_shards_are_reported() {
+        let db = Federated::new(vec![unreachable(), unreachable()]);
+
+        let results = db.get_partial(&0, false).unwrap();
+        assert_eq!(results.found, None);
+        assert!(!results.complete);
+        assert_eq!(results.skipped.iter().map(|&(i, _)| i).collect::<Vec<usize>>(), vec![0, 1]);
+
+        assert!(db.get_partial(&0, true).is_err());
+    }
+
+    #[test]
+    fn shard_maps_need_replicas() {
+        assert!(ShardMap{version: 1, shards: vec![vec!["a:1".to_string()]]}.validate().is_ok());
+        assert!(ShardMap{version: 1, shards: vec![]}.validate().is_err());
+        assert!(ShardMap{version: 1, shards: vec![vec!["a:1".to_string()], vec![]]}.validate().is_err());
+    }
+
+    #[test]
+    fn discovery_needs_a_reachable_seed() {
+        assert!(Federated::<u64>::discover(vec!["127.0.0.1:1".to_string()], "b/64/8/foo", None, Box::new(|_: &mut Remote<u64>| {})).is_err());
+    }
+}
@@ -0,0 +1,151 @@
+//! Synthetic datasets
+//!
+//! `Generator` produces clustered keys, like the near-duplicates real
+//! fingerprints have: each cluster has a random center, and its members are
+//! the center with up to `noise` of its bits flipped.  Uniformly random keys
+//! are almost never within tolerance of each other, so benchmarks using them
+//! only exercise the path where candidates are rejected; clustered keys
+//! exercise the path where they match.
+//!
+//! Cluster sizes vary around `cluster_size` (from 1 to twice it), and keys
+//! are generated from a seed, so the same arguments give the same dataset.
+
+use rand::{Rng, SeedableRng, XorShiftRng};
+
+use hyperplane::FromBits;
+
+pub struct Generator<T> {
+    rng: XorShiftRng,
+    /// Keys left to generate
+    count: usize,
+    cluster_size: usize,
+    noise: usize,
+    center: Option<T>,
+    /// Members left in the current cluster
+    remaining: usize,
+}
+
+impl<T: FromBits + Clone> Generator<T> {
+    pub fn new(seed: u64, count: usize, cluster_size: usize, noise: usize) -> Generator<T> {
+        Generator{
+            rng: XorShiftRng::from_seed([seed as u32, (seed >> 32) as u32, 0x9E3779B9, 0x7F4A7C15]),
+            count: count,
+            cluster_size: if cluster_size == 0 { 1 } else { cluster_size },
+            noise: if noise > T::bits() { T::bits() } else { noise },
+            center: None,
+            remaining: 0,
+        }
+    }
+
+    fn random(&mut self) -> T {
+        let bits: Vec<bool> = (0..T::bits()).map(|_| self.rng.gen()).collect();
+        T::from_bits(&bits)
+    }
+
+    /// `center` with between 1 and `noise` distinct bits flipped
+    ///
+    fn member(&mut self, center: &T) -> T {
+        let mut bits = center.to_bits();
+        let flips = self.rng.gen_range(0, self.noise) + 1;
+        let mut dimensions: Vec<usize> = (0..bits.len()).collect();
+        self.rng.shuffle(&mut dimensions);
+        for &i in dimensions[..flips].iter() {
+            bits[i] = !bits[i];
+        }
+        T::from_bits(&bits)
+    }
+}
+
+impl<T: FromBits + Clone> Iterator for Generator<T> {
+    type Item = T;
+
+    fn next(&mut self) -> Option<T> {
+        if self.count == 0 {
+            return None
+        }
+        self.count -= 1;
+
+        if self.remaining == 0 {
+            let center = self.random();
+            // Between 1 and 2 * cluster_size - 1 keys, the center included
+            self.remaining = self.rng.gen_range(0, 2 * self.cluster_size - 1);
+            self.center = Some(center.clone());
+            return Some(center)
+        }
+        self.remaining -= 1;
+
+        let center = self.center.clone().unwrap();
+        match self.noise {
+            0 => Some(center),
+            _ => Some(self.member(&center)),
+        }
+    }
+}
+
+/// Parses a count, optionally suffixed with `K` (thousands) or `M`
+/// (millions), i.e. `1M`
+///
+pub fn parse_count(count: &str) -> Result<usize, String> {
+    let (digits, multiplier) = match count.chars().last() {
+        Some('k') | Some('K') => (&count[..count.len() - 1], 1000),
+        Some('m') | Some('M') => (&count[..count.len() - 1], 1000000),
+        _ => (count, 1),
+    };
+
+    match digits.parse::<usize>() {
+        Ok(n) => Ok(n * multiplier),
+        Err(_) => Err(format!("invalid count '{}'", count)),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use db::generate::{Generator, parse_count};
+    use db::hamming::Hamming;
+
+    #[test]
+    fn generates_count_keys() {
+        let keys: Vec<u64> = Generator::new(0, 1000, 5, 3).collect();
+        assert_eq!(keys.len(), 1000);
+    }
+
+    #[test]
+    fn same_seed_same_keys() {
+        let a: Vec<u64> = Generator::new(7, 100, 5, 3).collect();
+        let b: Vec<u64> = Generator::new(7, 100, 5, 3).collect();
+        let c: Vec<u64> = Generator::new(8, 100, 5, 3).collect();
+        assert_eq!(a, b);
+        assert!(a != c);
+    }
+
+    #[test]
+    fn keys_have_near_duplicates() {
+        let keys: Vec<u64> = Generator::new(0, 1000, 5, 3).collect();
+
+        // Members are within 3 bits of their center, so within 6 of each other
+        let near = keys.iter().filter(|a| {
+            keys.iter().any(|b| a != &b && a.hamming(b) <= 6)
+        }).count();
+        assert!(near > 500, "{} keys with near-duplicates", near);
+    }
+
+    #[test]
+    fn cluster_size_one_is_uniform() {
+        let keys: Vec<u64> = Generator::new(0, 200, 1, 3).collect();
+
+        for (i, a) in keys.iter().enumerate() {
+            for b in keys[i + 1..].iter() {
+                assert!(a.hamming(b) > 6);
+            }
+        }
+    }
+
+    #[test]
+    fn parses_counts() {
+        assert_eq!(parse_count("500"), Ok(500));
+        assert_eq!(parse_count("10k"), Ok(10000));
+        assert_eq!(parse_count("1M"), Ok(1000000));
+        assert!(parse_count("1G").is_err());
+        assert!(parse_count("M").is_err());
+    }
+}
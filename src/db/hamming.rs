@@ -4,6 +4,7 @@ extern crate num;
 use std::cmp::*;
 use std::clone::*;
 use std::hash::*;
+use std::mem::size_of;
 
 /// HmSearch-indexable value
 ///
@@ -25,6 +26,17 @@ pub trait Hamming {
     /// `self` and `rhs`
     ///
     fn hamming_indices(&self, rhs: &Self) -> Vec<usize>;
+
+    /// Weighted hamming distance between `self` and `rhs`
+    ///
+    /// Each differing dimension `i` contributes `weights[i]` to the distance.
+    /// Dimensions without a weight contribute 1.
+    ///
+    fn weighted_hamming(&self, rhs: &Self, weights: &[usize]) -> usize {
+        self.hamming_indices(rhs).iter().fold(0, |h, &i| {
+            h + if i < weights.len() { weights[i] } else { 1 }
+        })
+    }
 }
 
 macro_rules! intrinsic_hamming {
@@ -39,7 +51,7 @@ macro_rules! intrinsic_hamming {
             fn hamming_indices(&self, other: &$elem) -> Vec<usize> {
                 let different = *self ^ *other;
 
-                (0..8).filter(|i| (0 as $elem) != (1 as $elem) << i & different ).collect()
+                (0..(8 * size_of::<$elem>())).filter(|i| (0 as $elem) != (1 as $elem) << i & different ).collect()
             }
         }
     }
@@ -58,11 +70,14 @@ macro_rules! array_hamming {
             fn hamming(&self, other: &$elem) -> usize {
                 self.iter().zip(other.iter()).fold(0, |h, (&a, &b)| { h + a.hamming(&b) })
             }
+            // Dimensions are numbered from the least significant bit of the
+            // last element, matching `Windowable`
+            //
             fn hamming_indices(&self, other: &$elem) -> Vec<usize> {
                 let len = self.len();
 
                 self.iter().zip(other.iter()).enumerate().fold(Vec::new(), |mut h, (i, (a, b))| {
-                    let offset = i * len;
+                    let offset = (len - 1 - i) * 8 * size_of::<u64>();
                     let mut pair_indices = a.hamming_indices(b).iter().map(|idx| idx + offset).collect();
                     h.append(&mut pair_indices);
                     h
@@ -182,4 +197,30 @@ mod test {
 
         assert_eq!(a.hamming(&b), 8);
     }
+
+    #[test]
+    fn test_hamming_indices_u64() {
+        let a = 0u64;
+        let b = (1u64 << 63) | (1u64 << 9) | 1u64;
+
+        assert_eq!(a.hamming_indices(&b), vec![0, 9, 63]);
+    }
+
+    #[test]
+    fn test_hamming_indices_u64x2() {
+        let a = [0u64, 0u64];
+        let b = [1u64, 1u64 << 3];
+
+        assert_eq!(a.hamming_indices(&b), vec![64, 3]);
+    }
+
+    #[test]
+    fn test_weighted_hamming_u64() {
+        let a = 0b00000000u64;
+        let b = 0b00000111u64;
+
+        assert_eq!(a.weighted_hamming(&b, &[]), 3);
+        assert_eq!(a.weighted_hamming(&b, &[0, 2, 5]), 7);
+        assert_eq!(a.weighted_hamming(&b, &[0, 0]), 1);
+    }
 }
@@ -23,4 +23,5 @@ impl<T: Sync + Send> IDMap<T, T> for Echo<T> {
     fn get(&self, id: T) -> T { id }
     fn insert(&mut self, _: T, _: T) {}
     fn remove(&mut self, _: &T) {}
+    fn contains(&self, _: &T) -> bool { true }
 }
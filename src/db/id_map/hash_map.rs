@@ -46,4 +46,8 @@ T: Sync + Send + Clone,
     fn remove(&mut self, id: &ID) {
         self.data.remove(id);
     }
+
+    fn contains(&self, id: &ID) -> bool {
+        self.data.contains_key(id)
+    }
 }
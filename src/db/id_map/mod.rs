@@ -1,20 +1,58 @@
 mod echo;
 mod hash_map;
+#[cfg(feature = "rocksdb")]
 mod rocks_db;
+#[cfg(not(feature = "rocksdb"))]
+mod no_rocks_db;
 
 use std::hash::{Hash, Hasher, SipHasher};
 use std::ops::{Deref, DerefMut};
 
 use fnv::FnvHasher;
 
+use db::error::StoreError;
+
 pub use self::echo::Echo;
 pub use self::hash_map::HashMap;
+#[cfg(feature = "rocksdb")]
 pub use self::rocks_db::{RocksDB, TempRocksDB};
+#[cfg(not(feature = "rocksdb"))]
+pub use self::no_rocks_db::{RocksDB, TempRocksDB};
 
+/// Storage for the values a database indexes by id (its value store)
+///
+/// Like `MapSet`, this can be implemented by custom storage backends and
+/// named as the `ValueStore` of a `TypeMap`.  Stores which can fail should
+/// report it from the `try_` methods, as with `MapSet`, and panic from the
+/// others rather than lose a write.
+///
 pub trait IDMap<ID, T>: Sync + Send {
+    /// The value stored for `id`.  Databases only look up ids found in their
+    /// index, so this may panic if `id` isn't stored
     fn get(&self, id: ID) -> T;
+
+    /// Store `value` for `id`, replacing any value already stored
     fn insert(&mut self, id: ID, value: T);
+
+    /// Remove the value for `id`, if any
     fn remove(&mut self, id: &ID);
+
+    fn contains(&self, id: &ID) -> bool;
+
+    /// Like `get`, but returns an error if the store fails
+    fn try_get(&self, id: ID) -> Result<T, StoreError> {
+        Ok(self.get(id))
+    }
+
+    /// Like `insert`, but returns an error if the store fails
+    fn try_insert(&mut self, id: ID, value: T) -> Result<(), StoreError> {
+        Ok(self.insert(id, value))
+    }
+
+    /// Like `remove`, but returns an error if the store fails
+    fn try_remove(&mut self, id: &ID) -> Result<(), StoreError> {
+        Ok(self.remove(id))
+    }
 }
 
 impl<T, ID, D: Deref + DerefMut> IDMap<ID, T> for D where 
@@ -32,6 +70,22 @@ D: Sync + Send,
     fn remove(&mut self, id: &ID) {
         self.deref_mut().remove(id)
     }
+
+    fn contains(&self, id: &ID) -> bool {
+        self.deref().contains(id)
+    }
+
+    fn try_get(&self, id: ID) -> Result<T, StoreError> {
+        self.deref().try_get(id)
+    }
+
+    fn try_insert(&mut self, id: ID, value: T) -> Result<(), StoreError> {
+        self.deref_mut().try_insert(id, value)
+    }
+
+    fn try_remove(&mut self, id: &ID) -> Result<(), StoreError> {
+        self.deref_mut().try_remove(id)
+    }
 }
 
 pub trait ToID<T> {
@@ -0,0 +1,73 @@
+//! Stand-ins for the RocksDB stores when built without the `rocksdb` feature
+//!
+//! See `map_set::no_rocks_db`.
+
+use std::marker::PhantomData;
+
+use super::IDMap;
+
+const UNAVAILABLE: &'static str = "hammer was built without RocksDB support (enable the `rocksdb` feature)";
+
+pub struct TempRocksDB<ID, T> {
+    id: PhantomData<ID>,
+    value: PhantomData<T>,
+}
+
+impl<ID, T> TempRocksDB<ID, T> {
+    pub fn new() -> TempRocksDB<ID, T> {
+        panic!(UNAVAILABLE)
+    }
+}
+
+impl<ID, T> IDMap<ID, T> for TempRocksDB<ID, T> where
+ID: Sync + Send,
+T: Sync + Send,
+{
+    fn get(&self, _: ID) -> T {
+        unreachable!()
+    }
+
+    fn insert(&mut self, _: ID, _: T) {
+        unreachable!()
+    }
+
+    fn remove(&mut self, _: &ID) {
+        unreachable!()
+    }
+
+    fn contains(&self, _: &ID) -> bool {
+        unreachable!()
+    }
+}
+
+pub struct RocksDB<ID, T> {
+    id: PhantomData<ID>,
+    value: PhantomData<T>,
+}
+
+impl<ID, T> RocksDB<ID, T> {
+    pub fn new(_: &str) -> RocksDB<ID, T> {
+        panic!(UNAVAILABLE)
+    }
+}
+
+impl<ID, T> IDMap<ID, T> for RocksDB<ID, T> where
+ID: Sync + Send,
+T: Sync + Send,
+{
+    fn get(&self, _: ID) -> T {
+        unreachable!()
+    }
+
+    fn insert(&mut self, _: ID, _: T) {
+        unreachable!()
+    }
+
+    fn remove(&mut self, _: &ID) {
+        unreachable!()
+    }
+
+    fn contains(&self, _: &ID) -> bool {
+        unreachable!()
+    }
+}
@@ -9,6 +9,8 @@ use bincode::SizeLimit;
 use bincode::rustc_serialize::{encode, decode};
 use uuid::Uuid;
 
+use db::error::{StoreError, classify};
+
 use super::IDMap;
 
 pub struct TempRocksDB<ID, T> {
@@ -60,6 +62,22 @@ T: Sync + Send + Encodable + Decodable,
     fn remove(&mut self, id: &ID) {
         self.db.remove(id)
     }
+
+    fn contains(&self, id: &ID) -> bool {
+        self.db.contains(id)
+    }
+
+    fn try_get(&self, id: ID) -> Result<T, StoreError> {
+        self.db.try_get(id)
+    }
+
+    fn try_insert(&mut self, id: ID, value: T) -> Result<(), StoreError> {
+        self.db.try_insert(id, value)
+    }
+
+    fn try_remove(&mut self, id: &ID) -> Result<(), StoreError> {
+        self.db.try_remove(id)
+    }
 }
 
 pub struct RocksDB<ID, T> {
@@ -95,23 +113,66 @@ ID: Sync + Send + Encodable + Decodable,
 T: Sync + Send + Encodable + Decodable,
 {
     fn get(&self, id: ID) -> T {
+        self.try_get(id).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn insert(&mut self, id: ID, value: T) {
+        self.try_insert(id, value).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn remove(&mut self, id: &ID) {
+        self.try_remove(id).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn contains(&self, id: &ID) -> bool {
         let encoded_id: Vec<u8> = encode(&id, SizeLimit::Infinite).unwrap();
 
-        let encoded_value = self.db.get(&encoded_id).unwrap().unwrap();
+        self.db.get(&encoded_id).unwrap().is_some()
+    }
 
-        decode(&encoded_value).unwrap()
+    /// A missing or undecodable value is a permanent error, since the index
+    /// only refers to ids whose values were stored
+    ///
+    fn try_get(&self, id: ID) -> Result<T, StoreError> {
+        let encoded_id: Vec<u8> = encode(&id, SizeLimit::Infinite).unwrap();
+
+        let encoded_value = match self.db.get(&encoded_id) {
+            Ok(Some(encoded_value)) => encoded_value,
+            Ok(None) => return Err(StoreError::permanent("no value stored for an indexed id")),
+            Err(e) => return Err(classify(e)),
+        };
+
+        match decode(&encoded_value) {
+            Ok(value) => Ok(value),
+            Err(e) => Err(StoreError::permanent(format!("unable to decode value: {:?}", e))),
+        }
     }
 
-    fn insert(&mut self, id: ID, value: T) {
+    fn try_insert(&mut self, id: ID, value: T) -> Result<(), StoreError> {
         let encoded_id: Vec<u8> = encode(&id, SizeLimit::Infinite).unwrap();
         let encoded_value: Vec<u8> = encode(&value, SizeLimit::Infinite).unwrap();
 
-        self.db.put(&encoded_id, &encoded_value).unwrap();
+        self.db.put(&encoded_id, &encoded_value).map_err(classify)
     }
 
-    fn remove(&mut self, id: &ID) {
+    fn try_remove(&mut self, id: &ID) -> Result<(), StoreError> {
         let encoded_id: Vec<u8> = encode(&id, SizeLimit::Infinite).unwrap();
 
-        self.db.delete(&encoded_id).unwrap();
+        self.db.delete(&encoded_id).map_err(classify)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use db::id_map::{IDMap, TempRocksDB};
+
+    #[test]
+    fn missing_values_are_permanent_errors() {
+        let mut db: TempRocksDB<u64, u64> = TempRocksDB::new();
+        db.try_insert(1, 2).unwrap();
+        assert_eq!(db.try_get(1), Ok(2));
+
+        db.try_remove(&1).unwrap();
+        assert!(!db.try_get(1).unwrap_err().is_transient());
     }
 }
@@ -0,0 +1,285 @@
+//! Insert time tracking
+//!
+//! `InsertTimes` records when each value was inserted, so that queries can
+//! ask about recently inserted values (i.e. "has a similar value been seen in
+//! the last week?") without keeping a separate database per period.
+//!
+//! A value's time is set when it's first inserted; inserting a value which is
+//! already stored doesn't change it.  Times are only recorded for values
+//! inserted through the wrapper, so values already present in a persistent
+//! database when it's opened have no insert time.
+//!
+//! Concurrent writes of the same value are serialized (see `key_locks`), so
+//! a value's time is only kept while the value is stored.
+
+use std::collections::{HashMap, HashSet};
+use std::hash::Hash;
+use std::sync::Mutex;
+use std::time::SystemTime;
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+use db::key_locks::{KeyLocks, DEFAULT_STRIPES};
+
+pub struct InsertTimes<T> {
+    db: Box<Database<T>>,
+    times: Mutex<HashMap<T, SystemTime>>,
+    locks: KeyLocks,
+}
+
+impl<T: Clone + Eq + Hash> InsertTimes<T> {
+    pub fn new(db: Box<Database<T>>) -> InsertTimes<T> {
+        InsertTimes{db: db, times: Mutex::new(HashMap::new()), locks: KeyLocks::new(DEFAULT_STRIPES)}
+    }
+
+    fn record(&self, key: T, inserted: bool) -> bool {
+        if inserted {
+            self.times.lock().unwrap().insert(key, SystemTime::now());
+        }
+        inserted
+    }
+
+    fn forget(&self, key: &T, removed: bool) -> bool {
+        if removed {
+            self.times.lock().unwrap().remove(key);
+        }
+        removed
+    }
+}
+
+impl<T: Sync + Send + Clone + Eq + Hash> Database<T> for InsertTimes<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        self.db.get(key)
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        self.db.try_get(key)
+    }
+
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        self.db.get_bounded(key, max_candidates)
+    }
+
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        self.db.try_get_bounded(key, max_candidates)
+    }
+
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        self.db.get_iter(key)
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.db.any_within(key)
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.db.contains(key)
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.db.explain(key, value)
+    }
+
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.db.query_cost(key)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        let inserted = self.db.insert(key.clone());
+        self.record(key, inserted)
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        let removed = self.db.remove(key);
+        self.forget(key, removed)
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let inserted = self.db.insert_batch(keys.clone(), workers);
+
+        let now = SystemTime::now();
+        let mut times = self.times.lock().unwrap();
+        for (key, &inserted) in keys.into_iter().zip(inserted.iter()) {
+            if inserted {
+                times.insert(key, now);
+            }
+        }
+
+        inserted
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        let removed = try!(self.db.try_remove(key));
+        Ok(self.forget(key, removed))
+    }
+
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let inserted = self.db.try_insert_batch(keys.clone(), workers);
+
+        let now = SystemTime::now();
+        let mut times = self.times.lock().unwrap();
+        for (key, inserted) in keys.into_iter().zip(inserted.iter()) {
+            if inserted == &Ok(true) {
+                times.insert(key, now);
+            }
+        }
+
+        inserted
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        self.db.concurrent_writes()
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        let _lock = self.locks.lock(&key);
+        let inserted = self.db.insert_concurrent(key.clone());
+        self.record(key, inserted)
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        let _lock = self.locks.lock(key);
+        let removed = self.db.remove_concurrent(key);
+        self.forget(key, removed)
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        let _lock = self.locks.lock(&key);
+        let inserted = try!(self.db.try_insert_concurrent(key.clone()));
+        Ok(self.record(key, inserted))
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        let _lock = self.locks.lock(key);
+        let removed = try!(self.db.try_remove_concurrent(key));
+        Ok(self.forget(key, removed))
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        self.db.check()
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        self.db.repair()
+    }
+
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        self.db.plan_repair()
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        self.db.repair_batch(plan, max)
+    }
+
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        self.db.bucket_stats()
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.db.heavy_bucket_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.db.set_bucket_threshold(threshold)
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.db.set_repair_on_insert(repair)
+    }
+
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        self.db.memory()
+    }
+
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        self.db.for_each(f)
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.times.lock().unwrap().get(value).cloned()
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        self.times.lock().unwrap().iter()
+            .filter(|&(_, &t)| t < cutoff)
+            .map(|(v, _)| v.clone())
+            .collect()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::Arc;
+    use std::thread;
+    use std::time::{Duration, SystemTime};
+
+    use db::{Database, Factory, StorageBackend};
+    use db::insert_times::InsertTimes;
+    use db::sharded::Sharded;
+
+    #[test]
+    fn records_first_insert() {
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = InsertTimes::new(db);
+
+        let before = SystemTime::now();
+        assert!(db.insert(0b0001u64));
+        let inserted_at = db.inserted_at(&0b0001u64).unwrap();
+        assert!(inserted_at >= before);
+
+        // Re-inserting doesn't reset the time
+        assert!(!db.insert(0b0001u64));
+        assert_eq!(db.inserted_at(&0b0001u64), Some(inserted_at));
+
+        assert_eq!(db.insert_batch(vec![0xFF00u64], 2), vec![true]);
+        assert!(db.inserted_at(&0xFF00u64).is_some());
+    }
+
+    #[test]
+    fn forgets_removed_values() {
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = InsertTimes::new(db);
+
+        assert!(db.insert(0b0001u64));
+        assert!(db.remove(&0b0001u64));
+        assert_eq!(db.inserted_at(&0b0001u64), None);
+    }
+
+    #[test]
+    fn concurrent_writes_keep_times_in_step() {
+        let shards = (0..2).map(|_| <u64 as Factory>::build(64, 4, StorageBackend::InMemory)).collect();
+        let db = Arc::new(InsertTimes::new(Box::new(Sharded::new(shards))));
+
+        let writers: Vec<_> = (0..4).map(|i| {
+            let db = db.clone();
+            thread::spawn(move || {
+                for _ in 0..200 {
+                    match i % 2 {
+                        0 => { db.insert_concurrent(0b0001u64); },
+                        _ => { db.remove_concurrent(&0b0001u64); },
+                    }
+                }
+            })
+        }).collect();
+        for writer in writers.into_iter() {
+            writer.join().unwrap();
+        }
+
+        assert_eq!(db.contains(&0b0001u64), db.inserted_at(&0b0001u64).is_some());
+    }
+
+    #[test]
+    fn lists_values_inserted_before_cutoff() {
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = InsertTimes::new(db);
+
+        assert!(db.insert(0b0001u64));
+        let cutoff = SystemTime::now() + Duration::from_secs(1);
+
+        assert_eq!(db.inserted_before(cutoff), vec![0b0001u64]);
+        assert_eq!(db.inserted_before(cutoff - Duration::from_secs(3600)), vec![]);
+    }
+}
@@ -0,0 +1,69 @@
+//! Index consistency checks
+//!
+//! Each indexed value is stored in several places; its ID is added to a
+//! 0-variant and a number of 1-variant entries in every partition.  A value
+//! which is only partly indexed can be unfindable (because some partitions
+//! don't know about it) and yet impossible to delete (because `remove` gives
+//! up when the 0-variant entry is missing).  `Database::check` looks for
+//! entries which should exist but don't, and entries which refer to values
+//! which aren't indexed; `Database::repair` restores the former and removes
+//! the latter.
+//!
+//! Repairs can also be made a batch at a time, so the database can be
+//! written in between: `Database::plan_repair` finds the problems (needing
+//! only a read lock) and `Database::repair_batch` fixes some of them.  Fixes
+//! which writes made since the plan have made unnecessary are skipped.
+
+use std::any::Any;
+
+/// Results of a consistency check
+///
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct IntegrityReport {
+    /// Number of indexed values checked
+    pub values: usize,
+    /// Entries which should exist but don't
+    pub missing: usize,
+    /// Entries referring to values which aren't indexed
+    pub dangling: usize,
+}
+
+impl IntegrityReport {
+    pub fn is_ok(&self) -> bool {
+        self.missing == 0 && self.dangling == 0
+    }
+}
+
+/// The fixes for the problems found by a check, to be made a batch at a time
+///
+pub struct RepairPlan {
+    /// The problems found
+    pub report: IntegrityReport,
+    /// The fixes still to be made, in whatever form the database which made
+    /// the plan uses
+    fixes: Box<Any + Send>,
+    remaining: usize,
+}
+
+impl RepairPlan {
+    pub fn new<F: Any + Send>(report: IntegrityReport, fixes: F, remaining: usize) -> RepairPlan {
+        RepairPlan{report: report, fixes: Box::new(fixes), remaining: remaining}
+    }
+
+    /// The number of fixes not yet made
+    ///
+    pub fn remaining(&self) -> usize {
+        self.remaining
+    }
+
+    /// The fixes still to be made, if they're an `F`; the caller updates
+    /// `remaining` as it makes them
+    ///
+    pub fn fixes_mut<F: Any>(&mut self) -> Option<&mut F> {
+        self.fixes.downcast_mut::<F>()
+    }
+
+    pub fn set_remaining(&mut self, remaining: usize) {
+        self.remaining = remaining;
+    }
+}
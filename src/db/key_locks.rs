@@ -0,0 +1,45 @@
+//! Per-key write ordering
+//!
+//! Wrappers which keep state beside the database they wrap (insert times,
+//! recency) update it in two steps: first the wrapped database, then their
+//! own state.  Each step is atomic, but with concurrent writes (see
+//! `Database::insert_concurrent`) the steps of an insert and a remove of the
+//! same key can interleave, leaving the wrapper's state out of step with the
+//! database - i.e. an insert time recorded for a value which has since been
+//! removed.
+//!
+//! `KeyLocks` serializes writes to the same key.  Keys are striped over a
+//! fixed set of locks by hash, so writes to keys on different stripes still
+//! proceed in parallel.  Each write should hold only one key's lock at a time,
+//! since two keys can share a stripe.
+
+use std::hash::{Hash, Hasher};
+use std::sync::{Mutex, MutexGuard};
+
+use fnv::FnvHasher;
+
+/// Stripes used by wrappers; enough that writes of different keys rarely
+/// wait for each other
+pub const DEFAULT_STRIPES: usize = 64;
+
+pub struct KeyLocks {
+    stripes: Vec<Mutex<()>>,
+}
+
+impl KeyLocks {
+    pub fn new(stripes: usize) -> KeyLocks {
+        assert!(stripes > 0, "at least one stripe is required");
+
+        KeyLocks{stripes: (0..stripes).map(|_| Mutex::new(())).collect()}
+    }
+
+    /// Lock `key`'s stripe until the guard is dropped
+    ///
+    pub fn lock<T: Hash>(&self, key: &T) -> MutexGuard<()> {
+        let mut hasher = FnvHasher::default();
+        key.hash(&mut hasher);
+
+        let stripe = (hasher.finish() % self.stripes.len() as u64) as usize;
+        self.stripes[stripe].lock().unwrap()
+    }
+}
@@ -0,0 +1,343 @@
+//! Databases read without waiting for writes
+//!
+//! Queries normally share a database's lock, so they wait for any write in
+//! progress.  `LeftRight` keeps two copies of a database instead: queries
+//! read whichever copy is published, which is never written while it's
+//! published, and writes are made to the other copy, which is then published
+//! in its place (by swapping an index, so readers take no lock to find it).
+//! The write is then repeated on the copy which was published, once the
+//! queries which were already reading it have finished.
+//!
+//! Writers take turns, so writes aren't any faster than they would be with
+//! one copy (they're slower, being made twice), and the database takes twice
+//! the memory.  It suits read-heavy workloads, where queries would otherwise
+//! queue behind writes.
+//!
+//! # Examples
+//!
+//! ```ignore
+//! let db = LeftRight::new(Factory::build(64, 4, StorageBackend::InMemory), Factory::build(64, 4, StorageBackend::InMemory));
+//!
+//! db.insert_concurrent(0b0001);
+//! assert!(db.get(&0b0000).unwrap().contains(&0b0001));
+//! ```
+
+use std::collections::HashSet;
+use std::sync::{Mutex, RwLock, RwLockReadGuard, TryLockError};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::time::SystemTime;
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+
+pub struct LeftRight<T> {
+    copies: [RwLock<Box<Database<T>>>; 2],
+    /// The index of the copy queries read
+    published: AtomicUsize,
+    /// Held while writing, so writers take turns
+    writer: Mutex<()>,
+}
+
+impl<T> LeftRight<T> {
+    /// Create a database from two copies, which must hold the same values
+    /// (i.e. both be empty)
+    ///
+    pub fn new(left: Box<Database<T>>, right: Box<Database<T>>) -> LeftRight<T> {
+        LeftRight{copies: [RwLock::new(left), RwLock::new(right)], published: AtomicUsize::new(0), writer: Mutex::new(())}
+    }
+
+    /// The published copy
+    ///
+    /// A copy is only locked for writing once it's no longer published, so
+    /// if it's locked, another copy has been published since it was loaded.
+    ///
+    fn published(&self) -> RwLockReadGuard<Box<Database<T>>> {
+        loop {
+            match self.copies[self.published.load(Ordering::SeqCst)].try_read() {
+                Ok(db) => return db,
+                Err(TryLockError::WouldBlock) => continue,
+                Err(TryLockError::Poisoned(e)) => panic!("database copy poisoned: {}", e),
+            }
+        }
+    }
+
+    /// Make a write to the unpublished copy, publish it, then make the same
+    /// write to the other, returning the first copy's result
+    ///
+    fn write<R, F: FnMut(&mut Box<Database<T>>) -> R>(&self, mut f: F) -> R {
+        let _writer = self.writer.lock().unwrap();
+        let published = self.published.load(Ordering::SeqCst);
+        let standby = 1 - published;
+
+        let result = f(&mut *self.copies[standby].write().unwrap());
+        self.published.store(standby, Ordering::SeqCst);
+        // Waits for queries still reading the copy published before
+        f(&mut *self.copies[published].write().unwrap());
+
+        result
+    }
+
+    /// Make a write to both copies, returning the published copy's result;
+    /// being mutably borrowed, nothing is reading either
+    ///
+    fn write_both<R, F: FnMut(&mut Box<Database<T>>) -> R>(&mut self, mut f: F) -> R {
+        let published = self.published.load(Ordering::SeqCst);
+        let result = f(self.copies[published].get_mut().unwrap());
+        f(self.copies[1 - published].get_mut().unwrap());
+
+        result
+    }
+}
+
+impl<T: Sync + Send + Clone> Database<T> for LeftRight<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        self.published().get(key)
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        self.published().try_get(key)
+    }
+
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        self.published().get_bounded(key, max_candidates)
+    }
+
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        self.published().try_get_bounded(key, max_candidates)
+    }
+
+    /// Reads every match up front, since the copy's lock can't be held
+    /// across calls to `next`
+    ///
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        let found: Vec<T> = self.published().get_iter(key).collect();
+        Box::new(found.into_iter())
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.published().any_within(key)
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.published().contains(key)
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.published().explain(key, value)
+    }
+
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.published().query_cost(key)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        self.write_both(|db| db.insert(key.clone()))
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        self.write_both(|db| db.remove(key))
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        self.write_both(|db| db.try_remove(key))
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        self.write_both(|db| db.insert_batch(keys.clone(), workers))
+    }
+
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        self.write_both(|db| db.try_insert_batch(keys.clone(), workers))
+    }
+
+    /// Writers only need to share the DB's lock, so queries never wait for
+    /// it
+    ///
+    fn concurrent_writes(&self) -> bool {
+        true
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        self.write(|db| db.insert(key.clone()))
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        self.write(|db| db.remove(key))
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        self.write(|db| db.try_insert_batch(vec![key.clone()], 1).pop().unwrap())
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        self.write(|db| db.try_remove(key))
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        self.published().check()
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        self.write_both(|db| db.repair())
+    }
+
+    /// A plan for each copy, the published copy's first
+    ///
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        let _writer = self.writer.lock().unwrap();
+        let published = self.published.load(Ordering::SeqCst);
+
+        let first = match self.copies[published].read().unwrap().plan_repair() {
+            Some(plan) => plan,
+            None => return None,
+        };
+        let second = match self.copies[1 - published].read().unwrap().plan_repair() {
+            Some(plan) => plan,
+            None => return None,
+        };
+
+        let report = first.report.clone();
+        let remaining = first.remaining();
+        Some(RepairPlan::new(report, vec![first, second], remaining))
+    }
+
+    /// Makes up to `max` fixes to each copy, counting the first copy's
+    ///
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        let published = self.published.load(Ordering::SeqCst);
+        let (made, remaining) = match plan.fixes_mut::<Vec<RepairPlan>>() {
+            Some(plans) => {
+                let made = self.copies[published].get_mut().unwrap().repair_batch(&mut plans[0], max);
+                self.copies[1 - published].get_mut().unwrap().repair_batch(&mut plans[1], max);
+                (made, plans[0].remaining())
+            },
+            None => return 0,
+        };
+
+        plan.set_remaining(remaining);
+        made
+    }
+
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        self.published().bucket_stats()
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.published().heavy_bucket_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.write_both(|db| db.set_bucket_threshold(threshold))
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.write_both(|db| db.set_repair_on_insert(repair))
+    }
+
+    /// Memory summed across both copies
+    ///
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        let mut total = match self.copies[0].read().unwrap().memory() {
+            Some(memory) => memory,
+            None => return None,
+        };
+        match self.copies[1].read().unwrap().memory() {
+            Some(memory) => PartitionMemory::merge(&mut total, memory),
+            None => return None,
+        }
+
+        Some(total)
+    }
+
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        self.published().for_each(f)
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.published().inserted_at(value)
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        self.published().inserted_before(cutoff)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::Arc;
+    use std::sync::atomic::Ordering;
+    use std::thread;
+
+    use db::{Database, Factory, StorageBackend};
+    use db::left_right::LeftRight;
+
+    fn build() -> LeftRight<u64> {
+        LeftRight::new(<u64 as Factory>::build(64, 4, StorageBackend::InMemory), <u64 as Factory>::build(64, 4, StorageBackend::InMemory))
+    }
+
+    #[test]
+    fn writes_are_made_to_both_copies() {
+        let db = build();
+        assert!(db.insert_concurrent(0b0001u64));
+        assert!(!db.insert_concurrent(0b0001u64));
+        assert!(db.insert_concurrent(0b0011u64));
+        assert!(db.remove_concurrent(&0b0011u64));
+
+        for copy in db.copies.iter() {
+            assert_eq!(copy.read().unwrap().get(&0b0000u64), Some(vec![0b0001u64].into_iter().collect()));
+        }
+        assert_eq!(db.check().unwrap().values, 1);
+    }
+
+    #[test]
+    fn writes_swap_the_published_copy() {
+        let db = build();
+        let before = db.published.load(Ordering::SeqCst);
+        db.insert_concurrent(0b0001u64);
+        assert!(db.published.load(Ordering::SeqCst) != before);
+    }
+
+    #[test]
+    fn queries_do_not_wait_for_writes() {
+        let db = build();
+        db.insert_concurrent(0b0001u64);
+
+        // A write in progress holds the unpublished copy's lock
+        let standby = 1 - db.published.load(Ordering::SeqCst);
+        let _writing = db.copies[standby].write().unwrap();
+        assert!(db.get(&0b0000u64).unwrap().contains(&0b0001u64));
+    }
+
+    #[test]
+    fn concurrent_reads_and_writes() {
+        let db = Arc::new(build());
+
+        let writer = {
+            let db = db.clone();
+            thread::spawn(move || {
+                for i in 0..64u64 {
+                    db.insert_concurrent(i << 8);
+                }
+            })
+        };
+        let readers: Vec<_> = (0..4).map(|_| {
+            let db = db.clone();
+            thread::spawn(move || {
+                for i in 0..64u64 {
+                    db.get(&(i << 8));
+                }
+            })
+        }).collect();
+        writer.join().unwrap();
+        for h in readers.into_iter() {
+            h.join().unwrap();
+        }
+
+        for copy in db.copies.iter() {
+            assert_eq!(copy.read().unwrap().check().unwrap().values, 64);
+        }
+    }
+}
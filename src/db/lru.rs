@@ -0,0 +1,540 @@
+//! Key-level LRU eviction
+//!
+//! `Lru` bounds the number of keys stored in a database.  Keys are "used" when
+//! they're inserted or returned by a query; once more than `max_keys` keys are
+//! stored, the least recently used key is removed from the underlying database
+//! (and therefore from every partition) and passed to the eviction callback.
+//!
+//! Recency is only tracked for keys inserted through the wrapper, so keys
+//! already present in a persistent database when it's opened are never
+//! evicted.
+//!
+//! Eviction is deterministic: each use stamps the key with the next tick of a
+//! `Clock` (a counter by default), and the keys returned by a single query
+//! are used in an order which depends only on the keys themselves, so the
+//! same operations always evict the same keys.  Evictions can be observed
+//! with `subscribe`, as well as the callback.
+//!
+//! Concurrent writes of the same key are serialized (see `key_locks`).  A
+//! key chosen for eviction which is inserted or used again before it's
+//! removed is kept.
+
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::hash::{Hash, Hasher};
+use std::sync::Mutex;
+use std::sync::mpsc::{channel, Receiver, Sender};
+use std::time::SystemTime;
+
+use fnv::FnvHasher;
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+use db::key_locks::{KeyLocks, DEFAULT_STRIPES};
+
+/// Source of the ticks keys are stamped with when they're used
+///
+/// Ticks must strictly increase; the key with the lowest tick is evicted
+/// first.
+///
+pub trait Clock: Send {
+    fn tick(&mut self) -> u64;
+}
+
+/// Counts uses, starting after the given tick (the default clock starts
+/// after 0)
+///
+pub struct Sequence(pub u64);
+
+impl Clock for Sequence {
+    fn tick(&mut self) -> u64 {
+        self.0 += 1;
+        self.0
+    }
+}
+
+/// A key evicted to make room for another
+///
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct Eviction<T> {
+    pub key: T,
+    /// Tick the key was last used at
+    pub last_used: u64,
+}
+
+struct Recency<T> {
+    clock: Box<Clock>,
+    ticks: HashMap<T, u64>,
+    keys: BTreeMap<u64, T>,
+}
+
+impl<T: Clone + Eq + Hash> Recency<T> {
+    fn touch(&mut self, key: &T) {
+        let tick = self.clock.tick();
+
+        match self.ticks.insert(key.clone(), tick) {
+            Some(old_tick) => { self.keys.remove(&old_tick); },
+            None => {},
+        }
+        self.keys.insert(tick, key.clone());
+    }
+
+    /// Mark each of `found` as used, in an order independent of the set's
+    /// iteration order
+    ///
+    fn touch_all(&mut self, found: &HashSet<T>) {
+        let mut found: Vec<(u64, &T)> = found.iter().map(|v| {
+            let mut hasher = FnvHasher::default();
+            v.hash(&mut hasher);
+            (hasher.finish(), v)
+        }).collect();
+        found.sort_by_key(|&(hash, _)| hash);
+
+        for (_, v) in found.into_iter() {
+            self.touch(v);
+        }
+    }
+
+    fn forget(&mut self, key: &T) {
+        match self.ticks.remove(key) {
+            Some(old_tick) => { self.keys.remove(&old_tick); },
+            None => {},
+        }
+    }
+
+    fn tracks(&self, key: &T) -> bool {
+        self.ticks.contains_key(key)
+    }
+
+    fn oldest(&self) -> Option<(u64, T)> {
+        self.keys.iter().next().map(|(tick, key)| (*tick, key.clone()))
+    }
+}
+
+pub struct Lru<T> {
+    db: Box<Database<T>>,
+    max_keys: usize,
+    recency: Mutex<Recency<T>>,
+    on_evict: Box<Fn(&T) + Sync + Send>,
+    subscribers: Mutex<Vec<Sender<Eviction<T>>>>,
+    locks: KeyLocks,
+}
+
+impl<T: Send + Clone + Eq + Hash> Lru<T> {
+    pub fn new(db: Box<Database<T>>, max_keys: usize, on_evict: Box<Fn(&T) + Sync + Send>) -> Lru<T> {
+        Lru::with_clock(db, max_keys, Box::new(Sequence(0)), on_evict)
+    }
+
+    /// Like `new`, stamping uses with ticks from `clock`
+    ///
+    pub fn with_clock(db: Box<Database<T>>, max_keys: usize, clock: Box<Clock>, on_evict: Box<Fn(&T) + Sync + Send>) -> Lru<T> {
+        let recency = Recency{clock: clock, ticks: HashMap::new(), keys: BTreeMap::new()};
+
+        Lru{db: db, max_keys: max_keys, recency: Mutex::new(recency), on_evict: on_evict, subscribers: Mutex::new(vec![]), locks: KeyLocks::new(DEFAULT_STRIPES)}
+    }
+
+    /// Number of keys being tracked
+    ///
+    pub fn len(&self) -> usize {
+        self.recency.lock().unwrap().ticks.len()
+    }
+
+    /// Receive every key evicted from now on, in the order they're evicted
+    ///
+    /// Evictions are sent after the key is removed from the database and the
+    /// callback is called.  The channel is unbounded, so subscribers should
+    /// keep up or drop their receiver.
+    ///
+    pub fn subscribe(&self) -> Receiver<Eviction<T>> {
+        let (tx, rx) = channel();
+        self.subscribers.lock().unwrap().push(tx);
+        rx
+    }
+
+    /// Mark `key` as used, returning the keys which should be evicted to
+    /// make room for it
+    ///
+    fn touch_and_evict(&self, key: &T) -> Vec<Eviction<T>> {
+        let mut recency = self.recency.lock().unwrap();
+        recency.touch(key);
+
+        let mut evicted = vec![];
+        while recency.ticks.len() > self.max_keys {
+            match recency.oldest() {
+                Some((tick, oldest)) => {
+                    recency.forget(&oldest);
+                    evicted.push(Eviction{key: oldest, last_used: tick});
+                },
+                None => break,
+            }
+        }
+        evicted
+    }
+
+    /// Remove an evicted key from the database, unless it's been inserted or
+    /// used again since it was chosen
+    ///
+    fn evict_concurrent(&self, eviction: Eviction<T>) {
+        let _lock = self.locks.lock(&eviction.key);
+        if self.recency.lock().unwrap().tracks(&eviction.key) {
+            return
+        }
+
+        // As with `try_insert_batch`, an eviction which fails isn't reported
+        if self.db.try_remove_concurrent(&eviction.key).is_ok() {
+            self.notify(eviction);
+        }
+    }
+
+    /// Notify the callback and subscribers of `eviction`, dropping
+    /// subscribers whose receivers are gone
+    ///
+    fn notify(&self, eviction: Eviction<T>) {
+        (self.on_evict)(&eviction.key);
+
+        let mut subscribers = self.subscribers.lock().unwrap();
+        subscribers.retain(|tx| tx.send(eviction.clone()).is_ok());
+    }
+}
+
+impl<T: Sync + Send + Clone + Eq + Hash> Database<T> for Lru<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        let found = self.db.get(key);
+
+        match found {
+            Some(ref found) => {
+                self.recency.lock().unwrap().touch_all(found);
+            },
+            None => {},
+        }
+
+        found
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        let found = try!(self.db.try_get(key));
+
+        match found {
+            Some(ref found) => {
+                self.recency.lock().unwrap().touch_all(found);
+            },
+            None => {},
+        }
+
+        Ok(found)
+    }
+
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        let (found, overflowed) = self.db.get_bounded(key, max_candidates);
+
+        match found {
+            Some(ref found) => {
+                self.recency.lock().unwrap().touch_all(found);
+            },
+            None => {},
+        }
+
+        (found, overflowed)
+    }
+
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        let (found, overflowed) = try!(self.db.try_get_bounded(key, max_candidates));
+
+        match found {
+            Some(ref found) => {
+                self.recency.lock().unwrap().touch_all(found);
+            },
+            None => {},
+        }
+
+        Ok((found, overflowed))
+    }
+
+    /// Values are marked as used as they're produced
+    ///
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        Box::new(self.db.get_iter(key).map(move |v| {
+            self.recency.lock().unwrap().touch(&v);
+            v
+        }))
+    }
+
+    /// Only the match found is marked as used
+    ///
+    fn any_within(&self, key: &T) -> bool {
+        let found = self.db.get_iter(key).next();
+
+        match found {
+            Some(ref v) => {
+                self.recency.lock().unwrap().touch(v);
+                true
+            },
+            None => false,
+        }
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.db.contains(key)
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.db.explain(key, value)
+    }
+
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.db.query_cost(key)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        let inserted = self.db.insert(key.clone());
+
+        for eviction in self.touch_and_evict(&key).into_iter() {
+            self.db.remove(&eviction.key);
+            self.notify(eviction);
+        }
+
+        inserted
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        self.recency.lock().unwrap().forget(key);
+        self.db.remove(key)
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let inserted = self.db.insert_batch(keys.clone(), workers);
+
+        for key in keys.iter() {
+            for eviction in self.touch_and_evict(key).into_iter() {
+                self.db.remove(&eviction.key);
+                self.notify(eviction);
+            }
+        }
+
+        inserted
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        self.recency.lock().unwrap().forget(key);
+        self.db.try_remove(key)
+    }
+
+    /// Only keys which were stored are marked as used.  An eviction which
+    /// fails isn't reported, and leaves the evicted value stored
+    ///
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let inserted = self.db.try_insert_batch(keys.clone(), workers);
+
+        for (key, result) in keys.iter().zip(inserted.iter()) {
+            if result.is_err() {
+                continue
+            }
+            for eviction in self.touch_and_evict(key).into_iter() {
+                if self.db.try_remove(&eviction.key).is_ok() {
+                    self.notify(eviction);
+                }
+            }
+        }
+
+        inserted
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        self.db.concurrent_writes()
+    }
+
+    /// Evictions are made after `key`'s lock is released, since an evicted
+    /// key may share its stripe
+    ///
+    fn insert_concurrent(&self, key: T) -> bool {
+        let (inserted, evicted) = {
+            let _lock = self.locks.lock(&key);
+            let inserted = self.db.insert_concurrent(key.clone());
+            (inserted, self.touch_and_evict(&key))
+        };
+
+        for eviction in evicted.into_iter() {
+            self.evict_concurrent(eviction);
+        }
+
+        inserted
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        let _lock = self.locks.lock(key);
+        self.recency.lock().unwrap().forget(key);
+        self.db.remove_concurrent(key)
+    }
+
+    /// Only a key which was stored is marked as used
+    ///
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        let (inserted, evicted) = {
+            let _lock = self.locks.lock(&key);
+            let inserted = try!(self.db.try_insert_concurrent(key.clone()));
+            (inserted, self.touch_and_evict(&key))
+        };
+
+        for eviction in evicted.into_iter() {
+            self.evict_concurrent(eviction);
+        }
+
+        Ok(inserted)
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        let _lock = self.locks.lock(key);
+        self.recency.lock().unwrap().forget(key);
+        self.db.try_remove_concurrent(key)
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        self.db.check()
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        self.db.repair()
+    }
+
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        self.db.plan_repair()
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        self.db.repair_batch(plan, max)
+    }
+
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        self.db.bucket_stats()
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.db.heavy_bucket_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.db.set_bucket_threshold(threshold)
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.db.set_repair_on_insert(repair)
+    }
+
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        self.db.memory()
+    }
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        self.db.for_each(f)
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.db.inserted_at(value)
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        self.db.inserted_before(cutoff)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+    use std::sync::{Arc, Mutex};
+
+    use db::{Database, Factory, StorageBackend};
+    use db::lru::{Eviction, Lru, Sequence};
+
+    #[test]
+    fn evicts_least_recently_used() {
+        let evicted = Arc::new(Mutex::new(vec![]));
+        let evicted_clone = evicted.clone();
+
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Lru::new(db, 2, Box::new(move |k: &u64| evicted_clone.lock().unwrap().push(*k)));
+
+        db.insert(0b0001u64);
+        db.insert(0xFF00u64);
+        // Touch 0b0001, so 0xFF00 is the least recently used
+        db.get(&0b0001u64);
+        db.insert(0xFFFF0000u64 << 16);
+
+        assert_eq!(*evicted.lock().unwrap(), vec![0xFF00u64]);
+        assert_eq!(db.len(), 2);
+
+        let mut expected = HashSet::new();
+        expected.insert(0b0001u64);
+        assert_eq!(Some(expected), db.get(&0b0000u64));
+    }
+
+    #[test]
+    fn removed_keys_are_not_evicted() {
+        let evicted = Arc::new(Mutex::new(vec![]));
+        let evicted_clone = evicted.clone();
+
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Lru::new(db, 1, Box::new(move |k: &u64| evicted_clone.lock().unwrap().push(*k)));
+
+        db.insert(0b0001u64);
+        db.remove(&0b0001u64);
+        db.insert(0b1000u64);
+
+        assert!(evicted.lock().unwrap().is_empty());
+    }
+
+    #[test]
+    fn evictions_are_sent_to_subscribers() {
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Lru::with_clock(db, 1, Box::new(Sequence(100)), Box::new(|_: &u64| {}));
+        let evictions = db.subscribe();
+
+        db.insert(0b0001u64);
+        db.insert(0xFF00u64);
+
+        assert_eq!(evictions.try_recv(), Ok(Eviction{key: 0b0001u64, last_used: 101}));
+        assert!(evictions.try_recv().is_err());
+    }
+
+    #[test]
+    fn dropped_subscribers_are_skipped() {
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Lru::new(db, 1, Box::new(|_: &u64| {}));
+        drop(db.subscribe());
+
+        db.insert(0b0001u64);
+        db.insert(0xFF00u64);
+
+        assert_eq!(db.len(), 1);
+    }
+
+    #[test]
+    fn query_results_are_used_in_a_fixed_order() {
+        // Each DB's result sets iterate in a different order, but the same
+        // operations must evict the same keys
+        let run = || {
+            let evicted = Arc::new(Mutex::new(vec![]));
+            let evicted_clone = evicted.clone();
+
+            let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+            let mut db = Lru::new(db, 4, Box::new(move |k: &u64| evicted_clone.lock().unwrap().push(*k)));
+
+            for k in [0b0001u64, 0b0010u64, 0b0100u64, 0b1000u64].iter() {
+                db.insert(*k);
+            }
+            // Uses all four, in an order the result set doesn't decide
+            db.get(&0b0000u64);
+            db.insert(0xFF00u64 << 32);
+            db.insert(0xFF00u64 << 16);
+
+            let evicted = evicted.lock().unwrap().clone();
+            evicted
+        };
+
+        let first = run();
+        assert_eq!(first.len(), 2);
+        for _ in 0..10 {
+            assert_eq!(run(), first);
+        }
+    }
+}
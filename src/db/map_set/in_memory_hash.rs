@@ -1,19 +1,31 @@
 use std::clone::Clone;
 use std::default::Default;
-use std::cmp::Eq;
+use std::cmp::{max, Eq};
 use std::hash::Hash;
+use std::mem::size_of;
 
 use std::collections::{HashMap, HashSet};
 use std::collections::hash_map::Entry::{Vacant, Occupied};
 
 use super::MapSet;
+use super::slab::{Chunk, Slabs};
+
+/// The values stored under a key: the first `usize` values of a slab chunk,
+/// or a hash set once they outgrow the largest chunk
+///
+#[derive(Debug)]
+enum Bucket<V> {
+    Small(Chunk, usize),
+    Large(HashSet<V>),
+}
 
 #[derive(Debug)]
 pub struct InMemoryHash<K, V>
 where   K: Sync + Send + Clone + Eq + Hash, 
         V: Sync + Send + Clone + Eq + Hash, 
 {
-    data: HashMap<K, HashSet<V>>,
+    data: HashMap<K, Bucket<V>>,
+    slabs: Slabs<V>,
 }
 
 impl<K, V> InMemoryHash<K, V>
@@ -21,7 +33,13 @@ where   K: Sync + Send + Clone + Eq + Hash,
         V: Sync + Send + Clone + Eq + Hash, 
 {
     pub fn new() -> InMemoryHash<K, V> {
-        InMemoryHash {data: HashMap::new()}
+        InMemoryHash {data: HashMap::new(), slabs: Slabs::new()}
+    }
+
+    /// Bytes of each key's bucket in the map, not counting the values it holds
+    ///
+    pub fn bucket_size() -> usize {
+        size_of::<Bucket<V>>()
     }
 }
 
@@ -39,44 +57,114 @@ where   K: Sync + Send + Clone + Eq + Hash,
         V: Sync + Send + Clone + Eq + Hash, 
 {
     fn insert(&mut self, key: K, value: V) -> bool {
+        let slabs = &mut self.slabs;
         match self.data.entry(key) {
             Vacant(entry) => {
-                let mut set: HashSet<V> = HashSet::new();
-                set.insert(value);
-                entry.insert(set);
+                // New chunks are filled with the value
+                let chunk = slabs.alloc(1, &value).unwrap();
+                entry.insert(Bucket::Small(chunk, 1));
                 true
             },
             Occupied(mut entry) => {
-                entry.get_mut().insert(value)
+                let bucket = entry.get_mut();
+                let (chunk, len) = match *bucket {
+                    Bucket::Large(ref mut set) => return set.insert(value),
+                    Bucket::Small(chunk, len) => (chunk, len),
+                };
+
+                if slabs.get(chunk)[..len].contains(&value) {
+                    return false
+                }
+
+                if len < chunk.capacity() {
+                    slabs.get_mut(chunk)[len] = value;
+                    *bucket = Bucket::Small(chunk, len + 1);
+                    return true
+                }
+
+                // Full, so move to the next size up
+                let values = slabs.get(chunk)[..len].to_vec();
+                slabs.free(chunk);
+                *bucket = match slabs.alloc(len + 1, &value) {
+                    Some(grown) => {
+                        slabs.get_mut(grown)[..len].clone_from_slice(&values);
+                        slabs.get_mut(grown)[len] = value;
+                        Bucket::Small(grown, len + 1)
+                    },
+                    None => {
+                        let mut set: HashSet<V> = values.into_iter().collect();
+                        set.insert(value);
+                        Bucket::Large(set)
+                    },
+                };
+                true
             },
         }
     }
 
     fn get(&self, key: &K) -> Option<HashSet<V>> {
         match self.data.get(key) {
-            Some(h) => Some(h.clone()),
+            Some(&Bucket::Small(chunk, len)) => Some(self.slabs.get(chunk)[..len].iter().cloned().collect()),
+            Some(&Bucket::Large(ref set)) => Some(set.clone()),
             None => None,
         }
     }
 
-    fn remove(&mut self, key: &K, value: &V) -> bool {
-        let mut delete_key = false;
+    fn iter<'a>(&'a self) -> Box<Iterator<Item = (K, V)> + 'a> {
+        let slabs = &self.slabs;
+        Box::new(self.data.iter().flat_map(move |(k, bucket)| {
+            let values: Vec<V> = match *bucket {
+                Bucket::Small(chunk, len) => slabs.get(chunk)[..len].to_vec(),
+                Bucket::Large(ref set) => set.iter().cloned().collect(),
+            };
+            values.into_iter().map(move |v| (k.clone(), v))
+        }))
+    }
 
-        let removed = match self.data.entry(key.clone()) {
-            Vacant(..) => {
-                false
-            },
-            Occupied(mut entry) => {
-                let set = entry.get_mut();
-                let removed = set.remove(value);
-                if set.is_empty() { delete_key = true };
-                removed
+    fn len(&self, key: &K) -> usize {
+        match self.data.get(key) {
+            Some(&Bucket::Small(_, len)) => len,
+            Some(&Bucket::Large(ref set)) => set.len(),
+            None => 0,
+        }
+    }
+
+    fn footprint<'a>(&'a self) -> Option<Box<Iterator<Item = (&'a K, usize, usize)> + 'a>> {
+        // Each key's slot in the map (a hash, the key and its bucket), with
+        // its share of the map's empty slots, then the bucket's chunk or set.
+        // Freed chunks waiting for reuse aren't counted.
+        let slot = (size_of::<u64>() + size_of::<K>() + size_of::<Bucket<V>>()) * max(self.data.capacity(), 1) / max(self.data.len(), 1);
+        Some(Box::new(self.data.iter().map(move |(k, bucket)| {
+            match *bucket {
+                Bucket::Small(chunk, len) => (k, len, slot + chunk.capacity() * size_of::<V>()),
+                Bucket::Large(ref set) => (k, set.len(), slot + set.capacity() * (size_of::<u64>() + size_of::<V>())),
+            }
+        })))
+    }
+
+    fn remove(&mut self, key: &K, value: &V) -> bool {
+        let (removed, remaining) = match self.data.get_mut(key) {
+            None => return false,
+            Some(&mut Bucket::Large(ref mut set)) => (set.remove(value), set.len()),
+            Some(&mut Bucket::Small(chunk, ref mut len)) => {
+                let values = self.slabs.get_mut(chunk);
+                match values[..*len].iter().position(|v| v == value) {
+                    Some(i) => {
+                        values.swap(i, *len - 1);
+                        *len -= 1;
+                        (true, *len)
+                    },
+                    None => (false, *len),
+                }
             },
         };
 
-        if delete_key {
-            self.data.remove(key);
-        };
+        if remaining == 0 {
+            match self.data.remove(key) {
+                Some(Bucket::Small(chunk, _)) => self.slabs.free(chunk),
+                _ => {},
+            }
+        }
 
         removed
     }
@@ -88,6 +176,8 @@ mod test {
 
     use self::quickcheck::quickcheck;
 
+    use std::collections::HashSet;
+
     use db::map_set::{MapSet, InMemoryHash};
 
     #[test]
@@ -199,4 +289,52 @@ mod test {
         }
         quickcheck(prop as fn(u64, u64, u64, u64) -> quickcheck::TestResult);
     }
+
+    #[test]
+    fn footprint_counts_each_set() {
+        let mut db = InMemoryHash::new();
+        db.insert(1u64, 10u64);
+        db.insert(1u64, 11u64);
+        db.insert(2u64, 10u64);
+
+        let mut sets: Vec<(u64, usize)> = db.footprint().unwrap().map(|(k, len, bytes)| {
+            assert!(bytes >= len * 16);
+            (*k, len)
+        }).collect();
+        sets.sort();
+        assert_eq!(sets, vec![(1, 2), (2, 1)]);
+    }
+
+    #[test]
+    fn sets_outgrow_their_chunks() {
+        let mut db = InMemoryHash::new();
+        for v in 0..100u64 {
+            assert!(db.insert(1u64, v));
+            assert!(!db.insert(1u64, v));
+            assert_eq!(db.len(&1), v as usize + 1);
+        }
+        let all: HashSet<u64> = (0..100).collect();
+        assert_eq!(db.get(&1).unwrap(), all);
+
+        for v in 0..100u64 {
+            assert!(db.remove(&1, &v));
+        }
+        assert_eq!(db.get(&1), None);
+    }
+
+    #[test]
+    fn removing_from_a_chunk_keeps_the_rest() {
+        let mut db = InMemoryHash::new();
+        for v in 0..5u64 {
+            db.insert(1u64, v);
+        }
+        db.remove(&1, &1);
+        db.remove(&1, &7);
+
+        let rest: HashSet<u64> = vec![0, 2, 3, 4].into_iter().collect();
+        assert_eq!(db.get(&1).unwrap(), rest);
+        let mut values: Vec<u64> = db.iter().map(|(_, v)| v).collect();
+        values.sort();
+        assert_eq!(values, vec![0, 2, 3, 4]);
+    }
 }
@@ -30,20 +30,84 @@ use std::cmp::Eq;
 use std::hash::Hash;
 use std::collections::HashSet;
 
+use db::error::StoreError;
+
 mod in_memory_hash;
+mod slab;
+#[cfg(feature = "rocksdb")]
 mod rocks_db;
+#[cfg(not(feature = "rocksdb"))]
+mod no_rocks_db;
 
 pub use self::in_memory_hash::InMemoryHash;
+pub use self::slab::MAX_CHUNK;
+#[cfg(feature = "rocksdb")]
 pub use self::rocks_db::{RocksDB, TempRocksDB};
+#[cfg(not(feature = "rocksdb"))]
+pub use self::no_rocks_db::{RocksDB, TempRocksDB};
 
+/// Storage for a database's index (its variant store)
+///
+/// This is the extension point for custom storage backends: implement it for
+/// your store, name it as the `VariantStore` of a `TypeMap`, and pass an
+/// instance to `substitution::DB::with_stores` or `deletion::DB::with_stores`.
+/// Stores are only written through `&mut self`, so the database's own locking
+/// is all the synchronization they need.
+///
+/// Stores which can fail (i.e. on I/O) should report it from the `try_`
+/// methods, which databases use to return errors from their own `try_`
+/// methods (see `db::error`).  The other methods can't return errors, so they
+/// should panic rather than lose a write, as the RocksDB stores do; a missed
+/// write leaves the index inconsistent (see `Database::check`).
+///
 pub trait MapSet<K, V>: Sync + Send where 
 K: Clone + Eq + Hash,
 V: Clone + Eq + Hash,
 {
 
+    /// Add `value` to the set at `key`, returning false if it was already
+    /// there
     fn insert(&mut self, key: K, value: V) -> bool;
+
+    /// The set at `key`, or `None` if it's empty (stores shouldn't return
+    /// empty sets)
     fn get(&self, key: &K) -> Option<HashSet<V>>;
+
+    /// Remove `value` from the set at `key`, returning false if it wasn't
+    /// there.  A set whose last value is removed should be dropped
     fn remove(&mut self, key: &K, value: &V) -> bool;
+
+    /// Like `insert`, but returns an error if the store fails
+    fn try_insert(&mut self, key: K, value: V) -> Result<bool, StoreError> {
+        Ok(self.insert(key, value))
+    }
+
+    /// Like `get`, but returns an error if the store fails
+    fn try_get(&self, key: &K) -> Result<Option<HashSet<V>>, StoreError> {
+        Ok(self.get(key))
+    }
+
+    /// Like `remove`, but returns an error if the store fails
+    fn try_remove(&mut self, key: &K, value: &V) -> Result<bool, StoreError> {
+        Ok(self.remove(key, value))
+    }
+
+    /// Iterate over every `(key, value)` pair
+    fn iter<'a>(&'a self) -> Box<Iterator<Item = (K, V)> + 'a>;
+
+    /// Number of values in the set at `key`
+    fn len(&self, key: &K) -> usize {
+        match self.get(key) {
+            Some(set) => set.len(),
+            None => 0,
+        }
+    }
+
+    /// Each key with the number of values in its set and the approximate
+    /// bytes of memory they take, if the sets are held in memory
+    fn footprint<'a>(&'a self) -> Option<Box<Iterator<Item = (&'a K, usize, usize)> + 'a>> {
+        None
+    }
 }
 
 /*
@@ -0,0 +1,79 @@
+//! Stand-ins for the RocksDB stores when built without the `rocksdb` feature
+//!
+//! These keep the persistent typemaps defined, but can't be constructed;
+//! callers should check `StorageBackend::rocksdb_available` before asking
+//! for a RocksDB backend.
+
+use std::clone::Clone;
+use std::cmp::Eq;
+use std::hash::Hash;
+use std::marker::PhantomData;
+use std::collections::HashSet;
+
+use super::MapSet;
+
+const UNAVAILABLE: &'static str = "hammer was built without RocksDB support (enable the `rocksdb` feature)";
+
+pub struct TempRocksDB<K, V> {
+    key: PhantomData<K>,
+    value: PhantomData<V>,
+}
+
+impl<K, V> TempRocksDB<K, V> {
+    pub fn new() -> TempRocksDB<K, V> {
+        panic!(UNAVAILABLE)
+    }
+}
+
+impl<K, V> MapSet<K, V> for TempRocksDB<K, V>
+where   K: Sync + Send + Clone + Eq + Hash,
+V: Sync + Send + Clone + Eq + Hash,
+{
+    fn insert(&mut self, _: K, _: V) -> bool {
+        unreachable!()
+    }
+
+    fn get(&self, _: &K) -> Option<HashSet<V>> {
+        unreachable!()
+    }
+
+    fn remove(&mut self, _: &K, _: &V) -> bool {
+        unreachable!()
+    }
+
+    fn iter<'a>(&'a self) -> Box<Iterator<Item = (K, V)> + 'a> {
+        unreachable!()
+    }
+}
+
+pub struct RocksDB<K, V> {
+    key: PhantomData<K>,
+    value: PhantomData<V>,
+}
+
+impl<K, V> RocksDB<K, V> {
+    pub fn new(_: &str) -> RocksDB<K, V> {
+        panic!(UNAVAILABLE)
+    }
+}
+
+impl<K, V> MapSet<K, V> for RocksDB<K, V>
+where   K: Sync + Send + Clone + Eq + Hash,
+V: Sync + Send + Clone + Eq + Hash,
+{
+    fn insert(&mut self, _: K, _: V) -> bool {
+        unreachable!()
+    }
+
+    fn get(&self, _: &K) -> Option<HashSet<V>> {
+        unreachable!()
+    }
+
+    fn remove(&mut self, _: &K, _: &V) -> bool {
+        unreachable!()
+    }
+
+    fn iter<'a>(&'a self) -> Box<Iterator<Item = (K, V)> + 'a> {
+        unreachable!()
+    }
+}
@@ -15,6 +15,8 @@ use bincode::SizeLimit;
 use bincode::rustc_serialize::{encode, decode};
 use uuid::Uuid;
 
+use db::error::{StoreError, classify};
+
 use super::MapSet;
 
 pub struct TempRocksDB<K, V> {
@@ -66,6 +68,22 @@ V: Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
     fn remove(&mut self, key: &K, value: &V) -> bool {
         self.db.remove(key, value)
     }
+
+    fn try_insert(&mut self, key: K, value: V) -> Result<bool, StoreError> {
+        self.db.try_insert(key, value)
+    }
+
+    fn try_get(&self, key: &K) -> Result<Option<HashSet<V>>, StoreError> {
+        self.db.try_get(key)
+    }
+
+    fn try_remove(&mut self, key: &K, value: &V) -> Result<bool, StoreError> {
+        self.db.try_remove(key, value)
+    }
+
+    fn iter<'a>(&'a self) -> Box<Iterator<Item = (K, V)> + 'a> {
+        self.db.iter()
+    }
 }
 
 /// RocksDB uses RocksDB to store a mapping from keys to sets of values
@@ -108,28 +126,41 @@ where   K: Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
 V: Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
 {
     fn insert(&mut self, key: K, value: V) -> bool {
+        self.try_insert(key, value).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn get(&self, key: &K) -> Option<HashSet<V>> {
+        self.try_get(key).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn remove(&mut self, key: &K, value: &V) -> bool {
+        self.try_remove(key, value).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn try_insert(&mut self, key: K, value: V) -> Result<bool, StoreError> {
         let encoded_key: Vec<u8> = encode(&(key.clone(), value.clone()), SizeLimit::Infinite).unwrap();
 
         match self.db.get(&encoded_key) {
-            Ok(Some(_)) => {
-                return false
-            },
-            Err(e) => {
-                panic!(e)
-            },
-            Ok(None) => {
-                self.db.put(&encoded_key, &[]).unwrap();
-                true
+            Ok(Some(_)) => Ok(false),
+            Err(e) => Err(classify(e)),
+            Ok(None) => match self.db.put(&encoded_key, &[]) {
+                Ok(_) => Ok(true),
+                Err(e) => Err(classify(e)),
             },
         }
     }
 
-    fn get(&self, key: &K) -> Option<HashSet<V>> {
+    /// Entries which can't be decoded are reported as permanent errors
+    ///
+    fn try_get(&self, key: &K) -> Result<Option<HashSet<V>>, StoreError> {
         let mut out = HashSet::new();
         let encoded_key_prefix: Vec<u8> = encode(&key, SizeLimit::Infinite).unwrap();
 
         for (k, _) in self.db.iterator(IteratorMode::From(&encoded_key_prefix, Direction::forward)) {
-            let (decoded_key, decoded_value): (K, V) = decode(&k).unwrap();
+            let (decoded_key, decoded_value): (K, V) = match decode(&k) {
+                Ok(v) => v,
+                Err(e) => return Err(StoreError::permanent(format!("unable to decode entry: {:?}", e))),
+            };
 
             if *key != decoded_key {
                 break
@@ -138,26 +169,32 @@ V: Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
         }
 
         if out.is_empty() {
-            None
+            Ok(None)
         } else {
-            Some(out)
+            Ok(Some(out))
         }
     }
 
-    fn remove(&mut self, key: &K, value: &V) -> bool {
+    fn try_remove(&mut self, key: &K, value: &V) -> Result<bool, StoreError> {
         let encoded_key: Vec<u8> = encode(&(key, value), SizeLimit::Infinite).unwrap();
 
         match self.db.get(&encoded_key) {
-            Err(e) => panic!(e),
-            Ok(None) => return false,
-            Ok(Some(_)) => {
-                self.db.delete(&encoded_key).unwrap();
-                true
-            }
+            Err(e) => Err(classify(e)),
+            Ok(None) => Ok(false),
+            Ok(Some(_)) => match self.db.delete(&encoded_key) {
+                Ok(_) => Ok(true),
+                Err(e) => Err(classify(e)),
+            },
         }
     }
-}
 
+    fn iter<'a>(&'a self) -> Box<Iterator<Item = (K, V)> + 'a> {
+        Box::new(self.db.iterator(IteratorMode::Start).map(|(k, _)| {
+            let (decoded_key, decoded_value): (K, V) = decode(&k).unwrap();
+            (decoded_key, decoded_value)
+        }))
+    }
+}
 
 #[cfg(test)] 
 mod test {
@@ -166,6 +203,7 @@ mod test {
     use self::quickcheck::quickcheck;
 
     use db::map_set::{MapSet, TempRocksDB};
+    use db::error::classify;
 
     #[test]
     fn inserted_exists() {
@@ -276,4 +314,11 @@ mod test {
         }
         quickcheck(prop as fn(u64, u64, u64, u64) -> quickcheck::TestResult);
     }
+
+    #[test]
+    fn classifies_errors() {
+        assert!(classify("IO error: Resource busy".to_string()).is_transient());
+        assert!(classify("Operation timed out".to_string()).is_transient());
+        assert!(!classify("Corruption: bad block contents".to_string()).is_transient());
+    }
 }
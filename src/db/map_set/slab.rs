@@ -0,0 +1,129 @@
+//! Slab allocation for small sets
+//!
+//! Most buckets hold a handful of values, but a `HashSet` allocates room for
+//! 32 however few it holds, and each one is a separate allocation.  `Slabs`
+//! keeps small sets in one vector per size class instead (chunks of 1, 2, 4,
+//! ... `MAX_CHUNK` values), handing out chunks and reusing freed ones, so a
+//! small set costs only its chunk and large indexes aren't made of millions of
+//! tiny allocations.
+//!
+//! Slabs only grow: freed chunks are reused by later sets of the same class,
+//! but their memory isn't returned.
+
+use std::clone::Clone;
+
+/// Most values held in a chunk; larger sets need their own storage
+pub const MAX_CHUNK: usize = 16;
+
+/// Number of size classes, from 1 to `MAX_CHUNK` values
+const CLASSES: usize = 5;
+
+/// A chunk of `capacity()` values in one of the slabs
+///
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub struct Chunk {
+    class: usize,
+    index: usize,
+}
+
+impl Chunk {
+    pub fn capacity(&self) -> usize {
+        1 << self.class
+    }
+}
+
+#[derive(Debug)]
+pub struct Slabs<V> {
+    /// Chunks of each size class, end to end
+    slabs: Vec<Vec<V>>,
+    /// Indices of the freed chunks of each size class
+    free: Vec<Vec<usize>>,
+}
+
+impl<V: Clone> Slabs<V> {
+    pub fn new() -> Slabs<V> {
+        Slabs{
+            slabs: (0..CLASSES).map(|_| vec![]).collect(),
+            free: (0..CLASSES).map(|_| vec![]).collect(),
+        }
+    }
+
+    /// A chunk with room for at least `len` values, or None if `len` is more
+    /// than `MAX_CHUNK`
+    ///
+    /// New chunks are filled with copies of `fill`; reused chunks hold
+    /// whatever they held before.
+    ///
+    pub fn alloc(&mut self, len: usize, fill: &V) -> Option<Chunk> {
+        let class = match (0..CLASSES).find(|&class| 1 << class >= len) {
+            Some(class) => class,
+            None => return None,
+        };
+
+        let index = match self.free[class].pop() {
+            Some(index) => index,
+            None => {
+                let slab = &mut self.slabs[class];
+                let index = slab.len() >> class;
+                for _ in 0..(1 << class) {
+                    slab.push(fill.clone());
+                }
+                index
+            },
+        };
+        Some(Chunk{class: class, index: index})
+    }
+
+    /// Make `chunk` available for reuse
+    ///
+    pub fn free(&mut self, chunk: Chunk) {
+        self.free[chunk.class].push(chunk.index);
+    }
+
+    pub fn get(&self, chunk: Chunk) -> &[V] {
+        let size = chunk.capacity();
+        &self.slabs[chunk.class][chunk.index * size..(chunk.index + 1) * size]
+    }
+
+    pub fn get_mut(&mut self, chunk: Chunk) -> &mut [V] {
+        let size = chunk.capacity();
+        &mut self.slabs[chunk.class][chunk.index * size..(chunk.index + 1) * size]
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use db::map_set::slab::{Slabs, MAX_CHUNK};
+
+    #[test]
+    fn chunks_are_sized_by_class() {
+        let mut slabs: Slabs<u64> = Slabs::new();
+        assert_eq!(slabs.alloc(1, &0).unwrap().capacity(), 1);
+        assert_eq!(slabs.alloc(3, &0).unwrap().capacity(), 4);
+        assert_eq!(slabs.alloc(MAX_CHUNK, &0).unwrap().capacity(), MAX_CHUNK);
+        assert_eq!(slabs.alloc(MAX_CHUNK + 1, &0), None);
+    }
+
+    #[test]
+    fn chunks_are_separate() {
+        let mut slabs: Slabs<u64> = Slabs::new();
+        let a = slabs.alloc(2, &0).unwrap();
+        let b = slabs.alloc(2, &0).unwrap();
+        slabs.get_mut(a)[1] = 7;
+        slabs.get_mut(b)[1] = 9;
+
+        assert_eq!(slabs.get(a), &[0, 7]);
+        assert_eq!(slabs.get(b), &[0, 9]);
+    }
+
+    #[test]
+    fn freed_chunks_are_reused() {
+        let mut slabs: Slabs<u64> = Slabs::new();
+        let a = slabs.alloc(4, &0).unwrap();
+        slabs.alloc(4, &0).unwrap();
+        slabs.free(a);
+
+        assert_eq!(slabs.alloc(3, &0), Some(a));
+        assert!(slabs.alloc(3, &0) != Some(a));
+    }
+}
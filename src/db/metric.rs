@@ -0,0 +1,133 @@
+//! Distance metrics
+//!
+//! A `Metric` defines the distance used to verify query candidates.  Every
+//! metric must be bounded by the number of differing dimensions (each
+//! differing dimension adds at most 1 to the distance), since that's what the
+//! HmSearch partitioning guarantees are based on.  Which partitioning a
+//! database uses depends on its values' type (see `typemap`), not its metric.
+
+use std::hash::Hash;
+
+use db::hamming::Hamming;
+
+pub trait Metric<T> {
+    /// Distance between `a` and `b`
+    ///
+    fn distance(a: &T, b: &T) -> usize;
+
+    /// Returns true if the distance between `a` and `b` is less than or equal
+    /// to `bound`
+    ///
+    fn within(a: &T, b: &T, bound: usize) -> bool {
+        Self::distance(a, b) <= bound
+    }
+}
+
+/// Hamming distance
+///
+pub struct HammingDistance;
+
+macro_rules! binary_hamming_metric {
+    ($elem:ty) => {
+        impl Metric<$elem> for HammingDistance {
+            fn distance(a: &$elem, b: &$elem) -> usize {
+                a.hamming(b)
+            }
+
+            fn within(a: &$elem, b: &$elem, bound: usize) -> bool {
+                a.hamming_lte(b, bound)
+            }
+        }
+    }
+}
+binary_hamming_metric!(u8);
+binary_hamming_metric!(u16);
+binary_hamming_metric!(u32);
+binary_hamming_metric!(u64);
+binary_hamming_metric!([u64; 2]);
+binary_hamming_metric!([u64; 4]);
+
+impl<T: Eq + Clone + Hash> Metric<Vec<T>> for HammingDistance {
+    fn distance(a: &Vec<T>, b: &Vec<T>) -> usize {
+        a.hamming(b)
+    }
+
+    fn within(a: &Vec<T>, b: &Vec<T>, bound: usize) -> bool {
+        a.hamming_lte(b, bound)
+    }
+}
+
+/// Jaccard distance between MinHash signatures
+///
+/// The fraction of equal components of two MinHash signatures estimates the
+/// Jaccard similarity of the underlying sets, so the distance between two
+/// signatures is the number of components which differ.  Use `tolerance` to
+/// convert a similarity threshold into a tolerance.
+///
+pub struct MinHashJaccard;
+
+impl MinHashJaccard {
+    /// Estimated Jaccard similarity between the sets described by `a` and `b`
+    ///
+    pub fn similarity(a: &Vec<u64>, b: &Vec<u64>) -> f64 {
+        if a.is_empty() {
+            return 1.0
+        }
+
+        1.0 - (MinHashJaccard::distance(a, b) as f64 / a.len() as f64)
+    }
+
+    /// Tolerance which returns signatures with `bands` components whose
+    /// estimated similarity is at least `similarity`
+    ///
+    pub fn tolerance(similarity: f64, bands: usize) -> usize {
+        // Allow a little slack for float rounding
+        (((1.0 - similarity) * bands as f64) + 1e-9).floor() as usize
+    }
+}
+
+impl Metric<Vec<u64>> for MinHashJaccard {
+    fn distance(a: &Vec<u64>, b: &Vec<u64>) -> usize {
+        a.iter().zip(b.iter()).filter(|&(x, y)| x != y).count()
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+
+    use db::{Database, StorageBackend};
+    use db::metric::*;
+    use db::typemap::build_minhash;
+
+    #[test]
+    fn minhash_similarity() {
+        let a = vec![1u64, 2, 3, 4];
+        let b = vec![1u64, 2, 5, 6];
+
+        assert_eq!(MinHashJaccard::distance(&a, &b), 2);
+        assert_eq!(MinHashJaccard::similarity(&a, &b), 0.5);
+    }
+
+    #[test]
+    fn minhash_tolerance() {
+        assert_eq!(MinHashJaccard::tolerance(0.5, 4), 2);
+        assert_eq!(MinHashJaccard::tolerance(0.9, 10), 1);
+        assert_eq!(MinHashJaccard::tolerance(0.85, 10), 1);
+        assert_eq!(MinHashJaccard::tolerance(1.0, 10), 0);
+    }
+
+    #[test]
+    fn find_similar_minhash_signatures() {
+        let mut db = build_minhash(4, MinHashJaccard::tolerance(0.5, 4), StorageBackend::InMemory);
+        let a = vec![1u64, 2, 3, 4];
+        let b = vec![9u64, 9, 9, 4];
+        let mut expected = HashSet::new();
+        expected.insert(a.clone());
+
+        db.insert(a.clone());
+        db.insert(b.clone());
+
+        assert_eq!(Some(expected), db.get(&vec![1u64, 2, 5, 6]));
+    }
+}
@@ -59,55 +59,326 @@
 //! ```
 //!
 
+pub mod bucket_stats;
+pub mod advise;
+pub mod cardinality;
+pub mod cluster;
+pub mod dedup;
 pub mod deletion;
+pub mod documents;
+pub mod error;
+pub mod estimate;
+pub mod explain;
+pub mod federated;
+pub mod generate;
 pub mod hamming;
 pub mod hashing;
 pub mod id_map;
+pub mod insert_times;
+pub mod integrity;
+pub mod key_locks;
+pub mod left_right;
+pub mod lru;
 pub mod substitution;
+pub mod timed;
 pub mod window;
 pub mod map_set;
+pub mod metric;
+pub mod normalize;
+pub mod remote;
+pub mod sharded;
 pub mod typemap;
+pub mod verify;
+pub mod weighted;
+pub mod workers;
 
 mod result_accumulator;
 
-// mod bench; // Uncomment to get benchmarks to run
+#[cfg(all(test, feature = "bench"))]
+mod bench;
 
 use std::collections::HashSet;
 use std::hash::Hash;
+use std::fs;
+use std::io;
 use std::path::PathBuf;
+use std::time::SystemTime;
 
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
 use db::hamming::Hamming;
+use db::integrity::{IntegrityReport, RepairPlan};
+use db::metric;
 use db::window::{Windowable};
 use db::id_map::{ToID, IDMap};
 
 pub trait TypeMap {
     /// The data type being indexed
-    type Input: Sync + Send + Clone + Eq + Hash + Hamming + Windowable<Self::Window> + ToID<Self::Identifier>;
+    type Input: 'static + Sync + Send + Clone + Eq + Hash + Hamming + Windowable<Self::Window> + ToID<Self::Identifier>;
 
     /// The type of windows over Input.  Window types must be large
     /// enough to store dimensions/tolerance  dimensions of Input (ideally not larger)
-    type Window: Sync + Send + Clone + Eq + Hash;
+    type Window: 'static + Sync + Send + Clone + Eq + Hash;
 
     /// The type of variants computed over windows
-    type Variant: Sync + Send + Clone + Eq + Hash;
+    type Variant: 'static + Sync + Send + Clone + Eq + Hash;
 
     /// Value identifier - balances memory use with collision probability given
     /// the cardinality of the data being indexed
-    type Identifier: Sync + Send + Clone + Eq + Hash;
+    type Identifier: 'static + Sync + Send + Clone + Eq + Hash;
 
     /// The value sture - maps Identifier -> Input
     type ValueStore: IDMap<Self::Identifier, Self::Input>;
 
     /// The variant store - maps Variant -> Identifier
     type VariantStore: Sync + Send;
+
+    /// The distance metric used to verify candidates
+    type Metric: metric::Metric<Self::Input>;
 }
 
 /// Abstract interface for Hamming distance databases
 ///
 pub trait Database<T>: Sync + Send {
     fn get(&self, key: &T) -> Option<HashSet<T>>;
+
+    /// Like `get`, but verifies at most `max_candidates` candidates
+    ///
+    /// Returns true along with the results if candidates were skipped, in
+    /// which case some values within tolerance may be missing.  Skipped
+    /// candidates are chosen deterministically.
+    ///
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        let _ = max_candidates;
+        (self.get(key), false)
+    }
+
+    /// Like `get`, but finds values as they're iterated over
+    ///
+    /// Callers which only need some of the results (i.e. whether anything
+    /// matches) can stop early and skip the work of finding the rest.  Values
+    /// are produced in no particular order.
+    ///
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        match self.get(key) {
+            Some(found) => Box::new(found.into_iter()),
+            None => Box::new(None.into_iter()),
+        }
+    }
+
+    /// Whether any value is within tolerance of `key`
+    ///
+    /// Stops at the first match, so it's cheaper than `get` when only a yes or
+    /// no is needed.
+    ///
+    fn any_within(&self, key: &T) -> bool {
+        self.get_iter(key).next().is_some()
+    }
+
+    /// Whether `key` itself is stored
+    ///
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.get_iter(key).any(|v| v == *key)
+    }
+
+    /// The partitions in which `value` is a candidate for `key`, if supported
+    ///
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        let _ = (key, value);
+        None
+    }
+
+    /// Number of candidates a query for `key` would read, if known
+    ///
+    /// Only the sizes of the buckets the query would read are looked up, so
+    /// this is much cheaper than the query itself.  Values which are
+    /// candidates in more than one partition are counted once for each.
+    ///
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        let _ = key;
+        None
+    }
+
     fn insert(&mut self, key: T) -> bool;
     fn remove(&mut self, key: &T) -> bool;
+
+    /// Like `get`, but returns an error if the database's store fails
+    ///
+    /// Databases whose stores can't fail (or can't report it) never return
+    /// one.
+    ///
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        Ok(self.get(key))
+    }
+
+    /// Like `remove`, but returns an error if the database's store fails
+    ///
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        Ok(self.remove(key))
+    }
+
+    /// Like `get_bounded`, but returns an error if the database's store fails
+    ///
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        Ok(self.get_bounded(key, max_candidates))
+    }
+
+    /// Insert each of `keys`, spreading work which doesn't need exclusive
+    /// access to the database across up to `workers` threads
+    ///
+    /// Returns the result of inserting each key, in order.
+    ///
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let _ = workers;
+        keys.into_iter().map(|key| self.insert(key)).collect()
+    }
+
+    /// Like `insert_batch`, but returns an error for each key which couldn't
+    /// be inserted because the database's store failed
+    ///
+    /// Keys after a failed key are still attempted.
+    ///
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        self.insert_batch(keys, workers).into_iter().map(Ok).collect()
+    }
+
+    /// True if `insert_concurrent` and `remove_concurrent` are supported
+    ///
+    fn concurrent_writes(&self) -> bool {
+        false
+    }
+
+    /// Like `insert`, but callable from several threads at once
+    ///
+    /// Only supported if `concurrent_writes` returns true; otherwise nothing
+    /// is inserted and false is returned (`try_insert_concurrent` returns an
+    /// error instead).
+    ///
+    fn insert_concurrent(&self, key: T) -> bool {
+        self.try_insert_concurrent(key).unwrap_or(false)
+    }
+
+    /// Like `remove`, but callable from several threads at once
+    ///
+    /// Only supported if `concurrent_writes` returns true; otherwise nothing
+    /// is removed and false is returned (`try_remove_concurrent` returns an
+    /// error instead).
+    ///
+    fn remove_concurrent(&self, key: &T) -> bool {
+        self.try_remove_concurrent(key).unwrap_or(false)
+    }
+
+    /// Like `insert_concurrent`, but returns an error if the database's store
+    /// fails, or if concurrent writes aren't supported
+    ///
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        let _ = key;
+        Err(StoreError::permanent("concurrent writes are not supported by this database"))
+    }
+
+    /// Like `remove_concurrent`, but returns an error if the database's store
+    /// fails, or if concurrent writes aren't supported
+    ///
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        let _ = key;
+        Err(StoreError::permanent("concurrent writes are not supported by this database"))
+    }
+
+    /// Check the database's indices for consistency, if supported
+    ///
+    fn check(&self) -> Option<IntegrityReport> {
+        None
+    }
+
+    /// Check the database's indices and fix any problems found, if supported
+    ///
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        None
+    }
+
+    /// Find the fixes `repair` would make, without making them, if supported
+    ///
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        None
+    }
+
+    /// Make up to `max` of the fixes in `plan` (which this database made),
+    /// returning the number made; fixes no longer needed are skipped
+    ///
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        let _ = (plan, max);
+        0
+    }
+
+    /// Bucket size statistics, if the database tracks them
+    ///
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        None
+    }
+
+    /// The number of heavy buckets `bucket_stats` would report, without
+    /// building them
+    ///
+    fn heavy_bucket_count(&self) -> usize {
+        self.bucket_stats().map_or(0, |stats| stats.heavy.len())
+    }
+
+    /// Report buckets holding more than `threshold` values as heavy in
+    /// `bucket_stats`
+    ///
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        let _ = threshold;
+    }
+
+    /// If `repair` is true, inserting a value which is already indexed
+    /// restores any of its index entries which are missing, rather than
+    /// doing nothing, if supported
+    ///
+    /// Entries restored are counted in `bucket_stats`.  Re-inserts still
+    /// return false.
+    ///
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        let _ = repair;
+    }
+
+    /// Memory held by each partition's index entries, if they're held in
+    /// memory
+    ///
+    /// Unlike `bucket_stats`, this is measured by visiting every bucket, so
+    /// it's as costly as iterating the database.
+    ///
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        None
+    }
+
+    /// Call `f` once with each indexed value, in no particular order
+    ///
+    /// Iteration stops at the first error returned by `f`, which is then
+    /// returned.  The database can't be modified while it's being iterated;
+    /// callers sharing a database between threads should hold its read lock
+    /// for the duration (or copy the values out first) to get a consistent
+    /// snapshot.
+    ///
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        let _ = f;
+        Err("iteration is not supported by this database".to_string())
+    }
+
+    /// When `value` was inserted, if insert times are recorded (see
+    /// `insert_times::InsertTimes`)
+    ///
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        let _ = value;
+        None
+    }
+
+    /// Values inserted before `cutoff`, if insert times are recorded
+    ///
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        let _ = cutoff;
+        vec![]
+    }
 }
 
 pub enum StorageBackend {
@@ -116,6 +387,26 @@ pub enum StorageBackend {
     RocksDB(PathBuf),
 }
 
+impl StorageBackend {
+    /// Delete the backend's on-disk data, if any
+    ///
+    /// Databases are closed when they're dropped; any database using the
+    /// backend must be dropped before it's destroyed.
+    ///
+    pub fn destroy(&self) -> io::Result<()> {
+        match *self {
+            StorageBackend::RocksDB(ref path) if path.exists() => fs::remove_dir_all(path),
+            _ => Ok(()),
+        }
+    }
+
+    /// Whether the RocksDB backends were built (the `rocksdb` feature)
+    ///
+    pub fn rocksdb_available() -> bool {
+        cfg!(feature = "rocksdb")
+    }
+}
+
 /// Constructor for databases over common types
 ///
 pub trait Factory {
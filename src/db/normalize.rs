@@ -0,0 +1,368 @@
+//! Key normalization
+//!
+//! Normalizers transform keys before they reach the database, for instance to
+//! ignore known-noisy bits.  A `Normalized` database applies its normalizers
+//! (in order) to every inserted, queried and removed key, so the values stored
+//! and returned are the normalized values.
+//!
+//! # Examples
+//!
+//! ```ignore
+//! let db = Factory::build(64, 4, StorageBackend::InMemory);
+//! let mut db = Normalized::new(db, vec![Box::new(Mask::new(!0xFu64))]);
+//!
+//! db.insert(0b1111);
+//! assert!(db.get(&0b0000).unwrap().contains(&0b0000));
+//! ```
+
+use std;
+use std::mem::size_of;
+use std::collections::HashSet;
+use std::time::SystemTime;
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+
+pub trait Normalizer<T>: Sync + Send {
+    fn normalize(&self, value: T) -> T;
+}
+
+/// Values which can be combined with a bit mask
+///
+pub trait BitMask {
+    /// Returns `self` with all bits not set in `mask` cleared
+    fn mask(&self, mask: &Self) -> Self;
+
+    /// Returns a mask with every bit set except the given dimensions
+    fn mask_excluding(dimensions: &[usize]) -> Self;
+}
+
+/// Values whose bits can be rotated
+///
+pub trait Rotate {
+    /// Rotates the bits of `self` left by `n`, wrapping the truncated bits to
+    /// the end of the value
+    fn rotate(&self, n: u32) -> Self;
+}
+
+macro_rules! uint_normalize {
+    ($elem:ident) => {
+        impl BitMask for $elem {
+            fn mask(&self, mask: &$elem) -> $elem {
+                self & mask
+            }
+
+            fn mask_excluding(dimensions: &[usize]) -> $elem {
+                dimensions.iter()
+                    .filter(|&d| *d < 8 * size_of::<$elem>())
+                    .fold(std::$elem::MAX, |m, &d| m & !(1 << d))
+            }
+        }
+
+        impl Rotate for $elem {
+            fn rotate(&self, n: u32) -> $elem {
+                self.rotate_left(n)
+            }
+        }
+    }
+}
+uint_normalize!(u8);
+uint_normalize!(u16);
+uint_normalize!(u32);
+uint_normalize!(u64);
+
+// Arrays are treated as a single big-endian value (the last element holds the
+// least significant bits), matching `Windowable`
+macro_rules! array_normalize {
+    ([$elem:ident; $elems:expr]) => {
+        impl BitMask for [$elem; $elems] {
+            fn mask(&self, mask: &[$elem; $elems]) -> [$elem; $elems] {
+                let mut out = [0; $elems];
+                for i in 0..$elems {
+                    out[i] = self[i] & mask[i];
+                }
+                out
+            }
+
+            fn mask_excluding(dimensions: &[usize]) -> [$elem; $elems] {
+                let elem_bits = 8 * size_of::<$elem>();
+                let mut out = [std::$elem::MAX; $elems];
+                for &d in dimensions.iter().filter(|&d| *d < elem_bits * $elems) {
+                    out[$elems - 1 - (d / elem_bits)] &= !(1 << (d % elem_bits));
+                }
+                out
+            }
+        }
+
+        impl Rotate for [$elem; $elems] {
+            fn rotate(&self, n: u32) -> [$elem; $elems] {
+                let elem_bits = 8 * size_of::<$elem>();
+                let n = (n as usize) % (elem_bits * $elems);
+                let words = n / elem_bits;
+                let shift = n % elem_bits;
+
+                let mut out = [0; $elems];
+                for i in 0..$elems {
+                    let high = self[(i + words) % $elems];
+                    let low = self[(i + words + 1) % $elems];
+
+                    out[i] = if shift == 0 {
+                        high
+                    } else {
+                        (high << shift) | (low >> (elem_bits - shift))
+                    };
+                }
+                out
+            }
+        }
+    }
+}
+array_normalize!([u64; 2]);
+array_normalize!([u64; 4]);
+
+/// Clears all bits not set in the mask
+///
+pub struct Mask<T> {
+    mask: T,
+}
+
+impl<T> Mask<T> {
+    pub fn new(mask: T) -> Mask<T> {
+        Mask{mask: mask}
+    }
+}
+
+impl<T: Sync + Send + BitMask> Normalizer<T> for Mask<T> {
+    fn normalize(&self, value: T) -> T {
+        value.mask(&self.mask)
+    }
+}
+
+/// Rotates values by a fixed number of bits
+///
+pub struct RotateLeft {
+    n: u32,
+}
+
+impl RotateLeft {
+    pub fn new(n: u32) -> RotateLeft {
+        RotateLeft{n: n}
+    }
+}
+
+impl<T: Rotate> Normalizer<T> for RotateLeft {
+    fn normalize(&self, value: T) -> T {
+        value.rotate(self.n)
+    }
+}
+
+/// Database wrapper applying normalizers to every key
+///
+pub struct Normalized<T> {
+    db: Box<Database<T>>,
+    normalizers: Vec<Box<Normalizer<T>>>,
+}
+
+impl<T> Normalized<T> {
+    pub fn new(db: Box<Database<T>>, normalizers: Vec<Box<Normalizer<T>>>) -> Normalized<T> {
+        Normalized{db: db, normalizers: normalizers}
+    }
+
+    fn normalize(&self, value: T) -> T {
+        self.normalizers.iter().fold(value, |v, n| n.normalize(v))
+    }
+}
+
+impl<T: Clone> Database<T> for Normalized<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        self.db.get(&self.normalize(key.clone()))
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        self.db.try_get(&self.normalize(key.clone()))
+    }
+
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        self.db.get_bounded(&self.normalize(key.clone()), max_candidates)
+    }
+
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        self.db.try_get_bounded(&self.normalize(key.clone()), max_candidates)
+    }
+
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        self.db.get_iter(&self.normalize(key.clone()))
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.db.any_within(&self.normalize(key.clone()))
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.db.contains(&self.normalize(key.clone()))
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.db.explain(&self.normalize(key.clone()), value)
+    }
+
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.db.query_cost(&self.normalize(key.clone()))
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        let normalized = self.normalize(key);
+        self.db.insert(normalized)
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        let normalized = self.normalize(key.clone());
+        self.db.remove(&normalized)
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let normalized = keys.into_iter().map(|key| self.normalize(key)).collect();
+        self.db.insert_batch(normalized, workers)
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        let normalized = self.normalize(key.clone());
+        self.db.try_remove(&normalized)
+    }
+
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let normalized = keys.into_iter().map(|key| self.normalize(key)).collect();
+        self.db.try_insert_batch(normalized, workers)
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        self.db.concurrent_writes()
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        let normalized = self.normalize(key);
+        self.db.insert_concurrent(normalized)
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        let normalized = self.normalize(key.clone());
+        self.db.remove_concurrent(&normalized)
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        let normalized = self.normalize(key);
+        self.db.try_insert_concurrent(normalized)
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        let normalized = self.normalize(key.clone());
+        self.db.try_remove_concurrent(&normalized)
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        self.db.check()
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        self.db.repair()
+    }
+
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        self.db.plan_repair()
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        self.db.repair_batch(plan, max)
+    }
+
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        self.db.bucket_stats()
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.db.heavy_bucket_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.db.set_bucket_threshold(threshold)
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.db.set_repair_on_insert(repair)
+    }
+
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        self.db.memory()
+    }
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        self.db.for_each(f)
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.db.inserted_at(value)
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        self.db.inserted_before(cutoff)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+
+    use db::{Database, Factory, StorageBackend};
+    use db::normalize::*;
+
+    #[test]
+    fn rotate_u64_array() {
+        let a = [0x8000000000000000u64, 0x1u64];
+
+        assert_eq!(a.rotate(1), [0x0u64, 0x3u64]);
+        assert_eq!(a.rotate(64), [0x1u64, 0x8000000000000000u64]);
+        assert_eq!(a.rotate(128), a);
+    }
+
+    #[test]
+    fn mask_u64_array() {
+        let a = [0xFFu64, 0xFFu64];
+
+        assert_eq!(a.mask(&[0x0Fu64, 0xF0u64]), [0x0Fu64, 0xF0u64]);
+    }
+
+    #[test]
+    fn mask_excluding_dimensions() {
+        assert_eq!(u8::mask_excluding(&[0, 7, 8]), 0b01111110u8);
+        assert_eq!(<[u64; 2]>::mask_excluding(&[0, 64]), [!1u64, !1u64]);
+        assert_eq!(<[u64; 2]>::mask_excluding(&[1, 127]), [!(1u64 << 63), !2u64]);
+    }
+
+    #[test]
+    fn masked_bits_are_ignored() {
+        let db: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        let normalizers: Vec<Box<Normalizer<u64>>> = vec![Box::new(Mask::new(!0xFu64))];
+        let mut db = Normalized::new(db, normalizers);
+        let mut expected = HashSet::new();
+        expected.insert(0xFF00u64);
+
+        db.insert(0xFF0Fu64);
+
+        assert_eq!(Some(expected), db.get(&0xFF03u64));
+        assert!(!db.insert(0xFF01u64));
+    }
+
+    #[test]
+    fn normalizers_apply_to_remove() {
+        let db: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        let normalizers: Vec<Box<Normalizer<u64>>> = vec![Box::new(RotateLeft::new(4)), Box::new(Mask::new(!0xFu64))];
+        let mut db = Normalized::new(db, normalizers);
+
+        db.insert(0xF000000000000001u64);
+
+        assert!(db.remove(&0xF000000000000001u64));
+        assert_eq!(None, db.get(&0xF000000000000001u64));
+    }
+}
@@ -0,0 +1,645 @@
+//! Databases held by other hammer servers
+//!
+//! `Remote` implements `Database` by calling a hammer server's HTTP API, so
+//! code written against `Database` can use an index on another server, and a
+//! proxy can treat local and remote indexes alike.  Requests are made over
+//! hyper's pooled keep-alive connections.
+//!
+//! A remote database may have several replicas (i.e. a primary and its
+//! standbys).  Writes always go to the first, the primary; queries are spread
+//! across all of them.  A failed request is retried on the next replica, up
+//! to `set_retries` times.  With `set_hedge_after`, a query which hasn't been
+//! answered in that time is also sent to the next replica and whichever
+//! answers first is used, trimming tail latency from a slow replica at the
+//! cost of some extra load.  Hedges count against the retries, so a query is
+//! sent at most `retries + 1` times.
+//!
+//! Rather than a fixed delay, `set_hedge_percentile(Some(0.95))` hedges
+//! queries which have taken longer than 95% of recent ones (the last 1000
+//! requests to any replica; until 20 have been answered, `hedge_after` is used
+//! instead).  Hedges are limited by `set_hedge_budget`: each query earns that
+//! fraction of a hedge (0.1 by default, up to a burst of 10), so a replica
+//! which slows down for everyone can't double the load on the others.  A query
+//! which is due a hedge when the budget is spent just keeps waiting.
+//!
+//! A query which fails on every replica finds nothing, and a write which
+//! fails returns false; both are counted in `errors`.  The `try_` methods
+//! return the error instead, as a `StoreError`: transient if the server
+//! couldn't be reached, timed out or failed (a 5xx), or if its own store
+//! failed transiently, and otherwise permanent.  Retrying a write whose
+//! response was lost reports the value as already there (`insert` returns
+//! false) although it was added.
+
+use std::collections::HashSet;
+use std::hash::Hash;
+use std::io::Read;
+use std::marker::PhantomData;
+use std::sync::{Arc, Condvar, Mutex};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use bincode;
+use hyper::Client;
+use hyper::header::Headers;
+use hyper::status::StatusCode;
+use rustc_serialize::{Encodable, Decodable};
+use rustc_serialize::base64::{FromBase64, ToBase64, STANDARD};
+use rustc_serialize::json;
+use rustc_serialize::json::Json;
+
+use db::Database;
+use db::error::StoreError;
+
+const DEFAULT_RETRIES: usize = 2;
+
+/// Delay before retrying a write, doubled for each further retry
+const RETRY_DELAY_MS: u64 = 50;
+
+const DEFAULT_HEDGE_BUDGET: f64 = 0.1;
+
+/// Most hedges which can be saved up
+const MAX_HEDGE_BURST: f64 = 10.0;
+
+/// Number of recent latencies hedge percentiles are taken from
+const LATENCY_SAMPLES: usize = 1000;
+
+/// Fewest latencies hedge percentiles are taken from
+const MIN_LATENCY_SAMPLES: usize = 20;
+
+pub struct Remote<T> {
+    client: Arc<Client>,
+    /// `host:port` of each replica, the primary first
+    replicas: Vec<String>,
+    /// The database's path, i.e. `b/64/8/foo`
+    db: String,
+    token: Option<String>,
+    retries: usize,
+    hedge_after: Option<Duration>,
+    hedge_percentile: Option<f64>,
+    hedge_budget: f64,
+    /// Hedges which may be sent now
+    hedge_credit: Mutex<f64>,
+    latencies: Arc<Mutex<Latencies>>,
+    /// Replica the next query starts with
+    next: AtomicUsize,
+    errors: AtomicUsize,
+    value: PhantomData<T>,
+}
+
+impl<T> Remote<T> where
+T: Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
+{
+    /// The database `db` (i.e. `b/64/8/foo`) on `replicas`, given as
+    /// `host:port`, the primary first
+    ///
+    pub fn new(replicas: Vec<String>, db: &str) -> Remote<T> {
+        assert!(!replicas.is_empty(), "a remote database needs at least one server");
+
+        Remote{
+            client: Arc::new(Client::new()),
+            replicas: replicas,
+            db: db.to_string(),
+            token: None,
+            retries: DEFAULT_RETRIES,
+            hedge_after: None,
+            hedge_percentile: None,
+            hedge_budget: DEFAULT_HEDGE_BUDGET,
+            hedge_credit: Mutex::new(0.0),
+            latencies: Arc::new(Mutex::new(Latencies::new())),
+            next: AtomicUsize::new(0),
+            errors: AtomicUsize::new(0),
+            value: PhantomData,
+        }
+    }
+
+    /// Send `token` as a bearer token with every request
+    ///
+    pub fn set_token(&mut self, token: Option<String>) {
+        self.token = token;
+    }
+
+    pub fn set_retries(&mut self, retries: usize) {
+        self.retries = retries;
+    }
+
+    /// Also send queries which haven't been answered after `hedge_after` to
+    /// the next replica
+    ///
+    pub fn set_hedge_after(&mut self, hedge_after: Option<Duration>) {
+        self.hedge_after = hedge_after;
+    }
+
+    /// Also send queries which have taken longer than this fraction of recent
+    /// requests to the next replica
+    ///
+    pub fn set_hedge_percentile(&mut self, percentile: Option<f64>) {
+        assert!(percentile.map_or(true, |p| p > 0.0 && p <= 1.0), "hedge percentile must be in (0, 1]");
+        self.hedge_percentile = percentile;
+    }
+
+    /// Hedges allowed per query, on average
+    ///
+    pub fn set_hedge_budget(&mut self, budget: f64) {
+        self.hedge_budget = budget;
+    }
+
+    /// Number of requests which failed on every attempt
+    ///
+    pub fn errors(&self) -> usize {
+        self.errors.load(Ordering::Relaxed)
+    }
+
+    pub fn try_any_within(&self, key: &T) -> Result<bool, StoreError> {
+        self.query("any_match", vec![key]).and_then(|results| self.boolean(results))
+    }
+
+    pub fn try_contains(&self, key: &T) -> Result<bool, StoreError> {
+        self.query("contains", vec![key]).and_then(|results| self.boolean(results))
+    }
+
+    /// Like `try_insert_batch`, but through a shared reference (as
+    /// `Federated` holds its shards)
+    ///
+    pub fn add(&self, keys: Vec<T>) -> Vec<Result<bool, StoreError>> {
+        match self.write("add", keys.iter().collect()) {
+            Ok(results) => results.into_iter().map(|result| self.status(result, "ok", "exists")).collect(),
+            Err(e) => keys.iter().map(|_| Err(e.clone())).collect(),
+        }
+    }
+
+    /// Like `try_remove`, but through a shared reference
+    ///
+    pub fn delete(&self, key: &T) -> Result<bool, StoreError> {
+        let mut results = try!(self.write("delete", vec![key]));
+        match results.pop() {
+            Some(result) => self.status(result, "ok", "not_found"),
+            None => Err(StoreError::permanent(format!("{} returned no results", self.db))),
+        }
+    }
+
+    fn boolean(&self, mut results: Vec<Json>) -> Result<bool, StoreError> {
+        match results.pop() {
+            Some(Json::Boolean(b)) => Ok(b),
+            Some(other) => Err(self.value_error(other)),
+            None => Err(StoreError::permanent(format!("{} returned no results", self.db))),
+        }
+    }
+
+    /// True for `yes`, false for `no`, otherwise the result is an error
+    ///
+    fn status(&self, result: Json, yes: &str, no: &str) -> Result<bool, StoreError> {
+        match result {
+            Json::String(ref s) if s == yes => Ok(true),
+            Json::String(ref s) if s == no => Ok(false),
+            other => Err(self.value_error(other)),
+        }
+    }
+
+    /// The error for a value the server couldn't handle, which is transient
+    /// if the server's store failed transiently
+    ///
+    fn value_error(&self, result: Json) -> StoreError {
+        match result {
+            Json::String(ref s) if s.starts_with("err: transient") => StoreError::transient(format!("{} request failed: {}", self.db, s)),
+            other => StoreError::permanent(format!("{} request failed: {}", self.db, other)),
+        }
+    }
+
+    fn url(&self, op: &str, replica: usize) -> String {
+        format!("http://{}/{}/{}", self.replicas[replica % self.replicas.len()], op, self.db)
+    }
+
+    /// Send a read to the replicas in turn until one answers
+    ///
+    fn query(&self, op: &str, keys: Vec<&T>) -> Result<Vec<Json>, StoreError> {
+        let body = encode_keys(&keys);
+        let start = self.next.fetch_add(1, Ordering::Relaxed);
+
+        let result = match (self.hedge_after, self.hedge_percentile) {
+            (None, None) => self.failover(op, &body, start),
+            _ => {
+                self.earn_hedge();
+                self.hedged(op, &body, start)
+            },
+        };
+
+        self.results(result, keys.len())
+    }
+
+    /// Send a request to each replica in turn, starting with `start`, until
+    /// one succeeds
+    ///
+    fn failover(&self, op: &str, body: &str, start: usize) -> Result<String, StoreError> {
+        let mut attempt = 0;
+
+        loop {
+            let e = match timed_send(&self.client, &self.url(op, start + attempt), body, &self.token, &self.latencies) {
+                Ok(response) => return Ok(response),
+                Err(e) => e,
+            };
+            if attempt >= self.retries {
+                return Err(e)
+            }
+            attempt += 1;
+        }
+    }
+
+    /// Like `failover`, but also sends the request to the next replica when
+    /// it's unanswered for the hedge delay and the budget allows
+    ///
+    fn hedged(&self, op: &str, body: &str, start: usize) -> Result<String, StoreError> {
+        let race = Arc::new(Race::new());
+        let mut sent = 0;
+
+        loop {
+            let (client, race_, url, body, token, latencies) = (self.client.clone(), race.clone(), self.url(op, start + sent), body.to_string(), self.token.clone(), self.latencies.clone());
+            thread::spawn(move || race_.finish(timed_send(&client, &url, &body, &token, &latencies)));
+            sent += 1;
+
+            let timeout = match sent <= self.retries {
+                true => self.hedge_delay(),
+                false => None,
+            };
+            let outcome = match race.wait(sent, timeout) {
+                Some(outcome) => outcome,
+                None if self.spend_hedge() => continue,
+                // Out of budget, so wait for the requests already sent
+                None => race.wait(sent, None).unwrap(),
+            };
+            match outcome {
+                Ok(body) => return Ok(body),
+                Err(e) => if sent > self.retries { return Err(e) },
+            }
+        }
+    }
+
+    /// How long to wait for a query before hedging it, if it should be
+    ///
+    fn hedge_delay(&self) -> Option<Duration> {
+        let percentile = self.hedge_percentile.and_then(|p| self.latencies.lock().unwrap().percentile(p));
+        percentile.or(self.hedge_after)
+    }
+
+    fn earn_hedge(&self) {
+        let mut credit = self.hedge_credit.lock().unwrap();
+        *credit = (*credit + self.hedge_budget).min(MAX_HEDGE_BURST);
+    }
+
+    /// Takes a hedge from the budget, if there's one left
+    ///
+    fn spend_hedge(&self) -> bool {
+        let mut credit = self.hedge_credit.lock().unwrap();
+        if *credit < 1.0 {
+            return false
+        }
+        *credit -= 1.0;
+        true
+    }
+
+    /// Send a write to the primary, retrying after a delay if it fails
+    ///
+    fn write(&self, op: &str, keys: Vec<&T>) -> Result<Vec<Json>, StoreError> {
+        let result = self.send_to_primary(op, &encode_keys(&keys));
+        self.results(result, keys.len())
+    }
+
+    fn send_to_primary(&self, op: &str, body: &str) -> Result<String, StoreError> {
+        let mut delay = RETRY_DELAY_MS;
+        let mut attempt = 0;
+
+        loop {
+            let e = match send(&self.client, &self.url(op, 0), body, &self.token) {
+                Ok(response) => return Ok(response),
+                Err(e) => e,
+            };
+            if attempt >= self.retries {
+                return Err(e)
+            }
+
+            thread::sleep(Duration::from_millis(delay));
+            delay *= 2;
+            attempt += 1;
+        }
+    }
+
+    /// The per-value results in a response, counting the request as an error
+    /// if it failed or they can't be parsed
+    ///
+    fn results(&self, response: Result<String, StoreError>, expected: usize) -> Result<Vec<Json>, StoreError> {
+        let parsed = response.and_then(|body| match Json::from_str(&body) {
+            Ok(Json::Array(results)) if results.len() == expected => Ok(results),
+            Ok(_) => Err(StoreError::permanent(format!("unexpected response from {}: {}", self.db, body))),
+            Err(e) => Err(StoreError::permanent(format!("unable to parse response from {}: {:?}", self.db, e))),
+        });
+
+        match parsed {
+            Ok(results) => Ok(results),
+            Err(e) => {
+                self.errors.fetch_add(1, Ordering::Relaxed);
+                Err(e)
+            },
+        }
+    }
+}
+
+impl<T> Database<T> for Remote<T> where
+T: Sync + Send + Clone + Eq + Hash + Encodable + Decodable,
+{
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        self.try_get(key).unwrap_or(None)
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.try_any_within(key).unwrap_or(false)
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.try_contains(key).unwrap_or(false)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        self.insert_concurrent(key)
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        self.remove_concurrent(key)
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        let mut results = try!(self.query("query", vec![key]));
+
+        match results.pop() {
+            Some(Json::String(ref s)) if s == "none" => Ok(None),
+            Some(Json::Array(matches)) => decode_matches(matches).map(Some).map_err(StoreError::permanent),
+            // Detailed results, i.e. if the server truncated the response
+            Some(Json::Object(mut d)) => match d.remove("matches") {
+                Some(Json::Array(matches)) => decode_matches(matches).map(Some).map_err(StoreError::permanent),
+                _ => Err(self.value_error(Json::Object(d))),
+            },
+            Some(other) => Err(self.value_error(other)),
+            None => Err(StoreError::permanent(format!("{} returned no results", self.db))),
+        }
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        self.delete(key)
+    }
+
+    /// Adds the keys with a single request
+    ///
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let _ = workers;
+        self.add(keys).into_iter().map(|added| added.unwrap_or(false)).collect()
+    }
+
+    /// Adds the keys with a single request, so if it fails every key gets
+    /// its error
+    ///
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let _ = workers;
+        self.add(keys)
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        true
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        self.add(vec![key]).pop().map_or(false, |added| added.unwrap_or(false))
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        self.delete(key).unwrap_or(false)
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        self.add(vec![key]).pop().unwrap()
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        self.delete(key)
+    }
+}
+
+/// Outcomes of a request sent to several replicas
+///
+struct Outcomes {
+    answer: Option<String>,
+    errors: Vec<StoreError>,
+}
+
+/// Waits for the first answer from a request sent to several replicas
+///
+struct Race {
+    outcomes: Mutex<Outcomes>,
+    finished: Condvar,
+}
+
+impl Race {
+    fn new() -> Race {
+        Race{outcomes: Mutex::new(Outcomes{answer: None, errors: vec![]}), finished: Condvar::new()}
+    }
+
+    fn finish(&self, result: Result<String, StoreError>) {
+        let mut outcomes = self.outcomes.lock().unwrap();
+        match result {
+            Ok(body) => if outcomes.answer.is_none() { outcomes.answer = Some(body) },
+            Err(e) => outcomes.errors.push(e),
+        }
+        self.finished.notify_all();
+    }
+
+    /// The first answer, or the last error once all `sent` requests have
+    /// failed, or None if neither happens within `timeout`
+    ///
+    fn wait(&self, sent: usize, timeout: Option<Duration>) -> Option<Result<String, StoreError>> {
+        let deadline = timeout.map(|timeout| Instant::now() + timeout);
+        let mut outcomes = self.outcomes.lock().unwrap();
+
+        loop {
+            match outcomes.answer {
+                Some(ref body) => return Some(Ok(body.clone())),
+                None => {},
+            }
+            if outcomes.errors.len() >= sent {
+                return outcomes.errors.last().map(|e| Err(e.clone()))
+            }
+
+            outcomes = match deadline {
+                Some(deadline) => {
+                    let now = Instant::now();
+                    if now >= deadline {
+                        return None
+                    }
+                    self.finished.wait_timeout(outcomes, deadline - now).unwrap().0
+                },
+                None => self.finished.wait(outcomes).unwrap(),
+            };
+        }
+    }
+}
+
+/// Latencies of recent successful requests, for choosing when to hedge
+///
+struct Latencies {
+    samples: Vec<Duration>,
+    /// Sample to be replaced next, once there are `LATENCY_SAMPLES`
+    next: usize,
+}
+
+impl Latencies {
+    fn new() -> Latencies {
+        Latencies{samples: Vec::with_capacity(LATENCY_SAMPLES), next: 0}
+    }
+
+    fn record(&mut self, latency: Duration) {
+        if self.samples.len() < LATENCY_SAMPLES {
+            self.samples.push(latency);
+        } else {
+            self.samples[self.next] = latency;
+            self.next = (self.next + 1) % LATENCY_SAMPLES;
+        }
+    }
+
+    /// The `p`th percentile latency, once there are enough samples
+    ///
+    fn percentile(&self, p: f64) -> Option<Duration> {
+        if self.samples.len() < MIN_LATENCY_SAMPLES {
+            return None
+        }
+
+        let mut sorted = self.samples.clone();
+        sorted.sort();
+        Some(sorted[((sorted.len() - 1) as f64 * p) as usize])
+    }
+}
+
+/// Like `send`, recording the latency of successful requests
+///
+fn timed_send(client: &Client, url: &str, body: &str, token: &Option<String>, latencies: &Mutex<Latencies>) -> Result<String, StoreError> {
+    let started = Instant::now();
+    let result = send(client, url, body, token);
+    match result {
+        Ok(_) => latencies.lock().unwrap().record(started.elapsed()),
+        Err(_) => {},
+    }
+    result
+}
+
+/// The body of a successful response to a POST of `body` to `url`
+///
+/// Failing to reach the server, and responses which say it's overloaded or
+/// failed, are transient errors.
+///
+fn send(client: &Client, url: &str, body: &str, token: &Option<String>) -> Result<String, StoreError> {
+    let mut headers = Headers::new();
+    headers.set_raw("Content-Type", vec![b"application/json".to_vec()]);
+    match *token {
+        Some(ref token) => headers.set_raw("Authorization", vec![format!("Bearer {}", token).into_bytes()]),
+        None => {},
+    }
+
+    let mut res = match client.post(url).headers(headers).body(body).send() {
+        Ok(res) => res,
+        Err(e) => return Err(StoreError::transient(format!("POST {} failed: {}", url, e))),
+    };
+
+    let mut response = String::new();
+    match res.read_to_string(&mut response) {
+        Ok(_) => {},
+        Err(e) => return Err(StoreError::transient(format!("unable to read response to POST {}: {}", url, e))),
+    }
+
+    match res.status {
+        StatusCode::Ok => Ok(response),
+        status if transient_status(status) => Err(StoreError::transient(format!("POST {} returned {}: {}", url, status, response.trim()))),
+        status => Err(StoreError::permanent(format!("POST {} returned {}: {}", url, status, response.trim()))),
+    }
+}
+
+/// Whether a request answered with `status` may succeed if it's retried
+///
+fn transient_status(status: StatusCode) -> bool {
+    match status {
+        StatusCode::RequestTimeout | StatusCode::TooManyRequests => true,
+        status => status.is_server_error(),
+    }
+}
+
+fn encode_keys<T: Encodable>(keys: &[&T]) -> String {
+    let encoded = keys.iter().map(|key| {
+        bincode::rustc_serialize::encode(*key, bincode::SizeLimit::Infinite).unwrap().to_base64(STANDARD)
+    }).collect::<Vec<String>>();
+
+    json::encode(&encoded).unwrap()
+}
+
+fn decode_matches<T: Eq + Hash + Decodable>(matches: Vec<Json>) -> Result<HashSet<T>, String> {
+    matches.into_iter().map(|m| {
+        let bytes = match m {
+            Json::String(ref s) => match s.from_base64() {
+                Ok(bytes) => bytes,
+                Err(e) => return Err(format!("unable to base64-decode '{}': {:?}", s, e)),
+            },
+            other => return Err(format!("expected a base64 value, not {}", other)),
+        };
+
+        match bincode::rustc_serialize::decode(&bytes) {
+            Ok(v) => Ok(v),
+            Err(e) => Err(format!("unable to decode match: {:?}", e)),
+        }
+    }).collect()
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+
+    use rustc_serialize::json::Json;
+
+    use std::time::Duration;
+
+    use db::Database;
+    use db::remote::{encode_keys, decode_matches, Latencies, Remote, MIN_LATENCY_SAMPLES};
+
+    #[test]
+    fn keys_are_encoded_as_the_server_expects() {
+        assert_eq!(encode_keys(&[&0u64, &1u64]), r#"["AAAAAAAAAAA=","AAAAAAAAAAE="]"#);
+    }
+
+    #[test]
+    fn matches_are_decoded() {
+        let matches = vec![Json::String("AAAAAAAAAAA=".to_string()), Json::String("AAAAAAAAAAE=".to_string())];
+        let expected: HashSet<u64> = vec![0, 1].into_iter().collect();
+
+        assert_eq!(decode_matches::<u64>(matches), Ok(expected));
+        assert!(decode_matches::<u64>(vec![Json::U64(1)]).is_err());
+    }
+
+    #[test]
+    fn percentiles_need_enough_samples() {
+        let mut latencies = Latencies::new();
+        for ms in 1..MIN_LATENCY_SAMPLES as u64 {
+            latencies.record(Duration::from_millis(ms));
+        }
+        assert_eq!(latencies.percentile(0.5), None);
+
+        for ms in MIN_LATENCY_SAMPLES as u64..101 {
+            latencies.record(Duration::from_millis(ms));
+        }
+        assert_eq!(latencies.percentile(0.5), Some(Duration::from_millis(50)));
+        assert_eq!(latencies.percentile(1.0), Some(Duration::from_millis(100)));
+    }
+
+    #[test]
+    fn unreachable_servers_are_transient_errors() {
+        // Nothing listens on port 1, so connections are refused straight away
+        let mut db = Remote::<u64>::new(vec!["127.0.0.1:1".to_string()], "b/64/8/foo");
+        db.set_retries(0);
+
+        assert!(db.try_get(&0).unwrap_err().is_transient());
+        assert!(db.try_remove(&0).unwrap_err().is_transient());
+        assert!(db.try_insert_batch(vec![0, 1], 1).iter().all(|added| added.as_ref().unwrap_err().is_transient()));
+    }
+}
@@ -1,24 +1,149 @@
+use std::cmp;
 use std::cmp::*;
 use std::hash::*;
 use std::clone::*;
 
-use std::collections::{HashMap, HashSet};
+use std::marker::PhantomData;
+use std::collections::{BinaryHeap, HashMap, HashSet};
 use std::collections::hash_map::Entry::{Occupied, Vacant};
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicUsize, Ordering};
 
-use db::hamming::*;
+use fnv::FnvHasher;
 
-pub struct ResultAccumulator<V> {
+use db::metric::{Metric, HammingDistance};
+
+/// Pooled candidate maps larger than this are dropped rather than reused, so
+/// one unusually large query doesn't pin its memory
+const MAX_POOLED_CAPACITY: usize = 1 << 16;
+
+/// Maximum number of candidate maps kept for reuse
+const MAX_POOLED_MAPS: usize = 16;
+
+/// Moving average of recent sizes, used as a capacity hint
+///
+/// Updates from concurrent queries may be lost, which only skews the hint.
+///
+pub struct SizeHint {
+    average: AtomicUsize,
+}
+
+impl SizeHint {
+    pub fn new() -> SizeHint {
+        SizeHint{average: AtomicUsize::new(0)}
+    }
+
+    pub fn get(&self) -> usize {
+        self.average.load(Ordering::Relaxed)
+    }
+
+    /// Fold `size` into the average, with a weight of 1/8
+    ///
+    pub fn record(&self, size: usize) {
+        let average = self.get();
+        self.average.store((average * 7 + size) / 8, Ordering::Relaxed);
+    }
+}
+
+/// Reusable candidate maps, sized by recent queries
+///
+/// Building a `ResultAccumulator` from the pool avoids allocating (and
+/// repeatedly growing) a new candidate map for every query.
+///
+pub struct AccumulatorPool<V> {
+    maps: Mutex<Vec<HashMap<V, (usize, usize)>>>,
+    candidates: SizeHint,
+    matches: SizeHint,
+}
+
+impl<V: Hash + Eq + Clone> AccumulatorPool<V> {
+    pub fn new() -> AccumulatorPool<V> {
+        AccumulatorPool{maps: Mutex::new(vec![]), candidates: SizeHint::new(), matches: SizeHint::new()}
+    }
+
+    pub fn accumulator<M: Metric<V>>(&self, tolerance: usize, query: V) -> ResultAccumulator<V, M> {
+        let mut candidates = match self.maps.lock().unwrap().pop() {
+            Some(map) => map,
+            None => HashMap::new(),
+        };
+        candidates.reserve(self.candidates.get());
+
+        let mut results = ResultAccumulator::with_candidates(tolerance, query, candidates);
+        results.match_capacity = self.matches.get();
+        results
+    }
+
+    /// Return `results`' candidate map to the pool, recording the number of
+    /// candidates and `found`
+    ///
+    pub fn recycle<M: Metric<V>>(&self, results: ResultAccumulator<V, M>, found: &Option<HashSet<V>>) {
+        self.candidates.record(results.candidates.len());
+        self.matches.record(match found {
+            &Some(ref found) => found.len(),
+            &None => 0,
+        });
+
+        let mut candidates = results.candidates;
+        if candidates.capacity() > MAX_POOLED_CAPACITY {
+            return
+        }
+        candidates.clear();
+
+        let mut maps = self.maps.lock().unwrap();
+        if maps.len() < MAX_POOLED_MAPS {
+            maps.push(candidates);
+        }
+    }
+}
+
+/// A candidate, ordered by its hash alone
+///
+struct ByHash<'a, V: 'a> {
+    hash: u64,
+    value: &'a V,
+}
+
+impl<'a, V> PartialEq for ByHash<'a, V> {
+    fn eq(&self, other: &ByHash<'a, V>) -> bool {
+        self.hash == other.hash
+    }
+}
+
+impl<'a, V> Eq for ByHash<'a, V> {}
+
+impl<'a, V> PartialOrd for ByHash<'a, V> {
+    fn partial_cmp(&self, other: &ByHash<'a, V>) -> Option<cmp::Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+impl<'a, V> Ord for ByHash<'a, V> {
+    fn cmp(&self, other: &ByHash<'a, V>) -> cmp::Ordering {
+        self.hash.cmp(&other.hash)
+    }
+}
+
+pub struct ResultAccumulator<V, M = HammingDistance> {
     tolerance: usize,
     query: V,
     candidates: HashMap<V, (usize, usize)>,
+    /// Expected number of matches
+    match_capacity: usize,
+    metric: PhantomData<M>,
 }
 
-impl<V> ResultAccumulator<V>
-where V: Hash + Eq + Clone + Hamming
+impl<V, M> ResultAccumulator<V, M>
+where V: Hash + Eq + Clone,
+M: Metric<V>,
 {
-    pub fn new(tolerance: usize, query: V) -> ResultAccumulator<V> {
-        let candidates = HashMap::new();
-        return ResultAccumulator {tolerance: tolerance, query: query, candidates: candidates};
+    pub fn new(tolerance: usize, query: V) -> ResultAccumulator<V, M> {
+        ResultAccumulator::with_candidates(tolerance, query, HashMap::new())
+    }
+
+    /// Accumulate candidates in `candidates`, which must be empty
+    ///
+    pub fn with_candidates(tolerance: usize, query: V, candidates: HashMap<V, (usize, usize)>) -> ResultAccumulator<V, M> {
+        return ResultAccumulator {tolerance: tolerance, query: query, candidates: candidates, match_capacity: 0, metric: PhantomData};
     }
 
     pub fn insert_zero_variant(&mut self, value: &V) {
@@ -46,34 +171,152 @@ where V: Hash + Eq + Clone + Hamming
     }
 
     pub fn found_values(&self) -> Option<HashSet<V>> {
-        let mut matches: HashSet<V> = HashSet::new();
+        self.verify(self.eligible_candidates())
+    }
 
-        if self.tolerance % 2 == 0 {
-            for (candidate, &(exact_matches, one_matches)) in self.candidates.iter() {
-                // "If k is an even number, S must have at least one exact-matching
-                // partition, or two 1-matching partitions"
-                if exact_matches >= 1 || one_matches >= 2 {
-                    if self.query.hamming_lte(candidate, self.tolerance) {
-                        matches.insert(candidate.clone());
-                    }
-                }
+    /// Like `found_values`, but verifies at most `max_candidates` candidates
+    ///
+    /// If there are more eligible candidates, the ones with the lowest hash
+    /// are verified, so the same query against the same data always returns
+    /// the same results.  Returns true along with the matches if any
+    /// candidates were skipped.
+    ///
+    pub fn found_values_bounded(&self, max_candidates: usize) -> (Option<HashSet<V>>, bool) {
+        // The lowest hashes seen so far, with the highest of them on top, so
+        // only `max_candidates` are ever held
+        let mut lowest: BinaryHeap<ByHash<V>> = BinaryHeap::with_capacity(max_candidates);
+        let mut skipped = false;
+
+        for (candidate, &(exact_matches, one_matches)) in self.candidates.iter() {
+            if !self.eligible(exact_matches, one_matches) {
+                continue
             }
-        } else {
-            for (candidate, &(exact_matches, one_matches)) in self.candidates.iter() {
-                // "If k is an odd number, S must have at least two matching partitions
-                // where at least one of the matches should be an exact match, or S
-                // must have at least three 1-matching partitions"
-                if (exact_matches >= 1 && (exact_matches + one_matches) >= 2) || one_matches >= 3 {
-                    if self.query.hamming_lte(candidate, self.tolerance) {
-                        matches.insert(candidate.clone());
-                    }
-                }
+
+            let mut hasher = FnvHasher::default();
+            candidate.hash(&mut hasher);
+            let candidate = ByHash{hash: hasher.finish(), value: candidate};
+
+            if lowest.len() < max_candidates {
+                lowest.push(candidate);
+                continue
+            }
+            skipped = true;
+            if lowest.peek().map_or(false, |highest| candidate.hash < highest.hash) {
+                lowest.pop();
+                lowest.push(candidate);
             }
         }
 
+        (self.verify(lowest.into_iter().map(|c| c.value).collect()), skipped)
+    }
+
+    /// Candidates with enough matching partitions to possibly be within
+    /// tolerance
+    ///
+    fn eligible_candidates(&self) -> Vec<&V> {
+        self.candidates.iter()
+            .filter(|&(_, &(exact_matches, one_matches))| self.eligible(exact_matches, one_matches))
+            .map(|(candidate, _)| candidate)
+            .collect()
+    }
+
+    /// Whether a candidate matching `exact_matches` partitions exactly and
+    /// `one_matches` partitions with one substitution can be within tolerance
+    ///
+    fn eligible(&self, exact_matches: usize, one_matches: usize) -> bool {
+        if self.tolerance % 2 == 0 {
+            // "If k is an even number, S must have at least one exact-matching
+            // partition, or two 1-matching partitions"
+            exact_matches >= 1 || one_matches >= 2
+        } else {
+            // "If k is an odd number, S must have at least two matching partitions
+            // where at least one of the matches should be an exact match, or S
+            // must have at least three 1-matching partitions"
+            (exact_matches >= 1 && (exact_matches + one_matches) >= 2) || one_matches >= 3
+        }
+    }
+
+    fn verify(&self, candidates: Vec<&V>) -> Option<HashSet<V>> {
+        let mut matches: HashSet<V> = HashSet::with_capacity(self.match_capacity);
+        matches.extend(candidates.into_iter()
+            .filter(|candidate| M::within(&self.query, *candidate, self.tolerance))
+            .cloned());
+
         match matches.len() {
             0 => return None,
             _ => return Some(matches),
         }
     }
 }
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+    use std::hash::{Hash, Hasher};
+
+    use fnv::FnvHasher;
+
+    use db::result_accumulator::{ResultAccumulator, AccumulatorPool};
+    use db::metric::HammingDistance;
+
+    #[test]
+    fn bounded_below_cap() {
+        let mut results: ResultAccumulator<u64, HammingDistance> = ResultAccumulator::new(2, 0);
+        results.insert_zero_variant(&1);
+        results.insert_zero_variant(&3);
+        let mut expected = HashSet::new();
+        expected.insert(1);
+        expected.insert(3);
+
+        assert_eq!((Some(expected), false), results.found_values_bounded(2));
+    }
+
+    #[test]
+    fn bounded_above_cap() {
+        let mut results: ResultAccumulator<u64, HammingDistance> = ResultAccumulator::new(2, 0);
+        for v in vec![1, 2, 3, 4, 5] {
+            results.insert_zero_variant(&v);
+        }
+
+        let (found, overflowed) = results.found_values_bounded(2);
+        assert!(overflowed);
+        assert_eq!(found.as_ref().map(|f| f.len()), Some(2));
+        assert_eq!(found, results.found_values_bounded(2).0);
+    }
+
+    #[test]
+    fn bounded_keeps_lowest_hashes() {
+        let mut results: ResultAccumulator<u64, HammingDistance> = ResultAccumulator::new(8, 0);
+        for v in 1..100u64 {
+            results.insert_zero_variant(&v);
+        }
+
+        let mut by_hash: Vec<u64> = (1..100u64).collect();
+        by_hash.sort_by_key(|v| {
+            let mut hasher = FnvHasher::default();
+            v.hash(&mut hasher);
+            hasher.finish()
+        });
+        let expected: HashSet<u64> = by_hash.into_iter().take(10).collect();
+
+        // Every candidate is within tolerance
+        assert_eq!(results.found_values_bounded(10), (Some(expected), true));
+        assert_eq!(results.found_values_bounded(0), (None, true));
+        assert_eq!(results.found_values_bounded(99).1, false);
+    }
+
+    #[test]
+    fn pooled_accumulators_start_empty() {
+        let pool: AccumulatorPool<u64> = AccumulatorPool::new();
+
+        let mut results: ResultAccumulator<u64, HammingDistance> = pool.accumulator(2, 0);
+        results.insert_zero_variant(&1);
+        let found = results.found_values();
+        pool.recycle(results, &found);
+
+        let results: ResultAccumulator<u64, HammingDistance> = pool.accumulator(2, 8);
+        assert!(results.candidates.is_empty());
+        assert!(results.candidates.capacity() >= 1);
+        assert_eq!(results.found_values(), None);
+    }
+}
@@ -0,0 +1,572 @@
+//! Sharded databases
+//!
+//! Writes to a database are serialized, so a single database can't make use of
+//! more than one core for inserts.  `Sharded` splits values between several
+//! databases ("shards") by hash, each with its own lock, so writes to
+//! different shards can proceed in parallel (see
+//! `Database::insert_concurrent`).  Queries are sent to every shard and the
+//! results combined.
+//!
+//! # Examples
+//!
+//! ```ignore
+//! let shards = (0..4).map(|_| Factory::build(64, 4, StorageBackend::InMemory)).collect();
+//! let db = Sharded::new(shards);
+//!
+//! db.insert_concurrent(0b0001);
+//! assert!(db.get(&0b0000).unwrap().contains(&0b0001));
+//! ```
+
+use std::cmp;
+use std::collections::HashSet;
+use std::hash::{Hash, Hasher};
+use std::sync::RwLock;
+use std::time::SystemTime;
+
+use fnv::FnvHasher;
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+
+pub struct Sharded<T> {
+    shards: Vec<RwLock<Box<Database<T>>>>,
+}
+
+impl<T: Hash> Sharded<T> {
+    /// Create a database spread across `shards`
+    ///
+    /// Values are assigned to shards by hash, so the same shards must be
+    /// passed in the same order every time a persistent database is opened.
+    ///
+    pub fn new(shards: Vec<Box<Database<T>>>) -> Sharded<T> {
+        assert!(!shards.is_empty(), "at least one shard is required");
+
+        Sharded{shards: shards.into_iter().map(|db| RwLock::new(db)).collect()}
+    }
+
+    fn shard_index(&self, key: &T) -> usize {
+        let mut hasher = FnvHasher::default();
+        key.hash(&mut hasher);
+
+        (hasher.finish() % self.shards.len() as u64) as usize
+    }
+
+    fn shard(&self, key: &T) -> &RwLock<Box<Database<T>>> {
+        &self.shards[self.shard_index(key)]
+    }
+
+    /// Splits `keys` into a batch for each shard, remembering where each
+    /// key's result goes
+    ///
+    fn batches(&self, keys: Vec<T>) -> Vec<(Vec<usize>, Vec<T>)> {
+        let mut batches: Vec<(Vec<usize>, Vec<T>)> = self.shards.iter().map(|_| (vec![], vec![])).collect();
+        for (i, key) in keys.into_iter().enumerate() {
+            let shard = self.shard_index(&key);
+            batches[shard].0.push(i);
+            batches[shard].1.push(key);
+        }
+        batches
+    }
+}
+
+impl<T: Sync + Send + Clone + Eq + Hash> Database<T> for Sharded<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        let mut found = HashSet::new();
+
+        for shard in self.shards.iter() {
+            match shard.read().unwrap().get(key) {
+                Some(values) => found.extend(values.into_iter()),
+                None => {},
+            }
+        }
+
+        if found.is_empty() {
+            None
+        } else {
+            Some(found)
+        }
+    }
+
+    /// Stops at the first shard which returns an error
+    ///
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        let mut found = HashSet::new();
+
+        for shard in self.shards.iter() {
+            match try!(shard.read().unwrap().try_get(key)) {
+                Some(values) => found.extend(values.into_iter()),
+                None => {},
+            }
+        }
+
+        if found.is_empty() {
+            Ok(None)
+        } else {
+            Ok(Some(found))
+        }
+    }
+
+    /// Verifies at most `max_candidates` candidates from each shard, divided
+    /// evenly between the shards
+    ///
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        let per_shard = (max_candidates + self.shards.len() - 1) / self.shards.len();
+        let mut found = HashSet::new();
+        let mut overflowed = false;
+
+        for shard in self.shards.iter() {
+            let (values, shard_overflowed) = shard.read().unwrap().get_bounded(key, per_shard);
+
+            match values {
+                Some(values) => found.extend(values.into_iter()),
+                None => {},
+            }
+            overflowed = overflowed || shard_overflowed;
+        }
+
+        if found.is_empty() {
+            (None, overflowed)
+        } else {
+            (Some(found), overflowed)
+        }
+    }
+
+    /// Stops at the first shard which returns an error
+    ///
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        let per_shard = (max_candidates + self.shards.len() - 1) / self.shards.len();
+        let mut found = HashSet::new();
+        let mut overflowed = false;
+
+        for shard in self.shards.iter() {
+            let (values, shard_overflowed) = try!(shard.read().unwrap().try_get_bounded(key, per_shard));
+
+            match values {
+                Some(values) => found.extend(values.into_iter()),
+                None => {},
+            }
+            overflowed = overflowed || shard_overflowed;
+        }
+
+        if found.is_empty() {
+            Ok((None, overflowed))
+        } else {
+            Ok((Some(found), overflowed))
+        }
+    }
+
+    /// Reads one shard at a time, so callers which stop early skip the
+    /// remaining shards
+    ///
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        Box::new(ShardMatches{shards: &self.shards, key: key.clone(), shard: 0, pending: vec![]})
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.shards.iter().any(|shard| shard.read().unwrap().any_within(key))
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.shard(key).read().unwrap().contains(key)
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.shard(value).read().unwrap().explain(key, value)
+    }
+
+    /// The total cost of querying every shard
+    ///
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.shards.iter().fold(None, |total, shard| {
+            match (total, shard.read().unwrap().query_cost(key)) {
+                (Some(total), Some(cost)) => Some(total + cost),
+                (total, None) => total,
+                (None, cost) => cost,
+            }
+        })
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        self.insert_concurrent(key)
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        self.remove_concurrent(key)
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        self.shard(key).write().unwrap().try_remove(key)
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let mut results = vec![false; keys.len()];
+
+        for (shard, (positions, batch)) in self.shards.iter().zip(self.batches(keys).into_iter()) {
+            let inserted = shard.write().unwrap().insert_batch(batch, workers);
+            for (i, inserted) in positions.into_iter().zip(inserted.into_iter()) {
+                results[i] = inserted;
+            }
+        }
+
+        results
+    }
+
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let mut results: Vec<Result<bool, StoreError>> = keys.iter().map(|_| Ok(false)).collect();
+
+        for (shard, (positions, batch)) in self.shards.iter().zip(self.batches(keys).into_iter()) {
+            let inserted = shard.write().unwrap().try_insert_batch(batch, workers);
+            for (i, inserted) in positions.into_iter().zip(inserted.into_iter()) {
+                results[i] = inserted;
+            }
+        }
+
+        results
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        true
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        let mut db = self.shard(&key).write().unwrap();
+        db.insert(key)
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        self.shard(key).write().unwrap().remove(key)
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        let mut db = self.shard(&key).write().unwrap();
+        db.try_insert_batch(vec![key], 1).pop().unwrap()
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        self.shard(key).write().unwrap().try_remove(key)
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        let mut total = IntegrityReport::default();
+
+        for shard in self.shards.iter() {
+            match shard.read().unwrap().check() {
+                Some(report) => {
+                    total.values += report.values;
+                    total.missing += report.missing;
+                    total.dangling += report.dangling;
+                },
+                None => return None,
+            }
+        }
+
+        Some(total)
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        let mut total = IntegrityReport::default();
+
+        for shard in self.shards.iter() {
+            match shard.write().unwrap().repair() {
+                Some(report) => {
+                    total.values += report.values;
+                    total.missing += report.missing;
+                    total.dangling += report.dangling;
+                },
+                None => return None,
+            }
+        }
+
+        Some(total)
+    }
+
+    /// A plan for each shard, made under each shard's read lock in turn
+    ///
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        let mut total = IntegrityReport::default();
+        let mut plans = vec![];
+        let mut remaining = 0;
+
+        for shard in self.shards.iter() {
+            match shard.read().unwrap().plan_repair() {
+                Some(plan) => {
+                    total.values += plan.report.values;
+                    total.missing += plan.report.missing;
+                    total.dangling += plan.report.dangling;
+                    remaining += plan.remaining();
+                    plans.push(plan);
+                },
+                None => return None,
+            }
+        }
+
+        Some(RepairPlan::new(total, plans, remaining))
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        let mut made = 0;
+        let mut budget = max;
+        let mut remaining = 0;
+
+        match plan.fixes_mut::<Vec<RepairPlan>>() {
+            Some(plans) => {
+                for (shard, shard_plan) in self.shards.iter().zip(plans.iter_mut()) {
+                    let batch = cmp::min(budget, shard_plan.remaining());
+                    if batch > 0 {
+                        made += shard.write().unwrap().repair_batch(shard_plan, batch);
+                        budget -= batch;
+                    }
+                    remaining += shard_plan.remaining();
+                }
+            },
+            None => return 0,
+        }
+
+        plan.set_remaining(remaining);
+        made
+    }
+
+    /// Bucket statistics summed across shards
+    ///
+    /// Each shard holds part of every bucket, so bucket counts and sizes are
+    /// per-shard: heavy buckets are only reported once a single shard's part
+    /// of the bucket exceeds the threshold.
+    ///
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        let mut total: Option<BucketStats<T>> = None;
+
+        for shard in self.shards.iter() {
+            let stats = match shard.read().unwrap().bucket_stats() {
+                Some(stats) => stats,
+                None => return None,
+            };
+
+            total = match total {
+                Some(mut total) => {
+                    total.merge(stats);
+                    Some(total)
+                },
+                None => Some(stats),
+            };
+        }
+
+        total
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.shards.iter().fold(0, |count, shard| count + shard.read().unwrap().heavy_bucket_count())
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        for shard in self.shards.iter() {
+            shard.write().unwrap().set_bucket_threshold(threshold);
+        }
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        for shard in self.shards.iter() {
+            shard.write().unwrap().set_repair_on_insert(repair);
+        }
+    }
+
+    /// Memory summed across shards
+    ///
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        let mut total: Option<Vec<PartitionMemory>> = None;
+
+        for shard in self.shards.iter() {
+            let memory = match shard.read().unwrap().memory() {
+                Some(memory) => memory,
+                None => return None,
+            };
+
+            total = match total {
+                Some(mut total) => {
+                    PartitionMemory::merge(&mut total, memory);
+                    Some(total)
+                },
+                None => Some(memory),
+            };
+        }
+
+        total
+    }
+
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        for shard in self.shards.iter() {
+            try!(shard.read().unwrap().for_each(f));
+        }
+
+        Ok(())
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.shard(value).read().unwrap().inserted_at(value)
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        let mut found = vec![];
+        for shard in self.shards.iter() {
+            found.extend(shard.read().unwrap().inserted_before(cutoff).into_iter());
+        }
+        found
+    }
+}
+
+/// Lazily read results of a query, see `Database::get_iter`
+///
+/// Each shard's matches are read while holding its lock, since the lock
+/// can't be held across calls to `next`.
+///
+struct ShardMatches<'a, T: 'a> {
+    shards: &'a [RwLock<Box<Database<T>>>],
+    key: T,
+    // Index of the next shard to read
+    shard: usize,
+    pending: Vec<T>,
+}
+
+impl<'a, T: 'a> Iterator for ShardMatches<'a, T> {
+    type Item = T;
+
+    fn next(&mut self) -> Option<T> {
+        loop {
+            match self.pending.pop() {
+                Some(value) => return Some(value),
+                None => {
+                    if self.shard >= self.shards.len() {
+                        return None
+                    }
+                    let db = self.shards[self.shard].read().unwrap();
+                    self.pending = db.get_iter(&self.key).collect();
+                    self.shard += 1;
+                },
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+    use std::sync::Arc;
+    use std::thread;
+
+    use db::{Database, Factory, StorageBackend};
+    use db::error::StoreError;
+    use db::sharded::Sharded;
+
+    fn build(shards: usize) -> Sharded<u64> {
+        Sharded::new((0..shards).map(|_| <u64 as Factory>::build(64, 4, StorageBackend::InMemory)).collect())
+    }
+
+    #[test]
+    fn finds_values_in_every_shard() {
+        let mut db = build(4);
+        let values: Vec<u64> = (0..16u64).map(|i| i << 8).collect();
+        for v in values.iter() {
+            assert!(db.insert(*v));
+        }
+
+        for v in values.iter() {
+            assert!(db.get(v).unwrap().contains(v));
+        }
+
+        let mut found = HashSet::new();
+        db.for_each(&mut |v| { found.insert(*v); Ok(()) }).unwrap();
+        assert_eq!(found, values.iter().cloned().collect::<HashSet<u64>>());
+    }
+
+    #[test]
+    fn any_within_checks_every_shard() {
+        let mut db = build(4);
+        let values: Vec<u64> = (0..16u64).map(|i| i << 8).collect();
+        for v in values.iter() {
+            db.insert(*v);
+        }
+
+        for v in values.iter() {
+            assert!(db.any_within(&(v | 1)));
+        }
+        assert!(!db.any_within(&0xFFFF00000000u64));
+    }
+
+    #[test]
+    fn get_iter_reads_every_shard() {
+        let mut db = build(4);
+        for v in (0..16u64).map(|i| i << 8) {
+            db.insert(v);
+        }
+        db.insert(0b0001u64);
+        db.insert(0b0011u64);
+
+        let found: HashSet<u64> = db.get_iter(&0b0000u64).collect();
+        assert_eq!(Some(found), db.get(&0b0000u64));
+        assert_eq!(db.get_iter(&0xFFFF00000000u64).next(), None);
+    }
+
+    #[test]
+    fn removes_from_owning_shard() {
+        let mut db = build(4);
+        db.insert(0b0001u64);
+
+        assert!(db.remove(&0b0001u64));
+        assert!(!db.remove(&0b0001u64));
+        assert_eq!(db.get(&0b0001u64), None);
+    }
+
+    /// A database whose store is down
+    struct Unavailable;
+
+    impl Database<u64> for Unavailable {
+        fn get(&self, _: &u64) -> Option<HashSet<u64>> { panic!("store is down") }
+        fn insert(&mut self, _: u64) -> bool { panic!("store is down") }
+        fn remove(&mut self, _: &u64) -> bool { panic!("store is down") }
+
+        fn try_get_bounded(&self, _: &u64, _: usize) -> Result<(Option<HashSet<u64>>, bool), StoreError> {
+            Err(StoreError::transient("store is down"))
+        }
+
+        fn try_remove(&mut self, _: &u64) -> Result<bool, StoreError> {
+            Err(StoreError::transient("store is down"))
+        }
+
+        fn try_insert_batch(&mut self, keys: Vec<u64>, _: usize) -> Vec<Result<bool, StoreError>> {
+            keys.iter().map(|_| Err(StoreError::transient("store is down"))).collect()
+        }
+    }
+
+    #[test]
+    fn store_errors_are_returned() {
+        let db = Sharded::new(vec![Box::new(Unavailable) as Box<Database<u64>>, Box::new(Unavailable)]);
+
+        assert!(db.try_insert_concurrent(0b0001u64).unwrap_err().is_transient());
+        assert!(db.try_remove_concurrent(&0b0001u64).unwrap_err().is_transient());
+        assert!(db.try_get_bounded(&0b0001u64, 10).unwrap_err().is_transient());
+    }
+
+    #[test]
+    fn concurrent_inserts() {
+        let db = Arc::new(build(4));
+
+        let handles: Vec<_> = (0..4u64).map(|t| {
+            let db = db.clone();
+            thread::spawn(move || {
+                for i in 0..64u64 {
+                    db.insert_concurrent((t << 32) | (i << 8));
+                }
+            })
+        }).collect();
+        for h in handles.into_iter() {
+            h.join().unwrap();
+        }
+
+        let mut count = 0;
+        db.for_each(&mut |_| { count += 1; Ok(()) }).unwrap();
+        assert_eq!(count, 256);
+        assert_eq!(db.check().unwrap().values, 256);
+    }
+}
@@ -1,20 +1,38 @@
 use std::fmt;
+use std::cmp;
 use std::cmp::{PartialEq};
 use std::clone::Clone;
-use std::collections::HashSet;
-
-use num::rational::Ratio;
+use std::collections::{BTreeMap, HashSet};
+use std::sync::mpsc;
 
 use db::TypeMap;
 use db::Database;
 use db::map_set::{MapSet, InMemoryHash};
-use db::result_accumulator::ResultAccumulator;
+use db::metric::Metric;
+use db::result_accumulator::{ResultAccumulator, AccumulatorPool};
+use db::bucket_stats::{BucketStats, BucketTracker, PartitionMemory};
+use db::explain::{MatchKind, PartitionMatch};
+use db::integrity::{IntegrityReport, RepairPlan};
+use db::error::StoreError;
+use db::window;
 use db::window::{Window, Windowable};
+use db::workers;
 use db::id_map::{ToID, IDMap, Echo};
 use db::substitution::{Key, SubstitutionVariant};
 
 type TypeMapU64 = (u64, Echo<u64>, InMemoryHash<Key<u64>, u64>);
 
+/// A value's index entries in each partition: its 0-variant entry and its
+/// 1-variant entries
+type Entries<V> = Vec<(Key<V>, Vec<Key<V>>)>;
+
+/// An index entry to be removed (because it's dangling) or restored
+/// (because it's missing), as planned by `plan_repair`
+enum Fix<V, I> {
+    Remove(Key<V>, I),
+    Insert(Key<V>, I),
+}
+
 /// HmSearch Database using substitution variants
 ///
 /// Pseudo-code Index(T):
@@ -38,6 +56,9 @@ pub struct DB<T: TypeMap> {
 
     value_store: <T as TypeMap>::ValueStore,
     variant_store: <T as TypeMap>::VariantStore,
+    buckets: BucketTracker<<T as TypeMap>::Variant, <T as TypeMap>::Input>,
+    pool: AccumulatorPool<<T as TypeMap>::Input>,
+    repair_on_insert: bool,
 }
 
 impl<T: TypeMap> DB<T> where 
@@ -58,40 +79,13 @@ impl<T: TypeMap> DB<T> where
 
     /// Create a new DB with given backing store
     ///
-    /// Partitions the keyspace as evenly as possible - all partitions
-    /// will have either N or N-1 dimensions
+    /// See `window::partitions` for how the keyspace is partitioned
     ///
     pub fn with_stores(dimensions: usize, tolerance: usize, value_store: <T as TypeMap>::ValueStore, variant_store: <T as TypeMap>::VariantStore) -> DB<T> {
+        let partitions = window::partitions(dimensions, tolerance);
+        let partition_count = partitions.len();
 
-        // Determine number of partitions
-        let partition_count = if tolerance == 0 {
-            1
-        } else if tolerance > dimensions {
-            (dimensions + 3) / 2
-        } else {
-            (tolerance + 3) / 2
-        };
-
-        // Determine how many dimensions to allocate to each partition
-        let head_width = Ratio::new(dimensions, partition_count).ceil().to_integer() as usize;
-        let tail_width = Ratio::new(dimensions, partition_count).floor().to_integer() as usize;
-        let head_count = dimensions % partition_count;
-        let tail_count = partition_count - head_count;
-
-        // Build the partitions
-        let mut partitions: Vec<Window> = Vec::with_capacity(head_count + tail_count);
-        for i in 0..head_count {
-            let start_dimension = i * head_width;
-            let dimensions = head_width;
-
-            partitions.push(Window{start_dimension: start_dimension, dimensions: dimensions});
-        }
-        for i in 0..tail_count {
-            let start_dimension = (head_count * head_width) + (i * tail_width);
-            let dimensions = tail_width;
-
-            partitions.push(Window{start_dimension: start_dimension, dimensions: dimensions});
-        }
+        let buckets = BucketTracker::new(&partitions);
 
         // Done!
         return DB {
@@ -101,68 +95,469 @@ impl<T: TypeMap> DB<T> where
             partitions: partitions,
             value_store: value_store,
             variant_store: variant_store,
+            buckets: buckets,
+            pool: AccumulatorPool::new(),
+            repair_on_insert: false,
         };
     }
-}
 
-impl<T: TypeMap> Database<<T as TypeMap>::Input> for DB<T> where
-<T as TypeMap>::Window: SubstitutionVariant<<T as TypeMap>::Variant>,
-<T as TypeMap>::VariantStore: MapSet<Key<<T as TypeMap>::Variant>, <T as TypeMap>::Identifier>,
-{
-    /// Get all indexed values within `self.tolerance` hamming distance of `key`
+    /// Collect candidates for `key` from each partition
     ///
-    fn get(&self, key: &<T as TypeMap>::Input) -> Option<HashSet<<T as TypeMap>::Input>> {
-        let mut results = ResultAccumulator::new(self.tolerance, key.clone());
+    fn candidates(&self, key: &<T as TypeMap>::Input) -> ResultAccumulator<<T as TypeMap>::Input, <T as TypeMap>::Metric> {
+        self.try_candidates(key).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn try_candidates(&self, key: &<T as TypeMap>::Input) -> Result<ResultAccumulator<<T as TypeMap>::Input, <T as TypeMap>::Metric>, StoreError> {
+        let mut results: ResultAccumulator<_, <T as TypeMap>::Metric> = self.pool.accumulator(self.tolerance, key.clone());
 
         // Split across tasks?
         for window in self.partitions.iter() {
             let transformed_key = &key.window(window.start_dimension, window.dimensions);
 
-            match self.variant_store.get(&Key::Zero(window.clone(), transformed_key.null_variant())) {
+            match try!(self.variant_store.try_get(&Key::Zero(window.clone(), transformed_key.null_variant()))) {
                 Some(ids) => {
                     for id in ids.iter() {
-                        results.insert_zero_variant(&self.value_store.get(id.clone()))
+                        results.insert_zero_variant(&try!(self.value_store.try_get(id.clone())))
                     }
                 },
                 None => {},
             }
 
-            match self.variant_store.get(&Key::One(window.clone(), transformed_key.null_variant())) {
+            match try!(self.variant_store.try_get(&Key::One(window.clone(), transformed_key.null_variant()))) {
                 Some(ids) => {
                     for id in ids.iter() {
-                        results.insert_one_variant(&self.value_store.get(id.clone()))
+                        results.insert_one_variant(&try!(self.value_store.try_get(id.clone())))
                     }
                 },
                 None => {},
             }
         }
 
-        results.found_values()
+        Ok(results)
     }
 
-    /// Insert `key` into indices
+    /// Compute the index entries for `key`
+    ///
+    /// Doesn't need access to the stores, so entries for many values can be
+    /// computed in parallel
+    ///
+    fn entries(partitions: &[Window], key: &<T as TypeMap>::Input) -> Entries<<T as TypeMap>::Variant> {
+        partitions.iter().map(|window| {
+            let transformed_key = key.window(window.start_dimension, window.dimensions);
+            let zero_key = Key::Zero(window.clone(), transformed_key.null_variant());
+            let one_keys = transformed_key.substitution_variants(window.dimensions)
+                .map(|k| Key::One(window.clone(), k))
+                .collect();
+
+            (zero_key, one_keys)
+        }).collect()
+    }
+
+    /// Add `key` to the indices, given its entries
     ///
     /// Returns true if key was added to ANY index
     ///
-    fn insert(&mut self, key: <T as TypeMap>::Input) -> bool {
+    fn insert_entries(&mut self, key: <T as TypeMap>::Input, entries: Entries<<T as TypeMap>::Variant>) -> bool {
+        self.try_insert_entries(key, entries).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    /// Like `insert_entries`, stopping at the first entry the variant store
+    /// fails to write
+    ///
+    fn try_insert_entries(&mut self, key: <T as TypeMap>::Input, entries: Entries<<T as TypeMap>::Variant>) -> Result<bool, StoreError> {
         let id = key.clone().to_id();
-        self.value_store.insert(id.clone(), key.clone());
+        try!(self.value_store.try_insert(id.clone(), key.clone()));
+        self.buckets.inserted(&key);
+
+        let mut inserted = false;
+        for (i, (zero_key, one_keys)) in entries.into_iter().enumerate() {
+            if try!(self.variant_store.try_insert(zero_key.clone(), id.clone())) {
+                let size = self.variant_store.len(&zero_key);
+                match zero_key {
+                    Key::Zero(_, ref variant) => { self.buckets.grew(i, variant, size, &key); },
+                    Key::One(..) => {},
+                }
 
-        // Split across tasks?
-        self.partitions.clone().into_iter().map(|window| {
-            let transformed_key = key.window(window.start_dimension, window.dimensions);
+                for k in one_keys.into_iter() {
+                    try!(self.variant_store.try_insert(k, id.clone()));
+                }
+                inserted = true;
+            } else if self.repair_on_insert {
+                // The 0-variant entry is written first, so a write which
+                // failed part way leaves it without some of its 1-variants
+                let mut repaired = 0;
+                for k in one_keys.into_iter() {
+                    if try!(self.variant_store.try_insert(k, id.clone())) {
+                        repaired += 1;
+                    }
+                }
+                if repaired > 0 {
+                    self.buckets.repaired(i, repaired);
+                }
+            }
+        }
+
+        Ok(inserted)
+    }
+
+    /// Insert `keys` in the order given, computing their variants on
+    /// `workers` of the shared worker threads (see `db::workers`)
+    ///
+    /// Keys are split into one chunk per worker.  Chunks are added to the
+    /// indices in order as soon as their variants are ready, so results (and
+    /// the handling of duplicate keys) are the same as calling `insert` on
+    /// each key in turn.  If computing a chunk fails, it and the keys after
+    /// it aren't inserted and get an error.
+    ///
+    fn insert_ordered(&mut self, keys: Vec<<T as TypeMap>::Input>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        if workers <= 1 || keys.len() < 2 {
+            return keys.into_iter().map(|key| {
+                let entries = DB::<T>::entries(&self.partitions, &key);
+                self.try_insert_entries(key, entries)
+            }).collect()
+        }
+
+        let pool = workers::shared();
+        pool.ensure(workers);
 
-            if self.variant_store.insert(Key::Zero(window.clone(), transformed_key.null_variant()), id.clone()) {
+        let key_count = keys.len();
+        let chunk_size = (key_count + workers - 1) / workers;
+        let (tx, rx) = mpsc::channel();
+
+        let mut keys = keys.into_iter();
+        let mut chunk_count = 0;
+        loop {
+            let chunk: Vec<<T as TypeMap>::Input> = keys.by_ref().take(chunk_size).collect();
+            if chunk.is_empty() {
+                break
+            }
+
+            let tx = tx.clone();
+            let partitions = self.partitions.clone();
+            let chunk_index = chunk_count;
+            pool.spawn(move || {
+                let computed: Vec<_> = chunk.into_iter().map(|key| {
+                    let entries = DB::<T>::entries(&partitions, &key);
+                    (key, entries)
+                }).collect();
+
+                let _ = tx.send((chunk_index, computed));
+            });
+            chunk_count += 1;
+        }
+        drop(tx);
+
+        let mut results = Vec::with_capacity(key_count);
+        let mut ready = BTreeMap::new();
+        let mut next_chunk = 0;
+        for (chunk_index, computed) in rx.iter() {
+            ready.insert(chunk_index, computed);
+
+            loop {
+                match ready.remove(&next_chunk) {
+                    Some(computed) => {
+                        for (key, entries) in computed.into_iter() {
+                            results.push(self.try_insert_entries(key, entries));
+                        }
+                        next_chunk += 1;
+                    },
+                    None => break,
+                }
+            }
+        }
+
+        if next_chunk < chunk_count {
+            let err = StoreError::permanent(format!("computing the variants of batch chunk {} of {} failed", next_chunk + 1, chunk_count));
+            while results.len() < key_count {
+                results.push(Err(err.clone()));
+            }
+        }
+        results
+    }
+
+    /// Find index entries which are missing or dangling
+    ///
+    /// Returns the number of values checked, the missing entries and the
+    /// dangling entries
+    ///
+    fn problems(&self) -> (usize, Vec<(Key<<T as TypeMap>::Variant>, <T as TypeMap>::Identifier)>, Vec<(Key<<T as TypeMap>::Variant>, <T as TypeMap>::Identifier)>) {
+        let mut ids = HashSet::new();
+        let mut dangling = vec![];
+
+        // Values are indexed if they have at least one valid 0-variant entry
+        for (key, id) in self.variant_store.iter() {
+            let valid = match key {
+                Key::Zero(ref window, ref variant) => {
+                    self.value_store.contains(&id) &&
+                        self.value_store.get(id.clone()).window(window.start_dimension, window.dimensions).null_variant() == *variant
+                },
+                Key::One(..) => continue,
+            };
+
+            match valid {
+                true => { ids.insert(id); },
+                false => dangling.push((key, id)),
+            }
+        }
+
+        // 1-variant entries are valid if they belong to an indexed value
+        for (key, id) in self.variant_store.iter() {
+            let valid = match key {
+                Key::Zero(..) => continue,
+                Key::One(ref window, ref variant) => {
+                    ids.contains(&id) &&
+                        self.value_store.get(id.clone()).window(window.start_dimension, window.dimensions)
+                        .substitution_variants(window.dimensions).any(|v| v == *variant)
+                },
+            };
+
+            if !valid {
+                dangling.push((key, id));
+            }
+        }
+
+        let mut missing = vec![];
+        for id in ids.iter() {
+            let value = self.value_store.get(id.clone());
+
+            for window in self.partitions.iter() {
+                let transformed_key = value.window(window.start_dimension, window.dimensions);
+
+                let mut expected = vec![Key::Zero(window.clone(), transformed_key.null_variant())];
                 for k in transformed_key.substitution_variants(window.dimensions) {
-                    self.variant_store.insert(Key::One(window.clone(), k.clone()), id.clone());
+                    expected.push(Key::One(window.clone(), k));
+                }
+
+                for key in expected.into_iter() {
+                    let exists = match self.variant_store.get(&key) {
+                        Some(found) => found.contains(id),
+                        None => false,
+                    };
+
+                    if !exists {
+                        missing.push((key, id.clone()));
+                    }
+                }
+            }
+        }
+
+        (ids.len(), missing, dangling)
+    }
+
+    /// Whether `id`'s value is stored and has at least one 0-variant entry,
+    /// as `problems` decides which values are indexed
+    ///
+    fn indexed(&self, id: &<T as TypeMap>::Identifier) -> bool {
+        if !self.value_store.contains(id) {
+            return false
+        }
+
+        let value = self.value_store.get(id.clone());
+        self.partitions.iter().any(|window| {
+            let zero_key = Key::Zero(window.clone(), value.window(window.start_dimension, window.dimensions).null_variant());
+            match self.variant_store.get(&zero_key) {
+                Some(found) => found.contains(id),
+                None => false,
+            }
+        })
+    }
+
+    /// Whether the entry of `id` under `key` is dangling, as `problems`
+    /// decides
+    ///
+    fn dangling(&self, key: &Key<<T as TypeMap>::Variant>, id: &<T as TypeMap>::Identifier) -> bool {
+        match *key {
+            Key::Zero(ref window, ref variant) => {
+                !self.value_store.contains(id) ||
+                    self.value_store.get(id.clone()).window(window.start_dimension, window.dimensions).null_variant() != *variant
+            },
+            Key::One(ref window, ref variant) => {
+                !self.indexed(id) ||
+                    !self.value_store.get(id.clone()).window(window.start_dimension, window.dimensions)
+                    .substitution_variants(window.dimensions).any(|v| v == *variant)
+            },
+        }
+    }
+
+    /// Makes `fix` unless it's no longer needed; returns whether it was made
+    ///
+    fn apply_fix(&mut self, fix: Fix<<T as TypeMap>::Variant, <T as TypeMap>::Identifier>) -> bool {
+        match fix {
+            Fix::Remove(key, id) => {
+                if !self.dangling(&key, &id) || !self.variant_store.remove(&key, &id) {
+                    return false
+                }
+                match key {
+                    Key::Zero(ref window, ref variant) => {
+                        let partition = self.partitions.iter().position(|w| w == window).unwrap();
+                        let size = self.variant_store.len(&key);
+                        self.buckets.shrank(partition, variant, size);
+                    },
+                    Key::One(..) => {},
                 }
                 true
+            },
+            Fix::Insert(key, id) => {
+                if !self.indexed(&id) || !self.variant_store.insert(key.clone(), id.clone()) {
+                    return false
+                }
+                match key {
+                    Key::Zero(ref window, ref variant) => {
+                        let partition = self.partitions.iter().position(|w| w == window).unwrap();
+                        let size = self.variant_store.len(&key);
+                        let value = self.value_store.get(id);
+                        self.buckets.grew(partition, variant, size, &value);
+                    },
+                    Key::One(..) => {},
+                }
+                true
+            },
+        }
+    }
+}
+
+impl<T: 'static + TypeMap> Database<<T as TypeMap>::Input> for DB<T> where
+<T as TypeMap>::Window: SubstitutionVariant<<T as TypeMap>::Variant> + Ord,
+<T as TypeMap>::VariantStore: MapSet<Key<<T as TypeMap>::Variant>, <T as TypeMap>::Identifier>,
+{
+    /// Get all indexed values within `self.tolerance` hamming distance of `key`
+    ///
+    fn get(&self, key: &<T as TypeMap>::Input) -> Option<HashSet<<T as TypeMap>::Input>> {
+        let results = self.candidates(key);
+        let found = results.found_values();
+        self.pool.recycle(results, &found);
+        found
+    }
+
+    fn try_get(&self, key: &<T as TypeMap>::Input) -> Result<Option<HashSet<<T as TypeMap>::Input>>, StoreError> {
+        let results = try!(self.try_candidates(key));
+        let found = results.found_values();
+        self.pool.recycle(results, &found);
+        Ok(found)
+    }
+
+    fn get_bounded(&self, key: &<T as TypeMap>::Input, max_candidates: usize) -> (Option<HashSet<<T as TypeMap>::Input>>, bool) {
+        self.try_get_bounded(key, max_candidates).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    fn try_get_bounded(&self, key: &<T as TypeMap>::Input, max_candidates: usize) -> Result<(Option<HashSet<<T as TypeMap>::Input>>, bool), StoreError> {
+        let results = try!(self.try_candidates(key));
+        let (found, overflowed) = results.found_values_bounded(max_candidates);
+        self.pool.recycle(results, &found);
+        Ok((found, overflowed))
+    }
+
+    /// Reads candidates one partition at a time, verifying each as it's found
+    ///
+    /// Every value within tolerance is a candidate in at least one partition,
+    /// so verifying every candidate finds the same values as `get`.
+    ///
+    fn get_iter<'a>(&'a self, key: &<T as TypeMap>::Input) -> Box<Iterator<Item = <T as TypeMap>::Input> + 'a> where <T as TypeMap>::Input: 'a {
+        Box::new(Matches{
+            db: self,
+            key: key.clone(),
+            partition: 0,
+            pending: vec![],
+            seen: HashSet::new(),
+        })
+    }
+
+    /// Partitions where `value` is in the 0-variant or 1-variant entry for
+    /// `key`
+    ///
+    fn explain(&self, key: &<T as TypeMap>::Input, value: &<T as TypeMap>::Input) -> Option<Vec<PartitionMatch>> {
+        let id = value.clone().to_id();
+        let contains = |k: &Key<<T as TypeMap>::Variant>| match self.variant_store.get(k) {
+            Some(ids) => ids.contains(&id),
+            None => false,
+        };
+
+        let matches = self.partitions.iter().filter_map(|window| {
+            let transformed_key = key.window(window.start_dimension, window.dimensions);
+
+            if contains(&Key::Zero(window.clone(), transformed_key.null_variant())) {
+                Some(PartitionMatch{window: window.clone(), kind: MatchKind::Exact})
+            } else if contains(&Key::One(window.clone(), transformed_key.null_variant())) {
+                Some(PartitionMatch{window: window.clone(), kind: MatchKind::One})
             } else {
-                false
+                None
             }
+        }).collect();
+
+        Some(matches)
+    }
+
+    /// Whether `key`'s id is in its 0-variant entry in the first partition
+    /// (and, for wide keys, whether the id is `key`'s rather than a colliding
+    /// key's)
+    ///
+    fn contains(&self, key: &<T as TypeMap>::Input) -> bool where <T as TypeMap>::Input: PartialEq {
+        let id = key.clone().to_id();
+        let window = &self.partitions[0];
+        let zero_key = Key::Zero(window.clone(), key.window(window.start_dimension, window.dimensions).null_variant());
+
+        match self.variant_store.get(&zero_key) {
+            Some(ids) => ids.contains(&id) && self.value_store.get(id) == *key,
+            None => false,
+        }
+    }
+
+    /// The sizes of the 0-variant and 1-variant buckets for `key` in each
+    /// partition
+    ///
+    fn query_cost(&self, key: &<T as TypeMap>::Input) -> Option<usize> {
+        let cost = self.partitions.iter().fold(0, |cost, window| {
+            let transformed_key = key.window(window.start_dimension, window.dimensions);
+
+            cost + self.variant_store.len(&Key::Zero(window.clone(), transformed_key.null_variant())) +
+                self.variant_store.len(&Key::One(window.clone(), transformed_key.null_variant()))
+        });
+
+        Some(cost)
+    }
+
+    /// Insert `key` into indices
+    ///
+    /// Returns true if key was added to ANY index
+    ///
+    fn insert(&mut self, key: <T as TypeMap>::Input) -> bool {
+        let entries = DB::<T>::entries(&self.partitions, &key);
+        self.insert_entries(key, entries)
+    }
+
+    /// Insert `keys`, computing their variants on `workers` threads
+    ///
+    /// Keys are added in order of their bucket in the first partition, so
+    /// stores which keep entries sorted (RocksDB) see that partition's writes
+    /// in order rather than scattered across the keyspace.  Results are in the
+    /// order of `keys`, and since keys in the same bucket keep their order,
+    /// they're the same as calling `insert` on each key in turn.
+    ///
+    fn insert_batch(&mut self, keys: Vec<<T as TypeMap>::Input>, workers: usize) -> Vec<bool> {
+        self.try_insert_batch(keys, workers).into_iter()
+            .map(|inserted| inserted.unwrap_or_else(|e| panic!("{}", e)))
+            .collect()
+    }
+
+    fn try_insert_batch(&mut self, keys: Vec<<T as TypeMap>::Input>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let first = match self.partitions.first() {
+            Some(window) => window.clone(),
+            None => return self.insert_ordered(keys, workers),
+        };
+
+        let mut order: Vec<(<T as TypeMap>::Window, usize)> = keys.iter().enumerate()
+            .map(|(i, key)| (key.window(first.start_dimension, first.dimensions), i))
+            .collect();
+        order.sort();
+
+        let mut keys: Vec<Option<<T as TypeMap>::Input>> = keys.into_iter().map(Some).collect();
+        let sorted = order.iter().map(|&(_, i)| keys[i].take().unwrap()).collect();
 
-            // Collecting first to force evaluation
-        }).collect::<Vec<bool>>().iter().any(|i| *i)
+        let mut results: Vec<Option<Result<bool, StoreError>>> = order.iter().map(|_| None).collect();
+        for (&(_, i), inserted) in order.iter().zip(self.insert_ordered(sorted, workers).into_iter()) {
+            results[i] = Some(inserted);
+        }
+        results.into_iter().map(|inserted| inserted.unwrap()).collect()
     }
 
     /// Remove `key` from indices
@@ -170,24 +565,193 @@ impl<T: TypeMap> Database<<T as TypeMap>::Input> for DB<T> where
     /// Returns true if key was removed from ANY index
     ///
     fn remove(&mut self, key: &<T as TypeMap>::Input) -> bool {
+        self.try_remove(key).unwrap_or_else(|e| panic!("{}", e))
+    }
+
+    /// Stops at the first entry the variant store fails to remove
+    ///
+    fn try_remove(&mut self, key: &<T as TypeMap>::Input) -> Result<bool, StoreError> {
         let id = key.clone().to_id();
-        self.value_store.remove(&id);
+        try!(self.value_store.try_remove(&id));
 
         // Split across tasks?
-        self.partitions.clone().into_iter().map(|window| {
+        let mut removed = false;
+        for (i, window) in self.partitions.clone().into_iter().enumerate() {
             let transformed_key = &key.window(window.start_dimension, window.dimensions);
+            let zero_key = Key::Zero(window.clone(), transformed_key.null_variant());
 
-            if self.variant_store.remove(&Key::Zero(window.clone(), transformed_key.null_variant()), &id) {
-                for ref k in transformed_key.substitution_variants(window.dimensions) {
-                    self.variant_store.remove(&Key::Zero(window.clone(), k.clone()), &id);
-                }
-                true
-            } else {
-                false
+            // Remove the 1-variants even if the 0-variant is missing, so that
+            // partially indexed values don't leave dangling entries behind
+            for ref k in transformed_key.substitution_variants(window.dimensions) {
+                try!(self.variant_store.try_remove(&Key::One(window.clone(), k.clone()), &id));
+            }
+
+            if try!(self.variant_store.try_remove(&zero_key, &id)) {
+                let size = self.variant_store.len(&zero_key);
+                self.buckets.shrank(i, &transformed_key.null_variant(), size);
+                removed = true;
+            }
+        }
+
+        Ok(removed)
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        let (values, missing, dangling) = self.problems();
+
+        Some(IntegrityReport{values: values, missing: missing.len(), dangling: dangling.len()})
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        let mut plan = self.plan_repair().unwrap();
+        let remaining = plan.remaining();
+        self.repair_batch(&mut plan, remaining);
+        Some(plan.report)
+    }
+
+    /// Dangling entries are removed before missing ones are restored
+    ///
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        let (values, missing, dangling) = self.problems();
+        let report = IntegrityReport{values: values, missing: missing.len(), dangling: dangling.len()};
+
+        let mut fixes: Vec<Fix<<T as TypeMap>::Variant, <T as TypeMap>::Identifier>> = dangling.into_iter().map(|(key, id)| Fix::Remove(key, id)).collect();
+        fixes.extend(missing.into_iter().map(|(key, id)| Fix::Insert(key, id)));
+        let remaining = fixes.len();
+        Some(RepairPlan::new(report, fixes, remaining))
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        let (batch, remaining) = match plan.fixes_mut::<Vec<Fix<<T as TypeMap>::Variant, <T as TypeMap>::Identifier>>>() {
+            Some(fixes) => {
+                let count = cmp::min(max, fixes.len());
+                let batch: Vec<Fix<<T as TypeMap>::Variant, <T as TypeMap>::Identifier>> = fixes.drain(..count).collect();
+                (batch, fixes.len())
+            },
+            None => return 0,
+        };
+        plan.set_remaining(remaining);
+
+        let mut made = 0;
+        for fix in batch.into_iter() {
+            if self.apply_fix(fix) {
+                made += 1;
             }
+        }
+        made
+    }
 
-            // Collecting first to force evaluation
-        }).collect::<Vec<bool>>().iter().any(|i| *i)
+    fn bucket_stats(&self) -> Option<BucketStats<<T as TypeMap>::Input>> {
+        Some(self.buckets.stats())
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.buckets.heavy_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.buckets.set_threshold(threshold);
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.repair_on_insert = repair;
+    }
+
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        let footprint = match self.variant_store.footprint() {
+            Some(footprint) => footprint,
+            None => return None,
+        };
+
+        let mut memory: Vec<PartitionMemory> = self.partitions.iter().map(|window| {
+            PartitionMemory{window: window.clone(), buckets: 0, entries: 0, bytes: 0}
+        }).collect();
+        for (key, len, bytes) in footprint {
+            let window = match *key {
+                Key::Zero(ref window, _) | Key::One(ref window, _) => window,
+            };
+            match self.partitions.iter().position(|w| w == window) {
+                Some(i) => {
+                    memory[i].buckets += 1;
+                    memory[i].entries += len;
+                    memory[i].bytes += bytes;
+                },
+                None => {},
+            }
+        }
+
+        Some(memory)
+    }
+
+    /// Call `f` with each value having at least one 0-variant entry
+    ///
+    fn for_each(&self, f: &mut FnMut(&<T as TypeMap>::Input) -> Result<(), String>) -> Result<(), String> {
+        let mut seen = HashSet::new();
+
+        for (key, id) in self.variant_store.iter() {
+            match key {
+                Key::Zero(..) => {},
+                Key::One(..) => continue,
+            }
+
+            if !self.value_store.contains(&id) || !seen.insert(id.clone()) {
+                continue
+            }
+
+            try!(f(&self.value_store.get(id)));
+        }
+
+        Ok(())
+    }
+}
+
+/// Lazily verified results of a query, see `Database::get_iter`
+///
+struct Matches<'a, T: 'a + TypeMap> {
+    db: &'a DB<T>,
+    key: <T as TypeMap>::Input,
+    // Index of the next partition to read candidates from
+    partition: usize,
+    pending: Vec<<T as TypeMap>::Identifier>,
+    // Candidates are often found in more than one partition
+    seen: HashSet<<T as TypeMap>::Identifier>,
+}
+
+impl<'a, T: 'a + TypeMap> Iterator for Matches<'a, T> where
+<T as TypeMap>::Window: SubstitutionVariant<<T as TypeMap>::Variant>,
+<T as TypeMap>::VariantStore: MapSet<Key<<T as TypeMap>::Variant>, <T as TypeMap>::Identifier>,
+{
+    type Item = <T as TypeMap>::Input;
+
+    fn next(&mut self) -> Option<<T as TypeMap>::Input> {
+        loop {
+            match self.pending.pop() {
+                Some(id) => {
+                    if !self.seen.insert(id.clone()) {
+                        continue
+                    }
+                    let value = self.db.value_store.get(id);
+                    if <<T as TypeMap>::Metric as Metric<<T as TypeMap>::Input>>::within(&self.key, &value, self.db.tolerance) {
+                        return Some(value)
+                    }
+                },
+                None => {
+                    if self.partition >= self.db.partitions.len() {
+                        return None
+                    }
+                    let window = self.db.partitions[self.partition].clone();
+                    self.partition += 1;
+
+                    let transformed_key = self.key.window(window.start_dimension, window.dimensions);
+                    for k in vec![Key::Zero(window.clone(), transformed_key.null_variant()), Key::One(window, transformed_key.null_variant())].iter() {
+                        match self.db.variant_store.get(k) {
+                            Some(ids) => self.pending.extend(ids.into_iter()),
+                            None => {},
+                        }
+                    }
+                },
+            }
+        }
     }
 }
 
@@ -295,7 +859,10 @@ mod test {
     use self::rand::{thread_rng, sample, Rng};
 
     use db::*;
-    use db::substitution::{DB};
+    use db::substitution::{DB, Key, SubstitutionVariant};
+    use db::map_set::MapSet;
+    use db::window::Windowable;
+    use db::integrity::IntegrityReport;
 
     use db::substitution::db::{TypeMapU64};
 
@@ -565,4 +1132,286 @@ fn idempotent_delete() {
     }
     quickcheck(prop as fn(u64, u64, u64) -> quickcheck::TestResult);
 }
+
+#[test]
+fn consistent_db_checks_ok() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+    p.insert(0b1111u64);
+
+    let report = p.check().unwrap();
+    assert!(report.is_ok());
+    assert_eq!(report.values, 2);
+}
+
+#[test]
+fn partially_indexed_values_are_repaired() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+
+    // Drop the value from the first partition
+    let window = p.partitions[0].clone();
+    let transformed_key: u64 = 0b0001u64.window(window.start_dimension, window.dimensions);
+    p.variant_store.remove(&Key::Zero(window.clone(), transformed_key.null_variant()), &0b0001u64);
+    assert!(!p.check().unwrap().is_ok());
+
+    let report = p.repair().unwrap();
+    assert_eq!(report.missing, 1);
+    assert_eq!(report.dangling, 0);
+    assert!(p.check().unwrap().is_ok());
+}
+
+#[test]
+fn reinserts_restore_missing_entries_in_repair_mode() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+
+    // Drop one of the value's 1-variants from the first partition
+    let window = p.partitions[0].clone();
+    let transformed_key: u64 = 0b0001u64.window(window.start_dimension, window.dimensions);
+    let variant = transformed_key.substitution_variants(window.dimensions).next().unwrap();
+    p.variant_store.remove(&Key::One(window.clone(), variant), &0b0001u64);
+    assert!(!p.check().unwrap().is_ok());
+
+    // Without repair mode, re-inserts are ignored
+    assert!(!p.insert(0b0001u64));
+    assert!(!p.check().unwrap().is_ok());
+
+    p.set_repair_on_insert(true);
+    assert!(!p.insert(0b0001u64));
+    assert!(p.check().unwrap().is_ok());
+    assert_eq!(p.bucket_stats().unwrap().partitions[0].repaired, 1);
+}
+
+#[test]
+fn dangling_entries_are_removed() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+
+    // 0b0111 isn't a substitution variant of 0b0001
+    let window = p.partitions[0].clone();
+    let variant: u64 = 0b0111u64.window(window.start_dimension, window.dimensions);
+    p.variant_store.insert(Key::One(window, variant), 0b0001u64);
+
+    let report = p.repair().unwrap();
+    assert_eq!(report.dangling, 1);
+    assert!(p.check().unwrap().is_ok());
+}
+
+#[test]
+fn repairs_are_made_in_batches() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+    p.insert(0b1111u64);
+
+    // Drop both values from the first partition
+    let window = p.partitions[0].clone();
+    for value in vec![0b0001u64, 0b1111u64].into_iter() {
+        let transformed_key: u64 = value.window(window.start_dimension, window.dimensions);
+        p.variant_store.remove(&Key::Zero(window.clone(), transformed_key.null_variant()), &value);
+    }
+
+    let mut plan = p.plan_repair().unwrap();
+    assert_eq!(plan.report.missing, 2);
+    assert_eq!(plan.remaining(), 2);
+
+    // The fix for a value removed since the plan is skipped
+    p.remove(&0b1111u64);
+    let first = p.repair_batch(&mut plan, 1);
+    assert_eq!(plan.remaining(), 1);
+    let second = p.repair_batch(&mut plan, 1);
+    assert_eq!(plan.remaining(), 0);
+    assert_eq!(first + second, 1);
+    assert_eq!(p.check(), Some(IntegrityReport{values: 1, missing: 0, dangling: 0}));
+}
+
+#[test]
+fn remove_leaves_no_dangling_entries() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+    p.insert(0b1111u64);
+    p.remove(&0b1111u64);
+
+    assert_eq!(p.check(), Some(IntegrityReport{values: 1, missing: 0, dangling: 0}));
+    assert_eq!(p.get(&0b0111u64), Some(vec![0b0001u64].into_iter().collect()));
+}
+
+#[test]
+fn remove_partially_indexed_value() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+
+    let window = p.partitions[0].clone();
+    let transformed_key: u64 = 0b0001u64.window(window.start_dimension, window.dimensions);
+    p.variant_store.remove(&Key::Zero(window.clone(), transformed_key.null_variant()), &0b0001u64);
+
+    assert!(p.remove(&0b0001u64));
+    assert_eq!(p.check(), Some(IntegrityReport{values: 0, missing: 0, dangling: 0}));
+}
+
+#[test]
+fn for_each_visits_every_value_once() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+    p.insert(0b1111u64);
+    p.insert(0xFF00u64);
+    p.remove(&0b1111u64);
+
+    let mut found = vec![];
+    assert_eq!(p.for_each(&mut |v| { found.push(*v); Ok(()) }), Ok(()));
+    found.sort();
+
+    assert_eq!(found, vec![0b0001u64, 0xFF00u64]);
+}
+
+#[test]
+fn for_each_stops_at_first_error() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+    p.insert(0xFF00u64);
+
+    let mut calls = 0;
+    let result = p.for_each(&mut |_| { calls += 1; Err("stop".to_string()) });
+
+    assert_eq!(result, Err("stop".to_string()));
+    assert_eq!(calls, 1);
+}
+
+#[test]
+fn insert_batch_matches_insert() {
+    let keys: Vec<u64> = vec![0b0001, 0xFF00, 0b0001, 0xFF000000, 0b1111, 0xFF00];
+
+    let mut a: DB<TypeMapU64> = DB::new(64, 4);
+    let expected: Vec<bool> = keys.iter().map(|k| a.insert(*k)).collect();
+
+    let mut b: DB<TypeMapU64> = DB::new(64, 4);
+    assert_eq!(b.insert_batch(keys.clone(), 4), expected);
+    assert_eq!(b.insert_batch(keys.clone(), 4), vec![false; keys.len()]);
+
+    for k in keys.iter() {
+        assert_eq!(b.get(k), a.get(k));
+    }
+    assert!(b.check().unwrap().is_ok());
+}
+
+#[test]
+fn memory_counts_every_entry_by_partition() {
+    let mut db: DB<TypeMapU64> = DB::new(64, 4);
+    db.insert(0b0001);
+    db.insert(0xFF00);
+
+    let memory = db.memory().unwrap();
+    assert_eq!(memory.len(), 3);
+    for (p, window) in memory.iter().zip(window::partitions(64, 4).iter()) {
+        assert_eq!(p.window, *window);
+        assert_eq!(p.entries, 2 * (window.dimensions + 1));
+        assert!(p.bytes > 0);
+    }
+
+    db.remove(&0xFF00);
+    let entries = db.memory().unwrap().iter().fold(0, |n, p| n + p.entries);
+    assert_eq!(entries, 64 + 3);
+}
+
+#[test]
+fn insert_ordered_matches_one_worker() {
+    let mut rng = thread_rng();
+    let mut keys: Vec<u64> = (0..200).map(|_| rng.gen::<u64>()).collect();
+    let duplicates: Vec<u64> = keys.iter().enumerate().filter(|&(i, _)| i % 7 == 0).map(|(_, k)| *k).collect();
+    keys.extend(duplicates);
+
+    let mut a: DB<TypeMapU64> = DB::new(64, 4);
+    let expected = a.insert_ordered(keys.clone(), 1);
+    assert!(expected.iter().any(|inserted| *inserted == Ok(false)));
+
+    let mut b: DB<TypeMapU64> = DB::new(64, 4);
+    assert_eq!(b.insert_ordered(keys.clone(), 4), expected);
+    assert!(::db::workers::shared().threads() >= 4);
+
+    for k in keys.iter() {
+        assert_eq!(b.get(k), a.get(k));
+    }
+    assert!(b.check().unwrap().is_ok());
+}
+
+#[test]
+fn insert_batch_returns_results_in_key_order() {
+    // Keys are given out of order of their buckets in the first partition
+    let keys: Vec<u64> = vec![0b1111, 0xFF00, 0b0111, 0b1111, 0b0011, 0b0111];
+
+    for workers in vec![1, 4] {
+        let mut db: DB<TypeMapU64> = DB::new(64, 4);
+        assert_eq!(db.insert_batch(keys.clone(), workers), vec![true, true, true, false, true, false]);
+
+        for k in keys.iter() {
+            assert!(db.get(k).unwrap().contains(k));
+        }
+        assert!(db.check().unwrap().is_ok());
+    }
+}
+
+#[test]
+fn explain_reports_matching_partitions() {
+    use db::explain::MatchKind;
+
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+
+    let matches = p.explain(&0b0000u64, &0b0001u64).unwrap();
+    assert_eq!(matches.len(), p.partitions.len());
+    assert_eq!(matches.iter().filter(|m| m.kind == MatchKind::One).count(), 1);
+
+    // Values which aren't candidates aren't in any partition
+    assert_eq!(p.explain(&0b0000u64, &0xFFFFu64), Some(vec![]));
+}
+
+#[test]
+fn query_cost_counts_candidates_in_each_partition() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    assert_eq!(p.query_cost(&0b0000u64), Some(0));
+
+    // 0b0001 is a 1-variant candidate in the first partition and a 0-variant
+    // candidate in the other two; 0xFF00 only in the other two
+    p.insert(0b0001u64);
+    p.insert(0xFF00u64);
+    assert_eq!(p.query_cost(&0b0000u64), Some(5));
+}
+
+#[test]
+fn contains_only_stored_values() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+
+    assert!(p.contains(&0b0001u64));
+    // Within tolerance, but not stored
+    assert!(!p.contains(&0b0000u64));
+
+    p.remove(&0b0001u64);
+    assert!(!p.contains(&0b0001u64));
+}
+
+#[test]
+fn get_iter_matches_get() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+    p.insert(0b1111u64);
+    p.insert(0xFF00u64);
+
+    let mut found: Vec<u64> = p.get_iter(&0b0000u64).collect();
+    found.sort();
+    assert_eq!(found, vec![0b0001u64, 0b1111u64]);
+
+    assert_eq!(p.get_iter(&0xFFFF0000u64).next(), None);
+}
+
+#[test]
+fn any_within_matches_get() {
+    let mut p: DB<TypeMapU64> = DB::new(64, 4);
+    p.insert(0b0001u64);
+    p.insert(0xFF00u64);
+
+    assert!(p.any_within(&0b0000u64));
+    assert!(p.any_within(&0xFF01u64));
+    assert!(!p.any_within(&0xFFFF0000u64));
+}
 }
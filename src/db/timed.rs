@@ -0,0 +1,225 @@
+//! Operation timing
+//!
+//! `Timed` passes every operation through to the wrapped database, reporting
+//! how long reads and writes took to a callback.  The callback is given the
+//! name of the operation (`"get"`, `"insert"`, `"insert_batch"` or
+//! `"remove"`) and its duration.
+
+use std::collections::HashSet;
+use std::time::{Duration, Instant, SystemTime};
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+
+pub struct Timed<T> {
+    db: Box<Database<T>>,
+    on_op: Box<Fn(&'static str, Duration) + Sync + Send>,
+}
+
+impl<T> Timed<T> {
+    pub fn new(db: Box<Database<T>>, on_op: Box<Fn(&'static str, Duration) + Sync + Send>) -> Timed<T> {
+        Timed{db: db, on_op: on_op}
+    }
+
+    fn record(&self, op: &'static str, start: Instant) {
+        (self.on_op)(op, start.elapsed())
+    }
+}
+
+impl<T: Sync + Send> Database<T> for Timed<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        let start = Instant::now();
+        let found = self.db.get(key);
+        self.record("get", start);
+        found
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        let start = Instant::now();
+        let found = self.db.try_get(key);
+        self.record("get", start);
+        found
+    }
+
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        let start = Instant::now();
+        let found = self.db.get_bounded(key, max_candidates);
+        self.record("get", start);
+        found
+    }
+
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        let start = Instant::now();
+        let found = self.db.try_get_bounded(key, max_candidates);
+        self.record("get", start);
+        found
+    }
+
+    /// Not timed, since the work happens as the iterator is consumed
+    ///
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        self.db.get_iter(key)
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        let start = Instant::now();
+        let found = self.db.any_within(key);
+        self.record("any_within", start);
+        found
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.db.contains(key)
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.db.explain(key, value)
+    }
+
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.db.query_cost(key)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        let start = Instant::now();
+        let inserted = self.db.insert(key);
+        self.record("insert", start);
+        inserted
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        let start = Instant::now();
+        let removed = self.db.remove(key);
+        self.record("remove", start);
+        removed
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        let start = Instant::now();
+        let removed = self.db.try_remove(key);
+        self.record("remove", start);
+        removed
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        let start = Instant::now();
+        let inserted = self.db.insert_batch(keys, workers);
+        self.record("insert_batch", start);
+        inserted
+    }
+
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        let start = Instant::now();
+        let inserted = self.db.try_insert_batch(keys, workers);
+        self.record("insert_batch", start);
+        inserted
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        self.db.concurrent_writes()
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        let start = Instant::now();
+        let inserted = self.db.insert_concurrent(key);
+        self.record("insert", start);
+        inserted
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        let start = Instant::now();
+        let removed = self.db.remove_concurrent(key);
+        self.record("remove", start);
+        removed
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        let start = Instant::now();
+        let inserted = self.db.try_insert_concurrent(key);
+        self.record("insert", start);
+        inserted
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        let start = Instant::now();
+        let removed = self.db.try_remove_concurrent(key);
+        self.record("remove", start);
+        removed
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        self.db.check()
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        self.db.repair()
+    }
+
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        self.db.plan_repair()
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        self.db.repair_batch(plan, max)
+    }
+
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        self.db.bucket_stats()
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.db.heavy_bucket_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.db.set_bucket_threshold(threshold)
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.db.set_repair_on_insert(repair)
+    }
+
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        self.db.memory()
+    }
+
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        self.db.for_each(f)
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.db.inserted_at(value)
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        self.db.inserted_before(cutoff)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::{Arc, Mutex};
+    use std::time::Duration;
+
+    use db::{Database, Factory, StorageBackend};
+    use db::timed::Timed;
+
+    #[test]
+    fn reports_each_operation() {
+        let ops = Arc::new(Mutex::new(vec![]));
+        let ops_clone = ops.clone();
+
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let mut db = Timed::new(db, Box::new(move |op: &'static str, _: Duration| ops_clone.lock().unwrap().push(op)));
+
+        assert!(db.insert(0b0001u64));
+        assert!(db.get(&0b0000u64).unwrap().contains(&0b0001u64));
+        assert_eq!(db.insert_batch(vec![0xFF00u64], 2), vec![true]);
+        assert!(db.remove(&0b0001u64));
+
+        assert_eq!(*ops.lock().unwrap(), vec!["insert", "get", "insert_batch", "remove"]);
+    }
+}
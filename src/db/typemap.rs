@@ -7,6 +7,7 @@ use db::id_map;
 use db::map_set;
 use db::deletion;
 use db::substitution;
+use db::metric;
 use db::{TypeMap, StorageBackend, Factory, Database};
 
 macro_rules! deletion_inmemory {
@@ -19,6 +20,7 @@ macro_rules! deletion_inmemory {
             type Identifier = u64;
             type ValueStore = id_map::HashMap<u64, $elem>;
             type VariantStore = map_set::InMemoryHash<deletion::Key<deletion::Dvec>, u64>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -33,6 +35,7 @@ macro_rules! deletion_temp_rocksdb {
             type Identifier = u64;
             type ValueStore = id_map::TempRocksDB<u64, $elem>;
             type VariantStore = map_set::TempRocksDB<deletion::Key<deletion::Dvec>, u64>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -47,6 +50,7 @@ macro_rules! deletion_rocksdb {
             type Identifier = u64;
             type ValueStore = id_map::RocksDB<u64, $elem>;
             type VariantStore = map_set::RocksDB<deletion::Key<deletion::Dvec>, u64>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -61,6 +65,7 @@ macro_rules! substitution_echo_inmemory {
             type Identifier = $elem;
             type ValueStore = id_map::Echo<$elem>;
             type VariantStore = map_set::InMemoryHash<substitution::Key<$v>, $elem>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -75,6 +80,7 @@ macro_rules! substitution_echo_temp_rocksdb {
             type Identifier = $elem;
             type ValueStore = id_map::Echo<$elem>;
             type VariantStore = map_set::TempRocksDB<substitution::Key<$v>, $elem>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -90,6 +96,7 @@ macro_rules! substitution_echo_rocksdb {
             type Identifier = $elem;
             type ValueStore = id_map::Echo<$elem>;
             type VariantStore = map_set::RocksDB<substitution::Key<$v>, $elem>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -104,6 +111,7 @@ macro_rules! substitution_map_inmemory {
             type Identifier = u64;
             type ValueStore = id_map::HashMap<u64, $elem>;
             type VariantStore = map_set::InMemoryHash<substitution::Key<$v>, u64>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -118,6 +126,7 @@ macro_rules! substitution_map_temp_rocksdb {
             type Identifier = u64;
             type ValueStore = id_map::TempRocksDB<u64, $elem>;
             type VariantStore = map_set::TempRocksDB<substitution::Key<$v>, u64>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
@@ -132,11 +141,30 @@ macro_rules! substitution_map_rocksdb {
             type Identifier = u64;
             type ValueStore = id_map::RocksDB<u64, $elem>;
             type VariantStore = map_set::RocksDB<substitution::Key<$v>, u64>;
+            type Metric = metric::HammingDistance;
         }
     }
 }
 
 
+// MinHash signatures are indexed like any other vector of u64, but verified
+// using `MinHashJaccard`.  The trailing metric type distinguishes these
+// typemaps from the `Vec<u64>` deletion typemaps.
+macro_rules! minhash {
+    ($t:ident, $value_store:ty, $variant_store:ty) => {
+        pub type $t = (Vec<u64>, $value_store, $variant_store, metric::MinHashJaccard);
+        impl TypeMap for $t {
+            type Input = Vec<u64>;
+            type Window = Vec<u64>;
+            type Variant = deletion::Dvec;
+            type Identifier = u64;
+            type ValueStore = $value_store;
+            type VariantStore = $variant_store;
+            type Metric = metric::MinHashJaccard;
+        }
+    }
+}
+
 deletion_inmemory!(VecU8InMemory, Vec<u8>);
 deletion_inmemory!(VecU16InMemory, Vec<u16>);
 deletion_inmemory!(VecU32InMemory, Vec<u32>);
@@ -229,6 +257,41 @@ substitution_map_rocksdb!(U64x2wU32RocksDB, [u64; 2], u32);
 substitution_map_rocksdb!(U64x2wU64RocksDB, [u64; 2], u64);
 substitution_map_rocksdb!(U64x2wU64x2RocksDB, [u64; 2], [u64; 2]);
 
+minhash!(MinHashInMemory, id_map::HashMap<u64, Vec<u64>>, map_set::InMemoryHash<deletion::Key<deletion::Dvec>, u64>);
+minhash!(MinHashTempRocksDB, id_map::TempRocksDB<u64, Vec<u64>>, map_set::TempRocksDB<deletion::Key<deletion::Dvec>, u64>);
+minhash!(MinHashRocksDB, id_map::RocksDB<u64, Vec<u64>>, map_set::RocksDB<deletion::Key<deletion::Dvec>, u64>);
+
+/// Build a database of MinHash signatures with `bands` components
+///
+/// `tolerance` is the number of components which may differ; see
+/// `MinHashJaccard::tolerance` to derive it from a similarity threshold
+///
+pub fn build_minhash(bands: usize, tolerance: usize, backend: StorageBackend) -> Box<Database<Vec<u64>>> {
+    match backend {
+        StorageBackend::InMemory => {
+            let db: deletion::DB<MinHashInMemory> = deletion::DB::new(bands, tolerance);
+            Box::new(db)
+        },
+        StorageBackend::TempRocksDB => {
+            let id_map = id_map::TempRocksDB::new();
+            let map_set = map_set::TempRocksDB::new();
+            let db: deletion::DB<MinHashTempRocksDB> = deletion::DB::with_stores(bands, tolerance, id_map, map_set);
+            Box::new(db)
+        },
+        StorageBackend::RocksDB(ref path) => {
+            let mut id_map_path = path.clone();
+            id_map_path.push("id_map");
+            let mut map_set_path = PathBuf::from(path);
+            map_set_path.push("map_set");
+
+            let id_map = id_map::RocksDB::new(id_map_path.to_str().unwrap());
+            let map_set = map_set::RocksDB::new(map_set_path.to_str().unwrap());
+            let db: deletion::DB<MinHashRocksDB> = deletion::DB::with_stores(bands, tolerance, id_map, map_set);
+            Box::new(db)
+        },
+    }
+}
+
 impl Factory for Vec<[u64; 4]> {
     fn build(dimensions: usize, tolerance: usize, backend: StorageBackend) -> Box<Database<Vec<[u64; 4]>>> {
         match backend {
@@ -0,0 +1,152 @@
+//! Randomized verification of query results
+//!
+//! `run` applies a random sequence of inserts, removes and queries to a
+//! database, and checks each result against a brute-force model: every
+//! stored value within tolerance of a query must be returned, and no other
+//! value may be.  Values are generated near already-stored values, so queries
+//! regularly land at, just inside and just outside the tolerance.
+//!
+//! Sequences are generated from a seed, so a failing seed reproduces the same
+//! failure.
+
+use std::collections::HashSet;
+use std::hash::Hash;
+
+use rand::{Rng, SeedableRng, XorShiftRng};
+
+use db::{Database, Factory, StorageBackend};
+use db::hamming::Hamming;
+use hyperplane::FromBits;
+
+/// Stop reporting after this many failures
+const MAX_FAILURES: usize = 10;
+
+#[derive(Clone, Debug, Default, PartialEq, Eq)]
+pub struct Report {
+    pub inserts: usize,
+    pub removes: usize,
+    pub queries: usize,
+    /// Descriptions of the first `MAX_FAILURES` results which didn't match
+    /// the model
+    pub failures: Vec<String>,
+}
+
+impl Report {
+    pub fn ok(&self) -> bool {
+        self.failures.is_empty()
+    }
+
+    fn fail(&mut self, failure: String) {
+        if self.failures.len() < MAX_FAILURES {
+            self.failures.push(failure);
+        }
+    }
+}
+
+/// Apply `ops` random operations to an in-memory database of `T` with the
+/// given tolerance
+///
+pub fn run<T>(seed: u64, ops: usize, tolerance: usize) -> Report where
+T: 'static + Clone + Eq + Hash + Hamming + FromBits + Factory + ::std::fmt::Debug,
+{
+    let mut db: Box<Database<T>> = Factory::build(T::bits(), tolerance, StorageBackend::InMemory);
+    let mut model: Vec<T> = vec![];
+    let mut rng = XorShiftRng::from_seed([seed as u32, (seed >> 32) as u32, 0x9E3779B9, 0x7F4A7C15]);
+    let mut report = Report::default();
+
+    for _ in 0..ops {
+        let value = generate(&mut rng, &model, tolerance);
+
+        match rng.gen_range(0, 10) {
+            // Inserts outnumber removes, so the database grows
+            0...3 => {
+                report.inserts += 1;
+                let expected = !model.contains(&value);
+                if db.insert(value.clone()) != expected {
+                    report.fail(format!("insert({:?}) returned {}", value, !expected));
+                }
+                if expected {
+                    model.push(value);
+                }
+            },
+            4 => {
+                // Usually remove a stored value
+                let value = match model.is_empty() || rng.gen() {
+                    true => value,
+                    false => model[rng.gen_range(0, model.len())].clone(),
+                };
+                report.removes += 1;
+                let expected = model.contains(&value);
+                if db.remove(&value) != expected {
+                    report.fail(format!("remove({:?}) returned {}", value, !expected));
+                }
+                model.retain(|v| *v != value);
+            },
+            _ => {
+                report.queries += 1;
+                let expected: HashSet<T> = model.iter().filter(|v| v.hamming_lte(&value, tolerance)).cloned().collect();
+                let found = match db.get(&value) {
+                    Some(found) => found,
+                    None => HashSet::new(),
+                };
+
+                for v in expected.difference(&found) {
+                    report.fail(format!("get({:?}) missed {:?} at distance {}", value, v, v.hamming(&value)));
+                }
+                for v in found.difference(&expected) {
+                    report.fail(format!("get({:?}) returned {:?} at distance {}", value, v, v.hamming(&value)));
+                }
+            },
+        }
+    }
+
+    report
+}
+
+/// A random value, usually a few bits away from a stored value
+///
+fn generate<T: FromBits, R: Rng>(rng: &mut R, model: &[T], tolerance: usize) -> T {
+    if model.is_empty() || rng.gen_range(0, 4) == 0 {
+        let bits: Vec<bool> = (0..T::bits()).map(|_| rng.gen()).collect();
+        return T::from_bits(&bits)
+    }
+
+    let mut bits = model[rng.gen_range(0, model.len())].to_bits();
+    for _ in 0..rng.gen_range(0, tolerance + 3) {
+        let i = rng.gen_range(0, bits.len());
+        bits[i] = !bits[i];
+    }
+    T::from_bits(&bits)
+}
+
+#[cfg(test)]
+mod test {
+    use db::verify::run;
+
+    #[test]
+    fn verify_u32() {
+        for seed in 0..4 {
+            let report = run::<u32>(seed, 500, 3);
+            assert!(report.ok(), "seed {}: {:?}", seed, report.failures);
+        }
+    }
+
+    #[test]
+    fn verify_u64() {
+        for seed in 0..4 {
+            let report = run::<u64>(seed, 500, 6);
+            assert!(report.ok(), "seed {}: {:?}", seed, report.failures);
+        }
+    }
+
+    #[test]
+    fn verify_u128() {
+        let report = run::<[u64; 2]>(0, 300, 10);
+        assert!(report.ok(), "{:?}", report.failures);
+    }
+
+    #[test]
+    fn same_seed_same_sequence() {
+        assert_eq!(run::<u64>(42, 200, 4), run::<u64>(42, 200, 4));
+    }
+}
@@ -0,0 +1,239 @@
+//! Weighted hamming distance queries
+//!
+//! `Weighted` filters the results of an underlying database by weighted
+//! hamming distance, so that some dimensions count more than others.  Weights
+//! are integers; a dimension's weight is added to the distance when the
+//! dimension differs.
+//!
+//! Candidates are still generated using the unweighted distance.  With all
+//! weights at least 1, the weighted distance is never less than the unweighted
+//! distance, so no match within tolerance can be missed.  Dimensions with a
+//! weight of 0 would break this guarantee, so they must be masked out of the
+//! keys before they reach the underlying database (see `normalize::Mask` and
+//! `BitMask::mask_excluding`).
+
+use std::collections::HashSet;
+use std::time::SystemTime;
+
+use db::Database;
+use db::bucket_stats::{BucketStats, PartitionMemory};
+use db::error::StoreError;
+use db::explain::PartitionMatch;
+use db::integrity::{IntegrityReport, RepairPlan};
+use db::hamming::Hamming;
+
+pub struct Weighted<T> {
+    db: Box<Database<T>>,
+    weights: Vec<usize>,
+    tolerance: usize,
+}
+
+impl<T> Weighted<T> {
+    pub fn new(db: Box<Database<T>>, weights: Vec<usize>, tolerance: usize) -> Weighted<T> {
+        Weighted{db: db, weights: weights, tolerance: tolerance}
+    }
+
+    /// Dimensions which should be masked out of keys
+    ///
+    pub fn ignored_dimensions(weights: &[usize]) -> Vec<usize> {
+        weights.iter().enumerate().filter(|&(_, w)| *w == 0).map(|(i, _)| i).collect()
+    }
+}
+
+impl<T: Hamming> Weighted<T> {
+    fn filter(&self, key: &T, found: Option<HashSet<T>>) -> Option<HashSet<T>> {
+        match found {
+            Some(found) => {
+                let matches: HashSet<T> = found.into_iter()
+                    .filter(|v| key.weighted_hamming(v, &self.weights) <= self.tolerance)
+                    .collect();
+
+                match matches.len() {
+                    0 => None,
+                    _ => Some(matches),
+                }
+            },
+            None => None,
+        }
+    }
+}
+
+impl<T: Clone + Hamming> Database<T> for Weighted<T> {
+    fn get(&self, key: &T) -> Option<HashSet<T>> {
+        self.filter(key, self.db.get(key))
+    }
+
+    fn try_get(&self, key: &T) -> Result<Option<HashSet<T>>, StoreError> {
+        let found = try!(self.db.try_get(key));
+        Ok(self.filter(key, found))
+    }
+
+    fn get_bounded(&self, key: &T, max_candidates: usize) -> (Option<HashSet<T>>, bool) {
+        let (found, overflowed) = self.db.get_bounded(key, max_candidates);
+
+        (self.filter(key, found), overflowed)
+    }
+
+    fn try_get_bounded(&self, key: &T, max_candidates: usize) -> Result<(Option<HashSet<T>>, bool), StoreError> {
+        let (found, overflowed) = try!(self.db.try_get_bounded(key, max_candidates));
+
+        Ok((self.filter(key, found), overflowed))
+    }
+
+    fn get_iter<'a>(&'a self, key: &T) -> Box<Iterator<Item = T> + 'a> where T: 'a {
+        let query = key.clone();
+        Box::new(self.db.get_iter(key).filter(move |v| query.weighted_hamming(v, &self.weights) <= self.tolerance))
+    }
+
+    fn any_within(&self, key: &T) -> bool {
+        self.get_iter(key).next().is_some()
+    }
+
+    fn contains(&self, key: &T) -> bool where T: PartialEq {
+        self.db.contains(key)
+    }
+
+    fn explain(&self, key: &T, value: &T) -> Option<Vec<PartitionMatch>> {
+        self.db.explain(key, value)
+    }
+
+    fn query_cost(&self, key: &T) -> Option<usize> {
+        self.db.query_cost(key)
+    }
+
+    fn insert(&mut self, key: T) -> bool {
+        self.db.insert(key)
+    }
+
+    fn remove(&mut self, key: &T) -> bool {
+        self.db.remove(key)
+    }
+
+    fn try_remove(&mut self, key: &T) -> Result<bool, StoreError> {
+        self.db.try_remove(key)
+    }
+
+    fn insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<bool> {
+        self.db.insert_batch(keys, workers)
+    }
+
+    fn try_insert_batch(&mut self, keys: Vec<T>, workers: usize) -> Vec<Result<bool, StoreError>> {
+        self.db.try_insert_batch(keys, workers)
+    }
+
+    fn concurrent_writes(&self) -> bool {
+        self.db.concurrent_writes()
+    }
+
+    fn insert_concurrent(&self, key: T) -> bool {
+        self.db.insert_concurrent(key)
+    }
+
+    fn remove_concurrent(&self, key: &T) -> bool {
+        self.db.remove_concurrent(key)
+    }
+
+    fn try_insert_concurrent(&self, key: T) -> Result<bool, StoreError> {
+        self.db.try_insert_concurrent(key)
+    }
+
+    fn try_remove_concurrent(&self, key: &T) -> Result<bool, StoreError> {
+        self.db.try_remove_concurrent(key)
+    }
+
+    fn check(&self) -> Option<IntegrityReport> {
+        self.db.check()
+    }
+
+    fn repair(&mut self) -> Option<IntegrityReport> {
+        self.db.repair()
+    }
+
+    fn plan_repair(&self) -> Option<RepairPlan> {
+        self.db.plan_repair()
+    }
+
+    fn repair_batch(&mut self, plan: &mut RepairPlan, max: usize) -> usize {
+        self.db.repair_batch(plan, max)
+    }
+
+    fn bucket_stats(&self) -> Option<BucketStats<T>> {
+        self.db.bucket_stats()
+    }
+
+    fn heavy_bucket_count(&self) -> usize {
+        self.db.heavy_bucket_count()
+    }
+
+    fn set_bucket_threshold(&mut self, threshold: usize) {
+        self.db.set_bucket_threshold(threshold)
+    }
+
+    fn set_repair_on_insert(&mut self, repair: bool) {
+        self.db.set_repair_on_insert(repair)
+    }
+
+    fn memory(&self) -> Option<Vec<PartitionMemory>> {
+        self.db.memory()
+    }
+
+    fn for_each(&self, f: &mut FnMut(&T) -> Result<(), String>) -> Result<(), String> {
+        self.db.for_each(f)
+    }
+
+    fn inserted_at(&self, value: &T) -> Option<SystemTime> {
+        self.db.inserted_at(value)
+    }
+
+    fn inserted_before(&self, cutoff: SystemTime) -> Vec<T> {
+        self.db.inserted_before(cutoff)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+
+    use db::{Database, Factory, StorageBackend};
+    use db::weighted::Weighted;
+
+    #[test]
+    fn heavy_dimensions_count_more() {
+        let db: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        let mut db = Weighted::new(db, vec![2], 2);
+        let mut expected = HashSet::new();
+        expected.insert(0b110u64);
+
+        db.insert(0b001u64);
+        db.insert(0b110u64);
+
+        assert_eq!(Some(expected), db.get(&0b000u64));
+    }
+
+    #[test]
+    fn no_matches_within_weighted_tolerance() {
+        let db: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        let mut db = Weighted::new(db, vec![3], 2);
+
+        db.insert(0b001u64);
+
+        assert_eq!(None, db.get(&0b000u64));
+    }
+
+    #[test]
+    fn any_within_uses_weighted_distance() {
+        let db: Box<Database<u64>> = Factory::build(64, 2, StorageBackend::InMemory);
+        let mut db = Weighted::new(db, vec![3], 2);
+
+        db.insert(0b001u64);
+        assert!(!db.any_within(&0b000u64));
+
+        db.insert(0b110u64);
+        assert!(db.any_within(&0b000u64));
+    }
+
+    #[test]
+    fn ignored_dimensions() {
+        assert_eq!(Weighted::<u64>::ignored_dimensions(&[1, 0, 2, 0]), vec![1, 3]);
+    }
+}
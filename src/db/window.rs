@@ -1,12 +1,53 @@
 use std;
 use std::mem::size_of;
 
+use num::rational::Ratio;
+
 #[derive(Clone, Debug, PartialEq, Eq, Hash, RustcDecodable, RustcEncodable)]
 pub struct Window {
     pub start_dimension: usize,
     pub dimensions: usize,
 }
 
+/// The partitions of a database's keyspace for the given tolerance
+///
+/// Partitions the keyspace as evenly as possible - all partitions
+/// will have either N or N-1 dimensions
+///
+pub fn partitions(dimensions: usize, tolerance: usize) -> Vec<Window> {
+    // Determine number of partitions
+    let partition_count = if tolerance == 0 {
+        1
+    } else if tolerance > dimensions {
+        (dimensions + 3) / 2
+    } else {
+        (tolerance + 3) / 2
+    };
+
+    // Determine how many dimensions to allocate to each partition
+    let head_width = Ratio::new(dimensions, partition_count).ceil().to_integer() as usize;
+    let tail_width = Ratio::new(dimensions, partition_count).floor().to_integer() as usize;
+    let head_count = dimensions % partition_count;
+    let tail_count = partition_count - head_count;
+
+    // Build the partitions
+    let mut partitions: Vec<Window> = Vec::with_capacity(head_count + tail_count);
+    for i in 0..head_count {
+        let start_dimension = i * head_width;
+        let dimensions = head_width;
+
+        partitions.push(Window{start_dimension: start_dimension, dimensions: dimensions});
+    }
+    for i in 0..tail_count {
+        let start_dimension = (head_count * head_width) + (i * tail_width);
+        let dimensions = tail_width;
+
+        partitions.push(Window{start_dimension: start_dimension, dimensions: dimensions});
+    }
+
+    partitions
+}
+
 pub trait Windowable<T> {
     /// Subsample on a set of dimensions
     ///
@@ -0,0 +1,126 @@
+//! Shared worker threads
+//!
+//! Batch inserts compute their values' variants in parallel (see
+//! `--insert-workers`).  Rather than starting threads for every batch, the
+//! work runs on one pool of long-lived threads shared by every database.
+//! Threads are started as they're first needed, up to the most workers
+//! anything has asked for, and run until the process exits.  The server
+//! starts them when it starts, so batches don't wait for them.
+//!
+//! A task which panics takes its thread with it; the next `ensure` replaces
+//! it.
+
+use std::sync::{Arc, Mutex, Once, ONCE_INIT};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::mpsc::{channel, Receiver, Sender};
+use std::thread;
+
+trait Task: Send {
+    fn run(self: Box<Self>);
+}
+
+impl<F: FnOnce() + Send> Task for F {
+    fn run(self: Box<F>) {
+        (*self)()
+    }
+}
+
+/// Counts a thread out of the pool when it exits, i.e. by a task panicking
+///
+struct Running(Arc<AtomicUsize>);
+
+impl Drop for Running {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+pub struct Workers {
+    queue: Mutex<Sender<Box<Task>>>,
+    tasks: Arc<Mutex<Receiver<Box<Task>>>>,
+    threads: Arc<AtomicUsize>,
+}
+
+impl Workers {
+    pub fn new() -> Workers {
+        let (tx, rx) = channel();
+        Workers{queue: Mutex::new(tx), tasks: Arc::new(Mutex::new(rx)), threads: Arc::new(AtomicUsize::new(0))}
+    }
+
+    /// Start threads until there are at least `count`
+    ///
+    pub fn ensure(&self, count: usize) {
+        // Held so concurrent callers don't both start the missing threads
+        let _queue = self.queue.lock().unwrap();
+
+        while self.threads.load(Ordering::SeqCst) < count {
+            let tasks = self.tasks.clone();
+            let running = Running(self.threads.clone());
+            self.threads.fetch_add(1, Ordering::SeqCst);
+
+            thread::spawn(move || {
+                let _running = running;
+                loop {
+                    let task = match tasks.lock().unwrap().recv() {
+                        Ok(task) => task,
+                        Err(_) => return,
+                    };
+                    task.run();
+                }
+            });
+        }
+    }
+
+    /// The number of threads running
+    ///
+    pub fn threads(&self) -> usize {
+        self.threads.load(Ordering::SeqCst)
+    }
+
+    /// Run `task` on the next free thread
+    ///
+    /// Tasks queue until a thread is free, so there must be at least one
+    /// (see `ensure`).
+    ///
+    pub fn spawn<F: FnOnce() + Send + 'static>(&self, task: F) {
+        let _ = self.queue.lock().unwrap().send(Box::new(task));
+    }
+}
+
+static SHARED_INIT: Once = ONCE_INIT;
+static mut SHARED: *const Workers = 0 as *const Workers;
+
+/// The pool shared by every database
+///
+pub fn shared() -> &'static Workers {
+    unsafe {
+        SHARED_INIT.call_once(|| SHARED = Box::into_raw(Box::new(Workers::new())));
+        &*SHARED
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::mpsc::channel;
+
+    use db::workers::Workers;
+
+    #[test]
+    fn tasks_run_on_started_threads() {
+        let workers = Workers::new();
+        workers.ensure(2);
+        workers.ensure(1);
+        assert_eq!(workers.threads(), 2);
+
+        let (tx, rx) = channel();
+        for i in 0..10 {
+            let tx = tx.clone();
+            workers.spawn(move || tx.send(i).unwrap());
+        }
+        drop(tx);
+
+        let mut done: Vec<usize> = rx.iter().collect();
+        done.sort();
+        assert_eq!(done, (0..10).collect::<Vec<usize>>());
+    }
+}
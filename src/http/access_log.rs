@@ -0,0 +1,241 @@
+//! HTTP access log
+//!
+//! With `--access-log=<path>`, every request is written to its own file,
+//! separate from the application log on stdout, in one of three formats
+//! (`--access-log-format`):
+//!
+//! * `common`: the Common Log Format, followed by the latency in milliseconds
+//!   and the number of values in the request body
+//! * `combined`: as `common`, with the referer and user agent after the
+//!   response size
+//! * `json`: one JSON object per line
+//!
+//! Once the file reaches `--access-log-max-bytes` it's renamed to `<path>.1`
+//! (shifting older files up to `<path>.<keep>`, the oldest being removed) and
+//! a new file is started.
+
+use std::collections::BTreeMap;
+use std::fs;
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::sync::{Arc, Mutex};
+use std::time::{Instant, SystemTime, UNIX_EPOCH};
+
+use iron::prelude::*;
+use iron::{typemap, AfterMiddleware, BeforeMiddleware};
+use iron::headers::ContentLength;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::request_id::RequestIdKey;
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Format {
+    Common,
+    Combined,
+    Json,
+}
+
+impl Format {
+    pub fn parse(s: &str) -> Result<Format, String> {
+        match s {
+            "common" => Ok(Format::Common),
+            "combined" => Ok(Format::Combined),
+            "json" => Ok(Format::Json),
+            _ => Err(format!("unknown access log format '{}' (expected common, combined or json)", s)),
+        }
+    }
+}
+
+/// Number of values in the request body, recorded by `decode_body`
+///
+pub struct ValueCountKey;
+impl typemap::Key for ValueCountKey { type Value = usize; }
+
+/// Size of the request body, recorded by `decode_body`
+///
+pub struct BodyBytesKey;
+impl typemap::Key for BodyBytesKey { type Value = usize; }
+
+struct StartKey;
+impl typemap::Key for StartKey { type Value = Instant; }
+
+struct LogFile {
+    file: File,
+    written: u64,
+}
+
+#[derive(Clone)]
+pub struct AccessLog {
+    path: String,
+    format: Format,
+    max_bytes: u64,
+    keep: usize,
+    file: Arc<Mutex<LogFile>>,
+}
+
+impl AccessLog {
+    /// A `max_bytes` of 0 disables rotation
+    ///
+    pub fn open(path: &str, format: Format, max_bytes: u64, keep: usize) -> Result<AccessLog, String> {
+        Ok(AccessLog{
+            path: path.to_string(),
+            format: format,
+            max_bytes: max_bytes,
+            keep: keep,
+            file: Arc::new(Mutex::new(try!(open_file(path)))),
+        })
+    }
+
+    fn write(&self, line: String) {
+        let mut file = self.file.lock().unwrap();
+
+        if self.max_bytes > 0 && file.written >= self.max_bytes {
+            match self.rotate() {
+                Ok(new_file) => *file = new_file,
+                Err(e) => log!("WARNING: unable to rotate access log: {}", e),
+            }
+        }
+
+        match writeln!(file.file, "{}", line) {
+            Ok(_) => file.written += line.len() as u64 + 1,
+            Err(e) => log!("WARNING: unable to write access log: {}", e),
+        }
+    }
+
+    /// Shifts the rotated files along and starts a new file; the caller holds
+    /// the file lock
+    ///
+    fn rotate(&self) -> Result<LogFile, String> {
+        if self.keep > 0 {
+            for n in (1..self.keep).rev() {
+                let from = format!("{}.{}", self.path, n);
+                if fs::metadata(&from).is_ok() {
+                    try!(fs::rename(&from, format!("{}.{}", self.path, n + 1)).map_err(|e| format!("{}: {}", from, e)));
+                }
+            }
+            try!(fs::rename(&self.path, format!("{}.1", self.path)).map_err(|e| format!("{}: {}", self.path, e)));
+        } else {
+            try!(fs::remove_file(&self.path).map_err(|e| format!("{}: {}", self.path, e)));
+        }
+
+        open_file(&self.path)
+    }
+
+    fn line(&self, req: &Request, res: &Response) -> String {
+        let latency_ms = match req.extensions.get::<StartKey>() {
+            Some(start) => {
+                let elapsed = start.elapsed();
+                elapsed.as_secs() as f64 * 1000.0 + elapsed.subsec_nanos() as f64 / 1e6
+            },
+            None => 0.0,
+        };
+        let values = req.extensions.get::<ValueCountKey>().map(|n| *n);
+        let bytes_in = req.extensions.get::<BodyBytesKey>().map(|n| *n);
+        let bytes_out = res.headers.get::<ContentLength>().map(|l| l.0);
+        let status = match res.status {
+            Some(status) => status.to_u16(),
+            None => 404,
+        };
+        let path = match req.url.query {
+            Some(ref query) => format!("/{}?{}", req.url.path.join("/"), query),
+            None => format!("/{}", req.url.path.join("/")),
+        };
+        let now = SystemTime::now().duration_since(UNIX_EPOCH).unwrap().as_secs();
+
+        match self.format {
+            Format::Json => {
+                let mut d = BTreeMap::new();
+                d.insert("time".to_string(), now.to_json());
+                d.insert("remote_addr".to_string(), req.remote_addr.ip().to_string().to_json());
+                d.insert("method".to_string(), req.method.to_string().to_json());
+                d.insert("path".to_string(), path.to_json());
+                d.insert("status".to_string(), status.to_json());
+                d.insert("latency_ms".to_string(), latency_ms.to_json());
+                d.insert("values".to_string(), values.to_json());
+                d.insert("bytes_in".to_string(), bytes_in.to_json());
+                d.insert("bytes_out".to_string(), bytes_out.to_json());
+                d.insert("request_id".to_string(), req.extensions.get::<RequestIdKey>().map(|id| id.clone()).to_json());
+                json::encode(&Json::Object(d)).unwrap()
+            },
+            format => {
+                let mut line = format!("{} - - [{}] \"{} {} HTTP/1.1\" {} {}",
+                                       req.remote_addr.ip(), clf_time(now), req.method, path, status,
+                                       bytes_out.map(|n| n.to_string()).unwrap_or("-".to_string()));
+                if format == Format::Combined {
+                    line.push_str(&format!(" \"{}\" \"{}\"", header(req, "Referer"), header(req, "User-Agent")));
+                }
+                line.push_str(&format!(" {:.3} {}", latency_ms, values.map(|n| n.to_string()).unwrap_or("-".to_string())));
+                line
+            },
+        }
+    }
+}
+
+impl BeforeMiddleware for AccessLog {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        req.extensions.insert::<StartKey>(Instant::now());
+        Ok(())
+    }
+}
+
+impl AfterMiddleware for AccessLog {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        self.write(self.line(req, &res));
+        Ok(res)
+    }
+
+    fn catch(&self, req: &mut Request, err: IronError) -> IronResult<Response> {
+        self.write(self.line(req, &err.response));
+        Err(err)
+    }
+}
+
+fn open_file(path: &str) -> Result<LogFile, String> {
+    let file = match OpenOptions::new().append(true).create(true).open(path) {
+        Ok(file) => file,
+        Err(e) => return Err(format!("unable to open access log '{}': {}", path, e)),
+    };
+    let written = match file.metadata() {
+        Ok(metadata) => metadata.len(),
+        Err(e) => return Err(format!("unable to stat access log '{}': {}", path, e)),
+    };
+    Ok(LogFile{file: file, written: written})
+}
+
+/// A request header, quoted for the combined format, or `-`
+///
+fn header(req: &Request, name: &str) -> String {
+    match req.headers.get_raw(name) {
+        Some(values) if values.len() == 1 => String::from_utf8_lossy(&values[0]).replace("\"", "\\\""),
+        _ => "-".to_string(),
+    }
+}
+
+/// Seconds since the epoch in the Common Log Format's time format (in UTC),
+/// i.e. `10/Oct/2000:13:55:36 +0000`
+///
+fn clf_time(secs: u64) -> String {
+    const MONTHS: [&'static str; 12] = ["Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"];
+
+    let (year, month, day) = civil_from_days((secs / 86400) as i64);
+    let time = secs % 86400;
+    format!("{:02}/{}/{}:{:02}:{:02}:{:02} +0000", day, MONTHS[month - 1], year, time / 3600, time % 3600 / 60, time % 60)
+}
+
+/// The (year, month, day) of a count of days since the epoch, from Howard
+/// Hinnant's `civil_from_days`
+///
+fn civil_from_days(days: i64) -> (i64, usize, i64) {
+    let z = days + 719468;
+    let era = (if z >= 0 { z } else { z - 146096 }) / 146097;
+    let doe = z - era * 146097;
+    let yoe = (doe - doe / 1460 + doe / 36524 - doe / 146096) / 365;
+    let doy = doe - (365 * yoe + yoe / 4 - yoe / 100);
+    let mp = (5 * doy + 2) / 153;
+    let day = doy - (153 * mp + 2) / 5 + 1;
+    let month = if mp < 10 { mp + 3 } else { mp - 9 };
+    let year = yoe + era * 400 + if month <= 2 { 1 } else { 0 };
+    (year, month as usize, day)
+}
+
@@ -0,0 +1,497 @@
+//! Bearer token authorization
+//!
+//! With `--auth-tokens=<path>`, every request must carry a token from that
+//! file as `Authorization: Bearer <token>`.  Each line of the file is a scope
+//! and a token, and blank lines and lines starting with `#` are ignored:
+//!
+//! ```text
+//! data  3f1c0a9e8b7d...
+//! admin 9d2e4b6a1c0f...
+//! ```
+//!
+//! A `data` token can add, query and delete values and read databases'
+//! options, buckets, keys, jobs and the change feed.  Operations which
+//! create, drop or copy whole databases (`POST /options`, `DELETE /db`,
+//! `/dump` and `/load`), starting and cancelling jobs (which can repair or
+//! bulk delete) and everything on the admin endpoints need an `admin` token,
+//! which can do everything a `data` token can too.  Requests without a known
+//! token get a 401, and data tokens used for admin operations a 403.
+//!
+//! Tokens can also be checked by an external command, with
+//! `--auth-command=<cmd>`, i.e. to validate JWTs issued by an SSO provider
+//! (signature, issuer, audience and expiry) and map their claims to a scope
+//! for each namespace.  The command is started once and sent one line of JSON
+//! per token and namespace it hasn't seen recently:
+//!
+//! ```json
+//! {"token":"eyJhbGciOi...","namespace":"foo"}
+//! ```
+//!
+//! (`namespace` is null for requests which aren't about one database) and
+//! must reply with a line holding `"data"`, `"admin"` or `null` if the token
+//! isn't valid there.  Joins read two databases, so the token must be valid
+//! in both namespaces, and has the lower of its scopes there.  Answers are
+//! cached for `AUTH_CACHE_S` seconds.  With both options, tokens in the file
+//! are checked first.
+//!
+//! Jobs name their database in the job rather than the path, so they're
+//! checked by their handlers: starting or cancelling a job needs an admin
+//! token for its namespace, and reading one a data token.  Listing jobs or
+//! databases and reading the change feed only show the namespaces the token
+//! is valid in; changes to databases whose namespace can't be told are left
+//! out.
+//!
+//! Requests the server makes itself (a standby polling its primary, or an
+//! upgrade copying from the old process) send the token in the
+//! `HAMMER_AUTH_TOKEN` environment variable, if it's set.
+
+use std::collections::{BTreeMap, HashMap};
+use std::env;
+use std::fs::File;
+use std::io;
+use std::io::{BufRead, BufReader, Read, Write};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use iron::prelude::*;
+use iron::{status, typemap, BeforeMiddleware};
+use iron::method::Method;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+/// Environment variable holding the token for requests the server makes
+pub const CLIENT_TOKEN_VAR: &'static str = "HAMMER_AUTH_TOKEN";
+
+/// How long an auth command's answers are reused
+pub const AUTH_CACHE_S: u64 = 60;
+
+/// Most answers cached before the cache is cleared
+const AUTH_CACHE_MAX: usize = 10000;
+
+#[derive(Clone, Copy, Debug, PartialEq, PartialOrd)]
+pub enum Scope {
+    Data,
+    Admin,
+}
+
+/// The scope of an authorized request's token, for later middleware
+pub struct ScopeKey;
+impl typemap::Key for ScopeKey { type Value = Scope; }
+
+impl Scope {
+    fn parse(s: &str) -> Result<Scope, String> {
+        match s {
+            "data" => Ok(Scope::Data),
+            "admin" => Ok(Scope::Admin),
+            _ => Err(format!("unknown scope '{}' (expected data or admin)", s)),
+        }
+    }
+}
+
+/// A request's token, for handlers which find the namespaces it needs to be
+/// valid in themselves (see `deferred`)
+///
+pub struct Credentials {
+    authorizer: Arc<Authorizer>,
+    token: String,
+}
+
+impl Credentials {
+    pub fn scope(&self, namespace: &str) -> Option<Scope> {
+        self.authorizer.scope(&self.token, Some(namespace))
+    }
+}
+
+pub struct CredentialsKey;
+impl typemap::Key for CredentialsKey { type Value = Credentials; }
+
+/// Whether the request's token has at least `required` scope in `namespace`
+///
+/// Requests only carry credentials if their route is deferred, so this is
+/// always true without `--auth-tokens` or `--auth-command`.
+///
+pub fn allowed(req: &Request, namespace: &str, required: Scope) -> bool {
+    match req.extensions.get::<CredentialsKey>() {
+        Some(credentials) => credentials.scope(namespace).map_or(false, |scope| scope >= required),
+        None => true,
+    }
+}
+
+/// The namespace of a database name, i.e. `foo` for `b/64/8/foo`
+///
+pub fn db_namespace(db: &str) -> Option<&str> {
+    match db.rfind('/') {
+        Some(i) if i + 1 < db.len() => Some(&db[i + 1..]),
+        _ => None,
+    }
+}
+
+/// Decides what a token may do
+///
+pub trait Authorizer: Sync + Send {
+    /// The scope of `token` for requests on `namespace` (None for requests
+    /// which aren't about one database), or None if it isn't valid there
+    ///
+    fn scope(&self, token: &str, namespace: Option<&str>) -> Option<Scope>;
+}
+
+pub struct Tokens {
+    tokens: Vec<(Scope, String)>,
+}
+
+impl Tokens {
+    pub fn load(path: &str) -> Result<Tokens, String> {
+        let mut contents = String::new();
+        match File::open(path).and_then(|mut f| f.read_to_string(&mut contents)) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to read token file '{}': {}", path, e)),
+        }
+
+        let mut tokens = vec![];
+        for (i, line) in contents.lines().enumerate() {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                continue
+            }
+
+            let fields: Vec<&str> = line.split_whitespace().collect();
+            if fields.len() != 2 {
+                return Err(format!("{}:{}: expected a scope and a token", path, i + 1))
+            }
+            let scope = try!(Scope::parse(fields[0]).map_err(|e| format!("{}:{}: {}", path, i + 1, e)));
+            tokens.push((scope, fields[1].to_string()));
+        }
+
+        if tokens.is_empty() {
+            return Err(format!("token file '{}' has no tokens", path))
+        }
+        Ok(Tokens{tokens: tokens})
+    }
+
+}
+
+impl Authorizer for Tokens {
+    /// The scope of `token`, if it's known; static tokens apply to every
+    /// namespace
+    ///
+    fn scope(&self, token: &str, _: Option<&str>) -> Option<Scope> {
+        // Every token is compared, so the time taken doesn't reveal which
+        // matched
+        self.tokens.iter().fold(None, |found, &(scope, ref known)| {
+            match constant_time_eq(token.as_bytes(), known.as_bytes()) {
+                true => Some(scope),
+                false => found,
+            }
+        })
+    }
+}
+
+/// Asks an external process for tokens' scopes, see the module docs
+///
+pub struct AuthCommand {
+    // Keep the child around so it isn't dropped while we're talking to it
+    _child: Child,
+    pipes: Mutex<(ChildStdin, BufReader<ChildStdout>)>,
+    cache: Mutex<HashMap<(String, Option<String>), (Option<Scope>, Instant)>>,
+}
+
+impl AuthCommand {
+    /// Start `command` using the shell
+    ///
+    pub fn spawn(command: &str) -> Result<AuthCommand, String> {
+        let mut child = match Command::new("sh").arg("-c").arg(command).stdin(Stdio::piped()).stdout(Stdio::piped()).spawn() {
+            Ok(v) => v,
+            Err(e) => return Err(format!("unable to start auth command '{}': {}", command, e)),
+        };
+
+        let stdin = child.stdin.take().unwrap();
+        let stdout = BufReader::new(child.stdout.take().unwrap());
+
+        Ok(AuthCommand{_child: child, pipes: Mutex::new((stdin, stdout)), cache: Mutex::new(HashMap::new())})
+    }
+
+    fn ask(&self, token: &str, namespace: Option<&str>) -> Result<Option<Scope>, String> {
+        let mut request = BTreeMap::new();
+        request.insert("token".to_string(), token.to_json());
+        request.insert("namespace".to_string(), namespace.map(|ns| ns.to_string()).to_json());
+        let request_line = json::encode(&Json::Object(request)).unwrap();
+
+        let mut pipes = self.pipes.lock().unwrap();
+        let (ref mut stdin, ref mut stdout) = *pipes;
+
+        match writeln!(stdin, "{}", request_line).and_then(|_| stdin.flush()) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to write to auth command: {}", e)),
+        }
+
+        let mut response_line = String::new();
+        match stdout.read_line(&mut response_line) {
+            Ok(0) => return Err("auth command exited".to_string()),
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to read from auth command: {}", e)),
+        }
+
+        match Json::from_str(&response_line) {
+            Ok(Json::Null) => Ok(None),
+            Ok(Json::String(ref s)) => Scope::parse(s).map(Some),
+            _ => Err(format!("unexpected auth command response '{}'", response_line.trim())),
+        }
+    }
+}
+
+impl Authorizer for AuthCommand {
+    /// Failures of the command deny the request (and aren't cached)
+    ///
+    fn scope(&self, token: &str, namespace: Option<&str>) -> Option<Scope> {
+        let key = (token.to_string(), namespace.map(|ns| ns.to_string()));
+        match self.cache.lock().unwrap().get(&key) {
+            Some(&(scope, at)) if at.elapsed() < Duration::from_secs(AUTH_CACHE_S) => return scope,
+            _ => {},
+        }
+
+        let scope = match self.ask(token, namespace) {
+            Ok(scope) => scope,
+            Err(e) => {
+                log!("WARNING: {}", e);
+                return None
+            },
+        };
+
+        let mut cache = self.cache.lock().unwrap();
+        if cache.len() >= AUTH_CACHE_MAX {
+            cache.clear();
+        }
+        cache.insert(key, (scope, Instant::now()));
+        scope
+    }
+}
+
+/// Tries each authorizer in turn, using the first which accepts the token
+///
+pub struct FirstOf(pub Vec<Box<Authorizer>>);
+
+impl Authorizer for FirstOf {
+    fn scope(&self, token: &str, namespace: Option<&str>) -> Option<Scope> {
+        self.0.iter().filter_map(|authorizer| authorizer.scope(token, namespace)).next()
+    }
+}
+
+/// Rejects requests without a token of the scope they need
+///
+pub struct Authorize {
+    authorizer: Arc<Authorizer>,
+    /// Whether the chain serves only admin endpoints (`--admin-bind`)
+    admin_only: bool,
+}
+
+impl Authorize {
+    pub fn new(authorizer: Arc<Authorizer>, admin_only: bool) -> Authorize {
+        Authorize{authorizer: authorizer, admin_only: admin_only}
+    }
+
+    /// The namespaces of requests on a database (`/<op>/<type>/.../:namespace`),
+    /// of dumps and loads, and of joins, which read both of their databases
+    /// (`/join/b/:bits/:tolerance/:namespace/:other`)
+    ///
+    fn namespaces(path: &[String]) -> Vec<String> {
+        match (path.first().map(|s| &s[..]), path.get(1).map(|s| &s[..])) {
+            (Some("dump"), Some(ns)) | (Some("load"), Some(ns)) if path.len() == 2 => vec![ns.to_string()],
+            (Some("join"), Some("b")) if path.len() == 6 => vec![path[4].clone(), path[5].clone()],
+            (_, Some("b")) | (_, Some("bN")) | (_, Some("f")) | (_, Some("v")) | (_, Some("d")) if path.len() >= 5 => path.last().cloned().into_iter().collect(),
+            _ => vec![],
+        }
+    }
+
+    /// The scope of `token` across all of `namespaces`: its lowest scope in
+    /// any of them, or None if it isn't valid in one
+    ///
+    fn scope(authorizer: &Authorizer, token: &str, namespaces: &[String]) -> Option<Scope> {
+        if namespaces.is_empty() {
+            return authorizer.scope(token, None)
+        }
+
+        let mut lowest = Scope::Admin;
+        for ns in namespaces.iter() {
+            match authorizer.scope(token, Some(ns)) {
+                Some(scope) if scope < lowest => lowest = scope,
+                Some(_) => {},
+                None => return None,
+            }
+        }
+        Some(lowest)
+    }
+
+    /// Whether the request's namespaces are checked by its handler rather
+    /// than here: jobs, whose namespace is in the job, and listings which
+    /// span every namespace
+    ///
+    fn deferred(&self, path: &[String]) -> bool {
+        if self.admin_only {
+            return false
+        }
+        match path.first().map(|s| &s[..]) {
+            Some("jobs") | Some("changes") => true,
+            Some("db") => path.len() == 1,
+            _ => false,
+        }
+    }
+
+    fn required_scope(&self, req: &Request) -> Scope {
+        if self.admin_only {
+            return Scope::Admin
+        }
+
+        let path = &req.url.path;
+        match (&req.method, path.first().map(|s| &s[..])) {
+            (&Method::Post, Some("options")) => Scope::Admin,
+            (&Method::Delete, Some("db")) => Scope::Admin,
+            (_, Some("dump")) | (_, Some("load")) => Scope::Admin,
+            (_, Some("admin")) | (_, Some("metrics")) | (_, Some("debug")) | (_, Some("chaos")) => Scope::Admin,
+            _ => Scope::Data,
+        }
+    }
+}
+
+impl BeforeMiddleware for Authorize {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        // CORS preflight requests don't carry credentials
+        if req.method == Method::Options {
+            return Ok(())
+        }
+
+        let token = match req.headers.get_raw("Authorization") {
+            Some(values) if values.len() == 1 => {
+                let value = String::from_utf8_lossy(&values[0]).into_owned();
+                match value.starts_with("Bearer ") {
+                    true => Some(value[7..].trim().to_string()),
+                    false => None,
+                }
+            },
+            _ => None,
+        };
+
+        if self.deferred(&req.url.path) {
+            let token = match token {
+                Some(token) => token,
+                None => return Err(unauthorized()),
+            };
+            // Only the scope the token has outside any namespace may fence
+            let scope = self.authorizer.scope(&token, None).unwrap_or(Scope::Data);
+            req.extensions.insert::<ScopeKey>(scope);
+            req.extensions.insert::<CredentialsKey>(Credentials{authorizer: self.authorizer.clone(), token: token});
+            return Ok(())
+        }
+
+        let namespaces = Authorize::namespaces(&req.url.path);
+        let scope = match token {
+            Some(ref token) => Authorize::scope(&*self.authorizer, token, &namespaces),
+            None => None,
+        };
+        let required = self.required_scope(req);
+
+        match scope {
+            Some(scope) if scope >= required => {
+                req.extensions.insert::<ScopeKey>(scope);
+                Ok(())
+            },
+            Some(_) => {
+                let err = io::Error::new(io::ErrorKind::Other, "forbidden");
+                Err(IronError::new(err, (status::Forbidden, "this operation needs an admin token")))
+            },
+            None => Err(unauthorized()),
+        }
+    }
+}
+
+fn unauthorized() -> IronError {
+    let err = io::Error::new(io::ErrorKind::Other, "unauthorized");
+    let mut res = Response::with((status::Unauthorized, "a valid token is required (Authorization: Bearer <token>)"));
+    res.headers.set_raw("WWW-Authenticate", vec![b"Bearer".to_vec()]);
+    IronError{error: Box::new(err), response: res}
+}
+
+/// The token to send with requests the server makes, if any
+///
+pub fn client_token() -> Option<String> {
+    match env::var(CLIENT_TOKEN_VAR) {
+        Ok(token) => Some(token),
+        Err(_) => None,
+    }
+}
+
+fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    if a.len() != b.len() {
+        return false
+    }
+    a.iter().zip(b.iter()).fold(0, |diff, (x, y)| diff | (x ^ y)) == 0
+}
+
+#[cfg(test)]
+mod test {
+    use std::sync::Arc;
+
+    use http::auth::{Authorize, Authorizer, Credentials, Scope, db_namespace};
+
+    /// Accepts "t" as a data token for namespace "a" only
+    ///
+    struct OneNamespace;
+
+    impl Authorizer for OneNamespace {
+        fn scope(&self, token: &str, namespace: Option<&str>) -> Option<Scope> {
+            match (token, namespace) {
+                ("t", Some("a")) => Some(Scope::Data),
+                _ => None,
+            }
+        }
+    }
+
+    fn path(p: &str) -> Vec<String> {
+        p.split('/').map(|s| s.to_string()).collect()
+    }
+
+    #[test]
+    fn joins_need_both_namespaces() {
+        assert_eq!(Authorize::namespaces(&path("join/b/64/8/a/b")), vec!["a".to_string(), "b".to_string()]);
+
+        let scope = |p: &str| Authorize::scope(&OneNamespace, "t", &Authorize::namespaces(&path(p)));
+        assert_eq!(scope("query/b/64/8/a"), Some(Scope::Data));
+        assert_eq!(scope("join/b/64/8/a/a"), Some(Scope::Data));
+        assert_eq!(scope("join/b/64/8/b/a"), None);
+        assert_eq!(scope("join/b/64/8/a/b"), None);
+    }
+
+    #[test]
+    fn routes_without_a_namespace_are_deferred() {
+        let authorize = Authorize::new(Arc::new(OneNamespace), false);
+        for p in vec!["jobs", "jobs/abc", "changes", "db"] {
+            assert!(authorize.deferred(&path(p)), "{}", p);
+            assert!(Authorize::namespaces(&path(p)).is_empty(), "{}", p);
+        }
+        for p in vec!["db/b/64/8/a", "query/b/64/8/a", "dump/a", "admin/handoff/db"] {
+            assert!(!authorize.deferred(&path(p)), "{}", p);
+        }
+
+        let admin_only = Authorize::new(Arc::new(OneNamespace), true);
+        assert!(!admin_only.deferred(&path("jobs")));
+        assert!(!admin_only.deferred(&path("db")));
+    }
+
+    #[test]
+    fn credentials_are_checked_per_namespace() {
+        let credentials = Credentials{authorizer: Arc::new(OneNamespace), token: "t".to_string()};
+        assert_eq!(credentials.scope("a"), Some(Scope::Data));
+        assert_eq!(credentials.scope("b"), None);
+
+        let unknown = Credentials{authorizer: Arc::new(OneNamespace), token: "u".to_string()};
+        assert_eq!(unknown.scope("a"), None);
+    }
+
+    #[test]
+    fn db_names_have_namespaces() {
+        assert_eq!(db_namespace("b/64/8/foo"), Some("foo"));
+        assert_eq!(db_namespace("v/64/3/8/foo"), Some("foo"));
+        assert_eq!(db_namespace("b/64/8/"), None);
+        assert_eq!(db_namespace("foo"), None);
+    }
+}
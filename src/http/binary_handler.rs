@@ -2,34 +2,269 @@ use std::clone::Clone;
 use std::hash::Hash;
 use std::cmp::Eq;
 use std::io::Read;
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::sync::{Arc, RwLock};
+use std::sync::atomic::Ordering;
+use std::time::Duration;
 
 use bincode;
 use iron::prelude::*;
 use iron::status;
 use router::Router;
+use persistent;
 use persistent::State;
 use rustc_serialize::json;
 use rustc_serialize::base64::{FromBase64, ToBase64};
 use rustc_serialize::{Encodable, Decodable};
-use rustc_serialize::json::ToJson;
+use rustc_serialize::json::{ToJson, Json};
 
 use hammer::db::{Database, Factory, StorageBackend};
+use hammer::db::error::StoreError;
 use hammer::db::id_map::IDMap;
 use hammer::db::map_set::MapSet;
 use hammer::db::typemap::*;
+use hammer::db::hamming::Hamming;
+use hammer::db::normalize::{BitMask, Rotate};
+use hammer::db::sharded::Sharded;
+use hammer::db::left_right::LeftRight;
+use hammer::db::dedup::Dedup;
+use hammer::db::timed::Timed;
+use hammer::db::explain::MatchKind;
+use hammer::hyperplane::FromBits;
 
-use http::{Config, ConfigKey, B32, B64, B128, B256, decode_body, BASE64_CONFIG, AddResult, QueryResult, DeleteResult};
+use http::rerank;
+use http::rerank::{Reranker, RerankerKey};
+use http::ingest_hook::IngestHookKey;
+use http::sink::{Mirror, MirrorKey, Mutation};
+use http::changes::{ChangeFeed, ChangeFeedKey};
+use http::metrics::{Metrics, MetricsKey};
+use http::upgrade::{Handoff, HandoffKey};
+use http::conditional;
+#[cfg(feature = "chaos")]
+use http::chaos;
+use http::{Config, ConfigKey, BOptions, DBOptions, B32, B64, B128, B256, decode_body, query_param, bit_order, BitOrder, value_encoding, ValueEncoding, MAX_SAFE_INTEGER, response_budget, encoded_size, ResponseBudget, inserted_between, InsertedBetween, BASE64_CONFIG, AddResult, QueryResult, DeleteResult};
+
+/// Fail some of `values`, when built with fault injection (see `http::chaos`)
+///
+#[cfg(feature = "chaos")]
+fn inject_faults<T>(req: &mut Request, values: Vec<Result<T, String>>) -> Vec<Result<T, String>> {
+    chaos::fail_values(req, values)
+}
+
+#[cfg(not(feature = "chaos"))]
+fn inject_faults<T>(_: &mut Request, values: Vec<Result<T, String>>) -> Vec<Result<T, String>> {
+    values
+}
+
+/// Decode request values
+///
+/// Strings are base64-encoded values or, if `encoding` is `Binary`, strings of
+/// '0' and '1' or, if `Decimal`, decimal integers.  Arrays of 0 and 1 are
+/// accepted in any encoding, written in `order`.
+///
+/// Integers are accepted for DBs of up to 64 bits, as long as they're below
+/// 2^53: larger integers may have been rounded by a client which stores
+/// numbers as doubles, so they must be sent as decimal strings instead.
+///
+pub fn decode_values<T: Decodable + FromBits>(values: Vec<Json>, encoding: ValueEncoding, order: BitOrder) -> Vec<Result<T, String>> {
+    values.into_iter().map(|value| {
+        match value {
+            Json::String(ref s) if encoding == ValueEncoding::Binary => {
+                let bits = s.chars().map(|c| match c {
+                    '0' => Ok(false),
+                    '1' => Ok(true),
+                    c => Err(format!("unexpected '{}' in binary value '{}'", c, s)),
+                }).collect::<Result<Vec<bool>, String>>();
+
+                decode_bits(try!(bits), order, s)
+            },
+            Json::String(ref s) if encoding == ValueEncoding::Decimal => match s.parse::<u64>() {
+                Ok(n) => decode_integer(n, s),
+                Err(e) => Err(format!("unable to parse decimal value '{}': {}", s, e)),
+            },
+            Json::String(ref s) => decode_base64(s),
+            Json::Array(ref a) => {
+                let bits = a.iter().map(|b| match b.as_u64() {
+                    Some(0) => Ok(false),
+                    Some(1) => Ok(true),
+                    _ => Err(format!("unexpected {} in bit array {}", b, value)),
+                }).collect::<Result<Vec<bool>, String>>();
+
+                decode_bits(try!(bits), order, &value.to_string())
+            },
+            Json::U64(n) if n > MAX_SAFE_INTEGER => Err(format!("{} is above 2^53 and may have been rounded, send it as a string with ?encoding=decimal", n)),
+            Json::U64(n) => decode_integer(n, &value.to_string()),
+            Json::I64(n) if n >= 0 && n as u64 <= MAX_SAFE_INTEGER => decode_integer(n as u64, &value.to_string()),
+            _ => Err(format!("expected a string, bit array or integer below 2^53, not {}", value)),
+        }
+    }).collect()
+}
+
+/// Checks that no value is wider than `bits`, or with `truncate` drops the
+/// excess high bits
+///
+/// Base64 values are checked by their decoded length; values which can't be
+/// decoded (or are too narrow) are left for `decode_values` to report.
+///
+fn check_widths(values: &mut Vec<Json>, bits: usize, encoding: ValueEncoding, order: BitOrder, truncate: bool) -> Result<(), String> {
+    let binary = encoding == ValueEncoding::Binary;
+
+    for value in values.iter_mut() {
+        let width = match *value {
+            // Integers are checked as they're decoded
+            Json::String(_) if encoding == ValueEncoding::Decimal => continue,
+            Json::String(ref s) if binary => s.chars().count(),
+            Json::String(ref s) => match s.from_base64() {
+                Ok(bytes) => 8 * bytes.len(),
+                Err(_) => continue,
+            },
+            Json::Array(ref a) => a.len(),
+            _ => continue,
+        };
+
+        if width <= bits {
+            continue
+        }
+        if !truncate {
+            return Err(format!("{} is {} bits wide, the DB is {} bits (use ?truncate=true to drop the high bits)", value, width, bits))
+        }
+
+        // Base64 values are big-endian, so the high bits always come first
+        let skip = match (binary, value.is_array(), order) {
+            (false, false, _) | (_, _, BitOrder::MsbFirst) => width - bits,
+            (_, _, BitOrder::LsbFirst) => 0,
+        };
+
+        let truncated = match *value {
+            Json::String(ref s) if binary => Json::String(s.chars().skip(skip).take(bits).collect()),
+            Json::String(ref s) => {
+                let bytes = s.from_base64().unwrap();
+                Json::String(bytes[skip / 8..skip / 8 + bits / 8].to_base64(BASE64_CONFIG))
+            },
+            Json::Array(ref a) => Json::Array(a.iter().skip(skip).take(bits).cloned().collect()),
+            _ => unreachable!(),
+        };
+        *value = truncated;
+    }
+
+    Ok(())
+}
+
+fn decode_base64<T: Decodable>(value_b64: &String) -> Result<T, String> {
+    let value_bytes = match value_b64.from_base64() {
+        Ok(v) => v,
+        Err(e) => return Err(format!("unable to base64-decode '{}': {:?}", value_b64, e)),
+    };
+
+    match bincode::rustc_serialize::decode(&value_bytes) {
+        Ok(v) => Ok(v),
+        Err(e) => Err(format!("unable to decode '{}': {:?}", value_b64, e)),
+    }
+}
+
+/// Builds a value from the bits of `n`
+///
+fn decode_integer<T: FromBits>(n: u64, source: &str) -> Result<T, String> {
+    if T::bits() > 64 {
+        return Err(format!("integer values are only supported for DBs of up to 64 bits, not {}", T::bits()))
+    }
+    if T::bits() < 64 && n >> T::bits() != 0 {
+        return Err(format!("{} is wider than {} bits", source, T::bits()))
+    }
+
+    let bits: Vec<bool> = (0..T::bits()).map(|i| (n >> i) & 1 == 1).collect();
+    Ok(T::from_bits(&bits))
+}
+
+/// Base64-encoded value (of up to 64 bits) as a decimal string
+///
+fn decimal_from_base64(value_b64: &str) -> String {
+    // Values are big-endian, see `encode_value`
+    let bytes = value_b64.from_base64().unwrap();
+    bytes.iter().fold(0u64, |n, &b| (n << 8) | b as u64).to_string()
+}
+
+/// Builds a value from bits written in `order`
+///
+fn decode_bits<T: FromBits>(mut bits: Vec<bool>, order: BitOrder, source: &str) -> Result<T, String> {
+    if bits.len() != T::bits() {
+        return Err(format!("expected {} bits, not {} in '{}'", T::bits(), bits.len(), source))
+    }
+
+    // `from_bits` takes dimension 0 (the least significant bit) first
+    if order == BitOrder::MsbFirst {
+        bits.reverse();
+    }
+    Ok(T::from_bits(&bits))
+}
+
+/// Storage used for the DB `b/:bits/:tolerance/:namespace`
+///
+pub fn storage_backend(config: &Config, bits: usize, tolerance: usize, namespace: &String) -> StorageBackend {
+    match config.data_dir {
+        Some(ref dir) => {
+            let mut value_store_path = dir.clone();
+            value_store_path.push(format!("b{:03}_{:03}_{:}", bits, tolerance, namespace));
+
+            StorageBackend::RocksDB(value_store_path)
+        },
+        None => StorageBackend::InMemory
+    }
+}
+
+/// Build the DB `b/:bits/:tolerance/:namespace`, split into `config.shards`
+/// shards, and copied with `config.lock_free_reads`
+///
+fn build_db<T: 'static + Sync + Send + Clone + Eq + Hash + Factory>(config: &Config, bits: usize, tolerance: usize, namespace: &String) -> Box<Database<T>> {
+    if config.lock_free_reads {
+        return Box::new(LeftRight::new(build_store(config, bits, tolerance, namespace), build_store(config, bits, tolerance, namespace)))
+    }
+    build_store(config, bits, tolerance, namespace)
+}
+
+fn build_store<T: 'static + Sync + Send + Clone + Eq + Hash + Factory>(config: &Config, bits: usize, tolerance: usize, namespace: &String) -> Box<Database<T>> {
+    if config.shards <= 1 {
+        return T::build(bits, tolerance, storage_backend(config, bits, tolerance, namespace))
+    }
+
+    let shards = (0..config.shards).map(|i| {
+        let backend = match storage_backend(config, bits, tolerance, namespace) {
+            StorageBackend::RocksDB(mut path) => {
+                path.push(format!("shard_{:03}", i));
+                StorageBackend::RocksDB(path)
+            },
+            backend => backend,
+        };
+
+        T::build(bits, tolerance, backend)
+    }).collect();
+
+    Box::new(Sharded::new(shards))
+}
+
+pub fn encode_value<T: Encodable>(value: &T) -> String {
+    let value_bytes = bincode::rustc_serialize::encode(value, bincode::SizeLimit::Infinite).unwrap();
+
+    value_bytes.to_base64(BASE64_CONFIG)
+}
 
 pub fn add(req: &mut Request) -> IronResult<Response> {
-    let req_body = try!(decode_body::<Vec<String>>(req));
+    let req_body = try!(decode_body::<Vec<Json>>(req));
+    let order = match bit_order(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
 
     let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
         Some(v) => v.parse::<usize>().unwrap(),
         None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
     };
 
+    let encoding = match value_encoding(req, bits) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
     let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
         Some(v) => v.parse::<usize>().unwrap(),
         None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
@@ -40,33 +275,92 @@ pub fn add(req: &mut Request) -> IronResult<Response> {
         None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
     };
 
+    // The hook sees values as they were sent, and what it returns is checked
+    // like any other request's values
+    let ingest_hook = req.get::<persistent::Read<IngestHookKey>>().unwrap();
+    let mut req_body = match *ingest_hook {
+        Some(ref hook) => {
+            let db_name = format!("b/{}/{}/{}", bits, tolerance, namespace);
+            match hook.transform(&db_name, req_body) {
+                Ok(v) => v,
+                Err(e) => return Ok(Response::with((status::InternalServerError, e))),
+            }
+        },
+        None => req_body,
+    };
+
+    let truncate = query_param(req, "truncate") == Some("true".to_string());
+    match check_widths(&mut req_body, bits, encoding, order, truncate) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    }
+
     let config_mx = req.get::<State<ConfigKey>>().unwrap();
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let changes = req.get::<persistent::Read<ChangeFeedKey>>().unwrap();
+    let metrics = req.get::<persistent::Read<MetricsKey>>().unwrap();
+    let mirror = req.get::<persistent::Read<MirrorKey>>().unwrap();
+    let handoff = req.get::<persistent::Read<HandoffKey>>().unwrap();
 
     match bits {
         32 => {
             let dbmap_mx = req.get::<State<B32>>().unwrap();
-            do_add(req_body, bits, tolerance, namespace, config_mx, dbmap_mx)
+            do_add(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
         },
         64 => {
             let dbmap_mx = req.get::<State<B64>>().unwrap();
-            do_add(req_body, bits, tolerance, namespace, config_mx, dbmap_mx)
+            do_add(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
         },
         128 => {
             let dbmap_mx = req.get::<State<B128>>().unwrap();
-            do_add(req_body, bits, tolerance, namespace, config_mx, dbmap_mx)
+            do_add(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
         },
         256 => {
             let dbmap_mx = req.get::<State<B256>>().unwrap();
-            do_add(req_body, bits, tolerance, namespace, config_mx, dbmap_mx)
+            do_add(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
         },
         _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
     }
 }
 
-fn do_add<T>(req_body: Vec<String>, bits: usize, tolerance: usize, namespace: String, config_mx: Arc<RwLock<Config>>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
-T: Clone + Factory + Decodable,
+pub fn do_add<T>(values: Vec<Result<T, String>>, bits: usize, tolerance: usize, namespace: String, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, mirror: Arc<Option<Mirror>>, handoff: Arc<Handoff>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Factory + Encodable + Decodable + Hamming + BitMask + Rotate,
 {
-    let mut results = Vec::with_capacity(req_body.len());
+    let (values, positions) = collapse(values);
+    match add_values(values, bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx) {
+        Ok(results) => {
+            // Repeats of an added value already exist, as if added in turn
+            let results = fan_out(results, &positions, |result| match *result {
+                AddResult::Ok => AddResult::Exists,
+                ref result => result.clone(),
+            });
+            let response_body = json::encode(&results.to_json()).unwrap();
+            Ok(Response::with((status::Ok, response_body)))
+        },
+        Err(e) => Ok(Response::with((status::BadRequest, e))),
+    }
+}
+
+/// Adds values to the DB, creating it if necessary.  Returns an error if the
+/// DB's options can't be applied
+///
+pub fn add_values<T>(values: Vec<Result<T, String>>, bits: usize, tolerance: usize, namespace: String, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, mirror: Arc<Option<Mirror>>, handoff: Arc<Handoff>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> Result<Vec<AddResult>, String> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Factory + Encodable + Decodable + Hamming + BitMask + Rotate,
+{
+    let mut results = Vec::with_capacity(values.len());
+    let insert_workers = {
+        config_mx.read().unwrap().insert_workers
+    };
+
+    // Held until the writes are recorded, so an upgrade can't start journaling
+    // (or take the final journal) between encoding them and recording them
+    let admitted = match handoff.admit() {
+        Ok(admitted) => admitted,
+        Err(e) => return Ok(values.iter().map(|_| AddResult::Err(e.clone())).collect()),
+    };
+
+    // Values are consumed by the insert, so encode them for mirroring first
+    let encoded = encode_for_mirror(&values, &*mirror, &handoff, &changes);
 
     // this is a little contorted, but the idea is to optimize for the
     // frequent case where the DB being inserted into exists and only
@@ -78,20 +372,52 @@ T: Clone + Factory + Decodable,
                 config_mx.read().unwrap().clone()
             };
 
-            let backend = match config.data_dir {
-                Some(ref dir) => {
-                    let mut value_store_path = dir.clone();
-                    value_store_path.push(format!("b{:03}_{:03}_{:}", bits, tolerance, namespace));
+            let mut dbmap = dbmap_mx.write().unwrap();
 
-                    StorageBackend::RocksDB(value_store_path)
-                },
-                None => StorageBackend::InMemory
-            };
+            // Another request may have created the DB since we checked
+            if !dbmap.contains_key(&(tolerance, namespace.clone())) {
+                let options = match options_mx.read().unwrap().get(&(bits, tolerance, namespace.clone())) {
+                    Some(options) => options.clone(),
+                    None => DBOptions::default(),
+                };
 
-            let db = Factory::build(bits, tolerance, backend);
+                let db_name = format!("b/{}/{}/{}", bits, tolerance, namespace);
+                let feed = changes.clone();
+                let on_evict = Box::new(move |v: &T| feed.publish(db_name.clone(), "evict", encode_value(v)));
 
-            let mut dbmap = dbmap_mx.write().unwrap();
-            dbmap.insert((tolerance.clone(), namespace.clone()), Arc::new(RwLock::new(db)));
+                let db = build_db(&config, bits, tolerance, &namespace);
+                let db: Box<Database<T>> = match (config.debug_vars, config.slow_op_ms) {
+                    (false, 0) => db,
+                    (debug_vars, slow_op_ms) => {
+                        let metrics = metrics.clone();
+                        let db_name = format!("b/{}/{}/{}", bits, tolerance, namespace);
+                        let on_op = Box::new(move |op: &'static str, elapsed: Duration| {
+                            if debug_vars {
+                                metrics.debug_vars.record_op(op, elapsed);
+                            }
+                            // Ops run on the request's thread, so the log line
+                            // carries its ID
+                            let elapsed_ms = elapsed.as_secs() * 1000 + (elapsed.subsec_nanos() / 1_000_000) as u64;
+                            if slow_op_ms > 0 && elapsed_ms >= slow_op_ms {
+                                log!("WARNING: slow {} on {}: {}ms", op, db_name, elapsed_ms);
+                            }
+                        });
+                        Box::new(Timed::new(db, on_op))
+                    },
+                };
+                let db: Box<Database<T>> = match config.dedup_window_s {
+                    0 => db,
+                    window_s => {
+                        let metrics = metrics.clone();
+                        let on_duplicate = Box::new(move |_: &T| { metrics.duplicate_writes.fetch_add(1, Ordering::Relaxed); });
+                        Box::new(Dedup::new(db, Duration::from_secs(window_s), on_duplicate))
+                    },
+                };
+
+                let db = try!(options.apply(db, bits, tolerance, on_evict));
+
+                dbmap.insert((tolerance.clone(), namespace.clone()), Arc::new(RwLock::new(db)));
+            }
         }
 
         let dbmap = dbmap_mx.read().unwrap();
@@ -101,48 +427,151 @@ T: Clone + Factory + Decodable,
             continue
         }
 
-        let db_mx = dbmap.get(&(tolerance, namespace)).unwrap();
-        let mut db = db_mx.write().unwrap();
+        let db_mx = dbmap.get(&(tolerance, namespace.clone())).unwrap();
 
-        'value: for value_b64 in req_body.into_iter() {
-            let value_bytes = match value_b64.from_base64() {
-                Ok(v) => v,
-                Err(e) => {
-                    results.push(AddResult::Err(format!("unable to base64-decode '{}': {:?}", value_b64, e)));
-                    continue 'value;
-                }
-            };
+        // Sharded DBs lock each shard as it's written, so writers only need
+        // to share the DB's lock
+        let concurrent = db_mx.read().unwrap().concurrent_writes();
+        let (heavy_before, heavy_after) = if concurrent {
+            let db = db_mx.read().unwrap();
+            let heavy_before = db.heavy_bucket_count();
+            insert_values(values, &mut results, |v| db.try_insert_concurrent(v));
+            (heavy_before, db.heavy_bucket_count())
+        } else {
+            let mut db = db_mx.write().unwrap();
+            let heavy_before = db.heavy_bucket_count();
+            insert_batch(values, &mut results, &mut **db, insert_workers);
+            (heavy_before, db.heavy_bucket_count())
+        };
 
-            let value: T = match bincode::rustc_serialize::decode(&value_bytes) {
-                Ok(v) => v,
-                Err(e) => {
-                    results.push(AddResult::Err(format!("unable to decode '{}': {:?}", value_b64, e)));
-                    continue 'value;
-                },
-            };
+        if heavy_after > heavy_before {
+            log!("WARNING: b/{}/{}/{} has {} heavy buckets (see /buckets/b/{}/{}/{})", bits, tolerance, namespace, heavy_after, bits, tolerance, namespace);
+        }
+
+        break
+    }
+
+    let db_name = format!("b/{}/{}/{}", bits, tolerance, namespace);
+    let accepted: Vec<bool> = results.iter().map(|r| match *r { AddResult::Ok => true, _ => false }).collect();
+    handoff.record(&db_name, "add", &encoded, accepted.clone());
+    drop(admitted);
+    changes.publish_writes(&db_name, "add", &encoded, accepted);
+
+    match *mirror {
+        Some(ref mirror) => {
+            mirror_results(mirror, &db_name, "add", encoded, &mut results,
+                           |r: &AddResult| match *r { AddResult::Ok => true, _ => false },
+                           |e| AddResult::Err(e));
+        },
+        None => {},
+    }
+
+    Ok(results)
+}
+
+/// Values encoded for mirroring, the upgrade journal and the change feed, if
+/// any of them needs them
+///
+fn encode_for_mirror<T: Encodable>(values: &Vec<Result<T, String>>, mirror: &Option<Mirror>, handoff: &Handoff, changes: &ChangeFeed) -> Vec<Option<String>> {
+    match mirror.is_some() || handoff.journaling() || changes.records_writes() {
+        true => values.iter().map(|v| v.as_ref().ok().map(|v| encode_value(v))).collect(),
+        false => vec![],
+    }
+}
+
+/// Mirrors the values whose writes were accepted.  If they can't be mirrored
+/// (in write-through mode), each of their results becomes an error
+///
+fn mirror_results<R, A, E>(mirror: &Mirror, db_name: &str, op: &'static str, encoded: Vec<Option<String>>, results: &mut Vec<R>, accepted: A, error: E) where
+A: Fn(&R) -> bool,
+E: Fn(String) -> R,
+{
+    let mut positions = vec![];
+    let mut mutations = vec![];
+    for (i, value) in encoded.into_iter().enumerate() {
+        match (value, accepted(&results[i])) {
+            (Some(value), true) => {
+                positions.push(i);
+                mutations.push(Mutation{db: db_name.to_string(), op: op, value: value});
+            },
+            _ => {},
+        }
+    }
 
-            match db.insert(value) {
-                true => { results.push(AddResult::Ok); },
-                false => { results.push(AddResult::Exists); },
+    match mirror.publish(mutations) {
+        Ok(_) => {},
+        Err(e) => {
+            for i in positions.into_iter() {
+                results[i] = error(format!("{} applied, but not mirrored: {}", op, e));
             }
+        },
+    }
+}
 
+fn insert_values<T, F: FnMut(T) -> Result<bool, StoreError>>(values: Vec<Result<T, String>>, results: &mut Vec<AddResult>, mut insert: F) {
+    for value in values.into_iter() {
+        match value {
+            Ok(v) => match insert(v) {
+                Ok(true) => results.push(AddResult::Ok),
+                Ok(false) => results.push(AddResult::Exists),
+                Err(e) => results.push(AddResult::Err(e.to_string())),
+            },
+            Err(e) => results.push(AddResult::Err(e)),
         }
+    }
+}
 
-        break
+/// Insert values as a single batch (see `Database::insert_batch`)
+///
+fn insert_batch<T>(values: Vec<Result<T, String>>, results: &mut Vec<AddResult>, db: &mut Database<T>, workers: usize) {
+    let mut keys = Vec::with_capacity(values.len());
+    let mut errors = Vec::with_capacity(values.len());
+    for value in values.into_iter() {
+        match value {
+            Ok(v) => {
+                keys.push(v);
+                errors.push(None);
+            },
+            Err(e) => errors.push(Some(e)),
+        }
     }
 
-    let response_body = json::encode(&results.to_json()).unwrap();
-    Ok(Response::with((status::Ok, response_body)))
+    let mut inserted = db.try_insert_batch(keys, workers).into_iter();
+    for error in errors.into_iter() {
+        match error {
+            Some(e) => results.push(AddResult::Err(e)),
+            None => match inserted.next() {
+                Some(Ok(true)) => results.push(AddResult::Ok),
+                Some(Err(e)) => results.push(AddResult::Err(e.to_string())),
+                _ => results.push(AddResult::Exists),
+            },
+        }
+    }
 }
 
 pub fn query(req: &mut Request) -> IronResult<Response> {
-    let req_body = try!(decode_body::<Vec<String>>(req));
+    let mut req_body = try!(decode_body::<Vec<Json>>(req));
+    let order = match bit_order(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
 
     let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
         Some(v) => v.parse::<usize>().unwrap(),
         None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
     };
 
+    let encoding = match value_encoding(req, bits) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let truncate = query_param(req, "truncate") == Some("true".to_string());
+    match check_widths(&mut req_body, bits, encoding, order, truncate) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    }
+
     let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
         Some(v) => v.parse::<usize>().unwrap(),
         None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
@@ -153,88 +582,449 @@ pub fn query(req: &mut Request) -> IronResult<Response> {
         None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
     };
 
+    let reranker = req.get::<persistent::Read<RerankerKey>>().unwrap();
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let explain = query_param(req, "explain") == Some("true".to_string());
+    let diff = query_param(req, "diff") == Some("true".to_string());
+    let budget = match response_budget(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+    let inserted = match inserted_between(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
     match bits {
         32 => {
             let dbmap_mx = req.get::<State<B32>>().unwrap();
-            do_query(req_body, tolerance, namespace, dbmap_mx)
+            do_query(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, encoding == ValueEncoding::Decimal, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
         },
         64 => {
             let dbmap_mx = req.get::<State<B64>>().unwrap();
-            do_query(req_body, tolerance, namespace, dbmap_mx)
+            do_query(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, encoding == ValueEncoding::Decimal, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
         },
         128 => {
             let dbmap_mx = req.get::<State<B128>>().unwrap();
-            do_query(req_body, tolerance, namespace, dbmap_mx)
+            do_query(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, encoding == ValueEncoding::Decimal, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
         },
         256 => {
             let dbmap_mx = req.get::<State<B256>>().unwrap();
-            do_query(req_body, tolerance, namespace, dbmap_mx)
+            do_query(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, encoding == ValueEncoding::Decimal, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
         },
         _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
     }
 }
 
-fn do_query<T>(req_body: Vec<String>, tolerance: usize, namespace: String, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
-T: Eq + Hash + Clone + Encodable + Decodable,
+pub fn do_query<T>(values: Vec<Result<T, String>>, bits: usize, tolerance: usize, namespace: String, decimal: bool, explain: bool, diff: bool, mut budget: ResponseBudget, inserted: Option<InsertedBetween>, reranker: Arc<Option<Box<Reranker>>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
+T: Eq + Hash + Clone + Encodable + Decodable + Hamming,
 {
-    let mut results = Vec::with_capacity(req_body.len());
+    let (values, positions) = collapse(values);
+    let mut results = Vec::with_capacity(values.len());
 
-    match { dbmap_mx.read().unwrap().get(&(tolerance.clone(), namespace.clone())) } {
-        None => {
-            for _ in 0..req_body.len() {
-                results.push(QueryResult::None);
-            }
-        },
+    let (max_candidates, max_query_cost, insert_times) = match options_mx.read().unwrap().get(&(bits, tolerance, namespace.clone())) {
+        Some(options) => (options.max_candidates, options.max_query_cost, options.records_insert_times()),
+        None => (None, None, false),
+    };
+
+    if inserted.is_some() && !insert_times {
+        return Ok(Response::with((status::BadRequest, "insert times aren't recorded for this DB (see the insert_times option)")))
+    }
+
+    let db_mx = dbmap_mx.read().unwrap().get(&(tolerance.clone(), namespace.clone())).cloned();
+    let matched: Vec<Result<Matched<T>, QueryResult<Vec<String>>>> = match db_mx {
+        None => values.into_iter().map(|_| Err(QueryResult::None)).collect(),
         Some(db_mx) => {
+            // Only held while finding matches, so a slow reranker doesn't hold
+            // up writes
             let db = db_mx.read().unwrap();
+            let matched = values.into_iter().map(|value| find_matches(&**db, value, max_candidates, max_query_cost, &inserted, explain)).collect();
+            matched
+        },
+    };
 
-            'value: for value_b64 in req_body.into_iter() {
-                let value_bytes = match value_b64.from_base64() {
-                    Ok(v) => v,
-                    Err(e) => {
-                        results.push(QueryResult::Err(format!("unable to base64-decode '{}': {:?}", value_b64, e)));
-                        continue 'value;
-                    }
-                };
+    let db_name = format!("b/{}/{}/{}", bits, tolerance, namespace);
+    for matched in matched.into_iter() {
+        let Matched{value, found, overflowed, matches, partitions} = match matched {
+            Ok(matched) => matched,
+            Err(result) => {
+                results.push(result);
+                continue
+            },
+        };
 
-                let value: T = match bincode::rustc_serialize::decode(&value_bytes) {
-                    Ok(v) => v,
+        let matches = match *reranker {
+            Some(ref reranker) if !matches.is_empty() => {
+                match rerank::rerank(&**reranker, &db_name, &encode_value(&value), matches) {
+                    Ok(reranked) => reranked,
                     Err(e) => {
-                        results.push(QueryResult::Err(format!("unable to decode '{}': {:?}", value_b64, e)));
-                        continue 'value;
+                        results.push(QueryResult::Err(e));
+                        continue
                     },
-                };
+                }
+            },
+            _ => matches,
+        };
 
-                match db.get(&value) {
-                    Some(found) => {
-                        let found_b64s: Vec<String> = found.iter().map(|v| {
-                            let found_bytes = bincode::rustc_serialize::encode(v, bincode::SizeLimit::Infinite).unwrap();
+        let (found_b64s, truncated) = budget.take(matches, encoded_size);
 
-                            found_bytes.to_base64(BASE64_CONFIG)
-                        }).collect();
+        let partitions = partitions.map(|partitions| kept_entries(partitions, &found_b64s));
 
-                        results.push(QueryResult::Ok(found_b64s));
-                    },
+        let diffs = match (diff, &found) {
+            (true, &Some(ref found)) => Some(diff_matches(&value, found, &found_b64s, bits)),
+            (true, &None) => Some(Json::Object(BTreeMap::new())),
+            (false, _) => None,
+        };
+
+        let (found_b64s, partitions, diffs) = match decimal {
+            true => (
+                found_b64s.iter().map(|v| decimal_from_base64(v)).collect(),
+                partitions.map(decimal_keys),
+                diffs.map(decimal_keys),
+            ),
+            false => (found_b64s, partitions, diffs),
+        };
+
+        match (overflowed || truncated || partitions.is_some() || diffs.is_some()) {
+            true => results.push(QueryResult::Detailed{matches: found_b64s, overflowed: overflowed, truncated: truncated, partitions: partitions, diffs: diffs}),
+            false => results.push(QueryResult::Ok(found_b64s)),
+        }
+    }
+
+    let response_body = json::encode(&fan_out(results, &positions, |result| result.clone()).to_json()).unwrap();
+    Ok(conditional::with_etag(response_body))
+}
+
+/// A value's matches, ordered by distance, as found while the database was
+/// locked
+///
+struct Matched<T> {
+    value: T,
+    found: Option<HashSet<T>>,
+    overflowed: bool,
+    matches: Vec<String>,
+    /// If requested, the partitions each match was found in
+    partitions: Option<Json>,
+}
+
+/// Find the matches for `value`, or the result to return for it if there's
+/// nothing more to do
+///
+fn find_matches<T>(db: &Database<T>, value: Result<T, String>, max_candidates: Option<usize>, max_query_cost: Option<usize>, inserted: &Option<InsertedBetween>, explain: bool) -> Result<Matched<T>, QueryResult<Vec<String>>> where
+T: Eq + Hash + Clone + Encodable + Hamming,
+{
+    let value = try!(value.map_err(QueryResult::Err));
+
+    match max_query_cost.and_then(|max| db.query_cost(&value).map(|cost| (cost, max))) {
+        Some((cost, max)) if cost > max => return Err(QueryResult::TooExpensive{cost: cost, max_query_cost: max}),
+        _ => {},
+    }
+
+    let found = match max_candidates {
+        Some(max_candidates) => db.try_get_bounded(&value, max_candidates),
+        None => db.try_get(&value).map(|found| (found, false)),
+    };
+    let (found, overflowed) = try!(found.map_err(|e| QueryResult::Err(e.to_string())));
+
+    let found = match (found, inserted) {
+        (Some(found), &Some(ref inserted)) => {
+            let found: HashSet<T> = found.into_iter().filter(|v| inserted.contains(db.inserted_at(v))).collect();
+            if found.is_empty() { None } else { Some(found) }
+        },
+        (found, _) => found,
+    };
+
+    let matches = match found {
+        Some(ref found) => ordered_matches(&value, found),
+        None if overflowed => vec![],
+        None => return Err(QueryResult::None),
+    };
+
+    // Every match is explained, since the database isn't locked once they've
+    // been reranked; the partitions of matches which aren't returned are
+    // dropped then
+    let partitions = match (explain, &found) {
+        (true, &Some(ref found)) => Some(explain_matches(db, &value, found, &matches)),
+        (true, &None) => Some(Json::Object(BTreeMap::new())),
+        (false, _) => None,
+    };
+
+    Ok(Matched{value: value, found: found, overflowed: overflowed, matches: matches, partitions: partitions})
+}
+
+/// Whether anything matches each value, as `true` or `false`
+///
+/// Verification stops at the first match, so this is cheaper than a query
+/// when the matches themselves aren't needed.
+///
+pub fn any_match(req: &mut Request) -> IronResult<Response> {
+    presence(req, false)
+}
+
+/// Whether each value itself is stored, as `true` or `false`
+///
+/// Only the value's own bucket in the first partition is read, so this is
+/// cheaper again than `any_match`, i.e. for checking which values of a bulk
+/// load are already present.
+///
+pub fn contains(req: &mut Request) -> IronResult<Response> {
+    presence(req, true)
+}
+
+/// Whether each value is stored (if `exact`) or anything matches it
+///
+fn presence(req: &mut Request, exact: bool) -> IronResult<Response> {
+    let mut req_body = try!(decode_body::<Vec<Json>>(req));
+    let order = match bit_order(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let encoding = match value_encoding(req, bits) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let truncate = query_param(req, "truncate") == Some("true".to_string());
+    match check_widths(&mut req_body, bits, encoding, order, truncate) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    }
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_presence(inject_faults(req, decode_values(req_body, encoding, order)), tolerance, namespace, exact, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_presence(inject_faults(req, decode_values(req_body, encoding, order)), tolerance, namespace, exact, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_presence(inject_faults(req, decode_values(req_body, encoding, order)), tolerance, namespace, exact, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_presence(inject_faults(req, decode_values(req_body, encoding, order)), tolerance, namespace, exact, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_presence<T>(values: Vec<Result<T, String>>, tolerance: usize, namespace: String, exact: bool, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
+T: Eq + Hash + Clone,
+{
+    let (values, positions) = collapse(values);
+
+    let results: Vec<Json> = match { dbmap_mx.read().unwrap().get(&(tolerance.clone(), namespace.clone())) } {
+        None => values.into_iter().map(|value| match value {
+            Ok(_) => Json::Boolean(false),
+            Err(e) => Json::String(format!("err: {}", e)),
+        }).collect(),
+        Some(db_mx) => {
+            let db = db_mx.read().unwrap();
+
+            values.into_iter().map(|value| match value {
+                Ok(ref v) if exact => Json::Boolean(db.contains(v)),
+                Ok(v) => Json::Boolean(db.any_within(&v)),
+                Err(e) => Json::String(format!("err: {}", e)),
+            }).collect()
+        },
+    };
+
+    let response_body = json::encode(&Json::Array(fan_out(results, &positions, |result| result.clone()))).unwrap();
+    Ok(conditional::with_etag(response_body))
+}
+
+/// Drops repeated values, so that each is only added or queried once
+///
+/// Returns the distinct values (and every value which couldn't be decoded)
+/// in order of first appearance, and for each of the original values, the
+/// position of its distinct value.
+///
+fn collapse<T: Eq + Hash + Clone>(values: Vec<Result<T, String>>) -> (Vec<Result<T, String>>, Vec<usize>) {
+    let mut distinct = Vec::with_capacity(values.len());
+    let mut positions = Vec::with_capacity(values.len());
+    let mut seen: HashMap<T, usize> = HashMap::new();
+
+    for value in values.into_iter() {
+        let position = match value {
+            Ok(v) => {
+                let existing = seen.get(&v).cloned();
+                match existing {
+                    Some(position) => position,
                     None => {
-                        results.push(QueryResult::None);
+                        seen.insert(v.clone(), distinct.len());
+                        distinct.push(Ok(v));
+                        distinct.len() - 1
                     },
                 }
-            }
+            },
+            Err(e) => {
+                distinct.push(Err(e));
+                distinct.len() - 1
+            },
+        };
+        positions.push(position);
+    }
+
+    (distinct, positions)
+}
+
+/// The results of `collapse`d values, one for each original value, with
+/// `repeat` giving the result for repeats of a value
+///
+fn fan_out<R: Clone, F: Fn(&R) -> R>(results: Vec<R>, positions: &[usize], repeat: F) -> Vec<R> {
+    if results.len() == positions.len() {
+        return results
+    }
+
+    let mut seen = vec![false; results.len()];
+    positions.iter().map(|&i| {
+        let result = match seen[i] {
+            true => repeat(&results[i]),
+            false => results[i].clone(),
+        };
+        seen[i] = true;
+        result
+    }).collect()
+}
+
+/// Encoded matches, nearest to `key` first and then in order of their
+/// encoding, so that the same query gets the same response (and the response
+/// size limit drops the furthest matches)
+///
+fn ordered_matches<T: Encodable + Hamming>(key: &T, found: &HashSet<T>) -> Vec<String> {
+    let mut matches: Vec<(usize, String)> = found.iter().map(|v| (key.hamming(v), encode_value(v))).collect();
+    matches.sort();
+    matches.into_iter().map(|(_, v)| v).collect()
+}
+
+/// JSON object mapping each found value in `kept` to the partitions it
+/// matched in
+///
+fn explain_matches<T: Encodable>(db: &Database<T>, key: &T, found: &HashSet<T>, kept: &[String]) -> Json {
+    let kept: HashSet<&String> = kept.iter().collect();
+    let mut d = BTreeMap::new();
+
+    for value in found.iter() {
+        let value_b64 = encode_value(value);
+        if !kept.contains(&value_b64) {
+            continue
+        }
+
+        let matches = match db.explain(key, value) {
+            Some(matches) => matches,
+            None => return Json::Null,
+        };
+
+        let matches_json = matches.iter().map(|m| {
+            let mut d = BTreeMap::new();
+            d.insert("start_dimension".to_string(), m.window.start_dimension.to_json());
+            d.insert("dimensions".to_string(), m.window.dimensions.to_json());
+            d.insert("match".to_string(), match m.kind {
+                MatchKind::Exact => "exact",
+                MatchKind::One => "one",
+            }.to_json());
+            Json::Object(d)
+        }).collect::<Vec<Json>>();
+
+        d.insert(value_b64, Json::Array(matches_json));
+    }
+
+    Json::Object(d)
+}
+
+/// JSON object mapping each found value in `kept` to how it differs from
+/// `key`: the XOR of the two as hex (most significant digit first) and the
+/// differing dimensions
+///
+fn diff_matches<T: Encodable + Hamming>(key: &T, found: &HashSet<T>, kept: &[String], bits: usize) -> Json {
+    let kept: HashSet<&String> = kept.iter().collect();
+    let mut d = BTreeMap::new();
+
+    for value in found.iter() {
+        let value_b64 = encode_value(value);
+        if !kept.contains(&value_b64) {
+            continue
         }
+
+        let mut dimensions = key.hamming_indices(value);
+        dimensions.sort();
+
+        let mut xor = vec![0u8; bits / 4];
+        for &i in dimensions.iter() {
+            xor[i / 4] |= 1 << (i % 4);
+        }
+        let xor_hex: String = xor.iter().rev().map(|nibble| format!("{:x}", nibble)).collect();
+
+        let mut diff = BTreeMap::new();
+        diff.insert("xor".to_string(), xor_hex.to_json());
+        diff.insert("dimensions".to_string(), dimensions.to_json());
+        d.insert(value_b64, Json::Object(diff));
     }
 
-    let response_body = json::encode(&results.to_json()).unwrap();
-    Ok(Response::with((status::Ok, response_body)))
+    Json::Object(d)
+}
+
+/// The entries of a JSON object keyed by value for the values in `kept`
+///
+fn kept_entries(json: Json, kept: &[String]) -> Json {
+    let kept: HashSet<&String> = kept.iter().collect();
+    match json {
+        Json::Object(d) => Json::Object(d.into_iter().filter(|&(ref v, _)| kept.contains(v)).collect()),
+        json => json,
+    }
+}
+
+/// `explain` or `diff` output, keyed by decimal rather than base64 values
+///
+fn decimal_keys(json: Json) -> Json {
+    match json {
+        Json::Object(d) => Json::Object(d.into_iter().map(|(v, m)| (decimal_from_base64(&v), m)).collect()),
+        json => json,
+    }
 }
 
 pub fn delete(req: &mut Request) -> IronResult<Response> {
-    let req_body = try!(decode_body::<Vec<String>>(req));
+    let mut req_body = try!(decode_body::<Vec<Json>>(req));
+    let order = match bit_order(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
 
     let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
         Some(v) => v.parse::<usize>().unwrap(),
         None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
     };
 
+    let encoding = match value_encoding(req, bits) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let truncate = query_param(req, "truncate") == Some("true".to_string());
+    match check_widths(&mut req_body, bits, encoding, order, truncate) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    }
+
     let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
         Some(v) => v.parse::<usize>().unwrap(),
         None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
@@ -245,66 +1035,98 @@ pub fn delete(req: &mut Request) -> IronResult<Response> {
         None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
     };
 
+    let changes = req.get::<persistent::Read<ChangeFeedKey>>().unwrap();
+    let mirror = req.get::<persistent::Read<MirrorKey>>().unwrap();
+    let handoff = req.get::<persistent::Read<HandoffKey>>().unwrap();
+
     match bits {
         32 => {
             let dbmap_mx = req.get::<State<B32>>().unwrap();
-            do_delete(req_body, tolerance, namespace, dbmap_mx)
+            do_delete(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
         },
         64 => {
             let dbmap_mx = req.get::<State<B64>>().unwrap();
-            do_delete(req_body, tolerance, namespace, dbmap_mx)
+            do_delete(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
         },
         128 => {
             let dbmap_mx = req.get::<State<B128>>().unwrap();
-            do_delete(req_body, tolerance, namespace, dbmap_mx)
+            do_delete(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
         },
         256 => {
             let dbmap_mx = req.get::<State<B256>>().unwrap();
-            do_delete(req_body, tolerance, namespace, dbmap_mx)
+            do_delete(inject_faults(req, decode_values(req_body, encoding, order)), bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
         },
         _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize or tolerance"))),
     }
 }
 
-fn do_delete<T>(req_body: Vec<String>, tolerance: usize, namespace: String, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
+pub fn do_delete<T>(values: Vec<Result<T, String>>, bits: usize, tolerance: usize, namespace: String, changes: Arc<ChangeFeed>, mirror: Arc<Option<Mirror>>, handoff: Arc<Handoff>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
 T: Eq + Hash + Clone + Encodable + Decodable,
 {
-    let mut results = Vec::with_capacity(req_body.len());
+    let results = delete_values(values, bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx);
+
+    let response_body = json::encode(&results.to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+/// Removes values from the DB, if it exists
+///
+pub fn delete_values<T>(values: Vec<Result<T, String>>, bits: usize, tolerance: usize, namespace: String, changes: Arc<ChangeFeed>, mirror: Arc<Option<Mirror>>, handoff: Arc<Handoff>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> Vec<DeleteResult> where
+T: Eq + Hash + Clone + Encodable + Decodable,
+{
+    let admitted = match handoff.admit() {
+        Ok(admitted) => admitted,
+        Err(e) => return values.iter().map(|_| DeleteResult::Err(e.clone())).collect(),
+    };
+
+    let mut results = Vec::with_capacity(values.len());
+    let encoded = encode_for_mirror(&values, &*mirror, &handoff, &changes);
 
     match { dbmap_mx.read().unwrap().get(&(tolerance.clone(), namespace.clone())) } {
         None => {
-            for _ in 0..req_body.len() {
+            for _ in 0..values.len() {
                 results.push(DeleteResult::NotFound);
             }
         },
         Some(db_mx) => {
-            let mut db = db_mx.write().unwrap();
+            let concurrent = db_mx.read().unwrap().concurrent_writes();
+            if concurrent {
+                let db = db_mx.read().unwrap();
+                remove_values(values, &mut results, |v| db.try_remove_concurrent(v));
+            } else {
+                let mut db = db_mx.write().unwrap();
+                remove_values(values, &mut results, |v| db.try_remove(v));
+            }
+        }
+    }
 
-            'value: for value_b64 in req_body.into_iter() {
-                let value_bytes = match value_b64.from_base64() {
-                    Ok(v) => v,
-                    Err(e) => {
-                        results.push(DeleteResult::Err(format!("unable to base64-decode '{}': {:?}", value_b64, e)));
-                        continue 'value;
-                    }
-                };
+    let db_name = format!("b/{}/{}/{}", bits, tolerance, namespace);
+    let accepted: Vec<bool> = results.iter().map(|r| match *r { DeleteResult::Ok => true, _ => false }).collect();
+    handoff.record(&db_name, "delete", &encoded, accepted.clone());
+    drop(admitted);
+    changes.publish_writes(&db_name, "delete", &encoded, accepted);
 
-                let value: T = match bincode::rustc_serialize::decode(&value_bytes) {
-                    Ok(v) => v,
-                    Err(e) => {
-                        results.push(DeleteResult::Err(format!("unable to decode '{}': {:?}", value_b64, e)));
-                        continue 'value;
-                    },
-                };
+    match *mirror {
+        Some(ref mirror) => {
+            mirror_results(mirror, &db_name, "delete", encoded, &mut results,
+                           |r: &DeleteResult| match *r { DeleteResult::Ok => true, _ => false },
+                           |e| DeleteResult::Err(e));
+        },
+        None => {},
+    }
 
-                match db.remove(&value) {
-                    true => { results.push(DeleteResult::Ok); },
-                    false => { results.push(DeleteResult::NotFound); },
-                }
-            }
+    results
+}
+
+fn remove_values<T, F: FnMut(&T) -> Result<bool, StoreError>>(values: Vec<Result<T, String>>, results: &mut Vec<DeleteResult>, mut remove: F) {
+    for value in values.into_iter() {
+        match value {
+            Ok(v) => match remove(&v) {
+                Ok(true) => results.push(DeleteResult::Ok),
+                Ok(false) => results.push(DeleteResult::NotFound),
+                Err(e) => results.push(DeleteResult::Err(e.to_string())),
+            },
+            Err(e) => results.push(DeleteResult::Err(e)),
         }
     }
-
-    let response_body = json::encode(&results.to_json()).unwrap();
-    Ok(Response::with((status::Ok, response_body)))
 }
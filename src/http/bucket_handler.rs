@@ -0,0 +1,109 @@
+use std::collections::{BTreeMap, HashMap};
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::status;
+use router::Router;
+use persistent::State;
+use rustc_serialize::json;
+use rustc_serialize::Encodable;
+use rustc_serialize::json::{ToJson, Json};
+
+use hammer::db::Database;
+use hammer::db::bucket_stats::{BucketStats, PartitionMemory};
+
+use http::{B32, B64, B128, B256};
+use http::binary_handler::encode_value;
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_show(tolerance, namespace, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_show(tolerance, namespace, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_show(tolerance, namespace, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_show(tolerance, namespace, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_show<T: Encodable>(tolerance: usize, namespace: String, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> {
+    let (stats, memory) = match { dbmap_mx.read().unwrap().get(&(tolerance, namespace)) } {
+        Some(db_mx) => {
+            let db = db_mx.read().unwrap();
+            (db.bucket_stats(), db.memory())
+        },
+        None => return Ok(Response::with((status::NotFound, "DB not found"))),
+    };
+
+    match stats {
+        Some(stats) => {
+            let response_body = json::encode(&stats_to_json(&stats, memory)).unwrap();
+            Ok(Response::with((status::Ok, response_body)))
+        },
+        None => Ok(Response::with((status::NotFound, "DB doesn't track bucket sizes"))),
+    }
+}
+
+/// Bucket statistics, with each partition's memory (`entries` and `bytes`)
+/// if it's held in memory
+///
+fn stats_to_json<T: Encodable>(stats: &BucketStats<T>, memory: Option<Vec<PartitionMemory>>) -> Json {
+    let partitions = stats.partitions.iter().enumerate().map(|(i, p)| {
+        let mut d = BTreeMap::new();
+        d.insert("start_dimension".to_string(), p.window.start_dimension.to_json());
+        d.insert("dimensions".to_string(), p.window.dimensions.to_json());
+        d.insert("buckets".to_string(), p.buckets.to_json());
+        d.insert("max_size".to_string(), p.max_size.to_json());
+        d.insert("histogram".to_string(), p.histogram.to_json());
+        d.insert("repaired".to_string(), p.repaired.to_json());
+        match memory.as_ref().and_then(|memory| memory.get(i)) {
+            Some(m) => {
+                d.insert("entries".to_string(), m.entries.to_json());
+                d.insert("bytes".to_string(), m.bytes.to_json());
+            },
+            None => {},
+        }
+        Json::Object(d)
+    }).collect::<Vec<Json>>();
+
+    let heavy = stats.heavy.iter().map(|b| {
+        let mut d = BTreeMap::new();
+        d.insert("start_dimension".to_string(), b.window.start_dimension.to_json());
+        d.insert("dimensions".to_string(), b.window.dimensions.to_json());
+        d.insert("size".to_string(), b.size.to_json());
+        d.insert("sample".to_string(), encode_value(&b.sample).to_json());
+        Json::Object(d)
+    }).collect::<Vec<Json>>();
+
+    let mut d = BTreeMap::new();
+    d.insert("partitions".to_string(), Json::Array(partitions));
+    d.insert("heavy".to_string(), Json::Array(heavy));
+    d.insert("distinct_keys".to_string(), stats.distinct.estimate().to_json());
+    Json::Object(d)
+}
@@ -0,0 +1,155 @@
+//! Per-namespace concurrency limits
+//!
+//! Requests are served by a fixed pool of threads, so a tenant sending many
+//! slow requests (i.e. a bulk load) can occupy all of them and starve other
+//! tenants' queries.  With `--namespace-concurrency=N`, at most `N` `add`,
+//! `query`, `any_match`, `contains`, `delete` and `load` requests for each
+//! namespace are handled at once; further requests for that namespace are
+//! rejected straight away with a 503 rather than waiting, since a waiting
+//! request would hold a thread too.  Other namespaces are unaffected.
+//!
+//! Requests in flight, the most seen at once and the numbers admitted and
+//! rejected are reported by namespace in `/metrics` (`bulkheads`), whether or
+//! not a limit is set.
+
+use std::collections::BTreeMap;
+use std::io;
+use std::sync::{Arc, Mutex, RwLock};
+
+use iron::prelude::*;
+use iron::{status, typemap, AfterMiddleware, BeforeMiddleware};
+use rustc_serialize::json::{ToJson, Json};
+
+use http::Config;
+use http::metrics::Metrics;
+
+#[derive(Default)]
+struct Slots {
+    in_flight: usize,
+    max_in_flight: usize,
+    admitted: usize,
+    rejected: usize,
+}
+
+/// Requests in flight, by namespace
+///
+pub struct Bulkheads {
+    slots: Mutex<BTreeMap<String, Slots>>,
+}
+
+impl Bulkheads {
+    pub fn new() -> Bulkheads {
+        Bulkheads{slots: Mutex::new(BTreeMap::new())}
+    }
+
+    /// Takes a slot for a request to `namespace` if fewer than `limit` are in
+    /// flight (a `limit` of 0 is unlimited)
+    ///
+    fn acquire(&self, namespace: &str, limit: usize) -> bool {
+        let mut slots = self.slots.lock().unwrap();
+        let slots = slots.entry(namespace.to_string()).or_insert_with(Slots::default);
+
+        if limit > 0 && slots.in_flight >= limit {
+            slots.rejected += 1;
+            return false
+        }
+
+        slots.in_flight += 1;
+        slots.admitted += 1;
+        if slots.in_flight > slots.max_in_flight {
+            slots.max_in_flight = slots.in_flight;
+        }
+        true
+    }
+
+    fn release(&self, namespace: &str) {
+        match self.slots.lock().unwrap().get_mut(namespace) {
+            Some(slots) => slots.in_flight -= 1,
+            None => {},
+        }
+    }
+}
+
+impl ToJson for Bulkheads {
+    fn to_json(&self) -> Json {
+        let slots = self.slots.lock().unwrap();
+        Json::Object(slots.iter().map(|(namespace, slots)| {
+            let mut d = BTreeMap::new();
+            d.insert("in_flight".to_string(), slots.in_flight.to_json());
+            d.insert("max_in_flight".to_string(), slots.max_in_flight.to_json());
+            d.insert("admitted".to_string(), slots.admitted.to_json());
+            d.insert("rejected".to_string(), slots.rejected.to_json());
+            (namespace.clone(), Json::Object(d))
+        }).collect())
+    }
+}
+
+/// The namespace whose slot a request holds
+struct SlotKey;
+impl typemap::Key for SlotKey { type Value = String; }
+
+/// Admits requests while their namespace has free slots
+///
+/// The limit is read from the config for each request, so it can be
+/// reloaded.
+///
+#[derive(Clone)]
+pub struct Bulkhead {
+    metrics: Arc<Metrics>,
+    config: Arc<RwLock<Config>>,
+}
+
+impl Bulkhead {
+    pub fn new(metrics: Arc<Metrics>, config: Arc<RwLock<Config>>) -> Bulkhead {
+        Bulkhead{metrics: metrics, config: config}
+    }
+
+    /// The namespace of add, query, delete and load requests
+    ///
+    fn namespace(req: &Request) -> Option<String> {
+        let path = &req.url.path;
+        match path.first() {
+            Some(op) if (op == "add" || op == "query" || op == "any_match" || op == "contains" || op == "delete") && path.len() >= 5 => Some(path[path.len() - 1].clone()),
+            Some(op) if op == "load" && path.len() == 2 => Some(path[1].clone()),
+            _ => None,
+        }
+    }
+
+    fn release(&self, req: &mut Request) {
+        match req.extensions.remove::<SlotKey>() {
+            Some(namespace) => self.metrics.bulkheads.release(&namespace),
+            None => {},
+        }
+    }
+}
+
+impl BeforeMiddleware for Bulkhead {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        let namespace = match Bulkhead::namespace(req) {
+            Some(namespace) => namespace,
+            None => return Ok(()),
+        };
+
+        let limit = self.config.read().unwrap().namespace_concurrency;
+        if !self.metrics.bulkheads.acquire(&namespace, limit) {
+            let err = io::Error::new(io::ErrorKind::Other, "namespace saturated");
+            let msg = format!("too many concurrent requests for namespace '{}', retry shortly", namespace);
+            return Err(IronError::new(err, (status::ServiceUnavailable, msg)))
+        }
+
+        req.extensions.insert::<SlotKey>(namespace);
+        Ok(())
+    }
+}
+
+impl AfterMiddleware for Bulkhead {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        self.release(req);
+        Ok(res)
+    }
+
+    fn catch(&self, req: &mut Request, err: IronError) -> IronResult<Response> {
+        self.release(req);
+        Err(err)
+    }
+}
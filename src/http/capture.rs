@@ -0,0 +1,115 @@
+//! Workload capture
+//!
+//! With `--capture=<path>`, a fraction `--capture-rate` of `add`, `query`,
+//! `any_match` and `delete` requests (on every type of database) are
+//! appended to that file, one JSON object per line, for `hammerhttp replay`:
+//!
+//! ```text
+//! {"at_ms":1520,"body":"[\"AAAAAAAAAAE=\"]","method":"POST","path":"/query/b/64/8/foo?limit=10","status":200}
+//! ```
+//!
+//! `at_ms` is when the request arrived, in milliseconds since the server
+//! started, so replays can keep the original timing.  Requests are recorded
+//! once they've been handled, so lines aren't strictly in `at_ms` order, and
+//! requests rejected before their body was read (i.e. by `--auth-tokens` or
+//! the bulkhead) aren't recorded.  Bodies are kept in memory only for the
+//! requests being captured.
+
+use std::collections::BTreeMap;
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+use iron::prelude::*;
+use iron::{typemap, AfterMiddleware, BeforeMiddleware};
+use rand;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+/// Operations captured
+const OPS: [&'static str; 4] = ["add", "query", "any_match", "delete"];
+
+/// Set by middleware which needs the request body (`capture` and `shadow`),
+/// so that `decode_body` keeps a copy
+///
+pub struct KeepBodyKey;
+impl typemap::Key for KeepBodyKey { type Value = (); }
+
+/// Body of a request marked with `KeepBodyKey`, recorded by `decode_body`
+///
+pub struct RequestBodyKey;
+impl typemap::Key for RequestBodyKey { type Value = String; }
+
+/// When a captured request arrived; present only for requests being captured
+///
+struct CapturingKey;
+impl typemap::Key for CapturingKey { type Value = Instant; }
+
+#[derive(Clone)]
+pub struct Capture {
+    file: Arc<Mutex<File>>,
+    rate: f64,
+    started: Instant,
+}
+
+impl Capture {
+    pub fn open(path: &str, rate: f64) -> Result<Capture, String> {
+        let file = match OpenOptions::new().append(true).create(true).open(path) {
+            Ok(file) => file,
+            Err(e) => return Err(format!("unable to open capture file '{}': {}", path, e)),
+        };
+        Ok(Capture{file: Arc::new(Mutex::new(file)), rate: rate, started: Instant::now()})
+    }
+
+    fn record(&self, req: &Request, status: u16) {
+        let (arrived, body) = match (req.extensions.get::<CapturingKey>(), req.extensions.get::<RequestBodyKey>()) {
+            (Some(arrived), Some(body)) => (arrived, body),
+            _ => return,
+        };
+        let since = arrived.duration_since(self.started);
+        let path = match req.url.query {
+            Some(ref query) => format!("/{}?{}", req.url.path.join("/"), query),
+            None => format!("/{}", req.url.path.join("/")),
+        };
+
+        let mut d = BTreeMap::new();
+        d.insert("at_ms".to_string(), (since.as_secs() * 1000 + since.subsec_nanos() as u64 / 1000000).to_json());
+        d.insert("method".to_string(), req.method.to_string().to_json());
+        d.insert("path".to_string(), path.to_json());
+        d.insert("body".to_string(), body.to_json());
+        d.insert("status".to_string(), status.to_json());
+        let line = json::encode(&Json::Object(d)).unwrap();
+
+        match writeln!(self.file.lock().unwrap(), "{}", line) {
+            Ok(_) => {},
+            Err(e) => log!("WARNING: unable to write capture file: {}", e),
+        }
+    }
+}
+
+impl BeforeMiddleware for Capture {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        let captured = match req.url.path.first() {
+            Some(op) => OPS.contains(&&op[..]),
+            None => false,
+        };
+        if captured && rand::random::<f64>() < self.rate {
+            req.extensions.insert::<CapturingKey>(Instant::now());
+            req.extensions.insert::<KeepBodyKey>(());
+        }
+        Ok(())
+    }
+}
+
+impl AfterMiddleware for Capture {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        self.record(req, res.status.map(|s| s.to_u16()).unwrap_or(404));
+        Ok(res)
+    }
+
+    fn catch(&self, req: &mut Request, err: IronError) -> IronResult<Response> {
+        self.record(req, err.response.status.map(|s| s.to_u16()).unwrap_or(500));
+        Err(err)
+    }
+}
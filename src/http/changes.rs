@@ -0,0 +1,251 @@
+use std::collections::{BTreeMap, VecDeque};
+use std::sync::{Arc, Mutex};
+use std::time::Instant;
+
+use iron::prelude::*;
+use iron::{status, typemap};
+use persistent::Read;
+use rand;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::auth;
+use http::auth::Scope;
+use http::query_param;
+use http::fencing::Fencing;
+use http::versions::Versions;
+
+/// Maximum number of changes retained
+const CAPACITY: usize = 10000;
+
+#[derive(Clone, Debug)]
+pub struct Change {
+    /// Position in the feed
+    pub seq: u64,
+    /// Database the change applies to, i.e. `b/64/8/foo`
+    pub db: String,
+    pub op: &'static str,
+    /// Base64-encoded value
+    pub value: String,
+    /// Leader epoch of the server when the change was made
+    pub epoch: u64,
+    /// Version of the database after the change (see `versions`)
+    pub version: u64,
+}
+
+impl ToJson for Change {
+    fn to_json(&self) -> Json {
+        let mut d = BTreeMap::new();
+        d.insert("seq".to_string(), self.seq.to_json());
+        d.insert("db".to_string(), self.db.to_json());
+        d.insert("op".to_string(), self.op.to_json());
+        d.insert("value".to_string(), self.value.to_json());
+        d.insert("epoch".to_string(), self.epoch.to_json());
+        d.insert("version".to_string(), self.version.to_json());
+        Json::Object(d)
+    }
+}
+
+/// Position acknowledged by a replica polling the feed
+///
+struct Replica {
+    /// Every change before this sequence number has been applied
+    acked: u64,
+    last_seen: Instant,
+}
+
+/// Server-wide feed of changes made by the server itself (i.e. evictions),
+/// and of accepted adds and deletes if `writes` is set (`--feed-writes`)
+///
+/// The feed is in-memory and bounded; once it's full the oldest changes are
+/// dropped, so consumers should poll often enough to keep up.  Changes are
+/// stamped with the server's leader epoch (see `fencing`).
+///
+/// Every change counts towards its database's version, whether or not writes
+/// are published.
+///
+/// Sequence numbers start from 0 whenever the server starts, so the feed has
+/// a random `id`; a consumer resuming from a saved position must check it.
+///
+pub struct ChangeFeed {
+    changes: Mutex<(u64, VecDeque<Change>)>,
+    writes: bool,
+    fencing: Arc<Fencing>,
+    versions: Versions,
+    id: String,
+    replicas: Mutex<BTreeMap<String, Replica>>,
+}
+
+impl ChangeFeed {
+    pub fn new(writes: bool, fencing: Arc<Fencing>) -> ChangeFeed {
+        ChangeFeed{
+            changes: Mutex::new((0, VecDeque::new())),
+            writes: writes,
+            fencing: fencing,
+            versions: Versions::new(),
+            id: format!("{:016x}", rand::random::<u64>()),
+            replicas: Mutex::new(BTreeMap::new()),
+        }
+    }
+
+    /// Whether adds and deletes are published
+    ///
+    pub fn records_writes(&self) -> bool {
+        self.writes
+    }
+
+    pub fn id(&self) -> &str {
+        &self.id
+    }
+
+    /// The server's current leader epoch
+    ///
+    pub fn epoch(&self) -> u64 {
+        self.fencing.epoch()
+    }
+
+    pub fn versions(&self) -> &Versions {
+        &self.versions
+    }
+
+    /// Publishes the writes of `encoded` values which were `accepted`, if
+    /// writes are published
+    ///
+    pub fn publish_writes(&self, db_name: &str, op: &'static str, encoded: &[Option<String>], accepted: Vec<bool>) {
+        if !self.writes {
+            let count = accepted.iter().filter(|&&a| a).count();
+            self.versions.bump(db_name, count as u64);
+            return
+        }
+
+        for (value, accepted) in encoded.iter().zip(accepted.into_iter()) {
+            match (value, accepted) {
+                (&Some(ref value), true) => self.publish(db_name.to_string(), op, value.clone()),
+                _ => {},
+            }
+        }
+    }
+
+    pub fn publish(&self, db: String, op: &'static str, value: String) {
+        let epoch = self.fencing.epoch();
+        let mut changes = self.changes.lock().unwrap();
+        let (ref mut next_seq, ref mut queue) = *changes;
+
+        // Bumped while holding the feed, so versions increase with `seq`
+        let version = self.versions.bump(&db, 1);
+        queue.push_back(Change{seq: *next_seq, db: db, op: op, value: value, epoch: epoch, version: version});
+        *next_seq += 1;
+
+        while queue.len() > CAPACITY {
+            queue.pop_front();
+        }
+    }
+
+    /// The sequence number the next change will have
+    ///
+    pub fn head(&self) -> u64 {
+        self.changes.lock().unwrap().0
+    }
+
+    /// Changes with sequence numbers `since` or later, at most `limit` of
+    /// them (0 is unlimited)
+    ///
+    /// Returns the changes, the sequence number to request next, true if
+    /// changes after `since` have already been dropped, and true if `limit`
+    /// left changes out
+    ///
+    pub fn since(&self, since: u64, limit: usize) -> (Vec<Change>, u64, bool, bool) {
+        let changes = self.changes.lock().unwrap();
+        let (next_seq, ref queue) = *changes;
+
+        let truncated = match queue.front() {
+            Some(oldest) => oldest.seq > since,
+            None => next_seq > since,
+        };
+
+        let limit = if limit == 0 { queue.len() } else { limit };
+        let found: Vec<Change> = queue.iter().filter(|c| c.seq >= since).take(limit).cloned().collect();
+        match found.last() {
+            Some(last) if last.seq + 1 < next_seq => {
+                let next = last.seq + 1;
+                (found, next, truncated, true)
+            },
+            _ => (found, next_seq, truncated, false),
+        }
+    }
+
+    /// Records that `replica` has applied every change before `since`
+    ///
+    pub fn ack(&self, replica: &str, since: u64) {
+        let mut replicas = self.replicas.lock().unwrap();
+        let replica = replicas.entry(replica.to_string()).or_insert(Replica{acked: since, last_seen: Instant::now()});
+        replica.acked = since;
+        replica.last_seen = Instant::now();
+    }
+
+    /// Replicas' acknowledged positions, and how far behind they are
+    ///
+    pub fn replicas(&self) -> Json {
+        let next_seq = self.changes.lock().unwrap().0;
+        let replicas = self.replicas.lock().unwrap();
+
+        Json::Object(replicas.iter().map(|(id, replica)| {
+            let mut d = BTreeMap::new();
+            d.insert("acked".to_string(), replica.acked.to_json());
+            d.insert("lag".to_string(), next_seq.saturating_sub(replica.acked).to_json());
+            d.insert("last_seen_s".to_string(), replica.last_seen.elapsed().as_secs().to_json());
+            (id.clone(), Json::Object(d))
+        }).collect())
+    }
+}
+
+pub struct ChangeFeedKey;
+impl typemap::Key for ChangeFeedKey { type Value = ChangeFeed; }
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let since = match query_param(req, "since") {
+        Some(v) => match v.parse::<u64>() {
+            Ok(v) => v,
+            Err(_) => return Ok(Response::with((status::BadRequest, "since must be an integer"))),
+        },
+        None => 0,
+    };
+    let limit = match query_param(req, "limit") {
+        Some(v) => match v.parse::<usize>() {
+            Ok(v) => v,
+            Err(_) => return Ok(Response::with((status::BadRequest, "limit must be an integer"))),
+        },
+        None => 0,
+    };
+
+    let feed = req.get::<Read<ChangeFeedKey>>().unwrap();
+    // Polling from `since` acknowledges everything before it
+    match query_param(req, "replica") {
+        Some(replica) => feed.ack(&replica, since),
+        None => {},
+    }
+    let (changes, next_seq, truncated, more) = feed.since(since, limit);
+
+    // Only changes to namespaces the token can read are shown, though `next`
+    // still moves past the rest
+    let readable = |db: &str| auth::db_namespace(db).map_or(false, |namespace| auth::allowed(req, namespace, Scope::Data));
+    let changes: Vec<Change> = changes.into_iter().filter(|change| readable(&change.db[..])).collect();
+    let versions = match feed.versions().to_json() {
+        Json::Object(versions) => Json::Object(versions.into_iter().filter(|&(ref db, _)| readable(&db[..])).collect()),
+        versions => versions,
+    };
+
+    let mut d = BTreeMap::new();
+    d.insert("changes".to_string(), changes.to_json());
+    d.insert("next".to_string(), next_seq.to_json());
+    d.insert("truncated".to_string(), truncated.to_json());
+    d.insert("more".to_string(), more.to_json());
+    d.insert("head".to_string(), feed.head().to_json());
+    d.insert("feed".to_string(), feed.id().to_json());
+    d.insert("writes".to_string(), feed.records_writes().to_json());
+    d.insert("epoch".to_string(), feed.epoch().to_json());
+    d.insert("versions".to_string(), versions);
+
+    let response_body = json::encode(&Json::Object(d)).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
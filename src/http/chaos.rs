@@ -0,0 +1,122 @@
+//! Fault injection, for testing clients against an unreliable server
+//!
+//! Only built with the `chaos` feature.  Faults are configured (and disabled,
+//! which is the default) at runtime through `/chaos`:
+//!
+//! * `delay_ms`: `add`, `query`, `any_match` and `delete` requests are
+//!   delayed by a random time up to this many milliseconds
+//! * `error_rate`: Fraction of `add`, `query`, `any_match` and `delete`
+//!   requests which fail outright with a 503, without being applied
+//! * `partial_rate`: Fraction of values in binary `add`, `query`,
+//!   `any_match` and `delete` requests which fail individually, reported like
+//!   any other per-value error and not applied
+//!
+//! ```sh
+//! curl -X POST localhost:3000/chaos -d '{"delay_ms":200,"error_rate":0.1,"partial_rate":0.05}'
+//! ```
+//!
+//! Store failures aren't injected here; they're reported through the stores'
+//! `try_` methods (see `db::error`), so a `MapSet` or `IDMap` which fails
+//! them exercises the same per-value errors.
+
+use std::collections::BTreeMap;
+use std::io;
+use std::sync::{Arc, RwLock};
+use std::thread;
+use std::time::Duration;
+
+use iron::prelude::*;
+use iron::{status, typemap, BeforeMiddleware};
+use persistent::Read;
+use rand;
+use rand::Rng;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::decode_body;
+
+#[derive(Clone, Debug, Default, RustcDecodable)]
+pub struct Faults {
+    pub delay_ms: u64,
+    pub error_rate: f64,
+    pub partial_rate: f64,
+}
+
+impl ToJson for Faults {
+    fn to_json(&self) -> Json {
+        let mut d = BTreeMap::new();
+        d.insert("delay_ms".to_string(), self.delay_ms.to_json());
+        d.insert("error_rate".to_string(), self.error_rate.to_json());
+        d.insert("partial_rate".to_string(), self.partial_rate.to_json());
+        Json::Object(d)
+    }
+}
+
+pub struct ChaosKey;
+impl typemap::Key for ChaosKey { type Value = RwLock<Faults>; }
+
+/// Delays and fails requests according to the configured faults
+///
+pub struct Chaos {
+    faults: Arc<RwLock<Faults>>,
+}
+
+impl Chaos {
+    pub fn new(faults: Arc<RwLock<Faults>>) -> Chaos {
+        Chaos{faults: faults}
+    }
+}
+
+impl BeforeMiddleware for Chaos {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        match req.url.path.first() {
+            Some(op) if op == "add" || op == "query" || op == "any_match" || op == "delete" => {},
+            _ => return Ok(()),
+        }
+
+        let faults = self.faults.read().unwrap().clone();
+        let mut rng = rand::thread_rng();
+
+        if faults.delay_ms > 0 {
+            thread::sleep(Duration::from_millis(rng.gen_range(0, faults.delay_ms + 1)));
+        }
+
+        if rng.gen::<f64>() < faults.error_rate {
+            let err = io::Error::new(io::ErrorKind::Other, "injected fault");
+            return Err(IronError::new(err, (status::ServiceUnavailable, "injected fault")))
+        }
+
+        Ok(())
+    }
+}
+
+/// Fail values at the configured `partial_rate`
+///
+pub fn fail_values<T>(req: &mut Request, values: Vec<Result<T, String>>) -> Vec<Result<T, String>> {
+    let partial_rate = req.get::<Read<ChaosKey>>().unwrap().read().unwrap().partial_rate;
+    let mut rng = rand::thread_rng();
+
+    values.into_iter().map(|v| {
+        match rng.gen::<f64>() < partial_rate {
+            true => Err("injected fault".to_string()),
+            false => v,
+        }
+    }).collect()
+}
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let faults = req.get::<Read<ChaosKey>>().unwrap();
+
+    let response_body = json::encode(&faults.read().unwrap().to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+pub fn set(req: &mut Request) -> IronResult<Response> {
+    let new_faults = try!(decode_body::<Faults>(req));
+    let faults = req.get::<Read<ChaosKey>>().unwrap();
+
+    *faults.write().unwrap() = new_faults.clone();
+
+    let response_body = json::encode(&new_faults.to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
@@ -0,0 +1,130 @@
+//! Near-duplicate clusters, see `hammer::db::cluster`
+//!
+//! `GET /cluster/b/:bits/:tolerance/:namespace` clusters every value stored in
+//! the database; `POST` to the same path clusters only around the posted
+//! values.  Responds with the clusters as arrays of base64-encoded values,
+//! largest first.
+
+use std::collections::HashMap;
+use std::hash::Hash;
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::method::Method;
+use iron::status;
+use router::Router;
+use persistent::State;
+use rustc_serialize::json;
+use rustc_serialize::{Encodable, Decodable};
+use rustc_serialize::json::Json;
+
+use hammer::db::Database;
+use hammer::db::cluster::single_linkage;
+use hammer::db::hamming::Hamming;
+use hammer::hyperplane::FromBits;
+
+use http::{B32, B64, B128, B256, BitOrder, ValueEncoding, decode_body, query_param, bit_order, value_encoding};
+use http::binary_handler::{encode_value, decode_values};
+
+pub fn cluster(req: &mut Request) -> IronResult<Response> {
+    // Only POSTed requests have values to start from
+    let req_body = match req.method {
+        Method::Post => Some(try!(decode_body::<Vec<Json>>(req))),
+        _ => None,
+    };
+    let order = match bit_order(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let encoding = match value_encoding(req, bits) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let radius = match query_param(req, "radius") {
+        Some(v) => match v.parse::<usize>() {
+            Ok(r) if r <= tolerance => r,
+            _ => return Ok(Response::with((status::BadRequest, format!("invalid radius '{}', expected at most {}", v, tolerance)))),
+        },
+        None => tolerance,
+    };
+
+    let min_size = match query_param(req, "min_size") {
+        Some(v) => match v.parse::<usize>() {
+            Ok(n) => n,
+            Err(e) => return Ok(Response::with((status::BadRequest, format!("invalid min_size '{}': {}", v, e)))),
+        },
+        None => 2,
+    };
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_cluster(req_body, encoding, order, tolerance, namespace, radius, min_size, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_cluster(req_body, encoding, order, tolerance, namespace, radius, min_size, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_cluster(req_body, encoding, order, tolerance, namespace, radius, min_size, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_cluster(req_body, encoding, order, tolerance, namespace, radius, min_size, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_cluster<T>(req_body: Option<Vec<Json>>, encoding: ValueEncoding, order: BitOrder, tolerance: usize, namespace: String, radius: usize, min_size: usize, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
+T: Clone + Eq + Hash + Encodable + Decodable + FromBits + Hamming,
+{
+    let db_mx = match { dbmap_mx.read().unwrap().get(&(tolerance, namespace)).cloned() } {
+        Some(db_mx) => db_mx,
+        None => return Ok(Response::with((status::NotFound, "DB not found"))),
+    };
+
+    // Writes wait until clustering is finished
+    let db = db_mx.read().unwrap();
+
+    let keys = match req_body {
+        Some(values) => match decode_values::<T>(values, encoding, order).into_iter().collect::<Result<Vec<T>, String>>() {
+            Ok(keys) => keys,
+            Err(e) => return Ok(Response::with((status::BadRequest, e))),
+        },
+        None => {
+            let mut keys = vec![];
+            let result = db.for_each(&mut |v| { keys.push(v.clone()); Ok(()) });
+            match result {
+                Ok(_) => keys,
+                Err(e) => return Ok(Response::with((status::NotFound, e))),
+            }
+        },
+    };
+
+    let clusters = single_linkage(&**db, keys, radius).into_iter()
+        .filter(|c| c.len() >= min_size)
+        .map(|c| c.iter().map(|v| encode_value(v)).collect::<Vec<String>>())
+        .collect::<Vec<Vec<String>>>();
+
+    let response_body = json::encode(&clusters).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
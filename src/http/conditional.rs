@@ -0,0 +1,91 @@
+//! Conditional query requests
+//!
+//! Query responses carry an `ETag` derived from their body.  A client
+//! repeating a query can send the tag it last received in `If-None-Match`,
+//! and gets a `304 Not Modified` with no body if the results are unchanged.
+//! The query still runs, but the matches aren't sent again.
+
+use std::io;
+use std::io::Write;
+use std::sync::Arc;
+
+use iron::prelude::*;
+use iron::{status, typemap, AfterMiddleware};
+use iron::headers::ContentLength;
+use iron::response::{WriteBody, ResponseBody};
+
+/// Body of a response made by `with_etag`, for middleware comparing query
+/// results (see `shadow`)
+///
+pub struct QueryBodyKey;
+impl typemap::Key for QueryBodyKey { type Value = Arc<String>; }
+
+/// A body shared with `QueryBodyKey`
+///
+struct SharedBody(Arc<String>);
+
+impl WriteBody for SharedBody {
+    fn write_body(&mut self, res: &mut ResponseBody) -> io::Result<()> {
+        res.write_all(self.0.as_bytes())
+    }
+}
+
+/// A 200 response with `body` and its `ETag`
+///
+pub fn with_etag(body: String) -> Response {
+    let etag = etag(&body);
+    let body = Arc::new(body);
+    let shared: Box<WriteBody + Send> = Box::new(SharedBody(body.clone()));
+    let mut res = Response::with((status::Ok, shared));
+    res.headers.set(ContentLength(body.len() as u64));
+    res.headers.set_raw("ETag", vec![etag.into_bytes()]);
+    res.extensions.insert::<QueryBodyKey>(body);
+    res
+}
+
+/// Quoted FNV-1a hash of `body`
+///
+fn etag(body: &str) -> String {
+    let hash = body.as_bytes().iter().fold(0xcbf29ce484222325u64, |hash, &byte| {
+        (hash ^ byte as u64).wrapping_mul(0x100000001b3)
+    });
+    format!("\"{:016x}\"", hash)
+}
+
+/// Whether an `If-None-Match` header value matches `etag`
+///
+fn matches(if_none_match: &str, etag: &str) -> bool {
+    if_none_match.split(',').map(|tag| tag.trim()).any(|tag| {
+        tag == "*" || tag == etag || (tag.starts_with("W/") && &tag[2..] == etag)
+    })
+}
+
+/// Replaces responses whose `ETag` the client already has with a 304
+///
+pub struct Conditional;
+
+impl AfterMiddleware for Conditional {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        let etag = match res.headers.get_raw("ETag") {
+            Some(values) if values.len() == 1 => Some(String::from_utf8_lossy(&values[0]).into_owned()),
+            _ => None,
+        };
+        let etag = match (res.status, etag) {
+            (Some(status::Ok), Some(etag)) => etag,
+            _ => return Ok(res),
+        };
+        let unchanged = match req.headers.get_raw("If-None-Match") {
+            Some(values) => values.iter().any(|v| matches(&String::from_utf8_lossy(v), &etag)),
+            None => false,
+        };
+
+        match unchanged {
+            true => {
+                let mut not_modified = Response::with(status::NotModified);
+                not_modified.headers.set_raw("ETag", vec![etag.into_bytes()]);
+                Ok(not_modified)
+            },
+            false => Ok(res),
+        }
+    }
+}
@@ -0,0 +1,81 @@
+//! Cross-origin resource sharing
+//!
+//! Lets browser-based tools served from other origins call the API.  Only
+//! requests from the configured origins (or any origin, with `*`) get CORS
+//! headers; browsers block other cross-origin requests as usual.  Preflight
+//! `OPTIONS` requests from allowed origins are answered directly.
+
+use iron::prelude::*;
+use iron::{status, AfterMiddleware};
+use iron::method::Method;
+
+pub struct Cors {
+    origins: Vec<String>,
+    methods: String,
+    headers: String,
+}
+
+impl Cors {
+    /// `origins` is a comma-separated list of origins, or `*`; `methods` and
+    /// `headers` are comma-separated lists returned to preflight requests
+    ///
+    pub fn new(origins: &str, methods: &str, headers: &str) -> Cors {
+        Cors{
+            origins: origins.split(',').map(|o| o.trim().to_string()).filter(|o| !o.is_empty()).collect(),
+            methods: methods.to_string(),
+            headers: headers.to_string(),
+        }
+    }
+
+    /// The request's origin, if it's allowed
+    ///
+    fn allowed_origin(&self, req: &Request) -> Option<String> {
+        let origin = match req.headers.get_raw("Origin") {
+            Some(values) if values.len() == 1 => String::from_utf8_lossy(&values[0]).into_owned(),
+            _ => return None,
+        };
+
+        match self.origins.iter().any(|o| o == "*" || *o == origin) {
+            true => Some(origin),
+            false => None,
+        }
+    }
+
+    fn add_headers(&self, origin: String, preflight: bool, res: &mut Response) {
+        res.headers.set_raw("Access-Control-Allow-Origin", vec![origin.into_bytes()]);
+        // Responses differ by origin, so caches mustn't share them
+        res.headers.set_raw("Vary", vec![b"Origin".to_vec()]);
+
+        if preflight {
+            res.headers.set_raw("Access-Control-Allow-Methods", vec![self.methods.clone().into_bytes()]);
+            res.headers.set_raw("Access-Control-Allow-Headers", vec![self.headers.clone().into_bytes()]);
+        }
+    }
+}
+
+impl AfterMiddleware for Cors {
+    fn after(&self, req: &mut Request, mut res: Response) -> IronResult<Response> {
+        match self.allowed_origin(req) {
+            Some(origin) => self.add_headers(origin, false, &mut res),
+            None => {},
+        }
+        Ok(res)
+    }
+
+    fn catch(&self, req: &mut Request, mut err: IronError) -> IronResult<Response> {
+        let origin = match self.allowed_origin(req) {
+            Some(origin) => origin,
+            None => return Err(err),
+        };
+
+        // There are no OPTIONS routes, so preflight requests end up here
+        if req.method == Method::Options {
+            let mut res = Response::with(status::Ok);
+            self.add_headers(origin, true, &mut res);
+            return Ok(res)
+        }
+
+        self.add_headers(origin, false, &mut err.response);
+        Err(err)
+    }
+}
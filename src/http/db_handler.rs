@@ -0,0 +1,172 @@
+use std::collections::{BTreeMap, HashMap};
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::status;
+use router::Router;
+use persistent::{Read, State};
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use hammer::db::Database;
+
+use http::{Config, ConfigKey, BOptions, DBOptions, B32, B64, B128, B256};
+use http::auth;
+use http::auth::Scope;
+use http::binary_handler::storage_backend;
+use http::changes::ChangeFeedKey;
+use http::upgrade::HandoffKey;
+use http::versions::Versions;
+
+/// List the binary DBs the request's token can read, as objects holding
+/// their bits, tolerance, namespace and version
+///
+pub fn list(req: &mut Request) -> IronResult<Response> {
+    let changes = req.get::<Read<ChangeFeedKey>>().unwrap();
+    let versions = changes.versions();
+    let b32 = req.get::<State<B32>>().unwrap();
+    let b64 = req.get::<State<B64>>().unwrap();
+    let b128 = req.get::<State<B128>>().unwrap();
+    let b256 = req.get::<State<B256>>().unwrap();
+
+    let readable = |namespace: &str| auth::allowed(req, namespace, Scope::Data);
+    let mut dbs = vec![];
+    list_dbs(32, b32, versions, &readable, &mut dbs);
+    list_dbs(64, b64, versions, &readable, &mut dbs);
+    list_dbs(128, b128, versions, &readable, &mut dbs);
+    list_dbs(256, b256, versions, &readable, &mut dbs);
+
+    let response_body = json::encode(&Json::Array(dbs)).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+fn list_dbs<T>(bits: usize, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>, versions: &Versions, readable: &Fn(&str) -> bool, dbs: &mut Vec<Json>) {
+    let mut keys: Vec<(usize, String)> = dbmap_mx.read().unwrap().keys().filter(|&&(_, ref namespace)| readable(&namespace[..])).cloned().collect();
+    keys.sort();
+
+    for (tolerance, namespace) in keys.into_iter() {
+        let mut d = BTreeMap::new();
+        d.insert("bits".to_string(), bits.to_json());
+        d.insert("tolerance".to_string(), tolerance.to_json());
+        d.insert("namespace".to_string(), namespace.to_json());
+        d.insert("version".to_string(), versions.get(&format!("b/{}/{}/{}", bits, tolerance, namespace)).to_json());
+        dbs.push(Json::Object(d));
+    }
+}
+
+/// Delete a binary DB, along with its options and on-disk data
+///
+pub fn destroy(req: &mut Request) -> IronResult<Response> {
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let handoff = req.get::<Read<HandoffKey>>().unwrap();
+    let _admitted = match handoff.admit_unjournaled() {
+        Ok(admitted) => admitted,
+        Err(e) => return Ok(Response::with((status::ServiceUnavailable, e))),
+    };
+    let config_mx = req.get::<State<ConfigKey>>().unwrap();
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_destroy(bits, tolerance, namespace, config_mx, options_mx, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_destroy(bits, tolerance, namespace, config_mx, options_mx, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_destroy(bits, tolerance, namespace, config_mx, options_mx, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_destroy(bits, tolerance, namespace, config_mx, options_mx, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_destroy<T>(bits: usize, tolerance: usize, namespace: String, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> {
+    let config = {
+        config_mx.read().unwrap().clone()
+    };
+
+    // Holding the DB map lock keeps the DB from being re-created while its
+    // data is being deleted
+    let mut dbmap = dbmap_mx.write().unwrap();
+
+    match dbmap.remove(&(tolerance, namespace.clone())) {
+        Some(db_mx) => {
+            // Some handlers use the DB under the map lock, which this
+            // excludes, but others (and background tasks) clone it out of the
+            // map and release the map lock first, so another reference means
+            // a write may still be on its way; the DB is put back rather than
+            // deleted under it.  No references can be taken while the map
+            // lock is held, so if this is the only one, nothing else can
+            // write to the DB before its data is gone.
+            match Arc::try_unwrap(db_mx) {
+                Ok(db) => drop(db),
+                Err(db_mx) => {
+                    dbmap.insert((tolerance, namespace), db_mx);
+                    return Ok(Response::with((status::ServiceUnavailable, "DB is in use, try again later")))
+                },
+            }
+        },
+        None => {},
+    }
+
+    options_mx.write().unwrap().remove(&(bits, tolerance, namespace.clone()));
+
+    match storage_backend(&config, bits, tolerance, &namespace).destroy() {
+        Ok(_) => Ok(Response::with((status::Ok, "\"ok\""))),
+        Err(e) => Ok(Response::with((status::InternalServerError, format!("unable to delete DB data: {}", e)))),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashMap;
+    use std::sync::{Arc, RwLock};
+
+    use iron::status;
+
+    use hammer::db::{Database, Factory, StorageBackend};
+
+    use http::Config;
+    use http::db_handler::do_destroy;
+
+    #[test]
+    fn dbs_in_use_are_not_destroyed() {
+        let config_mx = Arc::new(RwLock::new(Config::default()));
+        let options_mx = Arc::new(RwLock::new(HashMap::new()));
+        let db: Box<Database<u64>> = Factory::build(64, 4, StorageBackend::InMemory);
+        let db_mx = Arc::new(RwLock::new(db));
+        let dbmap_mx = Arc::new(RwLock::new(HashMap::new()));
+        dbmap_mx.write().unwrap().insert((4, "foo".to_string()), db_mx.clone());
+
+        // As held by a handler part way through a write
+        let response = do_destroy(64, 4, "foo".to_string(), config_mx.clone(), options_mx.clone(), dbmap_mx.clone()).unwrap();
+        assert_eq!(response.status, Some(status::ServiceUnavailable));
+        assert!(dbmap_mx.read().unwrap().contains_key(&(4, "foo".to_string())));
+
+        drop(db_mx);
+        let response = do_destroy(64, 4, "foo".to_string(), config_mx, options_mx, dbmap_mx.clone()).unwrap();
+        assert_eq!(response.status, Some(status::Ok));
+        assert!(dbmap_mx.read().unwrap().is_empty());
+    }
+}
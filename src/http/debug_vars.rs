@@ -0,0 +1,135 @@
+use std::collections::BTreeMap;
+use std::env;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use iron::prelude::*;
+use iron::{status, AfterMiddleware};
+use persistent::Read;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::metrics::{Metrics, MetricsKey};
+use http::memstats::MemStats;
+
+#[derive(Clone, Debug, Default)]
+struct OpTiming {
+    count: usize,
+    total_us: u64,
+    max_us: u64,
+}
+
+/// Per-endpoint request counts and per-operation DB timings
+///
+/// Reported at `/debug/vars` in the layout used by Go's `expvar` package, for
+/// monitoring which scrapes that rather than `/metrics`.
+///
+pub struct DebugVars {
+    requests: Mutex<BTreeMap<String, usize>>,
+    errors: Mutex<BTreeMap<String, usize>>,
+    db_ops: Mutex<BTreeMap<&'static str, OpTiming>>,
+}
+
+impl DebugVars {
+    pub fn new() -> DebugVars {
+        DebugVars{
+            requests: Mutex::new(BTreeMap::new()),
+            errors: Mutex::new(BTreeMap::new()),
+            db_ops: Mutex::new(BTreeMap::new()),
+        }
+    }
+
+    pub fn record_request(&self, endpoint: String, failed: bool) {
+        if failed {
+            *self.errors.lock().unwrap().entry(endpoint.clone()).or_insert(0) += 1;
+        }
+        *self.requests.lock().unwrap().entry(endpoint).or_insert(0) += 1;
+    }
+
+    pub fn record_op(&self, op: &'static str, elapsed: Duration) {
+        let us = elapsed.as_secs() * 1_000_000 + (elapsed.subsec_nanos() / 1000) as u64;
+
+        let mut db_ops = self.db_ops.lock().unwrap();
+        let timing = db_ops.entry(op).or_insert(OpTiming::default());
+        timing.count += 1;
+        timing.total_us += us;
+        if us > timing.max_us {
+            timing.max_us = us;
+        }
+    }
+}
+
+impl ToJson for DebugVars {
+    fn to_json(&self) -> Json {
+        let mut d = BTreeMap::new();
+
+        // expvar always publishes these two
+        d.insert("cmdline".to_string(), env::args().collect::<Vec<String>>().to_json());
+        d.insert("memstats".to_string(), match MemStats::read() {
+            Ok(stats) => {
+                let mut m = BTreeMap::new();
+                m.insert("resident_bytes".to_string(), stats.resident_bytes.to_json());
+                m.insert("virtual_bytes".to_string(), stats.virtual_bytes.to_json());
+                Json::Object(m)
+            },
+            Err(_) => Json::Null,
+        });
+
+        d.insert("requests".to_string(), self.requests.lock().unwrap().to_json());
+        d.insert("errors".to_string(), self.errors.lock().unwrap().to_json());
+
+        let db_ops = self.db_ops.lock().unwrap().iter().map(|(op, timing)| {
+            let mut t = BTreeMap::new();
+            t.insert("count".to_string(), timing.count.to_json());
+            t.insert("total_us".to_string(), timing.total_us.to_json());
+            t.insert("max_us".to_string(), timing.max_us.to_json());
+            (op.to_string(), Json::Object(t))
+        }).collect::<BTreeMap<String, Json>>();
+        d.insert("db_ops".to_string(), Json::Object(db_ops));
+
+        Json::Object(d)
+    }
+}
+
+/// Counts requests (and failed requests) by endpoint
+///
+/// Endpoints are named by the leading route segments, ie `query/b` for
+/// `/query/b/64/8/foo`.  Only requests which fail outright are counted as
+/// errors - per-value errors in a successful response aren't.
+///
+pub struct RequestCounter {
+    metrics: Arc<Metrics>,
+}
+
+impl RequestCounter {
+    pub fn new(metrics: Arc<Metrics>) -> RequestCounter {
+        RequestCounter{metrics: metrics}
+    }
+
+    fn endpoint(req: &Request) -> String {
+        req.url.path.iter().take(2).cloned().collect::<Vec<String>>().join("/")
+    }
+}
+
+impl AfterMiddleware for RequestCounter {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        let failed = match res.status {
+            Some(status) => !status.is_success(),
+            None => false,
+        };
+        self.metrics.debug_vars.record_request(RequestCounter::endpoint(req), failed);
+        Ok(res)
+    }
+
+    fn catch(&self, req: &mut Request, err: IronError) -> IronResult<Response> {
+        self.metrics.debug_vars.record_request(RequestCounter::endpoint(req), true);
+        Err(err)
+    }
+}
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let metrics = req.get::<Read<MetricsKey>>().unwrap();
+
+    let response_body = json::encode(&metrics.debug_vars.to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
@@ -0,0 +1,100 @@
+//! Duplicate report
+//!
+//! `hammerhttp dedup-report` asks a running server to join a namespace with
+//! itself (see `join_handler`), and writes each pair of duplicates once, with
+//! the distance between them:
+//!
+//! ```text
+//! AAAAAAAAAAE=	AAAAAAAAAAM=	1
+//! ```
+//!
+//! Duplicates are found by querying the database's partitions with each
+//! stored value, so the work grows with the number of values and their
+//! duplicates rather than with the number of pairs of values.
+
+use std::collections::HashSet;
+use std::fs::File;
+use std::io;
+use std::io::{BufRead, BufReader, Write};
+use std::net::TcpStream;
+
+use rustc_serialize::base64::FromBase64;
+use rustc_serialize::json;
+
+use http::loader::get;
+
+/// Summary of a report
+///
+pub struct Summary {
+    /// Number of pairs of duplicates
+    pub pairs: usize,
+    /// Number of values with at least one duplicate
+    pub values: usize,
+}
+
+/// Write the duplicates in `b/:bits/:tolerance/:namespace` on `server` to
+/// `output` (or stdout)
+///
+pub fn run(server: &str, bits: usize, tolerance: usize, namespace: &str, output: Option<&str>) -> Result<Summary, String> {
+    let mut out: Box<Write> = match output {
+        Some(path) => match File::create(path) {
+            Ok(f) => Box::new(io::BufWriter::new(f)),
+            Err(e) => return Err(format!("unable to create '{}': {}", path, e)),
+        },
+        None => Box::new(io::stdout()),
+    };
+
+    let path = format!("/join/b/{}/{}/{}/{}", bits, tolerance, namespace, namespace);
+    let lines = try!(get_lines(server, &path));
+
+    let mut summary = Summary{pairs: 0, values: 0};
+    let mut seen = HashSet::new();
+    for line in lines {
+        let line = match line {
+            Ok(line) => line,
+            Err(e) => return Err(format!("unable to read response: {}", e)),
+        };
+        let (a, b) = match json::decode::<(String, String)>(&line) {
+            Ok(pair) => pair,
+            Err(e) => return Err(format!("unexpected response line '{}': {}", line, e)),
+        };
+
+        // The self-join reports each pair in both orders
+        if a > b {
+            continue
+        }
+
+        let d = try!(distance(&a, &b));
+        match writeln!(out, "{}\t{}\t{}", a, b, d) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to write report: {}", e)),
+        }
+
+        summary.pairs += 1;
+        for v in vec![a, b].into_iter() {
+            if seen.insert(v) {
+                summary.values += 1;
+            }
+        }
+    }
+
+    match out.flush() {
+        Ok(_) => Ok(summary),
+        Err(e) => Err(format!("unable to write report: {}", e)),
+    }
+}
+
+/// Lines of the body of `GET path`
+///
+fn get_lines(server: &str, path: &str) -> Result<io::Lines<BufReader<TcpStream>>, String> {
+    Ok(try!(get(server, path)).lines())
+}
+
+/// Hamming distance between two base64-encoded values
+///
+fn distance(a: &str, b: &str) -> Result<u32, String> {
+    match (a.from_base64(), b.from_base64()) {
+        (Ok(a), Ok(b)) => Ok(a.iter().zip(b.iter()).fold(0, |d, (x, y)| d + (x ^ y).count_ones())),
+        _ => Err(format!("unable to base64-decode '{}' or '{}'", a, b)),
+    }
+}
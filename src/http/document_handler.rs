@@ -0,0 +1,271 @@
+//! Multi-value documents, see `hammer::db::documents`
+//!
+//! Documents are arrays of base64-encoded values.  Queries return the stored
+//! documents holding values within tolerance of at least `min_matches` of the
+//! queried document's values (by default, all of them).
+
+use std::collections::HashMap;
+use std::hash::Hash;
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::status;
+use router::Router;
+use persistent::State;
+use rustc_serialize::json;
+use rustc_serialize::{Encodable, Decodable};
+use rustc_serialize::json::{ToJson, Json};
+
+use hammer::db::{Database, Factory, StorageBackend};
+use hammer::db::documents::Documents;
+use hammer::hyperplane::FromBits;
+
+use http::{D32, D64, D128, D256, BitOrder, ValueEncoding, decode_body, query_param, response_budget, encoded_size, ResponseBudget, AddResult, QueryResult, DeleteResult};
+use http::binary_handler::{encode_value, decode_values};
+use http::conditional;
+
+type DocumentMap<T> = Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Documents<T>>>>>>;
+
+fn decode_document<T: Decodable + FromBits>(document: Vec<String>) -> Result<Vec<T>, String> {
+    decode_values(document.into_iter().map(|v| Json::String(v)).collect(), ValueEncoding::Base64, BitOrder::MsbFirst)
+        .into_iter()
+        .collect()
+}
+
+pub fn add(req: &mut Request) -> IronResult<Response> {
+    let req_body = try!(decode_body::<Vec<Vec<String>>>(req));
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    match bits {
+        32 => {
+            let docmap_mx = req.get::<State<D32>>().unwrap();
+            do_add(req_body, bits, tolerance, namespace, docmap_mx)
+        },
+        64 => {
+            let docmap_mx = req.get::<State<D64>>().unwrap();
+            do_add(req_body, bits, tolerance, namespace, docmap_mx)
+        },
+        128 => {
+            let docmap_mx = req.get::<State<D128>>().unwrap();
+            do_add(req_body, bits, tolerance, namespace, docmap_mx)
+        },
+        256 => {
+            let docmap_mx = req.get::<State<D256>>().unwrap();
+            do_add(req_body, bits, tolerance, namespace, docmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_add<T>(req_body: Vec<Vec<String>>, bits: usize, tolerance: usize, namespace: String, docmap_mx: DocumentMap<T>) -> IronResult<Response> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Decodable + FromBits + Factory,
+{
+    let docs_mx = {
+        docmap_mx.write().unwrap()
+            .entry((tolerance, namespace))
+            .or_insert_with(|| {
+                let values: Box<Database<T>> = Factory::build(bits, tolerance, StorageBackend::InMemory);
+                Arc::new(RwLock::new(Documents::new(values)))
+            })
+            .clone()
+    };
+    let mut docs = docs_mx.write().unwrap();
+
+    let results = req_body.into_iter().map(|document| {
+        match decode_document(document) {
+            Ok(document) => match docs.insert(document) {
+                true => AddResult::Ok,
+                false => AddResult::Exists,
+            },
+            Err(e) => AddResult::Err(e),
+        }
+    }).collect::<Vec<AddResult>>();
+
+    let response_body = json::encode(&results.to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+pub fn query(req: &mut Request) -> IronResult<Response> {
+    let req_body = try!(decode_body::<Vec<Vec<String>>>(req));
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    // None requires every value to match
+    let min_matches = match query_param(req, "min_matches") {
+        Some(v) => match v.parse::<usize>() {
+            Ok(0) | Err(_) => return Ok(Response::with((status::BadRequest, format!("invalid min_matches '{}'", v)))),
+            Ok(n) => Some(n),
+        },
+        None => None,
+    };
+
+    let budget = match response_budget(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    match bits {
+        32 => {
+            let docmap_mx = req.get::<State<D32>>().unwrap();
+            do_query(req_body, tolerance, namespace, min_matches, budget, docmap_mx)
+        },
+        64 => {
+            let docmap_mx = req.get::<State<D64>>().unwrap();
+            do_query(req_body, tolerance, namespace, min_matches, budget, docmap_mx)
+        },
+        128 => {
+            let docmap_mx = req.get::<State<D128>>().unwrap();
+            do_query(req_body, tolerance, namespace, min_matches, budget, docmap_mx)
+        },
+        256 => {
+            let docmap_mx = req.get::<State<D256>>().unwrap();
+            do_query(req_body, tolerance, namespace, min_matches, budget, docmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_query<T>(req_body: Vec<Vec<String>>, tolerance: usize, namespace: String, min_matches: Option<usize>, mut budget: ResponseBudget, docmap_mx: DocumentMap<T>) -> IronResult<Response> where
+T: Clone + Eq + Hash + Encodable + Decodable + FromBits,
+{
+    let mut results = Vec::with_capacity(req_body.len());
+
+    match { docmap_mx.read().unwrap().get(&(tolerance, namespace)).cloned() } {
+        None => {
+            for _ in 0..req_body.len() {
+                results.push(QueryResult::None);
+            }
+        },
+        Some(docs_mx) => {
+            let docs = docs_mx.read().unwrap();
+
+            for document in req_body.into_iter() {
+                let document: Vec<T> = match decode_document(document) {
+                    Ok(v) => v,
+                    Err(e) => {
+                        results.push(QueryResult::Err(e));
+                        continue
+                    },
+                };
+
+                let min_matches = match min_matches {
+                    Some(n) => n,
+                    None => document.len(),
+                };
+
+                match docs.get(&document, min_matches) {
+                    Some(found) => {
+                        let mut found_b64s: Vec<Vec<String>> = found.iter()
+                            .map(|d| d.iter().map(|v| encode_value(v)).collect())
+                            .collect();
+                        found_b64s.sort();
+
+                        let (found_b64s, truncated) = budget.take(found_b64s, |d: &Vec<String>| {
+                            // Brackets and separator
+                            d.iter().fold(3, |size, v| size + encoded_size(v))
+                        });
+
+                        match truncated {
+                            true => results.push(QueryResult::Detailed{matches: found_b64s, overflowed: false, truncated: true, partitions: None, diffs: None}),
+                            false => results.push(QueryResult::Ok(found_b64s)),
+                        }
+                    },
+                    None => results.push(QueryResult::None),
+                }
+            }
+        },
+    }
+
+    let response_body = json::encode(&results.to_json()).unwrap();
+    Ok(conditional::with_etag(response_body))
+}
+
+pub fn delete(req: &mut Request) -> IronResult<Response> {
+    let req_body = try!(decode_body::<Vec<Vec<String>>>(req));
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    match bits {
+        32 => {
+            let docmap_mx = req.get::<State<D32>>().unwrap();
+            do_delete(req_body, tolerance, namespace, docmap_mx)
+        },
+        64 => {
+            let docmap_mx = req.get::<State<D64>>().unwrap();
+            do_delete(req_body, tolerance, namespace, docmap_mx)
+        },
+        128 => {
+            let docmap_mx = req.get::<State<D128>>().unwrap();
+            do_delete(req_body, tolerance, namespace, docmap_mx)
+        },
+        256 => {
+            let docmap_mx = req.get::<State<D256>>().unwrap();
+            do_delete(req_body, tolerance, namespace, docmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_delete<T>(req_body: Vec<Vec<String>>, tolerance: usize, namespace: String, docmap_mx: DocumentMap<T>) -> IronResult<Response> where
+T: Clone + Eq + Hash + Decodable + FromBits,
+{
+    let results = match { docmap_mx.read().unwrap().get(&(tolerance, namespace)).cloned() } {
+        None => req_body.iter().map(|_| DeleteResult::NotFound).collect::<Vec<DeleteResult>>(),
+        Some(docs_mx) => {
+            let mut docs = docs_mx.write().unwrap();
+
+            req_body.into_iter().map(|document| {
+                match decode_document(document) {
+                    Ok(document) => match docs.remove(&document) {
+                        true => DeleteResult::Ok,
+                        false => DeleteResult::NotFound,
+                    },
+                    Err(e) => DeleteResult::Err(e),
+                }
+            }).collect::<Vec<DeleteResult>>()
+        },
+    };
+
+    let response_body = json::encode(&results.to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
@@ -0,0 +1,499 @@
+//! Namespace export & import
+//!
+//! `GET /dump/:namespace` returns every binary DB in the namespace, with its
+//! options and values, as an archive.  `POST /load/:namespace` recreates the
+//! DBs from an archive, possibly on another server or under another
+//! namespace.  Restore progress is reported by `/admin/recovery`.
+//!
+//! Archives are newline-delimited JSON: a header line with the format
+//! version and each DB's bits, tolerance, options and number of values, then
+//! a line for each batch of `RESTORE_BATCH` values with its CRC32C checksum.
+//! When loading, values from the first batch whose checksum doesn't match
+//! onwards are skipped and reported as `corrupt`, rather than loading
+//! whatever a damaged archive decodes to.  An archive which was cut short is
+//! read up to its first incomplete line, and the values missing from the end
+//! are counted as corrupt too.
+//!
+//! With `--encryption-key`, each line is encrypted (see `encryption`), and
+//! a line which doesn't decrypt ends the archive like one which doesn't
+//! parse.
+
+use std::cmp;
+use std::collections::{BTreeMap, HashMap};
+use std::hash::Hash;
+use std::mem;
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::status;
+use router::Router;
+use persistent::{Read, State};
+use rustc_serialize::json;
+use rustc_serialize::{Encodable, Decodable};
+use rustc_serialize::json::{ToJson, Json};
+
+use hammer::db::{Database, Factory};
+use hammer::db::hamming::Hamming;
+use hammer::db::normalize::{BitMask, Rotate};
+use hammer::hyperplane::FromBits;
+
+use http::{Config, ConfigKey, BOptions, DBOptions, B32, B64, B128, B256, BitOrder, ValueEncoding, AddResult, read_body};
+use http::binary_handler::{encode_value, decode_values, add_values};
+use http::changes::{ChangeFeed, ChangeFeedKey};
+use http::encryption;
+use http::encryption::{Cipher, CipherKey};
+use http::metrics::{Metrics, MetricsKey};
+use http::recovery::{Recovery, RecoveryKey};
+use http::upgrade::{Handoff, HandoffKey};
+use http::sink::{Mirror, MirrorKey};
+
+/// Values are restored (and progress reported, and checksummed) in batches
+/// of this many
+const RESTORE_BATCH: usize = 1000;
+
+/// Format version of the archives written by `dump`
+pub const ARCHIVE_VERSION: u32 = 2;
+
+/// An archive, as dumped or loaded
+///
+#[derive(Debug)]
+pub struct Archive {
+    pub version: u32,
+    pub namespace: String,
+    pub databases: Vec<ArchivedDB>,
+}
+
+#[derive(Debug)]
+pub struct ArchivedDB {
+    pub bits: usize,
+    pub tolerance: usize,
+    pub options: DBOptions,
+    /// Base64-encoded values, as stored (i.e. after normalization)
+    pub values: Vec<String>,
+    /// CRC32C of each batch of values (see `checksum`)
+    pub checksums: Vec<u32>,
+    /// Number of values dumped, more than `values` if the archive was cut
+    /// short
+    pub count: usize,
+}
+
+impl ArchivedDB {
+    /// A DB holding all of `values`, as dumped
+    ///
+    pub fn new(bits: usize, tolerance: usize, options: DBOptions, values: Vec<String>) -> ArchivedDB {
+        let checksums = values.chunks(RESTORE_BATCH).map(checksum).collect();
+        let count = values.len();
+        ArchivedDB{bits: bits, tolerance: tolerance, options: options, values: values, checksums: checksums, count: count}
+    }
+}
+
+/// First line of an archive
+///
+#[derive(RustcDecodable, RustcEncodable)]
+struct Header {
+    version: u32,
+    namespace: String,
+    databases: Vec<DBHeader>,
+}
+
+#[derive(RustcDecodable, RustcEncodable)]
+struct DBHeader {
+    bits: usize,
+    tolerance: usize,
+    options: DBOptions,
+    count: usize,
+}
+
+/// Each line after the header
+///
+#[derive(RustcDecodable, RustcEncodable)]
+struct Batch {
+    /// Position of the batch's DB in the header
+    db: usize,
+    checksum: u32,
+    values: Vec<String>,
+}
+
+pub fn dump(req: &mut Request) -> IronResult<Response> {
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let mut databases = vec![];
+
+    let dbmap_mx = req.get::<State<B32>>().unwrap();
+    match dump_dbs(32, &namespace, options_mx.clone(), dbmap_mx, &mut databases) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::InternalServerError, e))),
+    }
+    let dbmap_mx = req.get::<State<B64>>().unwrap();
+    match dump_dbs(64, &namespace, options_mx.clone(), dbmap_mx, &mut databases) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::InternalServerError, e))),
+    }
+    let dbmap_mx = req.get::<State<B128>>().unwrap();
+    match dump_dbs(128, &namespace, options_mx.clone(), dbmap_mx, &mut databases) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::InternalServerError, e))),
+    }
+    let dbmap_mx = req.get::<State<B256>>().unwrap();
+    match dump_dbs(256, &namespace, options_mx.clone(), dbmap_mx, &mut databases) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::InternalServerError, e))),
+    }
+
+    if databases.is_empty() {
+        return Ok(Response::with((status::NotFound, "Namespace not found")))
+    }
+
+    let archive = Archive{version: ARCHIVE_VERSION, namespace: namespace, databases: databases};
+    let cipher = req.get::<Read<CipherKey>>().unwrap();
+    Ok(Response::with((status::Ok, write_archive(&archive, &cipher))))
+}
+
+/// `archive` as a header line followed by a line per batch of values, each
+/// sealed with `cipher` if there is one
+///
+fn write_archive(archive: &Archive, cipher: &Option<Cipher>) -> String {
+    let header = Header{
+        version: ARCHIVE_VERSION,
+        namespace: archive.namespace.clone(),
+        databases: archive.databases.iter().map(|db| DBHeader{bits: db.bits, tolerance: db.tolerance, options: db.options.clone(), count: db.values.len()}).collect(),
+    };
+
+    let mut out = encryption::seal(cipher, json::encode(&header).unwrap(), 0);
+    out.push('\n');
+    let mut line = 1;
+    for (i, db) in archive.databases.iter().enumerate() {
+        for batch in db.values.chunks(RESTORE_BATCH) {
+            out.push_str(&encryption::seal(cipher, json::encode(&Batch{db: i, checksum: checksum(batch), values: batch.to_vec()}).unwrap(), line));
+            out.push('\n');
+            line += 1;
+        }
+    }
+    out
+}
+
+/// Parse an archive
+///
+/// Batches are read up to the first line which can't be opened with
+/// `cipher` or parsed (i.e. where an archive was cut short), leaving the DBs
+/// short of their `count`.  An archive whose header was sealed must be
+/// sealed throughout.
+///
+pub fn parse_archive(body: &str, cipher: &Option<Cipher>) -> Result<Archive, String> {
+    let mut lines = body.lines();
+    let first = match lines.next() {
+        Some(first) => first,
+        None => return Err("the archive is empty".to_string()),
+    };
+    let sealed = encryption::sealed(first);
+    let header = match encryption::open(cipher, first, 0) {
+        Ok(header) => header,
+        Err(e) => return Err(format!("unable to read the archive's header: {}", e)),
+    };
+    let header = match json::decode::<Header>(&header) {
+        Ok(header) => header,
+        Err(e) => return Err(format!("unable to parse the archive's header: {}", e)),
+    };
+
+    let mut databases: Vec<ArchivedDB> = header.databases.into_iter().map(|db| {
+        ArchivedDB{bits: db.bits, tolerance: db.tolerance, options: db.options, values: vec![], checksums: vec![], count: db.count}
+    }).collect();
+
+    for (i, line) in lines.enumerate() {
+        if encryption::sealed(line) != sealed {
+            break
+        }
+        let line = match encryption::open(cipher, line, i as u64 + 1) {
+            Ok(line) => line,
+            Err(_) => break,
+        };
+        let batch = match json::decode::<Batch>(&line) {
+            Ok(batch) => batch,
+            Err(_) => break,
+        };
+        match databases.get_mut(batch.db) {
+            Some(db) => {
+                db.values.extend(batch.values.into_iter());
+                db.checksums.push(batch.checksum);
+            },
+            None => break,
+        }
+    }
+
+    Ok(Archive{version: header.version, namespace: header.namespace, databases: databases})
+}
+
+fn dump_dbs<T: Clone + Encodable>(bits: usize, namespace: &String, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>, databases: &mut Vec<ArchivedDB>) -> Result<(), String> {
+    let mut dbs = {
+        dbmap_mx.read().unwrap().iter()
+            .filter(|&(&(_, ref ns), _)| ns == namespace)
+            .map(|(&(tolerance, _), db_mx)| (tolerance, db_mx.clone()))
+            .collect::<Vec<(usize, Arc<RwLock<Box<Database<T>>>>)>>()
+    };
+    dbs.sort_by_key(|&(tolerance, _)| tolerance);
+
+    for (tolerance, db_mx) in dbs.into_iter() {
+        let options = match options_mx.read().unwrap().get(&(bits, tolerance, namespace.clone())) {
+            Some(options) => options.clone(),
+            None => DBOptions::default(),
+        };
+
+        // As with /keys, values are copied out under the read lock
+        let mut values = vec![];
+        try!(db_mx.read().unwrap().for_each(&mut |v| { values.push(encode_value(v)); Ok(()) }));
+
+        databases.push(ArchivedDB::new(bits, tolerance, options, values));
+    }
+
+    Ok(())
+}
+
+pub fn load(req: &mut Request) -> IronResult<Response> {
+    let cipher = req.get::<Read<CipherKey>>().unwrap();
+    let archive = match parse_archive(&try!(read_body(req)), &cipher) {
+        Ok(archive) => archive,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let config_mx = req.get::<State<ConfigKey>>().unwrap();
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let changes = req.get::<Read<ChangeFeedKey>>().unwrap();
+    let metrics = req.get::<Read<MetricsKey>>().unwrap();
+    let mirror = req.get::<Read<MirrorKey>>().unwrap();
+    let handoff = req.get::<Read<HandoffKey>>().unwrap();
+    let _admitted = match handoff.admit_unjournaled() {
+        Ok(admitted) => admitted,
+        Err(e) => return Ok(Response::with((status::ServiceUnavailable, e))),
+    };
+    let recovery = req.get::<Read<RecoveryKey>>().unwrap();
+    let b32 = req.get::<State<B32>>().unwrap();
+    let b64 = req.get::<State<B64>>().unwrap();
+    let b128 = req.get::<State<B128>>().unwrap();
+    let b256 = req.get::<State<B256>>().unwrap();
+
+    match restore(archive, namespace, config_mx, options_mx, changes, metrics, mirror, handoff.clone(), &recovery, b32, b64, b128, b256) {
+        Ok(loaded) => {
+            let response_body = json::encode(&loaded).unwrap();
+            Ok(Response::with((status::Ok, response_body)))
+        },
+        Err((status, e)) => Ok(Response::with((status, e))),
+    }
+}
+
+/// Recreate the DBs in `archive` under `namespace`, returning a summary of
+/// the values added to each
+///
+pub fn restore(archive: Archive, namespace: String, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, mirror: Arc<Option<Mirror>>, handoff: Arc<Handoff>, recovery: &Recovery, b32: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u32>>>>>>>, b64: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>>, b128: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 2]>>>>>>>, b256: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>>>) -> Result<Json, (status::Status, String)> {
+    if archive.version > ARCHIVE_VERSION {
+        return Err((status::BadRequest, format!("archive format version {} is newer than this server supports ({})", archive.version, ARCHIVE_VERSION)))
+    }
+
+    // Nothing is loaded unless every DB can be
+    for db in archive.databases.iter() {
+        let exists = match db.bits {
+            32 => b32.read().unwrap().contains_key(&(db.tolerance, namespace.clone())),
+            64 => b64.read().unwrap().contains_key(&(db.tolerance, namespace.clone())),
+            128 => b128.read().unwrap().contains_key(&(db.tolerance, namespace.clone())),
+            256 => b256.read().unwrap().contains_key(&(db.tolerance, namespace.clone())),
+            _ => return Err((status::BadRequest, format!("Unsuported bitsize {}", db.bits))),
+        };
+        if exists || options_mx.read().unwrap().contains_key(&(db.bits, db.tolerance, namespace.clone())) {
+            return Err((status::Conflict, format!("b/{}/{}/{} already exists", db.bits, db.tolerance, namespace)))
+        }
+    }
+
+    // Every DB is reported up front, so readiness checks don't pass between
+    // DBs
+    let db_names: Vec<String> = archive.databases.iter().map(|db| format!("b/{}/{}/{}", db.bits, db.tolerance, namespace)).collect();
+    for (db, db_name) in archive.databases.iter().zip(db_names.iter()) {
+        let bytes = db.values.iter().fold(0, |n, v| n + v.len());
+        recovery.start(db_name.clone(), db.values.len(), bytes);
+    }
+
+    let mut loaded = BTreeMap::new();
+    for db in archive.databases.into_iter() {
+        let db_name = format!("b/{}/{}/{}", db.bits, db.tolerance, namespace);
+        let result = match db.bits {
+            32 => load_db(db, namespace.clone(), config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), mirror.clone(), handoff.clone(), recovery, b32.clone()),
+            64 => load_db(db, namespace.clone(), config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), mirror.clone(), handoff.clone(), recovery, b64.clone()),
+            128 => load_db(db, namespace.clone(), config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), mirror.clone(), handoff.clone(), recovery, b128.clone()),
+            256 => load_db(db, namespace.clone(), config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), mirror.clone(), handoff.clone(), recovery, b256.clone()),
+            _ => unreachable!(),
+        };
+        recovery.finish(&db_name);
+
+        match result {
+            Ok((results, corrupt)) => { loaded.insert(db_name, summarize(&results, corrupt)); },
+            Err(e) => {
+                for db_name in db_names.iter() {
+                    recovery.finish(db_name);
+                }
+                return Err((status::BadRequest, format!("unable to load {}: {}", db_name, e)))
+            },
+        }
+    }
+
+    Ok(Json::Object(loaded))
+}
+
+/// Loads the values of `db` which pass their checksums, returning their
+/// results and the number of values skipped as corrupt
+///
+fn load_db<T>(mut db: ArchivedDB, namespace: String, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, mirror: Arc<Option<Mirror>>, handoff: Arc<Handoff>, recovery: &Recovery, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> Result<(Vec<AddResult>, usize), String> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Factory + Encodable + Decodable + FromBits + Hamming + BitMask + Rotate,
+{
+    try!(db.options.validate::<T>(db.bits));
+
+    // Archived values are already normalized; undo the rotation so that
+    // normalizing them again on insert restores the archived value (masking
+    // is idempotent)
+    let unrotate = match db.options.rotate {
+        Some(n) => (db.bits as u32 - n % db.bits as u32) % db.bits as u32,
+        None => 0,
+    };
+    let db_name = format!("b/{}/{}/{}", db.bits, db.tolerance, namespace);
+
+    let intact = intact_len(&db);
+    let corrupt = corrupt_len(&db);
+    if corrupt > 0 {
+        log!("WARNING: skipping {} corrupt or missing values at the end of {} in the archive", corrupt, db_name);
+        db.values.truncate(intact);
+    }
+
+    let sizes: Vec<usize> = db.values.iter().map(|v| v.len()).collect();
+    let mut values: Vec<Result<T, String>> = decode_values::<T>(db.values.into_iter().map(|v| Json::String(v)).collect(), ValueEncoding::Base64, BitOrder::MsbFirst)
+        .into_iter()
+        .map(|v| v.map(|v| if unrotate == 0 { v } else { v.rotate(unrotate) }))
+        .collect();
+
+    options_mx.write().unwrap().insert((db.bits, db.tolerance, namespace.clone()), db.options);
+
+    let mut results = Vec::with_capacity(values.len());
+    while !values.is_empty() {
+        let rest = match values.len() > RESTORE_BATCH {
+            true => values.split_off(RESTORE_BATCH),
+            false => vec![],
+        };
+        let batch = mem::replace(&mut values, rest);
+        let batch_len = batch.len();
+        let batch_bytes = sizes[results.len()..results.len() + batch_len].iter().fold(0, |n, s| n + s);
+
+        let mut batch_results = try!(add_values(batch, db.bits, db.tolerance, namespace.clone(), config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), mirror.clone(), handoff.clone(), dbmap_mx.clone()));
+        results.append(&mut batch_results);
+        recovery.applied(&db_name, batch_len, batch_bytes);
+    }
+
+    Ok((results, corrupt))
+}
+
+/// Number of values in `db` before the first batch failing its checksum
+///
+fn intact_len(db: &ArchivedDB) -> usize {
+    let mut intact = 0;
+    for (i, batch) in db.values.chunks(RESTORE_BATCH).enumerate() {
+        match db.checksums.get(i) {
+            Some(&expected) if expected == checksum(batch) => intact += batch.len(),
+            _ => break,
+        }
+    }
+    intact
+}
+
+/// Number of values in `db` from the first batch failing its checksum on,
+/// including any missing from the end of an archive which was cut short
+///
+fn corrupt_len(db: &ArchivedDB) -> usize {
+    cmp::max(db.count, db.values.len()) - intact_len(db)
+}
+
+/// CRC32C of a batch of encoded values, each followed by a newline
+///
+fn checksum(values: &[String]) -> u32 {
+    let mut crc = !0u32;
+    for value in values.iter() {
+        for &byte in value.as_bytes().iter().chain(b"\n".iter()) {
+            crc ^= byte as u32;
+            for _ in 0..8 {
+                crc = match crc & 1 {
+                    1 => (crc >> 1) ^ 0x82f63b78,
+                    _ => crc >> 1,
+                };
+            }
+        }
+    }
+    !crc
+}
+
+fn summarize(results: &Vec<AddResult>, corrupt: usize) -> Json {
+    let (mut added, mut exists, mut errors) = (0usize, 0usize, 0usize);
+    for result in results.iter() {
+        match result {
+            &AddResult::Ok => added += 1,
+            &AddResult::Exists => exists += 1,
+            &AddResult::Err(_) => errors += 1,
+        }
+    }
+
+    let mut d = BTreeMap::new();
+    d.insert("added".to_string(), added.to_json());
+    d.insert("exists".to_string(), exists.to_json());
+    d.insert("errors".to_string(), errors.to_json());
+    d.insert("corrupt".to_string(), corrupt.to_json());
+    Json::Object(d)
+}
+
+#[cfg(test)]
+mod test {
+    use http::DBOptions;
+    use http::dump_handler::{Archive, ArchivedDB, ARCHIVE_VERSION, RESTORE_BATCH, write_archive, parse_archive, intact_len, corrupt_len};
+    use http::encryption::Cipher;
+
+    fn archive() -> Archive {
+        let values: Vec<String> = (0..RESTORE_BATCH * 3).map(|i| format!("{:08}", i)).collect();
+        let db = ArchivedDB::new(64, 8, DBOptions::default(), values);
+        Archive{version: ARCHIVE_VERSION, namespace: "foo".to_string(), databases: vec![db]}
+    }
+
+    #[test]
+    fn truncated_archives_load_up_to_the_cut() {
+        let written = write_archive(&archive(), &None);
+
+        // Cut part way through the last batch
+        let archive = parse_archive(&written[..written.len() - RESTORE_BATCH * 5], &None).unwrap();
+        let db = &archive.databases[0];
+        assert_eq!(db.values.len(), RESTORE_BATCH * 2);
+        assert_eq!(intact_len(db), RESTORE_BATCH * 2);
+        assert_eq!(corrupt_len(db), RESTORE_BATCH);
+
+        // Without the header, nothing can be loaded
+        assert!(parse_archive(&written[..10], &None).is_err());
+    }
+
+    #[test]
+    fn sealed_archives_need_the_key() {
+        let cipher = Some(Cipher::new(vec![1; 32]).unwrap());
+        let written = write_archive(&archive(), &cipher);
+        assert!(!written.contains("00000001"));
+
+        let archive = parse_archive(&written, &cipher).unwrap();
+        assert_eq!(intact_len(&archive.databases[0]), RESTORE_BATCH * 3);
+        assert!(parse_archive(&written, &None).is_err());
+        assert!(parse_archive(&written, &Some(Cipher::new(vec![2; 32]).unwrap())).is_err());
+
+        // Batches can't be reordered
+        let mut lines: Vec<&str> = written.lines().collect();
+        lines.swap(1, 2);
+        let archive = parse_archive(&lines.join("\n"), &cipher).unwrap();
+        assert_eq!(archive.databases[0].values.len(), 0);
+        assert_eq!(corrupt_len(&archive.databases[0]), RESTORE_BATCH * 3);
+    }
+}
@@ -0,0 +1,184 @@
+//! Encryption at rest
+//!
+//! With `--encryption-key=<path>`, dump archives and the state saved under
+//! `--data-dir` (`standby.json` and `fencing.json`) are encrypted with
+//! AES-256-GCM, using the key in that file: 64 hex digits, i.e. from
+//! `openssl rand -hex 32`.  Each line of an archive is sealed on its own,
+//! with its line number authenticated alongside, so lines can't be reordered
+//! and an archive which was cut short still loads up to the cut (a line
+//! which doesn't decrypt is treated like one which doesn't parse).
+//!
+//! Sealed text is the base64 of a random nonce, the ciphertext and its tag,
+//! so it's told apart from the JSON it replaces by its first character.
+//! Archives and files written without a key still load with one, so a key
+//! can be added to an existing deployment; sealed ones don't load without
+//! it.  Servers copying DBs from each other (standbys and upgrades) must
+//! share the key.  The DBs themselves aren't encrypted by the server.
+
+use std::fs::File;
+use std::io::Read;
+use std::sync::Mutex;
+
+use crypto::aead::{AeadEncryptor, AeadDecryptor};
+use crypto::aes::KeySize;
+use crypto::aes_gcm::AesGcm;
+use iron::typemap;
+use rand::{OsRng, Rng};
+use rustc_serialize::base64::{FromBase64, ToBase64};
+use rustc_serialize::hex::FromHex;
+
+use http::BASE64_CONFIG;
+
+const KEY_BYTES: usize = 32;
+const NONCE_BYTES: usize = 12;
+const TAG_BYTES: usize = 16;
+
+pub struct CipherKey;
+impl typemap::Key for CipherKey { type Value = Option<Cipher>; }
+
+pub struct Cipher {
+    key: Vec<u8>,
+    /// Nonces are random, so they're drawn from the OS
+    rng: Mutex<OsRng>,
+}
+
+impl Cipher {
+    pub fn new(key: Vec<u8>) -> Result<Cipher, String> {
+        if key.len() != KEY_BYTES {
+            return Err(format!("encryption keys are {} bytes", KEY_BYTES))
+        }
+        match OsRng::new() {
+            Ok(rng) => Ok(Cipher{key: key, rng: Mutex::new(rng)}),
+            Err(e) => Err(format!("unable to open the OS's random number generator: {}", e)),
+        }
+    }
+
+    /// The cipher using the key in the file at `path`
+    ///
+    pub fn load(path: &str) -> Result<Cipher, String> {
+        let mut contents = String::new();
+        match File::open(path).and_then(|mut f| f.read_to_string(&mut contents)) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to read encryption key '{}': {}", path, e)),
+        }
+
+        match contents.trim().from_hex() {
+            Ok(key) => Cipher::new(key).map_err(|e| format!("encryption key '{}' is invalid: {}", path, e)),
+            Err(e) => Err(format!("encryption key '{}' must be hex: {}", path, e)),
+        }
+    }
+
+    /// `text` encrypted, as base64; it only opens as the same `line`
+    ///
+    pub fn seal(&self, text: &str, line: u64) -> String {
+        let mut nonce = [0u8; NONCE_BYTES];
+        self.rng.lock().unwrap().fill_bytes(&mut nonce);
+
+        let mut sealed = vec![0u8; NONCE_BYTES + text.len() + TAG_BYTES];
+        {
+            let (nonce_out, rest) = sealed.split_at_mut(NONCE_BYTES);
+            nonce_out.copy_from_slice(&nonce);
+            let (body, tag) = rest.split_at_mut(text.len());
+            AesGcm::new(KeySize::KeySize256, &self.key, &nonce, &line_bytes(line)).encrypt(text.as_bytes(), body, tag);
+        }
+        sealed.to_base64(BASE64_CONFIG)
+    }
+
+    /// The text sealed as `line`
+    ///
+    pub fn open(&self, sealed: &str, line: u64) -> Result<String, String> {
+        let sealed = match sealed.from_base64() {
+            Ok(sealed) => sealed,
+            Err(e) => return Err(format!("unable to decode encrypted text: {}", e)),
+        };
+        if sealed.len() < NONCE_BYTES + TAG_BYTES {
+            return Err("encrypted text is too short".to_string())
+        }
+
+        let (nonce, rest) = sealed.split_at(NONCE_BYTES);
+        let (body, tag) = rest.split_at(rest.len() - TAG_BYTES);
+        let mut text = vec![0u8; body.len()];
+        if !AesGcm::new(KeySize::KeySize256, &self.key, nonce, &line_bytes(line)).decrypt(body, &mut text, tag) {
+            return Err("unable to decrypt (it was encrypted with another key, or is damaged)".to_string())
+        }
+        String::from_utf8(text).map_err(|_| "decrypted text isn't UTF-8".to_string())
+    }
+}
+
+/// Whether `text` was sealed, rather than being the JSON it would replace
+///
+pub fn sealed(text: &str) -> bool {
+    !text.starts_with('{')
+}
+
+/// `text` sealed as `line`, if there's a cipher
+///
+pub fn seal(cipher: &Option<Cipher>, text: String, line: u64) -> String {
+    match *cipher {
+        Some(ref cipher) => cipher.seal(&text, line),
+        None => text,
+    }
+}
+
+/// `text` opened if it was sealed, otherwise as it is
+///
+pub fn open(cipher: &Option<Cipher>, text: &str, line: u64) -> Result<String, String> {
+    if !sealed(text) {
+        return Ok(text.to_string())
+    }
+    match *cipher {
+        Some(ref cipher) => cipher.open(text, line),
+        None => Err("it's encrypted, and no --encryption-key was given".to_string()),
+    }
+}
+
+fn line_bytes(line: u64) -> [u8; 8] {
+    let mut bytes = [0u8; 8];
+    for i in 0..8 {
+        bytes[i] = (line >> (56 - 8 * i)) as u8;
+    }
+    bytes
+}
+
+#[cfg(test)]
+mod test {
+    use http::encryption::{Cipher, seal, open, sealed};
+
+    fn with_key(byte: u8) -> Option<Cipher> {
+        Some(Cipher::new(vec![byte; 32]).unwrap())
+    }
+
+    #[test]
+    fn sealed_text_opens_as_the_same_line() {
+        let cipher = with_key(1);
+        let text = seal(&cipher, "{\"epoch\":3}".to_string(), 4);
+        assert!(sealed(&text));
+        assert!(!text.contains("epoch"));
+        assert_eq!(open(&cipher, &text, 4).unwrap(), "{\"epoch\":3}");
+
+        assert!(open(&cipher, &text, 5).is_err());
+        assert!(open(&with_key(2), &text, 4).is_err());
+        assert!(open(&None, &text, 4).is_err());
+    }
+
+    #[test]
+    fn plain_text_is_left_alone() {
+        assert_eq!(seal(&None, "{}".to_string(), 0), "{}");
+        assert_eq!(open(&with_key(1), "{}", 0).unwrap(), "{}");
+    }
+
+    #[test]
+    fn damaged_text_does_not_open() {
+        let cipher = with_key(1);
+        let text = seal(&cipher, "{\"epoch\":3}".to_string(), 0);
+        let mut damaged = text.clone().into_bytes();
+        damaged[20] = if damaged[20] == b'A' { b'B' } else { b'A' };
+        assert!(open(&cipher, &String::from_utf8(damaged).unwrap(), 0).is_err());
+        assert!(open(&cipher, &text[..text.len() - 4], 0).is_err());
+    }
+
+    #[test]
+    fn keys_must_be_32_bytes() {
+        assert!(Cipher::new(vec![0; 16]).is_err());
+    }
+}
@@ -0,0 +1,165 @@
+//! Queries across a cluster's shards, see `hammer::db::federated`
+//!
+//! On servers started with `--shard-map`, `POST /federated/b/:bits/:tolerance/:namespace`
+//! queries the posted values on every shard in the map at once, as a client
+//! using `Federated` would, for clients which can't.  Each value's result is
+//! its base64-encoded matches, or `"none"`, as with `/query`.  If a shard
+//! couldn't be queried (every replica failed), the result is instead
+//! `{"matches":[...],"complete":false,"skipped":[{"shard":1,"error":"..."}]}`,
+//! with the matches from the other shards; with `?require_complete=true` it's
+//! an error instead, as is any other failed query.
+//!
+//! Requests to the shards carry the server's own token (see `auth`).
+
+use std::collections::BTreeMap;
+use std::hash::Hash;
+
+use iron::prelude::*;
+use iron::status;
+use router::Router;
+use persistent::State;
+use rustc_serialize::{Encodable, Decodable};
+use rustc_serialize::json::{self, Json, ToJson};
+
+use hammer::db::federated::{Federated, ShardMap, ShardResults};
+use hammer::db::remote::Remote;
+use hammer::hyperplane::FromBits;
+
+use http::{ConfigKey, BitOrder, ValueEncoding, decode_body, query_param, bit_order, value_encoding};
+use http::auth;
+use http::binary_handler::{encode_value, decode_values};
+use http::shard_map;
+
+pub fn query(req: &mut Request) -> IronResult<Response> {
+    let req_body = try!(decode_body::<Vec<Json>>(req));
+    let order = match bit_order(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let encoding = match value_encoding(req, bits) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let require_complete = match query_param(req, "require_complete") {
+        Some(ref v) if v == "true" => true,
+        Some(ref v) if v == "false" => false,
+        Some(v) => return Ok(Response::with((status::BadRequest, format!("require_complete must be true or false, not '{}'", v)))),
+        None => false,
+    };
+
+    let path = {
+        let config_mx = req.get::<State<ConfigKey>>().unwrap();
+        let config = config_mx.read().unwrap();
+        config.shard_map.clone()
+    };
+    let map = match path {
+        Some(path) => match shard_map::load(&path) {
+            Ok(map) => map,
+            Err(e) => return Ok(Response::with((status::InternalServerError, e))),
+        },
+        None => return Ok(Response::with((status::NotFound, "no shard map configured (see --shard-map)"))),
+    };
+
+    let db = format!("b/{}/{}/{}", bits, tolerance, namespace);
+    let results = match bits {
+        32 => do_query::<u32>(req_body, encoding, order, &map, &db, require_complete),
+        64 => do_query::<u64>(req_body, encoding, order, &map, &db, require_complete),
+        128 => do_query::<[u64; 2]>(req_body, encoding, order, &map, &db, require_complete),
+        256 => do_query::<[u64; 4]>(req_body, encoding, order, &map, &db, require_complete),
+        _ => return Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    };
+
+    Ok(Response::with((status::Ok, json::encode(&Json::Array(results)).unwrap())))
+}
+
+fn do_query<T>(values: Vec<Json>, encoding: ValueEncoding, order: BitOrder, map: &ShardMap, db: &str, require_complete: bool) -> Vec<Json> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Encodable + Decodable + FromBits,
+{
+    let shards = map.shards.iter().map(|replicas| {
+        let mut shard = Remote::new(replicas.clone(), db);
+        shard.set_token(auth::client_token());
+        shard
+    }).collect();
+    let federated: Federated<T> = Federated::new(shards);
+
+    decode_values::<T>(values, encoding, order).into_iter().map(|value| {
+        match value {
+            Ok(value) => match federated.get_partial(&value, require_complete) {
+                Ok(results) => results_json(results),
+                Err(e) => Json::String(format!("err: {}", e)),
+            },
+            Err(e) => Json::String(format!("err: {}", e)),
+        }
+    }).collect()
+}
+
+fn results_json<T: Encodable>(results: ShardResults<T>) -> Json {
+    let matches = match results.found {
+        Some(found) => Json::Array(found.iter().map(|v| Json::String(encode_value(v))).collect()),
+        None if results.complete => return Json::String("none".to_string()),
+        None => Json::Array(vec![]),
+    };
+    if results.complete {
+        return matches
+    }
+
+    let skipped = results.skipped.iter().map(|&(shard, ref e)| {
+        let mut d = BTreeMap::new();
+        d.insert("shard".to_string(), shard.to_json());
+        d.insert("error".to_string(), e.to_string().to_json());
+        Json::Object(d)
+    }).collect();
+
+    let mut d = BTreeMap::new();
+    d.insert("matches".to_string(), matches);
+    d.insert("complete".to_string(), false.to_json());
+    d.insert("skipped".to_string(), Json::Array(skipped));
+    Json::Object(d)
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashSet;
+
+    use rustc_serialize::json::Json;
+
+    use hammer::db::error::StoreError;
+    use hammer::db::federated::ShardResults;
+
+    use http::federated_handler::results_json;
+
+    #[test]
+    fn incomplete_results_list_skipped_shards() {
+        let found: HashSet<u64> = vec![0b0001u64].into_iter().collect();
+        let results = ShardResults{found: Some(found), complete: false, skipped: vec![(1, StoreError::transient("unreachable"))]};
+
+        let json = results_json(results);
+        assert_eq!(json.find("complete"), Some(&Json::Boolean(false)));
+        assert_eq!(json.find("matches").unwrap().as_array().unwrap().len(), 1);
+        let skipped = json.find("skipped").unwrap().as_array().unwrap();
+        assert_eq!(skipped[0].find("shard"), Some(&Json::U64(1)));
+    }
+
+    #[test]
+    fn complete_results_are_plain() {
+        let results: ShardResults<u64> = ShardResults{found: None, complete: true, skipped: vec![]};
+        assert_eq!(results_json(results), Json::String("none".to_string()));
+    }
+}
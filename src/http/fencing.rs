@@ -0,0 +1,307 @@
+//! Leader epochs, for fencing off stale primaries
+//!
+//! Each server has an epoch (`--epoch`, 1 by default), which stamps every
+//! change it publishes to the change feed.  A standby promoted to primary
+//! takes an epoch higher than any it has seen, and tells the old primary (if
+//! it can be reached) to fence itself with `POST /admin/fence?epoch=N`.
+//!
+//! A fenced server rejects writes with a 409, so that a primary which comes
+//! back after a failover can't interleave its writes with the new primary's.
+//! Clients send the highest epoch they've seen in the `X-Hammer-Epoch`
+//! header of writes, and a server whose epoch is lower rejects the write.
+//! With an admin token (or without `--auth-tokens`/`--auth-command`, when
+//! anyone could use `/admin/fence`), the server fences itself too, so a
+//! stale primary can be fenced even if the new one can't reach it; data
+//! tokens can't fence a server.  Standbys refuse changes stamped with an
+//! epoch lower than one they've already applied.
+//!
+//! With `--data-dir`, the epoch and the epoch the server was fenced by are
+//! saved to `fencing.json` there whenever they change, and a restarted server
+//! carries on from them (or from `--epoch`, if that's higher).  With
+//! `--encryption-key` the file is encrypted (see `encryption`).
+
+use std::cmp;
+use std::collections::BTreeMap;
+use std::fs;
+use std::fs::File;
+use std::io;
+use std::io::{Read as IoRead, Write};
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+
+use iron::prelude::*;
+use iron::{status, typemap, BeforeMiddleware};
+use persistent::Read;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::query_param;
+use http::auth::{Scope, ScopeKey};
+use http::encryption;
+use http::encryption::Cipher;
+use http::upgrade;
+
+/// The fencing state, as saved in `fencing.json`
+///
+#[derive(RustcEncodable, RustcDecodable)]
+struct State {
+    epoch: u64,
+    /// The higher epoch this server was fenced by, if any
+    fenced_by: Option<u64>,
+}
+
+pub struct FencingKey;
+impl typemap::Key for FencingKey { type Value = Fencing; }
+
+pub struct Fencing {
+    /// Where the state is saved, with `--data-dir`
+    saved_path: Option<PathBuf>,
+    /// Encrypts the saved state, with `--encryption-key`
+    cipher: Arc<Option<Cipher>>,
+    state: Mutex<State>,
+}
+
+impl Fencing {
+    pub fn new(epoch: u64, data_dir: &Option<PathBuf>, cipher: Arc<Option<Cipher>>) -> Fencing {
+        let saved_path = data_dir.as_ref().map(|dir| dir.join("fencing.json"));
+        let state = match saved_path.as_ref().and_then(|path| load(path, &cipher)) {
+            Some(saved) => {
+                let resumed = State{
+                    epoch: cmp::max(epoch, saved.epoch),
+                    fenced_by: saved.fenced_by.and_then(|e| if e > epoch { Some(e) } else { None }),
+                };
+                log!("Resuming at epoch {}", resumed.epoch);
+                resumed
+            },
+            None => State{epoch: epoch, fenced_by: None},
+        };
+
+        Fencing{saved_path: saved_path, cipher: cipher, state: Mutex::new(state)}
+    }
+
+    pub fn epoch(&self) -> u64 {
+        self.state.lock().unwrap().epoch
+    }
+
+    pub fn fenced(&self) -> bool {
+        self.state.lock().unwrap().fenced_by.is_some()
+    }
+
+    /// Fences the server if `epoch` is higher than its own; returns whether
+    /// it's fenced
+    ///
+    pub fn observe(&self, epoch: u64) -> bool {
+        let mut state = self.state.lock().unwrap();
+        if epoch > state.epoch && state.fenced_by.map(|e| epoch > e).unwrap_or(true) {
+            log!("WARNING: fenced by epoch {} (this server's epoch is {}), rejecting writes", epoch, state.epoch);
+            state.fenced_by = Some(epoch);
+            self.save(&state);
+        }
+        state.fenced_by.is_some()
+    }
+
+    /// Whether a write sent with `client_epoch` should be rejected: if the
+    /// server is fenced, or the client has seen a higher epoch, which fences
+    /// the server too if the client `may_fence`
+    ///
+    fn stale(&self, client_epoch: Option<u64>, may_fence: bool) -> bool {
+        match client_epoch {
+            Some(epoch) if may_fence => self.observe(epoch),
+            Some(epoch) => epoch > self.epoch() || self.fenced(),
+            None => self.fenced(),
+        }
+    }
+
+    /// Takes an epoch higher than both the server's own and `seen`, i.e. on
+    /// promotion; returns the new epoch
+    ///
+    pub fn advance(&self, seen: u64) -> u64 {
+        let mut state = self.state.lock().unwrap();
+        let epoch = match state.fenced_by {
+            Some(fenced_by) if fenced_by > seen => fenced_by,
+            _ => seen,
+        };
+        if epoch >= state.epoch {
+            state.epoch = epoch + 1;
+        }
+        state.fenced_by = None;
+        self.save(&state);
+        state.epoch
+    }
+
+    /// Saves the state, if there's somewhere to save it; the caller holds
+    /// the state lock
+    ///
+    fn save(&self, state: &State) {
+        let path = match self.saved_path {
+            Some(ref path) => path,
+            None => return,
+        };
+
+        // Written alongside and renamed, so a crash can't leave half a file
+        let tmp = path.with_extension("json.tmp");
+        let result = File::create(&tmp)
+            .and_then(|mut f| f.write_all(encryption::seal(&self.cipher, json::encode(state).unwrap(), 0).as_bytes()).and_then(|_| f.sync_all()))
+            .and_then(|_| fs::rename(&tmp, path));
+        match result {
+            Ok(_) => {},
+            Err(e) => log!("WARNING: unable to save the epoch to {}: {}", path.display(), e),
+        }
+    }
+}
+
+fn load(path: &PathBuf, cipher: &Option<Cipher>) -> Option<State> {
+    let mut contents = String::new();
+    match File::open(path).and_then(|mut f| f.read_to_string(&mut contents)) {
+        Ok(_) => {},
+        Err(_) => return None,
+    }
+
+    let contents = match encryption::open(cipher, &contents, 0) {
+        Ok(contents) => contents,
+        Err(e) => {
+            log!("WARNING: ignoring unreadable epoch in {}: {}", path.display(), e);
+            return None
+        },
+    };
+    match json::decode::<State>(&contents) {
+        Ok(state) => Some(state),
+        Err(e) => {
+            log!("WARNING: ignoring unreadable epoch in {}: {}", path.display(), e);
+            None
+        },
+    }
+}
+
+impl ToJson for Fencing {
+    fn to_json(&self) -> Json {
+        let state = self.state.lock().unwrap();
+
+        let mut d = BTreeMap::new();
+        d.insert("epoch".to_string(), state.epoch.to_json());
+        d.insert("fenced_by".to_string(), state.fenced_by.to_json());
+        Json::Object(d)
+    }
+}
+
+/// Rejects writes once fenced, or which carry a higher epoch (fencing the
+/// server if they're allowed to)
+///
+pub struct RejectStaleWrites {
+    fencing: Arc<Fencing>,
+}
+
+impl RejectStaleWrites {
+    pub fn new(fencing: Arc<Fencing>) -> RejectStaleWrites {
+        RejectStaleWrites{fencing: fencing}
+    }
+}
+
+impl BeforeMiddleware for RejectStaleWrites {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        if !upgrade::is_write(req) {
+            return Ok(())
+        }
+
+        let client_epoch = match req.headers.get_raw("X-Hammer-Epoch") {
+            Some(values) if values.len() == 1 => String::from_utf8_lossy(&values[0]).parse::<u64>().ok(),
+            _ => None,
+        };
+        // Without auth, anyone could fence the server with /admin/fence
+        let may_fence = match req.extensions.get::<ScopeKey>() {
+            Some(scope) => *scope == Scope::Admin,
+            None => true,
+        };
+        if self.fencing.stale(client_epoch, may_fence) {
+            let err = io::Error::new(io::ErrorKind::Other, "fenced");
+            let msg = format!("this server (epoch {}) has been replaced by a newer primary; write to that instead", self.fencing.epoch());
+            return Err(IronError::new(err, (status::Conflict, msg)))
+        }
+        Ok(())
+    }
+}
+
+pub fn fence(req: &mut Request) -> IronResult<Response> {
+    let epoch = match query_param(req, "epoch").and_then(|e| e.parse::<u64>().ok()) {
+        Some(epoch) => epoch,
+        None => return Ok(Response::with((status::BadRequest, "epoch must be an integer"))),
+    };
+
+    let fencing = req.get::<Read<FencingKey>>().unwrap();
+    fencing.observe(epoch);
+
+    let response_body = json::encode(&fencing.to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+#[cfg(test)]
+mod test {
+    use std::env;
+    use std::fs;
+    use std::sync::Arc;
+
+    use super::Fencing;
+    use http::encryption::Cipher;
+
+    #[test]
+    fn higher_epochs_fence() {
+        let fencing = Fencing::new(3, &None, Arc::new(None));
+        assert!(!fencing.observe(2));
+        assert!(!fencing.observe(3));
+        assert!(fencing.observe(5));
+        assert!(fencing.fenced());
+
+        // Promotion takes an epoch above any seen, and lifts the fence
+        assert_eq!(fencing.advance(4), 6);
+        assert!(!fencing.fenced());
+        assert!(!fencing.observe(6));
+    }
+
+    #[test]
+    fn only_admins_fence_with_the_header() {
+        let fencing = Fencing::new(3, &None, Arc::new(None));
+        assert!(!fencing.stale(None, false));
+        assert!(!fencing.stale(Some(3), false));
+
+        // A data token's write is rejected, but the server isn't fenced
+        assert!(fencing.stale(Some(u64::max_value()), false));
+        assert!(!fencing.fenced());
+        assert!(!fencing.stale(Some(2), false));
+
+        assert!(fencing.stale(Some(4), true));
+        assert!(fencing.fenced());
+        assert!(fencing.stale(None, false));
+        assert!(fencing.stale(Some(2), true));
+    }
+
+    #[test]
+    fn epochs_are_saved() {
+        let mut data_dir = env::temp_dir();
+        data_dir.push("hammer-fencing-saved");
+        let _ = fs::remove_dir_all(&data_dir);
+        fs::create_dir_all(&data_dir).unwrap();
+        let data_dir = Some(data_dir);
+        let cipher = Arc::new(Some(Cipher::new(vec![1; 32]).unwrap()));
+
+        {
+            let fencing = Fencing::new(1, &data_dir, cipher.clone());
+            assert_eq!(fencing.advance(4), 5);
+            fencing.observe(7);
+        }
+
+        let fencing = Fencing::new(1, &data_dir, cipher.clone());
+        assert_eq!(fencing.epoch(), 5);
+        assert!(fencing.fenced());
+
+        // Without the key, the saved state can't be read
+        let fencing = Fencing::new(1, &data_dir, Arc::new(None));
+        assert_eq!(fencing.epoch(), 1);
+
+        // A higher --epoch wins, and lifts a fence below it
+        let fencing = Fencing::new(8, &data_dir, cipher.clone());
+        assert_eq!(fencing.epoch(), 8);
+        assert!(!fencing.fenced());
+
+        fs::remove_dir_all(data_dir.unwrap()).unwrap();
+    }
+}
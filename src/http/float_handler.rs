@@ -0,0 +1,262 @@
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::status;
+use rand;
+use router::Router;
+use persistent::{Read, State};
+
+use hammer::hyperplane::{Hyperplanes, FromBits};
+
+use http::{ConfigKey, BOptions, DBOptions, Projections, B32, B64, B128, B256, decode_body, query_param, response_budget, inserted_between};
+use http::binary_handler;
+use http::rerank::RerankerKey;
+use http::changes::ChangeFeedKey;
+use http::metrics::MetricsKey;
+use http::sink::MirrorKey;
+use http::upgrade::HandoffKey;
+
+pub fn add(req: &mut Request) -> IronResult<Response> {
+    let req_body = try!(decode_body::<Vec<Vec<f64>>>(req));
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let config_mx = req.get::<State<ConfigKey>>().unwrap();
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let changes = req.get::<Read<ChangeFeedKey>>().unwrap();
+    let metrics = req.get::<Read<MetricsKey>>().unwrap();
+    let mirror = req.get::<Read<MirrorKey>>().unwrap();
+    let handoff = req.get::<Read<HandoffKey>>().unwrap();
+    let projections_mx = req.get::<State<Projections>>().unwrap();
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            let values = match binarize::<u32>(req_body, bits, tolerance, &namespace, true, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_add(values, bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            let values = match binarize::<u64>(req_body, bits, tolerance, &namespace, true, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_add(values, bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            let values = match binarize::<[u64; 2]>(req_body, bits, tolerance, &namespace, true, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_add(values, bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            let values = match binarize::<[u64; 4]>(req_body, bits, tolerance, &namespace, true, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_add(values, bits, tolerance, namespace, config_mx, options_mx, changes, metrics, mirror, handoff, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+pub fn query(req: &mut Request) -> IronResult<Response> {
+    let req_body = try!(decode_body::<Vec<Vec<f64>>>(req));
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let projections_mx = req.get::<State<Projections>>().unwrap();
+    let reranker = req.get::<Read<RerankerKey>>().unwrap();
+    let explain = query_param(req, "explain") == Some("true".to_string());
+    let diff = query_param(req, "diff") == Some("true".to_string());
+    let budget = match response_budget(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+    let inserted = match inserted_between(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            let values = match binarize::<u32>(req_body, bits, tolerance, &namespace, false, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_query(values, bits, tolerance, namespace, false, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            let values = match binarize::<u64>(req_body, bits, tolerance, &namespace, false, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_query(values, bits, tolerance, namespace, false, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            let values = match binarize::<[u64; 2]>(req_body, bits, tolerance, &namespace, false, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_query(values, bits, tolerance, namespace, false, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            let values = match binarize::<[u64; 4]>(req_body, bits, tolerance, &namespace, false, options_mx.clone(), projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_query(values, bits, tolerance, namespace, false, explain, diff, budget, inserted, reranker, options_mx, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+pub fn delete(req: &mut Request) -> IronResult<Response> {
+    let req_body = try!(decode_body::<Vec<Vec<f64>>>(req));
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let projections_mx = req.get::<State<Projections>>().unwrap();
+    let mirror = req.get::<Read<MirrorKey>>().unwrap();
+    let handoff = req.get::<Read<HandoffKey>>().unwrap();
+    let changes = req.get::<Read<ChangeFeedKey>>().unwrap();
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            let values = match binarize::<u32>(req_body, bits, tolerance, &namespace, false, options_mx, projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_delete(values, bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            let values = match binarize::<u64>(req_body, bits, tolerance, &namespace, false, options_mx, projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_delete(values, bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            let values = match binarize::<[u64; 2]>(req_body, bits, tolerance, &namespace, false, options_mx, projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_delete(values, bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            let values = match binarize::<[u64; 4]>(req_body, bits, tolerance, &namespace, false, options_mx, projections_mx) {
+                Ok(values) => values,
+                Err(e) => return Ok(Response::with((status::BadRequest, e))),
+            };
+            binary_handler::do_delete(values, bits, tolerance, namespace, changes, mirror, handoff, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize or tolerance"))),
+    }
+}
+
+/// Project float vectors onto the DB's hyperplanes
+///
+/// The DB's projection seed and vector length are fixed by its first float
+/// add if they haven't been set explicitly.  Queries and deletes (`adding` is
+/// false) before then are rejected rather than fixing them.
+///
+fn binarize<T: FromBits>(vectors: Vec<Vec<f64>>, bits: usize, tolerance: usize, namespace: &String, adding: bool, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, projections_mx: Arc<RwLock<HashMap<(u64, usize, usize), Arc<Hyperplanes>>>>) -> Result<Vec<Result<T, String>>, String> {
+    if T::bits() != bits {
+        return Err(format!("can't project onto {} hyperplanes for {}-bit values", bits, T::bits()))
+    }
+
+    let options_key = (bits, tolerance, namespace.clone());
+
+    let projection = match options_mx.read().unwrap().get(&options_key) {
+        Some(&DBOptions{projection_seed: Some(seed), projection_dimensions: Some(dimensions), ..}) => Some((seed, dimensions)),
+        _ => None,
+    };
+
+    let (seed, dimensions) = match (projection, vectors.first()) {
+        (Some(projection), _) => projection,
+        (None, None) => return Ok(vec![]),
+        (None, Some(_)) if !adding => return Err("no float vectors have been added to this DB, so its projection isn't set".to_string()),
+        (None, Some(first)) => {
+            let mut options_map = options_mx.write().unwrap();
+            let options = options_map.entry(options_key).or_insert(DBOptions::default());
+
+            if options.projection_seed.is_none() {
+                options.projection_seed = Some(rand::random());
+            }
+            if options.projection_dimensions.is_none() {
+                options.projection_dimensions = Some(first.len());
+            }
+
+            (options.projection_seed.unwrap(), options.projection_dimensions.unwrap())
+        },
+    };
+
+    let planes_key = (seed, dimensions, bits);
+    let cached = projections_mx.read().unwrap().get(&planes_key).cloned();
+    let planes = match cached {
+        Some(planes) => planes,
+        None => {
+            let planes = Arc::new(Hyperplanes::new(seed, dimensions, bits));
+            projections_mx.write().unwrap().insert(planes_key, planes.clone());
+            planes
+        },
+    };
+
+    Ok(vectors.iter().map(|vector| planes.binarize(vector)).collect())
+}
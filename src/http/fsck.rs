@@ -0,0 +1,238 @@
+//! Offline index verification
+//!
+//! `hammerhttp fsck --data-dir=<path>` opens each binary database persisted
+//! under a data directory (each shard separately, for databases written with
+//! `--shards`) and checks its indices against the values it holds, as the
+//! scrubber does.  With `--repair`, missing entries are rebuilt from the
+//! values and dangling ones removed, and the fixes are written back before
+//! the database is closed, so the server starts from clean indices.
+//!
+//! RocksDB allows one process per database, so the server must be stopped
+//! first; a database which can't be opened (i.e. because it's locked by a
+//! running server) stops the check with an error.  Vector and document
+//! databases aren't checked.
+
+use std::any::Any;
+use std::fmt;
+use std::fs;
+use std::hash::Hash;
+use std::panic;
+use std::path::{Path, PathBuf};
+
+use hammer::db::{Database, Factory, StorageBackend};
+use hammer::db::integrity::IntegrityReport;
+
+/// Results of checking every database in a data directory
+///
+pub struct Fsck {
+    /// Each database (or shard) checked, by its directory name
+    pub checked: Vec<(String, IntegrityReport)>,
+    /// Directories which don't hold binary databases
+    pub skipped: Vec<String>,
+    pub repaired: bool,
+}
+
+impl Fsck {
+    /// True if no problems were found (or all were repaired)
+    ///
+    pub fn ok(&self) -> bool {
+        self.repaired || self.checked.iter().all(|&(_, ref report)| report.is_ok())
+    }
+}
+
+impl fmt::Display for Fsck {
+    fn fmt(&self, f: &mut fmt::Formatter) -> Result<(), fmt::Error> {
+        for &(ref name, ref report) in self.checked.iter() {
+            let status = match (report.is_ok(), self.repaired) {
+                (true, _) => "ok",
+                (false, true) => "repaired",
+                (false, false) => "damaged",
+            };
+            try!(writeln!(f, "{}: {} values, {} missing, {} dangling, {}", name, report.values, report.missing, report.dangling, status));
+        }
+        for name in self.skipped.iter() {
+            try!(writeln!(f, "{}: skipped", name));
+        }
+        Ok(())
+    }
+}
+
+/// Checks (and with `repair`, repairs) every binary database under
+/// `data_dir`
+///
+pub fn run(data_dir: &Path, repair: bool) -> Result<Fsck, String> {
+    if !StorageBackend::rocksdb_available() {
+        return Err("fsck requires RocksDB; rebuild with `--features rocksdb`".to_string())
+    }
+
+    let mut names = vec![];
+    for entry in try!(fs::read_dir(data_dir).map_err(|e| format!("unable to read {}: {}", data_dir.display(), e))) {
+        let entry = try!(entry.map_err(|e| format!("unable to read {}: {}", data_dir.display(), e)));
+        if entry.path().is_dir() {
+            names.push(entry.file_name().to_string_lossy().into_owned());
+        }
+    }
+    names.sort();
+
+    let mut fsck = Fsck{checked: vec![], skipped: vec![], repaired: repair};
+    for name in names.into_iter() {
+        let (bits, tolerance) = match parse_name(&name) {
+            Some(parsed) => parsed,
+            None => {
+                fsck.skipped.push(name);
+                continue
+            },
+        };
+
+        for (label, path) in try!(stores(data_dir, &name)).into_iter() {
+            let report = match bits {
+                32 => try!(check::<u32>(bits, tolerance, path, repair)),
+                64 => try!(check::<u64>(bits, tolerance, path, repair)),
+                128 => try!(check::<[u64; 2]>(bits, tolerance, path, repair)),
+                256 => try!(check::<[u64; 4]>(bits, tolerance, path, repair)),
+                _ => None,
+            };
+
+            match report {
+                Some(report) => fsck.checked.push((label, report)),
+                None => fsck.skipped.push(label),
+            }
+        }
+    }
+
+    Ok(fsck)
+}
+
+/// The bitsize and tolerance of a binary database's directory (see
+/// `binary_handler::storage_backend`), which is named
+/// `b<bits>_<tolerance>_<namespace>`
+///
+pub fn parse_name(name: &str) -> Option<(usize, usize)> {
+    if !name.starts_with("b") {
+        return None
+    }
+
+    let mut parts = name[1..].splitn(3, '_');
+    match (parts.next().map(|v| v.parse::<usize>()), parts.next().map(|v| v.parse::<usize>()), parts.next()) {
+        (Some(Ok(bits)), Some(Ok(tolerance)), Some(_)) => Some((bits, tolerance)),
+        _ => None,
+    }
+}
+
+/// The stores making up the database in `name`: one per `shard_<n>`
+/// subdirectory if it was sharded, otherwise the directory itself
+///
+fn stores(data_dir: &Path, name: &str) -> Result<Vec<(String, PathBuf)>, String> {
+    let dir = data_dir.join(name);
+
+    let mut shards = vec![];
+    for entry in try!(fs::read_dir(&dir).map_err(|e| format!("unable to read {}: {}", dir.display(), e))) {
+        let entry = try!(entry.map_err(|e| format!("unable to read {}: {}", dir.display(), e)));
+        let shard = entry.file_name().to_string_lossy().into_owned();
+        if shard.starts_with("shard_") && entry.path().is_dir() {
+            shards.push(shard);
+        }
+    }
+    shards.sort();
+
+    if shards.is_empty() {
+        return Ok(vec![(name.to_string(), dir)])
+    }
+    Ok(shards.into_iter().map(|shard| (format!("{}/{}", name, shard), dir.join(shard))).collect())
+}
+
+fn check<T: 'static + Sync + Send + Eq + Hash + Factory>(bits: usize, tolerance: usize, path: PathBuf, repair: bool) -> Result<Option<IntegrityReport>, String> {
+    let mut db = try!(open::<T>(bits, tolerance, path));
+
+    let report = match repair {
+        true => db.repair(),
+        false => db.check(),
+    };
+    Ok(report)
+}
+
+/// The database in `path`, or why it couldn't be opened
+///
+/// The stores panic if RocksDB can't open them, i.e. if a running server
+/// holds their locks, so the panic is caught (and kept quiet, since it's
+/// reported as an error instead).
+///
+fn open<T: 'static + Sync + Send + Eq + Hash + Factory>(bits: usize, tolerance: usize, path: PathBuf) -> Result<Box<Database<T>>, String> {
+    let display = path.display().to_string();
+
+    let hook = panic::take_hook();
+    panic::set_hook(Box::new(|_| {}));
+    let opened = panic::catch_unwind(panic::AssertUnwindSafe(|| T::build(bits, tolerance, StorageBackend::RocksDB(path))));
+    panic::set_hook(hook);
+
+    match opened {
+        Ok(db) => Ok(db),
+        Err(e) => Err(format!("unable to open {} (is a server still using it?): {}", display, panic_message(&e))),
+    }
+}
+
+fn panic_message(e: &Box<Any + Send>) -> String {
+    match (e.downcast_ref::<String>(), e.downcast_ref::<&str>()) {
+        (Some(message), _) => message.clone(),
+        (_, Some(message)) => message.to_string(),
+        _ => "unknown error".to_string(),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::env;
+    use std::fs;
+
+    use hammer::db::integrity::IntegrityReport;
+
+    use http::fsck::{Fsck, parse_name, stores};
+
+    #[test]
+    fn binary_db_names_parse() {
+        assert_eq!(parse_name("b64_4_images"), Some((64, 4)));
+        assert_eq!(parse_name("b256_12_with_underscores"), Some((256, 12)));
+        assert_eq!(parse_name("v64_4_images"), None);
+        assert_eq!(parse_name("b64_4"), None);
+        assert_eq!(parse_name("b64_x_images"), None);
+        assert_eq!(parse_name("standby.json"), None);
+    }
+
+    #[test]
+    fn shards_are_separate_stores() {
+        let mut data_dir = env::temp_dir();
+        data_dir.push("hammer-fsck-stores");
+        let _ = fs::remove_dir_all(&data_dir);
+        fs::create_dir_all(data_dir.join("b64_4_plain").join("map_set")).unwrap();
+        fs::create_dir_all(data_dir.join("b64_4_sharded").join("shard_1")).unwrap();
+        fs::create_dir_all(data_dir.join("b64_4_sharded").join("shard_0")).unwrap();
+
+        let plain = stores(&data_dir, "b64_4_plain").unwrap();
+        assert_eq!(plain, vec![("b64_4_plain".to_string(), data_dir.join("b64_4_plain"))]);
+
+        let sharded = stores(&data_dir, "b64_4_sharded").unwrap();
+        assert_eq!(sharded, vec![
+            ("b64_4_sharded/shard_0".to_string(), data_dir.join("b64_4_sharded").join("shard_0")),
+            ("b64_4_sharded/shard_1".to_string(), data_dir.join("b64_4_sharded").join("shard_1")),
+        ]);
+
+        assert!(stores(&data_dir, "b64_4_missing").is_err());
+
+        fs::remove_dir_all(&data_dir).unwrap();
+    }
+
+    #[test]
+    fn damage_is_ok_once_repaired() {
+        let clean = IntegrityReport{values: 10, missing: 0, dangling: 0};
+        let damaged = IntegrityReport{values: 10, missing: 2, dangling: 0};
+
+        let fsck = Fsck{checked: vec![("a".to_string(), clean.clone())], skipped: vec!["b".to_string()], repaired: false};
+        assert!(fsck.ok());
+
+        let fsck = Fsck{checked: vec![("a".to_string(), clean), ("b".to_string(), damaged.clone())], skipped: vec![], repaired: false};
+        assert!(!fsck.ok());
+
+        let fsck = Fsck{checked: vec![("b".to_string(), damaged)], skipped: vec![], repaired: true};
+        assert!(fsck.ok());
+    }
+}
@@ -0,0 +1,390 @@
+//! Imports from other stores
+//!
+//! `hammerhttp import` copies fingerprints from the stores people keep them
+//! in before moving to hammer into a binary DB on a running server:
+//!
+//! * `redis://[:password@]host[:port][/db]`: keys matching `--pattern` are
+//!   found with `SCAN`, and each key's value read with `GET`, or with `HGET`
+//!   of `--field` if the keys are hashes
+//! * `elasticsearch://host[:port]/index`: every document in the index is read
+//!   with a scroll, and the fingerprint taken from its `--field` (which may
+//!   be a dotted path, i.e. `meta.phash`)
+//!
+//! Fingerprints are read in the `--format` they're stored in: `base64`,
+//! `hex`, `decimal` (for up to 64 bits; JSON numbers are read as decimal
+//! too) or `raw` bytes, and must be exactly `--bits` wide.  Values which
+//! can't be read are counted and skipped; failing to talk to the source or
+//! the server stops the import.
+
+use std::io;
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::TcpStream;
+
+use rustc_serialize::base64::{FromBase64, ToBase64};
+use rustc_serialize::hex::FromHex;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::BASE64_CONFIG;
+use http::loader::{Loader, request_external};
+
+/// Keys requested by each `SCAN`, and documents by each scroll
+const PAGE_SIZE: usize = 1000;
+
+/// How long Elasticsearch keeps a scroll between pages
+const SCROLL_KEEP_ALIVE: &'static str = "1m";
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+pub enum Format {
+    Base64,
+    Hex,
+    Decimal,
+    Raw,
+}
+
+impl Format {
+    pub fn parse(s: &str) -> Result<Format, String> {
+        match s {
+            "base64" => Ok(Format::Base64),
+            "hex" => Ok(Format::Hex),
+            "decimal" => Ok(Format::Decimal),
+            "raw" => Ok(Format::Raw),
+            _ => Err(format!("unknown format '{}' (expected base64, hex, decimal or raw)", s)),
+        }
+    }
+}
+
+/// Where fingerprints are imported from
+///
+#[derive(Clone, Debug, PartialEq)]
+pub enum Source {
+    Redis{addr: String, password: Option<String>, db: Option<u32>},
+    Elasticsearch{addr: String, index: String},
+}
+
+impl Source {
+    pub fn parse(url: &str) -> Result<Source, String> {
+        if url.starts_with("redis://") {
+            let rest = &url["redis://".len()..];
+            let (password, rest) = match rest.rfind('@') {
+                Some(i) => (Some(rest[..i].trim_left_matches(':').to_string()), &rest[i + 1..]),
+                None => (None, rest),
+            };
+            let (addr, db) = match rest.find('/') {
+                Some(i) if i + 1 < rest.len() => match rest[i + 1..].parse::<u32>() {
+                    Ok(db) => (&rest[..i], Some(db)),
+                    Err(_) => return Err(format!("invalid Redis database in '{}'", url)),
+                },
+                Some(i) => (&rest[..i], None),
+                None => (rest, None),
+            };
+            let addr = match addr.contains(':') {
+                true => addr.to_string(),
+                false => format!("{}:6379", addr),
+            };
+            Ok(Source::Redis{addr: addr, password: password, db: db})
+        } else if url.starts_with("elasticsearch://") {
+            let rest = &url["elasticsearch://".len()..];
+            match rest.find('/') {
+                Some(i) if i + 1 < rest.len() => {
+                    let addr = match rest[..i].contains(':') {
+                        true => rest[..i].to_string(),
+                        false => format!("{}:9200", &rest[..i]),
+                    };
+                    Ok(Source::Elasticsearch{addr: addr, index: rest[i + 1..].trim_right_matches('/').to_string()})
+                },
+                _ => Err(format!("missing Elasticsearch index in '{}'", url)),
+            }
+        } else {
+            Err(format!("unsupported source '{}' (expected redis://... or elasticsearch://...)", url))
+        }
+    }
+}
+
+/// Summary of an import
+///
+#[derive(Debug, Default)]
+pub struct Summary {
+    /// Values found in the source
+    pub read: usize,
+    /// Values which couldn't be read as fingerprints
+    pub skipped: usize,
+    /// Why the first of them couldn't be read
+    pub first_skipped: Option<String>,
+    pub added: usize,
+    /// Values the DB already held
+    pub exists: usize,
+    /// Values the server rejected
+    pub errors: usize,
+}
+
+/// Imports the fingerprints in `source` into `loader`
+///
+/// `pattern` applies to Redis only; `field` is required for Elasticsearch
+///
+pub fn run(source: &Source, pattern: &str, field: Option<&str>, format: Format, bits: usize, mut loader: Loader) -> Result<Summary, String> {
+    let mut summary = Summary::default();
+    {
+        let mut add = |value: Option<Vec<u8>>| -> Result<(), String> {
+            summary.read += 1;
+            let decoded = match value {
+                Some(value) => decode(&value, format, bits),
+                None => Err("missing or not a string".to_string()),
+            };
+            match decoded {
+                Ok(encoded) => loader.add(encoded),
+                Err(e) => {
+                    summary.skipped += 1;
+                    if summary.first_skipped.is_none() {
+                        summary.first_skipped = Some(e);
+                    }
+                    Ok(())
+                },
+            }
+        };
+
+        match *source {
+            Source::Redis{ref addr, ref password, db} => try!(scan_redis(addr, password, db, pattern, field, &mut add)),
+            Source::Elasticsearch{ref addr, ref index} => match field {
+                Some(field) => try!(scroll_elasticsearch(addr, index, field, &mut add)),
+                None => return Err("--field is required for Elasticsearch".to_string()),
+            },
+        }
+    }
+
+    let loaded = try!(loader.finish());
+    summary.added = loaded.added;
+    summary.exists = loaded.exists;
+    summary.errors = loaded.errors;
+    Ok(summary)
+}
+
+/// A stored fingerprint, base64-encoded for `/add`
+///
+fn decode(value: &[u8], format: Format, bits: usize) -> Result<String, String> {
+    let bytes = match format {
+        Format::Raw => value.to_vec(),
+        Format::Base64 => try!(value.from_base64().map_err(|e| format!("{:?}", e))),
+        Format::Hex => match String::from_utf8(value.to_vec()) {
+            Ok(s) => try!(s.trim().trim_left_matches("0x").from_hex().map_err(|e| format!("{:?}", e))),
+            Err(e) => return Err(format!("{}", e)),
+        },
+        Format::Decimal => {
+            if bits > 64 {
+                return Err(format!("decimal values are only supported for up to 64 bits, not {}", bits))
+            }
+            let n = match String::from_utf8(value.to_vec()).ok().and_then(|s| s.trim().parse::<u64>().ok()) {
+                Some(n) => n,
+                None => return Err("not a decimal integer".to_string()),
+            };
+            if bits < 64 && n >> bits != 0 {
+                return Err(format!("{} is wider than {} bits", n, bits))
+            }
+            // Big-endian, as the server encodes integers
+            (0..bits / 8).rev().map(|i| (n >> (i * 8)) as u8).collect()
+        },
+    };
+
+    match bytes.len() * 8 == bits {
+        true => Ok(bytes.to_base64(BASE64_CONFIG)),
+        false => Err(format!("{} bits, expected {}", bytes.len() * 8, bits)),
+    }
+}
+
+/// A RESP reply, with bulk strings as bytes (fingerprints may be binary)
+///
+enum Reply {
+    Status(String),
+    Error(String),
+    Integer(i64),
+    Bulk(Option<Vec<u8>>),
+    Array(Vec<Reply>),
+}
+
+struct RedisConnection {
+    reader: BufReader<TcpStream>,
+    writer: TcpStream,
+}
+
+impl RedisConnection {
+    fn open(addr: &str) -> Result<RedisConnection, String> {
+        let stream = match TcpStream::connect(addr) {
+            Ok(s) => s,
+            Err(e) => return Err(format!("unable to connect to {}: {}", addr, e)),
+        };
+        let writer = match stream.try_clone() {
+            Ok(s) => s,
+            Err(e) => return Err(format!("unable to connect to {}: {}", addr, e)),
+        };
+        Ok(RedisConnection{reader: BufReader::new(stream), writer: writer})
+    }
+
+    /// Sends a command without waiting for its reply, so commands can be
+    /// pipelined
+    ///
+    fn send(&mut self, args: &[&[u8]]) -> Result<(), String> {
+        let mut command = format!("*{}\r\n", args.len()).into_bytes();
+        for arg in args.iter() {
+            command.extend(format!("${}\r\n", arg.len()).into_bytes());
+            command.extend(arg.iter().cloned());
+            command.extend(b"\r\n".iter().cloned());
+        }
+        self.writer.write_all(&command).map_err(|e| format!("unable to send to Redis: {}", e))
+    }
+
+    fn reply(&mut self) -> Result<Reply, String> {
+        read_reply(&mut self.reader).map_err(|e| format!("unable to read from Redis: {}", e))
+    }
+
+    /// Sends a command and waits for its reply, failing on an error reply
+    ///
+    fn call(&mut self, args: &[&[u8]]) -> Result<Reply, String> {
+        try!(self.send(args));
+        match try!(self.reply()) {
+            Reply::Error(e) => Err(format!("Redis: {}", e)),
+            reply => Ok(reply),
+        }
+    }
+}
+
+fn read_reply<R: BufRead>(reader: &mut R) -> io::Result<Reply> {
+    let mut line = String::new();
+    if try!(reader.read_line(&mut line)) == 0 {
+        return Err(io::Error::new(io::ErrorKind::UnexpectedEof, "connection closed"))
+    }
+    let line = line.trim_right_matches(|c| c == '\r' || c == '\n');
+    let invalid = || io::Error::new(io::ErrorKind::InvalidData, format!("unexpected reply '{}'", line));
+
+    match line.chars().next() {
+        Some('+') => Ok(Reply::Status(line[1..].to_string())),
+        Some('-') => Ok(Reply::Error(line[1..].to_string())),
+        Some(':') => line[1..].parse::<i64>().map(Reply::Integer).map_err(|_| invalid()),
+        Some('$') => match line[1..].parse::<i64>() {
+            Ok(len) if len < 0 => Ok(Reply::Bulk(None)),
+            Ok(len) => {
+                // The string is followed by CRLF
+                let mut buf = vec![0; len as usize + 2];
+                try!(reader.read_exact(&mut buf));
+                buf.truncate(len as usize);
+                Ok(Reply::Bulk(Some(buf)))
+            },
+            Err(_) => Err(invalid()),
+        },
+        Some('*') => match line[1..].parse::<i64>() {
+            Ok(len) if len < 0 => Ok(Reply::Array(vec![])),
+            Ok(len) => {
+                let mut replies = Vec::with_capacity(len as usize);
+                for _ in 0..len {
+                    replies.push(try!(read_reply(reader)));
+                }
+                Ok(Reply::Array(replies))
+            },
+            Err(_) => Err(invalid()),
+        },
+        _ => Err(invalid()),
+    }
+}
+
+/// Passes the value of each key matching `pattern` (or its `field`) to `add`,
+/// or None for keys whose value couldn't be read
+///
+fn scan_redis(addr: &str, password: &Option<String>, db: Option<u32>, pattern: &str, field: Option<&str>, add: &mut FnMut(Option<Vec<u8>>) -> Result<(), String>) -> Result<(), String> {
+    let mut conn = try!(RedisConnection::open(addr));
+    match *password {
+        Some(ref password) => { try!(conn.call(&[&b"AUTH"[..], password.as_bytes()])); },
+        None => {},
+    }
+    match db {
+        Some(db) => { try!(conn.call(&[&b"SELECT"[..], db.to_string().as_bytes()])); },
+        None => {},
+    }
+
+    let count = PAGE_SIZE.to_string();
+    let mut cursor = b"0".to_vec();
+    loop {
+        let (next, keys) = match try!(conn.call(&[&b"SCAN"[..], &cursor[..], &b"MATCH"[..], pattern.as_bytes(), &b"COUNT"[..], count.as_bytes()])) {
+            Reply::Array(mut parts) => match (parts.pop(), parts.pop()) {
+                (Some(Reply::Array(keys)), Some(Reply::Bulk(Some(next)))) => (next, keys),
+                _ => return Err("unexpected reply to SCAN".to_string()),
+            },
+            _ => return Err("unexpected reply to SCAN".to_string()),
+        };
+
+        // Pipelined, so each page of keys takes one round trip
+        let mut sent = 0;
+        for key in keys.iter() {
+            match (key, field) {
+                (&Reply::Bulk(Some(ref key)), Some(field)) => try!(conn.send(&[&b"HGET"[..], &key[..], field.as_bytes()])),
+                (&Reply::Bulk(Some(ref key)), None) => try!(conn.send(&[&b"GET"[..], &key[..]])),
+                _ => continue,
+            }
+            sent += 1;
+        }
+        for _ in 0..sent {
+            match try!(conn.reply()) {
+                Reply::Bulk(Some(value)) => try!(add(Some(value))),
+                // Deleted since the scan, or of another type
+                _ => try!(add(None)),
+            }
+        }
+
+        if &next[..] == &b"0"[..] {
+            return Ok(())
+        }
+        cursor = next;
+    }
+}
+
+/// Passes `field` of every document in `index` to `add`, or None for
+/// documents without it
+///
+fn scroll_elasticsearch(addr: &str, index: &str, field: &str, add: &mut FnMut(Option<Vec<u8>>) -> Result<(), String>) -> Result<(), String> {
+    let mut query = json::Object::new();
+    query.insert("size".to_string(), PAGE_SIZE.to_json());
+    query.insert("_source".to_string(), vec![field.to_string()].to_json());
+    // Unsorted, the cheapest order to scroll in
+    query.insert("sort".to_string(), vec!["_doc".to_string()].to_json());
+    let path = format!("/{}/_search?scroll={}", index, SCROLL_KEEP_ALIVE);
+    let mut page = try!(search(addr, &path, &Json::Object(query)));
+
+    loop {
+        let scroll_id = match page.find("_scroll_id") {
+            Some(&Json::String(ref id)) => id.clone(),
+            _ => return Err("Elasticsearch: response has no _scroll_id".to_string()),
+        };
+        let hits = match page.find_path(&["hits", "hits"]) {
+            Some(&Json::Array(ref hits)) => hits.clone(),
+            _ => return Err("Elasticsearch: response has no hits".to_string()),
+        };
+
+        if hits.is_empty() {
+            let mut clear = json::Object::new();
+            clear.insert("scroll_id".to_string(), vec![scroll_id].to_json());
+            // Scrolls expire anyway, so failing to clear one doesn't matter
+            let _ = request_external(addr, "DELETE", "/_search/scroll", &json::encode(&Json::Object(clear)).unwrap());
+            return Ok(())
+        }
+
+        let path: Vec<&str> = field.split('.').collect();
+        for hit in hits.iter() {
+            let value = match hit.find("_source").and_then(|source| source.find_path(&path)) {
+                Some(&Json::String(ref s)) => Some(s.clone().into_bytes()),
+                Some(&Json::U64(n)) => Some(n.to_string().into_bytes()),
+                _ => None,
+            };
+            try!(add(value));
+        }
+
+        let mut next = json::Object::new();
+        next.insert("scroll".to_string(), SCROLL_KEEP_ALIVE.to_json());
+        next.insert("scroll_id".to_string(), scroll_id.to_json());
+        page = try!(search(addr, "/_search/scroll", &Json::Object(next)));
+    }
+}
+
+fn search(addr: &str, path: &str, body: &Json) -> Result<Json, String> {
+    match try!(request_external(addr, "POST", path, &json::encode(body).unwrap())) {
+        (200, response) => Json::from_str(&response).map_err(|e| format!("Elasticsearch: unable to parse response: {}", e)),
+        (status, response) => Err(format!("Elasticsearch: {}: {}", status, response.chars().take(500).collect::<String>())),
+    }
+}
@@ -0,0 +1,123 @@
+//! Index comparison
+//!
+//! `hammerhttp diff` lists the keys of a binary database on two servers
+//! (with `/keys?encoding=raw`) and reports the keys only one of them holds,
+//! i.e. to check that a migration or a standby caught everything.  The first
+//! server's keys are held in memory while the second's are streamed past
+//! them, so the memory needed grows with the first database only.
+//!
+//! Each listing is a consistent snapshot, but the two are taken at slightly
+//! different times, so keys written during the comparison may be reported.
+
+use std::collections::HashSet;
+use std::fmt;
+use std::io::{BufRead, BufReader, Read};
+use std::net::TcpStream;
+
+use rustc_serialize::base64::ToBase64;
+
+use http::BASE64_CONFIG;
+use http::loader::get;
+
+/// Differences between a database on two servers
+///
+pub struct Diff {
+    pub db: String,
+    pub a: String,
+    pub b: String,
+    pub a_keys: usize,
+    pub b_keys: usize,
+    pub only_a: usize,
+    pub only_b: usize,
+    /// Up to `samples` base64-encoded keys only on `a`
+    pub only_a_samples: Vec<String>,
+    /// Up to `samples` base64-encoded keys only on `b`
+    pub only_b_samples: Vec<String>,
+}
+
+impl Diff {
+    pub fn same(&self) -> bool {
+        self.only_a == 0 && self.only_b == 0
+    }
+}
+
+impl fmt::Display for Diff {
+    fn fmt(&self, f: &mut fmt::Formatter) -> Result<(), fmt::Error> {
+        try!(writeln!(f, "{}: {} keys on {}, {} on {}", self.db, self.a_keys, self.a, self.b_keys, self.b));
+        try!(writeln!(f, "{} only on {}", self.only_a, self.a));
+        for key in self.only_a_samples.iter() {
+            try!(writeln!(f, "  {}", key));
+        }
+        try!(writeln!(f, "{} only on {}", self.only_b, self.b));
+        for key in self.only_b_samples.iter() {
+            try!(writeln!(f, "  {}", key));
+        }
+        Ok(())
+    }
+}
+
+/// Compares `b/:bits/:tolerance/:namespace` on servers `a` and `b`, keeping
+/// up to `samples` of the keys only one holds
+///
+pub fn run(a: &str, b: &str, bits: usize, tolerance: usize, namespace: &str, samples: usize) -> Result<Diff, String> {
+    let path = format!("/keys/b/{}/{}/{}?encoding=raw", bits, tolerance, namespace);
+    let width = bits / 8;
+
+    let mut keys = HashSet::new();
+    let mut a_keys = 0;
+    let mut reader = try!(get(a, &path).map_err(|e| format!("{}: {}", a, e)));
+    loop {
+        match try!(next_key(&mut reader, width).map_err(|e| format!("{}: {}", a, e))) {
+            Some(key) => { keys.insert(key); },
+            None => break,
+        }
+        a_keys += 1;
+    }
+
+    let mut diff = Diff{
+        db: format!("b/{}/{}/{}", bits, tolerance, namespace),
+        a: a.to_string(),
+        b: b.to_string(),
+        a_keys: a_keys,
+        b_keys: 0,
+        only_a: 0,
+        only_b: 0,
+        only_a_samples: vec![],
+        only_b_samples: vec![],
+    };
+
+    let mut reader = try!(get(b, &path).map_err(|e| format!("{}: {}", b, e)));
+    loop {
+        let key = match try!(next_key(&mut reader, width).map_err(|e| format!("{}: {}", b, e))) {
+            Some(key) => key,
+            None => break,
+        };
+        diff.b_keys += 1;
+        if !keys.remove(&key) {
+            diff.only_b += 1;
+            if diff.only_b_samples.len() < samples {
+                diff.only_b_samples.push(key.to_base64(BASE64_CONFIG));
+            }
+        }
+    }
+
+    diff.only_a = keys.len();
+    diff.only_a_samples = keys.iter().take(samples).map(|key| key.to_base64(BASE64_CONFIG)).collect();
+    Ok(diff)
+}
+
+/// The next `width`-byte key of a raw listing, or None at its end
+///
+fn next_key(reader: &mut BufReader<TcpStream>, width: usize) -> Result<Option<Vec<u8>>, String> {
+    match reader.fill_buf() {
+        Ok(buf) if buf.is_empty() => return Ok(None),
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to read keys: {}", e)),
+    }
+
+    let mut key = vec![0; width];
+    match reader.read_exact(&mut key) {
+        Ok(_) => Ok(Some(key)),
+        Err(e) => Err(format!("truncated key listing: {}", e)),
+    }
+}
@@ -0,0 +1,87 @@
+use std::collections::BTreeMap;
+use std::io::{BufRead, BufReader, Write};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::sync::Mutex;
+
+use iron::typemap;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+/// Rewrites values before they're added
+///
+/// Hooks are given the values from an `/add` request (as sent, before they're
+/// decoded) and return the values to add instead.  Values may be changed,
+/// dropped or added, so one shared server can apply different ingest rules to
+/// different namespaces.
+///
+pub trait IngestHook: Sync + Send {
+    fn transform(&self, db: &str, values: Vec<Json>) -> Result<Vec<Json>, String>;
+}
+
+/// Rewrites values using an external process
+///
+/// The process is started once and kept running.  Each request is written to
+/// its stdin as a single line of JSON:
+///
+/// ```json
+/// {"db":"b/64/8/foo","values":["AAAAAAAAAAE=","AAAAAAAAAAI="]}
+/// ```
+///
+/// and the process must respond by writing a single line to its stdout
+/// containing a JSON array of the values to add, in the request's encoding.
+/// Requests are serialized, so the process doesn't need to handle concurrency.
+///
+pub struct Subprocess {
+    // Keep the child around so it isn't dropped while we're talking to it
+    _child: Child,
+    pipes: Mutex<(ChildStdin, BufReader<ChildStdout>)>,
+}
+
+impl Subprocess {
+    /// Start `command` using the shell
+    ///
+    pub fn spawn(command: &str) -> Result<Subprocess, String> {
+        let mut child = match Command::new("sh").arg("-c").arg(command).stdin(Stdio::piped()).stdout(Stdio::piped()).spawn() {
+            Ok(v) => v,
+            Err(e) => return Err(format!("unable to start ingest hook '{}': {}", command, e)),
+        };
+
+        let stdin = child.stdin.take().unwrap();
+        let stdout = BufReader::new(child.stdout.take().unwrap());
+
+        Ok(Subprocess{_child: child, pipes: Mutex::new((stdin, stdout))})
+    }
+}
+
+impl IngestHook for Subprocess {
+    fn transform(&self, db: &str, values: Vec<Json>) -> Result<Vec<Json>, String> {
+        let mut request = BTreeMap::new();
+        request.insert("db".to_string(), db.to_json());
+        request.insert("values".to_string(), Json::Array(values));
+        let request_line = json::encode(&Json::Object(request)).unwrap();
+
+        let mut pipes = self.pipes.lock().unwrap();
+        let (ref mut stdin, ref mut stdout) = *pipes;
+
+        match writeln!(stdin, "{}", request_line).and_then(|_| stdin.flush()) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to write to ingest hook: {}", e)),
+        }
+
+        let mut response_line = String::new();
+        match stdout.read_line(&mut response_line) {
+            Ok(0) => return Err("ingest hook exited".to_string()),
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to read from ingest hook: {}", e)),
+        }
+
+        match Json::from_str(&response_line) {
+            Ok(Json::Array(v)) => Ok(v),
+            Ok(_) => Err(format!("ingest hook response '{}' isn't an array", response_line.trim())),
+            Err(e) => Err(format!("unable to parse ingest hook response '{}': {:?}", response_line.trim(), e)),
+        }
+    }
+}
+
+pub struct IngestHookKey;
+impl typemap::Key for IngestHookKey { type Value = Option<Box<IngestHook>>; }
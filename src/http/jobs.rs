@@ -0,0 +1,780 @@
+//! Long-running jobs
+//!
+//! Some operations take too long to finish within a request, such as
+//! clustering every value in a large database, checking and repairing its
+//! indices, or deleting every value matching a predicate.  `POST /jobs`
+//! starts one in the background and responds straight away with its ID;
+//! `GET /jobs/:id` reports its progress and, once it's finished, its result
+//! or error.  `DELETE /jobs/:id` cancels a job (jobs stop at their next
+//! step, so some finish anyway), and `GET /jobs` lists every job.  The most
+//! recent `MAX_FINISHED` finished jobs are kept.
+//!
+//! With `--data-dir`, jobs are saved to `jobs.json` there as they start and
+//! finish.  Jobs which hadn't finished when the server stopped are started
+//! again from the beginning when it restarts, once their database has been
+//! reopened by its first write.
+
+use std::cmp::min;
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::fs::File;
+use std::hash::Hash;
+use std::io::{Read as IoRead, Write};
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex, RwLock};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::thread;
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
+
+use iron::prelude::*;
+use iron::{status, typemap};
+use persistent::Read;
+use rand;
+use router::Router;
+use rustc_serialize::{Encodable, Decodable};
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use hammer::db::Database;
+use hammer::db::cluster::single_linkage;
+use hammer::db::hamming::Hamming;
+use hammer::db::integrity::IntegrityReport;
+use hammer::db::normalize::BitMask;
+use hammer::hyperplane::FromBits;
+
+use http::{DBOptions, DeleteResult, BitOrder, ValueEncoding, decode_body, parse_duration};
+use http::auth;
+use http::auth::Scope;
+use http::binary_handler::{encode_value, decode_values, delete_values};
+use http::changes::ChangeFeed;
+use http::sink::Mirror;
+use http::upgrade::Handoff;
+
+type DBMap<T> = Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>;
+
+/// Most finished jobs kept; the oldest are dropped as others finish
+const MAX_FINISHED: usize = 100;
+
+/// Values deleted per second by `delete` jobs, unless they set a `rate`
+const DEFAULT_DELETE_RATE: usize = 1000;
+
+/// Most values deleted at once; each batch holds the database's write lock
+const DELETE_BATCH: usize = 1000;
+
+/// Most index fixes made at once by `repair`; each batch holds the
+/// database's write lock
+const REPAIR_BATCH: usize = 1000;
+
+/// What a job does, as posted to `/jobs`
+///
+#[derive(Clone, Debug, RustcEncodable, RustcDecodable)]
+pub struct JobSpec {
+    /// `cluster`, `check`, `repair` or `delete`
+    pub kind: String,
+    /// The binary database to run against, i.e. `b/64/8/foo`
+    pub db: String,
+    /// For `cluster`, as for `/cluster` (the tolerance and 2 by default)
+    pub radius: Option<usize>,
+    pub min_size: Option<usize>,
+    /// For `delete`, exactly one of: the values to delete (base64-encoded),
+    /// how long ago values must have been inserted to be deleted (i.e.
+    /// `30d`), or a pattern values must match in the bits set in a mask (both
+    /// base64-encoded)
+    pub values: Option<Vec<String>>,
+    pub older_than: Option<String>,
+    pub mask: Option<String>,
+    pub pattern: Option<String>,
+    /// For `delete`, most values deleted per second
+    pub rate: Option<usize>,
+}
+
+impl JobSpec {
+    /// The database's bits, tolerance and namespace
+    ///
+    fn db(&self) -> Result<(usize, usize, String), String> {
+        let parts: Vec<&str> = self.db.splitn(4, '/').collect();
+        match (parts.len(), parts[0], parts.get(1).and_then(|b| b.parse::<usize>().ok()), parts.get(2).and_then(|t| t.parse::<usize>().ok())) {
+            (4, "b", Some(bits), Some(tolerance)) => Ok((bits, tolerance, parts[3].to_string())),
+            _ => Err(format!("invalid db '{}', expected i.e. b/64/8/foo", self.db)),
+        }
+    }
+
+    fn validate(&self) -> Result<(), String> {
+        let (_, tolerance, _) = try!(self.db());
+
+        match &self.kind[..] {
+            "cluster" => match self.radius {
+                Some(radius) if radius > tolerance => Err(format!("invalid radius {}, expected at most {}", radius, tolerance)),
+                _ => Ok(()),
+            },
+            "check" | "repair" => Ok(()),
+            "delete" => {
+                let predicates = [self.values.is_some(), self.older_than.is_some(), self.mask.is_some() || self.pattern.is_some()];
+                if predicates.iter().filter(|&p| *p).count() != 1 {
+                    return Err("expected one of values, older_than or mask and pattern".to_string())
+                }
+                if self.mask.is_some() != self.pattern.is_some() {
+                    return Err("mask and pattern must be given together".to_string())
+                }
+                match self.older_than {
+                    Some(ref older_than) => { try!(parse_duration(older_than).map_err(|e| format!("invalid older_than: {}", e))); },
+                    None => {},
+                }
+                match self.rate {
+                    Some(0) => Err("rate must be positive".to_string()),
+                    _ => Ok(()),
+                }
+            },
+            _ => Err(format!("unknown job kind '{}' (expected cluster, check, repair or delete)", self.kind)),
+        }
+    }
+}
+
+#[derive(Clone, Copy, Debug, PartialEq)]
+enum Status {
+    /// Resumed after a restart, waiting for its database to be reopened
+    Waiting,
+    Running,
+    Done,
+    Failed,
+    Cancelled,
+}
+
+impl Status {
+    fn name(&self) -> &'static str {
+        match *self {
+            Status::Waiting => "waiting",
+            Status::Running => "running",
+            Status::Done => "done",
+            Status::Failed => "failed",
+            Status::Cancelled => "cancelled",
+        }
+    }
+
+    fn parse(s: &str) -> Option<Status> {
+        match s {
+            "waiting" => Some(Status::Waiting),
+            "running" => Some(Status::Running),
+            "done" => Some(Status::Done),
+            "failed" => Some(Status::Failed),
+            "cancelled" => Some(Status::Cancelled),
+            _ => None,
+        }
+    }
+
+    fn finished(&self) -> bool {
+        match *self {
+            Status::Done | Status::Failed | Status::Cancelled => true,
+            Status::Waiting | Status::Running => false,
+        }
+    }
+}
+
+struct Progress {
+    status: Status,
+    /// Steps completed out of `total`; what a step is depends on the kind
+    done: usize,
+    total: usize,
+    started_s: u64,
+    finished_s: Option<u64>,
+    result: Option<Json>,
+    error: Option<String>,
+}
+
+pub struct Job {
+    id: String,
+    spec: JobSpec,
+    progress: Mutex<Progress>,
+    cancelled: AtomicBool,
+}
+
+impl Job {
+    /// Records that `done` of `total` steps are complete
+    ///
+    pub fn advance(&self, done: usize, total: usize) {
+        let mut progress = self.progress.lock().unwrap();
+        progress.done = done;
+        progress.total = total;
+    }
+
+    /// Whether the job should stop at its next step
+    ///
+    pub fn cancelled(&self) -> bool {
+        self.cancelled.load(Ordering::Relaxed)
+    }
+
+    fn status(&self) -> Status {
+        self.progress.lock().unwrap().status
+    }
+
+    fn set_status(&self, status: Status) {
+        self.progress.lock().unwrap().status = status;
+    }
+
+    fn finish(&self, outcome: Result<Json, String>) {
+        let mut progress = self.progress.lock().unwrap();
+        progress.finished_s = Some(now_s());
+        match (outcome, self.cancelled()) {
+            (_, true) => progress.status = Status::Cancelled,
+            (Ok(result), false) => {
+                progress.status = Status::Done;
+                progress.result = Some(result);
+            },
+            (Err(e), false) => {
+                progress.status = Status::Failed;
+                progress.error = Some(e);
+            },
+        }
+    }
+
+    fn save(&self) -> Saved {
+        let progress = self.progress.lock().unwrap();
+        Saved{
+            id: self.id.clone(),
+            spec: self.spec.clone(),
+            status: progress.status.name().to_string(),
+            done: progress.done,
+            total: progress.total,
+            started_s: progress.started_s,
+            finished_s: progress.finished_s,
+            result: progress.result.as_ref().map(|r| json::encode(r).unwrap()),
+            error: progress.error.clone(),
+        }
+    }
+}
+
+impl ToJson for Job {
+    fn to_json(&self) -> Json {
+        let progress = self.progress.lock().unwrap();
+
+        let mut d = BTreeMap::new();
+        d.insert("id".to_string(), self.id.to_json());
+        d.insert("kind".to_string(), self.spec.kind.to_json());
+        d.insert("db".to_string(), self.spec.db.to_json());
+        d.insert("status".to_string(), progress.status.name().to_json());
+        d.insert("done".to_string(), progress.done.to_json());
+        d.insert("total".to_string(), progress.total.to_json());
+        d.insert("started".to_string(), progress.started_s.to_json());
+        d.insert("finished".to_string(), progress.finished_s.to_json());
+        match progress.result {
+            Some(ref result) => { d.insert("result".to_string(), result.clone()); },
+            None => {},
+        }
+        match progress.error {
+            Some(ref e) => { d.insert("error".to_string(), e.to_json()); },
+            None => {},
+        }
+        Json::Object(d)
+    }
+}
+
+#[derive(RustcEncodable, RustcDecodable)]
+struct Saved {
+    id: String,
+    spec: JobSpec,
+    status: String,
+    done: usize,
+    total: usize,
+    started_s: u64,
+    finished_s: Option<u64>,
+    /// JSON-encoded
+    result: Option<String>,
+    error: Option<String>,
+}
+
+pub struct JobsKey;
+impl typemap::Key for JobsKey { type Value = Jobs; }
+
+pub struct Jobs {
+    /// In the order they were started
+    jobs: Mutex<Vec<Arc<Job>>>,
+    /// Where jobs are saved, with `--data-dir`
+    saved_path: Option<PathBuf>,
+    // Deletes are published as `/delete` publishes them
+    options: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>,
+    changes: Arc<ChangeFeed>,
+    mirror: Arc<Option<Mirror>>,
+    handoff: Arc<Handoff>,
+    b32: DBMap<u32>,
+    b64: DBMap<u64>,
+    b128: DBMap<[u64; 2]>,
+    b256: DBMap<[u64; 4]>,
+}
+
+impl Jobs {
+    /// Loads any jobs saved in `data_dir`; call `resume` to restart the
+    /// unfinished ones
+    ///
+    pub fn new(data_dir: &Option<PathBuf>, options: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, mirror: Arc<Option<Mirror>>, handoff: Arc<Handoff>, b32: DBMap<u32>, b64: DBMap<u64>, b128: DBMap<[u64; 2]>, b256: DBMap<[u64; 4]>) -> Jobs {
+        let saved_path = data_dir.as_ref().map(|dir| dir.join("jobs.json"));
+        let saved = match saved_path {
+            Some(ref path) => load(path),
+            None => vec![],
+        };
+
+        let jobs = saved.into_iter().map(|saved| {
+            let status = match Status::parse(&saved.status) {
+                Some(status) if status.finished() => status,
+                _ => Status::Waiting,
+            };
+            let progress = Progress{
+                status: status,
+                done: if status.finished() { saved.done } else { 0 },
+                total: saved.total,
+                started_s: saved.started_s,
+                finished_s: saved.finished_s,
+                result: saved.result.and_then(|r| Json::from_str(&r).ok()),
+                error: saved.error,
+            };
+            Arc::new(Job{id: saved.id, spec: saved.spec, progress: Mutex::new(progress), cancelled: AtomicBool::new(false)})
+        }).collect();
+
+        Jobs{
+            jobs: Mutex::new(jobs),
+            saved_path: saved_path,
+            options: options,
+            changes: changes,
+            mirror: mirror,
+            handoff: handoff,
+            b32: b32,
+            b64: b64,
+            b128: b128,
+            b256: b256,
+        }
+    }
+
+    fn get(&self, id: &str) -> Option<Arc<Job>> {
+        self.jobs.lock().unwrap().iter().find(|job| job.id == id).cloned()
+    }
+
+    fn db_exists(&self, spec: &JobSpec) -> bool {
+        let (bits, tolerance, namespace) = match spec.db() {
+            Ok(db) => db,
+            Err(_) => return false,
+        };
+        let key = (tolerance, namespace);
+        match bits {
+            32 => self.b32.read().unwrap().contains_key(&key),
+            64 => self.b64.read().unwrap().contains_key(&key),
+            128 => self.b128.read().unwrap().contains_key(&key),
+            256 => self.b256.read().unwrap().contains_key(&key),
+            _ => false,
+        }
+    }
+
+    fn run(&self, job: &Job, resumed: bool) -> Result<Json, String> {
+        let (bits, tolerance, namespace) = try!(job.spec.db());
+        match bits {
+            32 => run(self, job, bits, &self.b32, tolerance, namespace, resumed),
+            64 => run(self, job, bits, &self.b64, tolerance, namespace, resumed),
+            128 => run(self, job, bits, &self.b128, tolerance, namespace, resumed),
+            256 => run(self, job, bits, &self.b256, tolerance, namespace, resumed),
+            _ => Err(format!("unsupported bitsize {}", bits)),
+        }
+    }
+
+    /// Drops the oldest finished jobs beyond `MAX_FINISHED`, then saves the
+    /// rest
+    ///
+    fn finished(&self) {
+        let mut jobs = self.jobs.lock().unwrap();
+
+        let finished = jobs.iter().filter(|job| job.status().finished()).count();
+        let mut excess = finished.saturating_sub(MAX_FINISHED);
+        jobs.retain(|job| {
+            match excess > 0 && job.status().finished() {
+                true => { excess -= 1; false },
+                false => true,
+            }
+        });
+
+        self.save(&jobs);
+    }
+
+    /// Saves `jobs`, if there's somewhere to save them; the caller holds the
+    /// jobs lock
+    ///
+    fn save(&self, jobs: &Vec<Arc<Job>>) {
+        let path = match self.saved_path {
+            Some(ref path) => path,
+            None => return,
+        };
+        let saved: Vec<Saved> = jobs.iter().map(|job| job.save()).collect();
+
+        // Written alongside and renamed, so a crash can't leave half a file
+        let tmp = path.with_extension("json.tmp");
+        let result = File::create(&tmp)
+            .and_then(|mut f| f.write_all(json::encode(&saved).unwrap().as_bytes()).and_then(|_| f.sync_all()))
+            .and_then(|_| fs::rename(&tmp, path));
+        match result {
+            Ok(_) => {},
+            Err(e) => log!("WARNING: unable to save jobs to {}: {}", path.display(), e),
+        }
+    }
+}
+
+/// Starts a job described by `spec`, which must be valid
+///
+pub fn start(jobs: Arc<Jobs>, spec: JobSpec) -> Arc<Job> {
+    let progress = Progress{status: Status::Running, done: 0, total: 0, started_s: now_s(), finished_s: None, result: None, error: None};
+    let job = Arc::new(Job{
+        id: format!("{:016x}", rand::random::<u64>()),
+        spec: spec,
+        progress: Mutex::new(progress),
+        cancelled: AtomicBool::new(false),
+    });
+
+    {
+        let mut all = jobs.jobs.lock().unwrap();
+        all.push(job.clone());
+        jobs.save(&all);
+    }
+
+    spawn(jobs, job.clone(), false);
+    job
+}
+
+/// Restarts jobs which hadn't finished when the server last stopped
+///
+pub fn resume(jobs: Arc<Jobs>) {
+    let waiting: Vec<Arc<Job>> = jobs.jobs.lock().unwrap().iter().filter(|job| job.status() == Status::Waiting).cloned().collect();
+
+    for job in waiting.into_iter() {
+        log!("Resuming {} job {} on {}", job.spec.kind, job.id, job.spec.db);
+        spawn(jobs.clone(), job, true);
+    }
+}
+
+fn spawn(jobs: Arc<Jobs>, job: Arc<Job>, resumed: bool) {
+    thread::spawn(move || {
+        let outcome = jobs.run(&job, resumed);
+        match outcome {
+            Err(ref e) if !job.cancelled() => log!("WARNING: {} job {} on {} failed: {}", job.spec.kind, job.id, job.spec.db, e),
+            _ => {},
+        }
+        job.finish(outcome);
+        jobs.finished();
+    });
+}
+
+fn run<T>(jobs: &Jobs, job: &Job, bits: usize, dbmap_mx: &DBMap<T>, tolerance: usize, namespace: String, resumed: bool) -> Result<Json, String> where
+T: Clone + Eq + Hash + Encodable + Decodable + FromBits + Hamming + BitMask,
+{
+    let db_mx = try!(wait_for_db(job, dbmap_mx, tolerance, namespace.clone(), resumed));
+    job.set_status(Status::Running);
+
+    match &job.spec.kind[..] {
+        "check" => integrity(job, db_mx.read().unwrap().check()),
+        "repair" => repair(job, &db_mx),
+        "cluster" => cluster(job, &**db_mx.read().unwrap(), tolerance),
+        "delete" => delete(jobs, job, bits, dbmap_mx, &db_mx, tolerance, namespace),
+        kind => Err(format!("unknown job kind '{}'", kind)),
+    }
+}
+
+/// The job's database; resumed jobs wait for it to be reopened
+///
+fn wait_for_db<T>(job: &Job, dbmap_mx: &DBMap<T>, tolerance: usize, namespace: String, resumed: bool) -> Result<Arc<RwLock<Box<Database<T>>>>, String> {
+    loop {
+        match { dbmap_mx.read().unwrap().get(&(tolerance, namespace.clone())).cloned() } {
+            Some(db_mx) => return Ok(db_mx),
+            None if !resumed => return Err("DB not found".to_string()),
+            None => {},
+        }
+        if job.cancelled() {
+            return Err("cancelled".to_string())
+        }
+        thread::sleep(Duration::from_secs(1));
+    }
+}
+
+fn integrity(job: &Job, report: Option<IntegrityReport>) -> Result<Json, String> {
+    match report {
+        Some(report) => {
+            job.advance(report.values, report.values);
+            Ok(report_json(&report))
+        },
+        None => Err("not supported by this database".to_string()),
+    }
+}
+
+/// Repairs the database a batch at a time: the fixes are found under the
+/// read lock, and the write lock is taken for each batch of them, so writes
+/// carry on in between
+///
+fn repair<T>(job: &Job, db_mx: &RwLock<Box<Database<T>>>) -> Result<Json, String> {
+    let plan = db_mx.read().unwrap().plan_repair();
+    let mut plan = match plan {
+        Some(plan) => plan,
+        None => return Err("not supported by this database".to_string()),
+    };
+
+    let total = plan.remaining();
+    job.advance(0, total);
+    while plan.remaining() > 0 {
+        if job.cancelled() {
+            break
+        }
+        db_mx.write().unwrap().repair_batch(&mut plan, REPAIR_BATCH);
+        job.advance(total - plan.remaining(), total);
+    }
+
+    Ok(report_json(&plan.report))
+}
+
+fn report_json(report: &IntegrityReport) -> Json {
+    let mut d = BTreeMap::new();
+    d.insert("values".to_string(), report.values.to_json());
+    d.insert("missing".to_string(), report.missing.to_json());
+    d.insert("dangling".to_string(), report.dangling.to_json());
+    Json::Object(d)
+}
+
+/// Clusters every value in the database, as `GET /cluster` does; holds the
+/// database's read lock throughout, so writes wait until it's finished
+///
+fn cluster<T>(job: &Job, db: &Database<T>, tolerance: usize) -> Result<Json, String> where
+T: Clone + Eq + Hash + Encodable + Hamming,
+{
+    let mut keys = vec![];
+    try!(db.for_each(&mut |v| { keys.push(v.clone()); Ok(()) }));
+    let total = keys.len();
+    job.advance(0, total);
+
+    let min_size = job.spec.min_size.unwrap_or(2);
+    let clusters: Vec<Vec<String>> = single_linkage(db, keys, job.spec.radius.unwrap_or(tolerance)).into_iter()
+        .filter(|c| c.len() >= min_size)
+        .map(|c| c.iter().map(|v| encode_value(v)).collect())
+        .collect();
+
+    job.advance(total, total);
+    Ok(clusters.to_json())
+}
+
+/// Deletes the values matching the job's predicate, a batch at a time, as
+/// `/delete` does
+///
+/// Batches are paced so that no more than the job's `rate` values are deleted
+/// per second, and queries can run between them.
+///
+fn delete<T>(jobs: &Jobs, job: &Job, bits: usize, dbmap_mx: &DBMap<T>, db_mx: &RwLock<Box<Database<T>>>, tolerance: usize, namespace: String) -> Result<Json, String> where
+T: Clone + Eq + Hash + Encodable + Decodable + FromBits + BitMask,
+{
+    let targets: Vec<T> = match (&job.spec.values, &job.spec.older_than, &job.spec.mask, &job.spec.pattern) {
+        (&Some(ref values), _, _, _) => {
+            let values = values.iter().map(|v| Json::String(v.clone())).collect();
+            try!(decode_values(values, ValueEncoding::Base64, BitOrder::MsbFirst).into_iter().collect::<Result<Vec<T>, String>>())
+        },
+        (_, &Some(ref older_than), _, _) => {
+            let insert_times = match jobs.options.read().unwrap().get(&(bits, tolerance, namespace.clone())) {
+                Some(options) => options.records_insert_times(),
+                None => false,
+            };
+            if !insert_times {
+                return Err("insert times aren't recorded for this DB (see the insert_times option)".to_string())
+            }
+
+            let cutoff = SystemTime::now() - Duration::from_secs(try!(parse_duration(older_than)));
+            db_mx.read().unwrap().inserted_before(cutoff)
+        },
+        (_, _, &Some(ref mask), &Some(ref pattern)) => {
+            let mask: T = try!(decode_value(mask));
+            let pattern = try!(decode_value::<T>(pattern)).mask(&mask);
+
+            let mut matches = vec![];
+            try!(db_mx.read().unwrap().for_each(&mut |v| {
+                if v.mask(&mask) == pattern {
+                    matches.push(v.clone());
+                }
+                Ok(())
+            }));
+            matches
+        },
+        _ => return Err("nothing to delete".to_string()),
+    };
+
+    let total = targets.len();
+    let rate = job.spec.rate.unwrap_or(DEFAULT_DELETE_RATE);
+    let mut done = 0;
+    let mut deleted = 0;
+    job.advance(0, total);
+
+    for batch in targets.chunks(min(rate, DELETE_BATCH)) {
+        if job.cancelled() {
+            break
+        }
+        let started = Instant::now();
+
+        let values = batch.iter().map(|v| Ok(v.clone())).collect();
+        let results = delete_values(values, bits, tolerance, namespace.clone(), jobs.changes.clone(), jobs.mirror.clone(), jobs.handoff.clone(), dbmap_mx.clone());
+        deleted += results.iter().filter(|r| match **r { DeleteResult::Ok => true, _ => false }).count();
+        done += batch.len();
+        job.advance(done, total);
+
+        let pace = Duration::from_millis((batch.len() * 1000 / rate) as u64);
+        let elapsed = started.elapsed();
+        if elapsed < pace {
+            thread::sleep(pace - elapsed);
+        }
+    }
+
+    let mut d = BTreeMap::new();
+    d.insert("matched".to_string(), total.to_json());
+    d.insert("deleted".to_string(), deleted.to_json());
+    Ok(Json::Object(d))
+}
+
+fn decode_value<T: Decodable + FromBits>(value: &String) -> Result<T, String> {
+    decode_values(vec![Json::String(value.clone())], ValueEncoding::Base64, BitOrder::MsbFirst).pop().unwrap()
+}
+
+fn load(path: &PathBuf) -> Vec<Saved> {
+    let mut contents = String::new();
+    match File::open(path).and_then(|mut f| f.read_to_string(&mut contents)) {
+        Ok(_) => {},
+        Err(_) => return vec![],
+    }
+
+    match json::decode::<Vec<Saved>>(&contents) {
+        Ok(saved) => saved,
+        Err(e) => {
+            log!("WARNING: ignoring unreadable jobs in {}: {}", path.display(), e);
+            vec![]
+        },
+    }
+}
+
+fn now_s() -> u64 {
+    SystemTime::now().duration_since(UNIX_EPOCH).unwrap().as_secs()
+}
+
+/// Whether the request's token has at least `required` scope in the job's
+/// namespace; never, if the job's database can't be parsed
+///
+fn allowed(req: &Request, job: &Job, required: Scope) -> bool {
+    match job.spec.db() {
+        Ok((_, _, namespace)) => auth::allowed(req, &namespace, required),
+        Err(_) => false,
+    }
+}
+
+pub fn create(req: &mut Request) -> IronResult<Response> {
+    let spec = try!(decode_body::<JobSpec>(req));
+    let jobs = req.get::<Read<JobsKey>>().unwrap();
+
+    let namespace = match spec.validate().and_then(|_| spec.db()) {
+        Ok((_, _, namespace)) => namespace,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+    if !auth::allowed(req, &namespace, Scope::Admin) {
+        return Ok(Response::with((status::Forbidden, "starting a job needs an admin token for its namespace")))
+    }
+    if !jobs.db_exists(&spec) {
+        return Ok(Response::with((status::NotFound, "DB not found")))
+    }
+
+    // Jobs aren't handed over by upgrades
+    let handoff = jobs.handoff.clone();
+    let _admitted = match handoff.admit_unjournaled() {
+        Ok(admitted) => admitted,
+        Err(e) => return Ok(Response::with((status::ServiceUnavailable, e))),
+    };
+    let job = start(jobs, spec);
+    Ok(Response::with((status::Accepted, json::encode(&job.to_json()).unwrap())))
+}
+
+pub fn list(req: &mut Request) -> IronResult<Response> {
+    let jobs = req.get::<Read<JobsKey>>().unwrap();
+    let all: Vec<Json> = jobs.jobs.lock().unwrap().iter()
+        .filter(|job| allowed(req, job, Scope::Data))
+        .map(|job| job.to_json())
+        .collect();
+
+    Ok(Response::with((status::Ok, json::encode(&all).unwrap())))
+}
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let id = req.extensions.get::<Router>().unwrap().find("id").unwrap_or("").to_string();
+    let jobs = req.get::<Read<JobsKey>>().unwrap();
+
+    match jobs.get(&id) {
+        Some(ref job) if !allowed(req, job, Scope::Data) => Ok(Response::with((status::Forbidden, "reading a job needs a token for its namespace"))),
+        Some(job) => Ok(Response::with((status::Ok, json::encode(&job.to_json()).unwrap()))),
+        None => Ok(Response::with((status::NotFound, "job not found"))),
+    }
+}
+
+pub fn cancel(req: &mut Request) -> IronResult<Response> {
+    let id = req.extensions.get::<Router>().unwrap().find("id").unwrap_or("").to_string();
+    let jobs = req.get::<Read<JobsKey>>().unwrap();
+
+    match jobs.get(&id) {
+        Some(ref job) if !allowed(req, job, Scope::Admin) => Ok(Response::with((status::Forbidden, "cancelling a job needs an admin token for its namespace"))),
+        Some(job) => {
+            job.cancelled.store(true, Ordering::Relaxed);
+            Ok(Response::with((status::Ok, json::encode(&job.to_json()).unwrap())))
+        },
+        None => Ok(Response::with((status::NotFound, "job not found"))),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use http::jobs::JobSpec;
+
+    fn spec(kind: &str, db: &str) -> JobSpec {
+        JobSpec{kind: kind.to_string(), db: db.to_string(), radius: None, min_size: None, values: None, older_than: None, mask: None, pattern: None, rate: None}
+    }
+
+    #[test]
+    fn specs_need_a_binary_db() {
+        assert!(spec("check", "b/64/8/foo").validate().is_ok());
+        assert!(spec("repair", "b/64/8/foo/bar").validate().is_ok());
+        assert!(spec("check", "v/64/8/foo").validate().is_err());
+        assert!(spec("check", "b/64/foo").validate().is_err());
+        assert!(spec("check", "b/64/x/foo").validate().is_err());
+        assert!(spec("compact", "b/64/8/foo").validate().is_err());
+    }
+
+    #[test]
+    fn cluster_radius_is_at_most_the_tolerance() {
+        let mut cluster = spec("cluster", "b/64/8/foo");
+        assert!(cluster.validate().is_ok());
+        cluster.radius = Some(8);
+        assert!(cluster.validate().is_ok());
+        cluster.radius = Some(9);
+        assert!(cluster.validate().is_err());
+    }
+
+    #[test]
+    fn deletes_take_one_predicate() {
+        let delete = spec("delete", "b/64/8/foo");
+        assert!(delete.validate().is_err());
+
+        let mut by_values = delete.clone();
+        by_values.values = Some(vec!["AAAAAAAAAAE=".to_string()]);
+        assert!(by_values.validate().is_ok());
+
+        let mut by_age = delete.clone();
+        by_age.older_than = Some("30d".to_string());
+        assert!(by_age.validate().is_ok());
+        by_age.older_than = Some("a while".to_string());
+        assert!(by_age.validate().is_err());
+
+        let mut by_pattern = delete.clone();
+        by_pattern.mask = Some("AAAAAAAAAP8=".to_string());
+        assert!(by_pattern.validate().is_err());
+        by_pattern.pattern = Some("AAAAAAAAAAE=".to_string());
+        assert!(by_pattern.validate().is_ok());
+
+        let mut both = by_values.clone();
+        both.older_than = Some("30d".to_string());
+        assert!(both.validate().is_err());
+
+        let mut stopped = by_values.clone();
+        stopped.rate = Some(0);
+        assert!(stopped.validate().is_err());
+        stopped.rate = Some(10);
+        assert!(stopped.validate().is_ok());
+    }
+}
@@ -0,0 +1,132 @@
+//! Pairwise joins between namespaces
+//!
+//! `GET /join/b/:bits/:tolerance/:namespace/:other` finds every pair of values
+//! `(a, b)` with `a` stored in `b/:bits/:tolerance/:namespace` and `b` stored in
+//! `b/:bits/:tolerance/:other` which are within tolerance of each other.  Pairs
+//! are streamed as they're found, one JSON array of two base64-encoded values
+//! per line:
+//!
+//! ```json
+//! ["AAAAAAAAAAE=","AAAAAAAAAAM="]
+//! ```
+
+use std::collections::HashMap;
+use std::io;
+use std::io::Write;
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::response::{WriteBody, ResponseBody};
+use iron::status;
+use router::Router;
+use persistent::State;
+use rustc_serialize::json;
+use rustc_serialize::Encodable;
+
+use hammer::db::Database;
+
+use http::{B32, B64, B128, B256};
+use http::binary_handler::encode_value;
+
+/// Streams the pairs found by querying `other` with each of `values`
+///
+struct Pairs<T> {
+    values: Vec<T>,
+    other: Arc<RwLock<Box<Database<T>>>>,
+    // Set when joining a namespace with itself, to skip pairing each value
+    // with itself
+    skip_identical: bool,
+}
+
+impl<T: 'static + Sync + Send + Eq + Encodable> WriteBody for Pairs<T> {
+    fn write_body(&mut self, res: &mut ResponseBody) -> io::Result<()> {
+        for a in self.values.iter() {
+            // Only hold the read lock for one query at a time, so writes to
+            // `other` aren't held up by the whole join
+            let found = { self.other.read().unwrap().get(a) };
+
+            let found = match found {
+                Some(found) => found,
+                None => continue,
+            };
+
+            let a_b64 = encode_value(a);
+            for b in found.iter() {
+                if self.skip_identical && a == b {
+                    continue
+                }
+                try!(writeln!(res, "{}", json::encode(&(a_b64.clone(), encode_value(b))).unwrap()));
+            }
+            try!(res.flush());
+        }
+
+        Ok(())
+    }
+}
+
+pub fn join(req: &mut Request) -> IronResult<Response> {
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let other = match req.extensions.get::<Router>().unwrap().find("other") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "Namespace to join with is required"))),
+    };
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_join(tolerance, namespace, other, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_join(tolerance, namespace, other, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_join(tolerance, namespace, other, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_join(tolerance, namespace, other, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_join<T>(tolerance: usize, namespace: String, other: String, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
+T: 'static + Sync + Send + Clone + Eq + Encodable,
+{
+    let (db_mx, other_mx) = {
+        let dbmap = dbmap_mx.read().unwrap();
+        match (dbmap.get(&(tolerance, namespace.clone())), dbmap.get(&(tolerance, other.clone()))) {
+            (Some(db_mx), Some(other_mx)) => (db_mx.clone(), other_mx.clone()),
+            (None, _) => return Ok(Response::with((status::NotFound, format!("DB {} not found", namespace)))),
+            (_, None) => return Ok(Response::with((status::NotFound, format!("DB {} not found", other)))),
+        }
+    };
+
+    // As with /keys, the values being joined are copied out under the read
+    // lock
+    let mut values = vec![];
+    let result = { db_mx.read().unwrap().for_each(&mut |v| { values.push(v.clone()); Ok(()) }) };
+    match result {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::NotFound, e))),
+    }
+
+    let pairs: Box<WriteBody + Send> = Box::new(Pairs{values: values, other: other_mx, skip_identical: namespace == other});
+    Ok(Response::with((status::Ok, pairs)))
+}
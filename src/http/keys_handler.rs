@@ -0,0 +1,284 @@
+use std::collections::{BTreeMap, HashMap};
+use std::sync::{Arc, RwLock};
+use std::time::UNIX_EPOCH;
+
+use bincode;
+use rand;
+use rand::Rng;
+use iron::prelude::*;
+use iron::status;
+use iron::mime::Mime;
+use router::Router;
+use persistent::State;
+use rustc_serialize::json;
+use rustc_serialize::json::Json;
+use rustc_serialize::Encodable;
+
+use hammer::db::Database;
+use hammer::hyperplane::FromBits;
+
+use http::{B32, B64, B128, B256, BitOrder, query_param, bit_order, encode_bits};
+use http::binary_handler::encode_value;
+
+/// How listed values are written
+///
+enum Encoding {
+    /// A JSON array of base64-encoded values
+    Base64,
+    /// A JSON array of bit strings (`?encoding=binary`)
+    Bits(BitOrder),
+    /// The values' bytes, concatenated (`?encoding=raw`).  Every value of a
+    /// given bitsize is the same width, so the response is a sequence of
+    /// fixed-width records which analytics tools can load without parsing,
+    /// and which (unlike CSV of integers) loses nothing for keys wider than
+    /// 53 bits.
+    Raw,
+}
+
+/// List every value stored in a binary DB
+///
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let encoding = match query_param(req, "encoding") {
+        Some(ref v) if v == "binary" => match bit_order(req) {
+            Ok(order) => Encoding::Bits(order),
+            Err(e) => return Ok(Response::with((status::BadRequest, e))),
+        },
+        Some(ref v) if v == "raw" => Encoding::Raw,
+        Some(ref v) if v != "base64" => return Ok(Response::with((status::BadRequest, format!("unknown encoding '{}'", v)))),
+        _ => Encoding::Base64,
+    };
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_show(tolerance, namespace, encoding, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_show(tolerance, namespace, encoding, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_show(tolerance, namespace, encoding, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_show(tolerance, namespace, encoding, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_show<T: Clone + Encodable + FromBits>(tolerance: usize, namespace: String, encoding: Encoding, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> {
+    let db_mx = match { dbmap_mx.read().unwrap().get(&(tolerance, namespace)).cloned() } {
+        Some(db_mx) => db_mx,
+        None => return Ok(Response::with((status::NotFound, "DB not found"))),
+    };
+
+    // Copy the values out under the read lock, so writes only wait for the
+    // iteration itself and the listing is a consistent snapshot
+    let mut values = vec![];
+    let result = {
+        db_mx.read().unwrap().for_each(&mut |v| { values.push(v.clone()); Ok(()) })
+    };
+
+    match result {
+        Ok(_) => match encoding {
+            Encoding::Raw => {
+                let mut response_body = vec![];
+                for v in values.iter() {
+                    response_body.extend(bincode::rustc_serialize::encode(v, bincode::SizeLimit::Infinite).unwrap());
+                }
+                let content_type = "application/octet-stream".parse::<Mime>().unwrap();
+                Ok(Response::with((status::Ok, content_type, response_body)))
+            },
+            Encoding::Bits(order) => {
+                let encoded = values.iter().map(|v| encode_bits(v, order)).collect::<Vec<String>>();
+                Ok(Response::with((status::Ok, json::encode(&encoded).unwrap())))
+            },
+            Encoding::Base64 => {
+                let encoded = values.iter().map(|v| encode_value(v)).collect::<Vec<String>>();
+                Ok(Response::with((status::Ok, json::encode(&encoded).unwrap())))
+            },
+        },
+        Err(e) => Ok(not_listable(e)),
+    }
+}
+
+/// The response when iterating a DB fails, which only happens (since the
+/// handlers' callbacks don't fail) when its type doesn't support iteration
+///
+fn not_listable(e: String) -> Response {
+    Response::with((status::NotImplemented, format!("this database's values can't be listed: {}", e)))
+}
+
+/// List a uniform random sample of the values stored in a binary DB
+///
+/// `?n=` values are sampled (by default 100).  With `?times=true` each value
+/// is returned as an object along with the (unix) time it was inserted, or
+/// null if the DB doesn't record insert times.
+///
+pub fn sample(req: &mut Request) -> IronResult<Response> {
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let n = match query_param(req, "n") {
+        Some(v) => match v.parse::<usize>() {
+            Ok(n) => n,
+            Err(e) => return Ok(Response::with((status::BadRequest, format!("invalid n '{}': {}", v, e)))),
+        },
+        None => 100,
+    };
+
+    let times = query_param(req, "times") == Some("true".to_string());
+
+    let encoding = match query_param(req, "encoding") {
+        Some(ref v) if v == "binary" => match bit_order(req) {
+            Ok(order) => Encoding::Bits(order),
+            Err(e) => return Ok(Response::with((status::BadRequest, e))),
+        },
+        Some(ref v) if v != "base64" => return Ok(Response::with((status::BadRequest, format!("unknown encoding '{}'", v)))),
+        _ => Encoding::Base64,
+    };
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_sample(tolerance, namespace, n, times, encoding, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_sample(tolerance, namespace, n, times, encoding, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_sample(tolerance, namespace, n, times, encoding, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_sample(tolerance, namespace, n, times, encoding, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_sample<T: Clone + Encodable + FromBits>(tolerance: usize, namespace: String, n: usize, times: bool, encoding: Encoding, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> {
+    let db_mx = match { dbmap_mx.read().unwrap().get(&(tolerance, namespace)).cloned() } {
+        Some(db_mx) => db_mx,
+        None => return Ok(Response::with((status::NotFound, "DB not found"))),
+    };
+
+    let db = db_mx.read().unwrap();
+
+    // Reservoir sampling, so only the sample is copied out of the DB
+    let mut rng = rand::thread_rng();
+    let mut seen = 0;
+    let mut values: Vec<T> = Vec::with_capacity(n);
+    let result = db.for_each(&mut |v| {
+        if values.len() < n {
+            values.push(v.clone());
+        } else {
+            let i = rng.gen_range(0, seen + 1);
+            if i < n {
+                values[i] = v.clone();
+            }
+        }
+        seen += 1;
+        Ok(())
+    });
+
+    match result {
+        Ok(_) => {},
+        Err(e) => return Ok(not_listable(e)),
+    }
+
+    let encoded = values.iter().map(|v| {
+        let value = match encoding {
+            Encoding::Bits(order) => encode_bits(v, order),
+            _ => encode_value(v),
+        };
+        if !times {
+            return Json::String(value)
+        }
+
+        let inserted_at = match db.inserted_at(v) {
+            Some(t) => match t.duration_since(UNIX_EPOCH) {
+                Ok(d) => Json::U64(d.as_secs()),
+                Err(_) => Json::Null,
+            },
+            None => Json::Null,
+        };
+        let mut obj = BTreeMap::new();
+        obj.insert("value".to_string(), Json::String(value));
+        obj.insert("inserted_at".to_string(), inserted_at);
+        Json::Object(obj)
+    }).collect::<Vec<Json>>();
+
+    Ok(Response::with((status::Ok, json::encode(&Json::Array(encoded)).unwrap())))
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::{HashMap, HashSet};
+    use std::sync::{Arc, RwLock};
+
+    use iron::status;
+
+    use hammer::db::Database;
+
+    use http::keys_handler::{Encoding, do_show, do_sample};
+
+    /// A database which can't be iterated
+    struct Unlistable;
+
+    impl Database<u64> for Unlistable {
+        fn get(&self, _: &u64) -> Option<HashSet<u64>> { None }
+        fn insert(&mut self, _: u64) -> bool { false }
+        fn remove(&mut self, _: &u64) -> bool { false }
+    }
+
+    fn dbmap() -> Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>> {
+        let mut dbmap = HashMap::new();
+        dbmap.insert((4, "foo".to_string()), Arc::new(RwLock::new(Box::new(Unlistable) as Box<Database<u64>>)));
+        Arc::new(RwLock::new(dbmap))
+    }
+
+    #[test]
+    fn unlistable_dbs_are_not_implemented() {
+        let response = do_show(4, "foo".to_string(), Encoding::Base64, dbmap()).unwrap();
+        assert_eq!(response.status, Some(status::NotImplemented));
+
+        let response = do_sample(4, "foo".to_string(), 10, false, Encoding::Base64, dbmap()).unwrap();
+        assert_eq!(response.status, Some(status::NotImplemented));
+
+        let response = do_show(4, "bar".to_string(), Encoding::Base64, dbmap()).unwrap();
+        assert_eq!(response.status, Some(status::NotFound));
+    }
+}
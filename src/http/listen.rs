@@ -0,0 +1,85 @@
+//! Listening on sockets passed in by the service manager
+//!
+//! With systemd socket activation (or any fd handoff using the same
+//! convention, such as `systemfd`), the server inherits already-bound
+//! listening sockets rather than binding its own: `LISTEN_FDS` is the number
+//! of sockets, passed as fds 3, 4, ..., and `LISTEN_PID` is the process they
+//! are meant for.  The first socket serves the API and the second, if any,
+//! the admin endpoints.
+//!
+//! Sockets are passed the same way to the new process during an upgrade (see
+//! `upgrade`), without `LISTEN_PID`: the old process can't know the new one's
+//! PID before starting it.
+
+use std::env;
+use std::fs;
+use std::net::TcpListener;
+use std::os::unix::io::{FromRawFd, RawFd};
+
+use hyper::net::HttpListener;
+use hyper::server::Server;
+use iron::{Handler, Iron, Protocol};
+
+/// The first fd passed by systemd
+const LISTEN_FDS_START: RawFd = 3;
+
+/// Sockets passed to this process, if any
+///
+/// The environment variables are cleared so that child processes (i.e. the
+/// reranker) don't also try to use the sockets.
+///
+pub fn inherited_listeners() -> Result<Vec<TcpListener>, String> {
+    let fds = match env::var("LISTEN_FDS") {
+        Ok(v) => v,
+        Err(_) => return Ok(vec![]),
+    };
+    let pid = env::var("LISTEN_PID");
+    env::remove_var("LISTEN_FDS");
+    env::remove_var("LISTEN_PID");
+    env::remove_var("LISTEN_FDNAMES");
+
+    // The sockets were meant for another process (i.e. our parent) if the
+    // PID doesn't match
+    match pid {
+        Ok(pid) => if pid != try!(own_pid()) { return Ok(vec![]) },
+        Err(_) => {},
+    }
+
+    let fds = match fds.parse::<RawFd>() {
+        Ok(n) => n,
+        Err(e) => return Err(format!("unable to parse LISTEN_FDS '{}': {}", fds, e)),
+    };
+
+    // NOTE: The fds must be listening TCP sockets; systemd doesn't say what
+    // kind of socket it passed, so this trusts the unit's configuration
+    Ok((LISTEN_FDS_START..LISTEN_FDS_START + fds).map(|fd| unsafe { TcpListener::from_raw_fd(fd) }).collect())
+}
+
+/// The current PID, as a string
+///
+fn own_pid() -> Result<String, String> {
+    match fs::read_link("/proc/self") {
+        Ok(path) => Ok(path.to_string_lossy().into_owned()),
+        Err(e) => Err(format!("unable to read /proc/self: {}", e)),
+    }
+}
+
+pub fn bind(addr: &str) -> TcpListener {
+    match TcpListener::bind(addr) {
+        Ok(listener) => listener,
+        Err(e) => panic!("unable to bind {}: {}", addr, e),
+    }
+}
+
+/// Serve `handler` on `listener`
+///
+pub fn serve<H: Handler>(handler: H, listener: TcpListener) {
+    // Iron can only bind its own sockets (which can't then be passed on in an
+    // upgrade), so it's served directly by hyper; Iron needs the address to
+    // build request URLs
+    let mut iron = Iron::new(handler);
+    iron.addr = Some(listener.local_addr().unwrap());
+    iron.protocol = Some(Protocol::Http);
+
+    Server::new(HttpListener::from(listener)).handle(iron).unwrap();
+}
@@ -0,0 +1,219 @@
+//! Bulk loading
+//!
+//! `Loader` adds values to a binary DB on a running server, `BATCH_SIZE` at
+//! a time, i.e. for `hammerhttp gen --server=...` and `hammerhttp import`.  Values the server rejects
+//! are counted rather than stopping the load; a request failing outright
+//! stops it, unless the server was busy (a 503, i.e. from `--max-pending-writes`),
+//! in which case it's retried a few times.
+//!
+//! `request` and `get` make the requests of the other commands talking to a
+//! server.  Like the server's own requests, they send the token in
+//! `HAMMER_AUTH_TOKEN`, if it's set.
+
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::TcpStream;
+use std::thread;
+use std::time::Duration;
+
+use rustc_serialize::Encodable;
+use rustc_serialize::json;
+
+use http::auth::client_token;
+use http::binary_handler::encode_value;
+
+/// Values added by each request
+const BATCH_SIZE: usize = 1000;
+
+/// Times a batch is retried while the server is busy
+const BUSY_RETRIES: usize = 10;
+
+/// Delay before retrying a batch the server was too busy for; the write
+/// throttle's shortest `Retry-After`
+const BUSY_DELAY_S: u64 = 1;
+
+/// Summary of a load
+///
+#[derive(Debug, Default)]
+pub struct Summary {
+    pub added: usize,
+    /// Values the DB already held
+    pub exists: usize,
+    /// Values the server rejected
+    pub errors: usize,
+}
+
+/// Adds base64-encoded values to a binary DB, `BATCH_SIZE` at a time
+///
+pub struct Loader {
+    server: String,
+    path: String,
+    batch: Vec<String>,
+    summary: Summary,
+}
+
+impl Loader {
+    /// Loads into `b/:bits/:tolerance/:namespace` on `server`
+    ///
+    pub fn new(server: &str, bits: usize, tolerance: usize, namespace: &str) -> Loader {
+        Loader{
+            server: server.to_string(),
+            path: format!("/add/b/{}/{}/{}", bits, tolerance, namespace),
+            batch: Vec::with_capacity(BATCH_SIZE),
+            summary: Summary::default(),
+        }
+    }
+
+    pub fn add(&mut self, encoded: String) -> Result<(), String> {
+        self.batch.push(encoded);
+        match self.batch.len() {
+            BATCH_SIZE => self.flush(),
+            _ => Ok(()),
+        }
+    }
+
+    /// Adds any values left in the current batch
+    ///
+    pub fn finish(mut self) -> Result<Summary, String> {
+        try!(self.flush());
+        Ok(self.summary)
+    }
+
+    fn flush(&mut self) -> Result<(), String> {
+        if self.batch.is_empty() {
+            return Ok(())
+        }
+
+        let body = json::encode(&self.batch).unwrap();
+        let mut retries = 0;
+        let mut result = try!(request(&self.server, "POST", &self.path, &body));
+        while result.0 == 503 && retries < BUSY_RETRIES {
+            retries += 1;
+            thread::sleep(Duration::from_secs(BUSY_DELAY_S));
+            result = try!(request(&self.server, "POST", &self.path, &body));
+        }
+        let response = match result {
+            (200, response) => response,
+            (status, response) => return Err(format!("{}: {}", status, response)),
+        };
+        self.batch.clear();
+
+        let results = match json::decode::<Vec<String>>(&response) {
+            Ok(results) => results,
+            Err(e) => return Err(format!("unexpected response '{}': {}", response, e)),
+        };
+        for result in results.iter() {
+            match &result[..] {
+                "ok" => self.summary.added += 1,
+                "exists" => self.summary.exists += 1,
+                _ => self.summary.errors += 1,
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Adds `values` to `b/:bits/:tolerance/:namespace` on `server`
+///
+pub fn run<T, I>(server: &str, bits: usize, tolerance: usize, namespace: &str, values: I) -> Result<Summary, String> where
+T: Encodable,
+I: Iterator<Item=T>,
+{
+    let mut loader = Loader::new(server, bits, tolerance, namespace);
+    for value in values {
+        try!(loader.add(encode_value(&value)));
+    }
+    loader.finish()
+}
+
+/// Authorization header for requests, if `HAMMER_AUTH_TOKEN` is set (see
+/// `auth`)
+///
+fn authorization() -> String {
+    match client_token() {
+        Some(token) => format!("Authorization: Bearer {}\r\n", token),
+        None => String::new(),
+    }
+}
+
+/// Status and body of the response to `method path` on `server`
+///
+pub fn request(server: &str, method: &str, path: &str, body: &str) -> Result<(u16, String), String> {
+    exchange(server, method, path, body, &authorization())
+}
+
+/// As `request`, for services other than hammer, which aren't sent the token
+///
+pub fn request_external(server: &str, method: &str, path: &str, body: &str) -> Result<(u16, String), String> {
+    exchange(server, method, path, body, "")
+}
+
+fn exchange(server: &str, method: &str, path: &str, body: &str, headers: &str) -> Result<(u16, String), String> {
+    let mut stream = match TcpStream::connect(server) {
+        Ok(s) => s,
+        Err(e) => return Err(format!("unable to connect to {}: {}", server, e)),
+    };
+
+    // HTTP/1.0, so the response ends when the connection closes
+    match write!(stream, "{} {} HTTP/1.0\r\nHost: {}\r\n{}Content-Type: application/json\r\nContent-Length: {}\r\n\r\n{}", method, path, server, headers, body.len(), body) {
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to send request: {}", e)),
+    }
+
+    let mut response = String::new();
+    match stream.read_to_string(&mut response) {
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to read response: {}", e)),
+    }
+
+    let (head, body) = match response.find("\r\n\r\n") {
+        Some(i) => (&response[..i], &response[i + 4..]),
+        None => return Err("truncated response".to_string()),
+    };
+    let status_line = head.lines().next().unwrap_or("");
+    match status_line.split(' ').nth(1).map(|s| s.parse::<u16>()) {
+        Some(Ok(status)) => Ok((status, body.to_string())),
+        _ => Err(format!("unexpected status line '{}'", status_line)),
+    }
+}
+
+/// The body of `GET path` on `server`, for streaming large responses
+///
+pub fn get(server: &str, path: &str) -> Result<BufReader<TcpStream>, String> {
+    let mut stream = match TcpStream::connect(server) {
+        Ok(s) => s,
+        Err(e) => return Err(format!("unable to connect to {}: {}", server, e)),
+    };
+
+    // HTTP/1.0, so the body isn't chunked and ends when the connection closes
+    match write!(stream, "GET {} HTTP/1.0\r\nHost: {}\r\n{}\r\n", path, server, authorization()) {
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to send request: {}", e)),
+    }
+
+    let mut reader = BufReader::new(stream);
+    let mut status = String::new();
+    match reader.read_line(&mut status) {
+        Ok(n) if n > 0 => {},
+        _ => return Err("empty response".to_string()),
+    }
+    let status = status.trim().to_string();
+    let ok = status.split(' ').nth(1) == Some("200");
+
+    // Skip the headers
+    loop {
+        let mut line = String::new();
+        match reader.read_line(&mut line) {
+            Ok(n) if n > 0 && line.trim().is_empty() => break,
+            Ok(n) if n > 0 => {},
+            _ => return Err("truncated response".to_string()),
+        }
+    }
+
+    if !ok {
+        let mut body = String::new();
+        let _ = reader.read_to_string(&mut body);
+        return Err(format!("{}: {}", status, body.trim()))
+    }
+
+    Ok(reader)
+}
@@ -0,0 +1,116 @@
+use std::collections::{BTreeMap, HashMap};
+use std::fs::File;
+use std::io::Read;
+use std::thread;
+use std::time::Duration;
+use std::sync::{Arc, RwLock};
+use std::sync::atomic::Ordering;
+
+use hammer::db::Database;
+
+use http::metrics::Metrics;
+
+type DBMap<T> = Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>;
+
+/// Assumed page size; `/proc/self/statm` reports sizes in pages
+const PAGE_SIZE: usize = 4096;
+
+/// Process memory use, as reported by the kernel
+///
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct MemStats {
+    /// Total mapped memory
+    pub virtual_bytes: usize,
+    /// Memory actually resident in RAM
+    pub resident_bytes: usize,
+}
+
+impl MemStats {
+    /// Read the current process's memory use (Linux only)
+    ///
+    pub fn read() -> Result<MemStats, String> {
+        let mut statm = String::new();
+        match File::open("/proc/self/statm").and_then(|mut f| f.read_to_string(&mut statm)) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to read /proc/self/statm: {}", e)),
+        }
+
+        MemStats::parse(&statm)
+    }
+
+    fn parse(statm: &str) -> Result<MemStats, String> {
+        let pages: Vec<usize> = match statm.split_whitespace().take(2).map(|v| v.parse::<usize>()).collect::<Result<Vec<usize>, _>>() {
+            Ok(v) => v,
+            Err(e) => return Err(format!("unable to parse '{}': {}", statm, e)),
+        };
+
+        match pages.len() {
+            2 => Ok(MemStats{virtual_bytes: pages[0] * PAGE_SIZE, resident_bytes: pages[1] * PAGE_SIZE}),
+            _ => Err(format!("unable to parse '{}'", statm)),
+        }
+    }
+}
+
+/// Periodically logs memory use and records it in the server metrics
+///
+/// Each report also measures the memory held by each partition of every
+/// in-memory binary database (see `Database::memory`), holding each
+/// database's read lock while it's measured.
+///
+pub struct MemStatsReporter {
+    pub interval_s: u64,
+    pub metrics: Arc<Metrics>,
+    pub b32: DBMap<u32>,
+    pub b64: DBMap<u64>,
+    pub b128: DBMap<[u64; 2]>,
+    pub b256: DBMap<[u64; 4]>,
+}
+
+impl MemStatsReporter {
+    pub fn spawn(self) {
+        thread::spawn(move || {
+            loop {
+                match MemStats::read() {
+                    Ok(stats) => {
+                        self.metrics.virtual_bytes.store(stats.virtual_bytes, Ordering::Relaxed);
+                        self.metrics.resident_bytes.store(stats.resident_bytes, Ordering::Relaxed);
+
+                        let mut index = BTreeMap::new();
+                        account(32, &self.b32, &mut index);
+                        account(64, &self.b64, &mut index);
+                        account(128, &self.b128, &mut index);
+                        account(256, &self.b256, &mut index);
+                        let index_bytes = index.values().fold(0, |n, partitions| partitions.iter().fold(n, |n, bytes| n + bytes));
+                        *self.metrics.index_bytes.lock().unwrap() = index;
+
+                        log!("Memory: {} MB resident, {} MB virtual, {} MB in indices",
+                                 stats.resident_bytes / (1024 * 1024), stats.virtual_bytes / (1024 * 1024), index_bytes / (1024 * 1024));
+                    },
+                    Err(e) => {
+                        log!("WARNING: memory stats unavailable, disabling reporting: {}", e);
+                        return
+                    },
+                }
+
+                thread::sleep(Duration::from_secs(self.interval_s));
+            }
+        });
+    }
+}
+
+/// Records the bytes held by each partition of the DBs in `dbmap_mx` in
+/// `index`, by DB name
+///
+fn account<T>(bits: usize, dbmap_mx: &DBMap<T>, index: &mut BTreeMap<String, Vec<usize>>) {
+    // Don't hold the DB map lock while measuring, so new DBs can be created
+    let dbs: Vec<((usize, String), Arc<RwLock<Box<Database<T>>>>)> = {
+        dbmap_mx.read().unwrap().iter().map(|(k, v)| (k.clone(), v.clone())).collect()
+    };
+
+    for ((tolerance, namespace), db_mx) in dbs.into_iter() {
+        match db_mx.read().unwrap().memory() {
+            Some(memory) => { index.insert(format!("b/{}/{}/{}", bits, tolerance, namespace), memory.iter().map(|p| p.bytes).collect()); },
+            None => {},
+        }
+    }
+}
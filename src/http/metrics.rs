@@ -0,0 +1,125 @@
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+use std::sync::atomic::{AtomicUsize, Ordering};
+
+use iron::prelude::*;
+use iron::{status, typemap};
+use persistent::Read;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::bulkhead::Bulkheads;
+use http::debug_vars::DebugVars;
+use http::rates::NamespaceRates;
+use http::usage::UsageLog;
+
+/// Server-wide counters
+///
+/// Counters are updated with relaxed atomics - they're intended for
+/// monitoring, not for coordination
+///
+pub struct Metrics {
+    /// Number of /add requests currently being handled
+    pub pending_writes: AtomicUsize,
+    /// Highest observed value of `pending_writes`
+    pub max_pending_writes: AtomicUsize,
+    /// Number of /add requests which were rejected by the write throttle
+    pub throttled_writes: AtomicUsize,
+    /// Number of values dropped by the insert dedup window
+    pub duplicate_writes: AtomicUsize,
+    /// Number of keys removed for being older than their DB's retention
+    pub expired: AtomicUsize,
+    /// Number of writes which couldn't be mirrored to the sink
+    pub sink_errors: AtomicUsize,
+    /// Number of queries mirrored to the shadow server
+    pub shadow_sent: AtomicUsize,
+    /// Number of mirrored queries whose results differed
+    pub shadow_differed: AtomicUsize,
+    /// Number of mirrored queries the shadow server failed
+    pub shadow_errors: AtomicUsize,
+    /// Number of queries not mirrored because the queue was full
+    pub shadow_dropped: AtomicUsize,
+    /// Number of completed integrity checks
+    pub scrub_runs: AtomicUsize,
+    /// Total missing index entries found by integrity checks
+    pub scrub_missing: AtomicUsize,
+    /// Total dangling index entries found by integrity checks
+    pub scrub_dangling: AtomicUsize,
+    /// Resident memory, as of the last memory report
+    pub resident_bytes: AtomicUsize,
+    /// Mapped memory, as of the last memory report
+    pub virtual_bytes: AtomicUsize,
+    /// Bytes held by each partition of each in-memory binary DB, as of the
+    /// last memory report
+    pub index_bytes: Mutex<BTreeMap<String, Vec<usize>>>,
+    /// Request counts and DB timings, reported at /debug/vars
+    pub debug_vars: DebugVars,
+    /// Operation counts and rates by namespace
+    pub namespaces: NamespaceRates,
+    /// Requests in flight by namespace
+    pub bulkheads: Bulkheads,
+    /// Usage records by namespace, served at /admin/usage rather than here
+    pub usage: UsageLog,
+}
+
+impl Metrics {
+    pub fn new() -> Metrics {
+        Metrics{
+            pending_writes: AtomicUsize::new(0),
+            max_pending_writes: AtomicUsize::new(0),
+            throttled_writes: AtomicUsize::new(0),
+            duplicate_writes: AtomicUsize::new(0),
+            expired: AtomicUsize::new(0),
+            sink_errors: AtomicUsize::new(0),
+            shadow_sent: AtomicUsize::new(0),
+            shadow_differed: AtomicUsize::new(0),
+            shadow_errors: AtomicUsize::new(0),
+            shadow_dropped: AtomicUsize::new(0),
+            scrub_runs: AtomicUsize::new(0),
+            scrub_missing: AtomicUsize::new(0),
+            scrub_dangling: AtomicUsize::new(0),
+            resident_bytes: AtomicUsize::new(0),
+            virtual_bytes: AtomicUsize::new(0),
+            index_bytes: Mutex::new(BTreeMap::new()),
+            debug_vars: DebugVars::new(),
+            namespaces: NamespaceRates::new(),
+            bulkheads: Bulkheads::new(),
+            usage: UsageLog::new(),
+        }
+    }
+}
+
+impl ToJson for Metrics {
+    fn to_json(&self) -> Json {
+        let mut d = BTreeMap::new();
+        d.insert("pending_writes".to_string(), self.pending_writes.load(Ordering::Relaxed).to_json());
+        d.insert("max_pending_writes".to_string(), self.max_pending_writes.load(Ordering::Relaxed).to_json());
+        d.insert("throttled_writes".to_string(), self.throttled_writes.load(Ordering::Relaxed).to_json());
+        d.insert("duplicate_writes".to_string(), self.duplicate_writes.load(Ordering::Relaxed).to_json());
+        d.insert("expired".to_string(), self.expired.load(Ordering::Relaxed).to_json());
+        d.insert("sink_errors".to_string(), self.sink_errors.load(Ordering::Relaxed).to_json());
+        d.insert("shadow_sent".to_string(), self.shadow_sent.load(Ordering::Relaxed).to_json());
+        d.insert("shadow_differed".to_string(), self.shadow_differed.load(Ordering::Relaxed).to_json());
+        d.insert("shadow_errors".to_string(), self.shadow_errors.load(Ordering::Relaxed).to_json());
+        d.insert("shadow_dropped".to_string(), self.shadow_dropped.load(Ordering::Relaxed).to_json());
+        d.insert("scrub_runs".to_string(), self.scrub_runs.load(Ordering::Relaxed).to_json());
+        d.insert("scrub_missing".to_string(), self.scrub_missing.load(Ordering::Relaxed).to_json());
+        d.insert("scrub_dangling".to_string(), self.scrub_dangling.load(Ordering::Relaxed).to_json());
+        d.insert("resident_bytes".to_string(), self.resident_bytes.load(Ordering::Relaxed).to_json());
+        d.insert("virtual_bytes".to_string(), self.virtual_bytes.load(Ordering::Relaxed).to_json());
+        d.insert("index_bytes".to_string(), self.index_bytes.lock().unwrap().to_json());
+        d.insert("namespaces".to_string(), self.namespaces.to_json());
+        d.insert("bulkheads".to_string(), self.bulkheads.to_json());
+        Json::Object(d)
+    }
+}
+
+pub struct MetricsKey;
+impl typemap::Key for MetricsKey { type Value = Metrics; }
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let metrics = req.get::<Read<MetricsKey>>().unwrap();
+
+    let response_body = json::encode(&metrics.to_json()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
@@ -1,20 +1,98 @@
+/// Like `println!`, but prefixed with the ID of the request being handled,
+/// if any (see `request_id`)
+macro_rules! log {
+    ($($arg:tt)*) => (::http::request_id::log(format!($($arg)*)))
+}
+
 pub mod server;
+pub mod access_log;
+pub mod capture;
+pub mod shadow;
 pub mod binary_handler;
 pub mod vector_handler;
+pub mod metrics;
+pub mod throttle;
+pub mod options_handler;
+pub mod float_handler;
+pub mod rerank;
+pub mod ingest_hook;
+pub mod shard_map;
+pub mod federated_handler;
+pub mod bucket_handler;
+pub mod scrubber;
+pub mod reaper;
+pub mod changes;
+pub mod db_handler;
+pub mod keys_handler;
+pub mod memstats;
+pub mod debug_vars;
+pub mod rates;
+pub mod auth;
+pub mod conditional;
+pub mod cors;
+pub mod bulkhead;
+pub mod listen;
+pub mod ui_handler;
+pub mod dump_handler;
+pub mod recovery;
+pub mod reload;
+pub mod request_id;
+pub mod resp;
+pub mod upgrade;
+pub mod standby;
+pub mod fencing;
+pub mod encryption;
+pub mod versions;
+pub mod sink;
+pub mod document_handler;
+pub mod cluster_handler;
+pub mod join_handler;
+pub mod dedup_report;
+pub mod loader;
+pub mod replay;
+pub mod index_diff;
+pub mod fsck;
+pub mod import;
+pub mod jobs;
+pub mod usage;
+#[cfg(feature = "chaos")]
+pub mod chaos;
 
-use std::collections::HashMap;
+use std::cmp::min;
+use std::collections::{BTreeMap, HashMap};
 use std::sync::{Arc, RwLock};
 use std::path::PathBuf;
+use std::io;
 use std::io::Read;
+use std::hash::Hash;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
 
 use iron::prelude::*;
 use iron::{status, typemap};
+use persistent::State;
 use rustc_serialize::base64;
+use rustc_serialize::base64::FromBase64;
 use rustc_serialize::json;
 use rustc_serialize::Decodable;
 use rustc_serialize::json::{ToJson, Json};
+use bincode;
 use hammer::db::Database;
+use hammer::db::hamming::Hamming;
+use hammer::db::normalize::{Normalizer, Normalized, BitMask, Rotate, Mask, RotateLeft};
+use hammer::db::weighted::Weighted;
+use hammer::db::lru::Lru;
+use hammer::db::insert_times::InsertTimes;
+use hammer::db::documents::Documents;
+use hammer::hyperplane::{Hyperplanes, FromBits};
 
+use http::access_log::{BodyBytesKey, ValueCountKey};
+use http::capture::{KeepBodyKey, RequestBodyKey};
+
+/// The result of adding one value; a request's results are in the order of
+/// its values, one for each (including duplicates and values which couldn't
+/// be decoded), so they can be matched up by position
+///
+#[derive(Clone)]
 pub enum AddResult {
     Ok,
     Exists,
@@ -30,21 +108,59 @@ impl ToJson for AddResult {
     }
 }
 
+/// The result of querying one value, in the order of the request's values as
+/// with `AddResult`
+///
+#[derive(Clone)]
 pub enum QueryResult<T> {
     Ok(T),
+    /// Matches which may be incomplete (`overflowed` if some candidates
+    /// weren't verified, `truncated` if the response size limit was reached),
+    /// along with the partitions each was found in and how each differs from
+    /// the query, if requested
+    Detailed{matches: T, overflowed: bool, truncated: bool, partitions: Option<Json>, diffs: Option<Json>},
     None,
+    /// Not queried, since it would have read `cost` candidates, more than the
+    /// database's `max_query_cost`
+    TooExpensive{cost: usize, max_query_cost: usize},
     Err(String),
 }
 impl<T: ToJson> ToJson for QueryResult<T> {
     fn to_json(&self) -> Json {
         match self {
             &QueryResult::Ok(ref v) => v.to_json(),
+            &QueryResult::Detailed{ref matches, overflowed, truncated, ref partitions, ref diffs} => {
+                let mut d = BTreeMap::new();
+                d.insert("overflowed".to_string(), overflowed.to_json());
+                d.insert("truncated".to_string(), truncated.to_json());
+                d.insert("matches".to_string(), matches.to_json());
+                match partitions {
+                    &Some(ref partitions) => { d.insert("partitions".to_string(), partitions.clone()); },
+                    &None => {},
+                }
+                match diffs {
+                    &Some(ref diffs) => { d.insert("diffs".to_string(), diffs.clone()); },
+                    &None => {},
+                }
+                Json::Object(d)
+            },
             &QueryResult::None => Json::String("none".to_string()),
+            &QueryResult::TooExpensive{cost, max_query_cost} => {
+                let mut d = BTreeMap::new();
+                d.insert("error".to_string(), "too_expensive".to_json());
+                d.insert("cost".to_string(), cost.to_json());
+                d.insert("max_query_cost".to_string(), max_query_cost.to_json());
+                d.insert("hint".to_string(), "query a database with a lower tolerance".to_json());
+                Json::Object(d)
+            },
             &QueryResult::Err(ref e) => Json::String(format!("err: {}", e)),
         }
     }
 }
 
+/// The result of deleting one value, in the order of the request's values as
+/// with `AddResult`
+///
 pub enum DeleteResult {
     Ok,
     NotFound,
@@ -69,6 +185,15 @@ impl typemap::Key for B128 { type Value = HashMap<(usize, String), Arc<RwLock<Bo
 struct B256;
 impl typemap::Key for B256 { type Value = HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>; }
 
+struct D32;
+impl typemap::Key for D32 { type Value = HashMap<(usize, String), Arc<RwLock<Documents<u32>>>>; }
+struct D64;
+impl typemap::Key for D64 { type Value = HashMap<(usize, String), Arc<RwLock<Documents<u64>>>>; }
+struct D128;
+impl typemap::Key for D128 { type Value = HashMap<(usize, String), Arc<RwLock<Documents<[u64; 2]>>>>; }
+struct D256;
+impl typemap::Key for D256 { type Value = HashMap<(usize, String), Arc<RwLock<Documents<[u64; 4]>>>>; }
+
 struct V32;
 impl typemap::Key for V32 { type Value = HashMap<(usize, usize, String), Arc<RwLock<Box<Database<Vec<u32>>>>>>; }
 struct V64;
@@ -78,6 +203,195 @@ impl typemap::Key for V128 { type Value = HashMap<(usize, usize, String), Arc<Rw
 struct V256;
 impl typemap::Key for V256 { type Value = HashMap<(usize, usize, String), Arc<RwLock<Box<Database<Vec<[u64; 4]>>>>>>; }
 
+/// Per-database options for binary databases
+///
+/// Options are keyed by `(bits, tolerance, namespace)`.  They must be set
+/// before the database's first write, and are applied when it's created.
+///
+#[derive(Debug, Clone, Default, RustcDecodable, RustcEncodable)]
+pub struct DBOptions {
+    /// Base64-encoded key mask - bits not set in the mask are ignored
+    pub mask: Option<String>,
+    /// Number of bits to rotate keys (left) by
+    pub rotate: Option<u32>,
+    /// Per-dimension weights used when computing hamming distance.  Dimensions
+    /// with weight 0 are ignored, dimensions without a weight count as 1
+    pub weights: Option<Vec<usize>>,
+    /// Seed used to generate the hyperplanes float vectors are projected onto.
+    /// Chosen randomly by the first float add if unset
+    pub projection_seed: Option<u64>,
+    /// Length of float vectors.  Set by the first float add if unset
+    pub projection_dimensions: Option<usize>,
+    /// Maximum number of candidates to verify per queried value
+    pub max_candidates: Option<usize>,
+    /// Values whose queries would read more candidates than this are
+    /// rejected without being queried
+    pub max_query_cost: Option<usize>,
+    /// Buckets holding more than this many values are reported as heavy
+    pub bucket_threshold: Option<usize>,
+    /// Maximum number of keys to store; least recently used keys are evicted
+    pub max_keys: Option<usize>,
+    /// Record when each key is inserted, so queries can be limited to keys
+    /// inserted within a time range
+    pub insert_times: Option<bool>,
+    /// How long keys are kept after they're inserted, i.e. `30d`.  Implies
+    /// `insert_times`
+    pub retention: Option<String>,
+    /// Re-adding a stored key restores any of its index entries which are
+    /// missing
+    pub repair_on_insert: Option<bool>,
+}
+
+impl DBOptions {
+    /// Returns an error if the options can't be applied to a DB of the given
+    /// bitsize
+    ///
+    pub fn validate<T>(&self, bits: usize) -> Result<(), String> where
+    T: 'static + Sync + Send + Decodable + BitMask + Rotate,
+    {
+        try!(self.normalizers::<T>());
+
+        match self.weights {
+            Some(ref weights) if weights.len() > bits => {
+                return Err(format!("expected at most {} weights, got {}", bits, weights.len()))
+            },
+            _ => {},
+        }
+
+        match self.projection_dimensions {
+            Some(0) => return Err("projection_dimensions must be positive".to_string()),
+            _ => {},
+        }
+
+        match self.max_candidates {
+            Some(0) => return Err("max_candidates must be positive".to_string()),
+            _ => {},
+        }
+
+        match self.max_query_cost {
+            Some(0) => return Err("max_query_cost must be positive".to_string()),
+            _ => {},
+        }
+
+        match self.max_keys {
+            Some(0) => return Err("max_keys must be positive".to_string()),
+            _ => {},
+        }
+
+        match try!(self.retention_s()) {
+            Some(0) => Err("retention must be positive".to_string()),
+            _ => Ok(()),
+        }
+    }
+
+    /// True if the DB records when each key was inserted
+    ///
+    pub fn records_insert_times(&self) -> bool {
+        self.insert_times == Some(true) || self.retention.is_some()
+    }
+
+    /// The retention period, in seconds
+    ///
+    pub fn retention_s(&self) -> Result<Option<u64>, String> {
+        match self.retention {
+            Some(ref retention) => match parse_duration(retention) {
+                Ok(secs) => Ok(Some(secs)),
+                Err(e) => Err(format!("invalid retention: {}", e)),
+            },
+            None => Ok(None),
+        }
+    }
+
+    /// Wraps `db` with the normalization, weighting, insert time tracking and
+    /// eviction described by the options.  `on_evict` is called with each key
+    /// evicted
+    ///
+    pub fn apply<T>(&self, db: Box<Database<T>>, bits: usize, tolerance: usize, on_evict: Box<Fn(&T) + Sync + Send>) -> Result<Box<Database<T>>, String> where
+    T: 'static + Sync + Send + Clone + Eq + Hash + Decodable + Hamming + BitMask + Rotate,
+    {
+        try!(self.validate::<T>(bits));
+
+        let mut normalizers = try!(self.normalizers());
+
+        let mut db = db;
+        match self.bucket_threshold {
+            Some(threshold) => db.set_bucket_threshold(threshold),
+            None => {},
+        }
+        db.set_repair_on_insert(self.repair_on_insert == Some(true));
+
+        let db: Box<Database<T>> = match self.weights {
+            Some(ref weights) => {
+                let ignored = Weighted::<T>::ignored_dimensions(weights);
+                if !ignored.is_empty() {
+                    normalizers.push(Box::new(Mask::new(T::mask_excluding(&ignored))));
+                }
+
+                Box::new(Weighted::new(db, weights.clone(), tolerance))
+            },
+            None => db,
+        };
+
+        let db: Box<Database<T>> = match self.records_insert_times() {
+            true => Box::new(InsertTimes::new(db)),
+            false => db,
+        };
+
+        let db: Box<Database<T>> = match self.max_keys {
+            Some(max_keys) => Box::new(Lru::new(db, max_keys, on_evict)),
+            None => db,
+        };
+
+        if normalizers.is_empty() {
+            Ok(db)
+        } else {
+            Ok(Box::new(Normalized::new(db, normalizers)))
+        }
+    }
+
+    /// Key normalizers described by the options
+    ///
+    /// Keys are rotated before being masked, so masks should be given in
+    /// terms of the rotated key
+    ///
+    fn normalizers<T>(&self) -> Result<Vec<Box<Normalizer<T>>>, String> where
+    T: 'static + Sync + Send + Decodable + BitMask + Rotate,
+    {
+        let mut normalizers: Vec<Box<Normalizer<T>>> = Vec::new();
+
+        match self.rotate {
+            Some(n) => normalizers.push(Box::new(RotateLeft::new(n))),
+            None => {},
+        }
+
+        match self.mask {
+            Some(ref mask_b64) => {
+                let mask_bytes = match mask_b64.from_base64() {
+                    Ok(v) => v,
+                    Err(e) => return Err(format!("unable to base64-decode mask '{}': {:?}", mask_b64, e)),
+                };
+
+                let mask: T = match bincode::rustc_serialize::decode(&mask_bytes) {
+                    Ok(v) => v,
+                    Err(e) => return Err(format!("unable to decode mask '{}': {:?}", mask_b64, e)),
+                };
+
+                normalizers.push(Box::new(Mask::new(mask)));
+            },
+            None => {},
+        }
+
+        Ok(normalizers)
+    }
+}
+
+struct BOptions;
+impl typemap::Key for BOptions { type Value = HashMap<(usize, usize, String), DBOptions>; }
+
+// Hyperplanes keyed by (seed, dimensions, bits)
+struct Projections;
+impl typemap::Key for Projections { type Value = HashMap<(u64, usize, usize), Arc<Hyperplanes>>; }
+
 pub const BASE64_CONFIG: base64::Config = base64::Config{
     char_set: base64::CharacterSet::Standard,
     newline: base64::Newline::CRLF,
@@ -85,22 +399,121 @@ pub const BASE64_CONFIG: base64::Config = base64::Config{
     line_length: None,
 };
 
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, Default)]
 pub struct Config {
     pub data_dir: Option<PathBuf>,
     pub bind: String,
+    pub max_pending_writes: usize,
+    pub throttle_delay_ms: u64,
+    pub rerank_command: Option<String>,
+    pub ingest_hook_command: Option<String>,
+    pub scrub_interval_s: u64,
+    pub scrub_repair: bool,
+    pub shards: usize,
+    pub lock_free_reads: bool,
+    pub insert_workers: usize,
+    pub memstats_interval_s: u64,
+    pub dedup_window_s: u64,
+    pub debug_vars: bool,
+    pub max_response_bytes: usize,
+    pub sink: Option<String>,
+    pub sink_sync: bool,
+    pub sink_retries: usize,
+    pub reap_interval_s: u64,
+    pub cors_origins: Option<String>,
+    pub cors_methods: String,
+    pub cors_headers: String,
+    /// If set, admin endpoints are served here rather than on `bind`
+    pub admin_bind: Option<String>,
+    /// Admin address of the server being upgraded, to copy DBs from
+    pub take_over: Option<String>,
+    /// Binary started by upgrades, if not this one
+    pub upgrade_binary: Option<String>,
+    /// If set, Redis protocol commands are also accepted here
+    pub resp_bind: Option<String>,
+    /// DB operations taking at least this long are logged (0 disables)
+    pub slow_op_ms: u64,
+    pub access_log: Option<String>,
+    pub access_log_format: String,
+    /// Size at which the access log is rotated (0 disables rotation)
+    pub access_log_max_bytes: u64,
+    /// Rotated access logs kept
+    pub access_log_keep: usize,
+    /// File of reloadable settings (see `reload`)
+    pub config_file: Option<String>,
+    /// Most requests handled at once for each namespace (0 is unlimited)
+    pub namespace_concurrency: usize,
+    /// Publish accepted adds and deletes to the change feed
+    pub feed_writes: bool,
+    /// Admin address of the primary to follow, if this is a standby
+    pub standby_of: Option<String>,
+    /// Promote a standby once its primary is unreachable this long (0 never
+    /// does)
+    pub promote_after_s: u64,
+    /// Leader epoch the server starts at (see `fencing`)
+    pub epoch: u64,
+    /// File of bearer tokens and their scopes (see `auth`)
+    pub auth_tokens: Option<String>,
+    /// Command checking tokens, i.e. JWTs (see `auth`)
+    pub auth_command: Option<String>,
+    /// File requests are captured to, for replays (see `capture`)
+    pub capture: Option<String>,
+    /// Fraction of requests captured
+    pub capture_rate: f64,
+    /// Server queries are mirrored to, for comparison (see `shadow`)
+    pub shadow: Option<String>,
+    /// Fraction of queries mirrored
+    pub shadow_rate: f64,
+    /// File differences from the shadow server are written to
+    pub shadow_diffs: Option<String>,
+    /// File holding the cluster's shard map (see `shard_map`)
+    pub shard_map: Option<String>,
+    /// Length of usage periods (0 disables usage records, see `usage`)
+    pub usage_interval_s: u64,
+    /// URL usage records are POSTed to as each period closes
+    pub usage_webhook: Option<String>,
+    /// File holding the key archives and saved state are encrypted with (see
+    /// `encryption`)
+    pub encryption_key: Option<String>,
 }
 
 struct ConfigKey;
 impl typemap::Key for ConfigKey { type Value = Config; }
 
+/// The request's body, counted for the access log (and kept for it, if
+/// asked to)
+///
+fn read_body(req: &mut Request) -> Result<String, IronError> {
+    let mut payload = String::new();
+    itry!(Read::by_ref(&mut req.body).take(MAX_BODY_BYTES as u64 + 1).read_to_string(&mut payload));
+    if payload.len() > MAX_BODY_BYTES {
+        let err = io::Error::new(io::ErrorKind::InvalidData, "body too large");
+        return Err(IronError::new(err, (status::PayloadTooLarge, format!("request bodies are limited to {} bytes", MAX_BODY_BYTES))))
+    }
+    req.extensions.insert::<BodyBytesKey>(payload.len());
+    if req.extensions.contains::<KeepBodyKey>() {
+        req.extensions.insert::<RequestBodyKey>(payload.clone());
+    }
+    Ok(payload)
+}
+
 fn decode_body<T>(req: &mut Request) -> Result<T, IronError> where
 T: Decodable
 {
-    let mut payload = String::new();
-    itry!(req.body.read_to_string(&mut payload));
+    let payload = try!(read_body(req));
 
-    match json::decode::<T>(&payload) {
+    let body = match Json::from_str(&payload) {
+        Ok(body) => body,
+        Err(err) => return Err(IronError::new(err, (status::BadRequest, "Unable to parse JSON"))),
+    };
+
+    // Counted for the access log
+    match body {
+        Json::Array(ref values) => { req.extensions.insert::<ValueCountKey>(values.len()); },
+        _ => {},
+    }
+
+    match T::decode(&mut json::Decoder::new(body)) {
         Ok(req_body) => {
             Ok(req_body)
         },
@@ -109,3 +522,212 @@ T: Decodable
         }
     }
 }
+
+/// Value of the query string parameter `name`, if given
+///
+fn query_param(req: &Request, name: &str) -> Option<String> {
+    match req.url.query {
+        Some(ref query) => query.split('&').filter_map(|kv| {
+            let mut parts = kv.splitn(2, '=');
+            match (parts.next(), parts.next()) {
+                (Some(k), Some(v)) if k == name => Some(v.to_string()),
+                _ => None,
+            }
+        }).next(),
+        None => None,
+    }
+}
+
+/// How values are written in request (and binary query response) bodies
+///
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum ValueEncoding {
+    /// Base64-encoded bytes (the default)
+    Base64,
+    /// Strings of '0' and '1' (`?encoding=binary`)
+    Binary,
+    /// Decimal integer strings (`?encoding=decimal`), for DBs of up to 64
+    /// bits
+    Decimal,
+}
+
+/// Largest request body accepted; larger ones get a 413
+pub const MAX_BODY_BYTES: usize = 256 * 1024 * 1024;
+
+/// Largest integer which clients storing numbers as doubles (JavaScript's
+/// `Number.MAX_SAFE_INTEGER`) can represent exactly
+pub const MAX_SAFE_INTEGER: u64 = (1 << 53) - 1;
+
+/// Encoding requested with the `encoding` parameter
+///
+fn value_encoding(req: &Request, bits: usize) -> Result<ValueEncoding, String> {
+    match query_param(req, "encoding") {
+        None => Ok(ValueEncoding::Base64),
+        Some(ref v) if v == "base64" => Ok(ValueEncoding::Base64),
+        Some(ref v) if v == "binary" => Ok(ValueEncoding::Binary),
+        Some(ref v) if v == "decimal" && bits <= 64 => Ok(ValueEncoding::Decimal),
+        Some(ref v) if v == "decimal" => Err(format!("decimal encoding is only supported for DBs of up to 64 bits, not {}", bits)),
+        Some(v) => Err(format!("invalid encoding '{}', expected 'base64', 'binary' or 'decimal'", v)),
+    }
+}
+
+/// Order in which the bits of binary strings and bit arrays are written
+///
+#[derive(Clone, Copy, Debug, PartialEq, Eq)]
+pub enum BitOrder {
+    /// Most significant bit first, as in standard binary notation
+    MsbFirst,
+    /// Least significant bit (dimension 0) first
+    LsbFirst,
+}
+
+/// Bit order requested with the `bit_order` parameter (`msb`, the default,
+/// or `lsb`)
+///
+fn bit_order(req: &Request) -> Result<BitOrder, String> {
+    match query_param(req, "bit_order") {
+        None => Ok(BitOrder::MsbFirst),
+        Some(ref v) if v == "msb" => Ok(BitOrder::MsbFirst),
+        Some(ref v) if v == "lsb" => Ok(BitOrder::LsbFirst),
+        Some(v) => Err(format!("invalid bit_order '{}', expected 'msb' or 'lsb'", v)),
+    }
+}
+
+/// Write a value as a string of '0' and '1' in `order`
+///
+fn encode_bits<T: FromBits>(value: &T, order: BitOrder) -> String {
+    let mut bits = value.to_bits();
+    if order == BitOrder::MsbFirst {
+        bits.reverse();
+    }
+
+    bits.into_iter().map(|b| if b { '1' } else { '0' }).collect()
+}
+
+/// Limits the total size of the matches returned in a query response
+///
+/// Each match is counted as its encoded size, so the limit is approximate.
+/// Once the budget is spent the remaining matches are dropped, and the
+/// results they were dropped from are flagged as truncated.
+///
+pub struct ResponseBudget {
+    remaining: Option<usize>,
+}
+
+impl ResponseBudget {
+    /// The matches which fit in the budget, and whether any were dropped
+    ///
+    pub fn take<V, F: Fn(&V) -> usize>(&mut self, matches: Vec<V>, size: F) -> (Vec<V>, bool) {
+        let mut remaining = match self.remaining {
+            Some(remaining) => remaining,
+            None => return (matches, false),
+        };
+
+        let count = matches.len();
+        let mut kept = Vec::with_capacity(count);
+        for v in matches.into_iter() {
+            let v_size = size(&v);
+            if v_size > remaining {
+                remaining = 0;
+                break
+            }
+            remaining -= v_size;
+            kept.push(v);
+        }
+
+        self.remaining = Some(remaining);
+        let truncated = kept.len() < count;
+        (kept, truncated)
+    }
+}
+
+/// Budget for a query response: the server's `max_response_bytes`, lowered by
+/// the request's `max_bytes` parameter if given (0 is unlimited for both)
+///
+fn response_budget(req: &mut Request) -> Result<ResponseBudget, String> {
+    let server_max = req.get::<State<ConfigKey>>().unwrap().read().unwrap().max_response_bytes;
+
+    let request_max = match query_param(req, "max_bytes") {
+        Some(v) => match v.parse::<usize>() {
+            Ok(v) => v,
+            Err(e) => return Err(format!("invalid max_bytes '{}': {}", v, e)),
+        },
+        None => 0,
+    };
+
+    let remaining = match (server_max, request_max) {
+        (0, 0) => None,
+        (0, max) | (max, 0) => Some(max),
+        (a, b) => Some(min(a, b)),
+    };
+
+    Ok(ResponseBudget{remaining: remaining})
+}
+
+/// Parses a duration such as `90s`, `30m`, `12h` or `30d` (a bare number is
+/// seconds) as a number of seconds
+///
+pub fn parse_duration(duration: &str) -> Result<u64, String> {
+    let (number, unit) = match duration.chars().last() {
+        Some('s') => (&duration[..duration.len() - 1], 1),
+        Some('m') => (&duration[..duration.len() - 1], 60),
+        Some('h') => (&duration[..duration.len() - 1], 60 * 60),
+        Some('d') => (&duration[..duration.len() - 1], 24 * 60 * 60),
+        _ => (duration, 1),
+    };
+
+    match number.parse::<u64>() {
+        Ok(n) => Ok(n * unit),
+        Err(_) => Err(format!("expected a duration like '30d', got '{}'", duration)),
+    }
+}
+
+/// Limits query matches to values inserted within a time range
+///
+pub struct InsertedBetween {
+    after: Option<SystemTime>,
+    before: Option<SystemTime>,
+}
+
+impl InsertedBetween {
+    /// True if `inserted_at` is within the range.  Values without an insert
+    /// time never are
+    ///
+    pub fn contains(&self, inserted_at: Option<SystemTime>) -> bool {
+        match (inserted_at, self.after, self.before) {
+            (None, _, _) => false,
+            (Some(t), Some(after), _) if t < after => false,
+            (Some(t), _, Some(before)) if t >= before => false,
+            (Some(_), _, _) => true,
+        }
+    }
+}
+
+/// Insert time range requested with the `inserted_after` and
+/// `inserted_before` parameters (unix timestamps, in seconds), if either is
+/// given
+///
+fn inserted_between(req: &Request) -> Result<Option<InsertedBetween>, String> {
+    let parse = |name: &str| match query_param(req, name) {
+        Some(v) => match v.parse::<u64>() {
+            Ok(secs) => Ok(Some(UNIX_EPOCH + Duration::from_secs(secs))),
+            Err(e) => Err(format!("invalid {} '{}': {}", name, v, e)),
+        },
+        None => Ok(None),
+    };
+
+    let after = try!(parse("inserted_after"));
+    let before = try!(parse("inserted_before"));
+
+    match (after, before) {
+        (None, None) => Ok(None),
+        (after, before) => Ok(Some(InsertedBetween{after: after, before: before})),
+    }
+}
+
+/// JSON-encoded size of a match
+///
+fn encoded_size(v: &String) -> usize {
+    // Quotes and separator
+    v.len() + 3
+}
@@ -0,0 +1,107 @@
+use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+
+use iron::prelude::*;
+use iron::status;
+use router::Router;
+use persistent::{Read, State};
+use rustc_serialize::json;
+use rustc_serialize::Decodable;
+
+use hammer::db::Database;
+use hammer::db::normalize::{BitMask, Rotate};
+
+use http::{B32, B64, B128, B256, BOptions, DBOptions, decode_body};
+use http::upgrade::HandoffKey;
+
+pub fn set(req: &mut Request) -> IronResult<Response> {
+    let options = try!(decode_body::<DBOptions>(req));
+
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let handoff = req.get::<Read<HandoffKey>>().unwrap();
+    let _admitted = match handoff.admit_unjournaled() {
+        Ok(admitted) => admitted,
+        Err(e) => return Ok(Response::with((status::ServiceUnavailable, e))),
+    };
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+
+    match bits {
+        32 => {
+            let dbmap_mx = req.get::<State<B32>>().unwrap();
+            do_set(options, bits, tolerance, namespace, options_mx, dbmap_mx)
+        },
+        64 => {
+            let dbmap_mx = req.get::<State<B64>>().unwrap();
+            do_set(options, bits, tolerance, namespace, options_mx, dbmap_mx)
+        },
+        128 => {
+            let dbmap_mx = req.get::<State<B128>>().unwrap();
+            do_set(options, bits, tolerance, namespace, options_mx, dbmap_mx)
+        },
+        256 => {
+            let dbmap_mx = req.get::<State<B256>>().unwrap();
+            do_set(options, bits, tolerance, namespace, options_mx, dbmap_mx)
+        },
+        _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
+    }
+}
+
+fn do_set<T>(options: DBOptions, bits: usize, tolerance: usize, namespace: String, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> IronResult<Response> where
+T: 'static + Sync + Send + Decodable + BitMask + Rotate,
+{
+    match options.validate::<T>(bits) {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    }
+
+    // Holding the DB map lock ensures the DB isn't created while the
+    // options are being set
+    let dbmap = dbmap_mx.read().unwrap();
+    if dbmap.contains_key(&(tolerance, namespace.clone())) {
+        return Ok(Response::with((status::Conflict, "Options must be set before the DB is created")))
+    }
+
+    options_mx.write().unwrap().insert((bits, tolerance, namespace), options);
+
+    Ok(Response::with((status::Ok, "\"ok\"")))
+}
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let bits = match req.extensions.get::<Router>().unwrap().find("bits") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB bitsize is required"))),
+    };
+
+    let tolerance = match req.extensions.get::<Router>().unwrap().find("tolerance") {
+        Some(v) => v.parse::<usize>().unwrap(),
+        None => return Ok(Response::with((status::BadRequest, "DB tolerance is required"))),
+    };
+
+    let namespace = match req.extensions.get::<Router>().unwrap().find("namespace") {
+        Some(v) => v.to_string(),
+        None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
+    };
+
+    let options_mx = req.get::<State<BOptions>>().unwrap();
+    let options = match options_mx.read().unwrap().get(&(bits, tolerance, namespace)) {
+        Some(options) => options.clone(),
+        None => DBOptions::default(),
+    };
+
+    let response_body = json::encode(&options).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
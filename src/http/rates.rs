@@ -0,0 +1,143 @@
+//! Per-namespace operation rates
+//!
+//! Successful `add`, `query`, `any_match` and `delete` requests are counted
+//! by namespace, along with their rolling rates over the last minute, 5
+//! minutes and hour, so per-tenant traffic can be graphed from `/metrics`
+//! alone.  Requests are counted rather than values, and counts are kept in
+//! memory.
+
+use std::collections::BTreeMap;
+use std::sync::{Arc, Mutex};
+use std::time::{SystemTime, UNIX_EPOCH};
+
+use iron::prelude::*;
+use iron::AfterMiddleware;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::metrics::Metrics;
+
+/// Minutes of history kept for rolling rates
+const HISTORY_MINUTES: u64 = 60;
+
+/// A counter with per-minute history
+///
+struct Rolling {
+    total: u64,
+    // Indexed by minute % HISTORY_MINUTES, holding (minute, count)
+    minutes: Vec<(u64, u64)>,
+}
+
+impl Rolling {
+    fn new() -> Rolling {
+        Rolling{total: 0, minutes: vec![(0, 0); HISTORY_MINUTES as usize]}
+    }
+
+    fn record(&mut self, minute: u64) {
+        self.total += 1;
+
+        let slot = &mut self.minutes[(minute % HISTORY_MINUTES) as usize];
+        if slot.0 != minute {
+            *slot = (minute, 0);
+        }
+        slot.1 += 1;
+    }
+
+    /// Average operations per second over the `minutes` minutes up to and
+    /// including `now`
+    ///
+    fn rate(&self, now: u64, minutes: u64) -> f64 {
+        let count = self.minutes.iter()
+            .filter(|&&(minute, _)| minute <= now && minute + minutes > now)
+            .fold(0, |sum, &(_, count)| sum + count);
+
+        count as f64 / (minutes * 60) as f64
+    }
+}
+
+/// Operation counters, by namespace and operation
+///
+pub struct NamespaceRates {
+    counters: Mutex<BTreeMap<String, BTreeMap<String, Rolling>>>,
+}
+
+impl NamespaceRates {
+    pub fn new() -> NamespaceRates {
+        NamespaceRates{counters: Mutex::new(BTreeMap::new())}
+    }
+
+    pub fn record(&self, namespace: &str, op: &str) {
+        let mut counters = self.counters.lock().unwrap();
+        counters.entry(namespace.to_string()).or_insert_with(BTreeMap::new)
+            .entry(op.to_string()).or_insert_with(Rolling::new)
+            .record(current_minute());
+    }
+
+    /// Total requests by namespace and operation
+    ///
+    pub fn totals(&self) -> BTreeMap<String, BTreeMap<String, u64>> {
+        let counters = self.counters.lock().unwrap();
+        counters.iter().map(|(namespace, ops)| {
+            (namespace.clone(), ops.iter().map(|(op, rolling)| (op.clone(), rolling.total)).collect())
+        }).collect()
+    }
+}
+
+impl ToJson for NamespaceRates {
+    fn to_json(&self) -> Json {
+        let now = current_minute();
+
+        let counters = self.counters.lock().unwrap();
+        let namespaces = counters.iter().map(|(namespace, ops)| {
+            let ops = ops.iter().map(|(op, rolling)| {
+                let mut d = BTreeMap::new();
+                d.insert("total".to_string(), rolling.total.to_json());
+                d.insert("rate_1m".to_string(), rolling.rate(now, 1).to_json());
+                d.insert("rate_5m".to_string(), rolling.rate(now, 5).to_json());
+                d.insert("rate_1h".to_string(), rolling.rate(now, 60).to_json());
+                (op.clone(), Json::Object(d))
+            }).collect::<BTreeMap<String, Json>>();
+            (namespace.clone(), Json::Object(ops))
+        }).collect::<BTreeMap<String, Json>>();
+
+        Json::Object(namespaces)
+    }
+}
+
+fn current_minute() -> u64 {
+    match SystemTime::now().duration_since(UNIX_EPOCH) {
+        Ok(d) => d.as_secs() / 60,
+        Err(_) => 0,
+    }
+}
+
+/// Counts successful requests to `/:op/:type/.../:namespace`
+///
+pub struct NamespaceCounter {
+    metrics: Arc<Metrics>,
+}
+
+impl NamespaceCounter {
+    pub fn new(metrics: Arc<Metrics>) -> NamespaceCounter {
+        NamespaceCounter{metrics: metrics}
+    }
+}
+
+impl AfterMiddleware for NamespaceCounter {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        let succeeded = match res.status {
+            Some(status) => status.is_success(),
+            None => false,
+        };
+
+        // The namespace is always the last segment of add, query, any_match
+        // and delete routes
+        let path = &req.url.path;
+        if succeeded && path.len() >= 5 {
+            match &path[0][..] {
+                "add" | "query" | "any_match" | "delete" => self.metrics.namespaces.record(&path[path.len() - 1], &path[0]),
+                _ => {},
+            }
+        }
+        Ok(res)
+    }
+}
@@ -0,0 +1,87 @@
+use std::collections::HashMap;
+use std::thread;
+use std::time::{Duration, SystemTime};
+use std::sync::{Arc, RwLock};
+use std::sync::atomic::Ordering;
+
+use hammer::db::Database;
+use rustc_serialize::Encodable;
+
+use http::DBOptions;
+use http::binary_handler::encode_value;
+use http::changes::ChangeFeed;
+use http::metrics::Metrics;
+
+type DBMap<T> = Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>;
+
+/// Background removal of keys older than their database's retention period
+///
+/// Every `interval_s` seconds, removes the keys of each binary database with
+/// the `retention` option which were inserted longer ago than the retention
+/// period.  Keys are removed from every partition, and published to the
+/// change feed as `expire`.  Removing holds the database's write lock.
+///
+pub struct Reaper {
+    pub interval_s: u64,
+    pub options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>,
+    pub changes: Arc<ChangeFeed>,
+    pub metrics: Arc<Metrics>,
+    pub b32: DBMap<u32>,
+    pub b64: DBMap<u64>,
+    pub b128: DBMap<[u64; 2]>,
+    pub b256: DBMap<[u64; 4]>,
+}
+
+impl Reaper {
+    pub fn spawn(self) {
+        thread::spawn(move || {
+            loop {
+                thread::sleep(Duration::from_secs(self.interval_s));
+
+                reap(32, &self.b32, &self.options_mx, &self.changes, &self.metrics);
+                reap(64, &self.b64, &self.options_mx, &self.changes, &self.metrics);
+                reap(128, &self.b128, &self.options_mx, &self.changes, &self.metrics);
+                reap(256, &self.b256, &self.options_mx, &self.changes, &self.metrics);
+            }
+        });
+    }
+}
+
+fn reap<T: Encodable>(bits: usize, dbmap_mx: &DBMap<T>, options_mx: &RwLock<HashMap<(usize, usize, String), DBOptions>>, changes: &ChangeFeed, metrics: &Metrics) {
+    // Don't hold the DB map lock while removing, so new DBs can be created
+    let dbs: Vec<((usize, String), Arc<RwLock<Box<Database<T>>>>)> = {
+        dbmap_mx.read().unwrap().iter().map(|(k, v)| (k.clone(), v.clone())).collect()
+    };
+
+    for ((tolerance, namespace), db_mx) in dbs.into_iter() {
+        let retention_s = match options_mx.read().unwrap().get(&(bits, tolerance, namespace.clone())) {
+            Some(options) => match options.retention_s() {
+                Ok(Some(secs)) => secs,
+                _ => continue,
+            },
+            None => continue,
+        };
+        let cutoff = SystemTime::now() - Duration::from_secs(retention_s);
+
+        let expired = { db_mx.read().unwrap().inserted_before(cutoff) };
+        if expired.is_empty() {
+            continue
+        }
+
+        let db_name = format!("b/{}/{}/{}", bits, tolerance, namespace);
+        let mut db = db_mx.write().unwrap();
+        for value in expired.iter() {
+            // The value may have been removed and inserted again since it
+            // was listed
+            match db.inserted_at(value) {
+                Some(t) if t < cutoff => {},
+                _ => continue,
+            }
+
+            if db.remove(value) {
+                changes.publish(db_name.clone(), "expire", encode_value(value));
+                metrics.expired.fetch_add(1, Ordering::Relaxed);
+            }
+        }
+    }
+}
@@ -0,0 +1,106 @@
+//! Restore progress, for readiness checks
+//!
+//! Restoring a namespace with `POST /load/:namespace` can take a while for
+//! large archives.  `GET /admin/recovery` reports the progress of each
+//! database being restored, and responds with a 503 until every restore has
+//! finished, so it can be used directly as a readiness probe.
+
+use std::collections::BTreeMap;
+use std::sync::Mutex;
+use std::time::Instant;
+
+use iron::prelude::*;
+use iron::{status, typemap};
+use persistent::Read;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+struct Progress {
+    started: Instant,
+    keys_total: usize,
+    keys_applied: usize,
+    bytes_remaining: usize,
+}
+
+impl Progress {
+    /// Estimated seconds until the restore finishes, assuming the rate so far
+    /// is maintained
+    ///
+    fn eta_s(&self) -> Option<f64> {
+        if self.keys_applied == 0 {
+            return None
+        }
+
+        let elapsed = self.started.elapsed();
+        let elapsed_s = elapsed.as_secs() as f64 + elapsed.subsec_nanos() as f64 / 1e9;
+        Some(elapsed_s * (self.keys_total - self.keys_applied) as f64 / self.keys_applied as f64)
+    }
+}
+
+impl ToJson for Progress {
+    fn to_json(&self) -> Json {
+        let mut d = BTreeMap::new();
+        d.insert("keys_total".to_string(), self.keys_total.to_json());
+        d.insert("keys_applied".to_string(), self.keys_applied.to_json());
+        d.insert("bytes_remaining".to_string(), self.bytes_remaining.to_json());
+        d.insert("eta_s".to_string(), self.eta_s().to_json());
+        Json::Object(d)
+    }
+}
+
+pub struct RecoveryKey;
+impl typemap::Key for RecoveryKey { type Value = Recovery; }
+
+/// Restores in progress, by DB name (i.e. `b/64/8/foo`)
+///
+pub struct Recovery {
+    restores: Mutex<BTreeMap<String, Progress>>,
+}
+
+impl Recovery {
+    pub fn new() -> Recovery {
+        Recovery{restores: Mutex::new(BTreeMap::new())}
+    }
+
+    pub fn start(&self, db: String, keys: usize, bytes: usize) {
+        let progress = Progress{started: Instant::now(), keys_total: keys, keys_applied: 0, bytes_remaining: bytes};
+        self.restores.lock().unwrap().insert(db, progress);
+    }
+
+    pub fn applied(&self, db: &String, keys: usize, bytes: usize) {
+        match self.restores.lock().unwrap().get_mut(db) {
+            Some(progress) => {
+                progress.keys_applied += keys;
+                progress.bytes_remaining -= bytes;
+            },
+            None => {},
+        }
+    }
+
+    /// Called whether or not the restore succeeded
+    ///
+    pub fn finish(&self, db: &String) {
+        self.restores.lock().unwrap().remove(db);
+    }
+}
+
+impl ToJson for Recovery {
+    fn to_json(&self) -> Json {
+        let restores = self.restores.lock().unwrap();
+
+        let mut d = BTreeMap::new();
+        d.insert("ready".to_string(), restores.is_empty().to_json());
+        d.insert("restores".to_string(), Json::Object(restores.iter().map(|(db, p)| (db.clone(), p.to_json())).collect()));
+        Json::Object(d)
+    }
+}
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let recovery = req.get::<Read<RecoveryKey>>().unwrap().to_json();
+
+    let response_body = json::encode(&recovery).unwrap();
+    match recovery.find("ready") == Some(&Json::Boolean(true)) {
+        true => Ok(Response::with((status::Ok, response_body))),
+        false => Ok(Response::with((status::ServiceUnavailable, response_body))),
+    }
+}
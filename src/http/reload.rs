@@ -0,0 +1,129 @@
+//! Reloading settings without a restart
+//!
+//! With `--config=<path>`, settings are read from a JSON file at startup,
+//! taking precedence over flags, and read again on `SIGHUP` or
+//! `POST /admin/reload`:
+//!
+//! ```json
+//! {"max_pending_writes": 500, "throttle_delay_ms": 20, "max_response_bytes": 1048576}
+//! ```
+//!
+//! Only the settings in `RELOADABLE` can be set this way; any other key is
+//! an error, and a file with an error isn't applied at all.  Settings missing
+//! from the file keep their current values.
+
+use std::collections::BTreeMap;
+use std::fs::File;
+use std::io::Read;
+use std::sync::{Arc, RwLock};
+use std::sync::atomic::{AtomicBool, ATOMIC_BOOL_INIT, Ordering};
+use std::thread;
+use std::time::Duration;
+
+use iron::prelude::*;
+use iron::status;
+use libc;
+use persistent::State;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::{Config, ConfigKey};
+
+/// Settings which take effect for requests started after they change
+pub const RELOADABLE: [&'static str; 5] = ["max_pending_writes", "throttle_delay_ms", "max_response_bytes", "insert_workers", "namespace_concurrency"];
+
+/// How often the signal watcher checks for `SIGHUP`
+const SIGNAL_POLL_MS: u64 = 500;
+
+static SIGHUP_RECEIVED: AtomicBool = ATOMIC_BOOL_INIT;
+
+extern "C" fn on_sighup(_: libc::c_int) {
+    SIGHUP_RECEIVED.store(true, Ordering::SeqCst);
+}
+
+/// Applies the settings in the file at `path` to `config`, returning the
+/// settings applied
+///
+pub fn apply_file(path: &str, config: &mut Config) -> Result<Json, String> {
+    let mut contents = String::new();
+    match File::open(path).and_then(|mut f| f.read_to_string(&mut contents)) {
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to read config file '{}': {}", path, e)),
+    }
+
+    let settings = match Json::from_str(&contents) {
+        Ok(Json::Object(settings)) => settings,
+        Ok(_) => return Err(format!("config file '{}' must hold a JSON object", path)),
+        Err(e) => return Err(format!("unable to parse config file '{}': {}", path, e)),
+    };
+
+    // Checked against a copy, so that nothing changes if any setting is bad
+    let mut updated = config.clone();
+    for (key, value) in settings.iter() {
+        try!(apply(&mut updated, key, value));
+    }
+    *config = updated;
+
+    Ok(Json::Object(settings))
+}
+
+fn apply(config: &mut Config, key: &str, value: &Json) -> Result<(), String> {
+    let n = match value.as_u64() {
+        Some(n) => n,
+        None => return Err(format!("{} must be a non-negative integer", key)),
+    };
+
+    match key {
+        "max_pending_writes" => config.max_pending_writes = n as usize,
+        "throttle_delay_ms" => config.throttle_delay_ms = n,
+        "max_response_bytes" => config.max_response_bytes = n as usize,
+        "insert_workers" if n > 0 => config.insert_workers = n as usize,
+        "insert_workers" => return Err("insert_workers must be at least 1".to_string()),
+        "namespace_concurrency" => config.namespace_concurrency = n as usize,
+        _ => return Err(format!("{} can't be reloaded (reloadable settings are {})", key, RELOADABLE.join(", "))),
+    }
+    Ok(())
+}
+
+/// Reloads the config file whenever the process receives `SIGHUP`
+///
+pub fn watch_sighup(path: String, config_mx: Arc<RwLock<Config>>) {
+    unsafe {
+        libc::signal(libc::SIGHUP, on_sighup as libc::sighandler_t);
+    }
+
+    thread::spawn(move || {
+        loop {
+            thread::sleep(Duration::from_millis(SIGNAL_POLL_MS));
+            if !SIGHUP_RECEIVED.swap(false, Ordering::SeqCst) {
+                continue
+            }
+
+            match apply_file(&path, &mut *config_mx.write().unwrap()) {
+                Ok(settings) => log!("Reloaded {}: {}", path, json::encode(&settings).unwrap()),
+                Err(e) => log!("WARNING: not reloading: {}", e),
+            }
+        }
+    });
+}
+
+pub fn reload(req: &mut Request) -> IronResult<Response> {
+    let config_mx = req.get::<State<ConfigKey>>().unwrap();
+    let path = match config_mx.read().unwrap().config_file {
+        Some(ref path) => path.clone(),
+        None => return Ok(Response::with((status::BadRequest, "no config file to reload (see --config)"))),
+    };
+
+    let result = apply_file(&path, &mut *config_mx.write().unwrap());
+    match result {
+        Ok(settings) => {
+            log!("Reloaded {}: {}", path, json::encode(&settings).unwrap());
+
+            let mut d = BTreeMap::new();
+            d.insert("reloaded".to_string(), settings);
+            d.insert("reloadable".to_string(), RELOADABLE.iter().map(|s| s.to_string()).collect::<Vec<String>>().to_json());
+            Ok(Response::with((status::Ok, json::encode(&Json::Object(d)).unwrap())))
+        },
+        Err(e) => Ok(Response::with((status::BadRequest, e))),
+    }
+}
@@ -0,0 +1,211 @@
+//! Workload replay
+//!
+//! `hammerhttp replay` sends the requests in a capture file (see `capture`)
+//! to a server, at their original pace scaled by `--speed` (so 2 replays
+//! twice as fast, and 0 sends them as fast as possible), from `WORKERS`
+//! threads at once.  It reports the requests' latencies, how far behind
+//! schedule they were sent, and which got a different status from the one
+//! they got when captured; the server replayed against should start with
+//! the same data as the one captured from, or adds will differ by design.
+
+use std::cmp::Ordering;
+use std::collections::BTreeMap;
+use std::fmt;
+use std::fs::File;
+use std::io::{BufRead, BufReader};
+use std::sync::{mpsc, Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use rustc_serialize::json::Json;
+
+use http::loader::request;
+
+/// Requests in flight at once
+const WORKERS: usize = 16;
+
+/// A captured request
+///
+pub struct Record {
+    /// Milliseconds after the capture started that the request arrived
+    pub at_ms: u64,
+    pub method: String,
+    pub path: String,
+    pub body: String,
+    /// Status of the captured response
+    pub status: u16,
+}
+
+impl Record {
+    fn from_json(line: &str) -> Result<Record, String> {
+        let json = match Json::from_str(line) {
+            Ok(json) => json,
+            Err(e) => return Err(format!("{}", e)),
+        };
+        let field = |name: &str| match json.find(name) {
+            Some(value) => Ok(value.clone()),
+            None => Err(format!("missing '{}'", name)),
+        };
+
+        match (try!(field("at_ms")), try!(field("method")), try!(field("path")), try!(field("body")), try!(field("status"))) {
+            (Json::U64(at_ms), Json::String(method), Json::String(path), Json::String(body), Json::U64(status)) => {
+                Ok(Record{at_ms: at_ms, method: method, path: path, body: body, status: status as u16})
+            },
+            _ => Err("unexpected field types".to_string()),
+        }
+    }
+}
+
+/// Reads the requests in a capture file, in the order they arrived
+///
+pub fn load(path: &str) -> Result<Vec<Record>, String> {
+    let file = match File::open(path) {
+        Ok(f) => f,
+        Err(e) => return Err(format!("unable to open '{}': {}", path, e)),
+    };
+
+    let mut records = vec![];
+    for (i, line) in BufReader::new(file).lines().enumerate() {
+        let line = match line {
+            Ok(line) => line,
+            Err(e) => return Err(format!("unable to read '{}': {}", path, e)),
+        };
+        if line.trim().is_empty() {
+            continue
+        }
+        match Record::from_json(&line) {
+            Ok(record) => records.push(record),
+            Err(e) => return Err(format!("{}:{}: {}", path, i + 1, e)),
+        }
+    }
+
+    // Requests are captured as they complete
+    records.sort_by(|a, b| a.at_ms.cmp(&b.at_ms));
+    Ok(records)
+}
+
+/// Summary of a replay
+///
+#[derive(Default)]
+pub struct Summary {
+    pub sent: usize,
+    /// Requests which couldn't be sent, or got no response
+    pub failed: usize,
+    /// Why the first of them failed
+    pub first_error: Option<String>,
+    /// Counts of requests whose status differed, by captured and replayed
+    /// status
+    pub mismatches: BTreeMap<(u16, u16), usize>,
+    /// Latency of each request which got a response, in milliseconds
+    pub latencies_ms: Vec<f64>,
+    /// Most any request was sent behind schedule, in milliseconds
+    pub max_lag_ms: f64,
+}
+
+impl Summary {
+    /// The `p`th percentile latency
+    ///
+    fn percentile(&self, p: f64) -> f64 {
+        match self.latencies_ms.len() {
+            0 => 0.0,
+            n => self.latencies_ms[((n - 1) as f64 * p) as usize],
+        }
+    }
+}
+
+impl fmt::Display for Summary {
+    fn fmt(&self, f: &mut fmt::Formatter) -> Result<(), fmt::Error> {
+        try!(writeln!(f, "{} requests sent, {} failed", self.sent, self.failed));
+        match self.first_error {
+            Some(ref e) => try!(writeln!(f, "first failure: {}", e)),
+            None => {},
+        }
+        try!(writeln!(f, "latency: p50 {:.1}ms, p99 {:.1}ms, max {:.1}ms", self.percentile(0.5), self.percentile(0.99), self.percentile(1.0)));
+        try!(writeln!(f, "most behind schedule: {:.1}ms", self.max_lag_ms));
+
+        let mismatched = self.mismatches.values().fold(0, |n, count| n + count);
+        try!(writeln!(f, "{} statuses differed from the capture", mismatched));
+        for (&(captured, replayed), count) in self.mismatches.iter() {
+            try!(writeln!(f, "  {} -> {}: {}", captured, replayed, count));
+        }
+        Ok(())
+    }
+}
+
+/// Sends `records` to `server`, `speed` times as fast as they were captured
+/// (0 is as fast as possible)
+///
+pub fn run(server: &str, records: Vec<Record>, speed: f64) -> Summary {
+    let (requests_tx, requests_rx) = mpsc::channel::<(Record, Instant)>();
+    let requests_rx = Arc::new(Mutex::new(requests_rx));
+    let (results_tx, results_rx) = mpsc::channel();
+
+    for _ in 0..WORKERS {
+        let requests_rx = requests_rx.clone();
+        let results_tx = results_tx.clone();
+        let server = server.to_string();
+        thread::spawn(move || {
+            loop {
+                // Not held while sending the request
+                let next = requests_rx.lock().unwrap().recv();
+                let (record, due) = match next {
+                    Ok(next) => next,
+                    Err(_) => return,
+                };
+
+                let start = Instant::now();
+                let lag_ms = match start > due {
+                    true => ms(start.duration_since(due)),
+                    false => 0.0,
+                };
+                let result = request(&server, &record.method, &record.path, &record.body).map(|(status, _)| status);
+                results_tx.send((record.status, result, ms(start.elapsed()), lag_ms)).unwrap();
+            }
+        });
+    }
+    drop(results_tx);
+
+    let start = Instant::now();
+    let first_ms = records.first().map(|r| r.at_ms).unwrap_or(0);
+    for record in records.into_iter() {
+        let due = match speed > 0.0 {
+            true => start + Duration::from_millis(((record.at_ms - first_ms) as f64 / speed) as u64),
+            false => Instant::now(),
+        };
+        let now = Instant::now();
+        if due > now {
+            thread::sleep(due.duration_since(now));
+        }
+        requests_tx.send((record, due)).unwrap();
+    }
+    drop(requests_tx);
+
+    let mut summary = Summary::default();
+    for (captured, result, latency_ms, lag_ms) in results_rx.iter() {
+        summary.sent += 1;
+        if lag_ms > summary.max_lag_ms {
+            summary.max_lag_ms = lag_ms;
+        }
+        match result {
+            Ok(status) => {
+                summary.latencies_ms.push(latency_ms);
+                if status != captured {
+                    *summary.mismatches.entry((captured, status)).or_insert(0) += 1;
+                }
+            },
+            Err(e) => {
+                summary.failed += 1;
+                if summary.first_error.is_none() {
+                    summary.first_error = Some(e);
+                }
+            },
+        }
+    }
+
+    summary.latencies_ms.sort_by(|a, b| a.partial_cmp(b).unwrap_or(Ordering::Equal));
+    summary
+}
+
+fn ms(d: Duration) -> f64 {
+    d.as_secs() as f64 * 1000.0 + d.subsec_nanos() as f64 / 1e6
+}
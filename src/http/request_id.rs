@@ -0,0 +1,105 @@
+//! Request IDs, for correlating client reports with server logs
+//!
+//! Each request is identified by its `X-Request-Id` header, or by a random ID
+//! if it doesn't have one.  The ID is returned in the response's
+//! `X-Request-Id` header, and log lines written while handling the request
+//! (with `log!`), including slow DB operations (`--slow-op-ms`), are prefixed
+//! with it.  Failed requests are always logged.
+
+use std::cell::RefCell;
+
+use iron::prelude::*;
+use iron::{typemap, AfterMiddleware, BeforeMiddleware};
+use rand;
+
+/// Longest client-supplied ID accepted; longer IDs are replaced
+const MAX_LEN: usize = 128;
+
+thread_local!(static CURRENT: RefCell<Option<String>> = RefCell::new(None));
+
+pub struct RequestIdKey;
+impl typemap::Key for RequestIdKey { type Value = String; }
+
+/// Writes a log line, prefixed with the ID of the request this thread is
+/// handling, if any
+///
+pub fn log(line: String) {
+    CURRENT.with(|current| {
+        match *current.borrow() {
+            Some(ref id) => println!("[{}] {}", id, line),
+            None => println!("{}", line),
+        }
+    })
+}
+
+pub struct RequestId;
+
+impl RequestId {
+    /// The request's ID, assigning one if the `before` middleware didn't run
+    /// (i.e. because an earlier middleware failed)
+    ///
+    fn id(req: &mut Request) -> String {
+        match req.extensions.get::<RequestIdKey>() {
+            Some(id) => return id.clone(),
+            None => {},
+        }
+
+        let id = generate();
+        RequestId::start(req, id.clone());
+        id
+    }
+
+    fn start(req: &mut Request, id: String) {
+        CURRENT.with(|current| *current.borrow_mut() = Some(id.clone()));
+        req.extensions.insert::<RequestIdKey>(id);
+    }
+
+    fn finish(id: String, res: &mut Response) {
+        res.headers.set_raw("X-Request-Id", vec![id.into_bytes()]);
+        CURRENT.with(|current| *current.borrow_mut() = None);
+    }
+}
+
+impl BeforeMiddleware for RequestId {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        let id = match req.headers.get_raw("X-Request-Id") {
+            Some(values) if values.len() == 1 && valid(&values[0]) => String::from_utf8_lossy(&values[0]).into_owned(),
+            _ => generate(),
+        };
+
+        RequestId::start(req, id);
+        Ok(())
+    }
+}
+
+impl AfterMiddleware for RequestId {
+    fn after(&self, req: &mut Request, mut res: Response) -> IronResult<Response> {
+        let id = RequestId::id(req);
+        match res.status {
+            Some(status) if !status.is_success() => {
+                log(format!("{} /{} returned {}", req.method, req.url.path.join("/"), status));
+            },
+            _ => {},
+        }
+        RequestId::finish(id, &mut res);
+        Ok(res)
+    }
+
+    fn catch(&self, req: &mut Request, mut err: IronError) -> IronResult<Response> {
+        let id = RequestId::id(req);
+        log(format!("{} /{} failed: {}", req.method, req.url.path.join("/"), err));
+        RequestId::finish(id, &mut err.response);
+        Err(err)
+    }
+}
+
+/// Client IDs must be printable ASCII, so they can be logged and returned
+/// as-is
+///
+fn valid(id: &[u8]) -> bool {
+    !id.is_empty() && id.len() <= MAX_LEN && id.iter().all(|&b| b > b' ' && b < 0x7f)
+}
+
+fn generate() -> String {
+    format!("{:016x}", rand::random::<u64>())
+}
@@ -0,0 +1,143 @@
+use std::collections::{BTreeMap, HashSet};
+use std::io::{BufRead, BufReader, Write};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+use std::sync::Mutex;
+
+use iron::typemap;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+/// Re-scores query results before they're returned
+///
+/// Rerankers are given the query and the matches found within tolerance (all
+/// base64-encoded), and return the matches to be returned, in order.  Matches
+/// may be dropped; values which weren't passed to the reranker (and repeats)
+/// are dropped by `rerank`.
+///
+pub trait Reranker: Sync + Send {
+    fn rerank(&self, db: &str, query: &str, matches: Vec<String>) -> Result<Vec<String>, String>;
+}
+
+/// Rerank `matches` of `query` in `db`, keeping only the values returned
+/// which were among them, once each
+///
+pub fn rerank(reranker: &Reranker, db: &str, query: &str, matches: Vec<String>) -> Result<Vec<String>, String> {
+    let mut given: HashSet<String> = matches.iter().cloned().collect();
+    let mut reranked = try!(reranker.rerank(db, query, matches));
+
+    let returned = reranked.len();
+    reranked.retain(|v| given.remove(v));
+    if reranked.len() < returned {
+        log!("WARNING: reranker returned {} values for {} which weren't matches", returned - reranked.len(), db);
+    }
+    Ok(reranked)
+}
+
+/// Reranks using an external process
+///
+/// The process is started once and kept running.  Each request is written to
+/// its stdin as a single line of JSON:
+///
+/// ```json
+/// {"db":"b/64/8/foo","query":"AAAAAAAAAAA=","matches":["AAAAAAAAAAE=","AAAAAAAAAAI="]}
+/// ```
+///
+/// and the process must respond by writing a single line to its stdout
+/// containing a JSON array of the matches to return.  Requests are
+/// serialized, so the process doesn't need to handle concurrency.
+///
+pub struct Subprocess {
+    // Keep the child around so it isn't dropped while we're talking to it
+    _child: Child,
+    pipes: Mutex<(ChildStdin, BufReader<ChildStdout>)>,
+}
+
+impl Subprocess {
+    /// Start `command` using the shell
+    ///
+    pub fn spawn(command: &str) -> Result<Subprocess, String> {
+        let mut child = match Command::new("sh").arg("-c").arg(command).stdin(Stdio::piped()).stdout(Stdio::piped()).spawn() {
+            Ok(v) => v,
+            Err(e) => return Err(format!("unable to start reranker '{}': {}", command, e)),
+        };
+
+        let stdin = child.stdin.take().unwrap();
+        let stdout = BufReader::new(child.stdout.take().unwrap());
+
+        Ok(Subprocess{_child: child, pipes: Mutex::new((stdin, stdout))})
+    }
+}
+
+impl Reranker for Subprocess {
+    fn rerank(&self, db: &str, query: &str, matches: Vec<String>) -> Result<Vec<String>, String> {
+        let mut request = BTreeMap::new();
+        request.insert("db".to_string(), db.to_json());
+        request.insert("query".to_string(), query.to_json());
+        request.insert("matches".to_string(), matches.to_json());
+        let request_line = json::encode(&Json::Object(request)).unwrap();
+
+        let mut pipes = self.pipes.lock().unwrap();
+        let (ref mut stdin, ref mut stdout) = *pipes;
+
+        match writeln!(stdin, "{}", request_line).and_then(|_| stdin.flush()) {
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to write to reranker: {}", e)),
+        }
+
+        let mut response_line = String::new();
+        match stdout.read_line(&mut response_line) {
+            Ok(0) => return Err("reranker exited".to_string()),
+            Ok(_) => {},
+            Err(e) => return Err(format!("unable to read from reranker: {}", e)),
+        }
+
+        match json::decode::<Vec<String>>(&response_line) {
+            Ok(v) => Ok(v),
+            Err(e) => Err(format!("unable to parse reranker response '{}': {:?}", response_line.trim(), e)),
+        }
+    }
+}
+
+pub struct RerankerKey;
+impl typemap::Key for RerankerKey { type Value = Option<Box<Reranker>>; }
+
+#[cfg(test)]
+mod test {
+    use http::rerank::{rerank, Reranker, Subprocess};
+
+    /// Returns its matches reversed, along with a value it wasn't given
+    ///
+    struct Reverse;
+
+    impl Reranker for Reverse {
+        fn rerank(&self, _: &str, _: &str, mut matches: Vec<String>) -> Result<Vec<String>, String> {
+            matches.reverse();
+            matches.push("injected".to_string());
+            Ok(matches)
+        }
+    }
+
+    fn strings(values: &[&str]) -> Vec<String> {
+        values.iter().map(|v| v.to_string()).collect()
+    }
+
+    #[test]
+    fn values_which_werent_matches_are_dropped() {
+        assert_eq!(rerank(&Reverse, "b/64/8/foo", "q", strings(&["a", "b"])), Ok(strings(&["b", "a"])));
+    }
+
+    #[test]
+    fn subprocess_responses_are_filtered() {
+        let reranker = Subprocess::spawn("while read line; do echo '[\"b\",\"a\",\"b\",\"z\"]'; done").unwrap();
+
+        assert_eq!(reranker.rerank("b/64/8/foo", "q", strings(&["a", "b"])), Ok(strings(&["b", "a", "b", "z"])));
+        assert_eq!(rerank(&reranker, "b/64/8/foo", "q", strings(&["a", "b"])), Ok(strings(&["b", "a"])));
+        assert_eq!(rerank(&reranker, "b/64/8/foo", "q", strings(&["c"])), Ok(vec![]));
+    }
+
+    #[test]
+    fn subprocess_errors_are_returned() {
+        let reranker = Subprocess::spawn("read line; echo 'not json'").unwrap();
+        assert!(rerank(&reranker, "b/64/8/foo", "q", strings(&["a"])).is_err());
+    }
+}
@@ -0,0 +1,323 @@
+//! The Redis protocol (RESP)
+//!
+//! With `--resp-bind`, the server also accepts commands from Redis clients,
+//! so services which already talk to Redis don't need an HTTP client:
+//!
+//! * `HADD <db> <value> ...`
+//! * `HQUERY <db> <value> ...`
+//! * `HDEL <db> <value> ...`
+//! * `AUTH <token>`, with `--auth-tokens` or `--auth-command`
+//! * `PING` and `QUIT`
+//!
+//! `<db>` is the path after the HTTP endpoint, i.e. `b/64/8/foo` or
+//! `f/64/0/bar`, and may carry query parameters (`b/64/8/foo?diff=true`);
+//! anything else is rejected, so commands can't reach other endpoints.
+//! Each command is forwarded to the HTTP listener, so it passes through the
+//! same middleware (throttling, metrics, chaos and so on) as HTTP requests,
+//! and the JSON response is translated into RESP: strings become bulk
+//! strings, arrays become arrays and `null` becomes a nil bulk string.
+//! Objects (i.e. explained matches) are returned as JSON bulk strings.
+//! The token given with `AUTH` is sent with every command after it.
+//!
+//! Commands are limited to `http::MAX_BODY_BYTES` in total, and at most
+//! `MAX_CONNECTIONS` clients are served at once.
+
+use std::io;
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::{Ipv4Addr, Ipv6Addr, SocketAddr, SocketAddrV4, SocketAddrV6, TcpListener, TcpStream};
+use std::sync::Arc;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::thread;
+
+use hyper::Client;
+use hyper::header::Headers;
+use hyper::status::StatusCode;
+use rustc_serialize::json;
+use rustc_serialize::json::Json;
+
+use http::MAX_BODY_BYTES;
+
+/// Most arguments in a command, as in Redis
+const MAX_ARGS: usize = 1024 * 1024;
+
+/// Most bytes in a command's arguments, as they're forwarded as one request
+const MAX_BULK_BYTES: usize = MAX_BODY_BYTES;
+
+/// Longest inline command or length header
+const MAX_LINE_BYTES: usize = 64 * 1024;
+
+/// Most clients connected at once
+const MAX_CONNECTIONS: usize = 1024;
+
+/// Accepts RESP connections on `listener`, forwarding commands to the HTTP
+/// server at `http_addr`
+///
+pub fn serve(listener: TcpListener, http_addr: SocketAddr) {
+    let upstream = Arc::new(format!("http://{}", loopback(http_addr)));
+    let connections = Arc::new(AtomicUsize::new(0));
+
+    for stream in listener.incoming() {
+        match stream {
+            Ok(mut stream) => {
+                if connections.fetch_add(1, Ordering::SeqCst) >= MAX_CONNECTIONS {
+                    connections.fetch_sub(1, Ordering::SeqCst);
+                    let _ = write_reply(&mut stream, &Reply::Error("ERR max number of clients reached".to_string()));
+                    continue
+                }
+
+                let upstream = upstream.clone();
+                let connections = connections.clone();
+                thread::spawn(move || {
+                    match handle(stream, &upstream) {
+                        Ok(_) => {},
+                        Err(e) => log!("RESP connection failed: {}", e),
+                    }
+                    connections.fetch_sub(1, Ordering::SeqCst);
+                });
+            },
+            Err(e) => log!("Unable to accept RESP connection: {}", e),
+        }
+    }
+}
+
+/// The address to connect to for `addr`, which may be a wildcard
+///
+fn loopback(addr: SocketAddr) -> SocketAddr {
+    match addr {
+        SocketAddr::V4(ref a) if *a.ip() == Ipv4Addr::new(0, 0, 0, 0) => SocketAddr::V4(SocketAddrV4::new(Ipv4Addr::new(127, 0, 0, 1), a.port())),
+        SocketAddr::V6(ref a) if *a.ip() == Ipv6Addr::new(0, 0, 0, 0, 0, 0, 0, 0) => SocketAddr::V6(SocketAddrV6::new(Ipv6Addr::new(0, 0, 0, 0, 0, 0, 0, 1), a.port(), 0, 0)),
+        addr => addr,
+    }
+}
+
+fn handle(stream: TcpStream, upstream: &str) -> io::Result<()> {
+    let client = Client::new();
+    let mut reader = BufReader::new(try!(stream.try_clone()));
+    let mut writer = stream;
+    let mut token = None;
+
+    loop {
+        let command = match try!(read_command(&mut reader)) {
+            Some(command) => command,
+            None => return Ok(()),
+        };
+        if command.is_empty() {
+            continue
+        }
+
+        let reply = match &command[0].to_lowercase()[..] {
+            "ping" => Reply::Status("PONG".to_string()),
+            "auth" if command.len() == 2 => {
+                token = Some(command[1].clone());
+                Reply::Status("OK".to_string())
+            },
+            "auth" => Reply::Error("ERR wrong number of arguments for 'auth'".to_string()),
+            "quit" => {
+                try!(write_reply(&mut writer, &Reply::Status("OK".to_string())));
+                return Ok(())
+            },
+            "hadd" => forward(&client, upstream, &token, "add", &command[1..]),
+            "hquery" => forward(&client, upstream, &token, "query", &command[1..]),
+            "hdel" => forward(&client, upstream, &token, "delete", &command[1..]),
+            other => Reply::Error(format!("ERR unknown command '{}'", other)),
+        };
+        try!(write_reply(&mut writer, &reply));
+    }
+}
+
+enum Reply {
+    Status(String),
+    Error(String),
+    Integer(i64),
+    Bulk(Option<String>),
+    Array(Vec<Reply>),
+}
+
+/// Sends the values in `args` to the HTTP endpoint for `op`
+///
+fn forward(client: &Client, upstream: &str, token: &Option<String>, op: &str, args: &[String]) -> Reply {
+    if args.len() < 2 {
+        return Reply::Error(format!("ERR wrong number of arguments for '{}'", op))
+    }
+    if !is_db_path(&args[0]) {
+        return Reply::Error(format!("ERR invalid database '{}' (expected b or f/<bits>/<tolerance>/<namespace>)", args[0]))
+    }
+
+    let url = format!("{}/{}/{}", upstream, op, args[0]);
+    let body = json::encode(&args[1..].to_vec()).unwrap();
+    let mut headers = Headers::new();
+    match *token {
+        Some(ref token) => headers.set_raw("Authorization", vec![format!("Bearer {}", token).into_bytes()]),
+        None => {},
+    }
+    let mut res = match client.post(&url).headers(headers).body(&body[..]).send() {
+        Ok(res) => res,
+        Err(e) => return Reply::Error(format!("ERR {}", e)),
+    };
+
+    let mut response_body = String::new();
+    match res.read_to_string(&mut response_body) {
+        Ok(_) => {},
+        Err(e) => return Reply::Error(format!("ERR {}", e)),
+    }
+
+    if res.status != StatusCode::Ok {
+        return Reply::Error(format!("ERR {}: {}", res.status, response_body.trim()))
+    }
+
+    match Json::from_str(&response_body) {
+        Ok(json) => to_reply(json),
+        Err(e) => Reply::Error(format!("ERR unable to parse response: {}", e)),
+    }
+}
+
+/// Whether `db` is `b` or `f`, bits, tolerance and namespace, optionally
+/// followed by query parameters
+///
+fn is_db_path(db: &str) -> bool {
+    if db.chars().any(|c| c.is_whitespace() || c.is_control() || c == '#') {
+        return false
+    }
+
+    let path = db.splitn(2, '?').next().unwrap();
+    let parts: Vec<&str> = path.split('/').collect();
+    parts.len() == 4 &&
+        (parts[0] == "b" || parts[0] == "f") &&
+        parts[1].parse::<usize>().is_ok() &&
+        parts[2].parse::<usize>().is_ok() &&
+        !parts[3].is_empty() && parts[3] != "." && parts[3] != ".."
+}
+
+fn to_reply(json: Json) -> Reply {
+    match json {
+        Json::String(s) => Reply::Bulk(Some(s)),
+        Json::Array(a) => Reply::Array(a.into_iter().map(to_reply).collect()),
+        Json::I64(n) => Reply::Integer(n),
+        Json::U64(n) => Reply::Integer(n as i64),
+        Json::F64(n) => Reply::Bulk(Some(n.to_string())),
+        Json::Boolean(b) => Reply::Integer(b as i64),
+        Json::Null => Reply::Bulk(None),
+        json => Reply::Bulk(Some(json::encode(&json).unwrap())),
+    }
+}
+
+fn write_reply<W: Write>(writer: &mut W, reply: &Reply) -> io::Result<()> {
+    match *reply {
+        Reply::Status(ref s) => write!(writer, "+{}\r\n", s),
+        Reply::Error(ref s) => write!(writer, "-{}\r\n", s.replace("\r", " ").replace("\n", " ")),
+        Reply::Integer(n) => write!(writer, ":{}\r\n", n),
+        Reply::Bulk(Some(ref s)) => write!(writer, "${}\r\n{}\r\n", s.len(), s),
+        Reply::Bulk(None) => write!(writer, "$-1\r\n"),
+        Reply::Array(ref replies) => {
+            try!(write!(writer, "*{}\r\n", replies.len()));
+            for reply in replies.iter() {
+                try!(write_reply(writer, reply));
+            }
+            Ok(())
+        },
+    }
+}
+
+/// The next command, either a RESP array of bulk strings or an inline
+/// command (as sent by `telnet`), or `None` once the client disconnects
+///
+fn read_command<R: BufRead>(reader: &mut R) -> io::Result<Option<Vec<String>>> {
+    let line = match try!(read_line(reader)) {
+        Some(line) => line,
+        None => return Ok(None),
+    };
+
+    if !line.starts_with("*") {
+        return Ok(Some(line.split_whitespace().map(|s| s.to_string()).collect()))
+    }
+
+    // Lengths are only limits: nothing is allocated until the data arrives
+    let count = try!(parse_length(&line[1..], MAX_ARGS));
+    let mut args = vec![];
+    let mut remaining = MAX_BULK_BYTES;
+    for _ in 0..count {
+        let header = match try!(read_line(reader)) {
+            Some(ref header) if header.starts_with("$") => header.clone(),
+            _ => return Err(protocol_error("expected a bulk string")),
+        };
+        let len = try!(parse_length(&header[1..], remaining));
+        remaining -= len;
+
+        let mut buf = vec![];
+        if try!(reader.by_ref().take(len as u64).read_to_end(&mut buf)) < len {
+            return Err(io::Error::new(io::ErrorKind::UnexpectedEof, "command cut short"))
+        }
+        // The string is followed by CRLF
+        try!(reader.read_exact(&mut [0; 2]));
+        match String::from_utf8(buf) {
+            Ok(arg) => args.push(arg),
+            Err(_) => return Err(protocol_error("arguments must be UTF-8")),
+        }
+    }
+    Ok(Some(args))
+}
+
+fn read_line<R: BufRead>(reader: &mut R) -> io::Result<Option<String>> {
+    let mut line = String::new();
+    match try!(reader.by_ref().take(MAX_LINE_BYTES as u64).read_line(&mut line)) {
+        0 => Ok(None),
+        n if n == MAX_LINE_BYTES && !line.ends_with("\n") => Err(protocol_error("line too long")),
+        _ => Ok(Some(line.trim_right_matches(|c| c == '\r' || c == '\n').to_string())),
+    }
+}
+
+/// A length of at most `max`, which a client can't be trusted to keep to
+///
+fn parse_length(s: &str, max: usize) -> io::Result<usize> {
+    match s.parse::<usize>() {
+        Ok(n) if n <= max => Ok(n),
+        Ok(_) => Err(protocol_error("length too large")),
+        Err(_) => Err(protocol_error("invalid length")),
+    }
+}
+
+fn protocol_error(msg: &str) -> io::Error {
+    io::Error::new(io::ErrorKind::InvalidData, msg)
+}
+
+#[cfg(test)]
+mod test {
+    use std::io::Cursor;
+
+    use super::{is_db_path, read_command, MAX_LINE_BYTES};
+
+    #[test]
+    fn read_command_rejects_huge_lengths() {
+        let command = read_command(&mut Cursor::new(b"*2\r\n$4\r\nHADD\r\n$10\r\nb/64/8/foo\r\n".to_vec())).unwrap();
+        assert_eq!(command, Some(vec!["HADD".to_string(), "b/64/8/foo".to_string()]));
+
+        assert!(read_command(&mut Cursor::new(b"*2000000\r\n".to_vec())).is_err());
+        assert!(read_command(&mut Cursor::new(b"*1\r\n$18446744073709551615\r\n".to_vec())).is_err());
+        assert!(read_command(&mut Cursor::new(b"*1\r\n$1000000000\r\n".to_vec())).is_err());
+
+        // Lengths aren't trusted until the data arrives
+        assert!(read_command(&mut Cursor::new(b"*1000000\r\n$100000000\r\nabc\r\n".to_vec())).is_err());
+    }
+
+    #[test]
+    fn read_command_limits_lines() {
+        let inline = read_command(&mut Cursor::new(b"PING\r\n".to_vec())).unwrap();
+        assert_eq!(inline, Some(vec!["PING".to_string()]));
+
+        let long = vec![b'a'; MAX_LINE_BYTES * 2];
+        assert!(read_command(&mut Cursor::new(long)).is_err());
+    }
+
+    #[test]
+    fn only_db_paths_are_forwarded() {
+        assert!(is_db_path("b/64/8/foo"));
+        assert!(is_db_path("f/64/0/bar?diff=true"));
+
+        assert!(!is_db_path("b/64/8"));
+        assert!(!is_db_path("../admin/upgrade"));
+        assert!(!is_db_path("b/64/8/../../admin/upgrade"));
+        assert!(!is_db_path("v/64/8/foo"));
+        assert!(!is_db_path("b/64/8/.."));
+        assert!(!is_db_path("b/64/8/foo bar"));
+    }
+}
@@ -0,0 +1,73 @@
+use std::collections::HashMap;
+use std::thread;
+use std::time::Duration;
+use std::sync::{Arc, RwLock};
+use std::sync::atomic::Ordering;
+
+use hammer::db::Database;
+use hammer::db::integrity::IntegrityReport;
+
+use http::metrics::Metrics;
+
+type DBMap<T> = Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>;
+
+/// Background index consistency checker
+///
+/// Every `interval_s` seconds, checks each binary database's indices for
+/// missing or dangling entries (see `hammer::db::integrity`), logging a
+/// warning for any database with problems.  If `repair` is set, problems are
+/// fixed as they're found; repairing holds the database's write lock for the
+/// duration of the check.
+///
+pub struct Scrubber {
+    pub interval_s: u64,
+    pub repair: bool,
+    pub metrics: Arc<Metrics>,
+    pub b32: DBMap<u32>,
+    pub b64: DBMap<u64>,
+    pub b128: DBMap<[u64; 2]>,
+    pub b256: DBMap<[u64; 4]>,
+}
+
+impl Scrubber {
+    pub fn spawn(self) {
+        thread::spawn(move || {
+            loop {
+                thread::sleep(Duration::from_secs(self.interval_s));
+
+                scrub(32, &self.b32, self.repair, &self.metrics);
+                scrub(64, &self.b64, self.repair, &self.metrics);
+                scrub(128, &self.b128, self.repair, &self.metrics);
+                scrub(256, &self.b256, self.repair, &self.metrics);
+
+                self.metrics.scrub_runs.fetch_add(1, Ordering::Relaxed);
+            }
+        });
+    }
+}
+
+fn scrub<T>(bits: usize, dbmap_mx: &DBMap<T>, repair: bool, metrics: &Metrics) {
+    // Don't hold the DB map lock while checking, so new DBs can be created
+    let dbs: Vec<((usize, String), Arc<RwLock<Box<Database<T>>>>)> = {
+        dbmap_mx.read().unwrap().iter().map(|(k, v)| (k.clone(), v.clone())).collect()
+    };
+
+    for ((tolerance, namespace), db_mx) in dbs.into_iter() {
+        let report: Option<IntegrityReport> = match repair {
+            true => db_mx.write().unwrap().repair(),
+            false => db_mx.read().unwrap().check(),
+        };
+
+        match report {
+            Some(ref report) if !report.is_ok() => {
+                metrics.scrub_missing.fetch_add(report.missing, Ordering::Relaxed);
+                metrics.scrub_dangling.fetch_add(report.dangling, Ordering::Relaxed);
+
+                log!("WARNING: b/{}/{}/{} has {} missing and {} dangling index entries{}",
+                         bits, tolerance, namespace, report.missing, report.dangling,
+                         if repair { " (repaired)" } else { "" });
+            },
+            _ => {},
+        }
+    }
+}
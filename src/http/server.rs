@@ -1,38 +1,550 @@
 use std::clone::Clone;
 use std::collections::HashMap;
+use std::sync::{Arc, RwLock};
+use std::thread;
 
 use iron::prelude::*;
+use iron::typemap::Key;
 use router::Router;
-use persistent::State;
+use persistent::{Read, State};
 
-use http::{Config, ConfigKey, B32, B64, B128, B256, V32, V64, V128, V256};
+use hammer::db::workers;
+
+use http::{Config, ConfigKey, BOptions, Projections, B32, B64, B128, B256, V32, V64, V128, V256, D32, D64, D128, D256};
 use http::binary_handler;
 use http::vector_handler;
+use http::options_handler;
+use http::float_handler;
+use http::bucket_handler;
+use http::db_handler;
+use http::keys_handler;
+use http::dump_handler;
+use http::document_handler;
+use http::cluster_handler;
+use http::join_handler;
+use http::jobs;
+use http::jobs::{Jobs, JobsKey};
+use http::ui_handler;
+use http::access_log;
+use http::access_log::AccessLog;
+use http::capture::Capture;
+use http::shadow::Shadow;
+use http::metrics;
+use http::metrics::{Metrics, MetricsKey};
+use http::throttle::WriteThrottle;
+use http::scrubber::Scrubber;
+use http::reaper::Reaper;
+use http::memstats::MemStatsReporter;
+use http::usage;
+use http::usage::UsageRecorder;
+use http::debug_vars;
+use http::debug_vars::RequestCounter;
+use http::rates::NamespaceCounter;
+use http::cors::Cors;
+use http::bulkhead::Bulkhead;
+use http::listen;
+use http::recovery;
+use http::reload;
+use http::resp;
+use http::recovery::{Recovery, RecoveryKey};
+use http::request_id::RequestId;
+use http::auth::{Authorize, Authorizer, AuthCommand, FirstOf, Tokens};
+use http::conditional::Conditional;
+use http::versions::VersionHeader;
+use http::encryption::{Cipher, CipherKey};
+use http::fencing;
+use http::fencing::{Fencing, FencingKey, RejectStaleWrites};
+use http::standby;
+use http::standby::{Standby, StandbyKey, RejectStandbyWrites};
+use http::upgrade;
+use http::upgrade::{Handoff, HandoffKey, RejectDrainedWrites};
+use http::changes;
+use http::changes::{ChangeFeed, ChangeFeedKey};
+use http::rerank::{Reranker, RerankerKey, Subprocess};
+use http::ingest_hook::{self, IngestHook, IngestHookKey};
+use http::shard_map;
+use http::federated_handler;
+use http::sink;
+use http::sink::{Mirror, MirrorKey};
+#[cfg(feature = "chaos")]
+use http::chaos;
+#[cfg(feature = "chaos")]
+use http::chaos::{Chaos, ChaosKey, Faults};
+
+pub fn serve(mut config: Config) {
+    match config.config_file.clone() {
+        Some(path) => { reload::apply_file(&path, &mut config).unwrap(); },
+        None => {},
+    }
+    // Batch inserts start more if `insert_workers` is raised by a reload
+    workers::shared().ensure(config.insert_workers);
 
-pub fn serve(config: Config) {
-    println!("Serving with config: {:?}", config);
+    log!("Serving with config: {:?}", config);
 
     let mut router = Router::new();
     router.post("/add/b/:bits/:tolerance/:namespace", binary_handler::add);
     router.post("/query/b/:bits/:tolerance/:namespace", binary_handler::query);
+    router.post("/any_match/b/:bits/:tolerance/:namespace", binary_handler::any_match);
+    router.post("/contains/b/:bits/:tolerance/:namespace", binary_handler::contains);
     router.post("/delete/b/:bits/:tolerance/:namespace", binary_handler::delete);
 
     router.post("/add/v/:bits/:dimensions/:tolerance/:namespace", vector_handler::add);
     router.post("/query/v/:bits/:dimensions/:tolerance/:namespace", vector_handler::query);
     router.post("/delete/v/:bits/:dimensions/:tolerance/:namespace", vector_handler::delete);
 
+    router.post("/add/f/:bits/:tolerance/:namespace", float_handler::add);
+    router.post("/query/f/:bits/:tolerance/:namespace", float_handler::query);
+    router.post("/delete/f/:bits/:tolerance/:namespace", float_handler::delete);
+
+    router.post("/add/d/:bits/:tolerance/:namespace", document_handler::add);
+    router.post("/query/d/:bits/:tolerance/:namespace", document_handler::query);
+    router.post("/delete/d/:bits/:tolerance/:namespace", document_handler::delete);
+
+    router.post("/options/b/:bits/:tolerance/:namespace", options_handler::set);
+    router.get("/options/b/:bits/:tolerance/:namespace", options_handler::show);
+
+    router.get("/db", db_handler::list);
+    router.delete("/db/b/:bits/:tolerance/:namespace", db_handler::destroy);
+
+    router.get("/buckets/b/:bits/:tolerance/:namespace", bucket_handler::show);
+    router.get("/keys/b/:bits/:tolerance/:namespace", keys_handler::show);
+    router.get("/sample/b/:bits/:tolerance/:namespace", keys_handler::sample);
+    router.get("/cluster/b/:bits/:tolerance/:namespace", cluster_handler::cluster);
+    router.post("/cluster/b/:bits/:tolerance/:namespace", cluster_handler::cluster);
+    router.get("/join/b/:bits/:tolerance/:namespace/:other", join_handler::join);
+
+    router.post("/jobs", jobs::create);
+    router.get("/jobs", jobs::list);
+    router.get("/jobs/:id", jobs::show);
+    router.delete("/jobs/:id", jobs::cancel);
+
+    router.get("/dump/:namespace", dump_handler::dump);
+    router.post("/load/:namespace", dump_handler::load);
+
+    router.get("/ui", ui_handler::show);
+    router.get("/changes", changes::show);
+    router.get("/shard_map", shard_map::show);
+    router.post("/federated/b/:bits/:tolerance/:namespace", federated_handler::query);
+
+    let metrics = Arc::new(Metrics::new());
+
+    let reranker: Option<Box<Reranker>> = match config.rerank_command {
+        Some(ref command) => Some(Box::new(Subprocess::spawn(command).unwrap())),
+        None => None,
+    };
+
+    let ingest_hook: Option<Box<IngestHook>> = match config.ingest_hook_command {
+        Some(ref command) => Some(Box::new(ingest_hook::Subprocess::spawn(command).unwrap())),
+        None => None,
+    };
+
+    let mirror: Option<Mirror> = match config.sink {
+        Some(ref spec) => {
+            let sink = sink::from_spec(spec).unwrap();
+            match config.sink_sync {
+                true => Some(Mirror::write_through(sink, config.sink_retries, metrics.clone())),
+                false => Some(Mirror::write_behind(sink, config.sink_retries, metrics.clone())),
+            }
+        },
+        None => None,
+    };
+
+    let access_log = match config.access_log {
+        Some(ref path) => {
+            let format = access_log::Format::parse(&config.access_log_format).unwrap();
+            Some(AccessLog::open(path, format, config.access_log_max_bytes, config.access_log_keep).unwrap())
+        },
+        None => None,
+    };
+
+    let capture = match config.capture {
+        Some(ref path) => Some(Capture::open(path, config.capture_rate).unwrap()),
+        None => None,
+    };
+
+    let shadow = match config.shadow {
+        Some(ref target) => Some(Shadow::start(target, config.shadow_rate, config.shadow_diffs.as_ref().map(|s| &s[..]), metrics.clone()).unwrap()),
+        None => None,
+    };
+
+    // Fail at startup rather than on the first client's request
+    match config.shard_map {
+        Some(ref path) => { shard_map::load(path).unwrap(); },
+        None => {},
+    }
+
+    let mut authorizers: Vec<Box<Authorizer>> = vec![];
+    match config.auth_tokens {
+        Some(ref path) => authorizers.push(Box::new(Tokens::load(path).unwrap())),
+        None => {},
+    }
+    match config.auth_command {
+        Some(ref command) => authorizers.push(Box::new(AuthCommand::spawn(command).unwrap())),
+        None => {},
+    }
+    let authorizer: Option<Arc<Authorizer>> = match authorizers.is_empty() {
+        true => None,
+        false => Some(Arc::new(FirstOf(authorizers))),
+    };
+
+    // Sockets passed by systemd (or the process being upgraded) take the
+    // place of --bind and --admin-bind
+    let mut inherited = listen::inherited_listeners().unwrap().into_iter();
+    let listener = match inherited.next() {
+        Some(listener) => listener,
+        None => listen::bind(&config.bind),
+    };
+    let admin_listener = match (inherited.next(), &config.admin_bind) {
+        (Some(listener), _) => Some(listener),
+        (None, &Some(ref admin_bind)) => Some(listen::bind(admin_bind)),
+        (None, &None) => None,
+    };
+    let resp_listener = match config.resp_bind {
+        Some(ref resp_bind) => Some(listen::bind(resp_bind)),
+        None => None,
+    };
+
+    let cipher: Option<Cipher> = match config.encryption_key {
+        Some(ref path) => Some(Cipher::load(path).unwrap()),
+        None => None,
+    };
+    let cipher = Arc::new(cipher);
+
+    let fencing = Arc::new(Fencing::new(config.epoch, &config.data_dir, cipher.clone()));
+    let shared = Shared{
+        config: Arc::new(RwLock::new(config.clone())),
+        metrics: metrics.clone(),
+        recovery: Arc::new(Recovery::new()),
+        changes: Arc::new(ChangeFeed::new(config.feed_writes, fencing.clone())),
+        handoff: Arc::new(Handoff::new(&listener, admin_listener.as_ref())),
+        standby: Arc::new(Standby::new(config.standby_of.clone(), fencing.clone(), &config.data_dir, cipher.clone())),
+        fencing: fencing,
+        cipher: cipher,
+        reranker: Arc::new(reranker),
+        ingest_hook: Arc::new(ingest_hook),
+        mirror: Arc::new(mirror),
+        options: Arc::new(RwLock::new(HashMap::new())),
+        projections: Arc::new(RwLock::new(HashMap::new())),
+        b32: Arc::new(RwLock::new(HashMap::new())),
+        b64: Arc::new(RwLock::new(HashMap::new())),
+        b128: Arc::new(RwLock::new(HashMap::new())),
+        b256: Arc::new(RwLock::new(HashMap::new())),
+        v32: Arc::new(RwLock::new(HashMap::new())),
+        v64: Arc::new(RwLock::new(HashMap::new())),
+        v128: Arc::new(RwLock::new(HashMap::new())),
+        v256: Arc::new(RwLock::new(HashMap::new())),
+        d32: Arc::new(RwLock::new(HashMap::new())),
+        d64: Arc::new(RwLock::new(HashMap::new())),
+        d128: Arc::new(RwLock::new(HashMap::new())),
+        d256: Arc::new(RwLock::new(HashMap::new())),
+    };
+
+    let throttle = WriteThrottle::new(metrics.clone(), shared.config.clone());
+
+    match config.config_file {
+        Some(ref path) => reload::watch_sighup(path.clone(), shared.config.clone()),
+        None => {},
+    }
+
+    match config.take_over {
+        Some(ref old) => {
+            match upgrade::take_over(old, &shared.cipher, shared.config.clone(), shared.options.clone(), shared.changes.clone(), shared.metrics.clone(), shared.recovery.clone(), shared.handoff.clone(), shared.b32.clone(), shared.b64.clone(), shared.b128.clone(), shared.b256.clone()) {
+                Ok(_) => log!("Took over from {}", old),
+                Err(e) => panic!("unable to take over from {}: {}", old, e),
+            }
+        },
+        None => {},
+    }
+
+    standby::follow(shared.standby.clone(), config.promote_after_s, shared.config.clone(), shared.options.clone(), shared.changes.clone(), shared.metrics.clone(), shared.recovery.clone(), shared.handoff.clone(), shared.b32.clone(), shared.b64.clone(), shared.b128.clone(), shared.b256.clone());
+
+    if config.scrub_interval_s > 0 {
+        Scrubber{
+            interval_s: config.scrub_interval_s,
+            repair: config.scrub_repair,
+            metrics: metrics.clone(),
+            b32: shared.b32.clone(),
+            b64: shared.b64.clone(),
+            b128: shared.b128.clone(),
+            b256: shared.b256.clone(),
+        }.spawn();
+    }
+
+    if config.reap_interval_s > 0 {
+        Reaper{
+            interval_s: config.reap_interval_s,
+            options_mx: shared.options.clone(),
+            changes: shared.changes.clone(),
+            metrics: metrics.clone(),
+            b32: shared.b32.clone(),
+            b64: shared.b64.clone(),
+            b128: shared.b128.clone(),
+            b256: shared.b256.clone(),
+        }.spawn();
+    }
+
+    let jobs = Arc::new(Jobs::new(&config.data_dir, shared.options.clone(), shared.changes.clone(), shared.mirror.clone(), shared.handoff.clone(), shared.b32.clone(), shared.b64.clone(), shared.b128.clone(), shared.b256.clone()));
+    jobs::resume(jobs.clone());
+
+    if config.memstats_interval_s > 0 {
+        MemStatsReporter{
+            interval_s: config.memstats_interval_s,
+            metrics: metrics.clone(),
+            b32: shared.b32.clone(),
+            b64: shared.b64.clone(),
+            b128: shared.b128.clone(),
+            b256: shared.b256.clone(),
+        }.spawn();
+    }
+
+    if config.usage_interval_s > 0 {
+        UsageRecorder{
+            interval_s: config.usage_interval_s,
+            webhook: config.usage_webhook.clone(),
+            metrics: metrics.clone(),
+            b32: shared.b32.clone(),
+            b64: shared.b64.clone(),
+            b128: shared.b128.clone(),
+            b256: shared.b256.clone(),
+        }.spawn();
+    }
+
+    let mut admin_chain = match admin_listener {
+        Some(_) => {
+            let mut admin_router = Router::new();
+            link_admin_routes(&mut admin_router, &config);
+            let mut admin_chain = Chain::new(admin_router);
+            admin_chain.link_before(RequestId);
+            link_access_log(&mut admin_chain, &access_log);
+            link_authorize(&mut admin_chain, &authorizer, true);
+            admin_chain.link_after(RequestId);
+            shared.link(&mut admin_chain);
+            Some(admin_chain)
+        },
+        None => {
+            link_admin_routes(&mut router, &config);
+            None
+        },
+    };
+
     let mut chain = Chain::new(router);
-    chain.link_before(State::<ConfigKey>::one(config.clone()));
+    // NOTE: The throttle must be the first `before` middleware, so that its
+    // `catch` is only invoked for requests it has counted
+    chain.link_before(throttle.clone());
+    chain.link_after(throttle);
+    chain.link_before(RequestId);
+    // Before `Conditional`, so that queries answered with a 304 are still
+    // compared
+    link_shadow(&mut chain, &shadow);
+    // Before the access log, so that it logs 304s as such
+    chain.link_after(Conditional);
+    // After `Conditional`, so that 304s carry the version too
+    let version_header = VersionHeader::new(shared.changes.clone());
+    chain.link_after(version_header.clone());
+    link_access_log(&mut chain, &access_log);
+    // After `Conditional` too, so that 304s are recorded as such
+    link_capture(&mut chain, &capture);
+    link_authorize(&mut chain, &authorizer, false);
+    chain.link_before(RejectDrainedWrites::new(shared.handoff.clone()));
+    chain.link_before(RejectStandbyWrites::new(shared.standby.clone()));
+    chain.link_before(RejectStaleWrites::new(shared.fencing.clone()));
+    let bulkhead = Bulkhead::new(metrics.clone(), shared.config.clone());
+    chain.link_before(bulkhead.clone());
+    chain.link_after(bulkhead);
+    // After the bulkhead, so that reads waiting for `min_version` count
+    // against their namespace's limit
+    chain.link_before(version_header);
+    link_chaos(&mut chain, admin_chain.as_mut());
+    chain.link_after(NamespaceCounter::new(metrics.clone()));
+    match config.cors_origins {
+        Some(ref origins) => { chain.link_after(Cors::new(origins, &config.cors_methods, &config.cors_headers)); },
+        None => {},
+    }
+    if config.debug_vars {
+        chain.link_after(RequestCounter::new(metrics.clone()));
+    }
+    // Last, so that the other middleware log with the request's ID
+    chain.link_after(RequestId);
+    shared.link(&mut chain);
+    // Jobs are only served by the API listener
+    chain.link_before(Read::<JobsKey>::one(jobs));
+
+    match (admin_chain, admin_listener) {
+        (Some(admin_chain), Some(admin_listener)) => {
+            thread::spawn(move || {
+                listen::serve(admin_chain, admin_listener);
+            });
+        },
+        _ => {},
+    }
+
+    // RESP commands are forwarded to the API listener, so they share its
+    // middleware
+    match resp_listener {
+        Some(resp_listener) => {
+            let http_addr = listener.local_addr().unwrap();
+            thread::spawn(move || {
+                resp::serve(resp_listener, http_addr);
+            });
+        },
+        None => {},
+    }
+
+    listen::serve(chain, listener);
+}
+
+/// State shared by the API and admin servers
+///
+struct Shared {
+    config: Arc<RwLock<Config>>,
+    metrics: Arc<Metrics>,
+    recovery: Arc<Recovery>,
+    changes: Arc<ChangeFeed>,
+    handoff: Arc<Handoff>,
+    fencing: Arc<Fencing>,
+    standby: Arc<Standby>,
+    cipher: Arc<Option<Cipher>>,
+    reranker: Arc<Option<Box<Reranker>>>,
+    ingest_hook: Arc<Option<Box<IngestHook>>>,
+    mirror: Arc<Option<Mirror>>,
+    options: Arc<RwLock<<BOptions as Key>::Value>>,
+    projections: Arc<RwLock<<Projections as Key>::Value>>,
+    b32: Arc<RwLock<<B32 as Key>::Value>>,
+    b64: Arc<RwLock<<B64 as Key>::Value>>,
+    b128: Arc<RwLock<<B128 as Key>::Value>>,
+    b256: Arc<RwLock<<B256 as Key>::Value>>,
+    v32: Arc<RwLock<<V32 as Key>::Value>>,
+    v64: Arc<RwLock<<V64 as Key>::Value>>,
+    v128: Arc<RwLock<<V128 as Key>::Value>>,
+    v256: Arc<RwLock<<V256 as Key>::Value>>,
+    d32: Arc<RwLock<<D32 as Key>::Value>>,
+    d64: Arc<RwLock<<D64 as Key>::Value>>,
+    d128: Arc<RwLock<<D128 as Key>::Value>>,
+    d256: Arc<RwLock<<D256 as Key>::Value>>,
+}
+
+impl Shared {
+    fn link(&self, chain: &mut Chain) {
+        chain.link_before(Read::<MetricsKey>::one(self.metrics.clone()));
+        chain.link_before(Read::<RecoveryKey>::one(self.recovery.clone()));
+        chain.link_before(Read::<ChangeFeedKey>::one(self.changes.clone()));
+        chain.link_before(Read::<HandoffKey>::one(self.handoff.clone()));
+        chain.link_before(Read::<FencingKey>::one(self.fencing.clone()));
+        chain.link_before(Read::<StandbyKey>::one(self.standby.clone()));
+        chain.link_before(Read::<CipherKey>::one(self.cipher.clone()));
+        chain.link_before(State::<ConfigKey>::one(self.config.clone()));
+        chain.link_before(Read::<RerankerKey>::one(self.reranker.clone()));
+        chain.link_before(Read::<IngestHookKey>::one(self.ingest_hook.clone()));
+        chain.link_before(Read::<MirrorKey>::one(self.mirror.clone()));
+
+        chain.link_before(State::<BOptions>::one(self.options.clone()));
+        chain.link_before(State::<Projections>::one(self.projections.clone()));
+
+        chain.link_before(State::<B256>::one(self.b256.clone()));
+        chain.link_before(State::<B128>::one(self.b128.clone()));
+        chain.link_before(State::<B64>::one(self.b64.clone()));
+        chain.link_before(State::<B32>::one(self.b32.clone()));
+
+        chain.link_before(State::<V256>::one(self.v256.clone()));
+        chain.link_before(State::<V128>::one(self.v128.clone()));
+        chain.link_before(State::<V64>::one(self.v64.clone()));
+        chain.link_before(State::<V32>::one(self.v32.clone()));
 
-    chain.link_before(State::<B256>::one(HashMap::new()));
-    chain.link_before(State::<B128>::one(HashMap::new()));
-    chain.link_before(State::<B64>::one(HashMap::new()));
-    chain.link_before(State::<B32>::one(HashMap::new()));
+        chain.link_before(State::<D256>::one(self.d256.clone()));
+        chain.link_before(State::<D128>::one(self.d128.clone()));
+        chain.link_before(State::<D64>::one(self.d64.clone()));
+        chain.link_before(State::<D32>::one(self.d32.clone()));
+    }
+}
+
+/// Times requests from as early as possible, logging them once the response is
+/// complete
+///
+fn link_access_log(chain: &mut Chain, access_log: &Option<AccessLog>) {
+    match *access_log {
+        Some(ref access_log) => {
+            chain.link_before(access_log.clone());
+            chain.link_after(access_log.clone());
+        },
+        None => {},
+    }
+}
+
+/// Records a sample of requests, with `--capture`
+///
+fn link_capture(chain: &mut Chain, capture: &Option<Capture>) {
+    match *capture {
+        Some(ref capture) => {
+            chain.link_before(capture.clone());
+            chain.link_after(capture.clone());
+        },
+        None => {},
+    }
+}
+
+/// Mirrors a sample of queries to another server, with `--shadow`
+///
+fn link_shadow(chain: &mut Chain, shadow: &Option<Shadow>) {
+    match *shadow {
+        Some(ref shadow) => {
+            chain.link_before(shadow.clone());
+            chain.link_after(shadow.clone());
+        },
+        None => {},
+    }
+}
 
-    chain.link_before(State::<V256>::one(HashMap::new()));
-    chain.link_before(State::<V128>::one(HashMap::new()));
-    chain.link_before(State::<V64>::one(HashMap::new()));
-    chain.link_before(State::<V32>::one(HashMap::new()));
+/// Requires tokens, with `--auth-tokens` or `--auth-command`; `admin_only`
+/// chains need an admin token for everything
+///
+fn link_authorize(chain: &mut Chain, authorizer: &Option<Arc<Authorizer>>, admin_only: bool) {
+    match *authorizer {
+        Some(ref authorizer) => { chain.link_before(Authorize::new(authorizer.clone(), admin_only)); },
+        None => {},
+    }
+}
+
+/// Routes for operators rather than clients, which can be served on a
+/// separate address (`--admin-bind`)
+///
+fn link_admin_routes(router: &mut Router, config: &Config) {
+    router.get("/metrics", metrics::show);
+    router.get("/admin/recovery", recovery::show);
+    router.post("/admin/reload", reload::reload);
+    router.post("/admin/upgrade", upgrade::upgrade);
+    router.get("/admin/handoff/db", db_handler::list);
+    router.get("/admin/handoff/dump/:namespace", dump_handler::dump);
+    router.post("/admin/handoff/journal", upgrade::journal);
+    router.get("/admin/handoff/changes", changes::show);
+    router.get("/admin/standby", standby::show);
+    router.post("/admin/promote", standby::promote);
+    router.post("/admin/fence", fencing::fence);
+    router.get("/admin/usage", usage::show);
+    if config.debug_vars {
+        router.get("/debug/vars", debug_vars::show);
+    }
+    link_chaos_routes(router);
+}
 
-    Iron::new(chain).http(&*config.bind).unwrap();
+#[cfg(feature = "chaos")]
+fn link_chaos_routes(router: &mut Router) {
+    router.get("/chaos", chaos::show);
+    router.post("/chaos", chaos::set);
 }
+
+#[cfg(not(feature = "chaos"))]
+fn link_chaos_routes(_: &mut Router) {}
+
+#[cfg(feature = "chaos")]
+fn link_chaos(chain: &mut Chain, admin_chain: Option<&mut Chain>) {
+    let faults = Arc::new(RwLock::new(Faults::default()));
+    chain.link_before(Chaos::new(faults.clone()));
+    chain.link_before(Read::<ChaosKey>::one(faults.clone()));
+    match admin_chain {
+        Some(admin_chain) => { admin_chain.link_before(Read::<ChaosKey>::one(faults)); },
+        None => {},
+    }
+}
+
+#[cfg(not(feature = "chaos"))]
+fn link_chaos(_: &mut Chain, _: Option<&mut Chain>) {}
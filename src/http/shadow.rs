@@ -0,0 +1,225 @@
+//! Shadow traffic
+//!
+//! With `--shadow=<host:port>`, a fraction `--shadow-rate` of successful
+//! `query` and `any_match` requests (on every type of database) are sent
+//! again to that server once they've been answered, i.e. one running a
+//! rebuilt index or a new version, and its results compared with ours.
+//! Clients never wait for the shadow server: requests are queued for
+//! `WORKERS` background threads, and dropped if `QUEUE_SIZE` are already
+//! waiting.
+//!
+//! Results are compared value by value, ignoring the order of each value's
+//! matches.  Counts are reported in `/metrics` (`shadow_sent`,
+//! `shadow_differed`, `shadow_errors` and `shadow_dropped`), and with
+//! `--shadow-diffs=<path>` each differing value is appended to that file, one
+//! JSON object per line:
+//!
+//! ```text
+//! {"path":"/query/b/64/8/foo","primary":["AAAAAAAAAAE="],"shadow":[],"value":"AAAAAAAAAAA="}
+//! ```
+
+use std::collections::BTreeMap;
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::sync::{Arc, Mutex};
+use std::sync::atomic::Ordering;
+use std::sync::mpsc::{sync_channel, Receiver, SyncSender};
+use std::thread;
+
+use iron::prelude::*;
+use iron::{status, typemap, AfterMiddleware, BeforeMiddleware};
+use rand;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::capture::{KeepBodyKey, RequestBodyKey};
+use http::conditional::QueryBodyKey;
+use http::loader::request;
+use http::metrics::Metrics;
+
+/// Operations mirrored
+const OPS: [&'static str; 2] = ["query", "any_match"];
+
+/// Threads sending requests to the shadow server
+const WORKERS: usize = 4;
+
+/// Requests waiting to be mirrored before more are dropped
+const QUEUE_SIZE: usize = 1000;
+
+/// Marks requests being mirrored
+///
+struct ShadowingKey;
+impl typemap::Key for ShadowingKey { type Value = (); }
+
+/// A request to mirror, and our response to it
+///
+struct Job {
+    path: String,
+    body: String,
+    primary: Arc<String>,
+}
+
+#[derive(Clone)]
+pub struct Shadow {
+    rate: f64,
+    queue: Arc<Mutex<SyncSender<Job>>>,
+    metrics: Arc<Metrics>,
+}
+
+impl Shadow {
+    /// Starts the threads mirroring requests to `target`, writing differences
+    /// to `diffs` if given
+    ///
+    pub fn start(target: &str, rate: f64, diffs: Option<&str>, metrics: Arc<Metrics>) -> Result<Shadow, String> {
+        let diffs = match diffs {
+            Some(path) => match OpenOptions::new().append(true).create(true).open(path) {
+                Ok(file) => Some(Arc::new(Mutex::new(file))),
+                Err(e) => return Err(format!("unable to open shadow diffs file '{}': {}", path, e)),
+            },
+            None => None,
+        };
+
+        let (tx, rx) = sync_channel::<Job>(QUEUE_SIZE);
+        let rx = Arc::new(Mutex::new(rx));
+        for _ in 0..WORKERS {
+            let target = target.to_string();
+            let rx = rx.clone();
+            let diffs = diffs.clone();
+            let metrics = metrics.clone();
+            thread::spawn(move || mirror(&target, rx, diffs, metrics));
+        }
+
+        Ok(Shadow{rate: rate, queue: Arc::new(Mutex::new(tx)), metrics: metrics})
+    }
+}
+
+impl BeforeMiddleware for Shadow {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        let mirrored = match req.url.path.first() {
+            Some(op) => OPS.contains(&&op[..]),
+            None => false,
+        };
+        if mirrored && rand::random::<f64>() < self.rate {
+            req.extensions.insert::<ShadowingKey>(());
+            req.extensions.insert::<KeepBodyKey>(());
+        }
+        Ok(())
+    }
+}
+
+impl AfterMiddleware for Shadow {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        if !req.extensions.contains::<ShadowingKey>() || res.status != Some(status::Ok) {
+            return Ok(res)
+        }
+        let job = match (req.extensions.get::<RequestBodyKey>(), res.extensions.get::<QueryBodyKey>()) {
+            (Some(body), Some(primary)) => {
+                let path = match req.url.query {
+                    Some(ref query) => format!("/{}?{}", req.url.path.join("/"), query),
+                    None => format!("/{}", req.url.path.join("/")),
+                };
+                Job{path: path, body: body.clone(), primary: primary.clone()}
+            },
+            _ => return Ok(res),
+        };
+
+        // Full, or (if the workers have all panicked) disconnected
+        match self.queue.lock().unwrap().try_send(job) {
+            Ok(_) => {},
+            Err(_) => { self.metrics.shadow_dropped.fetch_add(1, Ordering::Relaxed); },
+        }
+        Ok(res)
+    }
+}
+
+/// Sends queued requests to `target` and compares its results with ours
+///
+fn mirror(target: &str, rx: Arc<Mutex<Receiver<Job>>>, diffs: Option<Arc<Mutex<File>>>, metrics: Arc<Metrics>) {
+    loop {
+        // Not held while sending the request
+        let next = rx.lock().unwrap().recv();
+        let job = match next {
+            Ok(job) => job,
+            Err(_) => return,
+        };
+
+        metrics.shadow_sent.fetch_add(1, Ordering::Relaxed);
+        let shadow = match request(target, "POST", &job.path, &job.body) {
+            Ok((200, shadow)) => shadow,
+            Ok((status, body)) => {
+                log!("WARNING: shadow server returned {} for {}: {}", status, job.path, body.trim());
+                metrics.shadow_errors.fetch_add(1, Ordering::Relaxed);
+                continue
+            },
+            Err(e) => {
+                log!("WARNING: unable to mirror {}: {}", job.path, e);
+                metrics.shadow_errors.fetch_add(1, Ordering::Relaxed);
+                continue
+            },
+        };
+        if shadow == *job.primary {
+            continue
+        }
+
+        let differences = compare(&job.body, &job.primary, &shadow);
+        if differences.is_empty() {
+            continue
+        }
+        metrics.shadow_differed.fetch_add(1, Ordering::Relaxed);
+
+        match diffs {
+            Some(ref file) => {
+                let mut file = file.lock().unwrap();
+                for (value, primary, shadow) in differences.into_iter() {
+                    let mut d = BTreeMap::new();
+                    d.insert("path".to_string(), job.path.to_json());
+                    d.insert("value".to_string(), value);
+                    d.insert("primary".to_string(), primary);
+                    d.insert("shadow".to_string(), shadow);
+                    match writeln!(file, "{}", json::encode(&Json::Object(d)).unwrap()) {
+                        Ok(_) => {},
+                        Err(e) => log!("WARNING: unable to write shadow diffs file: {}", e),
+                    }
+                }
+            },
+            None => {},
+        }
+    }
+}
+
+/// The values of a request `body` whose results differ between the
+/// `primary` and `shadow` responses, with both results; responses which
+/// aren't lists of one result for each value are compared as a whole
+///
+fn compare(body: &str, primary: &str, shadow: &str) -> Vec<(Json, Json, Json)> {
+    let parse = |s: &str| Json::from_str(s).unwrap_or(Json::String(s.to_string()));
+    let (values, primary, shadow) = (parse(body), parse(primary), parse(shadow));
+
+    match (values, primary, shadow) {
+        (Json::Array(ref values), Json::Array(ref primary), Json::Array(ref shadow)) if values.len() == primary.len() && values.len() == shadow.len() => {
+            values.iter().zip(primary.iter().zip(shadow.iter()))
+                .filter(|&(_, (p, s))| normalize(p.clone()) != normalize(s.clone()))
+                .map(|(v, (p, s))| (v.clone(), p.clone(), s.clone()))
+                .collect()
+        },
+        (values, primary, shadow) => match normalize(primary.clone()) == normalize(shadow.clone()) {
+            true => vec![],
+            false => vec![(values, primary, shadow)],
+        },
+    }
+}
+
+/// `result` with its lists sorted, so matches found in a different order
+/// compare equal
+///
+fn normalize(result: Json) -> Json {
+    match result {
+        Json::Array(items) => {
+            let mut items: Vec<Json> = items.into_iter().map(normalize).collect();
+            items.sort_by(|a, b| json::encode(a).unwrap().cmp(&json::encode(b).unwrap()));
+            Json::Array(items)
+        },
+        Json::Object(fields) => Json::Object(fields.into_iter().map(|(k, v)| (k, normalize(v))).collect()),
+        other => other,
+    }
+}
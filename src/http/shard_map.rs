@@ -0,0 +1,51 @@
+//! Cluster topology for shard-aware clients, see `hammer::db::federated`
+//!
+//! With `--shard-map=<path>`, `GET /shard_map` returns the `ShardMap` in that
+//! file, so clients given any server of a cluster can find every shard and
+//! query them directly.  The file is read on each request, so it can be
+//! replaced (bumping its version) as shards move, without a restart.
+
+use std::fs::File;
+use std::io::Read;
+
+use iron::prelude::*;
+use iron::status;
+use persistent::State;
+use rustc_serialize::json;
+
+use hammer::db::federated::ShardMap;
+
+use http::ConfigKey;
+
+/// The shard map in `path`, checked for shards without replicas
+///
+pub fn load(path: &str) -> Result<ShardMap, String> {
+    let mut contents = String::new();
+    match File::open(path).and_then(|mut f| f.read_to_string(&mut contents)) {
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to read shard map {}: {}", path, e)),
+    }
+
+    let map = match json::decode::<ShardMap>(&contents) {
+        Ok(map) => map,
+        Err(e) => return Err(format!("unable to parse shard map {}: {}", path, e)),
+    };
+    try!(map.validate());
+    Ok(map)
+}
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let path = {
+        let config_mx = req.get::<State<ConfigKey>>().unwrap();
+        let config = config_mx.read().unwrap();
+        config.shard_map.clone()
+    };
+
+    match path {
+        Some(path) => match load(&path) {
+            Ok(map) => Ok(Response::with((status::Ok, json::encode(&map).unwrap()))),
+            Err(e) => Ok(Response::with((status::InternalServerError, e))),
+        },
+        None => Ok(Response::with((status::NotFound, "no shard map configured (see --shard-map)"))),
+    }
+}
@@ -0,0 +1,238 @@
+use std::collections::BTreeMap;
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::process::{Child, ChildStdin, Command, Stdio};
+use std::sync::{Arc, Mutex};
+use std::sync::atomic::Ordering;
+use std::sync::mpsc::{channel, Sender};
+use std::thread;
+use std::time::Duration;
+
+use iron::typemap;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use http::metrics::Metrics;
+
+/// Delay before the first retry of a failed send; doubled for each retry
+const RETRY_DELAY_MS: u64 = 100;
+
+/// A value added to or removed from a database
+///
+#[derive(Clone, Debug)]
+pub struct Mutation {
+    /// Database the value was written to, i.e. `b/64/8/foo`
+    pub db: String,
+    /// "add" or "delete"
+    pub op: &'static str,
+    /// Base64-encoded value
+    pub value: String,
+}
+
+impl ToJson for Mutation {
+    fn to_json(&self) -> Json {
+        let mut d = BTreeMap::new();
+        d.insert("db".to_string(), self.db.to_json());
+        d.insert("op".to_string(), self.op.to_json());
+        d.insert("value".to_string(), self.value.to_json());
+        Json::Object(d)
+    }
+}
+
+/// Destination for mirrored writes
+///
+/// Mutations are written as lines of JSON:
+///
+/// ```json
+/// {"db":"b/64/8/foo","op":"add","value":"AAAAAAAAAAE="}
+/// ```
+///
+pub trait Sink: Sync + Send {
+    fn send(&self, mutations: &[Mutation]) -> Result<(), String>;
+}
+
+fn write_lines<W: Write>(w: &mut W, mutations: &[Mutation]) -> ::std::io::Result<()> {
+    for mutation in mutations.iter() {
+        try!(writeln!(w, "{}", json::encode(&mutation.to_json()).unwrap()));
+    }
+    w.flush()
+}
+
+/// Appends mutations to a file
+///
+pub struct FileSink {
+    file: Mutex<File>,
+}
+
+impl FileSink {
+    pub fn open(path: &str) -> Result<FileSink, String> {
+        match OpenOptions::new().append(true).create(true).open(path) {
+            Ok(file) => Ok(FileSink{file: Mutex::new(file)}),
+            Err(e) => Err(format!("unable to open sink file '{}': {}", path, e)),
+        }
+    }
+}
+
+impl Sink for FileSink {
+    fn send(&self, mutations: &[Mutation]) -> Result<(), String> {
+        match write_lines(&mut *self.file.lock().unwrap(), mutations) {
+            Ok(_) => Ok(()),
+            Err(e) => Err(format!("unable to write to sink file: {}", e)),
+        }
+    }
+}
+
+/// Writes mutations to the stdin of an external process, which can forward
+/// them anywhere (a Kafka producer, an HTTP endpoint, ...)
+///
+/// The process is started using the shell and kept running; if writing to it
+/// fails it's restarted before the next send.
+///
+pub struct CommandSink {
+    command: String,
+    process: Mutex<Option<(Child, ChildStdin)>>,
+}
+
+impl CommandSink {
+    pub fn spawn(command: &str) -> Result<CommandSink, String> {
+        let process = try!(CommandSink::start(command));
+
+        Ok(CommandSink{command: command.to_string(), process: Mutex::new(Some(process))})
+    }
+
+    fn start(command: &str) -> Result<(Child, ChildStdin), String> {
+        let mut child = match Command::new("sh").arg("-c").arg(command).stdin(Stdio::piped()).spawn() {
+            Ok(v) => v,
+            Err(e) => return Err(format!("unable to start sink '{}': {}", command, e)),
+        };
+
+        let stdin = child.stdin.take().unwrap();
+        Ok((child, stdin))
+    }
+}
+
+impl Sink for CommandSink {
+    fn send(&self, mutations: &[Mutation]) -> Result<(), String> {
+        let mut process = self.process.lock().unwrap();
+
+        if process.is_none() {
+            *process = Some(try!(CommandSink::start(&self.command)));
+        }
+
+        let result = match *process {
+            Some((_, ref mut stdin)) => write_lines(stdin, mutations),
+            None => unreachable!(),
+        };
+
+        match result {
+            Ok(_) => Ok(()),
+            Err(e) => {
+                match process.take() {
+                    Some((mut child, _)) => { let _ = child.kill(); let _ = child.wait(); },
+                    None => {},
+                }
+                Err(format!("unable to write to sink: {}", e))
+            },
+        }
+    }
+}
+
+/// Build a sink from a description: `file:<path>` or `command:<command>`
+///
+pub fn from_spec(spec: &str) -> Result<Box<Sink>, String> {
+    let mut parts = spec.splitn(2, ':');
+
+    match (parts.next(), parts.next()) {
+        (Some("file"), Some(path)) => Ok(Box::new(try!(FileSink::open(path)))),
+        (Some("command"), Some(command)) => Ok(Box::new(try!(CommandSink::spawn(command)))),
+        _ => Err(format!("invalid sink '{}', expected 'file:<path>' or 'command:<command>'", spec)),
+    }
+}
+
+fn send_with_retry(sink: &Sink, mutations: &[Mutation], retries: usize) -> Result<(), String> {
+    let mut delay = RETRY_DELAY_MS;
+    let mut attempt = 0;
+
+    loop {
+        let e = match sink.send(mutations) {
+            Ok(_) => return Ok(()),
+            Err(e) => e,
+        };
+        if attempt >= retries {
+            return Err(e)
+        }
+        log!("WARNING: sink write failed, retrying in {}ms: {}", delay, e);
+
+        thread::sleep(Duration::from_millis(delay));
+        delay *= 2;
+        attempt += 1;
+    }
+}
+
+/// Mirrors accepted writes to a sink
+///
+/// In write-through mode, mutations are sent before the write's response is
+/// returned, and the write reports an error if they can't be sent.  In
+/// write-behind mode they're queued and sent from a background thread, so
+/// writes aren't delayed by the sink; mutations which can't be sent after
+/// retrying are dropped.  Either way, failures are counted in the
+/// `sink_errors` metric.
+///
+pub struct Mirror {
+    sink: Arc<Box<Sink>>,
+    retries: usize,
+    metrics: Arc<Metrics>,
+    // None in write-through mode
+    queue: Option<Mutex<Sender<Vec<Mutation>>>>,
+}
+
+impl Mirror {
+    pub fn write_through(sink: Box<Sink>, retries: usize, metrics: Arc<Metrics>) -> Mirror {
+        Mirror{sink: Arc::new(sink), retries: retries, metrics: metrics, queue: None}
+    }
+
+    pub fn write_behind(sink: Box<Sink>, retries: usize, metrics: Arc<Metrics>) -> Mirror {
+        let sink = Arc::new(sink);
+        let (tx, rx) = channel::<Vec<Mutation>>();
+
+        let thread_sink = sink.clone();
+        let thread_metrics = metrics.clone();
+        thread::spawn(move || {
+            for mutations in rx.iter() {
+                match send_with_retry(&**thread_sink, &mutations, retries) {
+                    Ok(_) => {},
+                    Err(e) => {
+                        log!("WARNING: dropping {} mirrored writes: {}", mutations.len(), e);
+                        thread_metrics.sink_errors.fetch_add(mutations.len(), Ordering::Relaxed);
+                    },
+                }
+            }
+        });
+
+        Mirror{sink: sink, retries: retries, metrics: metrics, queue: Some(Mutex::new(tx))}
+    }
+
+    pub fn publish(&self, mutations: Vec<Mutation>) -> Result<(), String> {
+        if mutations.is_empty() {
+            return Ok(())
+        }
+
+        match self.queue {
+            Some(ref queue) => {
+                // The sender only fails if the background thread has died
+                queue.lock().unwrap().send(mutations).unwrap();
+                Ok(())
+            },
+            None => {
+                let result = send_with_retry(&**self.sink, &mutations, self.retries);
+                if result.is_err() {
+                    self.metrics.sink_errors.fetch_add(mutations.len(), Ordering::Relaxed);
+                }
+                result
+            },
+        }
+    }
+}
+
+pub struct MirrorKey;
+impl typemap::Key for MirrorKey { type Value = Option<Mirror>; }
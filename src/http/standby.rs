@@ -0,0 +1,589 @@
+//! Warm standby
+//!
+//! With `--standby-of=<host:port>`, the server follows a primary whose admin
+//! endpoints are at that address: it copies the primary's binary DBs, then
+//! polls the primary's change feed and applies its writes (the primary must
+//! run with `--feed-writes`).  Queries are served as usual, but writes are
+//! rejected with a 503 until the standby is promoted, either with
+//! `POST /admin/promote` or, with `--promote-after=<s>`, once the primary has
+//! been unreachable for that long.  A promoted standby stops following,
+//! takes a leader epoch higher than the primary's and accepts writes; it asks
+//! the old primary to fence itself, and refuses changes from a primary whose
+//! epoch is lower than one it has seen (see `fencing`).
+//!
+//! Changes are pulled in batches of at most `BATCH`, so the primary only
+//! ever holds its bounded feed however slow the standby is, and each poll
+//! acknowledges the changes before it (the primary reports each replica's
+//! lag at `/admin/standby`).  With `--data-dir`, the standby saves its
+//! position to `standby.json` there after each batch, and resumes from it
+//! after a restart or disconnect rather than copying the DBs again, provided
+//! the primary hasn't restarted since.  If the standby falls so far behind
+//! that changes have been dropped from the primary's feed, its DBs (and
+//! their data under `--data-dir`) are deleted and copied again.
+//!
+//! With `--encryption-key`, `standby.json` is encrypted, and the standby
+//! needs the primary's key to open the archives it copies (see
+//! `encryption`).
+
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::fs::File;
+use std::io;
+use std::io::{Read as IoRead, Write};
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex, RwLock};
+use std::thread;
+use std::time::{Duration, Instant};
+
+use hyper::Client;
+use iron::prelude::*;
+use iron::{status, typemap, BeforeMiddleware};
+use persistent::Read;
+use rand;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use hammer::db::Database;
+
+use http::{Config, DBOptions};
+use http::changes::{ChangeFeed, ChangeFeedKey};
+use http::encryption;
+use http::encryption::Cipher;
+use http::fencing::Fencing;
+use http::fsck;
+use http::metrics::Metrics;
+use http::recovery::Recovery;
+use http::upgrade;
+use http::upgrade::{Handoff, JournalEntry};
+
+/// Delay between polls of the primary's change feed, once caught up
+const POLL_MS: u64 = 200;
+
+/// Most changes requested from the primary at once
+const BATCH: usize = 1000;
+
+/// Position in the primary's change feed, as saved in `standby.json`
+///
+#[derive(RustcEncodable, RustcDecodable)]
+struct Saved {
+    replica: String,
+    feed: String,
+    cursor: u64,
+    primary_epoch: u64,
+}
+
+struct State {
+    promoted: bool,
+    /// Next position in the primary's change feed, once the DBs are copied
+    cursor: Option<u64>,
+    /// ID of the primary's change feed `cursor` is a position in
+    feed: Option<String>,
+    synced_once: bool,
+    applied: u64,
+    /// Highest leader epoch seen in the primary's change feed
+    primary_epoch: u64,
+    last_contact: Instant,
+    last_error: Option<String>,
+}
+
+pub struct StandbyKey;
+impl typemap::Key for StandbyKey { type Value = Standby; }
+
+pub struct Standby {
+    /// Admin address of the primary, if this server is a standby
+    primary: Option<String>,
+    /// Identifies the standby to the primary
+    replica: String,
+    /// Where the feed position is saved, with `--data-dir`
+    saved_path: Option<PathBuf>,
+    /// Opens the primary's archives and encrypts the saved position, with
+    /// `--encryption-key`
+    cipher: Arc<Option<Cipher>>,
+    fencing: Arc<Fencing>,
+    state: Mutex<State>,
+}
+
+impl Standby {
+    pub fn new(primary: Option<String>, fencing: Arc<Fencing>, data_dir: &Option<PathBuf>, cipher: Arc<Option<Cipher>>) -> Standby {
+        let saved_path = match (&primary, data_dir) {
+            (&Some(_), &Some(ref dir)) => Some(dir.join("standby.json")),
+            _ => None,
+        };
+        let saved = match saved_path {
+            Some(ref path) => load(path, &cipher),
+            None => None,
+        };
+
+        let mut state = State{
+            promoted: false,
+            cursor: None,
+            feed: None,
+            synced_once: false,
+            applied: 0,
+            primary_epoch: 0,
+            last_contact: Instant::now(),
+            last_error: None,
+        };
+        let replica = match saved {
+            Some(saved) => {
+                log!("Resuming from position {} in the primary's change feed", saved.cursor);
+                state.cursor = Some(saved.cursor);
+                state.feed = Some(saved.feed);
+                state.primary_epoch = saved.primary_epoch;
+                state.synced_once = true;
+                saved.replica
+            },
+            None => format!("{:016x}", rand::random::<u64>()),
+        };
+
+        Standby{
+            primary: primary,
+            replica: replica,
+            saved_path: saved_path,
+            cipher: cipher,
+            fencing: fencing,
+            state: Mutex::new(state),
+        }
+    }
+
+    /// Whether the server is still following a primary (and so rejects
+    /// writes)
+    ///
+    pub fn following(&self) -> bool {
+        self.primary.is_some() && !self.state.lock().unwrap().promoted
+    }
+
+    /// Stops following the primary and fences it off; returns false if the
+    /// server isn't a standby
+    ///
+    pub fn promote(&self, reason: &str) -> bool {
+        let primary = match self.primary {
+            Some(ref primary) => primary.clone(),
+            None => return false,
+        };
+
+        let mut state = self.state.lock().unwrap();
+        if !state.promoted {
+            let epoch = self.fencing.advance(state.primary_epoch);
+            log!("Promoted to primary at epoch {}: {}", epoch, reason);
+            state.promoted = true;
+
+            // The old primary is likely unreachable, in which case clients
+            // sending `X-Hammer-Epoch` fence it once it's back
+            thread::spawn(move || {
+                match upgrade::fetch(&Client::new(), "POST", &format!("http://{}/admin/fence?epoch={}", primary, epoch)) {
+                    Ok(_) => log!("Fenced the old primary at {}", primary),
+                    Err(e) => log!("WARNING: unable to fence the old primary: {}", e),
+                }
+            });
+        }
+        true
+    }
+
+    fn primary_epoch(&self) -> u64 {
+        self.state.lock().unwrap().primary_epoch
+    }
+
+    fn cursor(&self) -> Option<u64> {
+        self.state.lock().unwrap().cursor
+    }
+
+    fn contacted(&self) {
+        self.state.lock().unwrap().last_contact = Instant::now();
+    }
+
+    fn feed(&self) -> Option<String> {
+        self.state.lock().unwrap().feed.clone()
+    }
+
+    fn synced(&self, feed: String, cursor: u64, epoch: u64) {
+        let mut state = self.state.lock().unwrap();
+        state.cursor = Some(cursor);
+        state.feed = Some(feed);
+        state.primary_epoch = epoch;
+        state.synced_once = true;
+        state.last_error = None;
+        self.save(&state);
+    }
+
+    /// The DBs need copying again
+    ///
+    fn desynced(&self) {
+        let mut state = self.state.lock().unwrap();
+        state.cursor = None;
+        state.feed = None;
+        match self.saved_path {
+            Some(ref path) => { let _ = fs::remove_file(path); },
+            None => {},
+        }
+    }
+
+    fn applied(&self, cursor: u64, changes: usize, epoch: u64) {
+        let mut state = self.state.lock().unwrap();
+        state.cursor = Some(cursor);
+        state.primary_epoch = epoch;
+        state.applied += changes as u64;
+        state.last_error = None;
+        self.save(&state);
+    }
+
+    /// Saves the feed position, if there's somewhere to save it; the caller
+    /// holds the state lock
+    ///
+    fn save(&self, state: &State) {
+        let path = match self.saved_path {
+            Some(ref path) => path,
+            None => return,
+        };
+        let saved = match (state.cursor, &state.feed) {
+            (Some(cursor), &Some(ref feed)) => Saved{replica: self.replica.clone(), feed: feed.clone(), cursor: cursor, primary_epoch: state.primary_epoch},
+            _ => return,
+        };
+
+        // Written alongside and renamed, so a crash can't leave half a file
+        let tmp = path.with_extension("json.tmp");
+        let result = File::create(&tmp)
+            .and_then(|mut f| f.write_all(encryption::seal(&self.cipher, json::encode(&saved).unwrap(), 0).as_bytes()).and_then(|_| f.sync_all()))
+            .and_then(|_| fs::rename(&tmp, path));
+        match result {
+            Ok(_) => {},
+            Err(e) => log!("WARNING: unable to save standby position to {}: {}", path.display(), e),
+        }
+    }
+
+    fn failed(&self, e: String, promote_after_s: u64) {
+        log!("WARNING: standby: {}", e);
+
+        let unreachable_s = {
+            let mut state = self.state.lock().unwrap();
+            state.last_error = Some(e);
+
+            // A standby which never copied the DBs has nothing to serve
+            match state.synced_once {
+                true => state.last_contact.elapsed().as_secs(),
+                false => 0,
+            }
+        };
+
+        if promote_after_s > 0 && unreachable_s >= promote_after_s {
+            self.promote(&format!("primary unreachable for {}s", unreachable_s));
+        }
+    }
+}
+
+impl ToJson for Standby {
+    fn to_json(&self) -> Json {
+        let state = self.state.lock().unwrap();
+
+        let mut d = BTreeMap::new();
+        let role = match (&self.primary, state.promoted) {
+            (&Some(_), false) => "standby",
+            _ => "primary",
+        };
+        d.insert("role".to_string(), role.to_json());
+        d.insert("fencing".to_string(), self.fencing.to_json());
+        match self.primary {
+            Some(ref primary) => {
+                d.insert("primary".to_string(), primary.to_json());
+                d.insert("promoted".to_string(), state.promoted.to_json());
+                d.insert("synced".to_string(), state.cursor.is_some().to_json());
+                d.insert("cursor".to_string(), state.cursor.to_json());
+                d.insert("replica".to_string(), self.replica.to_json());
+                d.insert("applied".to_string(), state.applied.to_json());
+                d.insert("primary_epoch".to_string(), state.primary_epoch.to_json());
+                d.insert("last_contact_s".to_string(), state.last_contact.elapsed().as_secs().to_json());
+                d.insert("last_error".to_string(), state.last_error.to_json());
+            },
+            None => {},
+        }
+        Json::Object(d)
+    }
+}
+
+/// Rejects writes while following the primary
+///
+pub struct RejectStandbyWrites {
+    standby: Arc<Standby>,
+}
+
+impl RejectStandbyWrites {
+    pub fn new(standby: Arc<Standby>) -> RejectStandbyWrites {
+        RejectStandbyWrites{standby: standby}
+    }
+}
+
+impl BeforeMiddleware for RejectStandbyWrites {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        if upgrade::is_write(req) && self.standby.following() {
+            let err = io::Error::new(io::ErrorKind::Other, "standby");
+            return Err(IronError::new(err, (status::ServiceUnavailable, "this server is a read-only standby; write to the primary")))
+        }
+        Ok(())
+    }
+}
+
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let standby = req.get::<Read<StandbyKey>>().unwrap();
+    let changes = req.get::<Read<ChangeFeedKey>>().unwrap();
+
+    let mut response = standby.to_json();
+    match response {
+        Json::Object(ref mut d) => { d.insert("replicas".to_string(), changes.replicas()); },
+        _ => {},
+    }
+
+    let response_body = json::encode(&response).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+pub fn promote(req: &mut Request) -> IronResult<Response> {
+    let standby = req.get::<Read<StandbyKey>>().unwrap();
+
+    match standby.promote("requested") {
+        true => Ok(Response::with((status::Ok, json::encode(&standby.to_json()).unwrap()))),
+        false => Ok(Response::with((status::Conflict, "this server isn't a standby"))),
+    }
+}
+
+#[derive(RustcDecodable)]
+struct FeedEntry {
+    db: String,
+    op: String,
+    value: String,
+    epoch: u64,
+    version: u64,
+}
+
+#[derive(RustcDecodable)]
+struct Feed {
+    changes: Vec<FeedEntry>,
+    next: u64,
+    head: u64,
+    truncated: bool,
+    more: bool,
+    writes: bool,
+    epoch: u64,
+    feed: String,
+    versions: HashMap<String, u64>,
+}
+
+/// Follows the primary until promoted
+///
+pub fn follow(standby: Arc<Standby>, promote_after_s: u64, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, recovery: Arc<Recovery>, handoff: Arc<Handoff>, b32: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u32>>>>>>>, b64: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>>, b128: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 2]>>>>>>>, b256: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>>>) {
+    let primary = match standby.primary {
+        Some(ref primary) => primary.clone(),
+        None => return,
+    };
+
+    thread::spawn(move || {
+        let client = Client::new();
+
+        while standby.following() {
+            // Polls again straight away while the primary has more changes
+            match step(&client, &primary, &standby, config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), recovery.clone(), handoff.clone(), b32.clone(), b64.clone(), b128.clone(), b256.clone()) {
+                Ok(true) => continue,
+                Ok(false) => {},
+                Err(e) => standby.failed(e, promote_after_s),
+            }
+            thread::sleep(Duration::from_millis(POLL_MS));
+        }
+    });
+}
+
+/// Copies the primary's DBs if they haven't been, otherwise applies the
+/// primary's next batch of changes; returns whether more are waiting
+///
+fn step(client: &Client, primary: &str, standby: &Standby, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, recovery: Arc<Recovery>, handoff: Arc<Handoff>, b32: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u32>>>>>>>, b64: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>>, b128: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 2]>>>>>>>, b256: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>>>) -> Result<bool, String> {
+    match standby.cursor() {
+        None => {
+            // The feed position is taken before copying, so changes made
+            // while copying are applied afterwards (adds and deletes can be
+            // applied twice)
+            let feed = try!(fetch_feed(client, primary, &standby.replica, 0, 1));
+            if !feed.writes {
+                return Err(format!("the primary at {} must run with --feed-writes", primary))
+            }
+            try!(check_epoch(primary, feed.epoch, standby.primary_epoch()));
+
+            log!("Copying DBs from primary at {}", primary);
+            try!(discard(&config_mx.read().unwrap().clone(), options_mx.clone(), b32.clone(), b64.clone(), b128.clone(), b256.clone()));
+            try!(upgrade::copy_dbs(client, primary, &standby.cipher, config_mx, options_mx, changes.clone(), metrics, recovery, handoff, b32, b64, b128, b256));
+            // The copy includes at least the changes before the position
+            changes.versions().reset(feed.versions);
+            standby.synced(feed.feed, feed.head, feed.epoch);
+            // Only a complete copy counts as contact, so a standby which
+            // keeps failing to copy can still be promoted
+            standby.contacted();
+            Ok(false)
+        },
+        Some(cursor) => {
+            let feed = try!(fetch_feed(client, primary, &standby.replica, cursor, BATCH));
+            if standby.feed().as_ref() != Some(&feed.feed) {
+                standby.desynced();
+                return Err("the primary has restarted since the DBs were copied, copying them again".to_string())
+            }
+            if feed.truncated {
+                standby.desynced();
+                return Err("fell behind the primary's change feed, copying its DBs again".to_string())
+            }
+
+            // Nothing is applied if any change is from a stale leader
+            let mut epoch = standby.primary_epoch();
+            for change in feed.changes.iter() {
+                try!(check_epoch(primary, change.epoch, epoch));
+                epoch = change.epoch;
+            }
+            try!(check_epoch(primary, feed.epoch, epoch));
+            epoch = feed.epoch;
+
+            // The primary's evictions and expiries are applied as deletes
+            let count = feed.changes.len();
+            let versions: Vec<(String, u64)> = feed.changes.iter().map(|c| (c.db.clone(), c.version)).collect();
+            let entries = feed.changes.into_iter().map(|c| {
+                let op = if c.op == "evict" || c.op == "expire" { "delete".to_string() } else { c.op };
+                JournalEntry{db: c.db, op: op, value: c.value}
+            }).collect();
+            try!(upgrade::apply_journal(entries, config_mx, options_mx, changes.clone(), metrics, handoff, b32, b64, b128, b256));
+            for (db, version) in versions.into_iter() {
+                changes.versions().adopt(&db, version);
+            }
+            standby.applied(feed.next, count, epoch);
+            standby.contacted();
+            Ok(feed.more)
+        },
+    }
+}
+
+/// Drops every binary DB and its options, and deletes their data under
+/// `--data-dir` (including DBs which haven't been opened since the server
+/// started), so a copy starts from nothing
+///
+fn discard(config: &Config, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, b32: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u32>>>>>>>, b64: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>>, b128: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 2]>>>>>>>, b256: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>>>) -> Result<(), String> {
+    b32.write().unwrap().clear();
+    b64.write().unwrap().clear();
+    b128.write().unwrap().clear();
+    b256.write().unwrap().clear();
+    options_mx.write().unwrap().clear();
+
+    let data_dir = match config.data_dir {
+        Some(ref dir) if dir.exists() => dir,
+        _ => return Ok(()),
+    };
+    for entry in try!(fs::read_dir(data_dir).map_err(|e| format!("unable to read {}: {}", data_dir.display(), e))) {
+        let entry = try!(entry.map_err(|e| format!("unable to read {}: {}", data_dir.display(), e)));
+        let name = entry.file_name().to_string_lossy().into_owned();
+        if entry.path().is_dir() && fsck::parse_name(&name).is_some() {
+            try!(fs::remove_dir_all(entry.path()).map_err(|e| format!("unable to delete {}: {}", entry.path().display(), e)));
+        }
+    }
+    Ok(())
+}
+
+/// Refuses changes at an `epoch` lower than one already `seen`, which can
+/// only come from a leader that's since been replaced
+///
+fn check_epoch(primary: &str, epoch: u64, seen: u64) -> Result<(), String> {
+    match epoch < seen {
+        true => Err(format!("the primary at {} is at epoch {}, but epoch {} has been seen; not applying changes from a stale leader", primary, epoch, seen)),
+        false => Ok(()),
+    }
+}
+
+fn fetch_feed(client: &Client, primary: &str, replica: &str, since: u64, limit: usize) -> Result<Feed, String> {
+    let body = try!(upgrade::fetch(client, "GET", &format!("http://{}/admin/handoff/changes?since={}&limit={}&replica={}", primary, since, limit, replica)));
+
+    match json::decode::<Feed>(&body) {
+        Ok(feed) => Ok(feed),
+        Err(e) => Err(format!("unable to parse change feed: {}", e)),
+    }
+}
+
+fn load(path: &PathBuf, cipher: &Option<Cipher>) -> Option<Saved> {
+    let mut contents = String::new();
+    match File::open(path).and_then(|mut f| f.read_to_string(&mut contents)) {
+        Ok(_) => {},
+        Err(_) => return None,
+    }
+
+    let contents = match encryption::open(cipher, &contents, 0) {
+        Ok(contents) => contents,
+        Err(e) => {
+            log!("WARNING: ignoring unreadable standby position in {}: {}", path.display(), e);
+            return None
+        },
+    };
+    match json::decode::<Saved>(&contents) {
+        Ok(saved) => Some(saved),
+        Err(e) => {
+            log!("WARNING: ignoring unreadable standby position in {}: {}", path.display(), e);
+            None
+        },
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::collections::HashMap;
+    use std::env;
+    use std::fs;
+    use std::net::TcpListener;
+    use std::sync::{Arc, RwLock};
+
+    use http::{Config, DBOptions};
+    use http::changes::ChangeFeed;
+    use http::dump_handler::{Archive, ArchivedDB, ARCHIVE_VERSION, restore};
+    use http::fencing::Fencing;
+    use http::metrics::Metrics;
+    use http::recovery::Recovery;
+    use http::upgrade::Handoff;
+    use super::discard;
+
+    #[test]
+    fn dbs_can_be_copied_again() {
+        let config = Arc::new(RwLock::new(Config::default()));
+        let options_mx = Arc::new(RwLock::new(HashMap::new()));
+        let changes = Arc::new(ChangeFeed::new(false, Arc::new(Fencing::new(0, &None, Arc::new(None)))));
+        let metrics = Arc::new(Metrics::new());
+        let recovery = Recovery::new();
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let handoff = Arc::new(Handoff::new(&listener, None));
+        let b32 = Arc::new(RwLock::new(HashMap::new()));
+        let b64 = Arc::new(RwLock::new(HashMap::new()));
+        let b128 = Arc::new(RwLock::new(HashMap::new()));
+        let b256 = Arc::new(RwLock::new(HashMap::new()));
+
+        // The first copy has a value the second doesn't
+        for values in vec![vec!["AAAAAAAAAAE=", "AAAAAAAAAAI="], vec!["AAAAAAAAAAE="]].into_iter() {
+            let db = ArchivedDB::new(64, 4, DBOptions::default(), values.into_iter().map(|v| v.to_string()).collect());
+            let archive = Archive{version: ARCHIVE_VERSION, namespace: "foo".to_string(), databases: vec![db]};
+
+            discard(&config.read().unwrap(), options_mx.clone(), b32.clone(), b64.clone(), b128.clone(), b256.clone()).unwrap();
+            restore(archive, "foo".to_string(), config.clone(), options_mx.clone(), changes.clone(), metrics.clone(), Arc::new(None), handoff.clone(), &recovery, b32.clone(), b64.clone(), b128.clone(), b256.clone()).unwrap();
+        }
+
+        let db = b64.read().unwrap().get(&(4, "foo".to_string())).unwrap().clone();
+        let db = db.read().unwrap();
+        assert!(db.contains(&1));
+        assert!(!db.contains(&2));
+    }
+
+    #[test]
+    fn discarding_deletes_stored_dbs() {
+        let mut data_dir = env::temp_dir();
+        data_dir.push("hammer-standby-discard");
+        let _ = fs::remove_dir_all(&data_dir);
+        fs::create_dir_all(data_dir.join("b064_004_foo").join("shard_000")).unwrap();
+        fs::create_dir_all(data_dir.join("not_a_db")).unwrap();
+
+        let mut config = Config::default();
+        config.data_dir = Some(data_dir.clone());
+        let options_mx = Arc::new(RwLock::new(HashMap::new()));
+        options_mx.write().unwrap().insert((64, 4, "foo".to_string()), DBOptions::default());
+        discard(&config, options_mx.clone(), Arc::new(RwLock::new(HashMap::new())), Arc::new(RwLock::new(HashMap::new())), Arc::new(RwLock::new(HashMap::new())), Arc::new(RwLock::new(HashMap::new()))).unwrap();
+
+        assert!(options_mx.read().unwrap().is_empty());
+        assert!(!data_dir.join("b064_004_foo").exists());
+        assert!(data_dir.join("not_a_db").exists());
+        fs::remove_dir_all(&data_dir).unwrap();
+    }
+}
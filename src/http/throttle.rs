@@ -0,0 +1,134 @@
+use std::cmp;
+use std::io;
+use std::sync::{Arc, RwLock};
+use std::sync::atomic::Ordering;
+
+use iron::prelude::*;
+use iron::status;
+use iron::{BeforeMiddleware, AfterMiddleware};
+
+use http::Config;
+use http::metrics::Metrics;
+
+/// Upper bound on the delay a rejected write is asked to wait
+const MAX_DELAY_MS: u64 = 10000;
+
+/// Peak-shaving throttle for writes
+///
+/// Tracks the number of /add requests in flight.  Once the count exceeds
+/// `max_pending_writes`, each new write is rejected with a 503, whose
+/// `Retry-After` asks the client to wait `throttle_delay_ms` for every
+/// pending write over the threshold (up to `MAX_DELAY_MS`, rounded up to
+/// whole seconds), giving the DB write locks a chance to drain rather than
+/// letting latency grow without bound after a burst.  Rejected writes don't
+/// hold a server thread, as they would if they were delayed.  A
+/// `max_pending_writes` of 0 disables throttling, but pending writes are
+/// still counted.  Both settings are read for each write, so they can be
+/// reloaded.
+///
+#[derive(Clone)]
+pub struct WriteThrottle {
+    metrics: Arc<Metrics>,
+    config: Arc<RwLock<Config>>,
+}
+
+impl WriteThrottle {
+    pub fn new(metrics: Arc<Metrics>, config: Arc<RwLock<Config>>) -> WriteThrottle {
+        WriteThrottle{
+            metrics: metrics,
+            config: config,
+        }
+    }
+
+    fn is_write(req: &Request) -> bool {
+        match req.url.path.first() {
+            Some(segment) => segment == "add",
+            None => false,
+        }
+    }
+
+    fn release(&self) {
+        self.metrics.pending_writes.fetch_sub(1, Ordering::Relaxed);
+    }
+}
+
+impl BeforeMiddleware for WriteThrottle {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        if !WriteThrottle::is_write(req) {
+            return Ok(())
+        }
+
+        let pending = self.metrics.pending_writes.fetch_add(1, Ordering::Relaxed) + 1;
+
+        // Racy, but good enough for reporting
+        if pending > self.metrics.max_pending_writes.load(Ordering::Relaxed) {
+            self.metrics.max_pending_writes.store(pending, Ordering::Relaxed);
+        }
+
+        let (max_pending, delay_ms) = {
+            let config = self.config.read().unwrap();
+            (config.max_pending_writes, config.throttle_delay_ms)
+        };
+
+        match retry_after_s(pending, max_pending, delay_ms) {
+            Some(retry_after) => {
+                self.metrics.throttled_writes.fetch_add(1, Ordering::Relaxed);
+
+                // Released by `catch`
+                let err = io::Error::new(io::ErrorKind::Other, "writes throttled");
+                let msg = format!("{} writes are pending, over the limit of {}; retry in {}s", pending, max_pending, retry_after);
+                let mut err = IronError::new(err, (status::ServiceUnavailable, msg));
+                err.response.headers.set_raw("Retry-After", vec![retry_after.to_string().into_bytes()]);
+                Err(err)
+            },
+            None => Ok(()),
+        }
+    }
+}
+
+/// Seconds a write should wait before retrying, if `pending` writes are over
+/// the limit
+///
+fn retry_after_s(pending: usize, max_pending: usize, delay_ms: u64) -> Option<u64> {
+    if max_pending == 0 || pending <= max_pending {
+        return None
+    }
+
+    let delay = cmp::min(delay_ms * (pending - max_pending) as u64, MAX_DELAY_MS);
+    Some(cmp::max((delay + 999) / 1000, 1))
+}
+
+impl AfterMiddleware for WriteThrottle {
+    fn after(&self, req: &mut Request, res: Response) -> IronResult<Response> {
+        if WriteThrottle::is_write(req) {
+            self.release();
+        }
+        Ok(res)
+    }
+
+    fn catch(&self, req: &mut Request, err: IronError) -> IronResult<Response> {
+        if WriteThrottle::is_write(req) {
+            self.release();
+        }
+        Err(err)
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use http::throttle::retry_after_s;
+
+    #[test]
+    fn writes_under_the_limit_are_not_throttled() {
+        assert_eq!(retry_after_s(10, 10, 100), None);
+        assert_eq!(retry_after_s(100, 0, 100), None);
+    }
+
+    #[test]
+    fn retries_wait_longer_the_further_over_the_limit() {
+        assert_eq!(retry_after_s(11, 10, 100), Some(1));
+        assert_eq!(retry_after_s(25, 10, 100), Some(2));
+        assert_eq!(retry_after_s(1000, 10, 100), Some(10));
+        assert_eq!(retry_after_s(11, 10, 0), Some(1));
+    }
+}
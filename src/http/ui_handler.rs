@@ -0,0 +1,17 @@
+//! Admin web UI
+//!
+//! A single page, compiled into the binary, which lists the binary DBs, shows
+//! a DB's bucket stats and queries it, highlighting the bits in which each
+//! match differs from the query.  It only uses the public API (`/db`,
+//! `/buckets` and `/query`).
+
+use iron::prelude::*;
+use iron::status;
+use iron::mime::Mime;
+
+const UI_HTML: &'static str = include_str!("ui.html");
+
+pub fn show(_: &mut Request) -> IronResult<Response> {
+    let content_type = "text/html; charset=utf-8".parse::<Mime>().unwrap();
+    Ok(Response::with((status::Ok, content_type, UI_HTML)))
+}
@@ -0,0 +1,640 @@
+//! Zero-downtime upgrades
+//!
+//! `POST /admin/upgrade` starts a new server process - from `--upgrade-binary`,
+//! or else the same binary path, so a new build can be installed over the old
+//! one first - with the same arguments, handing it the listening sockets as systemd would
+//! (see `listen`).  Both processes then share the sockets, but the new one
+//! copies the databases from the old one before it starts accepting
+//! connections:
+//!
+//! 1. The old process starts journaling the adds and deletes it accepts,
+//!    and rejects other writes (options, DB deletion, loads and jobs) with
+//!    a 503, as they aren't journaled
+//! 2. The new process fetches and loads a dump of each namespace
+//! 3. The new process applies the journal, repeating until it has caught up
+//! 4. The new process fetches the rest of the journal; from then on the old
+//!    process rejects writes with a 503
+//! 5. The new process starts accepting connections, and the old process
+//!    exits `DRAIN_S` seconds later
+//!
+//! If the new process exits before the old one, the upgrade is abandoned and
+//! the old process carries on as before.
+//!
+//! Only in-memory binary (and float) databases are handed over: upgrades are
+//! refused with `--data-dir` (a database's files can only be opened by one
+//! process, and restarting doesn't rebuild them anyway) or while vector or
+//! document databases exist.
+
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::env;
+use std::hash::Hash;
+use std::io;
+use std::io::Read;
+use std::net::{SocketAddr, TcpListener};
+use std::os::unix::io::{AsRawFd, RawFd};
+use std::os::unix::process::CommandExt;
+use std::process;
+use std::process::{Child, Command};
+use std::sync::{Arc, Mutex, RwLock, RwLockReadGuard};
+use std::thread;
+use std::time::Duration;
+
+use hyper::Client;
+use hyper::header::Headers;
+use hyper::status::StatusCode;
+use iron::prelude::*;
+use iron::{status, typemap, BeforeMiddleware};
+use iron::method::Method;
+use libc;
+use persistent;
+use persistent::State;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+use rustc_serialize::{Encodable, Decodable};
+
+use hammer::db::{Database, Factory};
+use hammer::db::hamming::Hamming;
+use hammer::db::normalize::{BitMask, Rotate};
+
+use http::{Config, ConfigKey, DBOptions, B32, B64, B128, B256, V32, V64, V128, V256, D32, D64, D128, D256, BitOrder, ValueEncoding, query_param};
+use http::auth;
+use http::binary_handler::{decode_values, add_values, delete_values};
+use http::changes::ChangeFeed;
+use http::dump_handler;
+use http::encryption::Cipher;
+use http::metrics::Metrics;
+use http::recovery::Recovery;
+use http::sink::Mutation;
+
+/// Seconds the old process keeps serving reads after handing over
+const DRAIN_S: u64 = 10;
+
+/// The new process stops catching up once a journal is shorter than this,
+/// and fetches the final journal
+const CATCH_UP_WRITES: usize = 1000;
+
+enum Phase {
+    Serving,
+    /// Writes accepted since the upgrade started which the new process
+    /// hasn't fetched yet
+    Journaling(Vec<Mutation>),
+    /// The new process has the final journal, so writes are rejected
+    Draining,
+}
+
+pub struct HandoffKey;
+impl typemap::Key for HandoffKey { type Value = Handoff; }
+
+pub struct Handoff {
+    phase: Mutex<Phase>,
+    /// Held for reading by each write from its admission until it's
+    /// recorded, and for writing while the phase changes, so the phase can't
+    /// change under a write and draining waits for writes in flight
+    writes: RwLock<()>,
+    /// Held for reading by each write which isn't journaled (see
+    /// `admit_unjournaled`) while it runs, and for writing while the upgrade
+    /// starts, so none is in flight once it has
+    unjournaled: RwLock<()>,
+    /// Listening sockets passed to the new process: the API's, and the admin
+    /// endpoints' if they're served separately
+    fds: (RawFd, Option<RawFd>),
+    /// Where the new process can reach the admin endpoints
+    admin_addr: String,
+}
+
+impl Handoff {
+    pub fn new(listener: &TcpListener, admin_listener: Option<&TcpListener>) -> Handoff {
+        let admin_addr = match admin_listener {
+            Some(admin_listener) => admin_listener.local_addr().unwrap(),
+            None => listener.local_addr().unwrap(),
+        };
+
+        Handoff{
+            phase: Mutex::new(Phase::Serving),
+            writes: RwLock::new(()),
+            unjournaled: RwLock::new(()),
+            fds: (listener.as_raw_fd(), admin_listener.map(|l| l.as_raw_fd())),
+            admin_addr: local_addr(admin_addr),
+        }
+    }
+
+    /// Admit a write, which is recorded (see `record`) before the returned
+    /// guard is dropped.  Fails once the new process has the final journal.
+    ///
+    pub fn admit(&self) -> Result<RwLockReadGuard<()>, String> {
+        let guard = self.writes.read().unwrap();
+        match *self.phase.lock().unwrap() {
+            Phase::Draining => Err("the server is being upgraded, retry shortly".to_string()),
+            _ => Ok(guard),
+        }
+    }
+
+    /// Admit a write which can't be journaled (setting options, deleting a
+    /// DB, loading an archive or starting a job), which runs before the
+    /// returned guard is dropped.  Fails once an upgrade has started.
+    ///
+    pub fn admit_unjournaled(&self) -> Result<RwLockReadGuard<()>, String> {
+        let guard = self.unjournaled.read().unwrap();
+        match *self.phase.lock().unwrap() {
+            Phase::Serving => Ok(guard),
+            _ => Err("the server is being upgraded, retry shortly".to_string()),
+        }
+    }
+
+    /// Whether admitted writes should be recorded
+    ///
+    pub fn journaling(&self) -> bool {
+        match *self.phase.lock().unwrap() {
+            Phase::Journaling(_) => true,
+            _ => false,
+        }
+    }
+
+    /// Record the writes of `encoded` values which were `accepted`
+    ///
+    pub fn record(&self, db_name: &str, op: &'static str, encoded: &[Option<String>], accepted: Vec<bool>) {
+        match *self.phase.lock().unwrap() {
+            Phase::Journaling(ref mut journal) => {
+                for (value, accepted) in encoded.iter().zip(accepted.into_iter()) {
+                    match (value, accepted) {
+                        (&Some(ref value), true) => journal.push(Mutation{db: db_name.to_string(), op: op, value: value.clone()}),
+                        _ => {},
+                    }
+                }
+            },
+            _ => {},
+        }
+    }
+
+    fn draining(&self) -> bool {
+        match *self.phase.lock().unwrap() {
+            Phase::Draining => true,
+            _ => false,
+        }
+    }
+
+    fn upgrading(&self) -> bool {
+        match *self.phase.lock().unwrap() {
+            Phase::Serving => false,
+            _ => true,
+        }
+    }
+
+    fn begin(&self) -> Result<(), String> {
+        let _unjournaled = self.unjournaled.write().unwrap();
+        let _writes = self.writes.write().unwrap();
+        let mut phase = self.phase.lock().unwrap();
+        match *phase {
+            Phase::Serving => {
+                *phase = Phase::Journaling(vec![]);
+                Ok(())
+            },
+            _ => Err("an upgrade is already running".to_string()),
+        }
+    }
+
+    fn abort(&self) {
+        let _writes = self.writes.write().unwrap();
+        *self.phase.lock().unwrap() = Phase::Serving;
+    }
+
+    /// Writes journaled since the last call, once the writes in flight are
+    /// recorded; if `last`, writes are rejected from then on
+    ///
+    fn take_journal(&self, last: bool) -> Result<Vec<Mutation>, String> {
+        let _writes = self.writes.write().unwrap();
+        let mut phase = self.phase.lock().unwrap();
+        let journal = match *phase {
+            Phase::Journaling(ref mut journal) => journal.drain(..).collect(),
+            _ => return Err("no upgrade is running".to_string()),
+        };
+
+        if last {
+            *phase = Phase::Draining;
+        }
+        Ok(journal)
+    }
+}
+
+/// Address for reaching `addr` from this host
+///
+fn local_addr(addr: SocketAddr) -> String {
+    match addr {
+        SocketAddr::V4(a) if a.ip().octets() == [0, 0, 0, 0] => format!("127.0.0.1:{}", a.port()),
+        SocketAddr::V6(a) if a.ip().segments() == [0, 0, 0, 0, 0, 0, 0, 0] => format!("[::1]:{}", a.port()),
+        a => a.to_string(),
+    }
+}
+
+/// Rejects writes which aren't journaled once an upgrade starts, and all
+/// writes once the new process has the final journal
+///
+pub struct RejectDrainedWrites {
+    handoff: Arc<Handoff>,
+}
+
+impl RejectDrainedWrites {
+    pub fn new(handoff: Arc<Handoff>) -> RejectDrainedWrites {
+        RejectDrainedWrites{handoff: handoff}
+    }
+}
+
+/// Whether the request changes the DBs
+///
+pub fn is_write(req: &Request) -> bool {
+    match (req.url.path.first(), &req.method) {
+        (Some(op), _) if op == "add" || op == "delete" || op == "load" => true,
+        (Some(op), &Method::Post) if op == "options" => true,
+        // Some jobs (`repair`, `delete`) change the DBs
+        (Some(op), &Method::Post) if op == "jobs" => true,
+        (Some(op), &Method::Delete) if op == "db" => true,
+        _ => false,
+    }
+}
+
+/// Whether the request's writes are journaled during upgrades
+///
+fn is_journaled(req: &Request) -> bool {
+    match req.url.path.first() {
+        Some(op) => op == "add" || op == "delete",
+        None => false,
+    }
+}
+
+impl BeforeMiddleware for RejectDrainedWrites {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        let rejected = match is_journaled(req) {
+            true => self.handoff.draining(),
+            false => is_write(req) && self.handoff.upgrading(),
+        };
+        if rejected {
+            let err = io::Error::new(io::ErrorKind::Other, "upgrading");
+            return Err(IronError::new(err, (status::ServiceUnavailable, "the server is being upgraded, retry shortly")))
+        }
+        Ok(())
+    }
+}
+
+pub fn upgrade(req: &mut Request) -> IronResult<Response> {
+    let config = req.get::<State<ConfigKey>>().unwrap().read().unwrap().clone();
+    if config.data_dir.is_some() {
+        return Ok(Response::with((status::BadRequest, "upgrades only hand over in-memory databases; restart servers with a --data-dir instead")))
+    }
+    if has_unsupported_dbs(req) {
+        return Ok(Response::with((status::BadRequest, "vector and document databases can't be handed over")))
+    }
+
+    let binary = match config.upgrade_binary {
+        Some(binary) => binary,
+        None => env::args().next().unwrap(),
+    };
+
+    let handoff = req.get::<persistent::Read<HandoffKey>>().unwrap();
+    match handoff.begin() {
+        Ok(_) => {},
+        Err(e) => return Ok(Response::with((status::Conflict, e))),
+    }
+
+    let child = match spawn(&binary, &handoff) {
+        Ok(child) => child,
+        Err(e) => {
+            handoff.abort();
+            return Ok(Response::with((status::InternalServerError, e)))
+        },
+    };
+    log!("Upgrading to {} (pid {})", binary, child.id());
+
+    let mut d = BTreeMap::new();
+    d.insert("pid".to_string(), child.id().to_json());
+    watch(child, handoff);
+
+    let response_body = json::encode(&Json::Object(d)).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+fn has_unsupported_dbs(req: &mut Request) -> bool {
+    !(req.get::<State<V32>>().unwrap().read().unwrap().is_empty() &&
+         req.get::<State<V64>>().unwrap().read().unwrap().is_empty() &&
+         req.get::<State<V128>>().unwrap().read().unwrap().is_empty() &&
+         req.get::<State<V256>>().unwrap().read().unwrap().is_empty() &&
+         req.get::<State<D32>>().unwrap().read().unwrap().is_empty() &&
+         req.get::<State<D64>>().unwrap().read().unwrap().is_empty() &&
+         req.get::<State<D128>>().unwrap().read().unwrap().is_empty() &&
+         req.get::<State<D256>>().unwrap().read().unwrap().is_empty())
+}
+
+/// Start the new process with this one's arguments, passing it the
+/// listening sockets
+///
+fn spawn(binary: &str, handoff: &Handoff) -> Result<Child, String> {
+    let args: Vec<String> = env::args().skip(1).filter(|a| !a.starts_with("--take-over=")).collect();
+    let (fd, admin_fd) = handoff.fds;
+    let fd_count = if admin_fd.is_some() { 2 } else { 1 };
+
+    let mut command = Command::new(binary);
+    command.args(&args)
+        .arg(format!("--take-over={}", handoff.admin_addr))
+        .env("LISTEN_FDS", fd_count.to_string())
+        .before_exec(move || unsafe { pass_fds(fd, admin_fd) });
+
+    match command.spawn() {
+        Ok(child) => Ok(child),
+        Err(e) => Err(format!("unable to start '{}': {}", binary, e)),
+    }
+}
+
+/// Move the sockets to fds 3 (and 4), where `listen` expects them.  Runs in
+/// the new process before it execs.
+///
+unsafe fn pass_fds(fd: RawFd, admin_fd: Option<RawFd>) -> io::Result<()> {
+    // Both are copied out of the way first, so that moving one can't close
+    // the other
+    let fd = try!(copy_fd(fd));
+    match admin_fd {
+        Some(admin_fd) => {
+            let admin_fd = try!(copy_fd(admin_fd));
+            try!(move_fd(fd, 3));
+            move_fd(admin_fd, 4)
+        },
+        None => move_fd(fd, 3),
+    }
+}
+
+unsafe fn copy_fd(fd: RawFd) -> io::Result<RawFd> {
+    match libc::fcntl(fd, libc::F_DUPFD, 10) {
+        -1 => Err(io::Error::last_os_error()),
+        copy => Ok(copy),
+    }
+}
+
+unsafe fn move_fd(from: RawFd, to: RawFd) -> io::Result<()> {
+    // The copy made by dup2 isn't closed on exec
+    if libc::dup2(from, to) == -1 {
+        return Err(io::Error::last_os_error())
+    }
+    libc::close(from);
+    Ok(())
+}
+
+/// Abandon the upgrade if the new process exits
+///
+fn watch(mut child: Child, handoff: Arc<Handoff>) {
+    thread::spawn(move || {
+        let status = child.wait();
+        log!("WARNING: upgrade process exited ({:?}), abandoning upgrade", status);
+        handoff.abort();
+    });
+}
+
+/// Journaled writes, as a JSON array of mutations (see `sink`); with
+/// `?final=true`, writes are rejected from then on and the process exits
+/// after draining
+///
+pub fn journal(req: &mut Request) -> IronResult<Response> {
+    let last = query_param(req, "final") == Some("true".to_string());
+    let handoff = req.get::<persistent::Read<HandoffKey>>().unwrap();
+
+    let journal = match handoff.take_journal(last) {
+        Ok(journal) => journal,
+        Err(e) => return Ok(Response::with((status::Conflict, e))),
+    };
+
+    if last {
+        thread::spawn(move || {
+            thread::sleep(Duration::from_secs(DRAIN_S));
+            if handoff.draining() {
+                log!("Upgrade complete, exiting");
+                process::exit(0);
+            }
+        });
+    }
+
+    let response_body = json::encode(&journal.iter().map(|m| m.to_json()).collect::<Vec<Json>>()).unwrap();
+    Ok(Response::with((status::Ok, response_body)))
+}
+
+/// A write, as journaled (or published to the change feed)
+///
+#[derive(RustcDecodable)]
+pub struct JournalEntry {
+    pub db: String,
+    pub op: String,
+    pub value: String,
+}
+
+/// Copy the databases from the process being upgraded, whose admin endpoints
+/// are at `old`, along with the writes it journals meanwhile
+///
+pub fn take_over(old: &str, cipher: &Option<Cipher>, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, recovery: Arc<Recovery>, handoff: Arc<Handoff>, b32: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u32>>>>>>>, b64: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>>, b128: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 2]>>>>>>>, b256: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>>>) -> Result<(), String> {
+    let client = Client::new();
+    try!(copy_dbs(&client, old, cipher, config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), recovery, handoff.clone(), b32.clone(), b64.clone(), b128.clone(), b256.clone()));
+
+    loop {
+        let journal = try!(fetch_journal(&client, old, false));
+        let caught_up = journal.len() < CATCH_UP_WRITES;
+        log!("Applying {} writes made while copying", journal.len());
+        try!(apply_journal(journal, config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), handoff.clone(), b32.clone(), b64.clone(), b128.clone(), b256.clone()));
+
+        if caught_up {
+            break
+        }
+    }
+
+    let journal = try!(fetch_journal(&client, old, true));
+    apply_journal(journal, config_mx, options_mx, changes, metrics, handoff, b32, b64, b128, b256)
+}
+
+/// Copy every namespace's binary DBs from the server whose admin endpoints
+/// are at `old`
+///
+/// Copied writes aren't mirrored again; the other server already did.  The
+/// archives are opened with `cipher`, so an encrypting server can only be
+/// copied by one with the same key.
+///
+pub fn copy_dbs(client: &Client, old: &str, cipher: &Option<Cipher>, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, recovery: Arc<Recovery>, handoff: Arc<Handoff>, b32: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u32>>>>>>>, b64: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>>, b128: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 2]>>>>>>>, b256: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>>>) -> Result<(), String> {
+    let mirror = Arc::new(None);
+
+    let dbs = match Json::from_str(&try!(fetch(client, "GET", &format!("http://{}/admin/handoff/db", old)))) {
+        Ok(Json::Array(dbs)) => dbs,
+        _ => return Err("unexpected DB list".to_string()),
+    };
+    let namespaces: BTreeSet<String> = dbs.iter().filter_map(|db| db.find("namespace").and_then(|n| n.as_string()).map(|n| n.to_string())).collect();
+
+    for namespace in namespaces.into_iter() {
+        log!("Copying namespace {} from {}", namespace, old);
+        let body = try!(fetch(client, "GET", &format!("http://{}/admin/handoff/dump/{}", old, encode_segment(&namespace))));
+        let archive = match dump_handler::parse_archive(&body, cipher) {
+            Ok(archive) => archive,
+            Err(e) => return Err(format!("unable to parse dump of {}: {}", namespace, e)),
+        };
+
+        match dump_handler::restore(archive, namespace.clone(), config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), mirror.clone(), handoff.clone(), &recovery, b32.clone(), b64.clone(), b128.clone(), b256.clone()) {
+            Ok(loaded) => {
+                let corrupt = loaded.as_object().map(|dbs| dbs.values().any(|db| db.find("corrupt").and_then(|n| n.as_u64()).unwrap_or(0) > 0));
+                if corrupt == Some(true) {
+                    return Err(format!("the dump of {} from {} failed its checksums", namespace, old))
+                }
+            },
+            Err((_, e)) => return Err(format!("unable to load {}: {}", namespace, e)),
+        }
+    }
+
+    Ok(())
+}
+
+/// `segment` percent-encoded for use in a URL path
+///
+fn encode_segment(segment: &str) -> String {
+    segment.bytes().map(|b| match b {
+        b'A'...b'Z' | b'a'...b'z' | b'0'...b'9' | b'-' | b'.' | b'_' | b'~' => (b as char).to_string(),
+        b => format!("%{:02X}", b),
+    }).collect()
+}
+
+/// The body of a successful response to `method url`, sent with the
+/// server's own token (see `auth`)
+///
+pub fn fetch(client: &Client, method: &str, url: &str) -> Result<String, String> {
+    let mut headers = Headers::new();
+    match auth::client_token() {
+        Some(token) => headers.set_raw("Authorization", vec![format!("Bearer {}", token).into_bytes()]),
+        None => {},
+    }
+
+    let request = match method {
+        "POST" => client.post(url),
+        _ => client.get(url),
+    }.headers(headers);
+
+    let mut res = match request.send() {
+        Ok(res) => res,
+        Err(e) => return Err(format!("{} {} failed: {}", method, url, e)),
+    };
+
+    let mut body = String::new();
+    match res.read_to_string(&mut body) {
+        Ok(_) => {},
+        Err(e) => return Err(format!("unable to read response to {} {}: {}", method, url, e)),
+    }
+
+    match res.status {
+        StatusCode::Ok => Ok(body),
+        status => Err(format!("{} {} returned {}: {}", method, url, status, body)),
+    }
+}
+
+fn fetch_journal(client: &Client, old: &str, last: bool) -> Result<Vec<JournalEntry>, String> {
+    let body = try!(fetch(client, "POST", &format!("http://{}/admin/handoff/journal?final={}", old, last)));
+
+    match json::decode::<Vec<JournalEntry>>(&body) {
+        Ok(journal) => Ok(journal),
+        Err(e) => Err(format!("unable to parse journal: {}", e)),
+    }
+}
+
+/// Applies writes in order
+///
+pub fn apply_journal(journal: Vec<JournalEntry>, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, handoff: Arc<Handoff>, b32: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u32>>>>>>>, b64: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<u64>>>>>>>, b128: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 2]>>>>>>>, b256: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<[u64; 4]>>>>>>>) -> Result<(), String> {
+    // Consecutive writes to the same DB are applied together, in order
+    let mut start = 0;
+    while start < journal.len() {
+        let mut end = start + 1;
+        while end < journal.len() && journal[end].db == journal[start].db && journal[end].op == journal[start].op {
+            end += 1;
+        }
+
+        let entry = &journal[start];
+        let values: Vec<Json> = journal[start..end].iter().map(|e| Json::String(e.value.clone())).collect();
+        let parts: Vec<&str> = entry.db.splitn(4, '/').collect();
+        let (bits, tolerance, namespace) = match (parts.len(), parts.get(1).and_then(|b| b.parse::<usize>().ok()), parts.get(2).and_then(|t| t.parse::<usize>().ok())) {
+            (4, Some(bits), Some(tolerance)) => (bits, tolerance, parts[3].to_string()),
+            _ => return Err(format!("unexpected journal DB '{}'", entry.db)),
+        };
+
+        try!(match bits {
+            32 => apply_writes(&entry.op, decode_values::<u32>(values, ValueEncoding::Base64, BitOrder::MsbFirst), bits, tolerance, namespace, config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), handoff.clone(), b32.clone()),
+            64 => apply_writes(&entry.op, decode_values::<u64>(values, ValueEncoding::Base64, BitOrder::MsbFirst), bits, tolerance, namespace, config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), handoff.clone(), b64.clone()),
+            128 => apply_writes(&entry.op, decode_values::<[u64; 2]>(values, ValueEncoding::Base64, BitOrder::MsbFirst), bits, tolerance, namespace, config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), handoff.clone(), b128.clone()),
+            256 => apply_writes(&entry.op, decode_values::<[u64; 4]>(values, ValueEncoding::Base64, BitOrder::MsbFirst), bits, tolerance, namespace, config_mx.clone(), options_mx.clone(), changes.clone(), metrics.clone(), handoff.clone(), b256.clone()),
+            _ => Err(format!("unexpected journal DB '{}'", entry.db)),
+        });
+
+        start = end;
+    }
+
+    Ok(())
+}
+
+fn apply_writes<T>(op: &str, values: Vec<Result<T, String>>, bits: usize, tolerance: usize, namespace: String, config_mx: Arc<RwLock<Config>>, options_mx: Arc<RwLock<HashMap<(usize, usize, String), DBOptions>>>, changes: Arc<ChangeFeed>, metrics: Arc<Metrics>, handoff: Arc<Handoff>, dbmap_mx: Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>) -> Result<(), String> where
+T: 'static + Sync + Send + Clone + Eq + Hash + Factory + Encodable + Decodable + Hamming + BitMask + Rotate,
+{
+    match op {
+        "add" => add_values(values, bits, tolerance, namespace, config_mx, options_mx, changes, metrics, Arc::new(None), handoff, dbmap_mx).map(|_| ()),
+        "delete" => {
+            delete_values(values, bits, tolerance, namespace, changes, Arc::new(None), handoff, dbmap_mx);
+            Ok(())
+        },
+        op => Err(format!("unexpected journal op '{}'", op)),
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use std::net::TcpListener;
+    use std::sync::Arc;
+    use std::sync::mpsc;
+    use std::thread;
+    use std::time::Duration;
+
+    use super::{Handoff, encode_segment};
+
+    #[test]
+    fn unjournaled_writes_are_refused_once_upgrading() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let handoff = Arc::new(Handoff::new(&listener, None));
+
+        // The upgrade can't start while an unjournaled write is in flight
+        let admitted = handoff.admit_unjournaled().unwrap();
+        let (tx, rx) = mpsc::channel();
+        let starter = handoff.clone();
+        thread::spawn(move || tx.send(starter.begin()).unwrap());
+        thread::sleep(Duration::from_millis(50));
+        assert!(rx.try_recv().is_err());
+
+        drop(admitted);
+        rx.recv().unwrap().unwrap();
+        assert!(handoff.admit_unjournaled().is_err());
+        assert!(handoff.admit().is_ok());
+    }
+
+    #[test]
+    fn namespaces_are_encoded() {
+        assert_eq!(encode_segment("foo_bar-1"), "foo_bar-1");
+        assert_eq!(encode_segment("a/b c?"), "a%2Fb%20c%3F");
+    }
+
+    #[test]
+    fn final_journal_waits_for_writes_in_flight() {
+        let listener = TcpListener::bind("127.0.0.1:0").unwrap();
+        let handoff = Arc::new(Handoff::new(&listener, None));
+        handoff.begin().unwrap();
+
+        let admitted = handoff.admit().unwrap();
+        assert!(handoff.journaling());
+
+        let (tx, rx) = mpsc::channel();
+        let taker = handoff.clone();
+        thread::spawn(move || tx.send(taker.take_journal(true).unwrap()).unwrap());
+
+        // The journal can't be taken until the write is recorded
+        thread::sleep(Duration::from_millis(50));
+        assert!(rx.try_recv().is_err());
+
+        handoff.record("b/64/0/foo", "add", &[Some("AAAAAAAAAAE=".to_string())], vec![true]);
+        drop(admitted);
+
+        let journal = rx.recv().unwrap();
+        assert_eq!(journal.len(), 1);
+        assert!(handoff.admit().is_err());
+    }
+}
@@ -0,0 +1,297 @@
+//! Per-namespace usage records, for chargeback
+//!
+//! Every `--usage-interval` seconds, `UsageRecorder` closes a usage period
+//! for each namespace: the successful `add`, `query`, `any_match` and
+//! `delete` requests made during the period (as counted by `rates`), and the
+//! key-seconds stored - the keys held across the namespace's binary
+//! databases at the end of the period, times the period's length.  Records
+//! are kept in memory, served by `GET /admin/usage` as JSON or CSV, and
+//! optionally POSTed to a webhook as each period closes.
+//!
+//! Keys are counted by iterating each database while holding its read lock,
+//! so intervals should be long (an hour, say) for large databases.
+
+use std::collections::{BTreeMap, BTreeSet, HashMap, VecDeque};
+use std::io::Read;
+use std::sync::{Arc, Mutex, RwLock};
+use std::thread;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use hyper::Client;
+use hyper::header::Headers;
+use iron::prelude::*;
+use iron::status;
+use persistent;
+use rustc_serialize::json;
+use rustc_serialize::json::{ToJson, Json};
+
+use hammer::db::Database;
+
+use http::query_param;
+use http::metrics::{Metrics, MetricsKey};
+
+type DBMap<T> = Arc<RwLock<HashMap<(usize, String), Arc<RwLock<Box<Database<T>>>>>>>;
+
+/// Operations counted in usage records, in CSV column order
+const OPS: [&'static str; 4] = ["add", "query", "any_match", "delete"];
+
+/// Most records kept in memory; the oldest are dropped first
+const MAX_RECORDS: usize = 10000;
+
+/// Retries for records the webhook rejects
+const WEBHOOK_RETRIES: usize = 3;
+
+/// Delay before the first webhook retry; doubled for each retry
+const RETRY_DELAY_MS: u64 = 1000;
+
+/// A namespace's usage over one period
+///
+#[derive(Clone, Debug, PartialEq, Eq)]
+pub struct UsageRecord {
+    pub namespace: String,
+    /// Start of the period, in seconds since the epoch
+    pub start: u64,
+    /// End of the period, in seconds since the epoch
+    pub end: u64,
+    /// Successful requests during the period, by operation
+    pub ops: BTreeMap<String, u64>,
+    /// Keys stored at the end of the period
+    pub keys: u64,
+    /// `keys` times the length of the period
+    pub key_seconds: u64,
+}
+
+impl UsageRecord {
+    pub fn csv_header() -> String {
+        let mut columns = vec!["namespace", "start", "end", "keys", "key_seconds"];
+        columns.extend(OPS.iter());
+        columns.join(",")
+    }
+
+    pub fn to_csv(&self) -> String {
+        let mut fields = vec![csv_field(&self.namespace), self.start.to_string(), self.end.to_string(), self.keys.to_string(), self.key_seconds.to_string()];
+        fields.extend(OPS.iter().map(|op| self.ops.get(*op).cloned().unwrap_or(0).to_string()));
+        fields.join(",")
+    }
+}
+
+impl ToJson for UsageRecord {
+    fn to_json(&self) -> Json {
+        let mut d = BTreeMap::new();
+        d.insert("namespace".to_string(), self.namespace.to_json());
+        d.insert("start".to_string(), self.start.to_json());
+        d.insert("end".to_string(), self.end.to_json());
+        d.insert("ops".to_string(), self.ops.to_json());
+        d.insert("keys".to_string(), self.keys.to_json());
+        d.insert("key_seconds".to_string(), self.key_seconds.to_json());
+        Json::Object(d)
+    }
+}
+
+/// Quotes `field` if it holds a separator, quote or line break
+///
+fn csv_field(field: &str) -> String {
+    match field.contains(|c| c == ',' || c == '"' || c == '\n' || c == '\r') {
+        true => format!("\"{}\"", field.replace("\"", "\"\"")),
+        false => field.to_string(),
+    }
+}
+
+/// The most recent usage records, oldest first
+///
+pub struct UsageLog {
+    records: Mutex<VecDeque<UsageRecord>>,
+}
+
+impl UsageLog {
+    pub fn new() -> UsageLog {
+        UsageLog{records: Mutex::new(VecDeque::new())}
+    }
+
+    pub fn push(&self, new_records: Vec<UsageRecord>) {
+        let mut records = self.records.lock().unwrap();
+        records.extend(new_records.into_iter());
+        while records.len() > MAX_RECORDS {
+            records.pop_front();
+        }
+    }
+
+    /// Records of periods ending after `since`
+    ///
+    pub fn since(&self, since: u64) -> Vec<UsageRecord> {
+        self.records.lock().unwrap().iter().filter(|r| r.end > since).cloned().collect()
+    }
+}
+
+/// Usage records for the period from `start` to `end`, for each namespace
+/// with requests during the period or keys at its end
+///
+/// `before` and `after` are the total requests by namespace and operation at
+/// the start and end of the period.
+///
+pub fn period(start: u64, end: u64, before: &BTreeMap<String, BTreeMap<String, u64>>, after: &BTreeMap<String, BTreeMap<String, u64>>, keys: &BTreeMap<String, u64>) -> Vec<UsageRecord> {
+    let namespaces: BTreeSet<&String> = after.keys().chain(keys.keys()).collect();
+
+    let empty = BTreeMap::new();
+    namespaces.into_iter().filter_map(|namespace| {
+        let ops_before = before.get(namespace).unwrap_or(&empty);
+        let ops = after.get(namespace).unwrap_or(&empty).iter()
+            .map(|(op, total)| (op.clone(), total - ops_before.get(op).cloned().unwrap_or(0)))
+            .filter(|&(_, count)| count > 0)
+            .collect::<BTreeMap<String, u64>>();
+        let stored = keys.get(namespace).cloned().unwrap_or(0);
+
+        if ops.is_empty() && stored == 0 {
+            return None
+        }
+
+        Some(UsageRecord{
+            namespace: namespace.clone(),
+            start: start,
+            end: end,
+            ops: ops,
+            keys: stored,
+            key_seconds: stored * (end - start),
+        })
+    }).collect()
+}
+
+/// Closes a usage period for every namespace each `interval_s` seconds
+///
+pub struct UsageRecorder {
+    pub interval_s: u64,
+    /// URL each period's records are POSTed to, as a JSON array
+    pub webhook: Option<String>,
+    pub metrics: Arc<Metrics>,
+    pub b32: DBMap<u32>,
+    pub b64: DBMap<u64>,
+    pub b128: DBMap<[u64; 2]>,
+    pub b256: DBMap<[u64; 4]>,
+}
+
+impl UsageRecorder {
+    pub fn spawn(self) {
+        thread::spawn(move || {
+            let client = Client::new();
+            let mut start = now_s();
+            let mut before = self.metrics.namespaces.totals();
+
+            loop {
+                thread::sleep(Duration::from_secs(self.interval_s));
+
+                let mut keys = BTreeMap::new();
+                count_keys(&self.b32, &mut keys);
+                count_keys(&self.b64, &mut keys);
+                count_keys(&self.b128, &mut keys);
+                count_keys(&self.b256, &mut keys);
+
+                let end = now_s();
+                let after = self.metrics.namespaces.totals();
+                let records = period(start, end, &before, &after, &keys);
+
+                match self.webhook {
+                    Some(ref url) if !records.is_empty() => match post(&client, url, &records) {
+                        Ok(_) => {},
+                        Err(e) => log!("WARNING: unable to send usage records to {}: {}", url, e),
+                    },
+                    _ => {},
+                }
+
+                self.metrics.usage.push(records);
+                start = end;
+                before = after;
+            }
+        });
+    }
+}
+
+/// Adds the keys held by each DB in `dbmap_mx` to `keys`, by namespace
+///
+fn count_keys<T>(dbmap_mx: &DBMap<T>, keys: &mut BTreeMap<String, u64>) {
+    // Don't hold the DB map lock while counting, so new DBs can be created
+    let dbs: Vec<((usize, String), Arc<RwLock<Box<Database<T>>>>)> = {
+        dbmap_mx.read().unwrap().iter().map(|(k, v)| (k.clone(), v.clone())).collect()
+    };
+
+    for ((_, namespace), db_mx) in dbs.into_iter() {
+        let mut count = 0;
+        match db_mx.read().unwrap().for_each(&mut |_| { count += 1; Ok(()) }) {
+            Ok(_) => { *keys.entry(namespace).or_insert(0) += count; },
+            Err(e) => log!("WARNING: unable to count keys in {}: {}", namespace, e),
+        }
+    }
+}
+
+fn post(client: &Client, url: &str, records: &[UsageRecord]) -> Result<(), String> {
+    let body = json::encode(&records.iter().map(|r| r.to_json()).collect::<Vec<Json>>()).unwrap();
+
+    let mut delay_ms = RETRY_DELAY_MS;
+    let mut result = send(client, url, &body);
+    for _ in 0..WEBHOOK_RETRIES {
+        if result.is_ok() {
+            break
+        }
+        thread::sleep(Duration::from_millis(delay_ms));
+        delay_ms *= 2;
+        result = send(client, url, &body);
+    }
+    result
+}
+
+fn send(client: &Client, url: &str, body: &str) -> Result<(), String> {
+    let mut headers = Headers::new();
+    headers.set_raw("Content-Type", vec![b"application/json".to_vec()]);
+
+    let mut res = match client.post(url).headers(headers).body(body).send() {
+        Ok(res) => res,
+        Err(e) => return Err(format!("POST {} failed: {}", url, e)),
+    };
+
+    let mut response = String::new();
+    let _ = res.read_to_string(&mut response);
+
+    match res.status {
+        status if status.is_success() => Ok(()),
+        status => Err(format!("POST {} returned {}: {}", url, status, response.trim())),
+    }
+}
+
+fn now_s() -> u64 {
+    SystemTime::now().duration_since(UNIX_EPOCH).unwrap().as_secs()
+}
+
+/// Usage records of periods ending after `since` (seconds since the epoch,
+/// 0 by default), as a JSON array or, with `format=csv`, as CSV with a
+/// header row
+///
+pub fn show(req: &mut Request) -> IronResult<Response> {
+    let since = match query_param(req, "since") {
+        Some(v) => match v.parse::<u64>() {
+            Ok(v) => v,
+            Err(e) => return Ok(Response::with((status::BadRequest, format!("invalid since '{}': {}", v, e)))),
+        },
+        None => 0,
+    };
+
+    let csv = match query_param(req, "format") {
+        None => false,
+        Some(ref v) if v == "json" => false,
+        Some(ref v) if v == "csv" => true,
+        Some(v) => return Ok(Response::with((status::BadRequest, format!("invalid format '{}', expected 'json' or 'csv'", v)))),
+    };
+
+    let metrics = req.get::<persistent::Read<MetricsKey>>().unwrap();
+    let records = metrics.usage.since(since);
+
+    let response_body = match csv {
+        true => {
+            let mut lines = vec![UsageRecord::csv_header()];
+            lines.extend(records.iter().map(|r| r.to_csv()));
+            lines.push(String::new());
+            lines.join("\n")
+        },
+        false => json::encode(&records.iter().map(|r| r.to_json()).collect::<Vec<Json>>()).unwrap(),
+    };
+
+    Ok(Response::with((status::Ok, response_body)))
+}
@@ -20,7 +20,8 @@ use hammer::db::id_map::IDMap;
 use hammer::db::map_set::MapSet;
 use hammer::db::typemap::*;
 
-use http::{Config, ConfigKey, V32, V64, V128, V256, decode_body, BASE64_CONFIG, AddResult, QueryResult, DeleteResult};
+use http::{Config, ConfigKey, V32, V64, V128, V256, decode_body, response_budget, encoded_size, ResponseBudget, BASE64_CONFIG, AddResult, QueryResult, DeleteResult};
+use http::conditional;
 
 pub fn add(req: &mut Request) -> IronResult<Response> {
     let req_body = try!(decode_body::<Vec<Vec<String>>>(req));
@@ -175,28 +176,33 @@ pub fn query(req: &mut Request) -> IronResult<Response> {
         None => return Ok(Response::with((status::BadRequest, "DB namespace is required"))),
     };
 
+    let budget = match response_budget(req) {
+        Ok(v) => v,
+        Err(e) => return Ok(Response::with((status::BadRequest, e))),
+    };
+
     match bits {
         32 => {
             let dbmap_mx = req.get::<State<V32>>().unwrap();
-            do_query(req_body, dimensions, tolerance, namespace, dbmap_mx)
+            do_query(req_body, dimensions, tolerance, namespace, budget, dbmap_mx)
         },
         64 => {
             let dbmap_mx = req.get::<State<V64>>().unwrap();
-            do_query(req_body, dimensions, tolerance, namespace, dbmap_mx)
+            do_query(req_body, dimensions, tolerance, namespace, budget, dbmap_mx)
         },
         128 => {
             let dbmap_mx = req.get::<State<V128>>().unwrap();
-            do_query(req_body, dimensions, tolerance, namespace, dbmap_mx)
+            do_query(req_body, dimensions, tolerance, namespace, budget, dbmap_mx)
         },
         256 => {
             let dbmap_mx = req.get::<State<V256>>().unwrap();
-            do_query(req_body, dimensions, tolerance, namespace, dbmap_mx)
+            do_query(req_body, dimensions, tolerance, namespace, budget, dbmap_mx)
         },
         _ => Ok(Response::with((status::BadRequest, "Unsuported bitsize"))),
     }
 }
 
-fn do_query<T>(req_body: Vec<Vec<String>>, dimensions: usize, tolerance: usize, namespace: String, dbmap_mx: Arc<RwLock<HashMap<(usize, usize, String), Arc<RwLock<Box<Database<Vec<T>>>>>>>>) -> IronResult<Response> where
+fn do_query<T>(req_body: Vec<Vec<String>>, dimensions: usize, tolerance: usize, namespace: String, mut budget: ResponseBudget, dbmap_mx: Arc<RwLock<HashMap<(usize, usize, String), Arc<RwLock<Box<Database<Vec<T>>>>>>>>) -> IronResult<Response> where
 T: Eq + Hash + Clone + Encodable + Decodable,
 {
     let mut results = Vec::with_capacity(req_body.len());
@@ -240,15 +246,24 @@ T: Eq + Hash + Clone + Encodable + Decodable,
 
                 match db.get(&vector) {
                     Some(found) => {
-                        let found_b64s: Vec<Vec<String>> = found.iter().map(|v| {
+                        let mut found_b64s: Vec<Vec<String>> = found.iter().map(|v| {
                             v.iter().map(|item| {
                                 let found_bytes = bincode::rustc_serialize::encode(item, bincode::SizeLimit::Infinite).unwrap();
 
                                 found_bytes.to_base64(BASE64_CONFIG)
                             }).collect()
                         }).collect();
+                        found_b64s.sort();
+
+                        let (found_b64s, truncated) = budget.take(found_b64s, |v: &Vec<String>| {
+                            // Brackets and separator
+                            v.iter().fold(3, |size, item| size + encoded_size(item))
+                        });
 
-                        results.push(QueryResult::Ok(found_b64s));
+                        match truncated {
+                            true => results.push(QueryResult::Detailed{matches: found_b64s, overflowed: false, truncated: true, partitions: None, diffs: None}),
+                            false => results.push(QueryResult::Ok(found_b64s)),
+                        }
                     },
                     None => {
                         results.push(QueryResult::None);
@@ -259,7 +274,7 @@ T: Eq + Hash + Clone + Encodable + Decodable,
     }
 
     let response_body = json::encode(&results.to_json()).unwrap();
-    Ok(Response::with((status::Ok, response_body)))
+    Ok(conditional::with_etag(response_body))
 }
 
 pub fn delete(req: &mut Request) -> IronResult<Response> {
@@ -0,0 +1,191 @@
+//! Per-database versions
+//!
+//! Each binary (and float) database has a version, counting the changes made
+//! to it: accepted adds and deletes, evictions and expiries.  Responses to
+//! requests on a database carry its version in `X-Hammer-Version`: for
+//! writes, the version including the write, and for reads, the version the
+//! database had when the request arrived.
+//!
+//! A standby takes the primary's versions when it copies the databases, and
+//! each change in the feed carries the version it brought its database to,
+//! so a standby reporting version N has applied the primary's changes up to
+//! N.  Versions are kept in memory and restart from 0 with the server (a
+//! standby copying from a restarted primary restarts with it).
+//!
+//! Reads can pass the version a write returned as `min_version`, and wait (up
+//! to `MAX_WAIT_MS`) until the server has reached it, so a client reading
+//! through a load balancer sees its own writes whichever server it reaches.
+//! If the server doesn't get there in time, the request fails with a 503 and
+//! can be retried elsewhere.
+
+use std::collections::{BTreeMap, HashMap};
+use std::io;
+use std::sync::{Arc, Condvar, Mutex};
+use std::time::{Duration, Instant};
+
+use iron::prelude::*;
+use iron::{status, typemap, AfterMiddleware, BeforeMiddleware};
+use rustc_serialize::json::{ToJson, Json};
+
+use http::changes::ChangeFeed;
+use http::query_param;
+use http::upgrade;
+
+/// Longest a read waits for its `min_version`
+const MAX_WAIT_MS: u64 = 5000;
+
+pub struct Versions {
+    versions: Mutex<HashMap<String, u64>>,
+    /// Notified whenever a version changes
+    changed: Condvar,
+}
+
+impl Versions {
+    pub fn new() -> Versions {
+        Versions{versions: Mutex::new(HashMap::new()), changed: Condvar::new()}
+    }
+
+    /// The version of `db`, i.e. `b/64/8/foo`
+    ///
+    pub fn get(&self, db: &str) -> u64 {
+        self.versions.lock().unwrap().get(db).cloned().unwrap_or(0)
+    }
+
+    /// Counts `count` changes to `db`; returns its new version
+    ///
+    pub fn bump(&self, db: &str, count: u64) -> u64 {
+        let mut versions = self.versions.lock().unwrap();
+        let version = {
+            let version = versions.entry(db.to_string()).or_insert(0);
+            *version += count;
+            *version
+        };
+        self.changed.notify_all();
+        version
+    }
+
+    /// Raises the version of `db` to `version`, i.e. one applied from the
+    /// primary
+    ///
+    pub fn adopt(&self, db: &str, version: u64) {
+        let mut versions = self.versions.lock().unwrap();
+        let current = versions.entry(db.to_string()).or_insert(0);
+        if version > *current {
+            *current = version;
+            self.changed.notify_all();
+        }
+    }
+
+    /// Replaces every version, i.e. with the primary's once its databases
+    /// have been copied
+    ///
+    pub fn reset(&self, versions: HashMap<String, u64>) {
+        *self.versions.lock().unwrap() = versions;
+        self.changed.notify_all();
+    }
+
+    /// Waits up to `timeout` for `db` to reach `version`; returns its version,
+    /// or its version so far as an error if it didn't get there in time
+    ///
+    pub fn wait_for(&self, db: &str, version: u64, timeout: Duration) -> Result<u64, u64> {
+        let deadline = Instant::now() + timeout;
+        let mut versions = self.versions.lock().unwrap();
+
+        loop {
+            let current = versions.get(db).cloned().unwrap_or(0);
+            if current >= version {
+                return Ok(current)
+            }
+
+            let now = Instant::now();
+            if now >= deadline {
+                return Err(current)
+            }
+            versions = self.changed.wait_timeout(versions, deadline - now).unwrap().0;
+        }
+    }
+}
+
+impl ToJson for Versions {
+    fn to_json(&self) -> Json {
+        let versions = self.versions.lock().unwrap();
+        Json::Object(versions.iter().map(|(db, version)| (db.clone(), version.to_json())).collect::<BTreeMap<String, Json>>())
+    }
+}
+
+/// The database a request is for, if any
+///
+fn db_name(req: &Request) -> Option<String> {
+    let path = &req.url.path;
+    match path.get(1).map(|s| &s[..]) {
+        Some("b") | Some("f") if path.len() >= 5 => Some(format!("b/{}/{}/{}", path[2], path[3], path[4])),
+        _ => None,
+    }
+}
+
+struct VersionSeen;
+impl typemap::Key for VersionSeen { type Value = u64; }
+
+/// Adds `X-Hammer-Version` to responses to requests on a database
+///
+#[derive(Clone)]
+pub struct VersionHeader {
+    changes: Arc<ChangeFeed>,
+}
+
+impl VersionHeader {
+    pub fn new(changes: Arc<ChangeFeed>) -> VersionHeader {
+        VersionHeader{changes: changes}
+    }
+}
+
+impl BeforeMiddleware for VersionHeader {
+    fn before(&self, req: &mut Request) -> IronResult<()> {
+        let db = match db_name(req) {
+            Some(db) => db,
+            None => return Ok(()),
+        };
+        let min_version = match query_param(req, "min_version") {
+            Some(v) => match v.parse::<u64>() {
+                Ok(v) => Some(v),
+                Err(_) => {
+                    let err = io::Error::new(io::ErrorKind::Other, "invalid min_version");
+                    return Err(IronError::new(err, (status::BadRequest, "min_version must be an integer")))
+                },
+            },
+            None => None,
+        };
+
+        let version = match min_version {
+            Some(min_version) if !upgrade::is_write(req) => {
+                match self.changes.versions().wait_for(&db, min_version, Duration::from_millis(MAX_WAIT_MS)) {
+                    Ok(version) => version,
+                    Err(version) => {
+                        let err = io::Error::new(io::ErrorKind::Other, "behind min_version");
+                        let msg = format!("{} is at version {}, and didn't reach version {} within {}ms", db, version, min_version, MAX_WAIT_MS);
+                        return Err(IronError::new(err, (status::ServiceUnavailable, msg)))
+                    },
+                }
+            },
+            _ => self.changes.versions().get(&db),
+        };
+        req.extensions.insert::<VersionSeen>(version);
+        Ok(())
+    }
+}
+
+impl AfterMiddleware for VersionHeader {
+    fn after(&self, req: &mut Request, mut res: Response) -> IronResult<Response> {
+        let db = match db_name(req) {
+            Some(db) => db,
+            None => return Ok(res),
+        };
+        let version = match (upgrade::is_write(req), req.extensions.get::<VersionSeen>()) {
+            (false, Some(&seen)) => seen,
+            _ => self.changes.versions().get(&db),
+        };
+
+        res.headers.set_raw("X-Hammer-Version", vec![version.to_string().into_bytes()]);
+        Ok(res)
+    }
+}
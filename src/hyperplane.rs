@@ -0,0 +1,188 @@
+//! Random hyperplane LSH
+//!
+//! Binarizes real-valued vectors by projecting them onto a set of random
+//! hyperplanes; bit `i` of the output is set if the vector lies on the
+//! positive side of hyperplane `i`.  The hamming distance between two outputs
+//! is proportional to the angle between the input vectors.
+//!
+//! Hyperplanes are generated deterministically from a seed, so values
+//! binarized with the same seed, dimensionality and bit width are comparable.
+
+use std::mem::size_of;
+
+use rand::{Rng, SeedableRng, XorShiftRng};
+use rand::distributions::normal::StandardNormal;
+
+/// Values which can be built from (and split into) a sequence of bits
+///
+pub trait FromBits: Sized {
+    /// Number of bits in the value
+    fn bits() -> usize;
+
+    /// Builds a value from `bits`, where `bits[i]` is dimension `i`
+    fn from_bits(bits: &[bool]) -> Self;
+
+    /// The value's bits, where `bits[i]` is dimension `i`
+    fn to_bits(&self) -> Vec<bool>;
+}
+
+macro_rules! uint_from_bits {
+    ($elem:ident) => {
+        impl FromBits for $elem {
+            fn bits() -> usize {
+                8 * size_of::<$elem>()
+            }
+
+            fn from_bits(bits: &[bool]) -> $elem {
+                bits.iter().enumerate()
+                    .filter(|&(_, b)| *b)
+                    .fold(0, |v, (i, _)| v | (1 << i))
+            }
+
+            fn to_bits(&self) -> Vec<bool> {
+                (0..<$elem as FromBits>::bits()).map(|i| (*self >> i) & 1 == 1).collect()
+            }
+        }
+    }
+}
+uint_from_bits!(u32);
+uint_from_bits!(u64);
+
+// The last element holds the least significant bits, matching `Windowable`
+macro_rules! array_from_bits {
+    ([$elem:ident; $elems:expr]) => {
+        impl FromBits for [$elem; $elems] {
+            fn bits() -> usize {
+                8 * $elems * size_of::<$elem>()
+            }
+
+            fn from_bits(bits: &[bool]) -> [$elem; $elems] {
+                let elem_bits = 8 * size_of::<$elem>();
+                let mut out = [0; $elems];
+                for (i, _) in bits.iter().enumerate().filter(|&(_, b)| *b) {
+                    out[$elems - 1 - (i / elem_bits)] |= 1 << (i % elem_bits);
+                }
+                out
+            }
+
+            fn to_bits(&self) -> Vec<bool> {
+                let elem_bits = 8 * size_of::<$elem>();
+                (0..Self::bits()).map(|i| (self[$elems - 1 - (i / elem_bits)] >> (i % elem_bits)) & 1 == 1).collect()
+            }
+        }
+    }
+}
+array_from_bits!([u64; 2]);
+array_from_bits!([u64; 4]);
+
+pub struct Hyperplanes {
+    dimensions: usize,
+    planes: Vec<Vec<f64>>,
+}
+
+impl Hyperplanes {
+    /// Generate `bits` hyperplanes over `dimensions`-dimensional vectors
+    ///
+    pub fn new(seed: u64, dimensions: usize, bits: usize) -> Hyperplanes {
+        // XorShift's algorithm is fixed, so the planes are reproducible given
+        // the seed.  The constant words keep the seed from being all zeros.
+        let mut rng = XorShiftRng::from_seed([seed as u32, (seed >> 32) as u32, 0x9E3779B9, 0x7F4A7C15]);
+
+        let planes = (0..bits).map(|_| {
+            (0..dimensions).map(|_| {
+                let StandardNormal(x) = rng.gen::<StandardNormal>();
+                x
+            }).collect()
+        }).collect();
+
+        Hyperplanes{dimensions: dimensions, planes: planes}
+    }
+
+    pub fn dimensions(&self) -> usize {
+        self.dimensions
+    }
+
+    /// Binarize `vector` into a value of type `T`
+    ///
+    /// Fails if the number of hyperplanes doesn't match `T::bits()`, or the
+    /// vector's length doesn't match the planes'
+    ///
+    pub fn binarize<T: FromBits>(&self, vector: &[f64]) -> Result<T, String> {
+        if self.planes.len() != T::bits() {
+            return Err(format!("expected {} hyperplanes for {}-bit values, not {}", T::bits(), T::bits(), self.planes.len()))
+        }
+
+        if vector.len() != self.dimensions {
+            return Err(format!("expected vector length to be {}, not {}", self.dimensions, vector.len()))
+        }
+
+        let bits: Vec<bool> = self.planes.iter().map(|plane| {
+            plane.iter().zip(vector.iter()).fold(0.0, |dot, (p, v)| dot + p * v) >= 0.0
+        }).collect();
+
+        Ok(T::from_bits(&bits))
+    }
+}
+
+#[cfg(test)]
+mod test {
+    use hyperplane::*;
+
+    #[test]
+    fn uint_from_bits() {
+        assert_eq!(u32::from_bits(&[true, false, true]), 0b101u32);
+    }
+
+    #[test]
+    fn array_from_bits() {
+        let mut bits = vec![false; 128];
+        bits[0] = true;
+        bits[65] = true;
+
+        assert_eq!(<[u64; 2]>::from_bits(&bits), [2u64, 1u64]);
+    }
+
+    #[test]
+    fn to_bits_inverts_from_bits() {
+        let mut bits = vec![false; 128];
+        bits[0] = true;
+        bits[65] = true;
+        bits[127] = true;
+
+        assert_eq!(<[u64; 2]>::from_bits(&bits).to_bits(), bits);
+        assert_eq!(&0b101u32.to_bits()[..4], &[true, false, true, false]);
+    }
+
+    #[test]
+    fn planes_are_reproducible() {
+        let a = Hyperplanes::new(42, 3, 64);
+        let b = Hyperplanes::new(42, 3, 64);
+        let v = vec![0.5, -1.0, 2.0];
+
+        assert_eq!(a.binarize::<u64>(&v), b.binarize::<u64>(&v));
+    }
+
+    #[test]
+    fn opposite_vectors_are_complements() {
+        let planes = Hyperplanes::new(7, 3, 64);
+        let a: u64 = planes.binarize(&[0.5, -1.0, 2.0]).unwrap();
+        let b: u64 = planes.binarize(&[-0.5, 1.0, -2.0]).unwrap();
+
+        assert_eq!(a, !b);
+    }
+
+    #[test]
+    fn wrong_dimensions() {
+        let planes = Hyperplanes::new(7, 3, 32);
+
+        assert!(planes.binarize::<u32>(&[1.0, 2.0]).is_err());
+    }
+
+    #[test]
+    fn wrong_bits() {
+        let planes = Hyperplanes::new(7, 3, 32);
+
+        assert!(planes.binarize::<u64>(&[1.0, 2.0, 3.0]).is_err());
+        assert!(planes.binarize::<u32>(&[1.0, 2.0, 3.0]).is_ok());
+    }
+}
@@ -1,4 +1,5 @@
-// #![feature(test)]
+#![cfg_attr(all(test, feature = "bench"), feature(test))]
+#[cfg(feature = "rocksdb")]
 extern crate rocksdb;
 extern crate bincode;
 extern crate rustc_serialize;
@@ -6,8 +7,11 @@ extern crate uuid;
 extern crate num;
 extern crate fnv;
 extern crate murmurhash3;
+extern crate rand;
+extern crate hyper;
 
 pub mod bit_matrix;
 pub mod simhash;
 pub mod minhash;
+pub mod hyperplane;
 pub mod db;